@@ -0,0 +1,142 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+var cacheOptions struct {
+	Backend    string
+	Redis      pkg.RedisOptions
+	MaxEntries int
+	DataDir    string
+	OlderThan  time.Duration
+}
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Inspect and prune the exchange stream caches",
+	Long: `Inspect and prune the caches of raw exchange stream messages replayed on
+startup, in Redis or, with --cache memory, the snapshots of the memory
+caches in data-dir/cache.
+
+Memory cache snapshots are rewritten by a running server, so they should
+only be pruned while it is stopped.`,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		applyConfig(cmd.Flags())
+		configureLogging()
+		pkg.DefaultRedisOptions = cacheOptions.Redis
+		pkg.DefaultCacheOptions.Backend = cacheOptions.Backend
+		pkg.DefaultCacheOptions.MaxEntries = cacheOptions.MaxEntries
+		pkg.DefaultCacheOptions.SnapshotDir = filepath.Join(cacheOptions.DataDir, "cache")
+		if err := pkg.DefaultCacheOptions.Validate(); err != nil {
+			log.Fatal("error: ", err)
+		}
+	},
+}
+
+var cacheInspectCmd = &cobra.Command{
+	Use:   "inspect [key]...",
+	Short: "Show the entries of the caches",
+	Long: `Show the number of entries of each cache, and when the oldest and newest
+were cached. All caches are shown if no keys are given.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "KEY\tENTRIES\tOLDEST\tNEWEST\tSPAN")
+		for _, key := range cacheKeys(args) {
+			info, err := pkg.InspectInputCache(key, pkg.NewInputCache(key))
+			if err != nil {
+				log.Fatal(fmt.Sprintf("error: %s: ", key), err)
+			}
+			if info.Entries == 0 {
+				fmt.Fprintf(writer, "%s\t0\t-\t-\t-\n", key)
+				continue
+			}
+			fmt.Fprintf(writer, "%s\t%d\t%s\t%s\t%v\n", key, info.Entries,
+				info.Oldest.Format(time.RFC3339), info.Newest.Format(time.RFC3339),
+				info.Newest.Sub(info.Oldest))
+		}
+		writer.Flush()
+	},
+}
+
+var cachePruneCmd = &cobra.Command{
+	Use:   "prune [key]...",
+	Short: "Remove old entries from the caches",
+	Long: `Remove the entries cached longer ago than --older-than from each cache,
+all caches if no keys are given. An --older-than of 0 empties the caches.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cutoff := time.Now().Add(-cacheOptions.OlderThan)
+		for _, key := range cacheKeys(args) {
+			cache := pkg.NewInputCache(key)
+			if err := cache.Ping(); err != nil {
+				log.Fatal(fmt.Sprintf("error: %s: ", key), err)
+			}
+			pruned, err := pkg.PruneInputCache(cache, cutoff)
+			if err != nil {
+				log.Fatal(fmt.Sprintf("error: %s: failed to prune: ", key), err)
+			}
+			log.Printf("%s: pruned %d entries\n", key, pruned)
+		}
+	},
+}
+
+// cacheKeys returns keys, or the keys of all caches if empty.
+func cacheKeys(keys []string) []string {
+	if len(keys) > 0 {
+		return keys
+	}
+	keys, err := pkg.InputCacheKeys()
+	if err != nil {
+		log.Fatal("error: failed to list caches: ", err)
+	}
+	return keys
+}
+
+func init() {
+	rootCmd.AddCommand(cacheCmd)
+	cacheCmd.AddCommand(cacheInspectCmd)
+	cacheCmd.AddCommand(cachePruneCmd)
+
+	flags := cacheCmd.PersistentFlags()
+	flags.StringVar(&cacheOptions.Backend, "cache", pkg.DefaultCacheOptions.Backend,
+		"Cache backend: redis, or memory for the memory cache snapshots")
+	flags.StringVar(&cacheOptions.Redis.Address, "redis-addr", pkg.DefaultRedisOptions.Address,
+		"Redis address")
+	flags.StringVar(&cacheOptions.Redis.Password, "redis-password", "",
+		"Redis password")
+	flags.IntVar(&cacheOptions.Redis.DB, "redis-db", 0,
+		"Redis database number")
+	flags.DurationVar(&cacheOptions.Redis.Retention, "redis-retention",
+		pkg.DefaultRedisOptions.Retention,
+		"How long cached trades are kept, memory cache entries older are not loaded")
+	flags.IntVar(&cacheOptions.MaxEntries, "cache-max-entries", pkg.DefaultCacheOptions.MaxEntries,
+		"Maximum entries loaded per memory cache")
+	flags.StringVar(&cacheOptions.DataDir, "data-dir", "data",
+		"Data directory of the memory cache snapshots")
+
+	cachePruneCmd.Flags().DurationVar(&cacheOptions.OlderThan, "older-than",
+		pkg.DefaultRedisOptions.Retention,
+		"Remove entries cached longer ago than this")
+}
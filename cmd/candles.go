@@ -0,0 +1,152 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/candles"
+	"gitlab.com/crankykernel/cryptoxscanner/server"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var importCandlesOptions struct {
+	DataDir   string
+	Exchange  string
+	Symbol    string
+	Interval  string
+	AllowGaps bool
+}
+
+var importCandlesCmd = &cobra.Command{
+	Use:   "import-candles <file>...",
+	Short: "Import historical candles from kline files",
+	Long: `Import historical candles from kline CSV or JSON lines files, such as
+the Binance data dumps. The candles are loaded into the candle builder on
+startup so long period indicators are available immediately.
+
+The symbol and interval are taken from file names of the form
+SYMBOL-INTERVAL-*.csv, as used by the Binance data dumps, unless given with
+--symbol and --interval. Files ending in .jsonl or .json are read as JSON
+lines, all others as CSV.
+
+Candles must be aligned to the interval without duplicates. Missing candles
+are an error unless --allow-gaps is given.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		type seriesKey struct {
+			symbol   string
+			interval time.Duration
+		}
+		series := map[seriesKey][]candles.Candle{}
+
+		for _, filename := range args {
+			symbol, interval, err := importCandlesSeries(filename)
+			if err != nil {
+				log.Fatal("error: ", err)
+			}
+			loaded, err := readCandleFile(filename, symbol, interval)
+			if err != nil {
+				log.Fatal(fmt.Sprintf("error: %s: ", filename), err)
+			}
+			key := seriesKey{symbol, interval}
+			series[key] = append(series[key], loaded...)
+		}
+
+		store := candles.NewHistoryStore(server.CandleHistoryDir(
+			importCandlesOptions.DataDir, importCandlesOptions.Exchange))
+		for key, imported := range series {
+			name := fmt.Sprintf("%s %s", key.symbol, candles.FormatInterval(key.interval))
+			candles.SortCandles(imported)
+			gaps, err := candles.CheckContinuity(imported, key.interval)
+			if err != nil {
+				log.Fatal(fmt.Sprintf("error: %s: ", name), err)
+			}
+			for _, gap := range gaps {
+				log.Printf("%s: missing candles %v\n", name, gap)
+			}
+			if len(gaps) > 0 && !importCandlesOptions.AllowGaps {
+				log.Fatal(fmt.Sprintf("error: %s: ", name),
+					fmt.Sprintf("%d gaps found, use --allow-gaps to import anyway", len(gaps)))
+			}
+			merged, err := store.Write(key.symbol, key.interval, imported)
+			if err != nil {
+				log.Fatal(fmt.Sprintf("error: %s: ", name), err)
+			}
+			log.Printf("%s: imported %d candles, %d stored\n", name,
+				len(imported), len(merged))
+		}
+	},
+}
+
+// importCandlesSeries returns the symbol and interval of a kline file from
+// the flags, or from the file name if not set.
+func importCandlesSeries(filename string) (string, time.Duration, error) {
+	symbol := strings.ToUpper(importCandlesOptions.Symbol)
+	intervalName := importCandlesOptions.Interval
+	parts := strings.Split(filepath.Base(filename), "-")
+	if symbol == "" {
+		if len(parts) < 2 {
+			return "", 0, fmt.Errorf("%s: cannot determine symbol, use --symbol", filename)
+		}
+		symbol = strings.ToUpper(parts[0])
+	}
+	if intervalName == "" {
+		if len(parts) < 2 {
+			return "", 0, fmt.Errorf("%s: cannot determine interval, use --interval", filename)
+		}
+		intervalName = parts[1]
+	}
+	interval, err := candles.ParseInterval(intervalName)
+	if err != nil {
+		return "", 0, fmt.Errorf("%s: %v", filename, err)
+	}
+	return symbol, interval, nil
+}
+
+func readCandleFile(filename string, symbol string, interval time.Duration) ([]candles.Candle, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	switch filepath.Ext(filename) {
+	case ".jsonl", ".json":
+		return candles.ReadKlineJSONL(file, symbol, interval)
+	default:
+		return candles.ReadKlineCSV(file, symbol, interval)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(importCandlesCmd)
+
+	flags := importCandlesCmd.Flags()
+	flags.StringVar(&importCandlesOptions.DataDir, "data-dir", "data",
+		"Data directory")
+	flags.StringVar(&importCandlesOptions.Exchange, "exchange", "binance",
+		"Exchange the candles are for")
+	flags.StringVar(&importCandlesOptions.Symbol, "symbol", "",
+		"Symbol of the candles (default from file name)")
+	flags.StringVar(&importCandlesOptions.Interval, "interval", "",
+		"Interval of the candles, such as 1m or 1d (default from file name)")
+	flags.BoolVar(&importCandlesOptions.AllowGaps, "allow-gaps", false,
+		"Import candles even if some are missing")
+}
@@ -0,0 +1,106 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/events"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/sandbox"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/source"
+	"gitlab.com/crankykernel/cryptoxscanner/server"
+	"io"
+	"os"
+)
+
+var replayOptions struct {
+	Exchange string
+}
+
+var replayCmd = &cobra.Command{
+	Use:   "replay <file>",
+	Short: "Detect the events of recorded trades",
+	Long: `Replay the trades of a CSV file through the candle builder and event
+detector, without running the server, and print each event detected as a
+line of JSON. The file has the columns timestamp,symbol,price,quantity,side
+and an optional id, as for csv sources.
+
+Events are detected with the whales, anomaly, activity and liquidations
+configuration of the exchange given with --exchange.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var options server.Options
+		if err := viper.UnmarshalKey("whales", &options.Whales); err != nil {
+			log.Fatal("error: invalid whale configuration: ", err)
+		}
+		if err := viper.UnmarshalKey("anomaly", &options.Anomaly); err != nil {
+			log.Fatal("error: invalid anomaly configuration: ", err)
+		}
+		if err := viper.UnmarshalKey("activity", &options.Activity); err != nil {
+			log.Fatal("error: invalid activity configuration: ", err)
+		}
+		if err := viper.UnmarshalKey("liquidations", &options.Liquidations); err != nil {
+			log.Fatal("error: invalid liquidation configuration: ", err)
+		}
+
+		file, err := os.Open(args[0])
+		if err != nil {
+			log.Fatal("error: ", err)
+		}
+		defer file.Close()
+		reader := source.NewCSVReader(file)
+
+		encoder := json.NewEncoder(os.Stdout)
+		detected := 0
+		replayed, err := sandbox.Detect(context.Background(),
+			func(fn func(trade pkg.CommonTrade) error) error {
+				for {
+					trade, err := reader.Next()
+					if err == io.EOF {
+						return nil
+					}
+					if err != nil {
+						return err
+					}
+					if err := fn(trade); err != nil {
+						return err
+					}
+				}
+			},
+			sandbox.Options{
+				Exchange: replayOptions.Exchange,
+				Detector: server.ExchangeDetectorOptions(options, replayOptions.Exchange),
+			},
+			func(event events.Event) {
+				detected++
+				encoder.Encode(event)
+			})
+		if err != nil {
+			log.Fatal("error: replay failed: ", err)
+		}
+		log.Printf("Replayed %d trades, detected %d events\n", replayed, detected)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(replayCmd)
+	replayCmd.Flags().StringVar(&replayOptions.Exchange, "exchange", "binance",
+		"Exchange the trades are from, for its detector configuration")
+}
@@ -18,16 +18,29 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
 )
 
+// The prefix of environment variables, such as CRYPTOXSCANNER_PORT.
+const envPrefix = "CRYPTOXSCANNER"
+
 var cfgFile string
 
+// Override the log level and format of the config.
+var logConfig log.Config
+
 var rootCmd = &cobra.Command{
-	Use:   "cryptoxscanner",
+	Use: "cryptoxscanner",
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		applyConfig(cmd.Flags())
+		configureLogging()
+	},
 }
 
 func Execute() {
@@ -40,7 +53,11 @@ func Execute() {
 func init() {
 	cobra.OnInitialize(initConfig)
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "",
-		"config file (default is $HOME/.cryptoxscanner.yaml)")
+		"config file, YAML, TOML or JSON (default is .cryptoxscanner.yaml in the current or home directory)")
+	rootCmd.PersistentFlags().StringVar(&logConfig.Level, "log-level", "",
+		"Log messages at or above this level: debug, info, warn or error (default info)")
+	rootCmd.PersistentFlags().StringVar(&logConfig.Format, "log-format", "",
+		"Log format, text or json (default text)")
 	rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 }
 
@@ -55,13 +72,54 @@ func initConfig() {
 			os.Exit(1)
 		}
 
+		viper.AddConfigPath(".")
 		viper.AddConfigPath(home)
-		viper.SetConfigName(".tokenfx")
+		viper.SetConfigName(".cryptoxscanner")
 	}
 
+	viper.SetEnvPrefix(envPrefix)
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_", ".", "_"))
 	viper.AutomaticEnv()
 
 	if err := viper.ReadInConfig(); err == nil {
 		fmt.Println("Using config file:", viper.ConfigFileUsed())
+	} else if _, ok := err.(viper.ConfigFileNotFoundError); !ok || cfgFile != "" {
+		fmt.Println("Failed to read config file:", err)
+		os.Exit(1)
+	}
+}
+
+// applyConfig sets each flag not given on the command line from the config
+// file, using the flag name as the key, or from the environment as
+// CRYPTOXSCANNER_<NAME> with dashes replaced by underscores. Flags keep their
+// defaults otherwise.
+func applyConfig(flags *pflag.FlagSet) {
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if flag.Changed || !viper.IsSet(flag.Name) {
+			return
+		}
+		value := viper.GetString(flag.Name)
+		if strings.HasSuffix(flag.Value.Type(), "Slice") {
+			value = strings.Join(viper.GetStringSlice(flag.Name), ",")
+		}
+		if err := flags.Set(flag.Name, value); err != nil {
+			fmt.Printf("Invalid value for %s: %v\n", flag.Name, err)
+			os.Exit(1)
+		}
+	})
+}
+
+// configureLogging sets up the log from the log section of the config, with
+// the level and format overridden by the flags.
+func configureLogging() {
+	var config log.Config
+	if err := viper.UnmarshalKey("log", &config); err != nil {
+		fmt.Println("Invalid log configuration:", err)
+		os.Exit(1)
+	}
+	config = log.DefaultConfig.Override(config).Override(logConfig)
+	if err := log.Configure(config); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
 }
@@ -17,7 +17,14 @@ package cmd
 
 import (
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 	"gitlab.com/crankykernel/cryptoxscanner/server"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/binance"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/recorder"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/replay"
+	"time"
 )
 
 var options server.Options
@@ -25,6 +32,69 @@ var options server.Options
 var binanceCmd = &cobra.Command{
 	Use: "server",
 	Run: func(cmd *cobra.Command, args []string) {
+		options.SymbolAliases = viper.GetStringMapString("symbols.aliases")
+		options.HiddenSymbols = viper.GetStringSlice("symbols.hidden")
+		if err := viper.UnmarshalKey("auth", &options.Auth); err != nil {
+			log.Fatal("error: invalid auth configuration: ", err)
+		}
+		if err := viper.UnmarshalKey("security", &options.IPPolicy); err != nil {
+			log.Fatal("error: invalid security configuration: ", err)
+		}
+		if err := viper.UnmarshalKey("sources", &options.Sources); err != nil {
+			log.Fatal("error: invalid sources configuration: ", err)
+		}
+		if err := viper.UnmarshalKey("anomaly", &options.Anomaly); err != nil {
+			log.Fatal("error: invalid anomaly configuration: ", err)
+		}
+		options.Endpoints = viper.GetStringMapString("endpoints")
+		if err := viper.UnmarshalKey("whales", &options.Whales); err != nil {
+			log.Fatal("error: invalid whale configuration: ", err)
+		}
+		if err := viper.UnmarshalKey("billing", &options.Billing); err != nil {
+			log.Fatal("error: invalid billing configuration: ", err)
+		}
+		if err := viper.UnmarshalKey("activity", &options.Activity); err != nil {
+			log.Fatal("error: invalid activity configuration: ", err)
+		}
+		if err := viper.UnmarshalKey("liquidations", &options.Liquidations); err != nil {
+			log.Fatal("error: invalid liquidation configuration: ", err)
+		}
+		if err := viper.UnmarshalKey("archive", &options.Archive); err != nil {
+			log.Fatal("error: invalid archive configuration: ", err)
+		}
+		if err := viper.UnmarshalKey("publish", &options.Publish); err != nil {
+			log.Fatal("error: invalid publish configuration: ", err)
+		}
+		if err := viper.UnmarshalKey("symbol_filters", &options.SymbolFilters); err != nil {
+			log.Fatal("error: invalid symbol filter configuration: ", err)
+		}
+		if err := viper.UnmarshalKey("spread", &options.Spread); err != nil {
+			log.Fatal("error: invalid spread configuration: ", err)
+		}
+		if err := viper.UnmarshalKey("volume_share", &options.VolumeShare); err != nil {
+			log.Fatal("error: invalid volume share configuration: ", err)
+		}
+		if err := viper.UnmarshalKey("prelisting", &options.Prelisting); err != nil {
+			log.Fatal("error: invalid pre-listing configuration: ", err)
+		}
+		if err := viper.UnmarshalKey("tape", &options.Tape); err != nil {
+			log.Fatal("error: invalid tape configuration: ", err)
+		}
+		if err := viper.UnmarshalKey("symbol_refresh", &options.SymbolRefresh); err != nil {
+			log.Fatal("error: invalid symbol refresh configuration: ", err)
+		}
+		if err := viper.UnmarshalKey("assets", &options.Assets); err != nil {
+			log.Fatal("error: invalid asset metadata configuration: ", err)
+		}
+		if err := viper.UnmarshalKey("metric_webhooks", &options.MetricWebhooks); err != nil {
+			log.Fatal("error: invalid metric webhooks configuration: ", err)
+		}
+		if err := viper.UnmarshalKey("workers", &options.Workers); err != nil {
+			log.Fatal("error: invalid workers configuration: ", err)
+		}
+		if err := viper.UnmarshalKey("volume_floor", &options.VolumeFloor); err != nil {
+			log.Fatal("error: invalid volume floor configuration: ", err)
+		}
 		server.ServerMain(options)
 	},
 }
@@ -34,4 +104,125 @@ func init() {
 
 	flags := binanceCmd.Flags()
 	flags.Uint16VarP(&options.Port, "port", "p", 6035, "Port to listen on")
+	flags.StringVar(&options.ListenAddress, "listen", "",
+		"Address to listen on, all addresses if empty")
+	flags.StringVar(&options.BasePath, "base-path", "",
+		"Path prefix to serve under, for proxies that forward the path unchanged")
+	flags.StringVar(&options.TLSCert, "tls-cert", "", "TLS certificate file")
+	flags.StringVar(&options.TLSKey, "tls-key", "", "TLS key file")
+	flags.StringSliceVar(&options.AutocertDomains, "autocert-domains", nil,
+		"Domains to obtain TLS certificates for from Let's Encrypt")
+	flags.StringVar(&options.AutocertEmail, "autocert-email", "",
+		"Contact email for Let's Encrypt")
+	flags.StringVar(&options.AutocertCacheDir, "autocert-cache-dir", "",
+		"Directory to cache certificates in (default data-dir/autocert)")
+	flags.StringVar(&options.AutocertHTTPListen, "autocert-http-listen", ":80",
+		"Address to answer Let's Encrypt HTTP challenges on, empty to disable")
+	flags.BoolVar(&options.IPPolicy.TrustProxy, "trust-proxy", false,
+		"Use the x-forwarded-for and x-real-ip headers for the client address")
+	flags.StringVar(&options.Mode, "mode", server.ModeFull,
+		"Startup mode: full, or lite to disable depth books, indicators and persistence")
+	flags.StringSliceVar(&options.Exchanges, "exchanges", server.DefaultExchanges,
+		"Built in exchanges to run")
+	flags.StringVar(&options.Redis.Address, "redis-addr", pkg.DefaultRedisOptions.Address,
+		"Redis address for caching the exchange streams")
+	flags.StringVar(&options.Redis.Password, "redis-password", "",
+		"Redis password")
+	flags.IntVar(&options.Redis.DB, "redis-db", 0,
+		"Redis database number")
+	flags.DurationVar(&options.Redis.Retention, "redis-retention",
+		pkg.DefaultRedisOptions.Retention,
+		"How long cached trades are kept for replay on restart")
+	flags.StringVar(&options.Cache.Backend, "cache", pkg.DefaultCacheOptions.Backend,
+		"Cache backend for the exchange streams: redis, or memory for an in-memory ring buffer")
+	flags.IntVar(&options.Cache.MaxEntries, "cache-max-entries", pkg.DefaultCacheOptions.MaxEntries,
+		"Maximum entries kept per stream by the memory cache")
+	flags.DurationVar(&options.Cache.SnapshotInterval, "cache-snapshot-interval",
+		pkg.DefaultCacheOptions.SnapshotInterval,
+		"How often the memory cache is snapshotted to data-dir/cache for restore on restart (0 to disable)")
+	flags.IntVar(&options.BackfillHours, "backfill-hours", 1,
+		"Hours of trade history to backfill from the exchange on startup (0 to disable)")
+	flags.IntVar(&options.BinanceStreamsPerConnection, "binance-streams-per-connection",
+		binance.DefaultStreamsPerConnection,
+		"Binance trade streams subscribed to per websocket connection")
+	flags.StringVar(&options.DataDir, "data-dir", "data",
+		"Directory for persistent data")
+	flags.BoolVar(&options.Journal, "journal", false,
+		"Journal the trade streams to the data directory")
+	flags.IntVar(&options.JournalRetentionHours, "journal-retention-hours", 72,
+		"Hours of journal to keep (0 to keep all)")
+	flags.BoolVar(&options.Record, "record", false,
+		"Record every raw stream message to the data directory")
+	flags.DurationVar(&options.RecordRotate, "record-rotate",
+		recorder.DefaultOptions.RotateInterval,
+		"How often a new raw recording file is started")
+	flags.DurationVar(&options.RecordRetention, "record-retention", 7*24*time.Hour,
+		"How long to keep raw recordings (0 to keep all)")
+	flags.DurationVar(&options.EventRetention, "event-retention", 24*time.Hour,
+		"How long to keep events in memory")
+	flags.DurationVar(&options.AllowedLateness, "allowed-lateness",
+		pkg.DefaultAllowedLateness,
+		"How late a trade or ticker may arrive and still be included in the metrics")
+	flags.IntVar(&options.DedupWindow, "dedup-window", pkg.DefaultDedupWindow,
+		"Trade IDs remembered per symbol to drop duplicate trades (0 to disable)")
+	flags.StringVar(&options.DatabaseDriver, "db-driver", "sqlite3",
+		"Database driver for trade, candle and event persistence: sqlite3 or postgres")
+	flags.StringVar(&options.DatabaseDSN, "db-dsn", "",
+		"Database to persist trades, candles and events to (empty to disable)")
+	flags.DurationVar(&options.DatabaseTradeRetention, "db-trade-retention",
+		7*24*time.Hour, "How long to keep persisted trades (0 to keep all)")
+	flags.DurationVar(&options.DatabaseCandleRetention, "db-candle-retention",
+		90*24*time.Hour, "How long to keep persisted candles (0 to keep all)")
+	flags.DurationVar(&options.DatabaseEventRetention, "db-event-retention",
+		30*24*time.Hour, "How long to keep persisted events (0 to keep all)")
+	flags.IntVar(&options.FloodGuard.MaxConnectionsPerIP, "ws-max-connections-per-ip",
+		server.DefaultFloodGuardOptions.MaxConnectionsPerIP,
+		"Maximum concurrent websocket connections per IP (0 for no limit)")
+	flags.IntVar(&options.FloodGuard.MaxSubscriptionsPerMinute, "ws-max-subscriptions-per-minute",
+		server.DefaultFloodGuardOptions.MaxSubscriptionsPerMinute,
+		"Maximum new websocket subscriptions per IP per minute (0 for no limit)")
+	flags.Int64Var(&options.FloodGuard.MaxMessageSize, "ws-max-message-size",
+		server.DefaultFloodGuardOptions.MaxMessageSize,
+		"Maximum size in bytes of a message from a websocket client (0 for no limit)")
+	flags.IntVar(&options.WebSocketQueueSize, "ws-queue-size",
+		server.DefaultWebSocketQueueOptions.Size,
+		"Messages queued per websocket client before the slow consumer policy applies")
+	flags.StringVar(&options.WebSocketSlowConsumer, "ws-slow-consumer",
+		string(server.DefaultWebSocketQueueOptions.Policy),
+		"What to do with websocket clients that fall behind: drop or disconnect")
+	flags.DurationVar(&options.ClientMemoryTTL, "client-memory-ttl", 30*24*time.Hour,
+		"How long the topic subscriptions of websocket clients with a client_id are remembered (0 to disable)")
+	flags.DurationVar(&options.ShutdownDrain, "shutdown-drain", 5*time.Second,
+		"Time websocket clients are given to disconnect after the drain notice on shutdown (0 to close immediately)")
+	flags.DurationVar(&options.DrainRetryAfter, "drain-retry-after", 15*time.Second,
+		"When websocket clients are told to reconnect after a drain notice")
+	flags.DurationVar(&options.HealthStaleAfter, "health-stale-after", server.DefaultHealthStaleAfter,
+		"How long an exchange stream may be down or silent before /healthz fails (0 to disable)")
+	flags.DurationVar(&options.ReconnectMaxDelay, "reconnect-max-delay",
+		pkg.DefaultBackoffOptions.Max,
+		"Maximum delay between exchange stream reconnection attempts")
+	flags.DurationVar(&options.LatencyProbeInterval, "latency-probe-interval", 10*time.Minute,
+		"How often to probe exchange stream endpoints for the fastest (0 for startup only)")
+	flags.DurationVar(&options.RulesPollInterval, "rules-poll-interval", 10*time.Minute,
+		"How often exchange trading rules are checked for changes (0 to disable)")
+	flags.StringVar(&options.Replay, "replay", "",
+		"Replay recorded trades in place of the live exchange streams at this speed, such as 1x, 10x or max")
+	flags.StringVar(&options.ReplaySource, "replay-source", replay.FromJournal,
+		"Where recorded trades are replayed from: journal or database")
+	flags.StringVar(&options.ReplayFrom, "replay-from", "",
+		"Start of the replay as Unix milliseconds or RFC3339 (default all recorded)")
+	flags.StringVar(&options.ReplayTo, "replay-to", "",
+		"End of the replay as Unix milliseconds or RFC3339 (default now)")
+	flags.BoolVar(&options.ReplayRebase, "replay-rebase", true,
+		"Shift replayed trades to the current time so they are treated as live")
+	flags.IntVar(&options.ReconnectMaxRetries, "reconnect-max-retries", 0,
+		"Consecutive failed reconnections before a stream gives up (0 for no limit)")
+	flags.StringVar(&options.FixListen, "fix-listen", "",
+		"Address to accept FIX 4.4 market data sessions on, such as :9878")
+	flags.StringVar(&options.FixCompID, "fix-comp-id", "CRYPTOXSCANNER",
+		"FIX SenderCompID used when accepting sessions")
+	flags.StringVar(&options.AlertsConfig, "alerts-config", "",
+		"Alert rules file (YAML, JSON or TOML), reloaded on change")
+	flags.BoolVar(&options.DryRun, "dry-run", false,
+		"Record alerts as events without delivering them, for tuning thresholds")
 }
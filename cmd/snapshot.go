@@ -0,0 +1,123 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/snapshot"
+	"os"
+)
+
+var snapshotOptions struct {
+	DataDir      string
+	AlertsConfig string
+	Output       string
+	ConfigFile   string
+	Force        bool
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the scanner state to an archive",
+	Long: `Export the data directory, alert rules and config file to a single
+archive. The archive may contain secrets from the config file. The server
+must be stopped first.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if _, err := os.Stat(snapshotOptions.DataDir); err == nil {
+			defer lockDataDir().Unlock()
+		}
+		file, err := os.OpenFile(snapshotOptions.Output,
+			os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			log.Fatal("error: ", err)
+		}
+		manifest, err := snapshot.Export(file, []snapshot.Entry{
+			{Name: "data", Path: snapshotOptions.DataDir},
+			{Name: "alerts", Path: snapshotOptions.AlertsConfig},
+			{Name: "config", Path: viper.ConfigFileUsed()},
+		})
+		if err == nil {
+			err = file.Close()
+		}
+		if err != nil {
+			os.Remove(snapshotOptions.Output)
+			log.Fatal("error: export failed: ", err)
+		}
+		for _, entry := range manifest.Entries {
+			log.Printf("Exported %s from %s\n", entry.Name, entry.Path)
+		}
+		log.Printf("Wrote %s\n", snapshotOptions.Output)
+	},
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import <archive>",
+	Short: "Import the scanner state from an archive",
+	Long: `Import an archive created with export. Entries are restored to the
+paths given by the flags, entries without a path are skipped. Existing files
+are not replaced unless --force is given. The server must be stopped first.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		defer lockDataDir().Unlock()
+		file, err := os.Open(args[0])
+		if err != nil {
+			log.Fatal("error: ", err)
+		}
+		defer file.Close()
+		_, err = snapshot.Import(file, map[string]string{
+			"data":   snapshotOptions.DataDir,
+			"alerts": snapshotOptions.AlertsConfig,
+			"config": snapshotOptions.ConfigFile,
+		}, snapshotOptions.Force)
+		if err != nil {
+			log.Fatal("error: import failed: ", err)
+		}
+	},
+}
+
+// lockDataDir locks the data directory so it is not exported or imported
+// while a server is writing to it.
+func lockDataDir() *snapshot.DirLock {
+	lock, err := snapshot.LockDir(snapshotOptions.DataDir)
+	if err == snapshot.ErrInUse {
+		log.Fatal("error: ", snapshotOptions.DataDir, ": ", err, ", stop it first")
+	} else if err != nil {
+		log.Fatal("error: ", err)
+	}
+	return lock
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+	rootCmd.AddCommand(importCmd)
+
+	for _, cmd := range []*cobra.Command{exportCmd, importCmd} {
+		flags := cmd.Flags()
+		flags.StringVar(&snapshotOptions.DataDir, "data-dir", "data",
+			"Data directory")
+		flags.StringVar(&snapshotOptions.AlertsConfig, "alerts-config", "",
+			"Alert rules file")
+	}
+	exportCmd.Flags().StringVarP(&snapshotOptions.Output, "output", "o",
+		"cryptoxscanner-snapshot.tar.gz", "Archive to write")
+	importCmd.Flags().StringVar(&snapshotOptions.ConfigFile, "config-out", "",
+		"Where to restore the config file (skipped if not set)")
+	importCmd.Flags().BoolVar(&snapshotOptions.Force, "force", false,
+		"Replace existing files")
+}
@@ -0,0 +1,107 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/server"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+var symbolsOptions struct {
+	Exchange   string
+	Unfiltered bool
+}
+
+var symbolsCmd = &cobra.Command{
+	Use:   "symbols",
+	Short: "Show the symbols of the exchanges",
+}
+
+var symbolsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the symbols trading on an exchange",
+	Long: `List the symbols currently trading on an exchange, from its REST API, with
+the symbol filter, aliases and hidden symbols of the configuration applied
+as the server would. Hidden symbols are listed, marked as hidden.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		// The streams of the exchange are not run, so there is nothing
+		// to cache.
+		pkg.DefaultCacheOptions.Backend = pkg.CacheBackendMemory
+		pkg.DefaultCacheOptions.SnapshotDir = ""
+
+		name := strings.ToLower(symbolsOptions.Exchange)
+		exchange := server.NewBuiltinExchange(name)
+		if exchange == nil {
+			log.Fatal("error: unknown exchange: ", symbolsOptions.Exchange)
+		}
+		if !symbolsOptions.Unfiltered {
+			var filters map[string]pkg.SymbolFilterConfig
+			if err := viper.UnmarshalKey("symbol_filters", &filters); err != nil {
+				log.Fatal("error: invalid symbol filter configuration: ", err)
+			}
+			config := filters["default"].Override(filters[name])
+			if !config.IsEmpty() {
+				filter, err := pkg.NewSymbolFilter(config)
+				if err != nil {
+					log.Fatal(fmt.Sprintf("error: %s: invalid symbol filter: ", name), err)
+				}
+				exchange.TradeStream().SetSymbolFilter(filter)
+			}
+		}
+
+		registry := pkg.NewSymbolRegistry()
+		for key, alias := range viper.GetStringMapString("symbols.aliases") {
+			registry.SetAlias(key, alias)
+		}
+		for _, key := range viper.GetStringSlice("symbols.hidden") {
+			registry.Hide(key)
+		}
+
+		symbols, err := exchange.GetSymbols()
+		if err != nil {
+			log.Fatal(fmt.Sprintf("error: %s: failed to get symbols: ", name), err)
+		}
+		sort.Strings(symbols)
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "SYMBOL\tALIAS\tHIDDEN\tCLASSES")
+		for _, symbol := range symbols {
+			fmt.Fprintf(writer, "%s\t%s\t%v\t%s\n", symbol,
+				registry.Alias(name, symbol), registry.IsHidden(name, symbol),
+				strings.Join(pkg.ClassifySymbol(symbol), ","))
+		}
+		writer.Flush()
+		log.Printf("%s: %d symbols\n", name, len(symbols))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(symbolsCmd)
+	symbolsCmd.AddCommand(symbolsListCmd)
+	flags := symbolsListCmd.Flags()
+	flags.StringVar(&symbolsOptions.Exchange, "exchange", "binance",
+		"Built in exchange to list the symbols of")
+	flags.BoolVar(&symbolsOptions.Unfiltered, "unfiltered", false,
+		"List all symbols, ignoring the configured symbol filter")
+}
@@ -13,15 +13,25 @@
 // You should have received a copy of the GNU Affero General Public License
 // along with this program. If not, see <http://www.gnu.org/licenses/>.
 
+// Package log logs leveled messages with fields through logrus. Each
+// message is tagged with the module it was logged from, the package of the
+// caller such as binance or server, and the level of each module can be set
+// so a noisy module can be quietened without losing the others.
+//
+// Messages logged with Printf take their level from the prefix of the
+// format, "error: " for errors and "warning: " for warnings, otherwise info.
 package log
 
 import (
-	"github.com/sirupsen/logrus"
-	"runtime"
 	"fmt"
-	"path/filepath"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh/terminal"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Fields = logrus.Fields
@@ -31,16 +41,104 @@ type LogLevel = logrus.Level
 const (
 	LogLevelDebug LogLevel = logrus.DebugLevel
 	LogLevelInfo  LogLevel = logrus.InfoLevel
+	LogLevelWarn  LogLevel = logrus.WarnLevel
+	LogLevelError LogLevel = logrus.ErrorLevel
 )
 
-var logLevel = LogLevelInfo
+const (
+	FormatText = "text"
+	FormatJson = "json"
+)
+
+type Config struct {
+	// The level messages are logged at or above: debug, info, warn or
+	// error.
+	Level string `mapstructure:"level"`
+
+	// The format of the log, text or json.
+	Format string `mapstructure:"format"`
+
+	// The level of each module, by package name such as binance or
+	// server, in place of Level.
+	Modules map[string]string `mapstructure:"modules"`
+
+	// Messages logged through a limited logger are logged at most once
+	// per interval from each line, with a count of those suppressed.
+	RepeatInterval time.Duration `mapstructure:"repeat_interval"`
+}
+
+var DefaultConfig = Config{
+	Level:          "info",
+	Format:         FormatText,
+	RepeatInterval: time.Minute,
+}
+
+// Override returns c with the fields that are set in override replaced.
+// Module levels are merged.
+func (c Config) Override(override Config) Config {
+	if override.Level != "" {
+		c.Level = override.Level
+	}
+	if override.Format != "" {
+		c.Format = override.Format
+	}
+	if len(override.Modules) > 0 {
+		modules := map[string]string{}
+		for module, level := range c.Modules {
+			modules[module] = level
+		}
+		for module, level := range override.Modules {
+			modules[module] = level
+		}
+		c.Modules = modules
+	}
+	if override.RepeatInterval != 0 {
+		c.RepeatInterval = override.RepeatInterval
+	}
+	return c
+}
+
+func (c Config) Validate() error {
+	if _, err := logrus.ParseLevel(c.Level); err != nil {
+		return fmt.Errorf("invalid log level: %s", c.Level)
+	}
+	if c.Format != FormatText && c.Format != FormatJson {
+		return fmt.Errorf("invalid log format: %s", c.Format)
+	}
+	for module, level := range c.Modules {
+		if _, err := logrus.ParseLevel(level); err != nil {
+			return fmt.Errorf("invalid log level for module %s: %s", module, level)
+		}
+	}
+	if c.RepeatInterval < 0 {
+		return fmt.Errorf("log repeat interval must not be negative")
+	}
+	return nil
+}
+
+// The configured levels. Messages are filtered here, logrus logs every
+// level.
+var levels = struct {
+	sync.RWMutex
+	level          LogLevel
+	modules        map[string]LogLevel
+	repeatInterval time.Duration
+}{
+	level:          LogLevelInfo,
+	modules:        map[string]LogLevel{},
+	repeatInterval: DefaultConfig.RepeatInterval,
+}
+
+// The field the source file and line of a message is logged as. Sorted
+// first by the text formatter.
+var sourceKey = "_source"
 
 func init() {
 	formatter := logrus.TextFormatter{}
 	formatter.DisableTimestamp = false
 	formatter.FullTimestamp = true
 	formatter.TimestampFormat = "2006-01-02 15:04:05.999"
-	logrus.SetLevel(logLevel)
+	logrus.SetLevel(logrus.DebugLevel)
 
 	if !terminal.IsTerminal(int(os.Stderr.Fd())) {
 		formatter.DisableColors = true
@@ -53,21 +151,249 @@ func init() {
 	logrus.SetFormatter(&formatter)
 }
 
+// Configure sets the levels and format of the log. Called on startup,
+// before other goroutines log.
+func Configure(config Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	level, _ := logrus.ParseLevel(config.Level)
+	modules := map[string]LogLevel{}
+	for module, value := range config.Modules {
+		modules[strings.ToLower(module)], _ = logrus.ParseLevel(value)
+	}
+	levels.Lock()
+	levels.level = level
+	levels.modules = modules
+	levels.repeatInterval = config.RepeatInterval
+	levels.Unlock()
+
+	if config.Format == FormatJson {
+		sourceKey = "source"
+		logrus.SetFormatter(&logrus.JSONFormatter{
+			TimestampFormat: time.RFC3339Nano,
+		})
+	}
+	return nil
+}
+
+func repeatInterval() time.Duration {
+	levels.RLock()
+	defer levels.RUnlock()
+	return levels.repeatInterval
+}
+
+// enabled returns true if messages of level are logged for module.
+func enabled(module string, level LogLevel) bool {
+	levels.RLock()
+	defer levels.RUnlock()
+	threshold, ok := levels.modules[module]
+	if !ok {
+		threshold = levels.level
+	}
+	return level <= threshold
+}
+
+// Logger logs messages with fields. The zero value logs without fields.
+type Logger struct {
+	fields  Fields
+	limited bool
+}
+
+// WithFields returns a logger that adds fields to each message, such as
+// the exchange or symbol it is about.
+func WithFields(fields Fields) *Logger {
+	return (&Logger{}).WithFields(fields)
+}
+
+func WithField(key string, value interface{}) *Logger {
+	return (&Logger{}).WithField(key, value)
+}
+
+// Limited returns a logger that logs at most one message per repeat
+// interval from each line, for errors that repeat at the rate of the
+// messages of a stream, such as decode failures.
+func Limited() *Logger {
+	return (&Logger{}).Limited()
+}
+
+func (l *Logger) WithFields(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for key, value := range l.fields {
+		merged[key] = value
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+	return &Logger{fields: merged, limited: l.limited}
+}
+
+func (l *Logger) WithField(key string, value interface{}) *Logger {
+	return l.WithFields(Fields{key: value})
+}
+
+func (l *Logger) Limited() *Logger {
+	return &Logger{fields: l.fields, limited: true}
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(LogLevelDebug, format, args)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(LogLevelInfo, format, args)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(LogLevelWarn, format, args)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(LogLevelError, format, args)
+}
+
+// Printf logs at the level of the prefix of format.
+func (l *Logger) Printf(format string, args ...interface{}) {
+	l.logf(prefixLevel(format), format, args)
+}
+
+var root = &Logger{}
+
+func Debugf(format string, args ...interface{}) {
+	root.logf(LogLevelDebug, format, args)
+}
+
+func Infof(format string, args ...interface{}) {
+	root.logf(LogLevelInfo, format, args)
+}
+
+func Warnf(format string, args ...interface{}) {
+	root.logf(LogLevelWarn, format, args)
+}
+
+func Errorf(format string, args ...interface{}) {
+	root.logf(LogLevelError, format, args)
+}
+
 func Printf(format string, args ...interface{}) {
-	withSource().Printf(format, args...)
+	root.logf(prefixLevel(format), format, args)
 }
 
 func Println(args ...interface{}) {
-	withSource().Println(args...)
+	root.logf(LogLevelInfo, "%s", []interface{}{strings.TrimSuffix(fmt.Sprintln(args...), "\n")})
 }
 
 func Fatal(v ...interface{}) {
-	withSource().Fatal(v...)
+	pc, filename, line, _ := runtime.Caller(1)
+	logrus.WithFields(Fields{
+		sourceKey: formatSource(filename, line),
+		"module":  moduleOf(pc),
+	}).Fatal(v...)
+}
+
+func prefixLevel(format string) LogLevel {
+	switch {
+	case strings.HasPrefix(format, "error:"):
+		return LogLevelError
+	case strings.HasPrefix(format, "warning:"):
+		return LogLevelWarn
+	}
+	return LogLevelInfo
+}
+
+// logf logs a message from the caller of the exported function that called
+// it.
+func (l *Logger) logf(level LogLevel, format string, args []interface{}) {
+	pc, filename, line, _ := runtime.Caller(2)
+	module := moduleOf(pc)
+	if !enabled(module, level) {
+		return
+	}
+	source := formatSource(filename, line)
+	suppressed := 0
+	if l.limited {
+		var ok bool
+		if suppressed, ok = repeats.allow(source, time.Now()); !ok {
+			return
+		}
+	}
+
+	fields := make(Fields, len(l.fields)+3)
+	for key, value := range l.fields {
+		fields[key] = value
+	}
+	fields[sourceKey] = source
+	fields["module"] = module
+	if suppressed > 0 {
+		fields["suppressed"] = suppressed
+	}
+	entry := logrus.WithFields(fields)
+	message := strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")
+	switch level {
+	case LogLevelDebug:
+		entry.Debug(message)
+	case LogLevelWarn:
+		entry.Warn(message)
+	case LogLevelError:
+		entry.Error(message)
+	default:
+		entry.Info(message)
+	}
+}
+
+// The module of each calling function, by program counter.
+var modules sync.Map
+
+// moduleOf returns the name of the package of the function at pc, such as
+// binance for gitlab.com/crankykernel/cryptoxscanner/pkg/binance.
+func moduleOf(pc uintptr) string {
+	if module, ok := modules.Load(pc); ok {
+		return module.(string)
+	}
+	module := "unknown"
+	if fn := runtime.FuncForPC(pc); fn != nil {
+		name := fn.Name()
+		name = name[strings.LastIndex(name, "/")+1:]
+		if dot := strings.Index(name, "."); dot >= 0 {
+			name = name[:dot]
+		}
+		module = name
+	}
+	modules.Store(pc, module)
+	return module
 }
 
-func withSource() *Entry {
-	_, filename, line, _ := runtime.Caller(2)
-	return logrus.WithField("_source", formatSource(filename, line))
+// repeatedLines tracks when each line logging through a limited logger last
+// logged.
+type repeatedLines struct {
+	sync.Mutex
+	lines map[string]*repeatedLine
+}
+
+type repeatedLine struct {
+	last       time.Time
+	suppressed int
+}
+
+var repeats = repeatedLines{lines: map[string]*repeatedLine{}}
+
+// allow returns true if source may log at now, with the number of messages
+// suppressed since it last logged.
+func (r *repeatedLines) allow(source string, now time.Time) (int, bool) {
+	r.Lock()
+	defer r.Unlock()
+	line := r.lines[source]
+	if line == nil {
+		line = &repeatedLine{}
+		r.lines[source] = line
+	} else if now.Sub(line.last) < repeatInterval() {
+		line.suppressed++
+		return 0, false
+	}
+	suppressed := line.suppressed
+	line.last = now
+	line.suppressed = 0
+	return suppressed, true
 }
 
 func formatSource(filename string, line int) string {
@@ -0,0 +1,202 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package activity tracks the trades and quote volume per minute of each
+// symbol and detects minutes of anomalous activity against their baseline.
+package activity
+
+import (
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/anomaly"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	// The baseline the trades and quote volume of each minute are scored
+	// against. A threshold of 0 disables surges.
+	anomaly.Config `mapstructure:",squash"`
+
+	// Minutes with fewer trades than this are never surges, so a handful
+	// of trades in a symbol that rarely trades is not reported.
+	MinTrades int64 `mapstructure:"min_trades" json:"min_trades"`
+}
+
+var DefaultConfig = Config{
+	Config: anomaly.Config{
+		Model:     anomaly.ModelEWMA,
+		Threshold: 6,
+		Window:    60,
+	},
+	MinTrades: 50,
+}
+
+// Override returns c with the fields that are set in override replaced.
+func (c Config) Override(override Config) Config {
+	c.Config = c.Config.Override(override.Config)
+	if override.MinTrades != 0 {
+		c.MinTrades = override.MinTrades
+	}
+	return c
+}
+
+func (c Config) Validate() error {
+	if c.Threshold < 0 || c.MinTrades < 0 {
+		return fmt.Errorf("activity threshold and min trades must not be negative")
+	}
+	if c.Threshold == 0 {
+		return nil
+	}
+	return c.Config.Validate()
+}
+
+// Surge is a minute with anomalous trades or quote volume.
+type Surge struct {
+	Symbol string `json:"symbol"`
+
+	// The start of the minute.
+	Timestamp time.Time `json:"timestamp"`
+
+	Trades      int64   `json:"trades"`
+	QuoteVolume float64 `json:"quote_volume"`
+
+	// The expected trades and quote volume of a minute, and the scores of
+	// the minute against them.
+	TradesBaseline float64 `json:"trades_baseline"`
+	VolumeBaseline float64 `json:"volume_baseline"`
+	TradesScore    float64 `json:"trades_score"`
+	VolumeScore    float64 `json:"volume_score"`
+}
+
+// symbolActivity is the current minute of a symbol and the completed
+// minutes before it, oldest first.
+type symbolActivity struct {
+	start   time.Time
+	trades  int64
+	volume  float64
+	history struct {
+		trades []float64
+		volume []float64
+	}
+}
+
+// push adds a completed minute to the history, keeping window minutes.
+func (s *symbolActivity) push(trades float64, volume float64, window int) {
+	s.history.trades = append(s.history.trades, trades)
+	s.history.volume = append(s.history.volume, volume)
+	if len(s.history.trades) > window {
+		s.history.trades = s.history.trades[len(s.history.trades)-window:]
+		s.history.volume = s.history.volume[len(s.history.volume)-window:]
+	}
+}
+
+// Tracker scores each completed minute of each symbol. Safe for concurrent
+// use.
+type Tracker struct {
+	config   Config
+	baseline *anomaly.Baseline
+	symbols  map[string]*symbolActivity
+	lock     sync.Mutex
+}
+
+func NewTracker(config Config) (*Tracker, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	tracker := &Tracker{
+		config:  config,
+		symbols: map[string]*symbolActivity{},
+	}
+	if config.Threshold > 0 {
+		baseline, err := anomaly.New(config.Config)
+		if err != nil {
+			return nil, err
+		}
+		tracker.baseline = baseline
+	}
+	return tracker, nil
+}
+
+func (t *Tracker) Config() Config {
+	return t.config
+}
+
+// Add adds a trade, returning the surge if the trade completes a minute of
+// anomalous activity. Trades older than the current minute of the symbol
+// are ignored.
+func (t *Tracker) Add(trade pkg.CommonTrade) (Surge, bool) {
+	if t.baseline == nil {
+		return Surge{}, false
+	}
+	start := trade.Timestamp.Truncate(time.Minute)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	s := t.symbols[trade.Symbol]
+	if s == nil {
+		s = &symbolActivity{start: start}
+		t.symbols[trade.Symbol] = s
+	}
+	if start.Before(s.start) {
+		return Surge{}, false
+	}
+
+	surge, ok := Surge{}, false
+	if start.After(s.start) {
+		surge, ok = t.score(trade.Symbol, s)
+		s.push(float64(s.trades), s.volume, t.config.Window)
+
+		// Minutes without trades are part of the baseline.
+		empty := int(start.Sub(s.start)/time.Minute) - 1
+		if empty > t.config.Window {
+			empty = t.config.Window
+		}
+		for i := 0; i < empty; i++ {
+			s.push(0, 0, t.config.Window)
+		}
+
+		s.start = start
+		s.trades = 0
+		s.volume = 0
+	}
+
+	s.trades++
+	s.volume += trade.QuoteQuantity()
+	return surge, ok
+}
+
+// score scores the current minute of a symbol against its history.
+func (t *Tracker) score(symbol string, s *symbolActivity) (Surge, bool) {
+	if s.trades < t.config.MinTrades {
+		return Surge{}, false
+	}
+	trades, tradesOk := t.baseline.Score(s.history.trades, float64(s.trades))
+	volume, volumeOk := t.baseline.Score(s.history.volume, s.volume)
+	if !(tradesOk && t.baseline.Anomalous(trades)) && !(volumeOk && t.baseline.Anomalous(volume)) {
+		return Surge{}, false
+	}
+	return Surge{
+		Symbol:         symbol,
+		Timestamp:      s.start,
+		Trades:         s.trades,
+		QuoteVolume:    s.volume,
+		TradesBaseline: trades.Baseline,
+		VolumeBaseline: volume.Baseline,
+		TradesScore:    trades.Score,
+		VolumeScore:    volume.Score,
+	}, true
+}
@@ -0,0 +1,538 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package alerts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/anomaly"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/billing"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/events"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/notify"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The number of fired alerts that can be waiting for delivery before new
+// alerts are dropped.
+const deliveryQueueSize = 1000
+
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+// Alert is a fired rule.
+type Alert struct {
+	// Idempotency key of the alert, the same on every delivery attempt.
+	Id string `json:"id"`
+
+	Rule       string             `json:"rule"`
+	Exchange   string             `json:"exchange"`
+	Symbol     string             `json:"symbol"`
+	Timestamp  time.Time          `json:"timestamp"`
+	Conditions []string           `json:"conditions"`
+	Values     map[string]float64 `json:"values"`
+	Message    string             `json:"message"`
+
+	// The ticker at the time the alert fired, for message templates.
+	Close          float64            `json:"close"`
+	Volume         float64            `json:"volume"`
+	PriceChangePct map[string]float64 `json:"price_change_pct"`
+
+	webhooks []string
+	notify   []string
+
+	// Sent to notifiers as the message alone rather than rendered with
+	// their templates, which are written for market alerts.
+	plain bool
+}
+
+// Scorer calculates the volume score of a symbol with the exchange baseline
+// overridden by a rule.
+type Scorer func(symbol string, override anomaly.Config) (float64, bool)
+
+// Engine evaluates the alert rules against ticker updates. Fired alerts are
+// recorded as events, delivered to the configured webhooks and published to
+// any additional sinks.
+type Engine struct {
+	filename string
+	config   Config
+	rules    []*Rule
+	channels map[string]*notify.Channel
+	health   healthChecks
+	lock     sync.RWMutex
+
+	// The last time each rule fired for an exchange and symbol.
+	lastFired     map[string]time.Time
+	lastFiredLock sync.Mutex
+
+	events *events.Store
+	topic  *pkg.Topic
+	queue  chan *Alert
+	outbox *Outbox
+
+	// Volume scorers by exchange, for rules that override the baseline.
+	scorers     map[string]Scorer
+	scorersLock sync.RWMutex
+
+	// Meters the evaluations of rules with an account, nil if billing is
+	// disabled.
+	meter *billing.Meter
+
+	// Dry runs all alerts regardless of the configuration.
+	dryRun bool
+}
+
+// NewEngine creates an engine with the rules from filename, which may be
+// any format supported by viper. The file is watched and the rules reloaded
+// when it changes. An empty filename creates an engine with no rules.
+func NewEngine(filename string, store *events.Store) (*Engine, error) {
+	outbox, _ := OpenOutbox("")
+	engine := &Engine{
+		filename:  filename,
+		channels:  map[string]*notify.Channel{},
+		lastFired: map[string]time.Time{},
+		events:    store,
+		topic:     pkg.DefaultBus.NewTopic("alerts", (*Alert)(nil)),
+		queue:     make(chan *Alert, deliveryQueueSize),
+		outbox:    outbox,
+		scorers:   map[string]Scorer{},
+		health:    healthChecks{interval: defaultHealthInterval},
+	}
+	if filename == "" {
+		return engine, nil
+	}
+
+	config := viper.New()
+	config.SetConfigFile(filename)
+	if err := engine.load(config); err != nil {
+		return nil, err
+	}
+	config.OnConfigChange(func(e fsnotify.Event) {
+		if err := engine.load(config); err != nil {
+			log.Printf("error: alerts: failed to reload %s, keeping previous rules: %v\n",
+				filename, err)
+		}
+	})
+	config.WatchConfig()
+	return engine, nil
+}
+
+func (e *Engine) load(v *viper.Viper) error {
+	if err := v.ReadInConfig(); err != nil {
+		return err
+	}
+	var config Config
+	if err := v.Unmarshal(&config); err != nil {
+		return err
+	}
+	rules := []*Rule{}
+	for _, ruleConfig := range config.Rules {
+		rule, err := NewRule(ruleConfig)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, rule)
+	}
+	for _, webhook := range config.Webhooks {
+		if webhook.Url == "" {
+			return fmt.Errorf("webhook %s: url required", webhook.Name)
+		}
+	}
+	health, err := newHealthChecks(config.Health)
+	if err != nil {
+		return err
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	// Unchanged notifiers are kept so their rate limits carry over the
+	// reload.
+	previous := map[string]notify.Config{}
+	for _, notifierConfig := range e.config.Notifiers {
+		previous[notifierConfig.Name] = notifierConfig
+	}
+	channels := map[string]*notify.Channel{}
+	for _, notifierConfig := range config.Notifiers {
+		if channel, ok := e.channels[notifierConfig.Name]; ok &&
+			reflect.DeepEqual(previous[notifierConfig.Name], notifierConfig) {
+			channels[notifierConfig.Name] = channel
+			continue
+		}
+		channel, err := notify.NewChannel(notifierConfig)
+		if err != nil {
+			return err
+		}
+		channels[notifierConfig.Name] = channel
+	}
+
+	e.config = config
+	e.rules = rules
+	e.channels = channels
+	e.health = health
+
+	log.Printf("alerts: loaded %d rules, %d webhooks and %d notifiers from %s\n",
+		len(rules), len(config.Webhooks), len(channels), e.filename)
+	return nil
+}
+
+// Config returns the currently loaded configuration.
+func (e *Engine) Config() Config {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.config
+}
+
+// AddSink registers a sink, such as a notification channel, to receive
+// each fired *Alert.
+func (e *Engine) AddSink(sink pkg.Sink) {
+	e.topic.AddSink(sink)
+}
+
+// SetOutbox replaces the in memory outbox, such as with one persisted to
+// disk. Alerts left in it are delivered when Run starts. Must be called
+// before Run.
+func (e *Engine) SetOutbox(outbox *Outbox) {
+	e.outbox = outbox
+}
+
+// SetUsageMeter meters the evaluations of rules with an account. Rules of
+// accounts over their hard limit are not evaluated. Must be called before
+// any updates are evaluated.
+func (e *Engine) SetUsageMeter(meter *billing.Meter) {
+	e.meter = meter
+}
+
+// SetDryRun dry runs all alerts when set, as if dry_run was set in the
+// configuration. Must be called before any updates are evaluated.
+func (e *Engine) SetDryRun(dryRun bool) {
+	e.dryRun = dryRun
+}
+
+// DryRun returns true if all alerts are dry run.
+func (e *Engine) DryRun() bool {
+	if e.dryRun {
+		return true
+	}
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.config.DryRun
+}
+
+// SetScorer registers the volume scorer of an exchange.
+func (e *Engine) SetScorer(exchange string, scorer Scorer) {
+	e.scorersLock.Lock()
+	defer e.scorersLock.Unlock()
+	e.scorers[exchange] = scorer
+}
+
+// withRuleBaseline returns the update with the volume score recalculated
+// with the baseline of the rule. The update is not modified.
+func (e *Engine) withRuleBaseline(rule *Rule, exchange string, symbol string,
+	update map[string]interface{}) map[string]interface{} {
+	e.scorersLock.RLock()
+	scorer := e.scorers[exchange]
+	e.scorersLock.RUnlock()
+	values := make(map[string]interface{}, len(update))
+	for key, value := range update {
+		values[key] = value
+	}
+	delete(values, VolumeScoreMetric)
+	if scorer != nil {
+		if score, ok := scorer(symbol, *rule.Baseline); ok {
+			values[VolumeScoreMetric] = score
+		}
+	}
+	return values
+}
+
+// Evaluate tests all matching rules against a ticker update.
+func (e *Engine) Evaluate(exchange string, symbol string, update map[string]interface{}) {
+	e.lock.RLock()
+	rules := e.rules
+	e.lock.RUnlock()
+
+	for _, rule := range rules {
+		if !rule.Matches(exchange, symbol) {
+			continue
+		}
+		if rule.Account != "" && !e.meter.Evaluate(rule.Account) {
+			continue
+		}
+		ruleValues := update
+		if rule.Baseline != nil {
+			ruleValues = e.withRuleBaseline(rule, exchange, symbol, update)
+		}
+		values := rule.Evaluate(ruleValues)
+		if values == nil {
+			continue
+		}
+		if !e.checkCooldown(rule, exchange, symbol) {
+			continue
+		}
+		e.fire(rule, exchange, symbol, update, values)
+	}
+}
+
+// checkCooldown returns true, and records the time, if the rule has not
+// fired for the symbol within its cooldown.
+func (e *Engine) checkCooldown(rule *Rule, exchange string, symbol string) bool {
+	key := fmt.Sprintf("%s:%s:%s", rule.Name, exchange, symbol)
+	now := time.Now()
+	e.lastFiredLock.Lock()
+	defer e.lastFiredLock.Unlock()
+	if last, ok := e.lastFired[key]; ok && now.Sub(last) < rule.Cooldown {
+		return false
+	}
+	e.lastFired[key] = now
+	return true
+}
+
+func (e *Engine) fire(rule *Rule, exchange string, symbol string,
+	update map[string]interface{}, values map[string]float64) {
+	conditions := []string{}
+	for _, condition := range rule.Conditions {
+		conditions = append(conditions, condition.String())
+	}
+	alert := &Alert{
+		Rule:       rule.Name,
+		Exchange:   exchange,
+		Symbol:     symbol,
+		Timestamp:  time.Now(),
+		Conditions: conditions,
+		Values:     values,
+		Message: fmt.Sprintf("%s: %s %s: %s", rule.Name, exchange, symbol,
+			strings.Join(conditions, " and ")),
+		PriceChangePct: map[string]float64{},
+		webhooks:       rule.Webhooks,
+		notify:         rule.Notify,
+	}
+	alert.Close, _ = LookupMetric(update, "close")
+	alert.Volume, _ = LookupMetric(update, "volume")
+	if changes, ok := update["price_change_pct"].(map[string]float64); ok {
+		alert.PriceChangePct = changes
+	}
+
+	data := map[string]interface{}{
+		"rule": rule.Name,
+	}
+	for metric, value := range values {
+		data[metric] = value
+	}
+	dryRun := rule.DryRun || e.DryRun()
+	if dryRun {
+		data[events.DryRunField] = true
+	}
+	e.events.Add(events.Event{
+		Type:      events.TypeAlert,
+		Exchange:  exchange,
+		Symbol:    symbol,
+		Timestamp: alert.Timestamp,
+		Message:   alert.Message,
+		Data:      data,
+	})
+
+	if dryRun {
+		log.Printf("alerts: dry run, not delivering: %s\n", alert.Message)
+		return
+	}
+	e.enqueue(alert)
+}
+
+// FireMonitor queues an alert raised outside the rules by a monitor, such
+// as the cross-exchange spread monitor, for delivery to the given webhooks
+// and notifiers, all if empty. The monitor records its own event. In dry run
+// the alert is only logged.
+func (e *Engine) FireMonitor(name string, exchange string, symbol string, message string,
+	values map[string]float64, webhooks []string, notify []string) {
+	if e.DryRun() {
+		log.Printf("alerts: dry run, not delivering %s: %s\n", name, message)
+		return
+	}
+	alert := &Alert{
+		Rule:           name,
+		Exchange:       exchange,
+		Symbol:         symbol,
+		Timestamp:      time.Now(),
+		Conditions:     []string{},
+		Values:         values,
+		Message:        message,
+		PriceChangePct: map[string]float64{},
+		webhooks:       webhooks,
+		notify:         notify,
+		plain:          true,
+	}
+	e.enqueue(alert)
+}
+
+// enqueue adds the alert to the outbox with its delivery targets and
+// queues it for delivery. If the queue is full delivery is left to the
+// retries of the outbox.
+func (e *Engine) enqueue(alert *Alert) {
+	alert.Id = fmt.Sprintf("%s-%s-%s-%d", alert.Rule, alert.Exchange, alert.Symbol,
+		alert.Timestamp.UnixNano())
+	e.outbox.add(alert, e.deliveryTargets(alert))
+	select {
+	case e.queue <- alert:
+	default:
+		log.Printf("warning: alerts: delivery queue full, delaying alert %s\n", alert.Message)
+		e.outbox.attempt(alert.Id)
+	}
+}
+
+// deliveryTargets returns the sinks and the configured webhooks and
+// notifiers the alert is delivered to.
+func (e *Engine) deliveryTargets(alert *Alert) []string {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	list := []string{sinksTarget}
+	for _, webhook := range e.config.Webhooks {
+		if targets(alert.webhooks, webhook.Name) {
+			list = append(list, webhookTarget(webhook.Name))
+		}
+	}
+	for name := range e.channels {
+		if targets(alert.notify, name) {
+			list = append(list, notifyTarget(name))
+		}
+	}
+	return list
+}
+
+// Run delivers fired alerts, and alerts left in the outbox from before a
+// restart, until ctx is cancelled, then delivers any alerts still queued.
+// Failed deliveries are retried every outboxRetryInterval.
+func (e *Engine) Run(ctx context.Context) {
+	if retries := e.outbox.retries(time.Now()); len(retries) > 0 {
+		log.Printf("alerts: delivering %d alerts from the outbox\n", len(retries))
+		for _, alert := range retries {
+			e.deliver(alert)
+		}
+	}
+
+	ticker := time.NewTicker(outboxRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case alert := <-e.queue:
+			e.deliver(alert)
+		case <-ticker.C:
+			for _, alert := range e.outbox.retries(time.Now()) {
+				e.deliver(alert)
+			}
+		case <-ctx.Done():
+			for {
+				select {
+				case alert := <-e.queue:
+					e.deliver(alert)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver delivers the alert to the targets it has not yet been delivered
+// to, recording each successful delivery in the outbox.
+func (e *Engine) deliver(alert *Alert) {
+	for _, target := range e.outbox.attempt(alert.Id) {
+		if err := e.deliverTo(alert, target); err != nil {
+			log.Printf("error: alerts: %s failed: %v\n", target, err)
+			continue
+		}
+		e.outbox.delivered(alert.Id, target)
+	}
+}
+
+func (e *Engine) deliverTo(alert *Alert, target string) error {
+	if target == sinksTarget {
+		e.topic.Publish(alert)
+		return nil
+	}
+
+	e.lock.RLock()
+	webhooks := e.config.Webhooks
+	channels := e.channels
+	e.lock.RUnlock()
+	for _, webhook := range webhooks {
+		if webhookTarget(webhook.Name) == target {
+			return postWebhook(webhook, alert)
+		}
+	}
+	for name, channel := range channels {
+		if notifyTarget(name) == target {
+			if alert.plain {
+				return channel.SendText(alert.Message)
+			}
+			return channel.Send(alert)
+		}
+	}
+
+	// Removed from the configuration since the alert fired.
+	log.Printf("warning: alerts: %s no longer configured, not delivering %s\n",
+		target, alert.Message)
+	return nil
+}
+
+// targets returns true if name is in the list of targets of a rule, or the
+// rule has no targets.
+func targets(names []string, name string) bool {
+	if len(names) == 0 {
+		return true
+	}
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func postWebhook(webhook WebhookConfig, alert *Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("POST", webhook.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("content-type", "application/json")
+	request.Header.Set("idempotency-key", alert.Id)
+	for key, value := range webhook.Headers {
+		request.Header.Set(key, value)
+	}
+	response, err := webhookClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("status %d", response.StatusCode)
+	}
+	return nil
+}
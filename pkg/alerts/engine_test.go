@@ -0,0 +1,169 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package alerts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/events"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeRules replaces filename with a rule and a webhook. The file is
+// renamed into place, as saved by an editor, so a reload never reads it
+// partially written.
+func writeRules(t *testing.T, filename string, url string, when string) {
+	config := fmt.Sprintf(`
+webhooks:
+  - name: hook
+    url: %s
+    headers:
+      x-secret: s3cret
+rules:
+  - name: breakout
+    exchange: binance
+    when:
+      - "%s"
+`, url, when)
+	if err := ioutil.WriteFile(filename+".tmp", []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filename+".tmp", filename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type webhookRequest struct {
+	header http.Header
+	alert  Alert
+}
+
+func TestEngineWebhookDelivery(t *testing.T) {
+	requests := make(chan webhookRequest, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert Alert
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			t.Error(err)
+		}
+		requests <- webhookRequest{header: r.Header, alert: alert}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "alerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "alerts.yaml")
+	writeRules(t, filename, server.URL, "price_change_pct.15m > 5")
+
+	store := events.NewStore(time.Hour)
+	engine, err := NewEngine(filename, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go engine.Run(ctx)
+
+	update := map[string]interface{}{
+		"close":            1.5,
+		"price_change_pct": map[string]float64{"15m": 6},
+	}
+	engine.Evaluate("kucoin", "BTCUSDT", update)
+	engine.Evaluate("binance", "BTCUSDT", update)
+	// Within the cooldown.
+	engine.Evaluate("binance", "BTCUSDT", update)
+
+	select {
+	case request := <-requests:
+		if request.header.Get("content-type") != "application/json" {
+			t.Errorf("unexpected content type %q", request.header.Get("content-type"))
+		}
+		if request.header.Get("x-secret") != "s3cret" {
+			t.Errorf("configured header not sent")
+		}
+		if request.alert.Id == "" || request.header.Get("idempotency-key") != request.alert.Id {
+			t.Errorf("expected idempotency key %q, got %q", request.alert.Id,
+				request.header.Get("idempotency-key"))
+		}
+		if request.alert.Rule != "breakout" || request.alert.Exchange != "binance" ||
+			request.alert.Symbol != "BTCUSDT" {
+			t.Errorf("unexpected alert %+v", request.alert)
+		}
+		if request.alert.Values["price_change_pct.15m"] != 6 || request.alert.Close != 1.5 {
+			t.Errorf("unexpected values %+v", request.alert)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not delivered")
+	}
+	select {
+	case request := <-requests:
+		t.Errorf("unexpected second delivery %+v", request.alert)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	recorded := store.Query("binance", "BTCUSDT", time.Now().Add(-time.Minute), time.Now().Add(time.Minute))
+	if len(recorded) != 1 || recorded[0].Type != events.TypeAlert {
+		t.Errorf("expected 1 alert event, got %v", recorded)
+	}
+}
+
+func TestEngineReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "alerts.yaml")
+	writeRules(t, filename, "http://localhost/hook", "volume_score > 2")
+
+	engine, err := NewEngine(filename, events.NewStore(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := func(when string) bool {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			rules := engine.Config().Rules
+			if len(rules) == 1 && len(rules[0].When) == 1 && rules[0].When[0] == when {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+
+	writeRules(t, filename, "http://localhost/hook", "volume_score > 3")
+	if !reloaded("volume_score > 3") {
+		t.Fatalf("rules not reloaded, have %v", engine.Config().Rules)
+	}
+
+	// An invalid file keeps the previous rules.
+	writeRules(t, filename, "http://localhost/hook", "volume_score >")
+	time.Sleep(200 * time.Millisecond)
+	if !reloaded("volume_score > 3") {
+		t.Fatalf("expected the previous rules, have %v", engine.Config().Rules)
+	}
+}
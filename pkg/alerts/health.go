@@ -0,0 +1,208 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package alerts
+
+import (
+	"context"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The default interval the health of the scanner is checked at.
+const defaultHealthInterval = 30 * time.Second
+
+// HealthConfig configures alerts on the health of the scanner itself,
+// delivered through the same webhooks and notifiers as market alerts.
+type HealthConfig struct {
+	// Alert when a stream has been disconnected this long, such as "5m".
+	// Empty disables.
+	StreamDown string `mapstructure:"stream_down" json:"stream_down,omitempty"`
+
+	// Alert when Redis becomes unreachable. Only alerts once Redis has
+	// been reachable, so running without Redis does not alert.
+	Redis bool `mapstructure:"redis" json:"redis,omitempty"`
+
+	// Alert when the Go heap exceeds this many megabytes, 0 to disable.
+	MemoryBudgetMB int `mapstructure:"memory_budget_mb" json:"memory_budget_mb,omitempty"`
+
+	// How often to check, such as "30s".
+	Interval string `mapstructure:"interval" json:"interval,omitempty"`
+
+	// Names of the webhooks and notifiers to deliver to. Empty delivers to
+	// all.
+	Webhooks []string `mapstructure:"webhooks" json:"webhooks,omitempty"`
+	Notify   []string `mapstructure:"notify" json:"notify,omitempty"`
+}
+
+// healthChecks is a parsed HealthConfig.
+type healthChecks struct {
+	streamDown   time.Duration
+	redis        bool
+	memoryBudget uint64
+	interval     time.Duration
+	webhooks     []string
+	notify       []string
+}
+
+func newHealthChecks(config HealthConfig) (healthChecks, error) {
+	checks := healthChecks{
+		redis:        config.Redis,
+		memoryBudget: uint64(config.MemoryBudgetMB) * 1024 * 1024,
+		interval:     defaultHealthInterval,
+		webhooks:     config.Webhooks,
+		notify:       config.Notify,
+	}
+	if config.MemoryBudgetMB < 0 {
+		return checks, fmt.Errorf("health: memory budget must not be negative")
+	}
+	if config.StreamDown != "" {
+		streamDown, err := time.ParseDuration(config.StreamDown)
+		if err != nil || streamDown <= 0 {
+			return checks, fmt.Errorf("health: invalid stream_down: %s", config.StreamDown)
+		}
+		checks.streamDown = streamDown
+	}
+	if config.Interval != "" {
+		interval, err := time.ParseDuration(config.Interval)
+		if err != nil || interval <= 0 {
+			return checks, fmt.Errorf("health: invalid interval: %s", config.Interval)
+		}
+		checks.interval = interval
+	}
+	return checks, nil
+}
+
+// fireHealth queues a health alert for delivery. Health alerts are not
+// recorded as events as they are not about a market.
+func (e *Engine) fireHealth(checks healthChecks, check string, message string) {
+	alert := &Alert{
+		Rule:           "health",
+		Timestamp:      time.Now(),
+		Conditions:     []string{check},
+		Values:         map[string]float64{},
+		Message:        "scanner health: " + message,
+		PriceChangePct: map[string]float64{},
+		webhooks:       checks.webhooks,
+		notify:         checks.notify,
+		plain:          true,
+	}
+	log.Printf("alerts: %s\n", alert.Message)
+	e.enqueue(alert)
+}
+
+type healthProblem struct {
+	since   time.Time
+	message string
+}
+
+// HealthMonitor checks the health of the scanner, alerting through the
+// engine when a problem is found and again when it is resolved.
+type HealthMonitor struct {
+	engine    *Engine
+	redisPing func() error
+	redisUp   bool
+
+	// Problems alerted on and not yet resolved, by check and subject.
+	problems map[string]healthProblem
+}
+
+func NewHealthMonitor(engine *Engine) *HealthMonitor {
+	return &HealthMonitor{
+		engine:   engine,
+		problems: map[string]healthProblem{},
+	}
+}
+
+// SetRedisPing sets the function used to check Redis is reachable. Must be
+// called before Run.
+func (m *HealthMonitor) SetRedisPing(ping func() error) {
+	m.redisPing = ping
+}
+
+// Run checks the health of the scanner until ctx is cancelled. The checks
+// are taken from the engine configuration each time so follow reloads.
+func (m *HealthMonitor) Run(ctx context.Context) {
+	for {
+		m.engine.lock.RLock()
+		checks := m.engine.health
+		m.engine.lock.RUnlock()
+		if !pkg.Sleep(ctx, checks.interval) {
+			return
+		}
+		m.check(checks)
+	}
+}
+
+// check runs the checks once, alerting on new and resolved problems.
+func (m *HealthMonitor) check(checks healthChecks) {
+	now := time.Now()
+	active := map[string]string{}
+
+	if checks.streamDown > 0 {
+		for _, status := range pkg.StreamStatuses() {
+			if status.Connected || now.Sub(status.DownSince) < checks.streamDown {
+				continue
+			}
+			active["stream_down:"+status.Name] = fmt.Sprintf("stream %s down since %s",
+				status.Name, status.DownSince.UTC().Format(time.RFC3339))
+		}
+	}
+
+	if checks.redis && m.redisPing != nil {
+		if err := m.redisPing(); err == nil {
+			m.redisUp = true
+		} else if m.redisUp {
+			active["redis_unreachable"] = fmt.Sprintf("redis unreachable: %v", err)
+		}
+	}
+
+	if checks.memoryBudget > 0 {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		if stats.HeapAlloc > checks.memoryBudget {
+			active["memory_budget"] = fmt.Sprintf("heap of %d MB exceeds the memory budget of %d MB",
+				stats.HeapAlloc/1024/1024, checks.memoryBudget/1024/1024)
+		}
+	}
+
+	keys := []string{}
+	for key := range active {
+		keys = append(keys, key)
+	}
+	for key := range m.problems {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		check := strings.SplitN(key, ":", 2)[0]
+		problem, raised := m.problems[key]
+		message, failing := active[key]
+		if failing && !raised {
+			m.problems[key] = healthProblem{since: now, message: message}
+			m.engine.fireHealth(checks, check, message)
+		} else if !failing && raised {
+			delete(m.problems, key)
+			m.engine.fireHealth(checks, check, fmt.Sprintf("resolved after %v: %s",
+				now.Sub(problem.since).Round(time.Second), problem.message))
+		}
+	}
+}
@@ -0,0 +1,284 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package alerts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/metrics"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	metrics.Describe("metric_webhooks_fired_total",
+		"Metric webhooks fired, by webhook.")
+	metrics.Describe("metric_webhooks_failed_total",
+		"Metric webhook deliveries that failed or were dropped, by webhook.")
+}
+
+// Metric webhook directions.
+const (
+	DirectionAbove = "above"
+	DirectionBelow = "below"
+)
+
+// The default time before a metric webhook fires again for the same symbol.
+const DefaultMetricWebhookCooldown = 15 * time.Minute
+
+// MetricWebhookConfig is a threshold on a single ticker metric that posts to
+// a URL when crossed, for simple automations that do not need alert rules.
+type MetricWebhookConfig struct {
+	// Name of the webhook in logs and posts, defaults to the metric.
+	Name string `mapstructure:"name" json:"name"`
+
+	// Metric of the ticker update, using dots for nested fields like alert
+	// rule conditions.
+	Metric string `mapstructure:"metric" json:"metric"`
+
+	Threshold float64 `mapstructure:"threshold" json:"threshold"`
+
+	// Fires when the metric rises to at least the threshold when above,
+	// the default, or falls to at most the threshold when below.
+	Direction string `mapstructure:"direction" json:"direction"`
+
+	Url     string            `mapstructure:"url" json:"url"`
+	Headers map[string]string `mapstructure:"headers" json:"-"`
+
+	// Limits the webhook to an exchange and its symbols, empty for all.
+	Exchange string   `mapstructure:"exchange" json:"exchange,omitempty"`
+	Symbols  []string `mapstructure:"symbols" json:"symbols,omitempty"`
+
+	// Minimum time before the webhook fires again for the same symbol.
+	Cooldown time.Duration `mapstructure:"cooldown" json:"cooldown"`
+
+	// Log the posts that would be made without making them.
+	DryRun bool `mapstructure:"dry_run" json:"dry_run,omitempty"`
+}
+
+func (c MetricWebhookConfig) Validate() error {
+	if c.Metric == "" {
+		return fmt.Errorf("metric webhook without a metric")
+	}
+	if c.Url == "" {
+		return fmt.Errorf("metric webhook %s without a url", c.Metric)
+	}
+	switch c.Direction {
+	case "", DirectionAbove, DirectionBelow:
+	default:
+		return fmt.Errorf("metric webhook %s: invalid direction: %s", c.Metric, c.Direction)
+	}
+	if c.Cooldown < 0 {
+		return fmt.Errorf("metric webhook %s: cooldown must not be negative", c.Metric)
+	}
+	return nil
+}
+
+func (c MetricWebhookConfig) withDefaults() MetricWebhookConfig {
+	if c.Name == "" {
+		c.Name = c.Metric
+	}
+	if c.Direction == "" {
+		c.Direction = DirectionAbove
+	}
+	if c.Cooldown == 0 {
+		c.Cooldown = DefaultMetricWebhookCooldown
+	}
+	return c
+}
+
+func (c MetricWebhookConfig) matches(exchange string, symbol string) bool {
+	if c.Exchange != "" && c.Exchange != exchange {
+		return false
+	}
+	if len(c.Symbols) == 0 {
+		return true
+	}
+	for _, s := range c.Symbols {
+		if strings.EqualFold(s, symbol) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c MetricWebhookConfig) crossed(value float64) bool {
+	if c.Direction == DirectionBelow {
+		return value <= c.Threshold
+	}
+	return value >= c.Threshold
+}
+
+// MetricWebhookPost is the body posted to a metric webhook.
+type MetricWebhookPost struct {
+	Name      string    `json:"name"`
+	Metric    string    `json:"metric"`
+	Direction string    `json:"direction"`
+	Threshold float64   `json:"threshold"`
+	Value     float64   `json:"value"`
+	Exchange  string    `json:"exchange"`
+	Symbol    string    `json:"symbol"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type metricWebhookDelivery struct {
+	config MetricWebhookConfig
+	post   MetricWebhookPost
+}
+
+type metricWebhookState struct {
+	crossed bool
+	fired   time.Time
+}
+
+// MetricWebhooks evaluates the metric webhooks against ticker updates.
+// Webhooks fire when the metric crosses the threshold, not while it stays
+// past it, so a symbol already past the threshold when first seen does not
+// fire until it crosses again. Posts are best effort: they are not retried
+// or kept across restarts, unlike alerts.
+type MetricWebhooks struct {
+	configs []MetricWebhookConfig
+	queue   chan metricWebhookDelivery
+	lock    sync.Mutex
+	state   map[string]*metricWebhookState
+
+	// Returns true if all webhooks are dry run, nil if none are.
+	dryRun func() bool
+}
+
+func NewMetricWebhooks(configs []MetricWebhookConfig) (*MetricWebhooks, error) {
+	m := &MetricWebhooks{
+		queue: make(chan metricWebhookDelivery, deliveryQueueSize),
+		state: map[string]*metricWebhookState{},
+	}
+	for _, config := range configs {
+		if err := config.Validate(); err != nil {
+			return nil, err
+		}
+		m.configs = append(m.configs, config.withDefaults())
+	}
+	return m, nil
+}
+
+// SetDryRun sets the function returning true when all webhooks are dry run,
+// such as the dry run of the alert engine. Must be called before any
+// updates are evaluated.
+func (m *MetricWebhooks) SetDryRun(dryRun func() bool) {
+	m.dryRun = dryRun
+}
+
+// Evaluate checks the ticker update of symbol against the webhooks, queuing
+// a post for each crossed threshold.
+func (m *MetricWebhooks) Evaluate(exchange string, symbol string, update map[string]interface{}) {
+	now := time.Now()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i, config := range m.configs {
+		if !config.matches(exchange, symbol) {
+			continue
+		}
+		value, ok := LookupMetric(update, config.Metric)
+		if !ok {
+			continue
+		}
+		key := fmt.Sprintf("%d:%s:%s", i, exchange, symbol)
+		state := m.state[key]
+		crossed := config.crossed(value)
+		if state == nil {
+			m.state[key] = &metricWebhookState{crossed: crossed}
+			continue
+		}
+		wasCrossed := state.crossed
+		state.crossed = crossed
+		if !crossed || wasCrossed || now.Sub(state.fired) < config.Cooldown {
+			continue
+		}
+		state.fired = now
+		delivery := metricWebhookDelivery{
+			config: config,
+			post: MetricWebhookPost{
+				Name:      config.Name,
+				Metric:    config.Metric,
+				Direction: config.Direction,
+				Threshold: config.Threshold,
+				Value:     value,
+				Exchange:  exchange,
+				Symbol:    symbol,
+				Timestamp: now,
+			},
+		}
+		labels := metrics.Labels{"webhook": config.Name}
+		if config.DryRun || (m.dryRun != nil && m.dryRun()) {
+			log.Printf("metric webhooks: dry run, not posting %s for %s:%s at %v\n",
+				config.Name, exchange, symbol, value)
+			continue
+		}
+		select {
+		case m.queue <- delivery:
+			metrics.GetCounter("metric_webhooks_fired_total", labels).Inc()
+		default:
+			metrics.GetCounter("metric_webhooks_failed_total", labels).Inc()
+			log.Printf("warning: metric webhooks: queue full, dropping %s for %s:%s\n",
+				config.Name, exchange, symbol)
+		}
+	}
+}
+
+// Run posts the fired webhooks until ctx is done.
+func (m *MetricWebhooks) Run(ctx context.Context) {
+	for {
+		select {
+		case delivery := <-m.queue:
+			if err := postMetricWebhook(delivery); err != nil {
+				metrics.GetCounter("metric_webhooks_failed_total",
+					metrics.Labels{"webhook": delivery.config.Name}).Inc()
+				log.Printf("error: metric webhooks: %s for %s:%s failed: %v\n",
+					delivery.config.Name, delivery.post.Exchange, delivery.post.Symbol, err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func postMetricWebhook(delivery metricWebhookDelivery) error {
+	body, err := json.Marshal(delivery.post)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("POST", delivery.config.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("content-type", "application/json")
+	for key, value := range delivery.config.Headers {
+		request.Header.Set(key, value)
+	}
+	response, err := webhookClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("status %d", response.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package alerts
+
+import (
+	"encoding/json"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How often deliveries that failed are retried.
+const outboxRetryInterval = 30 * time.Second
+
+// Alerts not delivered to all their targets within this time are given up
+// on.
+const outboxMaxAge = 24 * time.Hour
+
+// The delivery target for the engine sinks, such as the websocket and
+// message queue publishers. Webhooks and notifiers are targeted by their
+// kind and name, such as webhook:ops.
+const sinksTarget = "sinks"
+
+func webhookTarget(name string) string {
+	return "webhook:" + name
+}
+
+func notifyTarget(name string) string {
+	return "notify:" + name
+}
+
+type outboxEntry struct {
+	Alert *Alert `json:"alert"`
+	Plain bool   `json:"plain"`
+
+	// The targets not yet delivered to.
+	Pending []string `json:"pending"`
+
+	// Delivery attempts, 0 while the alert is still queued.
+	Attempts int `json:"attempts"`
+}
+
+// Outbox keeps fired alerts until they have been delivered to all their
+// targets. With a filename it is saved on every change, so alerts fired
+// just before a crash are delivered after a restart, and targets already
+// delivered to are not delivered to again. Each alert carries an
+// idempotency key so webhook receivers can drop the rare duplicate of a
+// delivery made just before a crash.
+type Outbox struct {
+	filename string
+	entries  map[string]*outboxEntry
+	lock     sync.Mutex
+}
+
+// OpenOutbox loads the outbox from filename, if it exists. An empty
+// filename keeps the outbox in memory only.
+func OpenOutbox(filename string) (*Outbox, error) {
+	o := &Outbox{
+		filename: filename,
+		entries:  map[string]*outboxEntry{},
+	}
+	if filename == "" {
+		return o, nil
+	}
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return o, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &o.entries); err != nil {
+		return nil, err
+	}
+	for _, entry := range o.entries {
+		entry.Alert.plain = entry.Plain
+
+		// Delivered by the first retry.
+		if entry.Attempts == 0 {
+			entry.Attempts = 1
+		}
+	}
+	return o, nil
+}
+
+// Len returns the number of alerts not yet delivered to all targets.
+func (o *Outbox) Len() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return len(o.entries)
+}
+
+func (o *Outbox) add(alert *Alert, targets []string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.entries[alert.Id] = &outboxEntry{
+		Alert:   alert,
+		Plain:   alert.plain,
+		Pending: targets,
+	}
+	o.save()
+}
+
+// attempt returns the targets of an alert not yet delivered to, counting
+// the attempt.
+func (o *Outbox) attempt(id string) []string {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	entry := o.entries[id]
+	if entry == nil {
+		return nil
+	}
+	entry.Attempts++
+	return append([]string{}, entry.Pending...)
+}
+
+// delivered records the delivery of an alert to target, removing the alert
+// once delivered to all targets.
+func (o *Outbox) delivered(id string, target string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	entry := o.entries[id]
+	if entry == nil {
+		return
+	}
+	for i, pending := range entry.Pending {
+		if pending == target {
+			entry.Pending = append(entry.Pending[:i], entry.Pending[i+1:]...)
+			break
+		}
+	}
+	if len(entry.Pending) == 0 {
+		delete(o.entries, id)
+	}
+	o.save()
+}
+
+// retries returns the alerts that have been attempted and still have
+// targets pending, oldest first. Alerts older than outboxMaxAge are given
+// up on.
+func (o *Outbox) retries(now time.Time) []*Alert {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	alerts := []*Alert{}
+	expired := false
+	for id, entry := range o.entries {
+		if now.Sub(entry.Alert.Timestamp) > outboxMaxAge {
+			log.Printf("warning: alerts: giving up on delivering %s to %v\n",
+				entry.Alert.Message, entry.Pending)
+			delete(o.entries, id)
+			expired = true
+			continue
+		}
+		if entry.Attempts > 0 {
+			alerts = append(alerts, entry.Alert)
+		}
+	}
+	if expired {
+		o.save()
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		return alerts[i].Timestamp.Before(alerts[j].Timestamp)
+	})
+	return alerts
+}
+
+// save writes the outbox to disk, replacing the previous file atomically.
+// Must be called with the lock held.
+func (o *Outbox) save() {
+	if o.filename == "" {
+		return
+	}
+	if err := o.write(); err != nil {
+		log.Printf("error: alerts: failed to save outbox: %v\n", err)
+	}
+}
+
+func (o *Outbox) write() error {
+	buf, err := json.Marshal(o.entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(o.filename), 0755); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(o.filename), ".outbox-")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(buf); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	if err := os.Rename(file.Name(), o.filename); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package alerts
+
+import (
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/anomaly"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/notify"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The default minimum time between alerts for the same rule and symbol.
+const defaultCooldown = 15 * time.Minute
+
+// The metric scoring the volume of the last closed 1 minute candle against
+// its baseline. Rules may override the baseline it is calculated with.
+const VolumeScoreMetric = "volume_score"
+
+type WebhookConfig struct {
+	Name    string            `mapstructure:"name" json:"name"`
+	Url     string            `mapstructure:"url" json:"url"`
+	Headers map[string]string `mapstructure:"headers" json:"headers,omitempty"`
+}
+
+type RuleConfig struct {
+	Name string `mapstructure:"name" json:"name"`
+
+	// Limit the rule to an exchange and/or symbols. Empty matches all.
+	Exchange string   `mapstructure:"exchange" json:"exchange,omitempty"`
+	Symbols  []string `mapstructure:"symbols" json:"symbols,omitempty"`
+
+	// Conditions that must all be true, in the form "<metric> <op>
+	// <value>", for example "price_change_pct.15m > 5".
+	When []string `mapstructure:"when" json:"when"`
+
+	// Minimum time between alerts for the same symbol, such as "15m".
+	Cooldown string `mapstructure:"cooldown" json:"cooldown,omitempty"`
+
+	// Overrides the exchange baseline used to calculate volume_score for
+	// this rule. Only the fields set are overridden.
+	Baseline *anomaly.Config `mapstructure:"baseline" json:"baseline,omitempty"`
+
+	// Names of the webhooks to deliver to. Empty delivers to all.
+	Webhooks []string `mapstructure:"webhooks" json:"webhooks,omitempty"`
+
+	// Names of the notifiers to deliver to. Empty delivers to all.
+	Notify []string `mapstructure:"notify" json:"notify,omitempty"`
+
+	// The account the evaluations of the rule are metered against, for
+	// hosted operators running rules on behalf of their users. Rules
+	// without an account are not metered.
+	Account string `mapstructure:"account" json:"account,omitempty"`
+
+	// Record the alerts of the rule as events without delivering them, to
+	// tune its conditions.
+	DryRun bool `mapstructure:"dry_run" json:"dry_run,omitempty"`
+}
+
+type Config struct {
+	Webhooks  []WebhookConfig `mapstructure:"webhooks" json:"webhooks"`
+	Notifiers []notify.Config `mapstructure:"notifiers" json:"notifiers"`
+	Rules     []RuleConfig    `mapstructure:"rules" json:"rules"`
+	Health    HealthConfig    `mapstructure:"health" json:"health"`
+
+	// Dry run all rules and monitor alerts.
+	DryRun bool `mapstructure:"dry_run" json:"dry_run,omitempty"`
+}
+
+var conditionRegex = regexp.MustCompile(`^\s*([\w.]+)\s*(>=|<=|==|!=|>|<)\s*(-?[\d.]+)\s*$`)
+
+type Condition struct {
+	Metric   string
+	Operator string
+	Value    float64
+}
+
+func ParseCondition(value string) (Condition, error) {
+	match := conditionRegex.FindStringSubmatch(value)
+	if match == nil {
+		return Condition{}, fmt.Errorf("invalid condition: %s", value)
+	}
+	threshold, err := strconv.ParseFloat(match[3], 64)
+	if err != nil {
+		return Condition{}, fmt.Errorf("invalid condition value: %s", value)
+	}
+	return Condition{
+		Metric:   match[1],
+		Operator: match[2],
+		Value:    threshold,
+	}, nil
+}
+
+func (c Condition) String() string {
+	return fmt.Sprintf("%s %s %v", c.Metric, c.Operator, c.Value)
+}
+
+func (c Condition) Test(value float64) bool {
+	switch c.Operator {
+	case ">":
+		return value > c.Value
+	case ">=":
+		return value >= c.Value
+	case "<":
+		return value < c.Value
+	case "<=":
+		return value <= c.Value
+	case "==":
+		return value == c.Value
+	case "!=":
+		return value != c.Value
+	}
+	return false
+}
+
+// Rule is a parsed RuleConfig.
+type Rule struct {
+	Name       string
+	Exchange   string
+	Symbols    map[string]bool
+	Conditions []Condition
+	Cooldown   time.Duration
+	Baseline   *anomaly.Config
+	Webhooks   []string
+	Notify     []string
+	Account    string
+	DryRun     bool
+}
+
+func NewRule(config RuleConfig) (*Rule, error) {
+	if config.Name == "" {
+		return nil, fmt.Errorf("rule name required")
+	}
+	if len(config.When) == 0 {
+		return nil, fmt.Errorf("rule %s: no conditions", config.Name)
+	}
+	rule := &Rule{
+		Name:     config.Name,
+		Exchange: strings.ToLower(config.Exchange),
+		Symbols:  map[string]bool{},
+		Cooldown: defaultCooldown,
+		Baseline: config.Baseline,
+		Webhooks: config.Webhooks,
+		Notify:   config.Notify,
+		Account:  config.Account,
+		DryRun:   config.DryRun,
+	}
+	for _, symbol := range config.Symbols {
+		rule.Symbols[strings.ToUpper(symbol)] = true
+	}
+	for _, when := range config.When {
+		condition, err := ParseCondition(when)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %v", config.Name, err)
+		}
+		rule.Conditions = append(rule.Conditions, condition)
+	}
+	if config.Baseline != nil {
+		if err := anomaly.DefaultConfig.Override(*config.Baseline).Validate(); err != nil {
+			return nil, fmt.Errorf("rule %s: %v", config.Name, err)
+		}
+	}
+	if config.Cooldown != "" {
+		cooldown, err := time.ParseDuration(config.Cooldown)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: invalid cooldown: %v", config.Name, err)
+		}
+		rule.Cooldown = cooldown
+	}
+	return rule, nil
+}
+
+func (r *Rule) Matches(exchange string, symbol string) bool {
+	if r.Exchange != "" && r.Exchange != exchange {
+		return false
+	}
+	if len(r.Symbols) > 0 && !r.Symbols[symbol] {
+		return false
+	}
+	return true
+}
+
+// Evaluate returns the values of the metrics if all conditions are true,
+// otherwise nil.
+func (r *Rule) Evaluate(values map[string]interface{}) map[string]float64 {
+	matched := map[string]float64{}
+	for _, condition := range r.Conditions {
+		value, ok := LookupMetric(values, condition.Metric)
+		if !ok || !condition.Test(value) {
+			return nil
+		}
+		matched[condition.Metric] = value
+	}
+	return matched
+}
+
+// LookupMetric returns a numeric value from a ticker update using a dotted
+// path into nested maps, such as "indicators.5m.rsi_14".
+func LookupMetric(values map[string]interface{}, metric string) (float64, bool) {
+	var current interface{} = values
+	for _, key := range strings.Split(metric, ".") {
+		v := reflect.ValueOf(current)
+		if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+			return 0, false
+		}
+		entry := v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key()))
+		if !entry.IsValid() {
+			return 0, false
+		}
+		current = entry.Interface()
+	}
+	v := reflect.ValueOf(current)
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	}
+	return 0, false
+}
@@ -0,0 +1,231 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package alerts
+
+import (
+	"testing"
+)
+
+func TestParseCondition(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected Condition
+		valid    bool
+	}{
+		{"price_change_pct.15m > 5", Condition{"price_change_pct.15m", ">", 5}, true},
+		{"volume_score>=2.5", Condition{"volume_score", ">=", 2.5}, true},
+		{"  indicators.5m.rsi_14 <= 30  ", Condition{"indicators.5m.rsi_14", "<=", 30}, true},
+		{"net_flow.1m < -10", Condition{"net_flow.1m", "<", -10}, true},
+		{"trades == 0", Condition{"trades", "==", 0}, true},
+		{"trades != 0", Condition{"trades", "!=", 0}, true},
+		{"", Condition{}, false},
+		{"volume_score", Condition{}, false},
+		{"volume_score > ", Condition{}, false},
+		{"volume_score => 2", Condition{}, false},
+		{"volume_score > high", Condition{}, false},
+		{"volume_score > 1.2.3", Condition{}, false},
+		{"volume-score > 2", Condition{}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			condition, err := ParseCondition(test.value)
+			if !test.valid {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", condition)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if condition != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, condition)
+			}
+		})
+	}
+}
+
+func TestConditionTest(t *testing.T) {
+	tests := []struct {
+		condition string
+		value     float64
+		expected  bool
+	}{
+		{"a > 5", 5.1, true},
+		{"a > 5", 5, false},
+		{"a >= 5", 5, true},
+		{"a >= 5", 4.9, false},
+		{"a < -1", -1.5, true},
+		{"a < -1", -1, false},
+		{"a <= -1", -1, true},
+		{"a == 2", 2, true},
+		{"a == 2", 2.1, false},
+		{"a != 2", 2.1, true},
+		{"a != 2", 2, false},
+	}
+	for _, test := range tests {
+		condition, err := ParseCondition(test.condition)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := condition.Test(test.value); got != test.expected {
+			t.Errorf("%s with %v: expected %v, got %v", test.condition, test.value,
+				test.expected, got)
+		}
+	}
+}
+
+func TestLookupMetric(t *testing.T) {
+	values := map[string]interface{}{
+		"close":            1.5,
+		"trades":           42,
+		"symbol":           "BTCUSDT",
+		"price_change_pct": map[string]float64{"1m": 0.5, "15m": 5.5},
+		"indicators": map[string]map[string]float64{
+			"5m": {"rsi_14": 72},
+		},
+		"nested": map[string]interface{}{
+			"count": int64(7),
+			"ratio": float32(0.25),
+		},
+	}
+	tests := []struct {
+		metric   string
+		expected float64
+		found    bool
+	}{
+		{"close", 1.5, true},
+		{"trades", 42, true},
+		{"price_change_pct.15m", 5.5, true},
+		{"indicators.5m.rsi_14", 72, true},
+		{"nested.count", 7, true},
+		{"nested.ratio", 0.25, true},
+		{"missing", 0, false},
+		{"price_change_pct.1h", 0, false},
+		{"indicators.5m.rsi_14.value", 0, false},
+		{"indicators.5m", 0, false},
+		{"symbol", 0, false},
+		{"close.1m", 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.metric, func(t *testing.T) {
+			value, found := LookupMetric(values, test.metric)
+			if found != test.found || value != test.expected {
+				t.Errorf("expected %v %v, got %v %v", test.expected, test.found, value, found)
+			}
+		})
+	}
+}
+
+func TestRuleEvaluate(t *testing.T) {
+	rule, err := NewRule(RuleConfig{
+		Name: "breakout",
+		When: []string{"price_change_pct.15m > 5", "volume_score >= 2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		values   map[string]interface{}
+		expected map[string]float64
+	}{
+		{
+			name: "all true",
+			values: map[string]interface{}{
+				"price_change_pct": map[string]float64{"15m": 6},
+				"volume_score":     2.0,
+			},
+			expected: map[string]float64{"price_change_pct.15m": 6, "volume_score": 2},
+		},
+		{
+			name: "one false",
+			values: map[string]interface{}{
+				"price_change_pct": map[string]float64{"15m": 6},
+				"volume_score":     1.5,
+			},
+		},
+		{
+			name: "metric missing",
+			values: map[string]interface{}{
+				"price_change_pct": map[string]float64{"15m": 6},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			matched := rule.Evaluate(test.values)
+			if test.expected == nil {
+				if matched != nil {
+					t.Errorf("expected no match, got %v", matched)
+				}
+				return
+			}
+			if len(matched) != len(test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, matched)
+			}
+			for metric, value := range test.expected {
+				if matched[metric] != value {
+					t.Errorf("%s: expected %v, got %v", metric, value, matched[metric])
+				}
+			}
+		})
+	}
+}
+
+func TestRuleMatches(t *testing.T) {
+	rule, err := NewRule(RuleConfig{
+		Name:     "btc",
+		Exchange: "Binance",
+		Symbols:  []string{"btcusdt"},
+		When:     []string{"close > 0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		exchange string
+		symbol   string
+		expected bool
+	}{
+		{"binance", "BTCUSDT", true},
+		{"binance", "ETHUSDT", false},
+		{"kucoin", "BTCUSDT", false},
+	}
+	for _, test := range tests {
+		if got := rule.Matches(test.exchange, test.symbol); got != test.expected {
+			t.Errorf("%s %s: expected %v, got %v", test.exchange, test.symbol,
+				test.expected, got)
+		}
+	}
+}
+
+func TestNewRuleErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config RuleConfig
+	}{
+		{"no name", RuleConfig{When: []string{"close > 0"}}},
+		{"no conditions", RuleConfig{Name: "empty"}},
+		{"invalid condition", RuleConfig{Name: "bad", When: []string{"close >"}}},
+		{"invalid cooldown", RuleConfig{Name: "bad", When: []string{"close > 0"}, Cooldown: "soon"}},
+	}
+	for _, test := range tests {
+		if _, err := NewRule(test.config); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
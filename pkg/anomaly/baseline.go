@@ -0,0 +1,261 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package anomaly scores values against a baseline of their recent history,
+// with a choice of baseline model.
+package anomaly
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	// The value as a multiple of the mean. This is the original volume
+	// spike test.
+	ModelRatio = "ratio"
+
+	// Standard deviations above the mean.
+	ModelMean = "mean"
+
+	// Standard deviations above an exponentially weighted mean, using an
+	// exponentially weighted variance, so recent history counts for more.
+	ModelEWMA = "ewma"
+
+	// Scaled median absolute deviations above the median. Robust to the
+	// heavy tailed volumes of small coins, where a few past spikes inflate
+	// the standard deviation and a quiet period deflates it.
+	ModelMAD = "mad"
+)
+
+var Models = []string{ModelRatio, ModelMean, ModelEWMA, ModelMAD}
+
+// Scales the MAD to be comparable to a standard deviation for normally
+// distributed values.
+const madScale = 1.4826
+
+// Scales the mean absolute deviation to be comparable to a standard
+// deviation, used when more than half the history is equal and the MAD is
+// 0.
+const meanAbsoluteDeviationScale = 1.2533
+
+type Config struct {
+	Model string `mapstructure:"model" json:"model"`
+
+	// A value is anomalous if its score is at least this.
+	Threshold float64 `mapstructure:"threshold" json:"threshold"`
+
+	// The number of previous values the baseline is calculated over.
+	Window int `mapstructure:"window" json:"window"`
+
+	// The EWMA smoothing factor, 2/(window+1) if 0.
+	Alpha float64 `mapstructure:"alpha" json:"alpha,omitempty"`
+}
+
+var DefaultConfig = Config{
+	Model:     ModelRatio,
+	Threshold: 5,
+	Window:    30,
+}
+
+// Override returns c with the fields that are set in override replaced.
+func (c Config) Override(override Config) Config {
+	if override.Model != "" {
+		c.Model = override.Model
+		// The alpha of one model makes no sense for another.
+		c.Alpha = 0
+	}
+	if override.Threshold != 0 {
+		c.Threshold = override.Threshold
+	}
+	if override.Window != 0 {
+		c.Window = override.Window
+	}
+	if override.Alpha != 0 {
+		c.Alpha = override.Alpha
+	}
+	return c
+}
+
+func (c Config) Validate() error {
+	if _, err := newModel(c); err != nil {
+		return err
+	}
+	if c.Window < 2 {
+		return fmt.Errorf("baseline window must be at least 2")
+	}
+	if c.Alpha < 0 || c.Alpha > 1 {
+		return fmt.Errorf("baseline alpha must be between 0 and 1")
+	}
+	return nil
+}
+
+type Result struct {
+	// How anomalous the value is, in the units of the model: a multiple
+	// for ratio, deviations for the others.
+	Score float64
+
+	// The expected value.
+	Baseline float64
+}
+
+type model interface {
+	score(history []float64, value float64) (Result, bool)
+}
+
+// Baseline scores values against their history as per a Config.
+type Baseline struct {
+	Config
+	model model
+}
+
+func New(config Config) (*Baseline, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	model, _ := newModel(config)
+	return &Baseline{
+		Config: config,
+		model:  model,
+	}, nil
+}
+
+func newModel(config Config) (model, error) {
+	switch config.Model {
+	case ModelRatio:
+		return ratioModel{}, nil
+	case ModelMean:
+		return meanModel{}, nil
+	case ModelEWMA:
+		alpha := config.Alpha
+		if alpha == 0 {
+			alpha = 2 / (float64(config.Window) + 1)
+		}
+		return ewmaModel{alpha: alpha}, nil
+	case ModelMAD:
+		return madModel{}, nil
+	}
+	return nil, fmt.Errorf("unknown baseline model: %q", config.Model)
+}
+
+// Score returns the score of value against the last Window values of
+// history, oldest first. Returns false if there is not enough history, or
+// the history has no variation to measure against.
+func (b *Baseline) Score(history []float64, value float64) (Result, bool) {
+	if len(history) < b.Window {
+		return Result{}, false
+	}
+	return b.model.score(history[len(history)-b.Window:], value)
+}
+
+// Anomalous returns true if the score meets the threshold.
+func (b *Baseline) Anomalous(result Result) bool {
+	return result.Score >= b.Threshold
+}
+
+// Describe describes a result for event messages, such as "5.2x the 30
+// period average".
+func (b *Baseline) Describe(result Result) string {
+	if b.Model == ModelRatio {
+		return fmt.Sprintf("%.1fx the %d period average", result.Score, b.Window)
+	}
+	return fmt.Sprintf("%.1f deviations above the %d period %s baseline",
+		result.Score, b.Window, b.Model)
+}
+
+type ratioModel struct{}
+
+func (ratioModel) score(history []float64, value float64) (Result, bool) {
+	mean, _ := meanStddev(history)
+	if mean <= 0 {
+		return Result{}, false
+	}
+	return Result{Score: value / mean, Baseline: mean}, true
+}
+
+type meanModel struct{}
+
+func (meanModel) score(history []float64, value float64) (Result, bool) {
+	mean, stddev := meanStddev(history)
+	if stddev <= 0 {
+		return Result{}, false
+	}
+	return Result{Score: (value - mean) / stddev, Baseline: mean}, true
+}
+
+type ewmaModel struct {
+	alpha float64
+}
+
+func (m ewmaModel) score(history []float64, value float64) (Result, bool) {
+	mean := history[0]
+	variance := float64(0)
+	for _, v := range history[1:] {
+		diff := v - mean
+		increment := m.alpha * diff
+		mean += increment
+		variance = (1 - m.alpha) * (variance + diff*increment)
+	}
+	if variance <= 0 {
+		return Result{}, false
+	}
+	return Result{Score: (value - mean) / math.Sqrt(variance), Baseline: mean}, true
+}
+
+type madModel struct{}
+
+func (madModel) score(history []float64, value float64) (Result, bool) {
+	middle := median(history)
+	deviations := make([]float64, len(history))
+	for i, v := range history {
+		deviations[i] = math.Abs(v - middle)
+	}
+	spread := median(deviations) * madScale
+	if spread <= 0 {
+		total := float64(0)
+		for _, deviation := range deviations {
+			total += deviation
+		}
+		spread = total / float64(len(deviations)) * meanAbsoluteDeviationScale
+	}
+	if spread <= 0 {
+		return Result{}, false
+	}
+	return Result{Score: (value - middle) / spread, Baseline: middle}, true
+}
+
+func meanStddev(values []float64) (float64, float64) {
+	total := float64(0)
+	for _, v := range values {
+		total += v
+	}
+	mean := total / float64(len(values))
+	variance := float64(0)
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+	return mean, math.Sqrt(variance / float64(len(values)))
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
@@ -0,0 +1,234 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package archive ships events and downsampled candles past their database
+// retention to S3 compatible object storage as Parquet files, keeping the
+// database small while preserving history.
+package archive
+
+import (
+	"encoding/json"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/candles"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/events"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+const parquetContentType = "application/vnd.apache.parquet"
+
+type Config struct {
+	// The S3 endpoint, such as https://s3.amazonaws.com or the address of
+	// a MinIO server. Archiving is disabled if the bucket is empty.
+	Endpoint string `mapstructure:"endpoint"`
+	Region   string `mapstructure:"region"`
+	Bucket   string `mapstructure:"bucket"`
+
+	// Prepended to the key of every object.
+	Prefix string `mapstructure:"prefix"`
+
+	// Credentials, read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+	// if not set.
+	AccessKey string `mapstructure:"access_key"`
+	SecretKey string `mapstructure:"secret_key"`
+
+	// Address the bucket as part of the path rather than the host name, as
+	// most S3 compatible servers require.
+	PathStyle bool `mapstructure:"path_style"`
+
+	// Candles are downsampled to this interval before archiving.
+	CandleInterval time.Duration `mapstructure:"candle_interval"`
+}
+
+var DefaultConfig = Config{
+	Endpoint:       "https://s3.amazonaws.com",
+	Region:         "us-east-1",
+	CandleInterval: time.Hour,
+}
+
+// Override returns c with the fields that are set in override replaced.
+func (c Config) Override(override Config) Config {
+	if override.Endpoint != "" {
+		c.Endpoint = override.Endpoint
+	}
+	if override.Region != "" {
+		c.Region = override.Region
+	}
+	if override.Bucket != "" {
+		c.Bucket = override.Bucket
+	}
+	if override.Prefix != "" {
+		c.Prefix = override.Prefix
+	}
+	if override.AccessKey != "" {
+		c.AccessKey = override.AccessKey
+	}
+	if override.SecretKey != "" {
+		c.SecretKey = override.SecretKey
+	}
+	if override.PathStyle {
+		c.PathStyle = true
+	}
+	if override.CandleInterval != 0 {
+		c.CandleInterval = override.CandleInterval
+	}
+	return c
+}
+
+func (c Config) Enabled() bool {
+	return c.Bucket != ""
+}
+
+var eventColumns = []Column{
+	{Name: "exchange", Type: StringColumn},
+	{Name: "symbol", Type: StringColumn},
+	{Name: "type", Type: StringColumn},
+	{Name: "timestamp", Type: TimestampColumn},
+	{Name: "message", Type: StringColumn},
+	{Name: "data", Type: StringColumn},
+}
+
+var candleColumns = []Column{
+	{Name: "exchange", Type: StringColumn},
+	{Name: "symbol", Type: StringColumn},
+	{Name: "interval", Type: StringColumn},
+	{Name: "open_time", Type: TimestampColumn},
+	{Name: "open", Type: DoubleColumn},
+	{Name: "high", Type: DoubleColumn},
+	{Name: "low", Type: DoubleColumn},
+	{Name: "close", Type: DoubleColumn},
+	{Name: "volume", Type: DoubleColumn},
+	{Name: "quote_volume", Type: DoubleColumn},
+	{Name: "taker_buy_quote_volume", Type: DoubleColumn},
+	{Name: "trades", Type: Int64Column},
+}
+
+// Archiver implements persist.Archiver, writing each call as a Parquet
+// object keyed by the date and range archived.
+type Archiver struct {
+	config Config
+	client *S3Client
+}
+
+func NewArchiver(config Config) (*Archiver, error) {
+	if config.AccessKey == "" {
+		config.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if config.SecretKey == "" {
+		config.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if config.AccessKey == "" || config.SecretKey == "" {
+		return nil, fmt.Errorf("archive credentials not set")
+	}
+	// Candles are archived an hour at a time, so longer intervals would be
+	// split across objects.
+	if config.CandleInterval < time.Minute || time.Hour%config.CandleInterval != 0 {
+		return nil, fmt.Errorf("archive candle interval must be at least 1m and divide 1h")
+	}
+	client, err := NewS3Client(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Archiver{
+		config: config,
+		client: client,
+	}, nil
+}
+
+// key returns the object key for a range, partitioned by the UTC date of
+// its start.
+func (a *Archiver) key(kind string, from time.Time, to time.Time, parts ...string) string {
+	elements := append([]string{a.config.Prefix, kind}, parts...)
+	elements = append(elements, from.UTC().Format("2006/01/02"),
+		fmt.Sprintf("%s-%d-%d.parquet", kind, from.Unix(), to.Unix()))
+	return path.Join(elements...)
+}
+
+func (a *Archiver) put(key string, writer *ParquetWriter) error {
+	body, err := writer.Bytes()
+	if err != nil {
+		return err
+	}
+	if err := a.client.Put(key, body, parquetContentType); err != nil {
+		return err
+	}
+	log.Printf("archive: wrote %d rows to %s\n", writer.Rows(), key)
+	return nil
+}
+
+func (a *Archiver) ArchiveEvents(from time.Time, to time.Time, archived []events.Event) error {
+	if len(archived) == 0 {
+		return nil
+	}
+	writer := NewParquetWriter(eventColumns...)
+	for _, event := range archived {
+		data, err := json.Marshal(event.Data)
+		if err != nil {
+			return err
+		}
+		if err := writer.Write(event.Exchange, event.Symbol, event.Type, event.Timestamp,
+			event.Message, string(data)); err != nil {
+			return err
+		}
+	}
+	return a.put(a.key("events", from, to), writer)
+}
+
+// ArchiveCandles downsamples the shortest interval of each symbol to the
+// candle interval. Candles of other intervals are dropped as they can be
+// derived from the archived candles.
+func (a *Archiver) ArchiveCandles(from time.Time, to time.Time, exchange string,
+	archived []candles.Candle) error {
+	bySymbol := map[string][]candles.Candle{}
+	for _, candle := range archived {
+		series := bySymbol[candle.Symbol]
+		if len(series) > 0 && candle.Interval > series[0].Interval {
+			continue
+		}
+		if len(series) > 0 && candle.Interval < series[0].Interval {
+			series = nil
+		}
+		bySymbol[candle.Symbol] = append(series, candle)
+	}
+	symbols := []string{}
+	for symbol := range bySymbol {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+
+	interval := candles.FormatInterval(a.config.CandleInterval)
+	writer := NewParquetWriter(candleColumns...)
+	for _, symbol := range symbols {
+		series := bySymbol[symbol]
+		if series[0].Interval > a.config.CandleInterval {
+			continue
+		}
+		candles.SortCandles(series)
+		for _, candle := range candles.Downsample(series, a.config.CandleInterval) {
+			if err := writer.Write(exchange, candle.Symbol, interval, candle.OpenTime,
+				candle.Open, candle.High, candle.Low, candle.Close, candle.Volume,
+				candle.QuoteVolume, candle.TakerBuyQuoteVolume, candle.Trades); err != nil {
+				return err
+			}
+		}
+	}
+	if writer.Rows() == 0 {
+		return nil
+	}
+	return a.put(a.key("candles", from, to, exchange, interval), writer)
+}
@@ -0,0 +1,388 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// ColumnType is the type of a Parquet column.
+type ColumnType int
+
+const (
+	Int64Column ColumnType = iota
+	DoubleColumn
+	StringColumn
+	BoolColumn
+
+	// Milliseconds since the epoch, written from a time.Time.
+	TimestampColumn
+)
+
+// Parquet physical types, encodings and converted types from the format
+// specification.
+const (
+	parquetBoolean   = 0
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetRequired = 0
+
+	parquetUtf8            = 0
+	parquetTimestampMillis = 9
+
+	parquetPlain = 0
+	parquetRle   = 3
+
+	parquetGzip = 2
+
+	parquetDataPage = 0
+)
+
+// Thrift compact protocol types.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+type Column struct {
+	Name string
+	Type ColumnType
+}
+
+func (c Column) physicalType() int32 {
+	switch c.Type {
+	case DoubleColumn:
+		return parquetDouble
+	case StringColumn:
+		return parquetByteArray
+	case BoolColumn:
+		return parquetBoolean
+	default:
+		return parquetInt64
+	}
+}
+
+// convertedType returns the converted type of the column, -1 if none.
+func (c Column) convertedType() int32 {
+	switch c.Type {
+	case StringColumn:
+		return parquetUtf8
+	case TimestampColumn:
+		return parquetTimestampMillis
+	default:
+		return -1
+	}
+}
+
+// ParquetWriter buffers rows in memory and encodes them as a Parquet file
+// with a single row group. Every column is required, plain encoded and
+// gzip compressed, which any Parquet reader supports.
+type ParquetWriter struct {
+	columns []Column
+	values  []bytes.Buffer
+	bools   [][]bool
+	rows    int
+}
+
+func NewParquetWriter(columns ...Column) *ParquetWriter {
+	return &ParquetWriter{
+		columns: columns,
+		values:  make([]bytes.Buffer, len(columns)),
+		bools:   make([][]bool, len(columns)),
+	}
+}
+
+// Rows returns the number of rows written.
+func (w *ParquetWriter) Rows() int {
+	return w.rows
+}
+
+// Write adds a row, with a value for each column in order.
+func (w *ParquetWriter) Write(values ...interface{}) error {
+	if len(values) != len(w.columns) {
+		return fmt.Errorf("expected %d values, got %d", len(w.columns), len(values))
+	}
+	// Validate the whole row first so a bad value does not leave the
+	// columns with different lengths.
+	for i, value := range values {
+		if !w.columns[i].accepts(value) {
+			return fmt.Errorf("column %s: unexpected value type %T", w.columns[i].Name, value)
+		}
+	}
+	var scratch [8]byte
+	for i, value := range values {
+		buffer := &w.values[i]
+		switch value := value.(type) {
+		case int64:
+			binary.LittleEndian.PutUint64(scratch[:], uint64(value))
+			buffer.Write(scratch[:])
+		case int:
+			binary.LittleEndian.PutUint64(scratch[:], uint64(value))
+			buffer.Write(scratch[:])
+		case time.Time:
+			millis := value.UnixNano() / int64(time.Millisecond)
+			binary.LittleEndian.PutUint64(scratch[:], uint64(millis))
+			buffer.Write(scratch[:])
+		case float64:
+			binary.LittleEndian.PutUint64(scratch[:], math.Float64bits(value))
+			buffer.Write(scratch[:])
+		case string:
+			binary.LittleEndian.PutUint32(scratch[:4], uint32(len(value)))
+			buffer.Write(scratch[:4])
+			buffer.WriteString(value)
+		case bool:
+			w.bools[i] = append(w.bools[i], value)
+		}
+	}
+	w.rows++
+	return nil
+}
+
+func (c Column) accepts(value interface{}) bool {
+	switch value.(type) {
+	case int64, int:
+		return c.Type == Int64Column
+	case time.Time:
+		return c.Type == TimestampColumn
+	case float64:
+		return c.Type == DoubleColumn
+	case string:
+		return c.Type == StringColumn
+	case bool:
+		return c.Type == BoolColumn
+	}
+	return false
+}
+
+type columnChunk struct {
+	offset           int64
+	uncompressedSize int64
+	compressedSize   int64
+}
+
+// Bytes encodes the rows written as a Parquet file.
+func (w *ParquetWriter) Bytes() ([]byte, error) {
+	file := bytes.Buffer{}
+	file.WriteString("PAR1")
+
+	chunks := make([]columnChunk, len(w.columns))
+	for i := range w.columns {
+		page := w.values[i].Bytes()
+		if w.columns[i].Type == BoolColumn {
+			page = packBools(w.bools[i])
+		}
+		compressed := bytes.Buffer{}
+		writer := gzip.NewWriter(&compressed)
+		if _, err := writer.Write(page); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+
+		header := newThriftWriter()
+		header.i32Field(1, parquetDataPage)
+		header.i32Field(2, int32(len(page)))
+		header.i32Field(3, int32(compressed.Len()))
+		header.structField(5)
+		header.i32Field(1, int32(w.rows))
+		header.i32Field(2, parquetPlain)
+		header.i32Field(3, parquetRle)
+		header.i32Field(4, parquetRle)
+		header.structEnd()
+		header.structEnd()
+
+		chunks[i] = columnChunk{
+			offset:           int64(file.Len()),
+			uncompressedSize: int64(header.buffer.Len() + len(page)),
+			compressedSize:   int64(header.buffer.Len() + compressed.Len()),
+		}
+		file.Write(header.buffer.Bytes())
+		file.Write(compressed.Bytes())
+	}
+
+	footer := w.footer(chunks)
+	file.Write(footer)
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(footer)))
+	file.Write(length[:])
+	file.WriteString("PAR1")
+	return file.Bytes(), nil
+}
+
+// footer encodes the FileMetaData of the file.
+func (w *ParquetWriter) footer(chunks []columnChunk) []byte {
+	t := newThriftWriter()
+	t.i32Field(1, 1)
+
+	t.listField(2, thriftStruct, len(w.columns)+1)
+	t.structElement()
+	t.stringField(4, "schema")
+	t.i32Field(5, int32(len(w.columns)))
+	t.structEnd()
+	for _, column := range w.columns {
+		t.structElement()
+		t.i32Field(1, column.physicalType())
+		t.i32Field(3, parquetRequired)
+		t.stringField(4, column.Name)
+		if converted := column.convertedType(); converted >= 0 {
+			t.i32Field(6, converted)
+		}
+		t.structEnd()
+	}
+
+	t.i64Field(3, int64(w.rows))
+
+	totalSize := int64(0)
+	for _, chunk := range chunks {
+		totalSize += chunk.uncompressedSize
+	}
+	t.listField(4, thriftStruct, 1)
+	t.structElement()
+	t.listField(1, thriftStruct, len(w.columns))
+	for i, column := range w.columns {
+		chunk := chunks[i]
+		t.structElement()
+		t.i64Field(2, chunk.offset)
+		t.structField(3)
+		t.i32Field(1, column.physicalType())
+		t.listField(2, thriftI32, 2)
+		t.i32(parquetPlain)
+		t.i32(parquetRle)
+		t.listField(3, thriftBinary, 1)
+		t.string(column.Name)
+		t.i32Field(4, parquetGzip)
+		t.i64Field(5, int64(w.rows))
+		t.i64Field(6, chunk.uncompressedSize)
+		t.i64Field(7, chunk.compressedSize)
+		t.i64Field(9, chunk.offset)
+		t.structEnd()
+		t.structEnd()
+	}
+	t.i64Field(2, totalSize)
+	t.i64Field(3, int64(w.rows))
+	t.structEnd()
+
+	t.stringField(6, "cryptoxscanner")
+	t.structEnd()
+	return t.buffer.Bytes()
+}
+
+// packBools bit packs booleans, least significant bit first, as plain
+// encoded by Parquet.
+func packBools(values []bool) []byte {
+	packed := make([]byte, (len(values)+7)/8)
+	for i, value := range values {
+		if value {
+			packed[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return packed
+}
+
+// thriftWriter encodes structs in the Thrift compact protocol, as used for
+// the Parquet page headers and footer. The writer starts within a struct,
+// ended with structEnd like any other.
+type thriftWriter struct {
+	buffer bytes.Buffer
+
+	// The last field ID of each struct being written, innermost last.
+	lastFields []int16
+}
+
+func newThriftWriter() *thriftWriter {
+	return &thriftWriter{
+		lastFields: []int16{0},
+	}
+}
+
+func (t *thriftWriter) varint(value uint64) {
+	var scratch [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(scratch[:], value)
+	t.buffer.Write(scratch[:n])
+}
+
+func (t *thriftWriter) fieldHeader(id int16, fieldType byte) {
+	last := &t.lastFields[len(t.lastFields)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.buffer.WriteByte(byte(delta)<<4 | fieldType)
+	} else {
+		t.buffer.WriteByte(fieldType)
+		t.varint(uint64(uint16((id << 1) ^ (id >> 15))))
+	}
+	*last = id
+}
+
+func (t *thriftWriter) i32(value int32) {
+	t.varint(uint64(uint32((value << 1) ^ (value >> 31))))
+}
+
+func (t *thriftWriter) string(value string) {
+	t.varint(uint64(len(value)))
+	t.buffer.WriteString(value)
+}
+
+func (t *thriftWriter) i32Field(id int16, value int32) {
+	t.fieldHeader(id, thriftI32)
+	t.i32(value)
+}
+
+func (t *thriftWriter) i64Field(id int16, value int64) {
+	t.fieldHeader(id, thriftI64)
+	t.varint(uint64((value << 1) ^ (value >> 63)))
+}
+
+func (t *thriftWriter) stringField(id int16, value string) {
+	t.fieldHeader(id, thriftBinary)
+	t.string(value)
+}
+
+// listField starts a list field of size elements, which are written next.
+func (t *thriftWriter) listField(id int16, elementType byte, size int) {
+	t.fieldHeader(id, thriftList)
+	if size < 15 {
+		t.buffer.WriteByte(byte(size)<<4 | elementType)
+	} else {
+		t.buffer.WriteByte(0xf0 | elementType)
+		t.varint(uint64(size))
+	}
+}
+
+// structField starts a struct field, ended with structEnd.
+func (t *thriftWriter) structField(id int16) {
+	t.fieldHeader(id, thriftStruct)
+	t.lastFields = append(t.lastFields, 0)
+}
+
+// structElement starts a struct list element, ended with structEnd.
+func (t *thriftWriter) structElement() {
+	t.lastFields = append(t.lastFields, 0)
+}
+
+func (t *thriftWriter) structEnd() {
+	t.buffer.WriteByte(0)
+	t.lastFields = t.lastFields[:len(t.lastFields)-1]
+}
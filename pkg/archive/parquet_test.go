@@ -0,0 +1,430 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// thriftReader decodes Thrift compact protocol structs generically, as a
+// map of field ID to value, so the file can be checked against the Parquet
+// format without sharing any code with the writer.
+type thriftReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *thriftReader) byte() byte {
+	if r.pos >= len(r.data) {
+		if r.err == nil {
+			r.err = fmt.Errorf("unexpected end of data at %d", r.pos)
+		}
+		return 0
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *thriftReader) varint() uint64 {
+	value := uint64(0)
+	for shift := uint(0); shift < 64; shift += 7 {
+		b := r.byte()
+		value |= uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	return value
+}
+
+func (r *thriftReader) zigzag() int64 {
+	value := r.varint()
+	return int64(value>>1) ^ -int64(value&1)
+}
+
+func (r *thriftReader) readStruct() map[int16]interface{} {
+	fields := map[int16]interface{}{}
+	last := int16(0)
+	for r.err == nil {
+		header := r.byte()
+		if header == 0 {
+			break
+		}
+		id := last + int16(header>>4)
+		if header>>4 == 0 {
+			id = int16(r.zigzag())
+		}
+		last = id
+		fieldType := header & 0x0f
+		switch fieldType {
+		case 1:
+			fields[id] = true
+		case 2:
+			fields[id] = false
+		default:
+			fields[id] = r.readValue(fieldType)
+		}
+	}
+	return fields
+}
+
+func (r *thriftReader) readValue(valueType byte) interface{} {
+	switch valueType {
+	case 1, 2:
+		return r.byte() == 1
+	case 3:
+		return int64(int8(r.byte()))
+	case 4, 5, 6:
+		return r.zigzag()
+	case 7:
+		var scratch [8]byte
+		for i := range scratch {
+			scratch[i] = r.byte()
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(scratch[:]))
+	case 8:
+		length := int(r.varint())
+		if r.pos+length > len(r.data) {
+			r.err = fmt.Errorf("binary of %d bytes overruns data at %d", length, r.pos)
+			return ""
+		}
+		value := string(r.data[r.pos : r.pos+length])
+		r.pos += length
+		return value
+	case 9, 10:
+		header := r.byte()
+		size := int(header >> 4)
+		if size == 15 {
+			size = int(r.varint())
+		}
+		list := []interface{}{}
+		for i := 0; i < size && r.err == nil; i++ {
+			list = append(list, r.readValue(header&0x0f))
+		}
+		return list
+	case 12:
+		return r.readStruct()
+	}
+	r.err = fmt.Errorf("unsupported thrift type %d at %d", valueType, r.pos)
+	return nil
+}
+
+type parquetColumn struct {
+	name          string
+	physicalType  int64
+	convertedType int64
+	values        []interface{}
+}
+
+// readParquet reads a file as written by ParquetWriter the way a reader
+// would: locating the footer from the end of the file and each page from
+// the column chunk metadata.
+func readParquet(t *testing.T, data []byte) []parquetColumn {
+	t.Helper()
+	if len(data) < 12 || string(data[:4]) != "PAR1" || string(data[len(data)-4:]) != "PAR1" {
+		t.Fatalf("missing PAR1 magic")
+	}
+	footerLength := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	footerStart := len(data) - 8 - footerLength
+	if footerStart < 4 {
+		t.Fatalf("footer length %d overruns file of %d bytes", footerLength, len(data))
+	}
+	footer := &thriftReader{data: data[footerStart : len(data)-8]}
+	meta := footer.readStruct()
+	if footer.err != nil {
+		t.Fatalf("decoding footer: %v", footer.err)
+	}
+	if footer.pos != footerLength {
+		t.Fatalf("footer decoded %d of %d bytes", footer.pos, footerLength)
+	}
+	if meta[1] != int64(1) {
+		t.Errorf("expected version 1, got %v", meta[1])
+	}
+	rows := meta[3].(int64)
+
+	schema := meta[2].([]interface{})
+	root := schema[0].(map[int16]interface{})
+	if root[5] != int64(len(schema)-1) {
+		t.Fatalf("root has %v children, schema has %d columns", root[5], len(schema)-1)
+	}
+
+	rowGroups := meta[4].([]interface{})
+	if len(rowGroups) != 1 {
+		t.Fatalf("expected 1 row group, got %d", len(rowGroups))
+	}
+	rowGroup := rowGroups[0].(map[int16]interface{})
+	if rowGroup[3] != rows {
+		t.Errorf("row group has %v rows, file has %d", rowGroup[3], rows)
+	}
+	chunks := rowGroup[1].([]interface{})
+	if len(chunks) != len(schema)-1 {
+		t.Fatalf("expected %d column chunks, got %d", len(schema)-1, len(chunks))
+	}
+
+	columns := []parquetColumn{}
+	totalSize := int64(0)
+	for i, chunk := range chunks {
+		element := schema[i+1].(map[int16]interface{})
+		column := parquetColumn{
+			name:          element[4].(string),
+			physicalType:  element[1].(int64),
+			convertedType: -1,
+		}
+		if converted, ok := element[6]; ok {
+			column.convertedType = converted.(int64)
+		}
+		if element[3] != int64(parquetRequired) {
+			t.Errorf("column %s: expected required, got %v", column.name, element[3])
+		}
+
+		chunkMeta := chunk.(map[int16]interface{})[3].(map[int16]interface{})
+		if chunkMeta[1] != column.physicalType {
+			t.Errorf("column %s: chunk type %v, schema type %d",
+				column.name, chunkMeta[1], column.physicalType)
+		}
+		if path := chunkMeta[3].([]interface{}); len(path) != 1 || path[0] != column.name {
+			t.Errorf("column %s: unexpected path %v", column.name, path)
+		}
+		if chunkMeta[4] != int64(parquetGzip) {
+			t.Errorf("column %s: expected gzip, got codec %v", column.name, chunkMeta[4])
+		}
+		if chunkMeta[5] != rows {
+			t.Errorf("column %s: %v values, expected %d", column.name, chunkMeta[5], rows)
+		}
+		totalSize += chunkMeta[6].(int64)
+
+		offset := int(chunkMeta[9].(int64))
+		pageReader := &thriftReader{data: data[offset:footerStart]}
+		page := pageReader.readStruct()
+		if pageReader.err != nil {
+			t.Fatalf("column %s: decoding page header: %v", column.name, pageReader.err)
+		}
+		if page[1] != int64(parquetDataPage) {
+			t.Fatalf("column %s: expected a data page, got %v", column.name, page[1])
+		}
+		dataPage := page[5].(map[int16]interface{})
+		if dataPage[1] != rows || dataPage[2] != int64(parquetPlain) {
+			t.Errorf("column %s: unexpected data page header %v", column.name, dataPage)
+		}
+		uncompressedSize := page[2].(int64)
+		compressedSize := page[3].(int64)
+		if int64(pageReader.pos)+compressedSize != chunkMeta[7] {
+			t.Errorf("column %s: chunk compressed size %v, page is %d",
+				column.name, chunkMeta[7], int64(pageReader.pos)+compressedSize)
+		}
+		if int64(pageReader.pos)+uncompressedSize != chunkMeta[6] {
+			t.Errorf("column %s: chunk uncompressed size %v, page is %d",
+				column.name, chunkMeta[6], int64(pageReader.pos)+uncompressedSize)
+		}
+
+		start := offset + pageReader.pos
+		reader, err := gzip.NewReader(bytes.NewReader(data[start : start+int(compressedSize)]))
+		if err != nil {
+			t.Fatalf("column %s: %v", column.name, err)
+		}
+		values, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("column %s: %v", column.name, err)
+		}
+		if int64(len(values)) != uncompressedSize {
+			t.Fatalf("column %s: page is %d bytes, header says %d",
+				column.name, len(values), uncompressedSize)
+		}
+		column.values = decodePlain(t, column, values, int(rows))
+		columns = append(columns, column)
+	}
+	if rowGroup[2] != totalSize {
+		t.Errorf("row group size %v, column chunks total %d", rowGroup[2], totalSize)
+	}
+	return columns
+}
+
+// decodePlain decodes the plain encoded values of a required column.
+func decodePlain(t *testing.T, column parquetColumn, page []byte, rows int) []interface{} {
+	t.Helper()
+	values := []interface{}{}
+	if column.physicalType == parquetBoolean {
+		if len(page) != (rows+7)/8 {
+			t.Fatalf("column %s: %d bytes for %d booleans", column.name, len(page), rows)
+		}
+		for i := 0; i < rows; i++ {
+			values = append(values, page[i/8]&(1<<uint(i%8)) != 0)
+		}
+		return values
+	}
+	for len(page) > 0 {
+		switch column.physicalType {
+		case parquetInt64:
+			values = append(values, int64(binary.LittleEndian.Uint64(page)))
+			page = page[8:]
+		case parquetDouble:
+			values = append(values, math.Float64frombits(binary.LittleEndian.Uint64(page)))
+			page = page[8:]
+		case parquetByteArray:
+			length := int(binary.LittleEndian.Uint32(page))
+			values = append(values, string(page[4:4+length]))
+			page = page[4+length:]
+		default:
+			t.Fatalf("column %s: unexpected type %d", column.name, column.physicalType)
+		}
+	}
+	if len(values) != rows {
+		t.Fatalf("column %s: decoded %d values, expected %d", column.name, len(values), rows)
+	}
+	return values
+}
+
+func TestParquetWriterRoundTrip(t *testing.T) {
+	writer := NewParquetWriter(
+		Column{Name: "symbol", Type: StringColumn},
+		Column{Name: "id", Type: Int64Column},
+		Column{Name: "time", Type: TimestampColumn},
+		Column{Name: "price", Type: DoubleColumn},
+		Column{Name: "buyer", Type: BoolColumn},
+	)
+	start := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	expected := [][]interface{}{{}, {}, {}, {}, {}}
+	symbols := []string{"ETHBTC", "", "LTCBTC", "ÉTH₿"}
+
+	// More than 8 rows so the booleans span bytes.
+	for i := 0; i < 11; i++ {
+		symbol := symbols[i%len(symbols)]
+		id := int64(i*1000 - 5000)
+		when := start.Add(time.Duration(i) * 1500 * time.Millisecond)
+		price := 0.001 * float64(i*i)
+		buyer := i%3 == 0
+		if err := writer.Write(symbol, id, when, price, buyer); err != nil {
+			t.Fatal(err)
+		}
+		for column, value := range []interface{}{symbol, id,
+			when.UnixNano() / int64(time.Millisecond), price, buyer} {
+			expected[column] = append(expected[column], value)
+		}
+	}
+
+	// Rejected rows are not written.
+	if err := writer.Write("ETHBTC", int64(1)); err == nil {
+		t.Errorf("expected an error for a short row")
+	}
+	if err := writer.Write("ETHBTC", int64(1), start, "0.1", true); err == nil {
+		t.Errorf("expected an error for a string price")
+	}
+	if writer.Rows() != 11 {
+		t.Errorf("expected 11 rows, got %d", writer.Rows())
+	}
+
+	data, err := writer.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	columns := readParquet(t, data)
+
+	types := []struct {
+		name          string
+		physicalType  int64
+		convertedType int64
+	}{
+		{"symbol", parquetByteArray, parquetUtf8},
+		{"id", parquetInt64, -1},
+		{"time", parquetInt64, parquetTimestampMillis},
+		{"price", parquetDouble, -1},
+		{"buyer", parquetBoolean, -1},
+	}
+	if len(columns) != len(types) {
+		t.Fatalf("expected %d columns, got %d", len(types), len(columns))
+	}
+	for i, column := range columns {
+		if column.name != types[i].name || column.physicalType != types[i].physicalType ||
+			column.convertedType != types[i].convertedType {
+			t.Errorf("column %d: expected %v, got %s %d %d", i, types[i],
+				column.name, column.physicalType, column.convertedType)
+		}
+		if !reflect.DeepEqual(column.values, expected[i]) {
+			t.Errorf("column %s: expected %v, got %v", column.name, expected[i], column.values)
+		}
+	}
+}
+
+func TestParquetWriterManyColumns(t *testing.T) {
+	// More than 14 list elements take the long form of the list header.
+	columns := []Column{}
+	row := []interface{}{}
+	for i := 0; i < 20; i++ {
+		columns = append(columns, Column{Name: fmt.Sprintf("c%d", i), Type: Int64Column})
+		row = append(row, i)
+	}
+	writer := NewParquetWriter(columns...)
+	if err := writer.Write(row...); err != nil {
+		t.Fatal(err)
+	}
+	data, err := writer.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, column := range readParquet(t, data) {
+		if column.name != columns[i].Name || !reflect.DeepEqual(column.values, []interface{}{int64(i)}) {
+			t.Errorf("column %d: unexpected %s %v", i, column.name, column.values)
+		}
+	}
+}
+
+func TestThriftWriterCompact(t *testing.T) {
+	// Encodings worked by hand from the compact protocol specification.
+	tests := []struct {
+		name     string
+		write    func(w *thriftWriter)
+		expected []byte
+	}{
+		{"short field", func(w *thriftWriter) { w.i32Field(1, -1) }, []byte{0x15, 0x01}},
+		{"field delta", func(w *thriftWriter) {
+			w.i32Field(1, 1)
+			w.i64Field(3, 150)
+		}, []byte{0x15, 0x02, 0x26, 0xac, 0x02}},
+		{"long field", func(w *thriftWriter) { w.stringField(20, "a") }, []byte{0x08, 0x28, 0x01, 'a'}},
+		{"short list", func(w *thriftWriter) {
+			w.listField(1, thriftI32, 2)
+			w.i32(0)
+			w.i32(3)
+		}, []byte{0x19, 0x25, 0x00, 0x06}},
+		{"long list", func(w *thriftWriter) { w.listField(1, thriftStruct, 20) }, []byte{0x19, 0xfc, 0x14}},
+		{"nested struct", func(w *thriftWriter) {
+			w.i32Field(4, 0)
+			w.structField(5)
+			w.i32Field(1, 7)
+			w.structEnd()
+			w.i32Field(6, 0)
+		}, []byte{0x45, 0x00, 0x1c, 0x15, 0x0e, 0x00, 0x15, 0x00}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := newThriftWriter()
+			test.write(w)
+			if !bytes.Equal(w.buffer.Bytes(), test.expected) {
+				t.Errorf("expected % x, got % x", test.expected, w.buffer.Bytes())
+			}
+		})
+	}
+}
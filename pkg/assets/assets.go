@@ -0,0 +1,591 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package assets provides metadata of assets, their full and localized
+// names and icons, from CoinGecko. It is cached on disk and refreshed in
+// the background, so frontends can display "Cardano (ADA)" and logos
+// without a metadata service of their own.
+package assets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/metrics"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	metrics.Describe("assets_requests_total",
+		"Requests made to the asset metadata source.")
+	metrics.Describe("assets_request_errors_total",
+		"Failed requests to the asset metadata source.")
+}
+
+const SourceCoinGecko = "coingecko"
+
+const (
+	// How often the assets of the exchanges are checked for ones that are
+	// missing or due a refresh.
+	checkInterval = time.Hour
+
+	// The most coin IDs requested in one market data request.
+	marketsBatchSize = 100
+
+	// The shortest refresh interval.
+	minRefreshInterval = time.Minute
+)
+
+type Config struct {
+	// The metadata source, coingecko, disabled if empty.
+	Source string `mapstructure:"source" json:"source"`
+
+	// The base URL of the CoinGecko API, and the API key if any. Keys of
+	// the pro API, at pro-api.coingecko.com, are sent as pro keys, others
+	// as demo keys.
+	URL    string `mapstructure:"url" json:"url"`
+	APIKey string `mapstructure:"api_key" json:"-"`
+
+	// The languages names are provided in, such as en, de or ja. The first
+	// is the default of responses.
+	Languages []string `mapstructure:"languages" json:"languages"`
+
+	// CoinGecko IDs of assets whose symbol is used by more than one coin,
+	// keyed by asset, such as ONE: harmony. Otherwise the coin with the
+	// largest market cap is used.
+	IDs map[string]string `mapstructure:"ids" json:"ids,omitempty"`
+
+	// How often the metadata of an asset is refreshed.
+	RefreshInterval time.Duration `mapstructure:"refresh_interval" json:"refresh_interval"`
+
+	// The time between requests, to stay within the rate limit of the
+	// API.
+	RequestInterval time.Duration `mapstructure:"request_interval" json:"request_interval"`
+}
+
+var DefaultConfig = Config{
+	URL:             "https://api.coingecko.com/api/v3",
+	Languages:       []string{"en"},
+	RefreshInterval: 7 * 24 * time.Hour,
+	RequestInterval: 3 * time.Second,
+}
+
+// Override returns c with the fields that are set in override replaced.
+func (c Config) Override(override Config) Config {
+	if override.Source != "" {
+		c.Source = override.Source
+	}
+	if override.URL != "" {
+		c.URL = override.URL
+	}
+	if override.APIKey != "" {
+		c.APIKey = override.APIKey
+	}
+	if len(override.Languages) > 0 {
+		c.Languages = override.Languages
+	}
+	if len(override.IDs) > 0 {
+		c.IDs = override.IDs
+	}
+	if override.RefreshInterval != 0 {
+		c.RefreshInterval = override.RefreshInterval
+	}
+	if override.RequestInterval != 0 {
+		c.RequestInterval = override.RequestInterval
+	}
+	return c
+}
+
+func (c Config) Validate() error {
+	if c.Source != "" && c.Source != SourceCoinGecko {
+		return fmt.Errorf("unknown asset metadata source: %s", c.Source)
+	}
+	if len(c.Languages) == 0 {
+		return fmt.Errorf("asset metadata requires at least one language")
+	}
+	for _, language := range c.Languages {
+		if language == "" || strings.ToLower(language) != language {
+			return fmt.Errorf("invalid asset metadata language %q, expected a lower case code such as en", language)
+		}
+	}
+	if c.RefreshInterval < minRefreshInterval {
+		return fmt.Errorf("asset metadata refresh interval must be at least %v", minRefreshInterval)
+	}
+	if c.RequestInterval < 0 {
+		return fmt.Errorf("asset metadata request interval must not be negative")
+	}
+	return nil
+}
+
+func (c Config) Enabled() bool {
+	return c.Source != ""
+}
+
+// Asset is the metadata of an asset as cached.
+type Asset struct {
+	Symbol string `json:"symbol"`
+
+	// The CoinGecko ID, empty if the asset is not known to CoinGecko.
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+
+	// Names keyed by language, for the configured languages that have one.
+	Names map[string]string `json:"names,omitempty"`
+
+	// The URL of the icon.
+	Image string `json:"image,omitempty"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// LocalName returns the name of the asset in a language, the English name
+// if it has none.
+func (a Asset) LocalName(language string) string {
+	if name := a.Names[language]; name != "" {
+		return name
+	}
+	return a.Name
+}
+
+// Metadata is the metadata of an asset in one language, as attached to
+// responses.
+type Metadata struct {
+	Symbol string `json:"symbol"`
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+
+	// The name with the symbol, such as "Cardano (ADA)".
+	Display string `json:"display"`
+	Image   string `json:"image,omitempty"`
+}
+
+func (a Asset) Metadata(language string) Metadata {
+	name := a.LocalName(language)
+	return Metadata{
+		Symbol:  a.Symbol,
+		ID:      a.ID,
+		Name:    name,
+		Display: fmt.Sprintf("%s (%s)", name, a.Symbol),
+		Image:   a.Image,
+	}
+}
+
+// Store holds the metadata of the assets of the exchanges, refreshing it
+// from the source when missing or older than the refresh interval.
+type Store struct {
+	config   Config
+	filename string
+
+	// Returns the assets the metadata is wanted for.
+	wanted func() []string
+
+	client      *http.Client
+	lastRequest time.Time
+
+	lock   sync.RWMutex
+	assets map[string]*Asset
+
+	requests      *metrics.Counter
+	requestErrors *metrics.Counter
+}
+
+// NewStore loads the metadata cached in filename, if it exists. wanted
+// returns the assets to fetch the metadata of, such as the base and quote
+// assets of the symbols of the exchanges.
+func NewStore(config Config, filename string, wanted func() []string) (*Store, error) {
+	s := &Store{
+		config:   config,
+		filename: filename,
+		wanted:   wanted,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+		assets:        map[string]*Asset{},
+		requests:      metrics.GetCounter("assets_requests_total", nil),
+		requestErrors: metrics.GetCounter("assets_request_errors_total", nil),
+	}
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	assets := []*Asset{}
+	if err := json.Unmarshal(buf, &assets); err != nil {
+		return nil, err
+	}
+	for _, asset := range assets {
+		s.assets[asset.Symbol] = asset
+	}
+	return s, nil
+}
+
+// Language returns language if it is configured, otherwise the default
+// language.
+func (s *Store) Language(language string) string {
+	language = strings.ToLower(language)
+	for _, configured := range s.config.Languages {
+		if configured == language {
+			return language
+		}
+	}
+	return s.config.Languages[0]
+}
+
+// Get returns the metadata of an asset, false if it is not known.
+func (s *Store) Get(asset string) (Asset, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	cached := s.assets[strings.ToUpper(asset)]
+	if cached == nil || cached.ID == "" {
+		return Asset{}, false
+	}
+	return *cached, true
+}
+
+// Metadata returns the metadata of an asset in a language, nil if it is not
+// known.
+func (s *Store) Metadata(asset string, language string) *Metadata {
+	cached, ok := s.Get(asset)
+	if !ok {
+		return nil
+	}
+	metadata := cached.Metadata(s.Language(language))
+	return &metadata
+}
+
+// Assets returns the metadata of the known assets, sorted by symbol.
+func (s *Store) Assets() []Asset {
+	s.lock.RLock()
+	assets := []Asset{}
+	for _, asset := range s.assets {
+		if asset.ID != "" {
+			assets = append(assets, *asset)
+		}
+	}
+	s.lock.RUnlock()
+	sort.Slice(assets, func(i, j int) bool {
+		return assets[i].Symbol < assets[j].Symbol
+	})
+	return assets
+}
+
+func (s *Store) Run(ctx context.Context) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.refresh(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("error: assets: failed to refresh metadata: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// stale returns the wanted assets that are not cached or are due a
+// refresh.
+func (s *Store) stale(now time.Time) []string {
+	wanted := s.wanted()
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	stale := []string{}
+	seen := map[string]bool{}
+	for _, asset := range wanted {
+		asset = strings.ToUpper(asset)
+		if asset == "" || seen[asset] {
+			continue
+		}
+		seen[asset] = true
+		cached := s.assets[asset]
+		if cached == nil || now.Sub(cached.UpdatedAt) >= s.config.RefreshInterval {
+			stale = append(stale, asset)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+// refresh fetches the metadata of the stale assets. Assets not known to
+// CoinGecko are cached without an ID so they are not looked up again until
+// the refresh interval has passed.
+func (s *Store) refresh(ctx context.Context) error {
+	now := time.Now()
+	stale := s.stale(now)
+	if len(stale) == 0 {
+		return nil
+	}
+	log.Printf("assets: refreshing the metadata of %d assets\n", len(stale))
+
+	// Every coin using each symbol.
+	coins := []coin{}
+	if err := s.request(ctx, "/coins/list", nil, &coins); err != nil {
+		return err
+	}
+	candidates := map[string][]string{}
+	for _, asset := range stale {
+		candidates[asset] = nil
+	}
+	for _, coin := range coins {
+		symbol := strings.ToUpper(coin.Symbol)
+		if ids, ok := candidates[symbol]; ok {
+			candidates[symbol] = append(ids, coin.ID)
+		}
+	}
+	for asset, id := range s.config.IDs {
+		asset = strings.ToUpper(asset)
+		if _, ok := candidates[asset]; ok {
+			candidates[asset] = []string{id}
+		}
+	}
+
+	// The market data of the candidates, to choose the coin with the
+	// largest market cap, with its name and icon.
+	ids := []string{}
+	for _, asset := range stale {
+		ids = append(ids, candidates[asset]...)
+	}
+	markets := map[string]market{}
+	for start := 0; start < len(ids); start += marketsBatchSize {
+		end := start + marketsBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		batch := []market{}
+		if err := s.request(ctx, "/coins/markets", url.Values{
+			"vs_currency": {"usd"},
+			"ids":         {strings.Join(ids[start:end], ",")},
+			"per_page":    {"250"},
+		}, &batch); err != nil {
+			return err
+		}
+		for _, market := range batch {
+			markets[market.ID] = market
+		}
+	}
+
+	localize := false
+	for _, language := range s.config.Languages {
+		if language != "en" {
+			localize = true
+		}
+	}
+
+	found := 0
+	defer func() {
+		s.save()
+		log.Printf("assets: found the metadata of %d of %d assets\n", found, len(stale))
+	}()
+	for _, symbol := range stale {
+		asset := &Asset{
+			Symbol:    symbol,
+			UpdatedAt: now,
+		}
+		if best, ok := chooseMarket(candidates[symbol], markets); ok {
+			asset.ID = best.ID
+			asset.Name = best.Name
+			asset.Image = best.Image
+		} else if len(candidates[symbol]) == 1 {
+			// Coins without market data are only used if unambiguous.
+			for _, coin := range coins {
+				if coin.ID == candidates[symbol][0] {
+					asset.ID = coin.ID
+					asset.Name = coin.Name
+				}
+			}
+		}
+		if asset.ID != "" && localize {
+			details := coinDetails{}
+			if err := s.request(ctx, "/coins/"+url.PathEscape(asset.ID), url.Values{
+				"localization":   {"true"},
+				"tickers":        {"false"},
+				"market_data":    {"false"},
+				"community_data": {"false"},
+				"developer_data": {"false"},
+				"sparkline":      {"false"},
+			}, &details); err != nil {
+				return err
+			}
+			asset.Names = map[string]string{}
+			for _, language := range s.config.Languages {
+				if name := details.Localization[language]; name != "" {
+					asset.Names[language] = name
+				}
+			}
+			if asset.Image == "" {
+				asset.Image = details.Image.Large
+			}
+		}
+		if asset.ID != "" {
+			found++
+		}
+		s.lock.Lock()
+		s.assets[symbol] = asset
+		s.lock.Unlock()
+	}
+	return nil
+}
+
+// chooseMarket returns the candidate with the largest market cap, those
+// without a rank last.
+func chooseMarket(ids []string, markets map[string]market) (market, bool) {
+	var best market
+	found := false
+	for _, id := range ids {
+		market, ok := markets[id]
+		if !ok {
+			continue
+		}
+		if !found || (market.MarketCapRank > 0 &&
+			(best.MarketCapRank == 0 || market.MarketCapRank < best.MarketCapRank)) {
+			best = market
+			found = true
+		}
+	}
+	return best, found
+}
+
+type coin struct {
+	ID     string `json:"id"`
+	Symbol string `json:"symbol"`
+	Name   string `json:"name"`
+}
+
+type market struct {
+	ID            string `json:"id"`
+	Symbol        string `json:"symbol"`
+	Name          string `json:"name"`
+	Image         string `json:"image"`
+	MarketCapRank int    `json:"market_cap_rank"`
+}
+
+type coinDetails struct {
+	Localization map[string]string `json:"localization"`
+	Image        struct {
+		Large string `json:"large"`
+	} `json:"image"`
+}
+
+// request makes a GET request to the API, waiting for the request interval
+// since the last.
+func (s *Store) request(ctx context.Context, path string, params url.Values, v interface{}) error {
+	if wait := s.config.RequestInterval - time.Since(s.lastRequest); wait > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+	s.lastRequest = time.Now()
+	s.requests.Inc()
+	if err := s.get(ctx, path, params, v); err != nil {
+		s.requestErrors.Inc()
+		return err
+	}
+	return nil
+}
+
+func (s *Store) get(ctx context.Context, path string, params url.Values, v interface{}) error {
+	endpoint := strings.TrimSuffix(s.config.URL, "/") + path
+	if len(params) > 0 {
+		endpoint += "?" + params.Encode()
+	}
+	request, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("user-agent", "cryptoxscanner")
+	if s.config.APIKey != "" {
+		if strings.Contains(s.config.URL, "pro-api.") {
+			request.Header.Set("x-cg-pro-api-key", s.config.APIKey)
+		} else {
+			request.Header.Set("x-cg-demo-api-key", s.config.APIKey)
+		}
+	}
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: status=%d: %s", path, response.StatusCode, string(body))
+	}
+	return json.Unmarshal(body, v)
+}
+
+// save writes the cached metadata to disk, replacing the previous file
+// atomically.
+func (s *Store) save() {
+	if s.filename == "" {
+		return
+	}
+	if err := s.write(); err != nil {
+		log.Printf("error: assets: failed to save metadata: %v\n", err)
+	}
+}
+
+func (s *Store) write() error {
+	s.lock.RLock()
+	assets := []*Asset{}
+	for _, asset := range s.assets {
+		assets = append(assets, asset)
+	}
+	sort.Slice(assets, func(i, j int) bool {
+		return assets[i].Symbol < assets[j].Symbol
+	})
+	buf, err := json.Marshal(assets)
+	s.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.filename), 0755); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(s.filename), ".assets-")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(buf); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	if err := os.Rename(file.Name(), s.filename); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/metrics"
+	"path"
+	"time"
+)
+
+func init() {
+	metrics.Describe("auth_rate_limited_total",
+		"Requests rejected for exceeding the rate limit of an API key.")
+}
+
+type APIKeyConfig struct {
+	// Identifies the key in logs, metrics and usage.
+	Name string `mapstructure:"name"`
+	Key  string `mapstructure:"key"`
+
+	// Defaults to the user role.
+	Role string `mapstructure:"role"`
+
+	// Maximum API requests, including websocket connects, per minute. 0 for
+	// no limit.
+	RequestsPerMinute int `mapstructure:"requests_per_minute"`
+
+	// Maximum concurrent websocket connections. 0 for no limit.
+	MaxConnections int `mapstructure:"max_connections"`
+
+	// Patterns of the websocket streams and topics the key may use, see
+	// Identity.AllowsTopic. Empty allows all.
+	Topics []string `mapstructure:"topics"`
+}
+
+type apiKey struct {
+	config  APIKeyConfig
+	limiter *pkg.RateLimiter
+	limited *metrics.Counter
+}
+
+// APIKeyProvider authenticates the API keys of the configuration, each with
+// its own rate limit and topic permissions.
+type APIKeyProvider struct {
+	keys []*apiKey
+}
+
+func NewAPIKeyProvider(configs []APIKeyConfig) (*APIKeyProvider, error) {
+	provider := &APIKeyProvider{}
+	names := map[string]bool{}
+	for _, config := range configs {
+		if config.Name == "" {
+			return nil, fmt.Errorf("api key name required")
+		}
+		if names[config.Name] {
+			return nil, fmt.Errorf("duplicate api key: %s", config.Name)
+		}
+		names[config.Name] = true
+		if config.Key == "" {
+			return nil, fmt.Errorf("api key %s: key required", config.Name)
+		}
+		if config.Role == "" {
+			config.Role = RoleUser
+		}
+		if config.Role != RoleUser && config.Role != RoleAdmin {
+			return nil, fmt.Errorf("api key %s: invalid role: %s", config.Name, config.Role)
+		}
+		if config.RequestsPerMinute < 0 || config.MaxConnections < 0 {
+			return nil, fmt.Errorf("api key %s: limits must not be negative", config.Name)
+		}
+		for _, pattern := range config.Topics {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("api key %s: invalid topic pattern: %s", config.Name, pattern)
+			}
+		}
+		key := &apiKey{
+			config: config,
+			limited: metrics.GetCounter("auth_rate_limited_total",
+				metrics.Labels{"key": config.Name}),
+		}
+		if config.RequestsPerMinute > 0 {
+			key.limiter = pkg.NewRateLimiter(config.RequestsPerMinute, time.Minute)
+		}
+		provider.keys = append(provider.keys, key)
+	}
+	return provider, nil
+}
+
+func (p *APIKeyProvider) Name() string {
+	return "apikey"
+}
+
+func (p *APIKeyProvider) Authenticate(token string) (*Identity, error) {
+	for _, key := range p.keys {
+		if subtle.ConstantTimeCompare([]byte(key.config.Key), []byte(token)) == 1 {
+			return &Identity{
+				Subject:        key.config.Name,
+				Provider:       p.Name(),
+				Roles:          []string{key.config.Role},
+				Account:        "key:" + key.config.Name,
+				Topics:         key.config.Topics,
+				MaxConnections: key.config.MaxConnections,
+				key:            key,
+			}, nil
+		}
+	}
+	return nil, ErrNoCredentials
+}
+
+// allow takes a request from the rate limit of the key.
+func (k *apiKey) allow() bool {
+	if k.limiter == nil || k.limiter.Allow() {
+		return true
+	}
+	k.limited.Inc()
+	return false
+}
+
+// AllowsTopic returns true if the identity may use the websocket stream,
+// topic or REST resource. Streams are named by their path under /ws/, such
+// as binance/live, topics of a topic websocket by the exchange and topic,
+// such as binance/trades:BTCUSDT, and the REST API of an exchange by the
+// exchange and resource, such as binance/stats for
+// /api/1/binance/stats/BTCUSDT. Patterns are matched with path.Match, so
+// binance/* allows all streams, topics and resources of binance. A nil
+// identity, as when authentication is disabled, allows all.
+func (i *Identity) AllowsTopic(topic string) bool {
+	if i == nil || len(i.Topics) == 0 {
+		return true
+	}
+	for _, pattern := range i.Topics {
+		if ok, _ := path.Match(pattern, topic); ok {
+			return true
+		}
+	}
+	return false
+}
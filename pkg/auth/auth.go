@@ -0,0 +1,227 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+// The cookie holding the token of a browser session.
+const SessionCookie = "cryptoxscanner_session"
+
+// The cookie holding the CSRF token of a browser session. Requests that
+// modify state with the session cookie must send its value in the
+// x-csrf-token header, which other sites can't read or set.
+const CSRFCookie = "cryptoxscanner_csrf"
+
+// ErrNoCredentials is returned by a provider when the request carries no
+// credentials it understands, so the next provider can be tried.
+var ErrNoCredentials = errors.New("no credentials")
+
+// ErrInvalidCSRFToken is returned for requests that modify state with the
+// session cookie without a valid CSRF token.
+var ErrInvalidCSRFToken = errors.New("invalid csrf token")
+
+type Identity struct {
+	Subject  string   `json:"subject"`
+	Provider string   `json:"provider"`
+	Roles    []string `json:"roles"`
+
+	// Identifies the user, or the static token, usage is metered against.
+	Account string `json:"account"`
+
+	// The websocket streams and topics permitted, and the maximum concurrent
+	// websocket connections, of an API key.
+	Topics         []string `json:"topics,omitempty"`
+	MaxConnections int      `json:"max_connections,omitempty"`
+
+	// The API key authenticated with, nil for other providers.
+	key *apiKey
+}
+
+func (i *Identity) HasRole(role string) bool {
+	for _, r := range i.Roles {
+		if r == role || r == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Provider authenticates a bearer token.
+type Provider interface {
+	Name() string
+	Authenticate(token string) (*Identity, error)
+}
+
+type OIDCConfig struct {
+	Issuer       string `mapstructure:"issuer"`
+	ClientId     string `mapstructure:"client_id"`
+	ClientSecret string `mapstructure:"client_secret"`
+	RedirectUrl  string `mapstructure:"redirect_url"`
+
+	// The claim holding the user's roles or groups, such as "groups" or
+	// "realm_access.roles".
+	RoleClaim string `mapstructure:"role_claim"`
+
+	// Maps claim values to roles. Users without a mapped role get
+	// DefaultRole, or are rejected if it is empty.
+	Roles       map[string]string `mapstructure:"roles"`
+	DefaultRole string            `mapstructure:"default_role"`
+}
+
+type Config struct {
+	// Static tokens mapped to a role.
+	Tokens map[string]string `mapstructure:"tokens"`
+
+	// API keys with rate limits and topic permissions.
+	Keys []APIKeyConfig `mapstructure:"keys"`
+
+	OIDC *OIDCConfig `mapstructure:"oidc"`
+}
+
+// Authenticator tries each provider in turn. With no providers
+// authentication is disabled and all requests are allowed.
+type Authenticator struct {
+	providers []Provider
+}
+
+func NewAuthenticator(providers ...Provider) *Authenticator {
+	return &Authenticator{
+		providers: providers,
+	}
+}
+
+func (a *Authenticator) Enabled() bool {
+	return len(a.providers) > 0
+}
+
+// RequestToken returns the token from the authorization header, the
+// x-api-key header, the token query parameter or the session cookie, and
+// true if it is from the session cookie. The query parameter is only
+// accepted for websockets, as browsers can't set their headers, to keep
+// tokens out of the logs and referrers of other requests.
+func RequestToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("authorization")
+	if strings.HasPrefix(strings.ToLower(header), "bearer ") {
+		return strings.TrimSpace(header[len("bearer "):]), false
+	}
+	if key := r.Header.Get("x-api-key"); key != "" {
+		return key, false
+	}
+	if strings.HasPrefix(r.URL.Path, "/ws/") {
+		if token := r.URL.Query().Get("token"); token != "" {
+			return token, false
+		}
+	}
+	if cookie, err := r.Cookie(SessionCookie); err == nil {
+		return cookie.Value, true
+	}
+	return "", false
+}
+
+// validCSRFToken returns true if the x-csrf-token header of the request
+// matches its CSRF cookie.
+func validCSRFToken(r *http.Request) bool {
+	cookie, err := r.Cookie(CSRFCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	header := r.Header.Get("x-csrf-token")
+	return subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) == 1
+}
+
+// isSafeMethod returns true for methods that don't modify state.
+func isSafeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+func (a *Authenticator) Authenticate(r *http.Request) (*Identity, error) {
+	token, session := RequestToken(r)
+	if token == "" {
+		return nil, ErrNoCredentials
+	}
+	if session && !isSafeMethod(r.Method) && !validCSRFToken(r) {
+		return nil, ErrInvalidCSRFToken
+	}
+	var lastErr error = ErrNoCredentials
+	for _, provider := range a.providers {
+		identity, err := provider.Authenticate(token)
+		if err == nil {
+			return identity, nil
+		}
+		if err != ErrNoCredentials {
+			lastErr = err
+		}
+	}
+	return nil, lastErr
+}
+
+type contextKey int
+
+const identityKey contextKey = 0
+
+// GetIdentity returns the identity of an authenticated request, or nil.
+func GetIdentity(r *http.Request) *Identity {
+	identity, _ := r.Context().Value(identityKey).(*Identity)
+	return identity
+}
+
+// Middleware requires an authenticated identity for all requests except
+// those for which public returns true. Requests that modify state require
+// the admin role, and a CSRF token if authenticated by the session cookie,
+// and requests of an API key over its rate limit are rejected.
+func (a *Authenticator) Middleware(public func(r *http.Request) bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !a.Enabled() || public(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			identity, err := a.Authenticate(r)
+			if err == ErrInvalidCSRFToken {
+				http.Error(w, "invalid csrf token", http.StatusForbidden)
+				return
+			}
+			if err != nil {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			required := RoleUser
+			if !isSafeMethod(r.Method) {
+				required = RoleAdmin
+			}
+			if !identity.HasRole(required) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			if identity.key != nil && !identity.key.allow() {
+				http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey, identity)))
+		})
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddlewareSessionCSRF(t *testing.T) {
+	authenticator := NewAuthenticator(NewStaticTokenProvider(map[string]string{
+		"secret": RoleAdmin,
+	}))
+	handler := authenticator.Middleware(func(r *http.Request) bool { return false })(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name     string
+		method   string
+		csrf     string
+		header   string
+		expected int
+	}{
+		{"get with the session", "GET", "", "", http.StatusOK},
+		{"put without a csrf token", "PUT", "", "", http.StatusForbidden},
+		{"put with a missing csrf header", "PUT", "csrf", "", http.StatusForbidden},
+		{"put with a wrong csrf header", "PUT", "csrf", "other", http.StatusForbidden},
+		{"put with the csrf token", "PUT", "csrf", "csrf", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, "/api/1/symbols/hidden/BTCUSDT", nil)
+			r.AddCookie(&http.Cookie{Name: SessionCookie, Value: "secret"})
+			if test.csrf != "" {
+				r.AddCookie(&http.Cookie{Name: CSRFCookie, Value: test.csrf})
+			}
+			if test.header != "" {
+				r.Header.Set("x-csrf-token", test.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != test.expected {
+				t.Errorf("expected %d, got %d", test.expected, w.Code)
+			}
+		})
+	}
+}
+
+func TestMiddlewareHeaderTokenWithoutCSRF(t *testing.T) {
+	authenticator := NewAuthenticator(NewStaticTokenProvider(map[string]string{
+		"secret": RoleAdmin,
+	}))
+	handler := authenticator.Middleware(func(r *http.Request) bool { return false })(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	r := httptest.NewRequest("PUT", "/api/1/symbols/hidden/BTCUSDT", nil)
+	r.Header.Set("authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected %d, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestRequestTokenQueryOnlyForWebSockets(t *testing.T) {
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		{"/ws/binance/live?token=secret", "secret"},
+		{"/api/1/binance/tickers?token=secret", ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.url, nil)
+		if token, _ := RequestToken(r); token != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.url, test.expected, token)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/metrics"
+	"net"
+	"net/http"
+	"strings"
+)
+
+func init() {
+	metrics.Describe("security_denied_total",
+		"Requests denied by an IP policy.")
+}
+
+type RoutePolicyConfig struct {
+	// A name for the policy used in logs and metrics. Defaults to the path.
+	Name string `mapstructure:"name"`
+
+	// The path prefix the policy applies to.
+	Path string `mapstructure:"path"`
+
+	// The methods the policy applies to. Empty applies to all methods.
+	Methods []string `mapstructure:"methods"`
+
+	// Addresses or CIDR ranges allowed.
+	Allow []string `mapstructure:"allow"`
+}
+
+type IPPolicyConfig struct {
+	// Addresses or CIDR ranges allowed for routes without a policy. Empty
+	// allows all.
+	Allow []string `mapstructure:"allow"`
+
+	// Use the x-forwarded-for or x-real-ip header for the client address,
+	// the last address of x-forwarded-for as added by the proxy. Only
+	// enable behind a single proxy that sets these headers.
+	TrustProxy bool `mapstructure:"trust_proxy"`
+
+	// Addresses or CIDR ranges of the trusted proxies. If set the headers
+	// are only used for requests from these proxies, and the client
+	// address is the last in x-forwarded-for that is not a trusted proxy.
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+
+	// Route policies, the first matching policy applies.
+	Policies []RoutePolicyConfig `mapstructure:"policies"`
+}
+
+type ipAllowList []*net.IPNet
+
+func newIPAllowList(entries []string) (ipAllowList, error) {
+	list := ipAllowList{}
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or range: %s", entry)
+		}
+		list = append(list, network)
+	}
+	return list, nil
+}
+
+func (l ipAllowList) Contains(ip net.IP) bool {
+	for _, network := range l {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type routePolicy struct {
+	name    string
+	path    string
+	methods map[string]bool
+	allow   ipAllowList
+	denied  *metrics.Counter
+}
+
+func (p *routePolicy) matches(r *http.Request) bool {
+	if !strings.HasPrefix(r.URL.Path, p.path) {
+		return false
+	}
+	return len(p.methods) == 0 || p.methods[r.Method]
+}
+
+// IPPolicy restricts requests by client address, globally and per route.
+type IPPolicy struct {
+	allow       ipAllowList
+	allowDenied *metrics.Counter
+	trustProxy  bool
+	proxies     ipAllowList
+	policies    []*routePolicy
+}
+
+func NewIPPolicy(config IPPolicyConfig) (*IPPolicy, error) {
+	allow, err := newIPAllowList(config.Allow)
+	if err != nil {
+		return nil, err
+	}
+	proxies, err := newIPAllowList(config.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("trusted proxies: %v", err)
+	}
+	policy := &IPPolicy{
+		allow: allow,
+		allowDenied: metrics.GetCounter("security_denied_total",
+			metrics.Labels{"policy": "global"}),
+		trustProxy: config.TrustProxy || len(proxies) > 0,
+		proxies:    proxies,
+	}
+	for _, routeConfig := range config.Policies {
+		if routeConfig.Path == "" {
+			return nil, fmt.Errorf("route policy path required")
+		}
+		name := routeConfig.Name
+		if name == "" {
+			name = routeConfig.Path
+		}
+		routeAllow, err := newIPAllowList(routeConfig.Allow)
+		if err != nil {
+			return nil, fmt.Errorf("route policy %s: %v", name, err)
+		}
+		route := &routePolicy{
+			name:    name,
+			path:    routeConfig.Path,
+			methods: map[string]bool{},
+			allow:   routeAllow,
+			denied: metrics.GetCounter("security_denied_total",
+				metrics.Labels{"policy": name}),
+		}
+		for _, method := range routeConfig.Methods {
+			route.methods[strings.ToUpper(method)] = true
+		}
+		policy.policies = append(policy.policies, route)
+	}
+	return policy, nil
+}
+
+// ClientIP returns the address of the client, using the proxy headers if
+// trusted.
+func (p *IPPolicy) ClientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remote := net.ParseIP(host)
+	if !p.trustProxy {
+		return remote
+	}
+	if len(p.proxies) > 0 && (remote == nil || !p.proxies.Contains(remote)) {
+		return remote
+	}
+	if ip := p.forwardedClient(r.Header.Get("x-forwarded-for")); ip != nil {
+		return ip
+	}
+	if ip := net.ParseIP(r.Header.Get("x-real-ip")); ip != nil {
+		return ip
+	}
+	return remote
+}
+
+// forwardedClient returns the last address of an x-forwarded-for header
+// that is not a trusted proxy, as the addresses before it may be forged by
+// the client. Without trusted proxies that is the last address, added by
+// the proxy in front of the server.
+func (p *IPPolicy) forwardedClient(forwarded string) net.IP {
+	if forwarded == "" {
+		return nil
+	}
+	entries := strings.Split(forwarded, ",")
+	var ip net.IP
+	for i := len(entries) - 1; i >= 0; i-- {
+		ip = net.ParseIP(strings.TrimSpace(entries[i]))
+		if ip == nil {
+			return nil
+		}
+		if !p.proxies.Contains(ip) {
+			return ip
+		}
+	}
+	return ip
+}
+
+// Allowed returns true if the request is allowed, and the name of the
+// policy that was applied.
+func (p *IPPolicy) Allowed(r *http.Request) (bool, string) {
+	ip := p.ClientIP(r)
+	for _, policy := range p.policies {
+		if policy.matches(r) {
+			if ip != nil && policy.allow.Contains(ip) {
+				return true, policy.name
+			}
+			policy.denied.Inc()
+			return false, policy.name
+		}
+	}
+	if len(p.allow) == 0 || (ip != nil && p.allow.Contains(ip)) {
+		return true, "global"
+	}
+	p.allowDenied.Inc()
+	return false, "global"
+}
+
+func (p *IPPolicy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if allowed, policy := p.Allowed(r); !allowed {
+			log.Printf("security: denied %s %s from %v by policy %s\n",
+				r.Method, r.URL.Path, p.ClientIP(r), policy)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
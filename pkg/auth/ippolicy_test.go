@@ -0,0 +1,103 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestIPPolicyClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     IPPolicyConfig
+		remoteAddr string
+		forwarded  string
+		realIP     string
+		expected   string
+	}{
+		{
+			name:       "no proxy ignores headers",
+			remoteAddr: "203.0.113.1:1234",
+			forwarded:  "198.51.100.1",
+			realIP:     "198.51.100.2",
+			expected:   "203.0.113.1",
+		},
+		{
+			name:       "trust proxy uses the address added by the proxy",
+			config:     IPPolicyConfig{TrustProxy: true},
+			remoteAddr: "10.0.0.1:1234",
+			forwarded:  "198.51.100.1, 203.0.113.7",
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "trust proxy falls back to x-real-ip",
+			config:     IPPolicyConfig{TrustProxy: true},
+			remoteAddr: "10.0.0.1:1234",
+			realIP:     "203.0.113.7",
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "trusted proxies skip the proxies",
+			config:     IPPolicyConfig{TrustedProxies: []string{"10.0.0.0/8"}},
+			remoteAddr: "10.0.0.1:1234",
+			forwarded:  "198.51.100.1, 203.0.113.7, 10.0.0.2",
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "untrusted proxy is the client",
+			config:     IPPolicyConfig{TrustedProxies: []string{"10.0.0.0/8"}},
+			remoteAddr: "192.0.2.1:1234",
+			forwarded:  "203.0.113.7",
+			expected:   "192.0.2.1",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy, err := NewIPPolicy(test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, _ := http.NewRequest("GET", "/api/1/ping", nil)
+			r.RemoteAddr = test.remoteAddr
+			if test.forwarded != "" {
+				r.Header.Set("x-forwarded-for", test.forwarded)
+			}
+			if test.realIP != "" {
+				r.Header.Set("x-real-ip", test.realIP)
+			}
+			if ip := policy.ClientIP(r); ip.String() != test.expected {
+				t.Errorf("expected %s, got %v", test.expected, ip)
+			}
+		})
+	}
+}
+
+func TestIPPolicyAllowedIgnoresForgedForwarded(t *testing.T) {
+	policy, err := NewIPPolicy(IPPolicyConfig{
+		Allow:      []string{"192.0.2.0/24"},
+		TrustProxy: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := http.NewRequest("GET", "/api/1/ping", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("x-forwarded-for", "192.0.2.1, 203.0.113.7")
+	if allowed, _ := policy.Allowed(r); allowed {
+		t.Errorf("allowed with a forged x-forwarded-for address")
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+func (k *jsonWebKey) publicKey() (*rsa.PublicKey, error) {
+	if k.Kty != "RSA" {
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+var jwtHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+}
+
+// parseJWT splits a JWT and decodes its header and claims without
+// verifying it.
+func parseJWT(token string) (header jwtHeader, claims map[string]interface{}, parts []string, err error) {
+	parts = strings.Split(token, ".")
+	if len(parts) != 3 {
+		return header, nil, nil, ErrNoCredentials
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return header, nil, nil, ErrNoCredentials
+	}
+	if err := json.Unmarshal(buf, &header); err != nil {
+		return header, nil, nil, ErrNoCredentials
+	}
+	buf, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return header, nil, nil, fmt.Errorf("invalid claims: %v", err)
+	}
+	if err := json.Unmarshal(buf, &claims); err != nil {
+		return header, nil, nil, fmt.Errorf("invalid claims: %v", err)
+	}
+	return header, claims, parts, nil
+}
+
+func verifyJWTSignature(header jwtHeader, parts []string, key *rsa.PublicKey) error {
+	hash, ok := jwtHashes[header.Alg]
+	if !ok {
+		return fmt.Errorf("unsupported algorithm %s", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+	hasher := hash.New()
+	hasher.Write([]byte(parts[0] + "." + parts[1]))
+	return rsa.VerifyPKCS1v15(key, hash, hasher.Sum(nil), signature)
+}
+
+func claimTime(claims map[string]interface{}, name string) (time.Time, bool) {
+	value, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(value), 0), true
+}
+
+// claimAudience returns true if the aud claim, a string or list, contains
+// audience.
+func claimAudience(claims map[string]interface{}, audience string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimStrings returns the values of a claim, which may be nested using dots
+// and contain a string or list of strings.
+func claimStrings(claims map[string]interface{}, name string) []string {
+	var current interface{} = claims
+	for _, key := range strings.Split(name, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		current = m[key]
+	}
+	values := []string{}
+	switch v := current.(type) {
+	case string:
+		values = append(values, v)
+	case []interface{}:
+		for _, entry := range v {
+			if s, ok := entry.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	return values
+}
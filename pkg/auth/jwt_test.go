@@ -0,0 +1,191 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	// The ID token returned by the token endpoint.
+	idToken string
+}
+
+// newTestIssuer serves the discovery document, a key set holding the
+// public key of the issuer under the key ID "test" and a token endpoint
+// returning idToken for any code.
+func newTestIssuer(t *testing.T) *testIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &testIssuer{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:        issuer.server.URL,
+			TokenEndpoint: issuer.server.URL + "/token",
+			JwksUri:       issuer.server.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id_token":   issuer.idToken,
+			"expires_in": 3600,
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jsonWebKeySet{
+			Keys: []jsonWebKey{{
+				Kid: "test",
+				Kty: "RSA",
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	issuer.server = httptest.NewServer(mux)
+	return issuer
+}
+
+func (i *testIssuer) sign(t *testing.T, header jwtHeader, claims map[string]interface{}) string {
+	encode := func(v interface{}) string {
+		buf, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(buf)
+	}
+	signed := encode(header) + "." + encode(claims)
+	hasher := crypto.SHA256.New()
+	hasher.Write([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, i.key, crypto.SHA256, hasher.Sum(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDCProviderAuthenticate(t *testing.T) {
+	issuer := newTestIssuer(t)
+	defer issuer.server.Close()
+	provider, err := NewOIDCProvider(OIDCConfig{
+		Issuer:    issuer.server.URL,
+		ClientId:  "cryptoxscanner",
+		RoleClaim: "realm_access.roles",
+		Roles: map[string]string{
+			"scanner-admin": RoleAdmin,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{
+			"iss":            issuer.server.URL,
+			"aud":            []string{"other", "cryptoxscanner"},
+			"sub":            "1234",
+			"email":          "user@example.com",
+			"email_verified": true,
+			"exp":            now + 60,
+			"realm_access": map[string]interface{}{
+				"roles": []string{"offline_access", "scanner-admin"},
+			},
+		}
+		for name, value := range changes {
+			if value == nil {
+				delete(claims, name)
+			} else {
+				claims[name] = value
+			}
+		}
+		return claims
+	}
+	header := jwtHeader{Alg: "RS256", Kid: "test"}
+	valid := issuer.sign(t, header, claims(nil))
+	parts := strings.Split(valid, ".")
+	other := strings.Split(issuer.sign(t, header, claims(map[string]interface{}{
+		"email": "admin@example.com"})), ".")
+
+	// The subject expected, empty if the token is invalid.
+	tests := []struct {
+		name    string
+		token   string
+		subject string
+	}{
+		{"valid", valid, "user@example.com"},
+		{"single audience", issuer.sign(t, header, claims(map[string]interface{}{
+			"aud": "cryptoxscanner"})), "user@example.com"},
+		{"unverified email", issuer.sign(t, header, claims(map[string]interface{}{
+			"email_verified": false})), "1234"},
+		{"no email", issuer.sign(t, header, claims(map[string]interface{}{
+			"email": nil})), "1234"},
+		{"no subject", issuer.sign(t, header, claims(map[string]interface{}{
+			"sub": nil})), ""},
+		{"not a jwt", "secret", ""},
+		{"tampered signature", valid[:len(valid)-4] + "AAAA", ""},
+		{"tampered claims", parts[0] + "." + other[1] + "." + parts[2], ""},
+		{"unknown key", issuer.sign(t, jwtHeader{Alg: "RS256", Kid: "other"}, claims(nil)), ""},
+		{"unsupported algorithm", issuer.sign(t, jwtHeader{Alg: "HS256", Kid: "test"}, claims(nil)), ""},
+		{"other issuer", issuer.sign(t, header, claims(map[string]interface{}{
+			"iss": "https://example.com"})), ""},
+		{"other audience", issuer.sign(t, header, claims(map[string]interface{}{
+			"aud": "other"})), ""},
+		{"expired", issuer.sign(t, header, claims(map[string]interface{}{
+			"exp": now - 60})), ""},
+		{"no expiry", issuer.sign(t, header, claims(map[string]interface{}{
+			"exp": nil})), ""},
+		{"not yet valid", issuer.sign(t, header, claims(map[string]interface{}{
+			"nbf": now + 60})), ""},
+		{"no mapped role", issuer.sign(t, header, claims(map[string]interface{}{
+			"realm_access": nil})), ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			identity, err := provider.Authenticate(test.token)
+			if test.subject == "" {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", identity)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The account is the same whichever email is shown.
+			if identity.Subject != test.subject || identity.Account != "oidc:"+issuer.server.URL+"#1234" ||
+				len(identity.Roles) != 1 || identity.Roles[0] != RoleAdmin {
+				t.Errorf("unexpected identity %+v", identity)
+			}
+		})
+	}
+}
@@ -0,0 +1,309 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The minimum time between key set refreshes triggered by unknown key IDs.
+const jwksRefreshInterval = time.Minute
+
+// The cookie holding the state of a login in progress.
+const stateCookie = "cryptoxscanner_oidc_state"
+
+var oidcClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+// OIDCProvider authenticates ID tokens issued by an OpenID Connect provider
+// such as Keycloak, Auth0 or Google, and implements the authorization code
+// login flow for the frontend.
+type OIDCProvider struct {
+	config    OIDCConfig
+	discovery oidcDiscovery
+
+	keys        map[string]*rsa.PublicKey
+	keysFetched time.Time
+	keysLock    sync.Mutex
+
+	// The path prefix the server is served under, without a trailing
+	// slash.
+	basePath string
+}
+
+// NewOIDCProvider fetches the provider's discovery document and keys.
+func NewOIDCProvider(config OIDCConfig) (*OIDCProvider, error) {
+	if config.Issuer == "" || config.ClientId == "" {
+		return nil, fmt.Errorf("oidc issuer and client_id required")
+	}
+	p := &OIDCProvider{
+		config: config,
+		keys:   map[string]*rsa.PublicKey{},
+	}
+	discoveryUrl := strings.TrimSuffix(config.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := getJSON(discoveryUrl, &p.discovery); err != nil {
+		return nil, fmt.Errorf("oidc discovery failed: %v", err)
+	}
+	if err := p.refreshKeys(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func getJSON(url string, v interface{}) error {
+	response, err := oidcClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: status %d", url, response.StatusCode)
+	}
+	return json.NewDecoder(response.Body).Decode(v)
+}
+
+func (p *OIDCProvider) Name() string {
+	return "oidc"
+}
+
+// SetBasePath sets the path prefix the server is served under, normalized
+// with a leading and no trailing slash. The cookies are scoped to it and a
+// login returns to it.
+func (p *OIDCProvider) SetBasePath(basePath string) {
+	p.basePath = basePath
+}
+
+func (p *OIDCProvider) cookiePath() string {
+	return p.basePath + "/"
+}
+
+// refreshKeys fetches the key set. Must be called with keysLock held or
+// before the provider is in use.
+func (p *OIDCProvider) refreshKeys() error {
+	var keySet jsonWebKeySet
+	if err := getJSON(p.discovery.JwksUri, &keySet); err != nil {
+		return fmt.Errorf("oidc key fetch failed: %v", err)
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range keySet.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	p.keys = keys
+	p.keysFetched = time.Now()
+	return nil
+}
+
+// getKey returns the key for kid, refreshing the key set if the key is not
+// known as the provider may have rotated its keys.
+func (p *OIDCProvider) getKey(kid string) (*rsa.PublicKey, error) {
+	p.keysLock.Lock()
+	defer p.keysLock.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Now().Sub(p.keysFetched) > jwksRefreshInterval {
+		if err := p.refreshKeys(); err != nil {
+			log.Printf("error: %v\n", err)
+		}
+		if key, ok := p.keys[kid]; ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key id %s", kid)
+}
+
+func (p *OIDCProvider) Authenticate(token string) (*Identity, error) {
+	header, claims, parts, err := parseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	key, err := p.getKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWTSignature(header, parts, key); err != nil {
+		return nil, err
+	}
+
+	if iss, _ := claims["iss"].(string); iss != p.discovery.Issuer {
+		return nil, fmt.Errorf("invalid issuer %s", iss)
+	}
+	if !claimAudience(claims, p.config.ClientId) {
+		return nil, fmt.Errorf("invalid audience")
+	}
+	now := time.Now()
+	if exp, ok := claimTime(claims, "exp"); !ok || now.After(exp) {
+		return nil, fmt.Errorf("token expired")
+	}
+	if nbf, ok := claimTime(claims, "nbf"); ok && now.Before(nbf) {
+		return nil, fmt.Errorf("token not yet valid")
+	}
+
+	roles := p.mapRoles(claims)
+	if len(roles) == 0 {
+		return nil, fmt.Errorf("no role")
+	}
+	// The account is keyed on the issuer and subject, as the email may be
+	// changed, or claimed by another user of a provider allowing
+	// self-registration. The email is only shown once verified.
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, fmt.Errorf("no subject")
+	}
+	subject := sub
+	if verified, _ := claims["email_verified"].(bool); verified {
+		if email, _ := claims["email"].(string); email != "" {
+			subject = email
+		}
+	}
+	return &Identity{
+		Subject:  subject,
+		Provider: p.Name(),
+		Roles:    roles,
+		Account:  p.Name() + ":" + p.discovery.Issuer + "#" + sub,
+	}, nil
+}
+
+func (p *OIDCProvider) mapRoles(claims map[string]interface{}) []string {
+	roles := []string{}
+	if p.config.RoleClaim != "" {
+		for _, value := range claimStrings(claims, p.config.RoleClaim) {
+			if role, ok := p.config.Roles[value]; ok {
+				roles = append(roles, role)
+			}
+		}
+	}
+	if len(roles) == 0 && p.config.DefaultRole != "" {
+		roles = append(roles, p.config.DefaultRole)
+	}
+	return roles
+}
+
+// HandleLogin redirects the browser to the provider to log in.
+func (p *OIDCProvider) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	state := hex.EncodeToString(buf)
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookie,
+		Value:    state,
+		Path:     p.cookiePath(),
+		MaxAge:   600,
+		HttpOnly: true,
+		// Lax so it is sent on the redirect back from the provider.
+		SameSite: http.SameSiteLaxMode,
+	})
+	params := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.config.ClientId},
+		"redirect_uri":  {p.config.RedirectUrl},
+		"scope":         {"openid email profile"},
+		"state":         {state},
+	}
+	http.Redirect(w, r, p.discovery.AuthorizationEndpoint+"?"+params.Encode(),
+		http.StatusFound)
+}
+
+// HandleCallback exchanges the authorization code for an ID token and
+// stores it in the session cookie.
+func (p *OIDCProvider) HandleCallback(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(stateCookie)
+	if err != nil || cookie.Value == "" || cookie.Value != r.FormValue("state") {
+		http.Error(w, "invalid state", http.StatusBadRequest)
+		return
+	}
+
+	response, err := oidcClient.PostForm(p.discovery.TokenEndpoint, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {r.FormValue("code")},
+		"redirect_uri":  {p.config.RedirectUrl},
+		"client_id":     {p.config.ClientId},
+		"client_secret": {p.config.ClientSecret},
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer response.Body.Close()
+	var tokens struct {
+		IdToken   string `json:"id_token"`
+		ExpiresIn int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&tokens); err != nil || tokens.IdToken == "" {
+		http.Error(w, "token exchange failed", http.StatusBadGateway)
+		return
+	}
+	identity, err := p.Authenticate(tokens.IdToken)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	log.Printf("auth: %s logged in with roles %v\n", identity.Subject, identity.Roles)
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: stateCookie, Path: p.cookiePath(), MaxAge: -1})
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    tokens.IdToken,
+		Path:     p.cookiePath(),
+		MaxAge:   tokens.ExpiresIn,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	// Readable by the webapp, to send in the x-csrf-token header.
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookie,
+		Value:    hex.EncodeToString(buf),
+		Path:     p.cookiePath(),
+		MaxAge:   tokens.ExpiresIn,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, p.cookiePath(), http.StatusFound)
+}
@@ -0,0 +1,77 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOIDCProviderCallbackBasePath(t *testing.T) {
+	issuer := newTestIssuer(t)
+	defer issuer.server.Close()
+	issuer.idToken = issuer.sign(t, jwtHeader{Alg: "RS256", Kid: "test"}, map[string]interface{}{
+		"iss": issuer.server.URL,
+		"aud": "cryptoxscanner",
+		"sub": "1234",
+		"exp": time.Now().Unix() + 60,
+	})
+
+	for _, basePath := range []string{"", "/scanner"} {
+		t.Run("base path "+basePath, func(t *testing.T) {
+			provider, err := NewOIDCProvider(OIDCConfig{
+				Issuer:      issuer.server.URL,
+				ClientId:    "cryptoxscanner",
+				DefaultRole: RoleUser,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			provider.SetBasePath(basePath)
+
+			w := httptest.NewRecorder()
+			provider.HandleLogin(w, httptest.NewRequest("GET", "/auth/login", nil))
+			state := w.Result().Cookies()[0]
+			if state.Path != basePath+"/" {
+				t.Errorf("expected state cookie path %s/, got %s", basePath, state.Path)
+			}
+
+			r := httptest.NewRequest("GET", "/auth/callback?code=code&state="+state.Value, nil)
+			r.AddCookie(state)
+			w = httptest.NewRecorder()
+			provider.HandleCallback(w, r)
+			if w.Code != http.StatusFound || w.Header().Get("location") != basePath+"/" {
+				t.Fatalf("expected a redirect to %s/, got %d %s", basePath, w.Code,
+					w.Header().Get("location"))
+			}
+			cookies := map[string]*http.Cookie{}
+			for _, cookie := range w.Result().Cookies() {
+				if cookie.Path != basePath+"/" {
+					t.Errorf("cookie %s: expected path %s/, got %s", cookie.Name, basePath, cookie.Path)
+				}
+				cookies[cookie.Name] = cookie
+			}
+			if cookies[SessionCookie] == nil || cookies[SessionCookie].Value != issuer.idToken {
+				t.Errorf("expected the session cookie to hold the id token")
+			}
+			if cookies[CSRFCookie] == nil || cookies[CSRFCookie].Value == "" {
+				t.Errorf("expected a csrf cookie")
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+)
+
+// StaticTokenProvider authenticates a fixed set of tokens from the
+// configuration.
+type StaticTokenProvider struct {
+	tokens map[string]string
+}
+
+func NewStaticTokenProvider(tokens map[string]string) *StaticTokenProvider {
+	return &StaticTokenProvider{
+		tokens: tokens,
+	}
+}
+
+// TokenAccount returns the account of a static token: the start of its
+// SHA-256 hash, so it can be used in billing limits and reports without
+// revealing the token.
+func TokenAccount(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "token:" + hex.EncodeToString(sum[:8])
+}
+
+func (p *StaticTokenProvider) Name() string {
+	return "token"
+}
+
+func (p *StaticTokenProvider) Authenticate(token string) (*Identity, error) {
+	for candidate, role := range p.tokens {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			return &Identity{
+				Subject:  "token",
+				Provider: p.Name(),
+				Roles:    []string{role},
+				Account:  TokenAccount(candidate),
+			}, nil
+		}
+	}
+	return nil, ErrNoCredentials
+}
@@ -0,0 +1,375 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package backfill runs on demand jobs fetching the trades or candles of a
+// symbol over a range from an exchange REST API into the database, to
+// repair history without backfilling a whole exchange.
+package backfill
+
+import (
+	"context"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/candles"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/metrics"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	metrics.Describe("backfill_jobs_total",
+		"Backfill jobs finished, by kind and state.")
+	metrics.Describe("backfill_rows_total",
+		"Rows written by backfill jobs, by kind.")
+}
+
+const (
+	KindTrades  = "trades"
+	KindCandles = "candles"
+)
+
+const (
+	StateQueued    = "queued"
+	StateRunning   = "running"
+	StateDone      = "done"
+	StateFailed    = "failed"
+	StateCancelled = "cancelled"
+)
+
+// The longest range of a job. Trades are far more numerous than candles.
+const (
+	MaxTradesRange  = 24 * time.Hour
+	MaxCandlesRange = 365 * 24 * time.Hour
+)
+
+// The maximum number of jobs waiting to run, and of finished jobs kept for
+// polling.
+const (
+	maxQueuedJobs   = 100
+	maxFinishedJobs = 1000
+)
+
+// Source is implemented by exchanges that can fetch past trades and
+// candles from their REST API.
+type Source interface {
+	// BackfillTrades calls cb with pages of the trades of symbol with a
+	// timestamp in [from, to), oldest first.
+	BackfillTrades(ctx context.Context, symbol string, from time.Time, to time.Time,
+		cb func(trades []pkg.CommonTrade) error) error
+
+	// BackfillCandles calls cb with pages of the candles of symbol at
+	// interval with an open time in [from, to), oldest first.
+	BackfillCandles(ctx context.Context, symbol string, interval time.Duration,
+		from time.Time, to time.Time, cb func(candles []candles.Candle) error) error
+}
+
+// Writer stores the fetched rows, such as the persist store.
+type Writer interface {
+	WriteTrades(exchange string, trades []pkg.CommonTrade) error
+	WriteCandles(exchange string, candles []candles.Candle) error
+}
+
+type Request struct {
+	Exchange string    `json:"exchange"`
+	Symbol   string    `json:"symbol"`
+	Kind     string    `json:"kind"`
+	Interval string    `json:"interval,omitempty"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+}
+
+// Job is the status of a backfill request.
+type Job struct {
+	Id string `json:"id"`
+	Request
+	State    string     `json:"state"`
+	Rows     int        `json:"rows"`
+	Error    string     `json:"error,omitempty"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+
+	interval time.Duration
+	cancel   context.CancelFunc
+}
+
+func (j *Job) finished() bool {
+	return j.State == StateDone || j.State == StateFailed || j.State == StateCancelled
+}
+
+// Scheduler runs backfill jobs one at a time, so the REST request rate of a
+// job is never multiplied and the live streams are not starved.
+type Scheduler struct {
+	writer   Writer
+	sources  map[string]Source
+	jobs     map[string]*Job
+	order    []string
+	queue    chan *Job
+	sequence int64
+	lock     sync.Mutex
+}
+
+func NewScheduler(writer Writer) *Scheduler {
+	return &Scheduler{
+		writer:  writer,
+		sources: map[string]Source{},
+		jobs:    map[string]*Job{},
+		queue:   make(chan *Job, maxQueuedJobs),
+	}
+}
+
+// AddSource makes exchange available to backfill. Must be called before
+// Run.
+func (s *Scheduler) AddSource(exchange string, source Source) {
+	s.sources[exchange] = source
+}
+
+// Exchanges returns the names of the exchanges that can be backfilled.
+func (s *Scheduler) Exchanges() []string {
+	names := []string{}
+	for name := range s.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *Scheduler) validate(request *Request) (time.Duration, error) {
+	if _, ok := s.sources[request.Exchange]; !ok {
+		return 0, fmt.Errorf("exchange %s does not support backfill (available: %s)",
+			request.Exchange, strings.Join(s.Exchanges(), ", "))
+	}
+	if request.Symbol == "" {
+		return 0, fmt.Errorf("symbol is required")
+	}
+	if request.From.IsZero() || request.To.IsZero() || !request.From.Before(request.To) {
+		return 0, fmt.Errorf("from must be before to")
+	}
+	if request.To.After(time.Now()) {
+		request.To = time.Now()
+	}
+	switch request.Kind {
+	case KindTrades:
+		if request.To.Sub(request.From) > MaxTradesRange {
+			return 0, fmt.Errorf("trades range must not be longer than %v", MaxTradesRange)
+		}
+		return 0, nil
+	case KindCandles:
+		interval, err := candles.ParseInterval(request.Interval)
+		if err != nil {
+			return 0, err
+		}
+		supported := false
+		for _, i := range candles.DefaultIntervals {
+			supported = supported || i == interval
+		}
+		if !supported {
+			return 0, fmt.Errorf("unsupported interval: %s", request.Interval)
+		}
+		if request.To.Sub(request.From) > MaxCandlesRange {
+			return 0, fmt.Errorf("candles range must not be longer than %v", MaxCandlesRange)
+		}
+		return interval, nil
+	}
+	return 0, fmt.Errorf("invalid kind: %s (available: %s, %s)", request.Kind,
+		KindTrades, KindCandles)
+}
+
+// Submit validates and queues a job, returning its initial status.
+func (s *Scheduler) Submit(request Request) (Job, error) {
+	request.Exchange = strings.ToLower(request.Exchange)
+	request.Symbol = strings.ToUpper(request.Symbol)
+	interval, err := s.validate(&request)
+	if err != nil {
+		return Job{}, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sequence++
+	job := &Job{
+		Id:       strconv.FormatInt(s.sequence, 10),
+		Request:  request,
+		State:    StateQueued,
+		Created:  time.Now(),
+		interval: interval,
+	}
+	select {
+	case s.queue <- job:
+	default:
+		return Job{}, fmt.Errorf("too many queued backfill jobs")
+	}
+	s.jobs[job.Id] = job
+	s.order = append(s.order, job.Id)
+	s.prune()
+	return *job, nil
+}
+
+// prune removes the oldest finished jobs over the maximum. Must be called
+// with the lock held.
+func (s *Scheduler) prune() {
+	finished := 0
+	for _, id := range s.order {
+		if s.jobs[id].finished() {
+			finished++
+		}
+	}
+	order := s.order[:0]
+	for _, id := range s.order {
+		if finished > maxFinishedJobs && s.jobs[id].finished() {
+			delete(s.jobs, id)
+			finished--
+			continue
+		}
+		order = append(order, id)
+	}
+	s.order = order
+}
+
+// Job returns the status of the job id.
+func (s *Scheduler) Job(id string) (Job, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// Jobs returns the status of every job kept, newest first.
+func (s *Scheduler) Jobs() []Job {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	list := make([]Job, 0, len(s.order))
+	for i := len(s.order) - 1; i >= 0; i-- {
+		list = append(list, *s.jobs[s.order[i]])
+	}
+	return list
+}
+
+// Cancel cancels a queued or running job. Rows already written are kept.
+func (s *Scheduler) Cancel(id string) (Job, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, fmt.Errorf("unknown job: %s", id)
+	}
+	switch job.State {
+	case StateQueued:
+		s.finish(job, StateCancelled, nil)
+	case StateRunning:
+		job.cancel()
+	}
+	return *job, nil
+}
+
+// finish must be called with the lock held.
+func (s *Scheduler) finish(job *Job, state string, err error) {
+	now := time.Now()
+	job.State = state
+	job.Finished = &now
+	if err != nil {
+		job.Error = err.Error()
+	}
+	metrics.GetCounter("backfill_jobs_total",
+		metrics.Labels{"kind": job.Kind, "state": state}).Inc()
+}
+
+// Run runs the queued jobs until ctx is cancelled, cancelling any job
+// running then.
+func (s *Scheduler) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-s.queue:
+			s.run(ctx, job)
+		}
+	}
+}
+
+func (s *Scheduler) run(ctx context.Context, job *Job) {
+	s.lock.Lock()
+	if job.State != StateQueued {
+		s.lock.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	now := time.Now()
+	job.State = StateRunning
+	job.Started = &now
+	job.cancel = cancel
+	request := job.Request
+	s.lock.Unlock()
+
+	log.Printf("backfill: job %s: %s %s %s from %s to %s\n", job.Id, request.Exchange,
+		request.Symbol, request.Kind, request.From.UTC().Format(time.RFC3339),
+		request.To.UTC().Format(time.RFC3339))
+	source := s.sources[request.Exchange]
+	written := func(rows int) {
+		metrics.GetCounter("backfill_rows_total", metrics.Labels{"kind": request.Kind}).Add(int64(rows))
+		s.lock.Lock()
+		job.Rows += rows
+		s.lock.Unlock()
+	}
+	var err error
+	if request.Kind == KindTrades {
+		err = source.BackfillTrades(ctx, request.Symbol, request.From, request.To,
+			func(trades []pkg.CommonTrade) error {
+				if err := s.writer.WriteTrades(request.Exchange, trades); err != nil {
+					return err
+				}
+				written(len(trades))
+				return nil
+			})
+	} else {
+		err = source.BackfillCandles(ctx, request.Symbol, job.interval, request.From, request.To,
+			func(list []candles.Candle) error {
+				closed := make([]candles.Candle, 0, len(list))
+				for _, candle := range list {
+					if candle.Closed {
+						closed = append(closed, candle)
+					}
+				}
+				if len(closed) == 0 {
+					return nil
+				}
+				if err := s.writer.WriteCandles(request.Exchange, closed); err != nil {
+					return err
+				}
+				written(len(closed))
+				return nil
+			})
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch {
+	case err == nil:
+		s.finish(job, StateDone, nil)
+	case ctx.Err() != nil:
+		s.finish(job, StateCancelled, nil)
+	default:
+		s.finish(job, StateFailed, err)
+	}
+	log.Printf("backfill: job %s: %s, %d rows\n", job.Id, job.State, job.Rows)
+}
@@ -0,0 +1,289 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"context"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/metrics"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	metrics.Describe("stream_connects_total",
+		"Successful stream connections.")
+	metrics.Describe("stream_disconnects_total",
+		"Stream disconnects and failed connection attempts.")
+	metrics.Describe("stream_connected",
+		"1 if the stream is currently connected.")
+}
+
+type BackoffOptions struct {
+	// The delay before the first retry, doubled on each further retry up to
+	// Max.
+	Min time.Duration
+	Max time.Duration
+
+	// Each delay is randomized by up to this fraction in either direction
+	// so many clients don't reconnect in lockstep.
+	Jitter float64
+
+	// Give up after this many consecutive failures, 0 to retry forever.
+	MaxRetries int
+
+	// A connection that stays up this long resets the backoff. Connections
+	// that drop sooner keep backing off, so a server that accepts and then
+	// immediately drops us is not hammered.
+	StableAfter time.Duration
+}
+
+var DefaultBackoffOptions = BackoffOptions{
+	Min:         1 * time.Second,
+	Max:         2 * time.Minute,
+	Jitter:      0.2,
+	StableAfter: time.Minute,
+}
+
+// Backoff provides exponentially increasing delays with jitter between
+// reconnection attempts.
+type Backoff struct {
+	options BackoffOptions
+	retries int
+}
+
+func NewBackoff(options BackoffOptions) *Backoff {
+	return &Backoff{
+		options: options,
+	}
+}
+
+// Next returns the delay before the next attempt, or false if the maximum
+// number of retries has been reached.
+func (b *Backoff) Next() (time.Duration, bool) {
+	if b.options.MaxRetries > 0 && b.retries >= b.options.MaxRetries {
+		return 0, false
+	}
+	delay := b.options.Min
+	for i := 0; i < b.retries && delay < b.options.Max; i++ {
+		delay *= 2
+	}
+	if delay > b.options.Max {
+		delay = b.options.Max
+	}
+	if b.options.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * b.options.Jitter * float64(delay))
+	}
+	b.retries++
+	return delay, true
+}
+
+// Retries returns the number of consecutive retries.
+func (b *Backoff) Retries() int {
+	return b.retries
+}
+
+func (b *Backoff) Reset() {
+	b.retries = 0
+}
+
+// StreamStatus is the connection state of a stream.
+type StreamStatus struct {
+	Name      string `json:"name"`
+	Connected bool   `json:"connected"`
+
+	// When the stream last lost its connection, or was created if it has
+	// never connected. Zero while connected.
+	DownSince time.Time `json:"down_since,omitempty"`
+
+	// When the last message was received, zero if none has been.
+	LastMessage time.Time `json:"last_message,omitempty"`
+
+	// The number of times the stream has connected again after its first
+	// connection.
+	Reconnects int64 `json:"reconnects"`
+
+	createdAt time.Time
+	connects  int64
+}
+
+// HasConnected returns true if the stream has connected at least once.
+func (s StreamStatus) HasConnected() bool {
+	return s.connects > 0
+}
+
+// LastMessageAge returns the time since the last message at now, or since
+// the stream was created if it has not received one.
+func (s StreamStatus) LastMessageAge(now time.Time) time.Duration {
+	if s.LastMessage.IsZero() {
+		return now.Sub(s.createdAt)
+	}
+	return now.Sub(s.LastMessage)
+}
+
+var streamHealths = map[string]*StreamHealth{}
+var streamHealthsLock sync.Mutex
+
+// StreamStatuses returns the status of every running stream, by name.
+func StreamStatuses() []StreamStatus {
+	streamHealthsLock.Lock()
+	list := make([]StreamStatus, 0, len(streamHealths))
+	for _, h := range streamHealths {
+		list = append(list, h.Status())
+	}
+	streamHealthsLock.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// StreamHealth tracks the connections of a stream client, backing off
+// between reconnection attempts and logging the health of each connection.
+type StreamHealth struct {
+	name        string
+	backoff     *Backoff
+	connectedAt time.Time
+	messages    int64
+	connects    *metrics.Counter
+	disconnects *metrics.Counter
+	connected   *metrics.Gauge
+
+	downSince time.Time
+	createdAt time.Time
+	lock      sync.Mutex
+
+	// Unix nanoseconds of the last message, updated atomically as it is
+	// written by the read loop.
+	lastMessage int64
+}
+
+func NewStreamHealth(name string, options BackoffOptions) *StreamHealth {
+	labels := metrics.Labels{"stream": name}
+	h := &StreamHealth{
+		name:        name,
+		backoff:     NewBackoff(options),
+		connects:    metrics.GetCounter("stream_connects_total", labels),
+		disconnects: metrics.GetCounter("stream_disconnects_total", labels),
+		connected:   metrics.GetGauge("stream_connected", labels),
+		downSince:   time.Now(),
+	}
+	h.createdAt = h.downSince
+	streamHealthsLock.Lock()
+	streamHealths[name] = h
+	streamHealthsLock.Unlock()
+	return h
+}
+
+// Status returns the current connection state.
+func (h *StreamHealth) Status() StreamStatus {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	status := StreamStatus{
+		Name:      h.name,
+		Connected: h.downSince.IsZero(),
+		DownSince: h.downSince,
+		createdAt: h.createdAt,
+	}
+	if last := atomic.LoadInt64(&h.lastMessage); last != 0 {
+		status.LastMessage = time.Unix(0, last)
+	}
+	status.connects = h.connects.Value()
+	if status.connects > 1 {
+		status.Reconnects = status.connects - 1
+	}
+	return status
+}
+
+func (h *StreamHealth) setDown(down bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if !down {
+		h.downSince = time.Time{}
+	} else if h.downSince.IsZero() {
+		h.downSince = time.Now()
+	}
+}
+
+// stopped removes the stream from the stream statuses once it is no longer
+// being run.
+func (h *StreamHealth) stopped() {
+	streamHealthsLock.Lock()
+	defer streamHealthsLock.Unlock()
+	if streamHealths[h.name] == h {
+		delete(streamHealths, h.name)
+	}
+}
+
+// Connected records a successful connection.
+func (h *StreamHealth) Connected() {
+	h.setDown(false)
+	h.connectedAt = time.Now()
+	h.messages = 0
+	h.connects.Inc()
+	h.connected.Set(1)
+	if retries := h.backoff.Retries(); retries > 0 {
+		log.Printf("%s: connected after %d retries\n", h.name, retries)
+	}
+}
+
+// Message records a message received on the current connection.
+func (h *StreamHealth) Message() {
+	h.messages++
+	atomic.StoreInt64(&h.lastMessage, time.Now().UnixNano())
+}
+
+// Disconnected records a dropped connection, or a failed connection attempt
+// if not connected, and waits before the next attempt. Returns false if ctx
+// is cancelled or the retry limit has been reached.
+func (h *StreamHealth) Disconnected(ctx context.Context, err error) bool {
+	h.disconnects.Inc()
+	h.connected.Set(0)
+	h.setDown(true)
+
+	if !h.connectedAt.IsZero() {
+		uptime := time.Now().Sub(h.connectedAt)
+		log.Printf("%s: disconnected after %v with %d messages: %v\n",
+			h.name, uptime.Round(time.Second), h.messages, err)
+		if uptime >= h.backoff.options.StableAfter {
+			h.backoff.Reset()
+		}
+		h.connectedAt = time.Time{}
+	} else if err != nil {
+		log.Printf("%s: connection failed: %v\n", h.name, err)
+	}
+
+	if ctx.Err() != nil {
+		h.stopped()
+		return false
+	}
+	delay, ok := h.backoff.Next()
+	if !ok {
+		log.Printf("error: %s: giving up after %d retries\n",
+			h.name, h.backoff.Retries())
+		return false
+	}
+	log.Printf("%s: reconnecting in %v (retry %d)\n", h.name,
+		delay.Round(time.Millisecond), h.backoff.Retries())
+	if !Sleep(ctx, delay) {
+		h.stopped()
+		return false
+	}
+	return true
+}
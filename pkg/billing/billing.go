@@ -0,0 +1,424 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package billing meters the usage of each account, for operators running
+// the scanner as a hosted service. Usage is reported to an external billing
+// system through reporters, and soft and hard usage limits are enforced per
+// billing period.
+package billing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/metrics"
+	"sync"
+	"time"
+)
+
+func init() {
+	metrics.Describe("billing_limit_rejections_total",
+		"Connections rejected and rule evaluations skipped for accounts over their hard limit.")
+	metrics.Describe("billing_report_errors_total",
+		"Failed attempts to report usage or limits to a reporter.")
+}
+
+const (
+	PeriodDay   = "day"
+	PeriodMonth = "month"
+)
+
+const (
+	LimitSoft = "soft"
+	LimitHard = "hard"
+)
+
+// ErrHardLimit is returned for accounts that have reached a hard limit for
+// the current period.
+var ErrHardLimit = errors.New("usage limit reached")
+
+// Limit is the usage allowed per period. Zero fields are unlimited.
+type Limit struct {
+	ConnectionMinutes float64 `mapstructure:"connection_minutes" json:"connection_minutes,omitempty"`
+	Messages          int64   `mapstructure:"messages" json:"messages,omitempty"`
+	RulesEvaluated    int64   `mapstructure:"rules_evaluated" json:"rules_evaluated,omitempty"`
+}
+
+// exceeded returns true if usage has reached any of the limits.
+func (l Limit) exceeded(usage Usage) bool {
+	return (l.ConnectionMinutes > 0 && usage.ConnectionMinutes >= l.ConnectionMinutes) ||
+		(l.Messages > 0 && usage.Messages >= l.Messages) ||
+		(l.RulesEvaluated > 0 && usage.RulesEvaluated >= l.RulesEvaluated)
+}
+
+// Limits are reported on reaching the soft limit, and enforced on reaching
+// the hard limit: new connections are rejected, open connections closed
+// and the account's alert rules no longer evaluated until the next period.
+type Limits struct {
+	Soft Limit `mapstructure:"soft" json:"soft"`
+	Hard Limit `mapstructure:"hard" json:"hard"`
+}
+
+type Config struct {
+	// Metering is disabled unless enabled.
+	Enabled bool `mapstructure:"enabled"`
+
+	// day or month. Usage and limits reset at the start of each period,
+	// in UTC.
+	Period string `mapstructure:"period"`
+
+	// How often the usage of accounts that changed is reported.
+	ReportInterval time.Duration `mapstructure:"report_interval"`
+
+	// Usage and limit notifications are posted to these webhooks.
+	Webhooks []WebhookConfig `mapstructure:"webhooks"`
+
+	// Limits keyed by account, or "default" for accounts without their
+	// own.
+	Limits map[string]Limits `mapstructure:"limits"`
+}
+
+var DefaultConfig = Config{
+	Period:         PeriodMonth,
+	ReportInterval: time.Minute,
+}
+
+// Override returns c with the fields that are set in override replaced.
+// Limits are merged.
+func (c Config) Override(override Config) Config {
+	if override.Enabled {
+		c.Enabled = true
+	}
+	if override.Period != "" {
+		c.Period = override.Period
+	}
+	if override.ReportInterval != 0 {
+		c.ReportInterval = override.ReportInterval
+	}
+	if len(override.Webhooks) > 0 {
+		c.Webhooks = override.Webhooks
+	}
+	if len(override.Limits) > 0 {
+		limits := map[string]Limits{}
+		for account, limit := range c.Limits {
+			limits[account] = limit
+		}
+		for account, limit := range override.Limits {
+			limits[account] = limit
+		}
+		c.Limits = limits
+	}
+	return c
+}
+
+func (c Config) Validate() error {
+	if c.Period != PeriodDay && c.Period != PeriodMonth {
+		return fmt.Errorf("billing period must be day or month")
+	}
+	if c.ReportInterval <= 0 {
+		return fmt.Errorf("billing report interval must be positive")
+	}
+	for _, webhook := range c.Webhooks {
+		if webhook.Url == "" {
+			return fmt.Errorf("billing webhook url required")
+		}
+	}
+	return nil
+}
+
+// AccountLimits returns the limits of account.
+func (c Config) AccountLimits(account string) Limits {
+	if limits, ok := c.Limits[account]; ok {
+		return limits
+	}
+	return c.Limits["default"]
+}
+
+// periodStart returns the start of the period containing now.
+func (c Config) periodStart(now time.Time) time.Time {
+	now = now.UTC()
+	if c.Period == PeriodDay {
+		return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// Usage is the usage of an account in the period starting at PeriodStart.
+type Usage struct {
+	Account           string    `json:"account"`
+	PeriodStart       time.Time `json:"period_start"`
+	ConnectionMinutes float64   `json:"connection_minutes"`
+	Messages          int64     `json:"messages"`
+	RulesEvaluated    int64     `json:"rules_evaluated"`
+}
+
+// LimitEvent is reported when an account reaches its soft or hard limit.
+type LimitEvent struct {
+	Account   string    `json:"account"`
+	Limit     string    `json:"limit"`
+	Timestamp time.Time `json:"timestamp"`
+	Usage     Usage     `json:"usage"`
+	Limits    Limit     `json:"limits"`
+}
+
+// Reporter is the hook for an external billing system. It is called from
+// the meter's Run goroutine.
+type Reporter interface {
+	// ReportUsage is called with the period to date usage of accounts
+	// that changed since the last report.
+	ReportUsage(usage []Usage) error
+
+	// ReportLimit is called once per period when an account reaches its
+	// soft limit, and again when it reaches its hard limit.
+	ReportLimit(event LimitEvent) error
+}
+
+type account struct {
+	usage Usage
+
+	// Open connections, and when their minutes were last added to the
+	// usage.
+	connections int
+	accrued     time.Time
+
+	soft    bool
+	hard    bool
+	changed bool
+}
+
+// Meter meters the usage of accounts. Safe for concurrent use. A nil meter
+// meters nothing and allows everything.
+type Meter struct {
+	config    Config
+	reporters []Reporter
+	accounts  map[string]*account
+	events    []LimitEvent
+	lock      sync.Mutex
+
+	// Closed when Run returns.
+	done chan struct{}
+
+	rejections *metrics.Counter
+	errors     *metrics.Counter
+}
+
+// NewMeter creates a meter, with a reporter for each configured webhook.
+func NewMeter(config Config) (*Meter, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	meter := &Meter{
+		config:     config,
+		accounts:   map[string]*account{},
+		done:       make(chan struct{}),
+		rejections: metrics.GetCounter("billing_limit_rejections_total", nil),
+		errors:     metrics.GetCounter("billing_report_errors_total", nil),
+	}
+	for _, webhook := range config.Webhooks {
+		meter.AddReporter(NewWebhookReporter(webhook))
+	}
+	return meter, nil
+}
+
+// AddReporter adds a reporter. Must be called before Run.
+func (m *Meter) AddReporter(reporter Reporter) {
+	m.reporters = append(m.reporters, reporter)
+}
+
+// get returns the account, starting a new period if the current one has
+// ended. Must be called with the lock held.
+func (m *Meter) get(name string, now time.Time) *account {
+	a := m.accounts[name]
+	if a == nil {
+		a = &account{
+			usage:   Usage{Account: name, PeriodStart: m.config.periodStart(now)},
+			accrued: now,
+		}
+		m.accounts[name] = a
+	}
+	m.accrue(a, now)
+	if start := m.config.periodStart(now); start.After(a.usage.PeriodStart) {
+		a.usage = Usage{Account: name, PeriodStart: start}
+		a.soft = false
+		a.hard = false
+		a.changed = true
+	}
+	return a
+}
+
+// accrue adds the minutes of the open connections since they were last
+// accrued. Minutes from before the period are added to the previous period
+// as it is reported before being replaced.
+func (m *Meter) accrue(a *account, now time.Time) {
+	if a.connections > 0 && now.After(a.accrued) {
+		a.usage.ConnectionMinutes += float64(a.connections) * now.Sub(a.accrued).Minutes()
+		a.changed = true
+	}
+	a.accrued = now
+}
+
+// check queues limit events for limits newly reached. Must be called with
+// the lock held.
+func (m *Meter) check(a *account, now time.Time) {
+	limits := m.config.AccountLimits(a.usage.Account)
+	if !a.soft && limits.Soft.exceeded(a.usage) {
+		a.soft = true
+		m.events = append(m.events, LimitEvent{Account: a.usage.Account, Limit: LimitSoft,
+			Timestamp: now, Usage: a.usage, Limits: limits.Soft})
+		log.Printf("billing: %s reached its soft limit\n", a.usage.Account)
+	}
+	if !a.hard && limits.Hard.exceeded(a.usage) {
+		a.hard = true
+		m.events = append(m.events, LimitEvent{Account: a.usage.Account, Limit: LimitHard,
+			Timestamp: now, Usage: a.usage, Limits: limits.Hard})
+		log.Printf("billing: %s reached its hard limit\n", a.usage.Account)
+	}
+}
+
+// Connect records a new connection of account, returning a function to
+// call when it closes. Returns ErrHardLimit if the account has reached its
+// hard limit.
+func (m *Meter) Connect(name string) (func(), error) {
+	if m == nil {
+		return func() {}, nil
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	a := m.get(name, time.Now())
+	if a.hard {
+		m.rejections.Inc()
+		return nil, ErrHardLimit
+	}
+	a.connections++
+	a.changed = true
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			m.lock.Lock()
+			defer m.lock.Unlock()
+			now := time.Now()
+			a := m.get(name, now)
+			a.connections--
+			m.check(a, now)
+		})
+	}, nil
+}
+
+// Delivered records count messages delivered to account. Returns
+// ErrHardLimit once the account has reached its hard limit.
+func (m *Meter) Delivered(name string, count int64) error {
+	if m == nil {
+		return nil
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	a := m.get(name, now)
+	a.usage.Messages += count
+	a.changed = true
+	m.check(a, now)
+	if a.hard {
+		return ErrHardLimit
+	}
+	return nil
+}
+
+// Evaluate records the evaluation of a rule of account, returning false
+// without recording it if the account has reached its hard limit.
+func (m *Meter) Evaluate(name string) bool {
+	if m == nil {
+		return true
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	a := m.get(name, now)
+	if a.hard {
+		return false
+	}
+	a.usage.RulesEvaluated++
+	a.changed = true
+	m.check(a, now)
+	return true
+}
+
+// Usage returns the usage of account in the current period.
+func (m *Meter) Usage(name string) Usage {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.get(name, time.Now()).usage
+}
+
+// Done is closed once Run has made its final report.
+func (m *Meter) Done() <-chan struct{} {
+	return m.done
+}
+
+// Run reports usage every report interval until ctx is cancelled, then
+// reports once more.
+func (m *Meter) Run(ctx context.Context) {
+	defer close(m.done)
+	ticker := time.NewTicker(m.config.ReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			m.report()
+			return
+		case <-ticker.C:
+			m.report()
+		}
+	}
+}
+
+// report reports the limit events since the last report and the usage of
+// accounts that changed, including the final usage of periods that ended.
+func (m *Meter) report() {
+	m.lock.Lock()
+	now := time.Now()
+	usage := []Usage{}
+	for name, a := range m.accounts {
+		if start := m.config.periodStart(now); start.After(a.usage.PeriodStart) {
+			m.accrue(a, start)
+			usage = append(usage, a.usage)
+		}
+		a = m.get(name, now)
+		m.check(a, now)
+		if a.changed {
+			usage = append(usage, a.usage)
+			a.changed = false
+		}
+	}
+	events := m.events
+	m.events = nil
+	m.lock.Unlock()
+
+	for _, reporter := range m.reporters {
+		for _, event := range events {
+			if err := reporter.ReportLimit(event); err != nil {
+				m.errors.Inc()
+				log.Printf("error: billing: failed to report limit of %s: %v\n", event.Account, err)
+			}
+		}
+		if len(usage) == 0 {
+			continue
+		}
+		if err := reporter.ReportUsage(usage); err != nil {
+			m.errors.Inc()
+			log.Printf("error: billing: failed to report usage: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package billing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+type WebhookConfig struct {
+	Url     string            `mapstructure:"url" json:"url"`
+	Headers map[string]string `mapstructure:"headers" json:"-"`
+}
+
+// webhookMessage is posted for usage reports, with type usage, and limit
+// events, with type limit.
+type webhookMessage struct {
+	Type  string      `json:"type"`
+	Usage []Usage     `json:"usage,omitempty"`
+	Limit *LimitEvent `json:"limit,omitempty"`
+}
+
+// WebhookReporter posts usage and limit events as JSON to a URL.
+type WebhookReporter struct {
+	config WebhookConfig
+}
+
+func NewWebhookReporter(config WebhookConfig) *WebhookReporter {
+	return &WebhookReporter{
+		config: config,
+	}
+}
+
+func (r *WebhookReporter) ReportUsage(usage []Usage) error {
+	return r.post(webhookMessage{Type: "usage", Usage: usage})
+}
+
+func (r *WebhookReporter) ReportLimit(event LimitEvent) error {
+	return r.post(webhookMessage{Type: "limit", Limit: &event})
+}
+
+func (r *WebhookReporter) post(message webhookMessage) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("POST", r.config.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("content-type", "application/json")
+	for key, value := range r.config.Headers {
+		request.Header.Set(key, value)
+	}
+	response, err := webhookClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("status %d", response.StatusCode)
+	}
+	return nil
+}
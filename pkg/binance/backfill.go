@@ -0,0 +1,166 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binance
+
+import (
+	"context"
+	"encoding/json"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/candles"
+	"time"
+)
+
+// The maximum number of klines Binance will return per request.
+const klinesLimit = 1000
+
+// BackfillTrades fetches the aggregate trades of symbol with a timestamp in
+// [from, to) from the REST API, calling cb with each page, oldest first.
+// The first trade is found by time, an hour at a time as that is the
+// longest range Binance accepts, then the rest are fetched by ID.
+func (b *TradeStream) BackfillTrades(ctx context.Context, symbol string, from time.Time, to time.Time,
+	cb func(trades []pkg.CommonTrade) error) error {
+	throttle := time.NewTicker(historyRequestInterval)
+	defer throttle.Stop()
+
+	var page []pkg.CommonTrade
+	for start := from; len(page) == 0 && start.Before(to); start = start.Add(time.Hour) {
+		if err := waitThrottle(ctx, throttle.C); err != nil {
+			return err
+		}
+		end := start.Add(time.Hour - time.Millisecond)
+		if !end.Before(to) {
+			end = to.Add(-time.Millisecond)
+		}
+		rawTrades, err := b.rest.GetAggTradesBetween(symbol, start, end, aggTradesLimit)
+		if err != nil {
+			return err
+		}
+		page = b.decodeRestTrades(symbol, rawTrades)
+	}
+
+	// Set once a page by ID is short, having reached the latest trade.
+	latest := false
+	for len(page) > 0 {
+		complete := false
+		for i, trade := range page {
+			if !trade.Timestamp.Before(to) {
+				page = page[:i]
+				complete = true
+				break
+			}
+		}
+		if len(page) > 0 {
+			if err := cb(page); err != nil {
+				return err
+			}
+		}
+		if complete || latest {
+			return nil
+		}
+		if err := waitThrottle(ctx, throttle.C); err != nil {
+			return err
+		}
+		rawTrades, err := b.rest.GetAggTrades(symbol, page[len(page)-1].Id+1, aggTradesLimit)
+		if err != nil {
+			return err
+		}
+		latest = len(rawTrades) < aggTradesLimit
+		page = b.decodeRestTrades(symbol, rawTrades)
+	}
+	return nil
+}
+
+// BackfillCandles fetches the candles of symbol at interval with an open
+// time in [from, to) from the REST API, calling cb with each page, oldest
+// first.
+func (b *TradeStream) BackfillCandles(ctx context.Context, symbol string, interval time.Duration,
+	from time.Time, to time.Time, cb func(candles []candles.Candle) error) error {
+	throttle := time.NewTicker(historyRequestInterval)
+	defer throttle.Stop()
+
+	for start := from; start.Before(to); {
+		if err := waitThrottle(ctx, throttle.C); err != nil {
+			return err
+		}
+		body, err := b.rest.GetKlines(symbol, candles.FormatInterval(interval), start,
+			to.Add(-time.Millisecond), klinesLimit)
+		if err != nil {
+			return err
+		}
+		page, err := candles.DecodeKlines(body, symbol, interval)
+		if err != nil {
+			return err
+		}
+		if len(page) == 0 {
+			break
+		}
+		if err := cb(page); err != nil {
+			return err
+		}
+		if len(page) < klinesLimit {
+			break
+		}
+		start = page[len(page)-1].OpenTime.Add(interval)
+	}
+	return nil
+}
+
+// decodeRestTrades decodes aggregate trades in the REST format, skipping
+// any that fail to decode.
+func (b *TradeStream) decodeRestTrades(symbol string, rawTrades []json.RawMessage) []pkg.CommonTrade {
+	trades := make([]pkg.CommonTrade, 0, len(rawTrades))
+	for _, rawTrade := range rawTrades {
+		body, err := AggTradeStreamBody(symbol, rawTrade)
+		if err != nil {
+			continue
+		}
+		trade, err := b.DecodeTrade(body)
+		if err != nil {
+			continue
+		}
+		trades = append(trades, pkg.CommonTradeFromBinanceTrade(*trade))
+	}
+	return trades
+}
+
+func waitThrottle(ctx context.Context, throttle <-chan time.Time) error {
+	select {
+	case <-throttle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *Exchange) BackfillTrades(ctx context.Context, symbol string, from time.Time, to time.Time,
+	cb func(trades []pkg.CommonTrade) error) error {
+	return e.tradeStream.BackfillTrades(ctx, symbol, from, to, cb)
+}
+
+func (e *Exchange) BackfillCandles(ctx context.Context, symbol string, interval time.Duration,
+	from time.Time, to time.Time, cb func(candles []candles.Candle) error) error {
+	return e.tradeStream.BackfillCandles(ctx, symbol, interval, from, to, cb)
+}
+
+func (e *FuturesExchange) BackfillTrades(ctx context.Context, symbol string, from time.Time, to time.Time,
+	cb func(trades []pkg.CommonTrade) error) error {
+	return e.tradeStream.BackfillTrades(ctx, symbol, from, to, cb)
+}
+
+func (e *FuturesExchange) BackfillCandles(ctx context.Context, symbol string, interval time.Duration,
+	from time.Time, to time.Time, cb func(candles []candles.Candle) error) error {
+	return e.tradeStream.BackfillCandles(ctx, symbol, interval, from, to, cb)
+}
@@ -0,0 +1,83 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binance
+
+import (
+	"gitlab.com/crankykernel/cryptotrader/binance"
+	"sync"
+)
+
+type ContinuityState int
+
+const (
+	// The trade directly follows the last seen trade for the symbol, or is
+	// the first trade seen for the symbol.
+	ContinuityOk ContinuityState = iota
+
+	// One or more trades are missing between the last seen trade and
+	// this trade.
+	ContinuityGap
+
+	// The trade is not newer than the last seen trade.
+	ContinuityStale
+)
+
+// TradeContinuity tracks the last aggregate trade ID seen per symbol.
+// Binance aggregate trade IDs are contiguous per symbol, so any jump in the
+// ID means trades were missed, usually due to a reconnect.
+type TradeContinuity struct {
+	lastIds map[string]int64
+	lock    sync.RWMutex
+}
+
+func NewTradeContinuity() *TradeContinuity {
+	return &TradeContinuity{
+		lastIds: map[string]int64{},
+	}
+}
+
+// Check compares the trade against the last trade seen for the symbol and
+// records it as the last trade if it is newer. On a gap the range of missing
+// aggregate trade IDs is returned, inclusive.
+func (c *TradeContinuity) Check(trade *binance.StreamAggTrade) (state ContinuityState, from int64, to int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	lastId, ok := c.lastIds[trade.Symbol]
+	if !ok {
+		c.lastIds[trade.Symbol] = trade.AggTradeID
+		return ContinuityOk, 0, 0
+	}
+
+	if trade.AggTradeID <= lastId {
+		return ContinuityStale, 0, 0
+	}
+
+	c.lastIds[trade.Symbol] = trade.AggTradeID
+
+	if trade.AggTradeID > lastId+1 {
+		return ContinuityGap, lastId + 1, trade.AggTradeID - 1
+	}
+
+	return ContinuityOk, 0, 0
+}
+
+// LastId returns the last aggregate trade ID seen for symbol, or 0 if no
+// trades have been seen.
+func (c *TradeContinuity) LastId(symbol string) int64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.lastIds[symbol]
+}
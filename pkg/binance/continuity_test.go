@@ -0,0 +1,95 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binance_test
+
+import (
+	"context"
+	"gitlab.com/crankykernel/cryptotrader/binance"
+	local "gitlab.com/crankykernel/cryptoxscanner/pkg/binance"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/testutil"
+	"testing"
+	"time"
+)
+
+func TestTradeContinuityCheck(t *testing.T) {
+	continuity := local.NewTradeContinuity()
+	tests := []struct {
+		symbol string
+		id     int64
+		state  local.ContinuityState
+		from   int64
+		to     int64
+		lastId int64
+	}{
+		{"ETHBTC", 100, local.ContinuityOk, 0, 0, 100},
+		{"ETHBTC", 101, local.ContinuityOk, 0, 0, 101},
+		{"ETHBTC", 101, local.ContinuityStale, 0, 0, 101},
+		{"ETHBTC", 50, local.ContinuityStale, 0, 0, 101},
+		{"ETHBTC", 105, local.ContinuityGap, 102, 104, 105},
+		{"ETHBTC", 106, local.ContinuityOk, 0, 0, 106},
+		{"LTCBTC", 1, local.ContinuityOk, 0, 0, 1},
+		{"LTCBTC", 3, local.ContinuityGap, 2, 2, 3},
+	}
+	for i, test := range tests {
+		trade := &binance.StreamAggTrade{Symbol: test.symbol, AggTradeID: test.id}
+		state, from, to := continuity.Check(trade)
+		if state != test.state || from != test.from || to != test.to {
+			t.Errorf("%d: %s %d: expected %v %d-%d, got %v %d-%d", i, test.symbol, test.id,
+				test.state, test.from, test.to, state, from, to)
+		}
+		if lastId := continuity.LastId(test.symbol); lastId != test.lastId {
+			t.Errorf("%d: %s: expected last id %d, got %d", i, test.symbol, test.lastId, lastId)
+		}
+	}
+	if lastId := continuity.LastId("XRPBTC"); lastId != 0 {
+		t.Errorf("expected last id 0 for an unseen symbol, got %d", lastId)
+	}
+}
+
+func TestTradeStreamBackfillsAfterReconnect(t *testing.T) {
+	m := testutil.NewMockExchange("ETHBTC")
+	defer m.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	testutil.UseFastReconnect(10 * time.Millisecond)
+	collector := startTradeStream(t, ctx, m, "reconnect")
+
+	trades := testutil.AggTrades("ETHBTC", 1, 10, time.Now(), 0.03, 0.0001)
+	publish(t, m, trades[:3]...)
+	received, err := collector.Collect(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIds(t, received, 1, 2, 3)
+
+	// The trades made during the outage are only available over REST.
+	m.Disconnect()
+	for m.Connections() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	m.AddAggTrades(trades[3:7]...)
+	if err := m.WaitSubscribed(ctx, local.AggTradeStreamName("ETHBTC")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first live trade after the reconnect is the last seen again.
+	publish(t, m, trades[2:]...)
+	received, err = collector.Collect(ctx, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIds(t, received, 4, 5, 6, 7, 8, 9, 10)
+}
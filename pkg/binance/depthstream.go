@@ -0,0 +1,435 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/depth"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/latency"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The number of levels requested in the REST snapshot used to initialize
+// a local book.
+const depthSnapshotLimit = 1000
+
+// The most snapshots fetched at once, as each has a weight of 50 against
+// the request limits and many are required after a reconnect.
+const maxConcurrentDepthSnapshots = 4
+
+// The delay before retrying a failed snapshot.
+const depthSnapshotRetryDelay = 5 * time.Second
+
+// The most updates buffered for a symbol while its snapshot is fetched, the
+// oldest are dropped beyond this.
+const maxPendingDepthUpdates = 1000
+
+type depthUpdateEvent struct {
+	EventType     string      `json:"e"`
+	EventTime     int64       `json:"E"`
+	Symbol        string      `json:"s"`
+	FirstUpdateId int64       `json:"U"`
+	FinalUpdateId int64       `json:"u"`
+	Bids          [][2]string `json:"b"`
+	Asks          [][2]string `json:"a"`
+}
+
+type depthStreamMessage struct {
+	Stream string          `json:"stream"`
+	Data   json.RawMessage `json:"data"`
+}
+
+type depthState struct {
+	book   *depth.Book
+	synced bool
+
+	// Set after a snapshot until the first update is applied, as the first
+	// update has different continuity rules.
+	first bool
+
+	// The updates received while the book is not synced, applied once a
+	// snapshot has been fetched.
+	pending []*depthUpdateEvent
+
+	// Set while a snapshot is being fetched.
+	fetching bool
+}
+
+// The queue of each subscriber, a subscriber only needs the latest book.
+var depthQueueOptions = pkg.QueueOptions{
+	Size:   1,
+	Policy: pkg.OverflowDrop,
+}
+
+// DepthStream maintains local order books from the Binance diff depth
+// streams. Books are only maintained for symbols that have subscribers as
+// each book requires a REST snapshot to initialize.
+type DepthStream struct {
+	states    map[string]*depthState
+	lock      sync.RWMutex
+	conn      *websocket.Conn
+	writeLock sync.Mutex
+	rest      *RestClient
+	prober    *latency.Prober
+	requestId int64
+	health    *pkg.StreamHealth
+	name      string
+
+	snapshotSlots chan struct{}
+
+	// Updated books are published keyed by symbol.
+	topic *pkg.Topic
+}
+
+func NewDepthStream() *DepthStream {
+	return NewCustomDepthStream("binance", NewRestClient(), StreamProber)
+}
+
+// NewCustomDepthStream returns a depth stream named name, fetching
+// snapshots from rest and connecting to the endpoint selected by prober,
+// such as those of a mock exchange.
+func NewCustomDepthStream(name string, rest *RestClient, prober *latency.Prober) *DepthStream {
+	return &DepthStream{
+		states:        map[string]*depthState{},
+		rest:          rest,
+		prober:        prober,
+		name:          name,
+		health:        pkg.NewStreamHealth(name+".depth", pkg.DefaultBackoffOptions),
+		topic:         pkg.DefaultBus.NewTopic(name+".depth", (*depth.Book)(nil)),
+		snapshotSlots: make(chan struct{}, maxConcurrentDepthSnapshots),
+	}
+}
+
+func DepthStreamName(symbol string) string {
+	return fmt.Sprintf("%s@depth@100ms", strings.ToLower(symbol))
+}
+
+// Subscribe returns a channel that receives the book for symbol each time it
+// is updated. Updates are dropped for subscribers that are not ready to
+// receive.
+func (s *DepthStream) Subscribe(symbol string) chan *depth.Book {
+	symbol = strings.ToUpper(symbol)
+
+	s.lock.Lock()
+	channel := s.topic.SubscribeKey(symbol, symbol, depthQueueOptions).(chan *depth.Book)
+	if s.states[symbol] == nil {
+		s.states[symbol] = &depthState{
+			book: depth.NewBook(symbol),
+		}
+		s.lock.Unlock()
+		s.sendSubscription("SUBSCRIBE", symbol)
+		return channel
+	}
+	s.lock.Unlock()
+
+	return channel
+}
+
+func (s *DepthStream) Unsubscribe(symbol string, channel chan *depth.Book) {
+	symbol = strings.ToUpper(symbol)
+
+	s.lock.Lock()
+	if s.states[symbol] == nil || !s.topic.Unsubscribe(channel) {
+		s.lock.Unlock()
+		return
+	}
+	remove := s.topic.Subscribers(symbol) == 0
+	if remove {
+		delete(s.states, symbol)
+	}
+	s.lock.Unlock()
+
+	if remove {
+		s.sendSubscription("UNSUBSCRIBE", symbol)
+	}
+}
+
+func (s *DepthStream) sendSubscription(method string, symbols ...string) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if s.conn == nil {
+		// Will be subscribed on connect.
+		return nil
+	}
+	params := []string{}
+	for _, symbol := range symbols {
+		params = append(params, DepthStreamName(symbol))
+	}
+	s.requestId++
+	err := s.conn.WriteJSON(map[string]interface{}{
+		"method": method,
+		"params": params,
+		"id":     s.requestId,
+	})
+	if err != nil {
+		log.Printf("binance: depth: failed to send %s: %v\n", method, err)
+	}
+	return err
+}
+
+// Run maintains the books of subscribed symbols until ctx is cancelled.
+func (s *DepthStream) Run(ctx context.Context) {
+	for {
+		err := s.runOnce(ctx)
+		if ctx.Err() != nil || !s.health.Disconnected(ctx, err) {
+			return
+		}
+	}
+}
+
+func (s *DepthStream) runOnce(ctx context.Context) error {
+	log.Printf("binance: connecting to depth stream.")
+	conn, _, err := websocket.DefaultDialer.Dial(s.prober.Selected(), nil)
+	if err != nil {
+		return err
+	}
+	defer pkg.CloseOnDone(ctx, conn)()
+	s.health.Connected()
+
+	// All books need to be resynced after a reconnect, replacing the state
+	// discards the updates buffered and snapshots fetched for the previous
+	// connection.
+	s.lock.Lock()
+	symbols := []string{}
+	for symbol := range s.states {
+		s.states[symbol] = &depthState{
+			book: depth.NewBook(symbol),
+		}
+		symbols = append(symbols, symbol)
+	}
+	s.lock.Unlock()
+
+	s.writeLock.Lock()
+	s.conn = conn
+	s.writeLock.Unlock()
+
+	defer func() {
+		s.writeLock.Lock()
+		s.conn = nil
+		s.writeLock.Unlock()
+		conn.Close()
+	}()
+
+	if len(symbols) > 0 {
+		if err := s.sendSubscription("SUBSCRIBE", symbols...); err != nil {
+			return err
+		}
+	}
+	log.Printf("binance: connected to depth stream.")
+
+	for {
+		_, body, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		s.health.Message()
+		pkg.RecordRaw(s.name+".depth", body)
+
+		var message depthStreamMessage
+		if err := json.Unmarshal(body, &message); err != nil {
+			log.WithField("exchange", "binance").Limited().
+				Errorf("failed to decode depth message: %v", err)
+			continue
+		}
+		if message.Stream == "" {
+			// Response to a subscription request.
+			continue
+		}
+
+		var event depthUpdateEvent
+		if err := json.Unmarshal(message.Data, &event); err != nil {
+			log.WithField("exchange", "binance").Limited().
+				Errorf("failed to decode depth update: %v", err)
+			continue
+		}
+
+		s.handleUpdate(ctx, &event)
+	}
+}
+
+// handleUpdate applies event to the book of its symbol. Following the
+// procedure documented by Binance, updates are buffered while the book is
+// not synced and a snapshot is fetched in the background, so a slow
+// snapshot does not hold up the books of other symbols.
+func (s *DepthStream) handleUpdate(ctx context.Context, event *depthUpdateEvent) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	state := s.states[event.Symbol]
+	if state == nil {
+		return
+	}
+	if state.synced && s.apply(state, event) {
+		s.topic.PublishKey(state.book.Symbol, state.book)
+		return
+	}
+
+	state.synced = false
+	state.pending = append(state.pending, event)
+	if len(state.pending) > maxPendingDepthUpdates {
+		state.pending = state.pending[1:]
+	}
+	if !state.fetching {
+		state.fetching = true
+		go s.sync(ctx, event.Symbol, state)
+	}
+}
+
+// sync fetches snapshots of the book of symbol until the updates buffered
+// while fetching can be applied to one, or the symbol is no longer being
+// tracked with state.
+func (s *DepthStream) sync(ctx context.Context, symbol string, state *depthState) {
+	for {
+		var snapshot *depthSnapshot
+		var err error
+		select {
+		case s.snapshotSlots <- struct{}{}:
+			snapshot, err = s.getSnapshot(symbol)
+			<-s.snapshotSlots
+		case <-ctx.Done():
+		}
+
+		s.lock.Lock()
+		if ctx.Err() != nil || s.states[symbol] != state {
+			state.fetching = false
+			s.lock.Unlock()
+			return
+		}
+		if err == nil && s.resync(state, snapshot) {
+			s.topic.PublishKey(state.book.Symbol, state.book)
+			state.fetching = false
+			s.lock.Unlock()
+			return
+		}
+		s.lock.Unlock()
+
+		if err != nil {
+			log.Printf("binance: failed to get depth snapshot for %s: %v\n", symbol, err)
+			select {
+			case <-time.After(depthSnapshotRetryDelay):
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
+type depthSnapshot struct {
+	lastUpdateId int64
+	bids         []depth.Level
+	asks         []depth.Level
+}
+
+func (s *DepthStream) getSnapshot(symbol string) (*depthSnapshot, error) {
+	snapshot, err := s.rest.GetDepth(symbol, depthSnapshotLimit)
+	if err != nil {
+		return nil, err
+	}
+	bids, err := decodeLevels(snapshot.Bids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode bids: %v", err)
+	}
+	asks, err := decodeLevels(snapshot.Asks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode asks: %v", err)
+	}
+	return &depthSnapshot{
+		lastUpdateId: snapshot.LastUpdateId,
+		bids:         bids,
+		asks:         asks,
+	}, nil
+}
+
+// resync resets the book of state to snapshot and applies the buffered
+// updates, returning false if they do not continue from the snapshot and
+// another is required. Must be called with the lock held.
+func (s *DepthStream) resync(state *depthState, snapshot *depthSnapshot) bool {
+	state.book.Reset(snapshot.lastUpdateId, snapshot.bids, snapshot.asks)
+	state.synced = true
+	state.first = true
+	pending := state.pending
+	state.pending = nil
+	for i, event := range pending {
+		if !s.apply(state, event) {
+			state.synced = false
+			state.pending = pending[i:]
+			return false
+		}
+	}
+	return true
+}
+
+// apply applies event to the synced book of state, returning false if the
+// book needs to be resynced as event does not continue from it. Must be
+// called with the lock held.
+func (s *DepthStream) apply(state *depthState, event *depthUpdateEvent) bool {
+	lastUpdateId := state.book.LastUpdateId
+
+	// Update is older than the book.
+	if event.FinalUpdateId <= lastUpdateId {
+		return true
+	}
+
+	if state.first {
+		if event.FirstUpdateId > lastUpdateId+1 {
+			log.Printf("binance: depth snapshot for %s is older than first update, resyncing\n",
+				event.Symbol)
+			return false
+		}
+	} else if event.FirstUpdateId != lastUpdateId+1 {
+		log.Printf("binance: depth update gap for %s (expected %d, got %d), resyncing\n",
+			event.Symbol, lastUpdateId+1, event.FirstUpdateId)
+		return false
+	}
+
+	bids, err := decodeLevels(event.Bids)
+	if err != nil {
+		log.WithFields(log.Fields{"exchange": "binance", "symbol": event.Symbol}).Limited().
+			Errorf("failed to decode depth update: %v", err)
+		return true
+	}
+	asks, err := decodeLevels(event.Asks)
+	if err != nil {
+		log.WithFields(log.Fields{"exchange": "binance", "symbol": event.Symbol}).Limited().
+			Errorf("failed to decode depth update: %v", err)
+		return true
+	}
+	state.book.Apply(event.FinalUpdateId, bids, asks)
+	state.first = false
+	return true
+}
+
+func decodeLevels(raw [][2]string) ([]depth.Level, error) {
+	levels := make([]depth.Level, 0, len(raw))
+	for _, entry := range raw {
+		price, err := strconv.ParseFloat(entry[0], 64)
+		if err != nil {
+			return nil, err
+		}
+		quantity, err := strconv.ParseFloat(entry[1], 64)
+		if err != nil {
+			return nil, err
+		}
+		levels = append(levels, depth.Level{Price: price, Quantity: quantity})
+	}
+	return levels, nil
+}
@@ -0,0 +1,156 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binance_test
+
+import (
+	"context"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/binance"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/depth"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/testutil"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func startDepthStream(t *testing.T, ctx context.Context, m *testutil.MockExchange,
+	name string, symbols ...string) map[string]chan *depth.Book {
+	stream := m.DepthStream(name)
+	go stream.Run(ctx)
+	books := map[string]chan *depth.Book{}
+	streams := []string{}
+	for _, symbol := range symbols {
+		books[symbol] = stream.Subscribe(symbol)
+		streams = append(streams, binance.DepthStreamName(symbol))
+	}
+	if err := m.WaitSubscribed(ctx, streams...); err != nil {
+		t.Fatal(err)
+	}
+	return books
+}
+
+func publishDepth(t *testing.T, m *testutil.MockExchange, updates ...testutil.DepthUpdate) {
+	for _, update := range updates {
+		if err := m.PublishDepthUpdate(update); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// waitBook waits for a book to be received with the bids and asks expected.
+func waitBook(t *testing.T, ctx context.Context, books chan *depth.Book,
+	bids []depth.Level, asks []depth.Level) {
+	var got [2][]depth.Level
+	for {
+		select {
+		case book := <-books:
+			got = [2][]depth.Level{book.Bids(10), book.Asks(10)}
+			if reflect.DeepEqual(got, [2][]depth.Level{bids, asks}) {
+				return
+			}
+		case <-ctx.Done():
+			t.Fatalf("expected bids %v and asks %v, last got %v", bids, asks, got)
+		}
+	}
+}
+
+func TestDepthStreamBuffersUpdatesUntilSynced(t *testing.T) {
+	m := testutil.NewMockExchange("ETHBTC")
+	defer m.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	m.SetDepth("ETHBTC", testutil.DepthSnapshot{
+		LastUpdateId: 10,
+		Bids:         []depth.Level{{Price: 0.03, Quantity: 1}},
+		Asks:         []depth.Level{{Price: 0.031, Quantity: 1}},
+	})
+	release := m.HoldDepth("ETHBTC")
+	defer release()
+	books := startDepthStream(t, ctx, m, "depth.buffer", "ETHBTC")
+
+	publishDepth(t, m,
+		// Older than the snapshot, dropped.
+		testutil.DepthUpdate{Symbol: "ETHBTC", FirstUpdateId: 5, FinalUpdateId: 8,
+			Bids: []depth.Level{{Price: 0.029, Quantity: 5}}},
+		// Straddles the snapshot.
+		testutil.DepthUpdate{Symbol: "ETHBTC", FirstUpdateId: 9, FinalUpdateId: 12,
+			Bids: []depth.Level{{Price: 0.0301, Quantity: 2}}},
+		testutil.DepthUpdate{Symbol: "ETHBTC", FirstUpdateId: 13, FinalUpdateId: 13,
+			Asks: []depth.Level{{Price: 0.031, Quantity: 0}, {Price: 0.0312, Quantity: 1}}},
+	)
+	release()
+
+	waitBook(t, ctx, books["ETHBTC"],
+		[]depth.Level{{Price: 0.0301, Quantity: 2}, {Price: 0.03, Quantity: 1}},
+		[]depth.Level{{Price: 0.0312, Quantity: 1}})
+}
+
+func TestDepthStreamSnapshotDoesNotBlockOtherSymbols(t *testing.T) {
+	m := testutil.NewMockExchange("ETHBTC", "BNBBTC")
+	defer m.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	m.SetDepth("ETHBTC", testutil.DepthSnapshot{LastUpdateId: 10,
+		Bids: []depth.Level{{Price: 0.03, Quantity: 1}}})
+	m.SetDepth("BNBBTC", testutil.DepthSnapshot{LastUpdateId: 20,
+		Bids: []depth.Level{{Price: 0.002, Quantity: 1}}})
+	release := m.HoldDepth("ETHBTC")
+	defer release()
+	books := startDepthStream(t, ctx, m, "depth.block", "ETHBTC", "BNBBTC")
+
+	publishDepth(t, m,
+		testutil.DepthUpdate{Symbol: "ETHBTC", FirstUpdateId: 11, FinalUpdateId: 11,
+			Bids: []depth.Level{{Price: 0.0301, Quantity: 1}}},
+		testutil.DepthUpdate{Symbol: "BNBBTC", FirstUpdateId: 21, FinalUpdateId: 21,
+			Bids: []depth.Level{{Price: 0.0021, Quantity: 1}}},
+	)
+
+	// The book of BNBBTC is synced while the snapshot of ETHBTC is held.
+	waitBook(t, ctx, books["BNBBTC"],
+		[]depth.Level{{Price: 0.0021, Quantity: 1}, {Price: 0.002, Quantity: 1}},
+		[]depth.Level{})
+	release()
+	waitBook(t, ctx, books["ETHBTC"],
+		[]depth.Level{{Price: 0.0301, Quantity: 1}, {Price: 0.03, Quantity: 1}},
+		[]depth.Level{})
+}
+
+func TestDepthStreamResyncsOnGap(t *testing.T) {
+	m := testutil.NewMockExchange("ETHBTC")
+	defer m.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	m.SetDepth("ETHBTC", testutil.DepthSnapshot{LastUpdateId: 10,
+		Bids: []depth.Level{{Price: 0.03, Quantity: 1}}})
+	books := startDepthStream(t, ctx, m, "depth.gap", "ETHBTC")
+
+	publishDepth(t, m, testutil.DepthUpdate{Symbol: "ETHBTC", FirstUpdateId: 11,
+		FinalUpdateId: 11, Bids: []depth.Level{{Price: 0.0301, Quantity: 1}}})
+	waitBook(t, ctx, books["ETHBTC"],
+		[]depth.Level{{Price: 0.0301, Quantity: 1}, {Price: 0.03, Quantity: 1}},
+		[]depth.Level{})
+
+	// Updates 12-14 are missed, the book is resynced from a new snapshot.
+	m.SetDepth("ETHBTC", testutil.DepthSnapshot{LastUpdateId: 16,
+		Bids: []depth.Level{{Price: 0.04, Quantity: 1}}})
+	publishDepth(t, m, testutil.DepthUpdate{Symbol: "ETHBTC", FirstUpdateId: 15,
+		FinalUpdateId: 15, Bids: []depth.Level{{Price: 0.05, Quantity: 1}}})
+	waitBook(t, ctx, books["ETHBTC"],
+		[]depth.Level{{Price: 0.04, Quantity: 1}},
+		[]depth.Level{})
+}
@@ -0,0 +1,41 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binance
+
+import (
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/latency"
+)
+
+// The endpoints of the combined stream, which all serve the same market
+// data streams.
+var StreamEndpoints = []latency.Endpoint{
+	{Name: "stream.binance.com:9443", Url: "wss://stream.binance.com:9443/stream"},
+	{Name: "stream.binance.com:443", Url: "wss://stream.binance.com:443/stream"},
+	{Name: "data-stream.binance.vision", Url: "wss://data-stream.binance.vision/stream"},
+}
+
+// StreamProber selects the endpoint the trade, ticker and depth streams
+// connect to.
+var StreamProber = latency.NewProber("binance.stream", StreamEndpoints, latency.DialProbe)
+
+// The endpoint of the USD-M futures combined stream.
+var FuturesStreamEndpoints = []latency.Endpoint{
+	{Name: "fstream.binance.com", Url: "wss://fstream.binance.com/stream"},
+}
+
+// FuturesStreamProber selects the endpoint the futures streams connect to.
+var FuturesStreamProber = latency.NewProber(FuturesName+".stream",
+	FuturesStreamEndpoints, latency.DialProbe)
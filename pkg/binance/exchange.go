@@ -0,0 +1,91 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binance
+
+import (
+	"gitlab.com/crankykernel/cryptotrader/binance"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"time"
+)
+
+// Exchange implements pkg.Exchange for Binance.
+type Exchange struct {
+	tradeStream  *TradeStream
+	tickerStream *TickerStream
+	depthStream  *DepthStream
+	rest         *RestClient
+}
+
+func NewExchange() *Exchange {
+	return &Exchange{
+		tradeStream:  NewTradeStream(),
+		tickerStream: NewTickerStream(),
+		depthStream:  NewDepthStream(),
+		rest:         NewRestClient(),
+	}
+}
+
+// SetHistoryDuration sets the amount of trade history to backfill from the
+// REST API on startup.
+func (e *Exchange) SetHistoryDuration(duration time.Duration) {
+	e.tradeStream.HistoryDuration = duration
+}
+
+// SetStreamsPerConnection sets the number of trade streams subscribed to on
+// each websocket connection.
+func (e *Exchange) SetStreamsPerConnection(count int) {
+	e.tradeStream.StreamsPerConnection = count
+}
+
+func (e *Exchange) Name() string {
+	return "binance"
+}
+
+func (e *Exchange) Market() pkg.Market {
+	return pkg.MarketSpot
+}
+
+func (e *Exchange) GetSymbols() ([]string, error) {
+	symbols, err := binance.NewAnonymousClient().GetAllSymbols()
+	if err != nil {
+		return nil, err
+	}
+	return e.tradeStream.SymbolFilter().Apply(symbols), nil
+}
+
+func (e *Exchange) GetTradingRules() (map[string]pkg.TradingRules, error) {
+	info, err := e.rest.GetExchangeInfo()
+	if err != nil {
+		return nil, err
+	}
+	rules := map[string]pkg.TradingRules{}
+	for _, symbol := range info.Symbols {
+		rules[symbol.Symbol] = symbol.TradingRules()
+	}
+	return rules, nil
+}
+
+func (e *Exchange) TradeStream() pkg.TradeStream {
+	return e.tradeStream
+}
+
+func (e *Exchange) TickerStream() pkg.TickerStream {
+	return e.tickerStream
+}
+
+func (e *Exchange) DepthStream() pkg.DepthStream {
+	return e.depthStream
+}
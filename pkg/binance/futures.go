@@ -0,0 +1,377 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The name of the USD-M futures exchange.
+const FuturesName = "binance-futures"
+
+// How often funding rates are polled for all symbols, and open interest for
+// each symbol. Mark prices and funding rates are also streamed, the poll
+// fills in symbols the stream has not updated.
+const (
+	fundingPollInterval      = time.Minute
+	openInterestPollInterval = 5 * time.Minute
+)
+
+// FuturesExchange implements pkg.Exchange and pkg.FuturesExchange for the
+// Binance USD-M perpetual futures. Trades and tickers are streamed like
+// spot, with mark prices, funding and open interest tracked per symbol.
+type FuturesExchange struct {
+	tradeStream  *TradeStream
+	tickerStream *TickerStream
+	rest         *RestClient
+
+	derivatives map[string]*pkg.DerivativesInfo
+	lock        sync.RWMutex
+
+	liquidations *pkg.Topic
+}
+
+func NewFuturesExchange() *FuturesExchange {
+	return &FuturesExchange{
+		tradeStream:  NewFuturesTradeStream(),
+		tickerStream: NewFuturesTickerStream(),
+		rest:         NewFuturesRestClient(),
+		derivatives:  map[string]*pkg.DerivativesInfo{},
+		liquidations: pkg.DefaultBus.NewTopic(FuturesName+".liquidations", pkg.Liquidation{}),
+	}
+}
+
+// SetHistoryDuration sets the amount of trade history to backfill from the
+// REST API on startup.
+func (e *FuturesExchange) SetHistoryDuration(duration time.Duration) {
+	e.tradeStream.HistoryDuration = duration
+}
+
+// SetStreamsPerConnection sets the number of trade streams subscribed to on
+// each websocket connection.
+func (e *FuturesExchange) SetStreamsPerConnection(count int) {
+	e.tradeStream.StreamsPerConnection = count
+}
+
+func (e *FuturesExchange) Name() string {
+	return FuturesName
+}
+
+func (e *FuturesExchange) Market() pkg.Market {
+	return pkg.MarketFutures
+}
+
+func (e *FuturesExchange) GetSymbols() ([]string, error) {
+	symbols, err := e.rest.GetFuturesSymbols()
+	if err != nil {
+		return nil, err
+	}
+	return e.tradeStream.SymbolFilter().Apply(symbols), nil
+}
+
+// GetTradingRules returns the rules of the perpetual contracts.
+func (e *FuturesExchange) GetTradingRules() (map[string]pkg.TradingRules, error) {
+	info, err := e.rest.GetExchangeInfo()
+	if err != nil {
+		return nil, err
+	}
+	rules := map[string]pkg.TradingRules{}
+	for _, symbol := range info.Symbols {
+		if symbol.ContractType == "PERPETUAL" {
+			rules[symbol.Symbol] = symbol.TradingRules()
+		}
+	}
+	return rules, nil
+}
+
+func (e *FuturesExchange) TradeStream() pkg.TradeStream {
+	return e.tradeStream
+}
+
+func (e *FuturesExchange) TickerStream() pkg.TickerStream {
+	return e.tickerStream
+}
+
+// DepthStream returns nil as futures order books are not supported.
+func (e *FuturesExchange) DepthStream() pkg.DepthStream {
+	return nil
+}
+
+func (e *FuturesExchange) Derivatives(symbol string) (pkg.DerivativesInfo, bool) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	info := e.derivatives[strings.ToUpper(symbol)]
+	if info == nil {
+		return pkg.DerivativesInfo{}, false
+	}
+	return *info, true
+}
+
+func (e *FuturesExchange) AllDerivatives() []pkg.DerivativesInfo {
+	e.lock.RLock()
+	all := make([]pkg.DerivativesInfo, 0, len(e.derivatives))
+	for _, info := range e.derivatives {
+		all = append(all, *info)
+	}
+	e.lock.RUnlock()
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Symbol < all[j].Symbol
+	})
+	return all
+}
+
+func (e *FuturesExchange) AddLiquidationSink(sink pkg.Sink) {
+	e.liquidations.AddSink(sink)
+}
+
+func (e *FuturesExchange) RunDerivatives(ctx context.Context) {
+	go e.pollFunding(ctx)
+	go e.pollOpenInterest(ctx)
+
+	bodies := make(chan []byte)
+	go NewStreamClient(FuturesStreamProber, "futures.markPrice",
+		"!markPrice@arr@1s", "!forceOrder@arr").RunRaw(ctx, bodies)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case body := <-bodies:
+			if err := e.handleMessage(body); err != nil {
+				log.WithField("exchange", FuturesName).Limited().
+					Errorf("failed to decode message: %v", err)
+			}
+		}
+	}
+}
+
+type futuresStreamMessage struct {
+	Stream string          `json:"stream"`
+	Data   json.RawMessage `json:"data"`
+}
+
+type markPriceUpdate struct {
+	Symbol          string `json:"s"`
+	MarkPrice       string `json:"p"`
+	IndexPrice      string `json:"i"`
+	FundingRate     string `json:"r"`
+	NextFundingTime int64  `json:"T"`
+	EventTime       int64  `json:"E"`
+}
+
+type forceOrderEvent struct {
+	EventTime int64 `json:"E"`
+	Order     struct {
+		Symbol         string `json:"s"`
+		Side           string `json:"S"`
+		Price          string `json:"p"`
+		AvgPrice       string `json:"ap"`
+		FilledQuantity string `json:"z"`
+		TradeTime      int64  `json:"T"`
+	} `json:"o"`
+}
+
+func (e *FuturesExchange) handleMessage(body []byte) error {
+	var message futuresStreamMessage
+	if err := json.Unmarshal(body, &message); err != nil {
+		return err
+	}
+	switch {
+	case strings.HasPrefix(message.Stream, "!markPrice@arr"):
+		updates := []markPriceUpdate{}
+		if err := json.Unmarshal(message.Data, &updates); err != nil {
+			return err
+		}
+		for _, update := range updates {
+			e.updateMarkPrice(update)
+		}
+	case message.Stream == "!forceOrder@arr":
+		var event forceOrderEvent
+		if err := json.Unmarshal(message.Data, &event); err != nil {
+			return err
+		}
+		liquidation := pkg.Liquidation{
+			Symbol:    event.Order.Symbol,
+			Side:      strings.ToLower(event.Order.Side),
+			Price:     parseFloat(event.Order.Price),
+			AvgPrice:  parseFloat(event.Order.AvgPrice),
+			Quantity:  parseFloat(event.Order.FilledQuantity),
+			Timestamp: time.Unix(0, event.Order.TradeTime*int64(time.Millisecond)),
+		}
+		if e.tradeStream.SymbolFilter().Allow(liquidation.Symbol) {
+			e.liquidations.Publish(liquidation)
+		}
+	}
+	return nil
+}
+
+func (e *FuturesExchange) updateMarkPrice(update markPriceUpdate) {
+	if !e.tradeStream.SymbolFilter().Allow(update.Symbol) {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	info := e.entry(update.Symbol)
+	info.MarkPrice = parseFloat(update.MarkPrice)
+	info.IndexPrice = parseFloat(update.IndexPrice)
+	info.FundingRate = parseFloat(update.FundingRate)
+	info.NextFundingTime = time.Unix(0, update.NextFundingTime*int64(time.Millisecond))
+	info.UpdatedAt = time.Unix(0, update.EventTime*int64(time.Millisecond))
+}
+
+// entry must be called with the lock held.
+func (e *FuturesExchange) entry(symbol string) *pkg.DerivativesInfo {
+	info := e.derivatives[symbol]
+	if info == nil {
+		info = &pkg.DerivativesInfo{Symbol: symbol}
+		e.derivatives[symbol] = info
+	}
+	return info
+}
+
+func (e *FuturesExchange) pollFunding(ctx context.Context) {
+	for {
+		indexes, err := e.rest.GetPremiumIndex()
+		if err != nil {
+			log.Printf("error: %s: failed to poll funding rates: %v\n", FuturesName, err)
+		} else {
+			e.lock.Lock()
+			for _, index := range indexes {
+				if !e.tradeStream.SymbolFilter().Allow(index.Symbol) {
+					continue
+				}
+				updatedAt := time.Unix(0, index.Time*int64(time.Millisecond))
+				info := e.entry(index.Symbol)
+				if !updatedAt.After(info.UpdatedAt) {
+					continue
+				}
+				info.MarkPrice = parseFloat(index.MarkPrice)
+				info.IndexPrice = parseFloat(index.IndexPrice)
+				info.FundingRate = parseFloat(index.LastFundingRate)
+				info.NextFundingTime = time.Unix(0, index.NextFundingTime*int64(time.Millisecond))
+				info.UpdatedAt = updatedAt
+			}
+			e.lock.Unlock()
+		}
+		if !pkg.Sleep(ctx, fundingPollInterval) {
+			return
+		}
+	}
+}
+
+// pollOpenInterest polls the open interest of each symbol in turn, as it is
+// not available for all symbols at once.
+func (e *FuturesExchange) pollOpenInterest(ctx context.Context) {
+	throttle := time.NewTicker(historyRequestInterval)
+	defer throttle.Stop()
+	for {
+		start := time.Now()
+		symbols, err := e.GetSymbols()
+		if err != nil {
+			log.Printf("error: %s: failed to get symbols: %v\n", FuturesName, err)
+		}
+		for _, symbol := range symbols {
+			select {
+			case <-throttle.C:
+			case <-ctx.Done():
+				return
+			}
+			openInterest, err := e.rest.GetOpenInterest(symbol)
+			if err != nil {
+				log.Printf("error: %s: failed to poll open interest for %s: %v\n",
+					FuturesName, symbol, err)
+				continue
+			}
+			e.lock.Lock()
+			info := e.entry(symbol)
+			info.OpenInterest = parseFloat(openInterest.OpenInterest)
+			info.OpenInterestTime = time.Unix(0, openInterest.Time*int64(time.Millisecond))
+			e.lock.Unlock()
+		}
+		if !pkg.Sleep(ctx, openInterestPollInterval-time.Now().Sub(start)) {
+			return
+		}
+	}
+}
+
+// GetFuturesSymbols returns the trading perpetual contracts of the futures
+// API.
+func (c *RestClient) GetFuturesSymbols() ([]string, error) {
+	info, err := c.GetExchangeInfo()
+	if err != nil {
+		return nil, err
+	}
+	symbols := []string{}
+	for _, symbol := range info.Symbols {
+		if symbol.Status == "TRADING" && symbol.ContractType == "PERPETUAL" {
+			symbols = append(symbols, symbol.Symbol)
+		}
+	}
+	return symbols, nil
+}
+
+type PremiumIndex struct {
+	Symbol          string `json:"symbol"`
+	MarkPrice       string `json:"markPrice"`
+	IndexPrice      string `json:"indexPrice"`
+	LastFundingRate string `json:"lastFundingRate"`
+	NextFundingTime int64  `json:"nextFundingTime"`
+	Time            int64  `json:"time"`
+}
+
+// GetPremiumIndex returns the mark price and funding rate of every symbol
+// of the futures API.
+func (c *RestClient) GetPremiumIndex() ([]PremiumIndex, error) {
+	indexes := []PremiumIndex{}
+	if err := c.get("/premiumIndex", nil, &indexes); err != nil {
+		return nil, err
+	}
+	return indexes, nil
+}
+
+type OpenInterest struct {
+	Symbol       string `json:"symbol"`
+	OpenInterest string `json:"openInterest"`
+	Time         int64  `json:"time"`
+}
+
+// GetOpenInterest returns the open interest of symbol from the futures API.
+func (c *RestClient) GetOpenInterest(symbol string) (*OpenInterest, error) {
+	params := url.Values{}
+	params.Set("symbol", symbol)
+	var openInterest OpenInterest
+	if err := c.get("/openInterest", params, &openInterest); err != nil {
+		return nil, err
+	}
+	if openInterest.Symbol == "" {
+		return nil, fmt.Errorf("no open interest returned")
+	}
+	return &openInterest, nil
+}
+
+func parseFloat(value string) float64 {
+	f, _ := strconv.ParseFloat(value, 64)
+	return f
+}
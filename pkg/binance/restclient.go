@@ -0,0 +1,253 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binance
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const restBaseUrl = "https://api.binance.com/api/v3"
+
+// The USD-M futures API, which serves the spot endpoints used here in the
+// same format.
+const futuresRestBaseUrl = "https://fapi.binance.com/fapi/v1"
+
+// RestClient is a small client for the public Binance REST endpoints that
+// are not covered by the cryptotrader client.
+type RestClient struct {
+	baseUrl string
+	client  *http.Client
+}
+
+func NewRestClient() *RestClient {
+	return newRestClient(restBaseUrl)
+}
+
+// NewFuturesRestClient returns a client for the USD-M futures API.
+func NewFuturesRestClient() *RestClient {
+	return newRestClient(futuresRestBaseUrl)
+}
+
+// NewRestClientWithUrl returns a client for an API at baseUrl, such as a
+// mock exchange.
+func NewRestClientWithUrl(baseUrl string) *RestClient {
+	return newRestClient(baseUrl)
+}
+
+func newRestClient(baseUrl string) *RestClient {
+	return &RestClient{
+		baseUrl: baseUrl,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+func (c *RestClient) get(path string, params url.Values, v interface{}) error {
+	u := fmt.Sprintf("%s%s", c.baseUrl, path)
+	if len(params) > 0 {
+		u = fmt.Sprintf("%s?%s", u, params.Encode())
+	}
+
+	response, err := c.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s: %s", path, response.Status, string(body))
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+// GetAggTrades returns up to limit aggregate trades for symbol starting at
+// aggregate trade ID fromId, or the most recent trades if fromId is
+// negative. The trades are returned undecoded in the REST format, which is
+// the stream format without the event fields.
+func (c *RestClient) GetAggTrades(symbol string, fromId int64, limit int) ([]json.RawMessage, error) {
+	params := url.Values{}
+	params.Set("symbol", symbol)
+	if fromId >= 0 {
+		params.Set("fromId", fmt.Sprintf("%d", fromId))
+	}
+	params.Set("limit", fmt.Sprintf("%d", limit))
+
+	trades := []json.RawMessage{}
+	if err := c.get("/aggTrades", params, &trades); err != nil {
+		return nil, err
+	}
+	return trades, nil
+}
+
+// GetAggTradesBetween returns up to limit aggregate trades for symbol with
+// a timestamp in [start, end], undecoded as GetAggTrades. The range must not
+// be longer than an hour.
+func (c *RestClient) GetAggTradesBetween(symbol string, start time.Time, end time.Time, limit int) ([]json.RawMessage, error) {
+	params := url.Values{}
+	params.Set("symbol", symbol)
+	params.Set("startTime", fmt.Sprintf("%d", start.UnixNano()/int64(time.Millisecond)))
+	params.Set("endTime", fmt.Sprintf("%d", end.UnixNano()/int64(time.Millisecond)))
+	params.Set("limit", fmt.Sprintf("%d", limit))
+
+	trades := []json.RawMessage{}
+	if err := c.get("/aggTrades", params, &trades); err != nil {
+		return nil, err
+	}
+	return trades, nil
+}
+
+// GetKlines returns up to limit klines for symbol at interval, such as 1m,
+// with an open time in [start, end], undecoded.
+func (c *RestClient) GetKlines(symbol string, interval string, start time.Time, end time.Time, limit int) (json.RawMessage, error) {
+	params := url.Values{}
+	params.Set("symbol", symbol)
+	params.Set("interval", interval)
+	params.Set("startTime", fmt.Sprintf("%d", start.UnixNano()/int64(time.Millisecond)))
+	params.Set("endTime", fmt.Sprintf("%d", end.UnixNano()/int64(time.Millisecond)))
+	params.Set("limit", fmt.Sprintf("%d", limit))
+
+	var klines json.RawMessage
+	if err := c.get("/klines", params, &klines); err != nil {
+		return nil, err
+	}
+	return klines, nil
+}
+
+type DepthSnapshot struct {
+	LastUpdateId int64       `json:"lastUpdateId"`
+	Bids         [][2]string `json:"bids"`
+	Asks         [][2]string `json:"asks"`
+}
+
+// GetDepth returns an order book snapshot for symbol with up to limit levels
+// per side.
+func (c *RestClient) GetDepth(symbol string, limit int) (*DepthSnapshot, error) {
+	params := url.Values{}
+	params.Set("symbol", symbol)
+	params.Set("limit", fmt.Sprintf("%d", limit))
+
+	var snapshot DepthSnapshot
+	if err := c.get("/depth", params, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+type ExchangeInfoSymbol struct {
+	Symbol       string   `json:"symbol"`
+	Status       string   `json:"status"`
+	ContractType string   `json:"contractType"`
+	OrderTypes   []string `json:"orderTypes"`
+
+	// Filters have a filterType and parameters that depend on the type,
+	// with numbers as strings.
+	Filters []map[string]interface{} `json:"filters"`
+}
+
+type ExchangeInfo struct {
+	Symbols []ExchangeInfoSymbol `json:"symbols"`
+}
+
+// GetExchangeInfo returns the symbols and their trading rules.
+func (c *RestClient) GetExchangeInfo() (*ExchangeInfo, error) {
+	var info ExchangeInfo
+	if err := c.get("/exchangeInfo", nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// GetTradingSymbols returns the symbols with a status of TRADING.
+func (c *RestClient) GetTradingSymbols() ([]string, error) {
+	info, err := c.GetExchangeInfo()
+	if err != nil {
+		return nil, err
+	}
+	symbols := []string{}
+	for _, symbol := range info.Symbols {
+		if symbol.Status == "TRADING" {
+			symbols = append(symbols, symbol.Symbol)
+		}
+	}
+	return symbols, nil
+}
+
+// TradingRules converts the exchange info of a symbol to the common
+// trading rules. The futures API names the minimum notional differently.
+func (s *ExchangeInfoSymbol) TradingRules() pkg.TradingRules {
+	rules := pkg.TradingRules{
+		Symbol:     s.Symbol,
+		Status:     s.Status,
+		OrderTypes: s.OrderTypes,
+	}
+	for _, filter := range s.Filters {
+		value := func(name string) float64 {
+			f, _ := strconv.ParseFloat(fmt.Sprint(filter[name]), 64)
+			return f
+		}
+		switch filter["filterType"] {
+		case "PRICE_FILTER":
+			rules.TickSize = value("tickSize")
+		case "LOT_SIZE":
+			rules.StepSize = value("stepSize")
+			rules.MinQty = value("minQty")
+			rules.MaxQty = value("maxQty")
+		case "MIN_NOTIONAL", "NOTIONAL":
+			if _, ok := filter["notional"]; ok {
+				rules.MinNotional = value("notional")
+			} else {
+				rules.MinNotional = value("minNotional")
+			}
+		}
+	}
+	return rules
+}
+
+// AggTradeStreamBody wraps an aggregate trade as returned by the REST API in
+// a combined stream message so it can be decoded and cached exactly like a
+// trade received from the websocket.
+func AggTradeStreamBody(symbol string, raw json.RawMessage) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+
+	data := map[string]interface{}{}
+	if err := decoder.Decode(&data); err != nil {
+		return nil, err
+	}
+	data["e"] = "aggTrade"
+	data["s"] = symbol
+	data["E"] = data["T"]
+
+	return json.Marshal(map[string]interface{}{
+		"stream": AggTradeStreamName(symbol),
+		"data":   data,
+	})
+}
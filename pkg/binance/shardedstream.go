@@ -0,0 +1,96 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binance
+
+import (
+	"context"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/latency"
+	"sync"
+)
+
+// The default number of streams subscribed to per websocket connection.
+// Binance allows more, but smaller connections limit the impact of a single
+// dropped connection and keep the connection URL short.
+const DefaultStreamsPerConnection = 200
+
+// ShardedStreamClient splits a list of streams across multiple connections,
+// each reconnecting independently, and merges their messages into one
+// channel. As each stream is on a single connection the messages of a
+// stream stay in order.
+type ShardedStreamClient struct {
+	name          string
+	perConnection int
+	streams       map[string]bool
+	shards        int
+	prober        *latency.Prober
+	lock          sync.Mutex
+}
+
+func NewShardedStreamClient(prober *latency.Prober, name string, perConnection int) *ShardedStreamClient {
+	if perConnection <= 0 {
+		perConnection = DefaultStreamsPerConnection
+	}
+	return &ShardedStreamClient{
+		name:          name,
+		perConnection: perConnection,
+		streams:       map[string]bool{},
+		prober:        prober,
+	}
+}
+
+// AddStreams starts new connections for the streams not already subscribed
+// to, sending their message bodies to channel until ctx is cancelled. Streams
+// no longer listed are left subscribed as they simply stop receiving
+// messages. Returns the number of streams added.
+func (c *ShardedStreamClient) AddStreams(ctx context.Context, streams []string, channel chan []byte) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	added := []string{}
+	for _, stream := range streams {
+		if !c.streams[stream] {
+			c.streams[stream] = true
+			added = append(added, stream)
+		}
+	}
+
+	for i := 0; i < len(added); i += c.perConnection {
+		end := i + c.perConnection
+		if end > len(added) {
+			end = len(added)
+		}
+		shard := NewStreamClient(c.prober, fmt.Sprintf("%s.%d", c.name, c.shards),
+			added[i:end]...)
+		shard.recordName = "binance." + c.name
+		c.shards++
+		go shard.RunRaw(ctx, channel)
+	}
+
+	if len(added) > 0 {
+		log.Printf("binance: %s: added %d streams, %d streams on %d connections\n",
+			c.name, len(added), len(c.streams), c.shards)
+	}
+	return len(added)
+}
+
+// Shards returns the number of connections started.
+func (c *ShardedStreamClient) Shards() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.shards
+}
@@ -16,28 +16,59 @@
 package binance
 
 import (
+	"context"
+	"fmt"
 	"gitlab.com/crankykernel/cryptotrader/binance"
-	"time"
+	"github.com/gorilla/websocket"
 	"encoding/json"
 	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/latency"
+	"strings"
+	"sync"
 )
 
+// StreamClient reads from a Binance combined stream. The connection is
+// managed here, rather than by the cryptotrader client, so it can be closed
+// to interrupt a blocked read on shutdown.
 type StreamClient struct {
 	name          string
-	client        *binance.StreamClient
 	streams       []string
+	conn          *websocket.Conn
+	stop          func()
+	lock          sync.Mutex
+	health        *pkg.StreamHealth
+
+	// The stream name raw messages are recorded as, shared by the shards
+	// of a sharded stream.
+	recordName string
+
+	// Selects the combined stream endpoint to connect to.
+	prober *latency.Prober
 }
 
-func NewStreamClient(name string, streams ...string) *StreamClient {
+func NewStreamClient(prober *latency.Prober, name string, streams ...string) *StreamClient {
 	return &StreamClient{
 		name:          name,
-		client:        binance.NewStreamClient(),
 		streams:       streams,
+		prober:        prober,
+		health:        pkg.NewStreamHealth("binance."+name, pkg.DefaultBackoffOptions),
+		recordName:    "binance." + name,
 	}
 }
 
 func (s *StreamClient) ReadNext() ([]byte, error) {
-	_, body, err := s.client.Next()
+	s.lock.Lock()
+	conn := s.conn
+	s.lock.Unlock()
+	if conn == nil {
+		return nil, fmt.Errorf("not connected")
+	}
+	_, body, err := conn.ReadMessage()
+	if err == nil {
+		s.health.Message()
+		pkg.RecordRaw(s.recordName, body)
+	}
 	return body, err
 }
 
@@ -47,45 +78,103 @@ func (s *StreamClient) Decode(buf []byte) (*binance.CombinedStreamMessage, error
 	return &message, err
 }
 
-func (s *StreamClient) Run(channel chan *binance.CombinedStreamMessage) {
+// Run sends each message to channel until ctx is cancelled, reconnecting
+// with backoff on error.
+func (s *StreamClient) Run(ctx context.Context, channel chan *binance.CombinedStreamMessage) {
+	s.run(ctx, func(body []byte) bool {
+		message, err := s.Decode(body)
+		if err != nil {
+			log.WithFields(log.Fields{"exchange": "binance", "stream": s.name}).Limited().
+				Errorf("failed to decode message: %v", err)
+			return true
+		}
+		select {
+		case channel <- message:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	})
+}
+
+// RunRaw is like Run but sends the undecoded message bodies.
+func (s *StreamClient) RunRaw(ctx context.Context, channel chan []byte) {
+	s.run(ctx, func(body []byte) bool {
+		select {
+		case channel <- body:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	})
+}
+
+// run calls handle with each message body until ctx is cancelled, the retry
+// limit is reached or handle returns false.
+func (s *StreamClient) run(ctx context.Context, handle func(body []byte) bool) {
+	defer s.Close()
 	for {
 		// Connect, runs in its own loop until connected.
 		log.Printf("binance: connecting to stream [%s]\n", s.name)
-		s.Connect()
+		if !s.Connect(ctx) {
+			return
+		}
 		log.Printf("binance: connected to stream [%s]\n", s.name)
 
 		// Read loop.
-	ReadLoop:
 		for {
 			body, err := s.ReadNext()
 			if err != nil {
-				log.Printf("binance: read error on stream [%s]: %v\n",
-					s.name, err)
-				break ReadLoop
+				s.Close()
+				if !s.Disconnected(ctx, err) {
+					return
+				}
+				break
 			}
-
-			message, err := s.Decode(body)
-			if err != nil {
-				log.Printf("binance: failed to decode message on stream [%s]: %v\n",
-					s.name, err)
-				goto ReadLoop
+			if !handle(body) {
+				return
 			}
-
-			channel <- message
 		}
-
-		time.Sleep(1 * time.Second)
 	}
 }
 
-func (s *StreamClient) Connect() {
+// Connect loops with backoff until connected, returning false if ctx is
+// cancelled or the retry limit is reached first. The connection is closed
+// when ctx is cancelled.
+func (s *StreamClient) Connect(ctx context.Context) bool {
+	url := fmt.Sprintf("%s?streams=%s", s.prober.Selected(), strings.Join(s.streams, "/"))
 	for {
-		err := s.client.Connect(s.streams...)
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
 		if err == nil {
-			return
+			s.Close()
+			s.lock.Lock()
+			s.conn = conn
+			s.stop = pkg.CloseOnDone(ctx, conn)
+			s.lock.Unlock()
+			s.health.Connected()
+			return true
+		}
+		if !s.health.Disconnected(ctx, err) {
+			return false
 		}
-		log.Printf("binance: failed to connect to stream [%s]: %v\n",
-			s.name, err)
-		time.Sleep(1 * time.Second)
+	}
+}
+
+// Disconnected records a read error on the connection and waits before
+// reconnecting. Returns false if the client should stop.
+func (s *StreamClient) Disconnected(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	return s.health.Disconnected(ctx, err)
+}
+
+func (s *StreamClient) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.conn != nil {
+		s.stop()
+		s.conn.Close()
+		s.conn = nil
 	}
 }
@@ -16,58 +16,132 @@
 package binance
 
 import (
+	"context"
 	"gitlab.com/crankykernel/cryptoxscanner/pkg"
 	"time"
 	"gitlab.com/crankykernel/cryptotrader/binance"
 	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/latency"
 )
 
 type TickerStream struct {
-	Cache *pkg.RedisInputCache
+	Cache pkg.InputCache
+
+	// The name of the stream connection and the endpoint it connects to.
+	streamName string
+	prober     *latency.Prober
 }
 
 func NewTickerStream() *TickerStream {
-	tickerStream := &TickerStream{}
-	cache := pkg.NewRedisInputCache("binance")
+	return newTickerStream("binance", "binance.ticker", StreamProber)
+}
+
+// NewFuturesTickerStream returns a ticker stream of the USD-M futures.
+func NewFuturesTickerStream() *TickerStream {
+	return newTickerStream(FuturesName, "futures.ticker", FuturesStreamProber)
+}
+
+// NewCustomTickerStream returns a ticker stream named name connecting to
+// the endpoint selected by prober, such as that of a mock exchange.
+func NewCustomTickerStream(name string, prober *latency.Prober) *TickerStream {
+	return newTickerStream(name, name+".ticker", prober)
+}
+
+func newTickerStream(cacheName string, streamName string, prober *latency.Prober) *TickerStream {
+	tickerStream := &TickerStream{
+		streamName: streamName,
+		prober:     prober,
+	}
+	cache := pkg.NewInputCache(cacheName)
 	if err := cache.Ping(); err != nil {
 		log.Printf("Redis not available. Tickers will not be cached.")
 	} else {
+		cache.SetRetention(time.Hour)
 		tickerStream.Cache = cache
 	}
 
 	return tickerStream
 }
 
-func (s *TickerStream) Run(channel chan []pkg.CommonTicker) {
+func (s *TickerStream) Run(ctx context.Context, channel chan []pkg.CommonTicker) {
 	inChannel := make(chan *binance.CombinedStreamMessage)
-	go NewStreamClient("binance.ticker", "!ticker@arr").Run(inChannel)
+	go NewStreamClient(s.prober, s.streamName, "!ticker@arr").Run(ctx, inChannel)
 	for {
-		streamMessage := <-inChannel
+		var streamMessage *binance.CombinedStreamMessage
+		select {
+		case streamMessage = <-inChannel:
+		case <-ctx.Done():
+			return
+		}
 		if s.Cache != nil {
 			s.CacheAdd(streamMessage.Bytes)
 			s.PruneCache()
 		}
-		channel <- s.TransformTickers(streamMessage.Tickers)
+		select {
+		case channel <- s.TransformTickers(streamMessage.Tickers):
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
-func (s *TickerStream) CacheAdd(body []byte) {
-	s.Cache.RPush(body)
-}
+// ReplayCache calls cb with each set of cached tickers that is less than an
+// hour old.
+func (s *TickerStream) ReplayCache(cb func(tickers []pkg.CommonTicker)) {
+	if s.Cache == nil {
+		return
+	}
 
-func (s *TickerStream) PruneCache() {
-	for {
-		next, err := s.Cache.GetFirst()
+	log.Printf("binance: cache replay start\n")
+	startTime := time.Now()
+	restoreCount := 0
+
+	skipCount := 0
+
+	for i := int64(0); ; i++ {
+		entry, err := s.Cache.GetN(i)
 		if err != nil {
-			log.Printf("error: binance ticker stream: failed to read from redis: %v\n", err)
+			log.Printf("error: failed to load ticker cache entry %d: %v",
+				i, err)
 			break
 		}
-		if time.Now().Sub(time.Unix(next.Timestamp, 0)) > time.Hour {
-			s.Cache.LRemove()
-		} else {
+		if entry == nil {
 			break
 		}
+
+		// Skip if over an hour old.
+		if time.Now().Sub(time.Unix(entry.Timestamp, 0)) > time.Hour*1 {
+			skipCount++
+			continue
+		}
+
+		tickers, err := s.DecodeTickers([]byte(entry.Message))
+		if err != nil {
+			log.WithField("exchange", "binance").Limited().
+				Errorf("failed to decode cached tickers: %v", err)
+			continue
+		}
+		if len(tickers) == 0 {
+			log.Printf("warning: decoded 0 length tickers\n")
+			continue
+		}
+
+		cb(tickers)
+
+		restoreCount++
 	}
+
+	duration := time.Now().Sub(startTime)
+	log.Printf("binance: cache replay done: %d records: duration: %v; skipped: %d\n",
+		restoreCount, duration, skipCount)
+}
+
+func (s *TickerStream) CacheAdd(body []byte) {
+	s.Cache.RPush(body)
+}
+
+func (s *TickerStream) PruneCache() {
+	s.Cache.Prune()
 }
 
 func (s *TickerStream) TransformTickers(inTickers []binance.Stream24Ticker) []pkg.CommonTicker {
@@ -16,57 +16,131 @@
 package binance
 
 import (
+	"context"
 	"gitlab.com/crankykernel/cryptotrader/binance"
 	"fmt"
 	"strings"
 	"time"
 	"gitlab.com/crankykernel/cryptoxscanner/pkg"
-	"sync"
 	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/latency"
 )
 
+// The maximum number of trades that will be backfilled for a single gap.
+// Larger gaps are most likely the result of the scanner being down for a
+// while and are left as is.
+const maxBackfillTrades = 5000
+
+// The longest a gap is backfilled for, as the trades of the symbol are held
+// until it is done. Requests already made may take their timeout longer.
+const maxBackfillDuration = 15 * time.Second
+
+// The most gaps backfilled at once.
+const maxConcurrentBackfills = 4
+
+// The maximum number of aggregate trades Binance will return per request.
+const aggTradesLimit = 1000
+
+// The maximum number of requests made per symbol when backfilling history
+// on startup.
+const maxHistoryRequests = 20
+
+// The minimum interval between REST requests when backfilling history, to
+// stay well within the Binance request weight limits.
+const historyRequestInterval = 100 * time.Millisecond
+
+// How often the symbol list is checked for new symbols to subscribe to.
+const streamRefreshInterval = 10 * time.Minute
+
+// TradeStream streams aggregate trades of a Binance market. The spot and
+// futures markets only differ in their endpoints.
 type TradeStream struct {
-	subscribers map[chan binance.StreamAggTrade]bool
-	cache       *pkg.RedisInputCache
-	lock        sync.RWMutex
+	*pkg.TradePublisher
+	cache      pkg.InputCache
+	continuity *TradeContinuity
+	rest       *RestClient
+	prober     *latency.Prober
+
+	// The name of the stream connections, such as aggTrades.
+	streamsName string
+
+	// Returns the symbols to stream.
+	symbols func() ([]string, error)
+
+	// Signalled to check for new symbols before the next refresh.
+	refresh chan struct{}
+
+	// The trades of symbols with a gap being backfilled, held so they are
+	// published after the backfilled trades. Only accessed by Run.
+	held map[string][]*binance.StreamAggTrade
+
+	// Backfilled gaps, published by Run.
+	backfilled    chan backfillResult
+	backfillSlots chan struct{}
+
+	// The amount of history to backfill from the REST API on startup. 0
+	// disables the backfill.
+	HistoryDuration time.Duration
+
+	// The number of trade streams per websocket connection.
+	StreamsPerConnection int
 }
 
 func NewTradeStream() *TradeStream {
+	return newTradeStream("binance", "aggTrades", NewRestClient(), StreamProber,
+		binance.NewAnonymousClient().GetAllSymbols)
+}
+
+// NewFuturesTradeStream returns a trade stream of the USD-M perpetual
+// futures.
+func NewFuturesTradeStream() *TradeStream {
+	rest := NewFuturesRestClient()
+	return newTradeStream(FuturesName, "futures.aggTrades", rest, FuturesStreamProber,
+		rest.GetFuturesSymbols)
+}
+
+// NewCustomTradeStream returns a trade stream named name of the symbols
+// trading on rest, connecting to the endpoint selected by prober, such as
+// those of a mock exchange.
+func NewCustomTradeStream(name string, rest *RestClient, prober *latency.Prober) *TradeStream {
+	return newTradeStream(name, name+".aggTrades", rest, prober, rest.GetTradingSymbols)
+}
+
+func newTradeStream(name string, streamsName string, rest *RestClient,
+	prober *latency.Prober, symbols func() ([]string, error)) *TradeStream {
 	tradeStream := &TradeStream{
-		subscribers: map[chan binance.StreamAggTrade]bool{},
+		TradePublisher: pkg.NewTradePublisher(name + ".trades"),
+		continuity:     NewTradeContinuity(),
+		rest:           rest,
+		prober:         prober,
+		streamsName:    streamsName,
+		symbols:        symbols,
+		refresh:        make(chan struct{}, 1),
+		held:           map[string][]*binance.StreamAggTrade{},
+		backfilled:     make(chan backfillResult),
+		backfillSlots:  make(chan struct{}, maxConcurrentBackfills),
 	}
+	tradeStream.StreamsPerConnection = DefaultStreamsPerConnection
 
-	redisCache := pkg.NewRedisInputCache("binance.trades")
-	if err := redisCache.Ping(); err != nil {
+	cache := pkg.NewInputCache(name + ".trades")
+	if err := cache.Ping(); err != nil {
 		log.Printf("Redis not available. No trade caching will be done.")
 	} else {
-		tradeStream.cache = redisCache
+		tradeStream.cache = cache
 	}
 
 	return tradeStream
 }
 
-func (b *TradeStream) Subscribe() chan binance.StreamAggTrade {
-	b.lock.Lock()
-	defer b.lock.Unlock()
-	channel := make(chan binance.StreamAggTrade)
-	b.subscribers[channel] = true
-	return channel
-}
-
-func (b *TradeStream) Unsubscribe(channel chan binance.StreamAggTrade) {
-	b.lock.Lock()
-	defer b.lock.Unlock()
-	delete(b.subscribers, channel)
-}
-
-func (b *TradeStream) RestoreFromCache(channel chan *binance.StreamAggTrade, count int64) {
+func (b *TradeStream) RestoreFromCache(ctx context.Context, channel chan *binance.StreamAggTrade,
+	count int64, progress *pkg.RestoreProgress) {
 	i := int64(0)
 	start := time.Now()
 	first := time.Time{}
 	last := time.Time{}
 
 	log.Printf("binance trade Cache: restoring %d Cache entries\n", count)
+	progress.AddTotal(count)
 
 	for {
 		next, err := b.cache.GetN(i)
@@ -82,6 +156,7 @@ func (b *TradeStream) RestoreFromCache(channel chan *binance.StreamAggTrade, cou
 			break
 		}
 		i += 1
+		progress.Restored(1)
 
 		if next.Timestamp == 0 {
 			log.Printf("error: redis: Cache entry with 0 timestamp\n")
@@ -90,7 +165,8 @@ func (b *TradeStream) RestoreFromCache(channel chan *binance.StreamAggTrade, cou
 
 		aggTrade, err := b.DecodeTrade([]byte(next.Message))
 		if err != nil {
-			log.Printf("error: failed to decode aggTrade from redis Cache: %v\n", err)
+			log.WithField("exchange", "binance").Limited().
+				Errorf("failed to decode aggTrade from redis Cache: %v", err)
 			continue
 		}
 		last = aggTrade.Timestamp()
@@ -99,7 +175,12 @@ func (b *TradeStream) RestoreFromCache(channel chan *binance.StreamAggTrade, cou
 			first = aggTrade.Timestamp()
 		}
 
-		channel <- aggTrade
+		select {
+		case channel <- aggTrade:
+		case <-ctx.Done():
+			log.Printf("binance trades: cache restore interrupted\n")
+			return
+		}
 
 		if i == count {
 			break
@@ -110,69 +191,70 @@ func (b *TradeStream) RestoreFromCache(channel chan *binance.StreamAggTrade, cou
 	restoreRange := last.Sub(first)
 	log.Printf("binance trades: restored %d trades in %v; range=%v\n",
 		i, restoreDuration, restoreRange)
-
-	channel <- nil
 }
 
-func (b *TradeStream) Run() {
+// Run restores from the cache and backfills history, then streams live
+// trades until ctx is cancelled. Live trades that arrive before the restore
+// is complete are queued. They are already in the cache so any still queued
+// at shutdown are restored on the next start.
+func (b *TradeStream) Run(ctx context.Context) {
 
 	cacheChannel := make(chan *binance.StreamAggTrade)
 	tradeChannel := make(chan *binance.StreamAggTrade)
+	restore := pkg.NewRestoreProgress(b.Name())
 
-	if b.cache != nil {
-		cacheCount, err := b.cache.Len()
-		if err != nil {
-			log.Printf("error: failed to get Cache len: %v\n", err)
+	// Restore from the cache, then backfill history. Live trades are queued
+	// until this is done.
+	go func() {
+		if b.cache != nil {
+			cacheCount, err := b.cache.Len()
+			if err != nil {
+				log.Printf("error: failed to get Cache len: %v\n", err)
+			}
+			b.RestoreFromCache(ctx, cacheChannel, cacheCount, restore)
+		}
+		if b.HistoryDuration > 0 {
+			b.BackfillHistory(ctx, cacheChannel, b.HistoryDuration)
+		}
+		select {
+		case cacheChannel <- nil:
+		case <-ctx.Done():
 		}
+	}()
 
-		go b.RestoreFromCache(cacheChannel, cacheCount)
-	}
+	// Live trades from the sharded connections, merged into one channel.
+	bodies := make(chan []byte)
+	go b.runStreams(ctx, bodies)
+
+	// Decoded in parallel, in order.
+	results := make(chan pkg.DecodeResult)
+	go b.DecodePool().Run(ctx, bodies, results, func(body []byte) (interface{}, error) {
+		return b.DecodeTrade(body)
+	})
 
 	go func() {
 		for {
-			// Get the streams to subscribe to.
-			var streams []string
-			for {
-				var err error
-				streams, err = b.GetStreams()
-				if err != nil {
-					log.Printf("binance: failed to get streams: %v", err)
-					goto TryAgain
-				}
-				if len(streams) == 0 {
-					log.Printf("binance: got 0 streams, trying again")
-					goto TryAgain
-				}
-				log.Printf("binance: got %d streams\n", len(streams))
-				break
-			TryAgain:
-				time.Sleep(1 * time.Second)
+			var result pkg.DecodeResult
+			select {
+			case result = <-results:
+			case <-ctx.Done():
+				return
 			}
 
-			tradeStream := NewStreamClient("aggTrades", streams...)
-			log.Printf("binance: connecting to trade stream.")
-			tradeStream.Connect()
-
-			// Read loop.
-		ReadLoop:
-			for {
-				body, err := tradeStream.ReadNext()
-				if err != nil {
-					log.Printf("binance: trade feed read error: %v\n", err)
-					break ReadLoop
-				}
-
-				b.Cache(body)
+			b.Cache(result.Body)
 
-				trade, err := b.DecodeTrade(body)
-				if err != nil {
-					log.Printf("binance: failed to decode trade feed: %v\n", err)
-					goto ReadLoop
-				}
-
-				tradeChannel <- trade
+			if result.Err != nil {
+				log.WithField("exchange", "binance").Limited().
+					Errorf("failed to decode trade feed: %v", result.Err)
+				continue
 			}
+			trade := result.Value.(*binance.StreamAggTrade)
 
+			select {
+			case tradeChannel <- trade:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
@@ -180,15 +262,29 @@ func (b *TradeStream) Run() {
 	tradeQueue := []*binance.StreamAggTrade{}
 	for {
 		select {
+		case <-ctx.Done():
+			if len(tradeQueue) > 0 {
+				log.Printf("binance: trade feed exiting with %d queued trades, will be restored from cache\n",
+					len(tradeQueue))
+			}
+			if len(b.held) > 0 {
+				log.Printf("binance: trade feed exiting with trades of %d symbols held for backfill, will be restored from cache\n",
+					len(b.held))
+			}
+			log.Printf("binance: trade feed exiting.\n")
+			return
 		case trade := <-cacheChannel:
 			if trade == nil {
 				cacheDone = true
+				restore.Done()
 			} else {
 				if cacheDone {
 					log.Printf("warning: got cached trade in state Cache done\n")
 				}
-				b.Publish(trade)
+				b.PublishContinuous(ctx, trade)
 			}
+		case result := <-b.backfilled:
+			b.publishBackfill(ctx, result)
 		case trade := <-tradeChannel:
 			if !cacheDone {
 				// The Cache is still being processed. Queue.
@@ -200,16 +296,55 @@ func (b *TradeStream) Run() {
 				log.Printf("binace trade stream: submitting %d queued trades\n",
 					len(tradeQueue))
 				for _, trade := range tradeQueue {
-					b.Publish(trade)
+					b.PublishContinuous(ctx, trade)
 				}
 				tradeQueue = []*binance.StreamAggTrade{}
 			}
-			b.Publish(trade)
+			b.PublishContinuous(ctx, trade)
 			b.PruneCache()
 		}
 	}
+}
+
+// runStreams subscribes to the trade streams of all symbols, sharded across
+// connections, and checks for new symbols every streamRefreshInterval, or
+// when RefreshSymbols is called.
+func (b *TradeStream) runStreams(ctx context.Context, bodies chan []byte) {
+	client := NewShardedStreamClient(b.prober, b.streamsName, b.StreamsPerConnection)
+	for {
+		streams, err := b.GetStreams()
+		if err != nil {
+			log.Printf("binance: failed to get streams: %v", err)
+		} else if len(streams) == 0 {
+			log.Printf("binance: got 0 streams, trying again")
+		} else {
+			client.AddStreams(ctx, streams, bodies)
+		}
+
+		// Retry quickly until the first streams are subscribed.
+		interval := streamRefreshInterval
+		if client.Shards() == 0 {
+			interval = time.Second
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-b.refresh:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
 
-	log.Printf("binance: trade feed exiting.\n")
+// RefreshSymbols checks for new symbols to subscribe to without waiting for
+// the next refresh.
+func (b *TradeStream) RefreshSymbols() {
+	select {
+	case b.refresh <- struct{}{}:
+	default:
+	}
 }
 
 func (b *TradeStream) Cache(body []byte) {
@@ -218,26 +353,238 @@ func (b *TradeStream) Cache(body []byte) {
 	}
 }
 
+// PruneCache requests that trades older than the retention be removed from
+// the cache. Must not be called until the cache has been restored.
 func (b *TradeStream) PruneCache() {
-	for {
-		next, err := b.cache.GetFirst()
+	if b.cache != nil {
+		b.cache.Prune()
+	}
+}
+
+// PublishContinuous publishes the trade after checking it for continuity
+// with the previous trade for the same symbol. Stale trades are dropped. If
+// trades are missing they are backfilled from the REST API in the
+// background, and the trades of the symbol are held until the backfilled
+// trades are published before them. Must only be called by Run.
+func (b *TradeStream) PublishContinuous(ctx context.Context, trade *binance.StreamAggTrade) {
+	state, from, to := b.continuity.Check(trade)
+	held, holding := b.held[trade.Symbol]
+	switch state {
+	case ContinuityStale:
+		log.WithFields(log.Fields{"exchange": "binance", "symbol": trade.Symbol}).Limited().
+			Warnf("dropped stale trade: id=%d; last=%d", trade.AggTradeID, b.continuity.LastId(trade.Symbol))
+		return
+	case ContinuityGap:
+		if !holding {
+			log.WithFields(log.Fields{"exchange": "binance", "symbol": trade.Symbol}).
+				Infof("trade gap detected: missing aggregate trades %d-%d", from, to)
+			b.held[trade.Symbol] = []*binance.StreamAggTrade{trade}
+			go b.backfill(ctx, trade.Symbol, from, to)
+			return
+		}
+	}
+	if holding {
+		// A gap between held trades is backfilled once they are released.
+		b.held[trade.Symbol] = append(held, trade)
+		return
+	}
+	b.publishAggTrade(trade)
+}
+
+type backfillResult struct {
+	symbol string
+
+	// The last ID of the gap.
+	to int64
+
+	trades []*binance.StreamAggTrade
+}
+
+// backfill fetches the trades of a gap and sends them to Run to publish.
+func (b *TradeStream) backfill(ctx context.Context, symbol string, from int64, to int64) {
+	result := backfillResult{
+		symbol: symbol,
+		to:     to,
+	}
+	select {
+	case b.backfillSlots <- struct{}{}:
+		result.trades = b.Backfill(ctx, symbol, from, to)
+		<-b.backfillSlots
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case b.backfilled <- result:
+	case <-ctx.Done():
+	}
+}
+
+// publishBackfill publishes the backfilled trades of a gap, then the trades
+// held for the symbol, until another gap between them which is backfilled
+// in turn.
+func (b *TradeStream) publishBackfill(ctx context.Context, result backfillResult) {
+	for _, trade := range result.trades {
+		b.publishAggTrade(trade)
+	}
+	held := b.held[result.symbol]
+	delete(b.held, result.symbol)
+	last := result.to
+	for i, trade := range held {
+		if trade.AggTradeID > last+1 {
+			log.WithFields(log.Fields{"exchange": "binance", "symbol": result.symbol}).
+				Infof("trade gap detected: missing aggregate trades %d-%d", last+1, trade.AggTradeID-1)
+			b.held[result.symbol] = held[i:]
+			go b.backfill(ctx, result.symbol, last+1, trade.AggTradeID-1)
+			return
+		}
+		b.publishAggTrade(trade)
+		last = trade.AggTradeID
+	}
+}
+
+// Backfill fetches the aggregate trades from ID from to ID to, inclusive,
+// for at most maxBackfillDuration.
+//
+// Backfilled trades are not added to the cache as the trade that exposed the
+// gap has already been cached, and adding them after it would put the cache
+// out of order. Instead the gap will be detected and backfilled again if the
+// cache is restored.
+func (b *TradeStream) Backfill(ctx context.Context, symbol string, from int64, to int64) []*binance.StreamAggTrade {
+	trades := []*binance.StreamAggTrade{}
+	if to-from+1 > maxBackfillTrades {
+		log.Printf("binance: not backfilling %d trades for %s, gap too large\n",
+			to-from+1, symbol)
+		return trades
+	}
+
+	deadline := time.Now().Add(maxBackfillDuration)
+	next := from
+	for next <= to && ctx.Err() == nil {
+		if time.Now().After(deadline) {
+			log.Printf("error: binance: backfill of %s timed out after %v\n",
+				symbol, maxBackfillDuration)
+			break
+		}
+		rawTrades, err := b.rest.GetAggTrades(symbol, next, aggTradesLimit)
 		if err != nil {
+			log.Printf("error: binance: failed to backfill trades for %s: %v\n",
+				symbol, err)
 			break
 		}
-		if time.Now().Sub(time.Unix(next.Timestamp, 0)) > time.Hour * 2{
-			b.cache.LRemove()
-		} else {
+		if len(rawTrades) == 0 {
 			break
 		}
+		for _, rawTrade := range rawTrades {
+			body, err := AggTradeStreamBody(symbol, rawTrade)
+			if err != nil {
+				log.Printf("error: binance: failed to encode backfilled trade: %v\n", err)
+				continue
+			}
+			trade, err := b.DecodeTrade(body)
+			if err != nil {
+				log.Printf("error: binance: failed to decode backfilled trade: %v\n", err)
+				continue
+			}
+			if trade.AggTradeID > to {
+				next = to + 1
+				break
+			}
+			next = trade.AggTradeID + 1
+			trades = append(trades, trade)
+		}
 	}
+
+	log.Printf("binance: backfilled %d of %d trades for %s\n",
+		len(trades), to-from+1, symbol)
+	return trades
 }
 
-func (b *TradeStream) Publish(trade *binance.StreamAggTrade) {
-	b.lock.RLock()
-	defer b.lock.RUnlock()
-	for subscriber := range b.subscribers {
-		subscriber <- *trade
+// BackfillHistory fetches up to duration of recent trades for every symbol
+// from the REST API and sends them to channel. For symbols restored from the
+// cache only trades newer than the last cached trade are fetched, so the
+// history merges with the cached trades without duplicates.
+func (b *TradeStream) BackfillHistory(ctx context.Context, channel chan *binance.StreamAggTrade, duration time.Duration) {
+	symbols, err := b.symbols()
+	if err != nil {
+		log.Printf("error: binance: history backfill: failed to get symbols: %v\n", err)
+		return
 	}
+	symbols = b.SymbolFilter().Apply(symbols)
+
+	log.Printf("binance: backfilling up to %v of trade history for %d symbols\n",
+		duration, len(symbols))
+	start := time.Now()
+	since := start.Add(-duration)
+	throttle := time.NewTicker(historyRequestInterval)
+	defer throttle.Stop()
+	total := 0
+
+	for _, symbol := range symbols {
+		trades := b.fetchHistory(symbol, since, b.continuity.LastId(symbol), throttle.C)
+		for _, trade := range trades {
+			select {
+			case channel <- trade:
+			case <-ctx.Done():
+				log.Printf("binance: history backfill interrupted after %d trades\n", total)
+				return
+			}
+			total++
+		}
+	}
+
+	log.Printf("binance: backfilled %d trades of history in %v\n",
+		total, time.Now().Sub(start))
+}
+
+// fetchHistory returns the trades for symbol newer than since and with an
+// aggregate trade ID greater than afterId, oldest first. Trades are fetched
+// backwards from the most recent so if the request limit is reached it is
+// the oldest history that is missing.
+func (b *TradeStream) fetchHistory(symbol string, since time.Time, afterId int64, throttle <-chan time.Time) []*binance.StreamAggTrade {
+	history := []*binance.StreamAggTrade{}
+	fromId := int64(-1)
+
+	for i := 0; i < maxHistoryRequests; i++ {
+		<-throttle
+		rawTrades, err := b.rest.GetAggTrades(symbol, fromId, aggTradesLimit)
+		if err != nil {
+			log.Printf("error: binance: history backfill for %s: %v\n", symbol, err)
+			break
+		}
+
+		page := []*binance.StreamAggTrade{}
+		done := len(rawTrades) < aggTradesLimit
+		for _, rawTrade := range rawTrades {
+			body, err := AggTradeStreamBody(symbol, rawTrade)
+			if err != nil {
+				continue
+			}
+			trade, err := b.DecodeTrade(body)
+			if err != nil {
+				continue
+			}
+			if trade.AggTradeID <= afterId || trade.Timestamp().Before(since) {
+				done = true
+				continue
+			}
+			page = append(page, trade)
+		}
+		history = append(page, history...)
+
+		if done || len(page) == 0 {
+			break
+		}
+		fromId = page[0].AggTradeID - aggTradesLimit
+		if fromId < 0 {
+			break
+		}
+	}
+
+	return history
+}
+
+func (b *TradeStream) publishAggTrade(trade *binance.StreamAggTrade) {
+	b.Publish(pkg.CommonTradeFromBinanceTrade(*trade))
 }
 
 func (b *TradeStream) DecodeTrade(body []byte) (*binance.StreamAggTrade, error) {
@@ -249,15 +596,18 @@ func (b *TradeStream) DecodeTrade(body []byte) (*binance.StreamAggTrade, error)
 }
 
 func (b *TradeStream) GetStreams() ([]string, error) {
-	symbols, err := binance.NewAnonymousClient().GetAllSymbols()
+	symbols, err := b.symbols()
 	if err != nil {
 		return nil, nil
 	}
 	streams := []string{}
-	for _, symbol := range symbols {
-		streams = append(streams,
-			fmt.Sprintf("%s@aggTrade", strings.ToLower(symbol)))
+	for _, symbol := range b.SymbolFilter().Apply(symbols) {
+		streams = append(streams, AggTradeStreamName(symbol))
 	}
 
 	return streams, nil
 }
+
+func AggTradeStreamName(symbol string) string {
+	return fmt.Sprintf("%s@aggTrade", strings.ToLower(symbol))
+}
@@ -0,0 +1,89 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binance_test
+
+import (
+	"context"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/testutil"
+	"testing"
+	"time"
+)
+
+func startTradeStream(t *testing.T, ctx context.Context, m *testutil.MockExchange,
+	name string) *testutil.TradeCollector {
+	testutil.UseMemoryCache()
+	collector, err := m.StartTradeStream(ctx, name, nil, "ETHBTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return collector
+}
+
+func publish(t *testing.T, m *testutil.MockExchange, trades ...testutil.AggTrade) {
+	for _, trade := range trades {
+		if err := m.PublishAggTrade(trade); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkIds(t *testing.T, trades []pkg.CommonTrade, ids ...int64) {
+	if len(trades) != len(ids) {
+		t.Fatalf("expected %d trades, got %d", len(ids), len(trades))
+	}
+	for i, trade := range trades {
+		if trade.Id != ids[i] {
+			t.Fatalf("trade %d: expected id %d, got %d", i, ids[i], trade.Id)
+		}
+	}
+}
+
+func TestTradeStreamBackfillsGapsInOrder(t *testing.T) {
+	m := testutil.NewMockExchange("ETHBTC")
+	defer m.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	collector := startTradeStream(t, ctx, m, "gap")
+
+	trades := testutil.AggTrades("ETHBTC", 1, 10, time.Now(), 0.03, 0.0001)
+	publish(t, m, trades[:2]...)
+	m.AddAggTrades(trades[2:5]...)
+	publish(t, m, trades[5:]...)
+
+	received, err := collector.Collect(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIds(t, received, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+}
+
+func TestTradeStreamDropsStaleTrades(t *testing.T) {
+	m := testutil.NewMockExchange("ETHBTC")
+	defer m.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	collector := startTradeStream(t, ctx, m, "stale")
+
+	trades := testutil.AggTrades("ETHBTC", 1, 4, time.Now(), 0.03, 0.0001)
+	publish(t, m, trades[0], trades[1], trades[2], trades[1], trades[3])
+
+	received, err := collector.Collect(ctx, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIds(t, received, 1, 2, 3, 4)
+}
@@ -0,0 +1,112 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/metrics"
+	"sync"
+)
+
+func init() {
+	metrics.Describe("broadcast_sent_total",
+		"Messages successfully sent to a broadcast sink.")
+	metrics.Describe("broadcast_errors_total",
+		"Messages that failed to be sent to a broadcast sink.")
+}
+
+// Sink is a destination for published messages, for example websocket
+// clients, a message queue or the metrics engine.
+type Sink interface {
+	// A name for the sink, used in logging and metrics.
+	Name() string
+
+	// Send a message to the sink. An error or panic in one sink does not
+	// prevent the message from being delivered to the other sinks.
+	Send(message interface{}) error
+}
+
+type sinkEntry struct {
+	sink   Sink
+	sent   *metrics.Counter
+	errors *metrics.Counter
+}
+
+// Broadcaster fans out each published message to all registered sinks, so
+// the message only has to be decoded once no matter how many consumers
+// there are.
+type Broadcaster struct {
+	name  string
+	sinks map[Sink]*sinkEntry
+	lock  sync.RWMutex
+}
+
+func NewBroadcaster(name string) *Broadcaster {
+	return &Broadcaster{
+		name:  name,
+		sinks: map[Sink]*sinkEntry{},
+	}
+}
+
+func (b *Broadcaster) AddSink(sink Sink) {
+	labels := metrics.Labels{
+		"broadcaster": b.name,
+		"sink":        sink.Name(),
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.sinks[sink] = &sinkEntry{
+		sink:   sink,
+		sent:   metrics.GetCounter("broadcast_sent_total", labels),
+		errors: metrics.GetCounter("broadcast_errors_total", labels),
+	}
+}
+
+func (b *Broadcaster) RemoveSink(sink Sink) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.sinks, sink)
+}
+
+func (b *Broadcaster) SinkCount() int {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return len(b.sinks)
+}
+
+func (b *Broadcaster) Publish(message interface{}) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for _, entry := range b.sinks {
+		if err := b.send(entry, message); err != nil {
+			entry.errors.Inc()
+			log.Printf("error: %s: failed to send to sink %s: %v\n",
+				b.name, entry.sink.Name(), err)
+		} else {
+			entry.sent.Inc()
+		}
+	}
+}
+
+func (b *Broadcaster) send(entry *sinkEntry, message interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return entry.sink.Send(message)
+}
@@ -0,0 +1,521 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/metrics"
+	"hash/fnv"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+func init() {
+	metrics.Describe("bus_published_total",
+		"Messages published to a bus topic.")
+	metrics.Describe("bus_rejected_total",
+		"Messages rejected by a bus topic for being of the wrong type.")
+	metrics.Describe("bus_subscribers",
+		"Channel subscribers of a bus topic.")
+}
+
+// FanoutShards is the number of shards of the topics delivering to many
+// subscribers, such as websocket clients.
+var FanoutShards = runtime.NumCPU()
+
+// The number of messages queued for the worker of each shard of a topic.
+// Publishing blocks while the queue of a shard is full.
+const topicShardQueueSize = 1024
+
+// TopicOptions tune how a topic delivers messages to its subscriber
+// channels.
+type TopicOptions struct {
+	// Shards splits the subscribers into groups, each delivered to by a
+	// worker goroutine of its own, so publishing only queues the message to
+	// the shards with subscribers for it rather than sending to every
+	// subscriber in turn. Zero or one delivers on the publishing goroutine.
+	Shards int
+
+	// ShardByKey places the subscribers of a key, such as a symbol, in the
+	// same shard, so a message published with the key is queued to a single
+	// worker. Otherwise subscribers are spread evenly over the shards.
+	ShardByKey bool
+}
+
+// Bus is the registry of the topics internal components publish on, so
+// they can be listed and closed together on shutdown.
+type Bus struct {
+	topics map[*Topic]bool
+	closed bool
+	lock   sync.Mutex
+}
+
+// DefaultBus is the bus of all long lived components.
+var DefaultBus = NewBus()
+
+func NewBus() *Bus {
+	return &Bus{
+		topics: map[*Topic]bool{},
+	}
+}
+
+// NewTopic creates a topic for messages of the type of example, or of any
+// type if example is nil. Names need not be unique, ephemeral components
+// such as sandbox replays create a topic of the same name for each run and
+// must close it when done.
+func (b *Bus) NewTopic(name string, example interface{}) *Topic {
+	return b.NewTopicWithOptions(name, example, TopicOptions{})
+}
+
+// NewTopicWithOptions creates a topic as NewTopic, delivering to its
+// subscribers as per options.
+func (b *Bus) NewTopicWithOptions(name string, example interface{}, options TopicOptions) *Topic {
+	topic := &Topic{
+		name:        name,
+		kind:        reflect.TypeOf(example),
+		bus:         b,
+		broadcaster: NewBroadcaster(name),
+		shardByKey:  options.ShardByKey,
+		channels:    map[interface{}]*subscription{},
+		published:   metrics.GetCounter("bus_published_total", metrics.Labels{"topic": name}),
+		rejected:    metrics.GetCounter("bus_rejected_total", metrics.Labels{"topic": name}),
+	}
+	shards := options.Shards
+	if shards < 1 {
+		shards = 1
+	} else if shards > MaxPoolWorkers {
+		shards = MaxPoolWorkers
+	}
+	for i := 0; i < shards; i++ {
+		shard := &topicShard{
+			subscriptions: map[string]map[interface{}]*subscription{},
+		}
+		if shards > 1 {
+			shard.queue = make(chan shardMessage, topicShardQueueSize)
+			topic.workers.Add(1)
+			go shard.work(topic.workers.Done)
+		}
+		topic.shards = append(topic.shards, shard)
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		topic.closed = true
+		topic.closeShards()
+	} else {
+		b.topics[topic] = true
+	}
+	return topic
+}
+
+func (b *Bus) remove(topic *Topic) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.topics, topic)
+}
+
+// TopicStats is a snapshot of a topic.
+type TopicStats struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Sinks       int    `json:"sinks"`
+	Subscribers int    `json:"subscribers"`
+	Shards      int    `json:"shards"`
+}
+
+// Topics returns a snapshot of the open topics by name.
+func (b *Bus) Topics() []TopicStats {
+	b.lock.Lock()
+	topics := make([]*Topic, 0, len(b.topics))
+	for topic := range b.topics {
+		topics = append(topics, topic)
+	}
+	b.lock.Unlock()
+	list := make([]TopicStats, 0, len(topics))
+	for _, topic := range topics {
+		list = append(list, topic.Stats())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// Close closes every topic, closing the channels of their subscribers.
+// Topics created after are closed already.
+func (b *Bus) Close() {
+	b.lock.Lock()
+	b.closed = true
+	topics := b.topics
+	b.topics = map[*Topic]bool{}
+	b.lock.Unlock()
+	for topic := range topics {
+		topic.Close()
+	}
+}
+
+// Topic fans out messages of a single type to its sinks and to subscriber
+// channels. Subscribers may subscribe to all messages, or to those
+// published with a key such as a symbol.
+type Topic struct {
+	name        string
+	kind        reflect.Type
+	bus         *Bus
+	broadcaster *Broadcaster
+
+	// Subscriptions by shard, and by channel.
+	shards     []*topicShard
+	shardByKey bool
+	channels   map[interface{}]*subscription
+	closed     bool
+	lock       sync.RWMutex
+
+	// Done once the workers of the shards have delivered the messages
+	// queued before the topic was closed.
+	workers sync.WaitGroup
+
+	published *metrics.Counter
+	rejected  *metrics.Counter
+}
+
+func (t *Topic) Name() string {
+	return t.name
+}
+
+// AddSink registers a sink to receive every message published without a
+// key.
+func (t *Topic) AddSink(sink Sink) {
+	t.broadcaster.AddSink(sink)
+}
+
+func (t *Topic) RemoveSink(sink Sink) {
+	t.broadcaster.RemoveSink(sink)
+}
+
+func (t *Topic) SinkCount() int {
+	return t.broadcaster.SinkCount()
+}
+
+// Subscribers returns the number of channels subscribed to key.
+func (t *Topic) Subscribers(key string) int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	count := 0
+	first, last := t.shardRange(key)
+	for _, shard := range t.shards[first:last] {
+		shard.lock.RLock()
+		count += len(shard.subscriptions[key])
+		shard.lock.RUnlock()
+	}
+	return count
+}
+
+func (t *Topic) Stats() TopicStats {
+	stats := TopicStats{
+		Name:   t.name,
+		Type:   "any",
+		Sinks:  t.broadcaster.SinkCount(),
+		Shards: len(t.shards),
+	}
+	if t.kind != nil {
+		stats.Type = t.kind.String()
+	}
+	t.lock.RLock()
+	stats.Subscribers = len(t.channels)
+	t.lock.RUnlock()
+	return stats
+}
+
+func (t *Topic) check(message interface{}) error {
+	if t.kind != nil && reflect.TypeOf(message) != t.kind {
+		t.rejected.Inc()
+		return fmt.Errorf("%s: unexpected message type %T", t.name, message)
+	}
+	return nil
+}
+
+// Publish sends message to the sinks and to the subscribers of all
+// messages. Messages of the wrong type are rejected.
+func (t *Topic) Publish(message interface{}) error {
+	if err := t.check(message); err != nil {
+		return err
+	}
+	t.published.Inc()
+	t.lock.RLock()
+	closed := t.closed
+	if !closed {
+		t.send("", message)
+	}
+	t.lock.RUnlock()
+	if !closed {
+		t.broadcaster.Publish(message)
+	}
+	return nil
+}
+
+// PublishKey sends message to the subscribers of key only.
+func (t *Topic) PublishKey(key string, message interface{}) error {
+	if err := t.check(message); err != nil {
+		return err
+	}
+	t.published.Inc()
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	if !t.closed {
+		t.send(key, message)
+	}
+	return nil
+}
+
+// send delivers message to the subscribers of key in each shard, or queues
+// it to the worker of the shard. Must be called with the read lock held.
+func (t *Topic) send(key string, message interface{}) {
+	value := reflect.ValueOf(message)
+	if !value.IsValid() {
+		value = reflect.Zero(t.channelType().Elem())
+	}
+	first, last := t.shardRange(key)
+	for _, shard := range t.shards[first:last] {
+		if shard.queue == nil {
+			shard.deliver(key, value)
+		} else if shard.has(key) {
+			shard.queue <- shardMessage{key: key, value: value}
+		}
+	}
+}
+
+// shardRange returns the range of the shards that may have subscribers of
+// key.
+func (t *Topic) shardRange(key string) (int, int) {
+	if t.shardByKey && key != "" {
+		i := t.shardIndex(key)
+		return i, i + 1
+	}
+	return 0, len(t.shards)
+}
+
+func (t *Topic) shardIndex(key string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(len(t.shards)))
+}
+
+// shardFor returns the shard for a new subscriber of key, the shard of the
+// key if sharding by key, otherwise the shard with the fewest subscribers.
+// Must be called with the lock held.
+func (t *Topic) shardFor(key string) *topicShard {
+	if t.shardByKey && key != "" {
+		return t.shards[t.shardIndex(key)]
+	}
+	shard := t.shards[0]
+	for _, candidate := range t.shards[1:] {
+		if candidate.count < shard.count {
+			shard = candidate
+		}
+	}
+	return shard
+}
+
+// closeShards stops the workers of the shards once they have delivered the
+// messages queued. Must be called with the lock held, once.
+func (t *Topic) closeShards() {
+	for _, shard := range t.shards {
+		if shard.queue != nil {
+			close(shard.queue)
+		}
+	}
+}
+
+func (t *Topic) channelType() reflect.Type {
+	kind := t.kind
+	if kind == nil {
+		kind = reflect.TypeOf((*interface{})(nil)).Elem()
+	}
+	return reflect.ChanOf(reflect.BothDir, kind)
+}
+
+// Subscribe returns a channel, a chan of the topic type, of all messages
+// queued as per options. The channel is closed when unsubscribed, if the
+// subscriber is disconnected for being too slow, or when the topic is
+// closed.
+func (t *Topic) Subscribe(name string, options QueueOptions) interface{} {
+	return t.SubscribeKey("", name, options)
+}
+
+// SubscribeKey returns a channel of the messages published with key, as
+// Subscribe.
+func (t *Topic) SubscribeKey(key string, name string, options QueueOptions) interface{} {
+	channel := reflect.MakeChan(t.channelType(), options.Size)
+	s := &subscription{
+		topic:   t,
+		key:     key,
+		channel: channel,
+		policy:  options.Policy,
+		stats: NewSubscriberStats(t.name, name, options, func() int {
+			return channel.Len()
+		}),
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		s.stats.Release()
+		channel.Close()
+		return channel.Interface()
+	}
+	s.shard = t.shardFor(key)
+	s.shard.add(s)
+	t.channels[channel.Interface()] = s
+	metrics.GetGauge("bus_subscribers", metrics.Labels{"topic": t.name}).Set(float64(len(t.channels)))
+	return channel.Interface()
+}
+
+// Unsubscribe removes the subscriber of channel and closes the channel.
+// Returns false if it was not subscribed.
+func (t *Topic) Unsubscribe(channel interface{}) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	s := t.channels[channel]
+	if s == nil {
+		return false
+	}
+	t.remove(s)
+	return true
+}
+
+// remove must be called with the lock held.
+func (t *Topic) remove(s *subscription) {
+	delete(t.channels, s.channel.Interface())
+	s.shard.remove(s)
+	s.stats.Release()
+	metrics.GetGauge("bus_subscribers", metrics.Labels{"topic": t.name}).Set(float64(len(t.channels)))
+}
+
+// Close closes the channels of all subscribers, once the messages queued
+// to the workers of the shards are delivered, and drops any further
+// messages.
+func (t *Topic) Close() {
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		return
+	}
+	t.closed = true
+	t.closeShards()
+	t.lock.Unlock()
+	t.workers.Wait()
+	t.lock.Lock()
+	for _, s := range t.channels {
+		t.remove(s)
+	}
+	t.lock.Unlock()
+	t.bus.remove(t)
+}
+
+type shardMessage struct {
+	key   string
+	value reflect.Value
+}
+
+// topicShard is a group of the subscribers of a topic, delivered to in the
+// order messages are published by a worker of its own, or by the publisher
+// if the queue is nil.
+type topicShard struct {
+	// Subscriptions by key, all messages being the empty key.
+	subscriptions map[string]map[interface{}]*subscription
+	count         int
+	lock          sync.RWMutex
+	queue         chan shardMessage
+}
+
+func (s *topicShard) add(sub *subscription) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := sub.key
+	if s.subscriptions[key] == nil {
+		s.subscriptions[key] = map[interface{}]*subscription{}
+	}
+	s.subscriptions[key][sub.channel.Interface()] = sub
+	s.count++
+}
+
+// remove closes the channel of sub once no message is being sent to it.
+func (s *topicShard) remove(sub *subscription) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := sub.key
+	delete(s.subscriptions[key], sub.channel.Interface())
+	if len(s.subscriptions[key]) == 0 {
+		delete(s.subscriptions, key)
+	}
+	s.count--
+	sub.channel.Close()
+}
+
+func (s *topicShard) has(key string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.subscriptions[key]) > 0
+}
+
+func (s *topicShard) deliver(key string, value reflect.Value) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, sub := range s.subscriptions[key] {
+		sub.send(value)
+	}
+}
+
+func (s *topicShard) work(done func()) {
+	defer done()
+	for message := range s.queue {
+		s.deliver(message.key, message.value)
+	}
+}
+
+type subscription struct {
+	topic   *Topic
+	shard   *topicShard
+	key     string
+	channel reflect.Value
+	policy  OverflowPolicy
+	stats   *SubscriberStats
+
+	// Set once the subscriber has been disconnected, after which no more
+	// messages are sent.
+	disconnected int32
+}
+
+// send must be called with the read lock of the shard held.
+func (s *subscription) send(value reflect.Value) {
+	if atomic.LoadInt32(&s.disconnected) != 0 {
+		return
+	}
+	if s.channel.TrySend(value) {
+		return
+	}
+	if s.policy == OverflowBlock {
+		s.channel.Send(value)
+		return
+	}
+	if s.stats.Overflow() && atomic.CompareAndSwapInt32(&s.disconnected, 0, 1) {
+		log.Printf("%s: disconnecting slow subscriber %s\n", s.topic.name, s.stats.Name)
+		go s.topic.Unsubscribe(s.channel.Interface())
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The queue size of the subscribers of the fan-out benchmark, which block
+// the topic when full so no message is dropped.
+const fanoutBenchmarkQueueSize = 1024
+
+// benchmarkFanout publishes b.N trades to a topic with subscribers, each
+// reading its channel on a goroutine of its own, until all are delivered.
+// With symbols, trades are published for that many symbols and each
+// subscriber subscribes to one of them.
+func benchmarkFanout(b *testing.B, subscribers int, shards int, symbols int, shardByKey bool) {
+	bus := NewBus()
+	defer bus.Close()
+	topic := bus.NewTopicWithOptions("bench.fanout", CommonTrade{}, TopicOptions{
+		Shards:     shards,
+		ShardByKey: shardByKey,
+	})
+
+	names := make([]string, symbols)
+	for i := range names {
+		names[i] = fmt.Sprintf("SYM%dUSDT", i)
+	}
+
+	var delivered int64
+	expected := int64(0)
+	var wg sync.WaitGroup
+	for i := 0; i < subscribers; i++ {
+		key := ""
+		if symbols > 0 {
+			key = names[i%symbols]
+			expected += int64(b.N / symbols)
+			if i%symbols < b.N%symbols {
+				expected++
+			}
+		} else {
+			expected += int64(b.N)
+		}
+		channel := topic.SubscribeKey(key, fmt.Sprintf("bench-%d", i), QueueOptions{
+			Size:   fanoutBenchmarkQueueSize,
+			Policy: OverflowBlock,
+		}).(chan CommonTrade)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var received int64
+			for range channel {
+				received++
+			}
+			atomic.AddInt64(&delivered, received)
+		}()
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		trade := CommonTrade{
+			Id:        int64(i),
+			Timestamp: start,
+			Price:     1,
+			Quantity:  1,
+		}
+		if symbols > 0 {
+			trade.Symbol = names[i%symbols]
+			topic.PublishKey(trade.Symbol, trade)
+		} else {
+			topic.Publish(trade)
+		}
+	}
+	// Closing waits for the shards to deliver the queued messages, then
+	// closes the channels of the subscribers.
+	topic.Close()
+	wg.Wait()
+	b.StopTimer()
+
+	if delivered != expected {
+		b.Fatalf("expected %d deliveries, got %d", expected, delivered)
+	}
+	b.ReportMetric(float64(delivered)/time.Since(start).Seconds(), "deliveries/s")
+}
+
+// BenchmarkBusFanout measures the delivery of trades to many subscribers.
+// With one shard every subscriber is sent to in turn on the publishing
+// goroutine. With more, subscribers are spread over the shards, each
+// delivered to by a worker of its own.
+func BenchmarkBusFanout(b *testing.B) {
+	shardCounts := []int{1}
+	if FanoutShards > 1 {
+		shardCounts = append(shardCounts, FanoutShards)
+	}
+	for _, subscribers := range []int{10, 100, 500} {
+		for _, shards := range shardCounts {
+			b.Run(fmt.Sprintf("subscribers=%d/shards=%d", subscribers, shards), func(b *testing.B) {
+				benchmarkFanout(b, subscribers, shards, 0, false)
+			})
+		}
+	}
+}
+
+// BenchmarkBusFanoutByKey publishes for many symbols, each subscriber
+// subscribing to one, with the subscribers of a symbol spread over the
+// shards or sharing one.
+func BenchmarkBusFanoutByKey(b *testing.B) {
+	for _, shardByKey := range []bool{false, true} {
+		b.Run(fmt.Sprintf("subscribers=500/symbols=50/by-key=%v", shardByKey), func(b *testing.B) {
+			benchmarkFanout(b, 500, FanoutShards, 50, shardByKey)
+		})
+	}
+}
@@ -0,0 +1,354 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package candles
+
+import (
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"sync"
+	"time"
+)
+
+type series struct {
+	// Closed candles, oldest first.
+	closed []Candle
+
+	current *Candle
+
+	// The last trade added to the candle in progress.
+	last pkg.TradeMark
+
+	// The last trade of a candle restored from a previous run, trades up
+	// to it already being in the candle.
+	restored pkg.TradeMark
+}
+
+// Builder builds candles for every symbol at each of its intervals from a
+// trade stream. A rolling window of closed candles is kept per symbol and
+// interval.
+type Builder struct {
+	// Every closed candle is published to the sinks, and every update to
+	// the subscribers of its symbol and interval.
+	topic *pkg.Topic
+
+	intervals []time.Duration
+	window    int
+
+	series map[string]map[time.Duration]*series
+	lock   sync.RWMutex
+}
+
+// The queue of each subscriber.
+var subscriberQueueOptions = pkg.QueueOptions{
+	Size:   16,
+	Policy: pkg.OverflowDrop,
+}
+
+// NewBuilder creates a builder for the given intervals keeping up to window
+// closed candles for each.
+func NewBuilder(name string, intervals []time.Duration, window int) *Builder {
+	return &Builder{
+		topic: pkg.DefaultBus.NewTopicWithOptions(name, Candle{},
+			pkg.TopicOptions{Shards: pkg.FanoutShards, ShardByKey: true}),
+		intervals: intervals,
+		window:    window,
+		series:    map[string]map[time.Duration]*series{},
+	}
+}
+
+// AddSink registers a sink to receive every closed candle, for all symbols
+// and intervals.
+func (b *Builder) AddSink(sink pkg.Sink) {
+	b.topic.AddSink(sink)
+}
+
+func (b *Builder) Intervals() []time.Duration {
+	return b.intervals
+}
+
+func (b *Builder) HasInterval(interval time.Duration) bool {
+	for _, i := range b.intervals {
+		if i == interval {
+			return true
+		}
+	}
+	return false
+}
+
+// Run adds every trade received on channel. It does not return.
+func (b *Builder) Run(channel chan pkg.CommonTrade) {
+	for trade := range channel {
+		b.AddTrade(trade)
+	}
+}
+
+func (b *Builder) AddTrade(trade pkg.CommonTrade) {
+	updates := make([]Candle, 0, len(b.intervals))
+	closed := []Candle{}
+
+	b.lock.Lock()
+	symbolSeries := b.series[trade.Symbol]
+	if symbolSeries == nil {
+		symbolSeries = map[time.Duration]*series{}
+		b.series[trade.Symbol] = symbolSeries
+	}
+	for _, interval := range b.intervals {
+		s := symbolSeries[interval]
+		if s == nil {
+			s = &series{}
+			symbolSeries[interval] = s
+		}
+		if s.restored.Covers(&trade) {
+			// Already in the restored candle, such as a trade replayed
+			// from the cache or backfilled on startup.
+			continue
+		}
+		if s.current != nil {
+			if trade.Timestamp.Before(s.current.OpenTime) {
+				// Late trade for a candle that has already been closed.
+				continue
+			}
+			if !trade.Timestamp.Before(s.current.CloseTime()) {
+				s.current.Closed = true
+				updates = append(updates, *s.current)
+				closed = append(closed, *s.current)
+				s.closed = append(s.closed, *s.current)
+				if len(s.closed) > b.window {
+					s.closed = s.closed[len(s.closed)-b.window:]
+				}
+				s.current = nil
+			}
+		}
+		if s.current == nil {
+			if n := len(s.closed); n > 0 && trade.Timestamp.Before(s.closed[n-1].CloseTime()) {
+				// Late trade for a period already closed, such as a
+				// seeded candle.
+				continue
+			}
+			s.current = newCandle(&trade, interval)
+			s.last = pkg.TradeMark{}
+		}
+		s.current.addTrade(&trade)
+		s.last = s.last.Advance(&trade)
+		updates = append(updates, *s.current)
+	}
+	b.lock.Unlock()
+
+	b.publish(trade.Symbol, updates)
+	for _, candle := range closed {
+		b.topic.Publish(candle)
+	}
+}
+
+// Seed loads historical closed candles for symbol at interval, oldest
+// first, such as imported or persisted candles. Candles for periods already
+// built, or at or after the candle in progress, are ignored so live data is
+// never replaced. Seeded candles are not published. The candles used are
+// returned, nil if the builder does not build the interval.
+func (b *Builder) Seed(symbol string, interval time.Duration, candles []Candle) []Candle {
+	if !b.HasInterval(interval) {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	symbolSeries := b.series[symbol]
+	if symbolSeries == nil {
+		symbolSeries = map[time.Duration]*series{}
+		b.series[symbol] = symbolSeries
+	}
+	s := symbolSeries[interval]
+	if s == nil {
+		s = &series{}
+		symbolSeries[interval] = s
+	}
+	existing := map[int64]bool{}
+	for _, candle := range s.closed {
+		existing[candle.OpenTime.UnixNano()] = true
+	}
+	seeded := []Candle{}
+	for _, candle := range candles {
+		if existing[candle.OpenTime.UnixNano()] {
+			continue
+		}
+		if s.current != nil && !candle.OpenTime.Before(s.current.OpenTime) {
+			continue
+		}
+		existing[candle.OpenTime.UnixNano()] = true
+		candle.Symbol = symbol
+		candle.Interval = interval
+		candle.Closed = true
+		seeded = append(seeded, candle)
+	}
+	if len(seeded) == 0 {
+		return seeded
+	}
+	s.closed = append(s.closed, seeded...)
+	SortCandles(s.closed)
+	if len(s.closed) > b.window {
+		s.closed = s.closed[len(s.closed)-b.window:]
+	}
+	return seeded
+}
+
+// InProgress returns the candles in progress of every symbol and interval,
+// to be restored after a restart.
+func (b *Builder) InProgress() []InProgress {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	candles := []InProgress{}
+	for _, symbolSeries := range b.series {
+		for interval, s := range symbolSeries {
+			if s.current == nil {
+				continue
+			}
+			candles = append(candles, InProgress{
+				Candle:       *s.current,
+				IntervalName: FormatInterval(interval),
+				LastTrade:    s.last,
+			})
+		}
+	}
+	return candles
+}
+
+// Restore restores candles in progress saved by a previous run, so the
+// first candle after a quick restart is not missing the trades before it.
+// Candles are only restored where no candle is in progress and the period
+// is after the closed candles. Trades up to the last trade of a restored
+// candle are not added to it again. Returns the number of candles restored.
+func (b *Builder) Restore(candles []InProgress) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	restored := 0
+	for _, saved := range candles {
+		interval, err := ParseInterval(saved.IntervalName)
+		if err != nil || !b.HasInterval(interval) {
+			continue
+		}
+		symbolSeries := b.series[saved.Symbol]
+		if symbolSeries == nil {
+			symbolSeries = map[time.Duration]*series{}
+			b.series[saved.Symbol] = symbolSeries
+		}
+		s := symbolSeries[interval]
+		if s == nil {
+			s = &series{}
+			symbolSeries[interval] = s
+		}
+		if s.current != nil {
+			continue
+		}
+		if n := len(s.closed); n > 0 && saved.OpenTime.Before(s.closed[n-1].CloseTime()) {
+			continue
+		}
+		candle := saved.Candle
+		candle.Interval = interval
+		candle.Closed = false
+		s.current = &candle
+		s.last = saved.LastTrade
+		s.restored = saved.LastTrade
+		restored++
+	}
+	return restored
+}
+
+// Get returns up to limit of the most recent candles for the symbol and
+// interval, oldest first, including the candle in progress. A limit of 0
+// returns all candles in the window.
+func (b *Builder) Get(symbol string, interval time.Duration, limit int) []Candle {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	candles := []Candle{}
+	s := b.series[symbol][interval]
+	if s == nil {
+		return candles
+	}
+	candles = append(candles, s.closed...)
+	if s.current != nil {
+		candles = append(candles, *s.current)
+	}
+	if limit > 0 && len(candles) > limit {
+		candles = candles[len(candles)-limit:]
+	}
+	return candles
+}
+
+// VolumeRatio returns the quote volume of the last closed candle at interval
+// as a multiple of the average of the window candles before it. Returns
+// false if there are not enough candles or no volume in the window.
+func (b *Builder) VolumeRatio(symbol string, interval time.Duration, window int) (float64, bool) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	s := b.series[symbol][interval]
+	if s == nil || len(s.closed) < window+1 {
+		return 0, false
+	}
+	last := s.closed[len(s.closed)-1]
+	total := float64(0)
+	for _, candle := range s.closed[len(s.closed)-window-1 : len(s.closed)-1] {
+		total += candle.QuoteVolume
+	}
+	if total == 0 {
+		return 0, false
+	}
+	return last.QuoteVolume / (total / float64(window)), true
+}
+
+// ClosedQuoteVolumes returns the quote volumes of up to count of the most
+// recent closed candles for the symbol and interval, oldest first.
+func (b *Builder) ClosedQuoteVolumes(symbol string, interval time.Duration, count int) []float64 {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	s := b.series[symbol][interval]
+	if s == nil {
+		return nil
+	}
+	closed := s.closed
+	if len(closed) > count {
+		closed = closed[len(closed)-count:]
+	}
+	volumes := make([]float64, len(closed))
+	for i, candle := range closed {
+		volumes[i] = candle.QuoteVolume
+	}
+	return volumes
+}
+
+// Subscribe returns a channel that receives every update to the candles of
+// the symbol at interval. Updates are dropped for subscribers that are not
+// ready to receive.
+func (b *Builder) Subscribe(symbol string, interval time.Duration) chan Candle {
+	key := subscriptionKey(symbol, interval)
+	return b.topic.SubscribeKey(key, key, subscriberQueueOptions).(chan Candle)
+}
+
+func (b *Builder) Unsubscribe(symbol string, interval time.Duration, channel chan Candle) {
+	b.topic.Unsubscribe(channel)
+}
+
+func (b *Builder) publish(symbol string, updates []Candle) {
+	for _, candle := range updates {
+		b.topic.PublishKey(subscriptionKey(symbol, candle.Interval), candle)
+	}
+}
+
+func subscriptionKey(symbol string, interval time.Duration) string {
+	return symbol + "@" + FormatInterval(interval)
+}
+
+// Close closes the channels of the subscribers and stops publishing.
+func (b *Builder) Close() {
+	b.topic.Close()
+}
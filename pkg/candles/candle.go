@@ -0,0 +1,165 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package candles
+
+import (
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"time"
+)
+
+// The default intervals candles are built for.
+var DefaultIntervals = []time.Duration{
+	time.Minute,
+	5 * time.Minute,
+	15 * time.Minute,
+	time.Hour,
+	24 * time.Hour,
+}
+
+type Candle struct {
+	Symbol   string        `json:"symbol"`
+	Interval time.Duration `json:"-"`
+
+	// The start of the period covered by this candle.
+	OpenTime time.Time `json:"open_time"`
+
+	Open  float64 `json:"open"`
+	High  float64 `json:"high"`
+	Low   float64 `json:"low"`
+	Close float64 `json:"close"`
+
+	// Volume in the base asset, and in the quote asset.
+	Volume      float64 `json:"volume"`
+	QuoteVolume float64 `json:"quote_volume"`
+
+	// Quote volume of trades where the taker was the buyer.
+	TakerBuyQuoteVolume float64 `json:"taker_buy_quote_volume"`
+
+	Trades int64 `json:"trades"`
+
+	// True once a trade for a later period has been seen.
+	Closed bool `json:"closed"`
+}
+
+// InProgress is a candle in progress saved on shutdown, with the last trade
+// added to it.
+type InProgress struct {
+	Candle
+	IntervalName string        `json:"interval"`
+	LastTrade    pkg.TradeMark `json:"last_trade"`
+}
+
+func newCandle(trade *pkg.CommonTrade, interval time.Duration) *Candle {
+	return &Candle{
+		Symbol:   trade.Symbol,
+		Interval: interval,
+		OpenTime: trade.Timestamp.Truncate(interval),
+		Open:     trade.Price,
+		High:     trade.Price,
+		Low:      trade.Price,
+		Close:    trade.Price,
+	}
+}
+
+func (c *Candle) CloseTime() time.Time {
+	return c.OpenTime.Add(c.Interval)
+}
+
+func (c *Candle) addTrade(trade *pkg.CommonTrade) {
+	if trade.Price > c.High {
+		c.High = trade.Price
+	}
+	if trade.Price < c.Low {
+		c.Low = trade.Price
+	}
+	c.Close = trade.Price
+	c.Volume += trade.Quantity
+	c.QuoteVolume += trade.QuoteQuantity()
+	if !trade.BuyerMaker {
+		c.TakerBuyQuoteVolume += trade.QuoteQuantity()
+	}
+	c.Trades++
+}
+
+// FormatInterval formats an interval the way exchanges name them: 1m, 5m,
+// 1h, 1d.
+func FormatInterval(interval time.Duration) string {
+	switch {
+	case interval%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", interval/(24*time.Hour))
+	case interval%time.Hour == 0:
+		return fmt.Sprintf("%dh", interval/time.Hour)
+	case interval%time.Minute == 0:
+		return fmt.Sprintf("%dm", interval/time.Minute)
+	default:
+		return interval.String()
+	}
+}
+
+// ParseInterval parses an interval as formatted by FormatInterval.
+func ParseInterval(value string) (time.Duration, error) {
+	var count int64
+	var unit string
+	if _, err := fmt.Sscanf(value, "%d%s", &count, &unit); err != nil || count <= 0 {
+		return 0, fmt.Errorf("invalid interval: %s", value)
+	}
+	switch unit {
+	case "m":
+		return time.Duration(count) * time.Minute, nil
+	case "h":
+		return time.Duration(count) * time.Hour, nil
+	case "d":
+		return time.Duration(count) * 24 * time.Hour, nil
+	}
+	return 0, fmt.Errorf("invalid interval: %s", value)
+}
+
+// Downsample combines candles of a single symbol, sorted by open time, into
+// candles of a longer interval. Each candle goes into the candle whose
+// period contains its open time.
+func Downsample(candles []Candle, interval time.Duration) []Candle {
+	result := []Candle{}
+	var current *Candle
+	for _, candle := range candles {
+		openTime := candle.OpenTime.Truncate(interval)
+		if current == nil || !current.OpenTime.Equal(openTime) {
+			result = append(result, Candle{
+				Symbol:   candle.Symbol,
+				Interval: interval,
+				OpenTime: openTime,
+				Open:     candle.Open,
+				High:     candle.High,
+				Low:      candle.Low,
+				Closed:   true,
+			})
+			current = &result[len(result)-1]
+		}
+		if candle.High > current.High {
+			current.High = candle.High
+		}
+		if candle.Low < current.Low {
+			current.Low = candle.Low
+		}
+		current.Close = candle.Close
+		current.Volume += candle.Volume
+		current.QuoteVolume += candle.QuoteVolume
+		current.TakerBuyQuoteVolume += candle.TakerBuyQuoteVolume
+		current.Trades += candle.Trades
+		current.Closed = current.Closed && candle.Closed
+	}
+	return result
+}
@@ -0,0 +1,145 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package candles
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// HistoryStore stores imported historical candles on disk, one JSON lines
+// file per symbol and interval, so they can be loaded into a builder on
+// startup.
+type HistoryStore struct {
+	dir string
+}
+
+func NewHistoryStore(dir string) *HistoryStore {
+	return &HistoryStore{
+		dir: dir,
+	}
+}
+
+// HistoryFile identifies the stored candles of a symbol and interval.
+type HistoryFile struct {
+	Symbol   string
+	Interval time.Duration
+}
+
+func (s *HistoryStore) filename(symbol string, interval time.Duration) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s_%s.jsonl", symbol, FormatInterval(interval)))
+}
+
+// List returns the symbols and intervals with stored candles. A missing
+// directory is not an error.
+func (s *HistoryStore) List() ([]HistoryFile, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	files := []HistoryFile{}
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, ".jsonl") {
+			continue
+		}
+		name = strings.TrimSuffix(name, ".jsonl")
+		i := strings.LastIndex(name, "_")
+		if i < 1 {
+			continue
+		}
+		interval, err := ParseInterval(name[i+1:])
+		if err != nil {
+			continue
+		}
+		files = append(files, HistoryFile{Symbol: name[:i], Interval: interval})
+	}
+	return files, nil
+}
+
+// Load returns the stored candles of symbol at interval, oldest first.
+func (s *HistoryStore) Load(symbol string, interval time.Duration) ([]Candle, error) {
+	file, err := os.Open(s.filename(symbol, interval))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Candle{}, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	return ReadKlineJSONL(file, symbol, interval)
+}
+
+// Write merges candles into the stored candles of symbol at interval. Where
+// both have a candle for the same period the new candle replaces the stored
+// one. The merged candles are returned.
+func (s *HistoryStore) Write(symbol string, interval time.Duration, candles []Candle) ([]Candle, error) {
+	existing, err := s.Load(symbol, interval)
+	if err != nil {
+		return nil, err
+	}
+	merged := map[int64]Candle{}
+	for _, candle := range existing {
+		merged[candle.OpenTime.UnixNano()] = candle
+	}
+	for _, candle := range candles {
+		merged[candle.OpenTime.UnixNano()] = candle
+	}
+	all := make([]Candle, 0, len(merged))
+	for _, candle := range merged {
+		all = append(all, candle)
+	}
+	SortCandles(all)
+
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, err
+	}
+	filename := s.filename(symbol, interval)
+	file, err := ioutil.TempFile(s.dir, ".import-")
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, candle := range all {
+		if err = encoder.Encode(candle); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return all, nil
+}
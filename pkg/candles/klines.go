@@ -0,0 +1,237 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package candles
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kline timestamps above this are in microseconds rather than milliseconds.
+// Binance switched its spot data dumps to microseconds in 2025.
+const microsecondThreshold = 1e14
+
+// ReadKlineCSV reads candles in the Binance kline CSV format, as found in
+// the data.binance.vision dumps:
+//
+//	open_time,open,high,low,close,volume,close_time,quote_volume,trades,
+//	taker_buy_volume,taker_buy_quote_volume,ignore
+//
+// Only the first 11 columns are used and a header line is skipped.
+func ReadKlineCSV(r io.Reader, symbol string, interval time.Duration) ([]Candle, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	candles := []Candle{}
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == 1 && len(record) > 0 {
+			if _, err := strconv.ParseInt(record[0], 10, 64); err != nil {
+				continue
+			}
+		}
+		candle, err := parseKline(record, symbol, interval)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		candles = append(candles, candle)
+	}
+	return candles, nil
+}
+
+// ReadKlineJSONL reads candles with one JSON value per line. Each line is
+// either a kline array as returned by the Binance REST API, or a candle
+// object as returned by the candles API. Blank lines are skipped.
+func ReadKlineJSONL(r io.Reader, symbol string, interval time.Duration) ([]Candle, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	candles := []Candle{}
+	for line := 1; scanner.Scan(); line++ {
+		body := bytes.TrimSpace(scanner.Bytes())
+		if len(body) == 0 {
+			continue
+		}
+		var candle Candle
+		var err error
+		if body[0] == '[' {
+			candle, err = decodeKlineArray(body, symbol, interval)
+		} else {
+			err = json.Unmarshal(body, &candle)
+			candle.Symbol = symbol
+			candle.Interval = interval
+			candle.Closed = true
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		candles = append(candles, candle)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return candles, nil
+}
+
+// DecodeKlines decodes the kline arrays of a Binance REST klines response.
+// The candle still open at the time of the request is marked as not
+// closed.
+func DecodeKlines(body []byte, symbol string, interval time.Duration) ([]Candle, error) {
+	var klines []json.RawMessage
+	if err := json.Unmarshal(body, &klines); err != nil {
+		return nil, err
+	}
+	candles := make([]Candle, 0, len(klines))
+	now := time.Now()
+	for _, kline := range klines {
+		candle, err := decodeKlineArray(kline, symbol, interval)
+		if err != nil {
+			return nil, err
+		}
+		candle.Closed = !candle.CloseTime().After(now)
+		candles = append(candles, candle)
+	}
+	return candles, nil
+}
+
+func decodeKlineArray(body []byte, symbol string, interval time.Duration) (Candle, error) {
+	var values []interface{}
+	if err := json.Unmarshal(body, &values); err != nil {
+		return Candle{}, err
+	}
+	record := make([]string, len(values))
+	for i, value := range values {
+		switch value := value.(type) {
+		case string:
+			record[i] = value
+		case float64:
+			record[i] = strconv.FormatFloat(value, 'f', -1, 64)
+		default:
+			record[i] = fmt.Sprintf("%v", value)
+		}
+	}
+	return parseKline(record, symbol, interval)
+}
+
+func parseKline(record []string, symbol string, interval time.Duration) (Candle, error) {
+	if len(record) < 11 {
+		return Candle{}, fmt.Errorf("expected at least 11 fields, got %d", len(record))
+	}
+	openTime, err := strconv.ParseInt(strings.TrimSpace(record[0]), 10, 64)
+	if err != nil {
+		return Candle{}, fmt.Errorf("bad open time: %v", err)
+	}
+	candle := Candle{
+		Symbol:   symbol,
+		Interval: interval,
+		Closed:   true,
+	}
+	if openTime > microsecondThreshold {
+		candle.OpenTime = time.Unix(0, openTime*int64(time.Microsecond))
+	} else {
+		candle.OpenTime = time.Unix(0, openTime*int64(time.Millisecond))
+	}
+	fields := []struct {
+		index int
+		value *float64
+		name  string
+	}{
+		{1, &candle.Open, "open"},
+		{2, &candle.High, "high"},
+		{3, &candle.Low, "low"},
+		{4, &candle.Close, "close"},
+		{5, &candle.Volume, "volume"},
+		{7, &candle.QuoteVolume, "quote volume"},
+		{10, &candle.TakerBuyQuoteVolume, "taker buy quote volume"},
+	}
+	for _, field := range fields {
+		*field.value, err = strconv.ParseFloat(strings.TrimSpace(record[field.index]), 64)
+		if err != nil {
+			return Candle{}, fmt.Errorf("bad %s: %v", field.name, err)
+		}
+	}
+	if candle.Trades, err = strconv.ParseInt(strings.TrimSpace(record[8]), 10, 64); err != nil {
+		return Candle{}, fmt.Errorf("bad trades: %v", err)
+	}
+	return candle, nil
+}
+
+// Gap is a range of missing candles, From being the open time of the first
+// missing candle and To the open time of the last.
+type Gap struct {
+	From time.Time
+	To   time.Time
+}
+
+func (g Gap) String() string {
+	return fmt.Sprintf("%s - %s", g.From.UTC().Format(time.RFC3339),
+		g.To.UTC().Format(time.RFC3339))
+}
+
+// SortCandles sorts candles by open time, oldest first.
+func SortCandles(candles []Candle) {
+	sort.SliceStable(candles, func(i, j int) bool {
+		return candles[i].OpenTime.Before(candles[j].OpenTime)
+	})
+}
+
+// CheckContinuity validates candles sorted by open time. Each candle must be
+// aligned to interval with no duplicates, and prices must be consistent.
+// Missing candles are returned as gaps, which is not an error as exchanges
+// do have outages.
+func CheckContinuity(candles []Candle, interval time.Duration) ([]Gap, error) {
+	gaps := []Gap{}
+	for i, candle := range candles {
+		if !candle.OpenTime.Equal(candle.OpenTime.Truncate(interval)) {
+			return nil, fmt.Errorf("candle at %s is not aligned to %s",
+				candle.OpenTime.UTC().Format(time.RFC3339), FormatInterval(interval))
+		}
+		if candle.High < candle.Low || candle.Open > candle.High ||
+			candle.Open < candle.Low || candle.Close > candle.High ||
+			candle.Close < candle.Low {
+			return nil, fmt.Errorf("candle at %s has inconsistent prices",
+				candle.OpenTime.UTC().Format(time.RFC3339))
+		}
+		if i == 0 {
+			continue
+		}
+		expected := candles[i-1].OpenTime.Add(interval)
+		if candle.OpenTime.Before(expected) {
+			return nil, fmt.Errorf("duplicate or out of order candle at %s",
+				candle.OpenTime.UTC().Format(time.RFC3339))
+		}
+		if candle.OpenTime.After(expected) {
+			gaps = append(gaps, Gap{
+				From: expected,
+				To:   candle.OpenTime.Add(-interval),
+			})
+		}
+	}
+	return gaps, nil
+}
@@ -0,0 +1,104 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package coinbase
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const apiBaseUrl = "https://api.exchange.coinbase.com"
+
+var httpClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+func apiRequest(method string, path string, v interface{}) error {
+	request, err := http.NewRequest(method, fmt.Sprintf("%s%s", apiBaseUrl, path), nil)
+	if err != nil {
+		return err
+	}
+	// Requests without a user agent are rejected.
+	request.Header.Set("user-agent", "cryptoxscanner")
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: status=%d: %s", path, response.StatusCode, string(body))
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+type Product struct {
+	Id              string `json:"id"`
+	BaseCurrency    string `json:"base_currency"`
+	QuoteCurrency   string `json:"quote_currency"`
+	BaseIncrement   string `json:"base_increment"`
+	QuoteIncrement  string `json:"quote_increment"`
+	MinMarketFunds  string `json:"min_market_funds"`
+	Status          string `json:"status"`
+	TradingDisabled bool   `json:"trading_disabled"`
+	CancelOnly      bool   `json:"cancel_only"`
+	AuctionMode     bool   `json:"auction_mode"`
+}
+
+// Trading returns true if the product is online and accepting new orders.
+func (p Product) Trading() bool {
+	return p.Status == "online" && !p.TradingDisabled && !p.CancelOnly
+}
+
+func GetProducts() ([]Product, error) {
+	products := []Product{}
+	if err := apiRequest("GET", "/products", &products); err != nil {
+		return nil, err
+	}
+	return products, nil
+}
+
+// GetTradingSymbols returns the IDs of all products that are trading, such
+// as BTC-USD.
+func GetTradingSymbols() ([]string, error) {
+	products, err := GetProducts()
+	if err != nil {
+		return nil, err
+	}
+	symbols := []string{}
+	for _, product := range products {
+		if product.Trading() {
+			symbols = append(symbols, product.Id)
+		}
+	}
+	return symbols, nil
+}
+
+// parseFloat parses the decimal strings of the API, returning 0 if empty or
+// invalid.
+func parseFloat(value string) float64 {
+	f, _ := strconv.ParseFloat(value, 64)
+	return f
+}
@@ -0,0 +1,99 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package coinbase
+
+import (
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/latency"
+)
+
+// The endpoint of the Coinbase Exchange websocket feed.
+var StreamEndpoints = []latency.Endpoint{
+	{Name: "ws-feed.exchange.coinbase.com", Url: "wss://ws-feed.exchange.coinbase.com"},
+}
+
+// StreamProber selects the endpoint the trade and ticker streams connect
+// to.
+var StreamProber = latency.NewProber("coinbase.stream", StreamEndpoints, latency.DialProbe)
+
+// Exchange implements pkg.Exchange for the Coinbase Exchange spot market.
+// Symbols are product IDs such as BTC-USD.
+type Exchange struct {
+	tradeStream  *TradeStream
+	tickerStream *TickerStream
+}
+
+func NewExchange() *Exchange {
+	exchange := &Exchange{
+		tradeStream: NewTradeStream(),
+	}
+	exchange.tickerStream = NewTickerStream(exchange.tradeStream.SymbolFilter)
+	return exchange
+}
+
+func (e *Exchange) Name() string {
+	return "coinbase"
+}
+
+func (e *Exchange) Market() pkg.Market {
+	return pkg.MarketSpot
+}
+
+func (e *Exchange) GetSymbols() ([]string, error) {
+	symbols, err := GetTradingSymbols()
+	if err != nil {
+		return nil, err
+	}
+	return e.tradeStream.SymbolFilter().Apply(symbols), nil
+}
+
+// GetTradingRules returns the rules of all products. Coinbase has no
+// quantity limits, only increments and a minimum order value.
+func (e *Exchange) GetTradingRules() (map[string]pkg.TradingRules, error) {
+	products, err := GetProducts()
+	if err != nil {
+		return nil, err
+	}
+	rules := map[string]pkg.TradingRules{}
+	for _, product := range products {
+		status := "TRADING"
+		if product.AuctionMode {
+			status = "AUCTION"
+		} else if !product.Trading() {
+			status = "DISABLED"
+		}
+		rules[product.Id] = pkg.TradingRules{
+			Symbol:      product.Id,
+			Status:      status,
+			TickSize:    parseFloat(product.QuoteIncrement),
+			StepSize:    parseFloat(product.BaseIncrement),
+			MinNotional: parseFloat(product.MinMarketFunds),
+		}
+	}
+	return rules, nil
+}
+
+func (e *Exchange) TradeStream() pkg.TradeStream {
+	return e.tradeStream
+}
+
+func (e *Exchange) TickerStream() pkg.TickerStream {
+	return e.tickerStream
+}
+
+func (e *Exchange) DepthStream() pkg.DepthStream {
+	return nil
+}
@@ -0,0 +1,227 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package coinbase
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"time"
+)
+
+// TickerStream follows the ticker channel of each product, which is sent
+// on every trade, and sends the last ticker of every product once a
+// second like the tickers of the other exchanges.
+type TickerStream struct {
+	filter func() *pkg.SymbolFilter
+	cache  pkg.InputCache
+	health *pkg.StreamHealth
+
+	// The last ticker of each product, updated by the stream.
+	tickers map[string]pkg.CommonTicker
+	updates chan pkg.CommonTicker
+}
+
+// NewTickerStream creates a ticker stream for the products allowed by the
+// symbol filter returned by filter.
+func NewTickerStream(filter func() *pkg.SymbolFilter) *TickerStream {
+	cache := pkg.NewInputCache("coinbase.tickers.list")
+	if err := cache.Ping(); err != nil {
+		log.Printf("Redis cache not available. Coinbase tickers will not be cached.")
+		cache = nil
+	} else {
+		cache.SetRetention(time.Hour)
+	}
+	return &TickerStream{
+		filter:  filter,
+		cache:   cache,
+		health:  pkg.NewStreamHealth("coinbase.tickers", pkg.DefaultBackoffOptions),
+		tickers: map[string]pkg.CommonTicker{},
+		updates: make(chan pkg.CommonTicker, 1024),
+	}
+}
+
+// Run streams the tickers, sending the tickers with a price and volume to
+// channel every second, until ctx is cancelled.
+func (t *TickerStream) Run(ctx context.Context, channel chan []pkg.CommonTicker) {
+	go t.stream(ctx)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case update := <-t.updates:
+			t.tickers[update.Symbol] = update
+		case <-ticker.C:
+			tickers := []pkg.CommonTicker{}
+			for _, ticker := range t.tickers {
+				if ticker.QuoteVolume == 0 || ticker.LastPrice == 0 {
+					continue
+				}
+				tickers = append(tickers, ticker)
+			}
+			if len(tickers) == 0 {
+				continue
+			}
+			t.Cache(tickers)
+			select {
+			case channel <- tickers:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// stream reads the ticker channel, reconnecting until ctx is cancelled.
+func (t *TickerStream) stream(ctx context.Context) {
+	for {
+		symbols, err := GetTradingSymbols()
+		if err != nil {
+			log.Printf("coinbase: failed to get symbols: %v\n", err)
+			goto TryAgain
+		}
+		symbols = t.filter().Apply(symbols)
+		if len(symbols) == 0 {
+			goto TryAgain
+		}
+
+		if err := t.runOnce(ctx, symbols); ctx.Err() == nil && t.health.Disconnected(ctx, err) {
+			continue
+		}
+		log.Printf("coinbase: ticker feed exiting.\n")
+		return
+
+	TryAgain:
+		if !pkg.Sleep(ctx, 1*time.Second) {
+			return
+		}
+	}
+}
+
+func (t *TickerStream) runOnce(ctx context.Context, symbols []string) error {
+	log.Printf("coinbase: connecting to ticker stream.")
+	conn, _, err := websocket.DefaultDialer.Dial(StreamProber.Selected(), nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer pkg.CloseOnDone(ctx, conn)()
+
+	if err := subscribe(conn, "ticker", symbols); err != nil {
+		return err
+	}
+	log.Printf("coinbase: connected to ticker stream.")
+	t.health.Connected()
+
+	for {
+		_, body, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		t.health.Message()
+		pkg.RecordRaw("coinbase.tickers", body)
+
+		message, err := decodeMessage(body)
+		if err != nil {
+			log.WithField("exchange", "coinbase").Limited().
+				Errorf("failed to decode ticker feed: %v", err)
+			continue
+		}
+		if message.Type != "ticker" {
+			continue
+		}
+		ticker, err := toCommonTicker(message)
+		if err != nil {
+			log.WithFields(log.Fields{"exchange": "coinbase", "symbol": message.ProductId}).Limited().
+				Errorf("failed to decode ticker: %v", err)
+			continue
+		}
+		select {
+		case t.updates <- ticker:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// toCommonTicker converts a ticker message. The 24h volume is in the base
+// currency, so the quote volume is estimated at the last price.
+func toCommonTicker(message *feedMessage) (pkg.CommonTicker, error) {
+	ticker := pkg.CommonTicker{
+		Symbol:    message.ProductId,
+		LastPrice: parseFloat(message.Price),
+		Bid:       parseFloat(message.BestBid),
+		Ask:       parseFloat(message.BestAsk),
+		High:      parseFloat(message.High24h),
+		Low:       parseFloat(message.Low24h),
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, message.Time)
+	if err != nil {
+		return ticker, fmt.Errorf("bad time: %v", err)
+	}
+	ticker.Timestamp = timestamp
+	ticker.QuoteVolume = parseFloat(message.Volume24h) * ticker.LastPrice
+	if open := parseFloat(message.Open24h); open > 0 {
+		ticker.PriceChangePct24 = (ticker.LastPrice - open) / open * 100
+	}
+	return ticker, nil
+}
+
+func (t *TickerStream) Cache(tickers []pkg.CommonTicker) {
+	if t.cache == nil {
+		return
+	}
+	buf, err := json.Marshal(tickers)
+	if err != nil {
+		log.Printf("error: failed to encode coinbase tickers: %v\n", err)
+		return
+	}
+	t.cache.RPush(buf)
+	t.cache.Prune()
+}
+
+func (t *TickerStream) ReplayCache(cb func(tickers []pkg.CommonTicker)) {
+	if t.cache == nil {
+		return
+	}
+	log.Printf("coinbase: cache replay start\n")
+	i := int64(0)
+	for {
+		entry, err := t.cache.GetN(i)
+		if err != nil {
+			log.Printf("error: failed to get redis cache entry %d: %v\n", i, err)
+			break
+		}
+		if entry == nil {
+			break
+		}
+		i++
+		tickers := []pkg.CommonTicker{}
+		if err := json.Unmarshal([]byte(entry.Message), &tickers); err != nil {
+			log.WithField("exchange", "coinbase").Limited().
+				Errorf("failed to decode coinbase ticker cache entry: %v", err)
+			continue
+		}
+		cb(tickers)
+	}
+	log.Printf("coinbase: cache replay done: ticks: %d\n", i)
+}
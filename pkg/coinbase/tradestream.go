@@ -0,0 +1,342 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package coinbase
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The number of products subscribed to per subscribe message.
+const maxProductsPerSubscribe = 100
+
+type feedMessage struct {
+	Type      string `json:"type"`
+	ProductId string `json:"product_id"`
+	Time      string `json:"time"`
+
+	// Matches.
+	TradeId int64  `json:"trade_id"`
+	Side    string `json:"side"`
+	Size    string `json:"size"`
+	Price   string `json:"price"`
+
+	// Tickers, which also have a price.
+	Open24h   string `json:"open_24h"`
+	Volume24h string `json:"volume_24h"`
+	High24h   string `json:"high_24h"`
+	Low24h    string `json:"low_24h"`
+	BestBid   string `json:"best_bid"`
+	BestAsk   string `json:"best_ask"`
+
+	// Errors.
+	Message string `json:"message"`
+	Reason  string `json:"reason"`
+}
+
+// subscribe subscribes conn to channel for symbols. Coinbase closes
+// connections that do not subscribe within a few seconds of connecting.
+func subscribe(conn *websocket.Conn, channel string, symbols []string) error {
+	for i := 0; i < len(symbols); i += maxProductsPerSubscribe {
+		end := i + maxProductsPerSubscribe
+		if end > len(symbols) {
+			end = len(symbols)
+		}
+		err := conn.WriteJSON(map[string]interface{}{
+			"type":        "subscribe",
+			"product_ids": symbols[i:end],
+			"channels":    []string{channel},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeMessage decodes a feed message, returning error messages from
+// Coinbase as an error.
+func decodeMessage(body []byte) (*feedMessage, error) {
+	var message feedMessage
+	if err := json.Unmarshal(body, &message); err != nil {
+		return nil, err
+	}
+	if message.Type == "error" {
+		return nil, fmt.Errorf("%s: %s", message.Message, message.Reason)
+	}
+	return &message, nil
+}
+
+type TradeStream struct {
+	*pkg.TradePublisher
+	cache  pkg.InputCache
+	health *pkg.StreamHealth
+
+	// Signalled to subscribe to new symbols on the current connection.
+	refresh chan struct{}
+}
+
+func NewTradeStream() *TradeStream {
+	tradeStream := &TradeStream{
+		TradePublisher: pkg.NewTradePublisher("coinbase.trades"),
+		health:         pkg.NewStreamHealth("coinbase.trades", pkg.DefaultBackoffOptions),
+		refresh:        make(chan struct{}, 1),
+	}
+
+	cache := pkg.NewInputCache("coinbase.trades")
+	if err := cache.Ping(); err != nil {
+		log.Printf("Redis not available. No Coinbase trade caching will be done.")
+	} else {
+		tradeStream.cache = cache
+	}
+
+	return tradeStream
+}
+
+// Run replays the cache then streams live trades until ctx is cancelled.
+func (s *TradeStream) Run(ctx context.Context) {
+	restore := pkg.NewRestoreProgress("coinbase.trades")
+	s.restoreFromCache(ctx, restore)
+	restore.Done()
+
+	// Raw messages from the connection, decoded in parallel, in order.
+	bodies := make(chan []byte)
+	go s.publishDecoded(ctx, bodies)
+
+	for {
+		symbols, err := GetTradingSymbols()
+		if err != nil {
+			log.Printf("coinbase: failed to get symbols: %v\n", err)
+			goto TryAgain
+		}
+		symbols = s.SymbolFilter().Apply(symbols)
+		if len(symbols) == 0 {
+			log.Printf("coinbase: got 0 symbols, trying again\n")
+			goto TryAgain
+		}
+		log.Printf("coinbase: got %d symbols\n", len(symbols))
+
+		if err := s.runOnce(ctx, symbols, bodies); ctx.Err() == nil && s.health.Disconnected(ctx, err) {
+			continue
+		}
+		log.Printf("coinbase: trade feed exiting.\n")
+		return
+
+	TryAgain:
+		if !pkg.Sleep(ctx, 1*time.Second) {
+			log.Printf("coinbase: trade feed exiting.\n")
+			return
+		}
+	}
+}
+
+// runOnce connects, subscribes and reads trades into bodies until the
+// connection fails.
+func (s *TradeStream) runOnce(ctx context.Context, symbols []string, bodies chan<- []byte) error {
+	log.Printf("coinbase: connecting to trade stream.")
+	conn, _, err := websocket.DefaultDialer.Dial(StreamProber.Selected(), nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer pkg.CloseOnDone(ctx, conn)()
+
+	if err := subscribe(conn, "matches", symbols); err != nil {
+		return err
+	}
+	log.Printf("coinbase: connected to trade stream.")
+	s.health.Connected()
+
+	done := make(chan bool)
+	defer close(done)
+	go s.subscribeNew(conn, symbols, done)
+
+	for {
+		_, body, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		s.health.Message()
+		pkg.RecordRaw("coinbase.trades", body)
+
+		select {
+		case bodies <- body:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// RefreshSymbols subscribes to symbols listed since the connection was made
+// without waiting for a reconnect.
+func (s *TradeStream) RefreshSymbols() {
+	select {
+	case s.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// subscribeNew subscribes conn to the symbols not already subscribed to
+// each time RefreshSymbols is called, until done is closed. It is the only
+// writer to conn once connected.
+func (s *TradeStream) subscribeNew(conn *websocket.Conn, symbols []string, done chan bool) {
+	subscribed := map[string]bool{}
+	for _, symbol := range symbols {
+		subscribed[symbol] = true
+	}
+	for {
+		select {
+		case <-done:
+			return
+		case <-s.refresh:
+		}
+		symbols, err := GetTradingSymbols()
+		if err != nil {
+			log.Printf("coinbase: failed to get symbols: %v\n", err)
+			continue
+		}
+		added := []string{}
+		for _, symbol := range s.SymbolFilter().Apply(symbols) {
+			if !subscribed[symbol] {
+				subscribed[symbol] = true
+				added = append(added, symbol)
+			}
+		}
+		if len(added) == 0 {
+			continue
+		}
+		log.Printf("coinbase: subscribing to %d new symbols: %s\n", len(added),
+			strings.Join(added, ", "))
+		if err := subscribe(conn, "matches", added); err != nil {
+			log.Printf("coinbase: failed to subscribe to new symbols: %v\n", err)
+			return
+		}
+	}
+}
+
+// publishDecoded decodes the messages from bodies on the decode pool,
+// publishing the trades, until ctx is cancelled.
+func (s *TradeStream) publishDecoded(ctx context.Context, bodies <-chan []byte) {
+	results := make(chan pkg.DecodeResult)
+	go s.DecodePool().Run(ctx, bodies, results, func(body []byte) (interface{}, error) {
+		return s.DecodeTrade(body)
+	})
+	for {
+		var result pkg.DecodeResult
+		select {
+		case result = <-results:
+		case <-ctx.Done():
+			return
+		}
+		if result.Err != nil {
+			log.WithField("exchange", "coinbase").Limited().
+				Errorf("failed to decode trade feed: %v", result.Err)
+			continue
+		}
+		trade := result.Value.(*pkg.CommonTrade)
+		if trade == nil {
+			continue
+		}
+
+		s.cacheAdd(result.Body)
+		s.Publish(*trade)
+	}
+}
+
+// DecodeTrade decodes a raw websocket message. If the message is not a trade
+// nil is returned without an error. The last match sent on subscribing is
+// also a trade, duplicates of it are dropped by trade ID.
+func (s *TradeStream) DecodeTrade(body []byte) (*pkg.CommonTrade, error) {
+	message, err := decodeMessage(body)
+	if err != nil {
+		return nil, err
+	}
+	if message.Type != "match" && message.Type != "last_match" {
+		return nil, nil
+	}
+
+	// The side is that of the maker order.
+	trade := pkg.CommonTrade{
+		Symbol:     message.ProductId,
+		Id:         message.TradeId,
+		BuyerMaker: message.Side == "buy",
+	}
+	if trade.Price, err = strconv.ParseFloat(message.Price, 64); err != nil {
+		return nil, fmt.Errorf("bad price: %v", err)
+	}
+	if trade.Quantity, err = strconv.ParseFloat(message.Size, 64); err != nil {
+		return nil, fmt.Errorf("bad size: %v", err)
+	}
+	if trade.Timestamp, err = time.Parse(time.RFC3339Nano, message.Time); err != nil {
+		return nil, fmt.Errorf("bad time: %v", err)
+	}
+
+	return &trade, nil
+}
+
+func (s *TradeStream) cacheAdd(body []byte) {
+	if s.cache == nil {
+		return
+	}
+	s.cache.RPush(body)
+	s.cache.Prune()
+}
+
+func (s *TradeStream) restoreFromCache(ctx context.Context, progress *pkg.RestoreProgress) {
+	if s.cache == nil {
+		return
+	}
+	if total, err := s.cache.Len(); err == nil {
+		progress.AddTotal(total)
+	}
+
+	log.Printf("coinbase: trade cache replay start\n")
+	start := time.Now()
+	count := 0
+
+	for i := int64(0); ctx.Err() == nil; i++ {
+		entry, err := s.cache.GetN(i)
+		if err != nil {
+			log.Printf("error: redis: %v", err)
+			break
+		}
+		if entry == nil {
+			break
+		}
+		progress.Restored(1)
+		trade, err := s.DecodeTrade([]byte(entry.Message))
+		if err != nil {
+			log.WithField("exchange", "coinbase").Limited().
+				Errorf("failed to decode coinbase trade from cache: %v", err)
+			continue
+		}
+		if trade == nil {
+			continue
+		}
+		s.Publish(*trade)
+		count++
+	}
+
+	log.Printf("coinbase: trade cache replay done: %d trades in %v\n",
+		count, time.Now().Sub(start))
+}
@@ -0,0 +1,193 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The currencies prices and volumes can be converted to.
+var ConversionCurrencies = []string{"USD", "EUR", "BTC"}
+
+// Quote assets used to split symbols that have no separator, such as
+// Binance's ETHBTC. Longer assets must come before any asset they end with.
+var knownQuoteAssets = []string{
+	"FDUSD", "USDT", "BUSD", "USDC", "TUSD", "PAX",
+	"BTC", "ETH", "BNB", "XRP", "TRX", "EUR",
+}
+
+// USD stable coins are treated as USD.
+var usdAssets = map[string]bool{
+	"USD":   true,
+	"USDT":  true,
+	"BUSD":  true,
+	"USDC":  true,
+	"TUSD":  true,
+	"FDUSD": true,
+	"PAX":   true,
+}
+
+// SplitSymbol splits a symbol into its base and quote asset. KuCoin style
+// symbols are split on the dash, others by matching a known quote asset.
+func SplitSymbol(symbol string) (base string, quote string, ok bool) {
+	symbol = strings.ToUpper(symbol)
+	if parts := strings.SplitN(symbol, "-", 2); len(parts) == 2 {
+		return parts[0], parts[1], true
+	}
+	for _, asset := range knownQuoteAssets {
+		if strings.HasSuffix(symbol, asset) && len(symbol) > len(asset) {
+			return strings.TrimSuffix(symbol, asset), asset, true
+		}
+	}
+	return "", "", false
+}
+
+func IsConversionCurrency(currency string) bool {
+	for _, c := range ConversionCurrencies {
+		if c == strings.ToUpper(currency) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsUsdAsset returns true for USD and the USD stable coins.
+func IsUsdAsset(asset string) bool {
+	return usdAssets[strings.ToUpper(asset)]
+}
+
+func normalizeAsset(asset string) string {
+	asset = strings.ToUpper(asset)
+	if usdAssets[asset] {
+		return "USD"
+	}
+	return asset
+}
+
+// ConversionRates is a snapshot of the last prices of an exchange used to
+// convert between assets. A snapshot is not modified once built, so it can be
+// shared without locking.
+type ConversionRates struct {
+	prices map[string]float64
+}
+
+// NewConversionRates builds a snapshot from a map of symbol to last price.
+// Symbols that can't be split into base and quote are ignored.
+func NewConversionRates(prices map[string]float64) *ConversionRates {
+	rates := &ConversionRates{
+		prices: map[string]float64{},
+	}
+	for symbol, price := range prices {
+		if price <= 0 {
+			continue
+		}
+		base, quote, ok := SplitSymbol(symbol)
+		if !ok {
+			continue
+		}
+		rates.prices[pairKey(normalizeAsset(base), normalizeAsset(quote))] = price
+	}
+	return rates
+}
+
+func pairKey(base string, quote string) string {
+	return fmt.Sprintf("%s/%s", base, quote)
+}
+
+func (r *ConversionRates) direct(from string, to string) (float64, bool) {
+	if from == to {
+		return 1, true
+	}
+	if price, ok := r.prices[pairKey(from, to)]; ok {
+		return price, true
+	}
+	if price, ok := r.prices[pairKey(to, from)]; ok {
+		return 1 / price, true
+	}
+	return 0, false
+}
+
+// Rate returns the amount of to that one unit of from is worth. If there is
+// no market between the two the rate is taken through USD or BTC.
+func (r *ConversionRates) Rate(from string, to string) (float64, bool) {
+	if r == nil {
+		return 0, false
+	}
+	from = normalizeAsset(from)
+	to = normalizeAsset(to)
+	if rate, ok := r.direct(from, to); ok {
+		return rate, true
+	}
+	for _, via := range []string{"USD", "BTC"} {
+		a, ok := r.direct(from, via)
+		if !ok {
+			continue
+		}
+		b, ok := r.direct(via, to)
+		if !ok {
+			continue
+		}
+		return a * b, true
+	}
+	return 0, false
+}
+
+// Fields of an update message that are prices or volumes in the quote
+// asset. Fields with one of the prefixes are per bucket.
+var conversionFields = []string{"close", "bid", "ask", "high", "low", "volume"}
+var conversionFieldPrefixes = []string{"l_", "h_", "r_", "vwap_", "total_volume_", "nv_"}
+
+func isConversionField(key string) bool {
+	for _, field := range conversionFields {
+		if key == field {
+			return true
+		}
+	}
+	for _, prefix := range conversionFieldPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ConvertUpdate returns a copy of an update message with its prices and
+// volumes expressed in currency. Percentages are left unchanged. If no rate
+// is available the update is returned as is.
+func (r *ConversionRates) ConvertUpdate(update map[string]interface{}, currency string) map[string]interface{} {
+	symbol, _ := update["symbol"].(string)
+	_, quote, ok := SplitSymbol(symbol)
+	if !ok {
+		return update
+	}
+	rate, ok := r.Rate(quote, currency)
+	if !ok {
+		return update
+	}
+
+	converted := make(map[string]interface{}, len(update)+2)
+	for key, value := range update {
+		if v, ok := value.(float64); ok && isConversionField(key) {
+			converted[key] = Round8(v * rate)
+		} else {
+			converted[key] = value
+		}
+	}
+	converted["quote_currency"] = strings.ToUpper(currency)
+	converted["conversion_rate"] = Round8(rate)
+	return converted
+}
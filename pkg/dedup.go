@@ -0,0 +1,126 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/metrics"
+	"sync"
+)
+
+func init() {
+	metrics.Describe("trades_duplicate_total",
+		"Trades dropped for having the ID of a recently published trade.")
+}
+
+// The default number of trade IDs before the newest remembered per symbol.
+// It needs to cover the trades of the busiest symbols over the cache
+// retention, as the whole cache may overlap with the live stream after a
+// restart. Each ID takes a bit, about 6KB per symbol.
+const DefaultDedupWindow = 50000
+
+// recentIds is the newest trade ID of a symbol and which of the IDs in the
+// window before it have been seen, as a ring of bits indexed by ID. Trade
+// IDs increase per symbol, so older IDs are forgotten as newer are seen.
+type recentIds struct {
+	last int64
+	seen []uint64
+}
+
+func newRecentIds(size int) *recentIds {
+	return &recentIds{
+		last: -1,
+		seen: make([]uint64, (size+63)/64),
+	}
+}
+
+func (r *recentIds) bit(id int64, size int) (int, uint64) {
+	position := uint64(id) % uint64(size)
+	return int(position / 64), 1 << (position % 64)
+}
+
+// add remembers id, returning true if it was already seen. IDs older than
+// the window are not remembered and never seen.
+func (r *recentIds) add(id int64, size int) bool {
+	if r.last >= 0 && id <= r.last-int64(size) {
+		return false
+	}
+	if id > r.last {
+		// Forget the IDs the ring positions between the last and id held.
+		skipped := id - r.last - 1
+		if r.last < 0 || skipped >= int64(size) {
+			for i := range r.seen {
+				r.seen[i] = 0
+			}
+		} else {
+			for skip := r.last + 1; skip < id; skip++ {
+				word, mask := r.bit(skip, size)
+				r.seen[word] &^= mask
+			}
+		}
+		r.last = id
+		word, mask := r.bit(id, size)
+		r.seen[word] |= mask
+		return false
+	}
+	word, mask := r.bit(id, size)
+	if r.seen[word]&mask != 0 {
+		return true
+	}
+	r.seen[word] |= mask
+	return false
+}
+
+// TradeDedup drops trades that have already been published, keyed on the
+// symbol and exchange trade ID. Duplicates happen when the cache restored on
+// start overlaps with trades queued from the live stream, or when a gap is
+// backfilled with trades that were received after all.
+type TradeDedup struct {
+	size       int
+	symbols    map[string]*recentIds
+	lock       sync.Mutex
+	duplicates *metrics.Counter
+}
+
+// NewTradeDedup remembers the trade IDs of each symbol up to size before
+// the newest. The name is the name of the trade stream, such as
+// binance.trades.
+func NewTradeDedup(name string, size int) *TradeDedup {
+	return &TradeDedup{
+		size:       size,
+		symbols:    map[string]*recentIds{},
+		duplicates: metrics.GetCounter("trades_duplicate_total", metrics.Labels{"stream": name}),
+	}
+}
+
+// Duplicate returns true if the trade has already been seen, otherwise it
+// is remembered. Trades without an ID are never duplicates.
+func (d *TradeDedup) Duplicate(trade *CommonTrade) bool {
+	if trade.Id == 0 || d.size <= 0 {
+		return false
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	recent := d.symbols[trade.Symbol]
+	if recent == nil {
+		recent = newRecentIds(d.size)
+		d.symbols[trade.Symbol] = recent
+	}
+	if recent.add(trade.Id, d.size) {
+		d.duplicates.Inc()
+		return true
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"testing"
+)
+
+func TestTradeDedup(t *testing.T) {
+	dedup := NewTradeDedup("test", 100)
+	check := func(symbol string, id int64, expected bool) {
+		t.Helper()
+		trade := CommonTrade{Symbol: symbol, Id: id}
+		if duplicate := dedup.Duplicate(&trade); duplicate != expected {
+			t.Errorf("%s %d: expected duplicate %v, got %v", symbol, id, expected, duplicate)
+		}
+	}
+
+	for id := int64(1); id <= 10; id++ {
+		check("ETHBTC", id, false)
+	}
+	check("ETHBTC", 5, true)
+	check("ETHBTC", 10, true)
+
+	// Symbols are independent.
+	check("LTCBTC", 5, false)
+
+	// A gap, then the missing trades backfilled after.
+	check("ETHBTC", 20, false)
+	check("ETHBTC", 15, false)
+	check("ETHBTC", 15, true)
+	check("ETHBTC", 20, true)
+
+	// The IDs skipped over are forgotten as the ring wraps.
+	check("ETHBTC", 150, false)
+	check("ETHBTC", 60, false)
+	check("ETHBTC", 60, true)
+	check("ETHBTC", 149, false)
+
+	// Older than the window, can't tell.
+	check("ETHBTC", 20, false)
+
+	// A gap larger than the window forgets everything.
+	check("ETHBTC", 1000, false)
+	check("ETHBTC", 999, false)
+	check("ETHBTC", 1000, true)
+
+	// Trades without an ID are never duplicates.
+	check("ETHBTC", 0, false)
+	check("ETHBTC", 0, false)
+}
+
+func TestTradeDedupDisabled(t *testing.T) {
+	dedup := NewTradeDedup("test", 0)
+	trade := CommonTrade{Symbol: "ETHBTC", Id: 1}
+	if dedup.Duplicate(&trade) || dedup.Duplicate(&trade) {
+		t.Errorf("duplicate with dedup disabled")
+	}
+}
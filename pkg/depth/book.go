@@ -0,0 +1,138 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package depth
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type Level struct {
+	Price    float64
+	Quantity float64
+}
+
+// Book is a local order book for a single symbol.
+type Book struct {
+	Symbol string
+
+	// The ID of the last update applied to the book.
+	LastUpdateId int64
+
+	bids map[float64]float64
+	asks map[float64]float64
+	lock sync.RWMutex
+}
+
+func NewBook(symbol string) *Book {
+	return &Book{
+		Symbol: symbol,
+		bids:   map[float64]float64{},
+		asks:   map[float64]float64{},
+	}
+}
+
+// Reset replaces the contents of the book with a snapshot.
+func (b *Book) Reset(lastUpdateId int64, bids []Level, asks []Level) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.bids = map[float64]float64{}
+	b.asks = map[float64]float64{}
+	applyLevels(b.bids, bids)
+	applyLevels(b.asks, asks)
+	b.LastUpdateId = lastUpdateId
+}
+
+// Apply applies an update to the book. A level with a quantity of 0 removes
+// the price level.
+func (b *Book) Apply(lastUpdateId int64, bids []Level, asks []Level) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	applyLevels(b.bids, bids)
+	applyLevels(b.asks, asks)
+	b.LastUpdateId = lastUpdateId
+}
+
+func applyLevels(side map[float64]float64, levels []Level) {
+	for _, level := range levels {
+		if level.Quantity == 0 {
+			delete(side, level.Price)
+		} else {
+			side[level.Price] = level.Quantity
+		}
+	}
+}
+
+// Bids returns up to n bids, best (highest) first. If n is 0 all bids are
+// returned.
+func (b *Book) Bids(n int) []Level {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return sortedLevels(b.bids, n, true)
+}
+
+// Asks returns up to n asks, best (lowest) first. If n is 0 all asks are
+// returned.
+func (b *Book) Asks(n int) []Level {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return sortedLevels(b.asks, n, false)
+}
+
+func sortedLevels(side map[float64]float64, n int, descending bool) []Level {
+	levels := make([]Level, 0, len(side))
+	for price, quantity := range side {
+		levels = append(levels, Level{Price: price, Quantity: quantity})
+	}
+	sort.Slice(levels, func(i, j int) bool {
+		if descending {
+			return levels[i].Price > levels[j].Price
+		}
+		return levels[i].Price < levels[j].Price
+	})
+	if n > 0 && len(levels) > n {
+		levels = levels[:n]
+	}
+	return levels
+}
+
+// FormatDecimal formats a price or quantity the same way it is sent to
+// clients, which is also the form used when computing checksums.
+func FormatDecimal(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// Checksum returns a CRC32 of the top depth levels of each side of the book.
+// The checksum string is built by interleaving bid and ask levels as
+// "bidPrice:bidQty:askPrice:askQty:..." so clients can compute the same
+// value from their copy of the book.
+func Checksum(bids []Level, asks []Level) uint32 {
+	parts := []string{}
+	for i := 0; i < len(bids) || i < len(asks); i++ {
+		if i < len(bids) {
+			parts = append(parts, FormatDecimal(bids[i].Price),
+				FormatDecimal(bids[i].Quantity))
+		}
+		if i < len(asks) {
+			parts = append(parts, FormatDecimal(asks[i].Price),
+				FormatDecimal(asks[i].Quantity))
+		}
+	}
+	return crc32.ChecksumIEEE([]byte(strings.Join(parts, ":")))
+}
@@ -0,0 +1,164 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package depth
+
+const (
+	FrameTypeSnapshot = "snapshot"
+	FrameTypeDelta    = "delta"
+	FrameTypeChecksum = "checksum"
+)
+
+// Frame is a depth message sent to a client. Levels are encoded as
+// [price, quantity] string pairs. In a delta frame a quantity of "0" means
+// the level was removed.
+type Frame struct {
+	Type     string      `json:"type"`
+	Symbol   string      `json:"symbol"`
+	Sequence int64       `json:"sequence"`
+	Bids     [][2]string `json:"bids,omitempty"`
+	Asks     [][2]string `json:"asks,omitempty"`
+
+	// Only meaningful on checksum frames, 0 on others. The CRC32 of the top
+	// levels of the book as described by Checksum, which may be 0.
+	Checksum uint32 `json:"checksum"`
+}
+
+type sentBook struct {
+	bids     map[float64]float64
+	asks     map[float64]float64
+	sequence int64
+	deltas   int
+}
+
+// DeltaEncoder tracks the state of the book last sent to a single client
+// and encodes further updates as deltas against it. Each client needs its
+// own encoder.
+type DeltaEncoder struct {
+	// The number of levels per side sent to the client.
+	depth int
+
+	// A checksum frame is sent after this many delta frames.
+	checksumInterval int
+
+	sent map[string]*sentBook
+}
+
+func NewDeltaEncoder(depth int, checksumInterval int) *DeltaEncoder {
+	return &DeltaEncoder{
+		depth:            depth,
+		checksumInterval: checksumInterval,
+		sent:             map[string]*sentBook{},
+	}
+}
+
+// RequestSnapshot causes the next encode for symbol to send a full snapshot,
+// used when a client reports that its book is out of sync.
+func (e *DeltaEncoder) RequestSnapshot(symbol string) {
+	delete(e.sent, symbol)
+}
+
+// Encode returns the frames required to bring the client up to date with
+// the current state of the book. A snapshot is returned the first time a
+// symbol is encoded, otherwise a delta containing only the changed levels,
+// followed by a checksum frame every checksumInterval deltas.
+func (e *DeltaEncoder) Encode(book *Book) []Frame {
+	bids := book.Bids(e.depth)
+	asks := book.Asks(e.depth)
+
+	previous := e.sent[book.Symbol]
+	current := &sentBook{
+		bids: levelMap(bids),
+		asks: levelMap(asks),
+	}
+
+	if previous == nil {
+		e.sent[book.Symbol] = current
+		return []Frame{{
+			Type:     FrameTypeSnapshot,
+			Symbol:   book.Symbol,
+			Sequence: 0,
+			Bids:     encodeLevels(bids),
+			Asks:     encodeLevels(asks),
+		}}
+	}
+
+	current.sequence = previous.sequence
+	current.deltas = previous.deltas
+	e.sent[book.Symbol] = current
+
+	frames := []Frame{}
+
+	bidChanges := diffLevels(previous.bids, current.bids)
+	askChanges := diffLevels(previous.asks, current.asks)
+	if len(bidChanges) > 0 || len(askChanges) > 0 {
+		current.sequence++
+		current.deltas++
+		frames = append(frames, Frame{
+			Type:     FrameTypeDelta,
+			Symbol:   book.Symbol,
+			Sequence: current.sequence,
+			Bids:     bidChanges,
+			Asks:     askChanges,
+		})
+	}
+
+	if e.checksumInterval > 0 && current.deltas >= e.checksumInterval {
+		current.deltas = 0
+		frames = append(frames, Frame{
+			Type:     FrameTypeChecksum,
+			Symbol:   book.Symbol,
+			Sequence: current.sequence,
+			Checksum: Checksum(bids, asks),
+		})
+	}
+
+	return frames
+}
+
+func levelMap(levels []Level) map[float64]float64 {
+	m := make(map[float64]float64, len(levels))
+	for _, level := range levels {
+		m[level.Price] = level.Quantity
+	}
+	return m
+}
+
+func encodeLevels(levels []Level) [][2]string {
+	encoded := make([][2]string, 0, len(levels))
+	for _, level := range levels {
+		encoded = append(encoded, [2]string{
+			FormatDecimal(level.Price), FormatDecimal(level.Quantity)})
+	}
+	return encoded
+}
+
+// diffLevels returns the levels that were added or changed in current, and
+// the levels removed from previous with a quantity of 0.
+func diffLevels(previous map[float64]float64, current map[float64]float64) [][2]string {
+	changes := [][2]string{}
+	for price, quantity := range current {
+		if previousQuantity, ok := previous[price]; !ok || previousQuantity != quantity {
+			changes = append(changes, [2]string{
+				FormatDecimal(price), FormatDecimal(quantity)})
+		}
+	}
+	for price := range previous {
+		if _, ok := current[price]; !ok {
+			changes = append(changes, [2]string{FormatDecimal(price), "0"})
+		}
+	}
+	return changes
+}
@@ -0,0 +1,99 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package depth
+
+type BookMetrics struct {
+	Symbol string `json:"symbol"`
+
+	BestBid float64 `json:"best_bid"`
+	BestAsk float64 `json:"best_ask"`
+
+	// The spread between the best ask and best bid, and as a percentage of
+	// the mid price.
+	Spread        float64 `json:"spread"`
+	SpreadPercent float64 `json:"spread_pct"`
+
+	// The quote volume of the top N levels of each side.
+	BidDepth float64 `json:"bid_depth"`
+	AskDepth float64 `json:"ask_depth"`
+
+	// (bid depth - ask depth) / (bid depth + ask depth), ranging from -1
+	// (all asks) to 1 (all bids).
+	Imbalance float64 `json:"imbalance"`
+
+	// Levels within the top N whose quote volume is at least the wall factor
+	// times the average level.
+	BidWalls []Level `json:"bid_walls"`
+	AskWalls []Level `json:"ask_walls"`
+}
+
+// CalculateMetrics calculates the book metrics over the top levels of each
+// side of the book.
+func CalculateMetrics(book *Book, levels int, wallFactor float64) BookMetrics {
+	bids := book.Bids(levels)
+	asks := book.Asks(levels)
+
+	metrics := BookMetrics{
+		Symbol:   book.Symbol,
+		BidWalls: []Level{},
+		AskWalls: []Level{},
+	}
+
+	if len(bids) > 0 {
+		metrics.BestBid = bids[0].Price
+	}
+	if len(asks) > 0 {
+		metrics.BestAsk = asks[0].Price
+	}
+	if metrics.BestBid > 0 && metrics.BestAsk > 0 {
+		metrics.Spread = metrics.BestAsk - metrics.BestBid
+		mid := (metrics.BestAsk + metrics.BestBid) / 2
+		metrics.SpreadPercent = metrics.Spread / mid * 100
+	}
+
+	metrics.BidDepth = quoteVolume(bids)
+	metrics.AskDepth = quoteVolume(asks)
+	if total := metrics.BidDepth + metrics.AskDepth; total > 0 {
+		metrics.Imbalance = (metrics.BidDepth - metrics.AskDepth) / total
+	}
+
+	metrics.BidWalls = findWalls(bids, metrics.BidDepth, wallFactor)
+	metrics.AskWalls = findWalls(asks, metrics.AskDepth, wallFactor)
+
+	return metrics
+}
+
+func quoteVolume(levels []Level) float64 {
+	volume := float64(0)
+	for _, level := range levels {
+		volume += level.Price * level.Quantity
+	}
+	return volume
+}
+
+func findWalls(levels []Level, depth float64, wallFactor float64) []Level {
+	walls := []Level{}
+	if len(levels) == 0 || wallFactor <= 0 {
+		return walls
+	}
+	average := depth / float64(len(levels))
+	for _, level := range levels {
+		if level.Price*level.Quantity >= average*wallFactor {
+			walls = append(walls, level)
+		}
+	}
+	return walls
+}
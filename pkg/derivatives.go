@@ -0,0 +1,111 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"context"
+	"time"
+)
+
+// The type of market an exchange provides.
+type Market string
+
+const (
+	MarketSpot    Market = "spot"
+	MarketFutures Market = "futures"
+)
+
+// FuturesExchange is implemented, in addition to Exchange, by futures
+// markets.
+type FuturesExchange interface {
+	// Derivatives returns the latest derivatives data of symbol.
+	Derivatives(symbol string) (DerivativesInfo, bool)
+
+	// AllDerivatives returns the latest derivatives data of every symbol.
+	AllDerivatives() []DerivativesInfo
+
+	// AddLiquidationSink registers a sink to receive every Liquidation.
+	AddLiquidationSink(sink Sink)
+
+	// RunDerivatives streams mark prices and liquidations, and polls
+	// funding rates and open interest, until ctx is cancelled.
+	RunDerivatives(ctx context.Context)
+}
+
+// DerivativesInfo is the state of a perpetual futures contract beyond its
+// trades and tickers.
+type DerivativesInfo struct {
+	Symbol string `json:"symbol"`
+
+	MarkPrice  float64 `json:"mark_price"`
+	IndexPrice float64 `json:"index_price"`
+
+	// The funding rate of the current period, paid by longs to shorts if
+	// positive, and when it is next paid.
+	FundingRate     float64   `json:"funding_rate"`
+	NextFundingTime time.Time `json:"next_funding_time"`
+
+	// Open interest in contracts, the base asset for USD-M futures, and
+	// when it was last polled.
+	OpenInterest     float64   `json:"open_interest"`
+	OpenInterestTime time.Time `json:"open_interest_time"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// OpenInterestValue returns the open interest in the quote asset at the
+// mark price.
+func (d DerivativesInfo) OpenInterestValue() float64 {
+	return d.OpenInterest * d.MarkPrice
+}
+
+// Metrics returns the values added to ticker updates. Funding is given as
+// a percentage.
+func (d DerivativesInfo) Metrics() map[string]interface{} {
+	return map[string]interface{}{
+		"mark_price":          d.MarkPrice,
+		"index_price":         d.IndexPrice,
+		"funding_rate_pct":    d.FundingRate * 100,
+		"next_funding_time":   d.NextFundingTime,
+		"open_interest":       d.OpenInterest,
+		"open_interest_value": d.OpenInterestValue(),
+	}
+}
+
+// Liquidation is a forced order of a futures market closing a position.
+// A sell liquidates a long position and a buy a short.
+type Liquidation struct {
+	Symbol    string    `json:"symbol"`
+	Side      string    `json:"side"`
+	Price     float64   `json:"price"`
+	AvgPrice  float64   `json:"avg_price"`
+	Quantity  float64   `json:"quantity"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// FilledPrice returns the average fill price of the liquidation, or the
+// order price if the average is not known.
+func (l Liquidation) FilledPrice() float64 {
+	if l.AvgPrice == 0 {
+		return l.Price
+	}
+	return l.AvgPrice
+}
+
+// Value returns the filled value of the liquidation in the quote asset.
+func (l Liquidation) Value() float64 {
+	return l.FilledPrice() * l.Quantity
+}
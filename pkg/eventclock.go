@@ -0,0 +1,82 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/metrics"
+	"sync"
+	"time"
+)
+
+func init() {
+	metrics.Describe("events_late_total",
+		"Messages dropped from the metrics for arriving later than the allowed lateness.")
+}
+
+// The default time a message may arrive behind the latest exchange time and
+// still be included in the metrics. It covers the longest ticker metric
+// window, so backfilled trades are not dropped.
+const DefaultAllowedLateness = time.Hour
+
+// EventClock tracks the event time of an exchange: the latest exchange
+// timestamp seen, which never goes backwards. Metric windows are assigned by
+// event time rather than the time messages arrive so replayed, backfilled
+// and delayed messages produce the same values as live processing.
+type EventClock struct {
+	lateness time.Duration
+	latest   time.Time
+	lock     sync.RWMutex
+	late     *metrics.Counter
+}
+
+func NewEventClock(name string, lateness time.Duration) *EventClock {
+	return &EventClock{
+		lateness: lateness,
+		late:     metrics.GetCounter("events_late_total", metrics.Labels{"exchange": name}),
+	}
+}
+
+// Observe advances the clock to timestamp if it is later. Returns false if
+// timestamp is more than the allowed lateness behind the clock, in which
+// case the message should be dropped.
+func (c *EventClock) Observe(timestamp time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if timestamp.After(c.latest) {
+		c.latest = timestamp
+		return true
+	}
+	if c.latest.Sub(timestamp) > c.lateness {
+		c.late.Inc()
+		return false
+	}
+	return true
+}
+
+// Now returns the event time, or the wall clock time if no messages have
+// been seen.
+func (c *EventClock) Now() time.Time {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.latest.IsZero() {
+		return time.Now()
+	}
+	return c.latest
+}
+
+func (c *EventClock) Lateness() time.Duration {
+	return c.lateness
+}
@@ -0,0 +1,465 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package events
+
+import (
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/activity"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/anomaly"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/candles"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/liquidation"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/whale"
+	"sync"
+	"time"
+)
+
+type DetectorOptions struct {
+	// Trades, and bursts of trades, with a large USD value.
+	Whale whale.Config
+
+	// Large liquidations, and cascades of liquidations, of futures markets.
+	Liquidation liquidation.Config
+
+	// A closed 1 minute candle is a volume spike if its quote volume scores
+	// at least the threshold against the baseline of the previous candles.
+	// A threshold of 0 disables volume spikes.
+	VolumeSpike anomaly.Config
+
+	// A minute is an activity surge if its trades or quote volume score at
+	// least the threshold against the previous minutes. Unlike volume
+	// spikes it is checked as soon as the next minute starts, from the
+	// trades rather than the candles.
+	ActivitySurge activity.Config
+
+	// A level break is a 1 minute close above the high, or below the low,
+	// of this many previous candles.
+	LevelBreakWindow int
+}
+
+var DefaultDetectorOptions = DetectorOptions{
+	Whale:            whale.DefaultConfig,
+	Liquidation:      liquidation.DefaultConfig,
+	VolumeSpike:      anomaly.DefaultConfig,
+	ActivitySurge:    activity.DefaultConfig,
+	LevelBreakWindow: 60,
+}
+
+// Detector generates events for an exchange from its trades and closed
+// candles. It is registered as a sink on both the trade stream and the
+// candle builder.
+type Detector struct {
+	exchange string
+	store    *Store
+	candles  *candles.Builder
+	rates    func() *pkg.ConversionRates
+	options  DetectorOptions
+
+	// Baseline for volume spikes, nil if disabled.
+	volumeBaseline *anomaly.Baseline
+
+	whales       *whale.Detector
+	liquidations *liquidation.Tracker
+	activity     *activity.Tracker
+
+	// Returns false for symbols that should not be checked, nil to check
+	// all symbols.
+	include func(symbol string) bool
+
+	// Symbols seen so far, by CheckListings or refreshes of the symbols of
+	// the exchange. The first call to CheckListings only records the
+	// symbols.
+	symbols        map[string]bool
+	listingsSeeded bool
+	symbolsLock    sync.Mutex
+}
+
+func NewDetector(exchange string, store *Store, builder *candles.Builder,
+	rates func() *pkg.ConversionRates, options DetectorOptions) *Detector {
+	detector := &Detector{
+		exchange: exchange,
+		store:    store,
+		candles:  builder,
+		rates:    rates,
+		symbols:  map[string]bool{},
+	}
+	if err := detector.SetOptions(options); err != nil {
+		log.Printf("error: %s: volume spikes disabled: %v\n", exchange, err)
+	}
+	return detector
+}
+
+// SetOptions replaces the options. Must be called before any trades or
+// candles are sent. On error the volume spike baseline, activity surges,
+// whale detection, or liquidation events, are disabled.
+func (d *Detector) SetOptions(options DetectorOptions) error {
+	d.options = options
+	d.volumeBaseline = nil
+	d.activity, _ = activity.NewTracker(activity.Config{})
+	if err := options.Liquidation.Validate(); err != nil {
+		d.liquidations = liquidation.NewTracker(liquidation.Config{})
+		d.whales = whale.NewDetector(whale.Config{})
+		return err
+	}
+	d.liquidations = liquidation.NewTracker(options.Liquidation)
+	if err := options.Whale.Validate(); err != nil {
+		d.whales = whale.NewDetector(whale.Config{})
+		return err
+	}
+	d.whales = whale.NewDetector(options.Whale)
+	tracker, err := activity.NewTracker(options.ActivitySurge)
+	if err != nil {
+		return err
+	}
+	d.activity = tracker
+	if options.VolumeSpike.Threshold <= 0 {
+		return nil
+	}
+	baseline, err := anomaly.New(options.VolumeSpike)
+	if err != nil {
+		return err
+	}
+	d.volumeBaseline = baseline
+	return nil
+}
+
+// SetFilter limits detection to the symbols include returns true for. Must
+// be called before any trades or candles are sent.
+func (d *Detector) SetFilter(include func(symbol string) bool) {
+	d.include = include
+}
+
+// Whales returns the whale detector, for the whale flow of each symbol.
+func (d *Detector) Whales() *whale.Detector {
+	return d.whales
+}
+
+// Liquidations returns the liquidation tracker, for the liquidation volume
+// of each symbol of futures markets.
+func (d *Detector) Liquidations() *liquidation.Tracker {
+	return d.liquidations
+}
+
+func (d *Detector) Options() DetectorOptions {
+	return d.options
+}
+
+func (d *Detector) Name() string {
+	return "events"
+}
+
+// Send implements pkg.Sink for trades, closed candles and liquidations.
+func (d *Detector) Send(message interface{}) error {
+	switch message := message.(type) {
+	case pkg.CommonTrade:
+		if d.include != nil && !d.include(message.Symbol) {
+			return nil
+		}
+		d.checkActivity(message)
+		d.checkTrade(message)
+	case candles.Candle:
+		if d.include != nil && !d.include(message.Symbol) {
+			return nil
+		}
+		if message.Interval == time.Minute {
+			d.checkCandle(message)
+		}
+	case pkg.Liquidation:
+		if d.include != nil && !d.include(message.Symbol) {
+			return nil
+		}
+		d.checkLiquidation(message)
+	default:
+		return fmt.Errorf("unexpected message type %T", message)
+	}
+	return nil
+}
+
+// CheckListings records the current symbols of the exchange, adding a
+// listing event for each symbol not seen before. The first call only records
+// the symbols.
+func (d *Detector) CheckListings(symbols []string) {
+	d.symbolsLock.Lock()
+	defer d.symbolsLock.Unlock()
+	if !d.listingsSeeded {
+		for _, symbol := range symbols {
+			d.symbols[symbol] = true
+		}
+		d.listingsSeeded = true
+		return
+	}
+	for _, symbol := range symbols {
+		d.addListing(symbol)
+	}
+}
+
+// AddListing adds a listing event for a symbol found by a refresh of the
+// symbols of the exchange, unless it has already been seen. Returns true if
+// the event was added.
+func (d *Detector) AddListing(symbol string) bool {
+	d.symbolsLock.Lock()
+	defer d.symbolsLock.Unlock()
+	return d.addListing(symbol)
+}
+
+func (d *Detector) addListing(symbol string) bool {
+	if d.symbols[symbol] {
+		return false
+	}
+	d.symbols[symbol] = true
+	d.store.Add(Event{
+		Type:      TypeListing,
+		Exchange:  d.exchange,
+		Symbol:    symbol,
+		Timestamp: time.Now(),
+		Message:   fmt.Sprintf("%s listed", symbol),
+	})
+	return true
+}
+
+// AddDelisting adds a delisting event for a symbol no longer in the symbols
+// of the exchange. The symbol is forgotten so a relisting is reported.
+func (d *Detector) AddDelisting(symbol string) {
+	d.symbolsLock.Lock()
+	delete(d.symbols, symbol)
+	d.symbolsLock.Unlock()
+	d.store.Add(Event{
+		Type:      TypeDelisting,
+		Exchange:  d.exchange,
+		Symbol:    symbol,
+		Timestamp: time.Now(),
+		Message:   fmt.Sprintf("%s delisted", symbol),
+	})
+}
+
+func (d *Detector) checkTrade(trade pkg.CommonTrade) {
+	if d.whales.Config().Threshold(trade.Symbol) <= 0 {
+		return
+	}
+	_, quote, ok := pkg.SplitSymbol(trade.Symbol)
+	if !ok {
+		return
+	}
+	rate, ok := d.rates().Rate(quote, "USD")
+	if !ok {
+		return
+	}
+	whale, ok := d.whales.Check(trade, rate)
+	if !ok {
+		return
+	}
+	message := fmt.Sprintf("%s whale %s of $%.0f", trade.Symbol, whale.Side, whale.Usd)
+	if whale.Burst {
+		message = fmt.Sprintf("%s whale %s burst of $%.0f in %d trades", trade.Symbol,
+			whale.Side, whale.Usd, whale.Trades)
+	}
+	d.store.Add(Event{
+		Type:      TypeWhaleTrade,
+		Exchange:  d.exchange,
+		Symbol:    trade.Symbol,
+		Timestamp: whale.Timestamp,
+		Message:   message,
+		Data: map[string]interface{}{
+			"side":     whale.Side,
+			"price":    whale.Price,
+			"quantity": whale.Quantity,
+			"usd":      whale.Usd,
+			"trades":   whale.Trades,
+			"burst":    whale.Burst,
+		},
+	})
+}
+
+// checkActivity adds a trade to the activity of its symbol, adding an event
+// if it completes a minute of anomalous activity.
+func (d *Detector) checkActivity(trade pkg.CommonTrade) {
+	surge, ok := d.activity.Add(trade)
+	if !ok {
+		return
+	}
+	d.store.Add(Event{
+		Type:      TypeActivitySurge,
+		Exchange:  d.exchange,
+		Symbol:    surge.Symbol,
+		Timestamp: surge.Timestamp,
+		Message: fmt.Sprintf("%s activity surge: %d trades and %.0f volume in a minute, expected %.0f and %.0f",
+			surge.Symbol, surge.Trades, surge.QuoteVolume, surge.TradesBaseline,
+			surge.VolumeBaseline),
+		Data: map[string]interface{}{
+			"trades":          surge.Trades,
+			"quote_volume":    pkg.Round8(surge.QuoteVolume),
+			"trades_baseline": pkg.Round3(surge.TradesBaseline),
+			"volume_baseline": pkg.Round8(surge.VolumeBaseline),
+			"trades_score":    pkg.Round3(surge.TradesScore),
+			"volume_score":    pkg.Round3(surge.VolumeScore),
+			"model":           d.activity.Config().Model,
+		},
+	})
+}
+
+// checkLiquidation records a liquidation, adding an event if it is large or
+// completes a cascade.
+func (d *Detector) checkLiquidation(l pkg.Liquidation) {
+	_, quote, ok := pkg.SplitSymbol(l.Symbol)
+	if !ok {
+		return
+	}
+	rate, ok := d.rates().Rate(quote, "USD")
+	if !ok {
+		return
+	}
+	liquidation, cascade, ok := d.liquidations.Add(l, rate)
+
+	threshold := d.liquidations.Config().ThresholdUsd
+	if threshold > 0 && liquidation.Usd >= threshold {
+		d.store.Add(Event{
+			Type:      TypeLiquidation,
+			Exchange:  d.exchange,
+			Symbol:    l.Symbol,
+			Timestamp: l.Timestamp,
+			Message: fmt.Sprintf("%s %s liquidation of $%.0f", l.Symbol,
+				liquidation.Position(), liquidation.Usd),
+			Data: map[string]interface{}{
+				"position": liquidation.Position(),
+				"price":    liquidation.Price,
+				"quantity": liquidation.Quantity,
+				"usd":      liquidation.Usd,
+			},
+		})
+	}
+
+	if !ok {
+		return
+	}
+	d.store.Add(Event{
+		Type:      TypeLiquidationCascade,
+		Exchange:  d.exchange,
+		Symbol:    l.Symbol,
+		Timestamp: l.Timestamp,
+		Message: fmt.Sprintf("%s liquidation cascade of $%.0f in %v, mostly %ss",
+			l.Symbol, cascade.Volume.TotalUsd, cascade.Window, cascade.Volume.Dominant()),
+		Data: map[string]interface{}{
+			"window":    cascade.Window.String(),
+			"position":  cascade.Volume.Dominant(),
+			"longs":     cascade.Volume.Longs,
+			"shorts":    cascade.Volume.Shorts,
+			"long_usd":  cascade.Volume.LongUsd,
+			"short_usd": cascade.Volume.ShortUsd,
+			"total_usd": cascade.Volume.TotalUsd,
+		},
+	})
+}
+
+// previousCandles returns up to count closed 1 minute candles before candle.
+func (d *Detector) previousCandles(candle candles.Candle, count int) []candles.Candle {
+	previous := []candles.Candle{}
+	for _, c := range d.candles.Get(candle.Symbol, time.Minute, 0) {
+		if c.Closed && c.OpenTime.Before(candle.OpenTime) {
+			previous = append(previous, c)
+		}
+	}
+	if len(previous) > count {
+		previous = previous[len(previous)-count:]
+	}
+	return previous
+}
+
+func (d *Detector) checkVolumeSpike(candle candles.Candle, previous []candles.Candle) {
+	history := make([]float64, len(previous))
+	for i, c := range previous {
+		history[i] = c.QuoteVolume
+	}
+	result, ok := d.volumeBaseline.Score(history, candle.QuoteVolume)
+	if !ok || !d.volumeBaseline.Anomalous(result) {
+		return
+	}
+	// The factor is kept for every model so spikes can be ranked the same
+	// way regardless of the model used.
+	factor := float64(0)
+	if result.Baseline > 0 {
+		factor = candle.QuoteVolume / result.Baseline
+	}
+	d.store.Add(Event{
+		Type:      TypeVolumeSpike,
+		Exchange:  d.exchange,
+		Symbol:    candle.Symbol,
+		Timestamp: candle.OpenTime,
+		Message: fmt.Sprintf("%s volume %s", candle.Symbol,
+			d.volumeBaseline.Describe(result)),
+		Data: map[string]interface{}{
+			"quote_volume": pkg.Round8(candle.QuoteVolume),
+			"baseline":     pkg.Round8(result.Baseline),
+			"factor":       pkg.Round3(factor),
+			"score":        pkg.Round3(result.Score),
+			"model":        d.volumeBaseline.Model,
+		},
+	})
+}
+
+func (d *Detector) checkCandle(candle candles.Candle) {
+	window := d.options.LevelBreakWindow
+	if d.volumeBaseline != nil && d.volumeBaseline.Window > window {
+		window = d.volumeBaseline.Window
+	}
+	previous := d.previousCandles(candle, window)
+
+	if d.volumeBaseline != nil {
+		d.checkVolumeSpike(candle, previous)
+	}
+
+	if d.options.LevelBreakWindow > 0 && len(previous) >= d.options.LevelBreakWindow {
+		recent := previous[len(previous)-d.options.LevelBreakWindow:]
+		high := recent[0].High
+		low := recent[0].Low
+		for _, c := range recent {
+			if c.High > high {
+				high = c.High
+			}
+			if c.Low < low {
+				low = c.Low
+			}
+		}
+
+		// Only the candle that breaks the level generates an event, not
+		// those that continue beyond it.
+		lastClose := recent[len(recent)-1].Close
+		direction := ""
+		level := float64(0)
+		if candle.Close > high && lastClose <= high {
+			direction = "up"
+			level = high
+		} else if candle.Close < low && lastClose >= low {
+			direction = "down"
+			level = low
+		}
+		if direction != "" {
+			d.store.Add(Event{
+				Type:      TypeLevelBreak,
+				Exchange:  d.exchange,
+				Symbol:    candle.Symbol,
+				Timestamp: candle.OpenTime,
+				Message: fmt.Sprintf("%s broke %s through the %d minute level %v",
+					candle.Symbol, direction, len(recent), level),
+				Data: map[string]interface{}{
+					"direction": direction,
+					"level":     level,
+					"close":     candle.Close,
+				},
+			})
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package events
+
+import (
+	"context"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RulesWatcher polls the trading rules of an exchange, adding a rule change
+// event for each symbol whose rules changed since the last poll. Symbols
+// that are new or no longer listed are left to the listing events.
+type RulesWatcher struct {
+	exchange string
+	source   pkg.TradingRulesExchange
+	store    *Store
+
+	// Symbols excluded by the filter are not checked.
+	include func(symbol string) bool
+
+	// Called with each change of the status of a symbol, nil if not set.
+	onStatus func(change pkg.SymbolStatusChange)
+
+	rules map[string]pkg.TradingRules
+	lock  sync.RWMutex
+}
+
+func NewRulesWatcher(exchange string, source pkg.TradingRulesExchange, store *Store,
+	include func(symbol string) bool) *RulesWatcher {
+	return &RulesWatcher{
+		exchange: exchange,
+		source:   source,
+		store:    store,
+		include:  include,
+	}
+}
+
+// Rules returns the last polled rules of symbol.
+func (w *RulesWatcher) Rules(symbol string) (pkg.TradingRules, bool) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	rules, ok := w.rules[symbol]
+	return rules, ok
+}
+
+// OnStatusChange sets the function called with each change of the trading
+// status of a symbol. Must be called before Run.
+func (w *RulesWatcher) OnStatusChange(fn func(change pkg.SymbolStatusChange)) {
+	w.onStatus = fn
+}
+
+// Status returns the last polled trading status of symbol, unknown if the
+// rules have not been polled.
+func (w *RulesWatcher) Status(symbol string) pkg.SymbolStatus {
+	rules, ok := w.Rules(symbol)
+	if !ok {
+		return pkg.SymbolUnknown
+	}
+	return rules.SymbolStatus()
+}
+
+// Statuses returns the last polled trading status of every symbol.
+func (w *RulesWatcher) Statuses() map[string]pkg.SymbolStatus {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	statuses := make(map[string]pkg.SymbolStatus, len(w.rules))
+	for symbol, rules := range w.rules {
+		statuses[symbol] = rules.SymbolStatus()
+	}
+	return statuses
+}
+
+// Run polls the rules every interval until ctx is cancelled.
+func (w *RulesWatcher) Run(ctx context.Context, interval time.Duration) {
+	for {
+		if err := w.Poll(); err != nil {
+			log.Printf("error: %s: failed to poll trading rules: %v\n", w.exchange, err)
+		}
+		if !pkg.Sleep(ctx, interval) {
+			return
+		}
+	}
+}
+
+// Poll fetches the current rules and adds an event for each change. The
+// first poll only records the rules.
+func (w *RulesWatcher) Poll() error {
+	current, err := w.source.GetTradingRules()
+	if err != nil {
+		return err
+	}
+
+	w.lock.Lock()
+	previous := w.rules
+	w.rules = current
+	w.lock.Unlock()
+
+	if previous == nil {
+		return nil
+	}
+	now := time.Now()
+	for symbol, rules := range current {
+		last, ok := previous[symbol]
+		if !ok || (w.include != nil && !w.include(symbol)) {
+			continue
+		}
+		changes := rules.Diff(last)
+		if len(changes) == 0 {
+			continue
+		}
+		w.store.Add(newRuleChangeEvent(w.exchange, rules, last, changes, now))
+		if status := rules.SymbolStatus(); status != last.SymbolStatus() && w.onStatus != nil {
+			w.onStatus(pkg.SymbolStatusChange{
+				Exchange:       w.exchange,
+				Symbol:         symbol,
+				Status:         status,
+				Previous:       last.SymbolStatus(),
+				ExchangeStatus: rules.Status,
+				Timestamp:      now,
+			})
+		}
+	}
+	return nil
+}
+
+func newRuleChangeEvent(exchange string, rules pkg.TradingRules, previous pkg.TradingRules,
+	changes []pkg.RuleChange, now time.Time) Event {
+	descriptions := []string{}
+	for _, change := range changes {
+		descriptions = append(descriptions, change.String())
+	}
+	message := fmt.Sprintf("%s trading rules changed: %s", rules.Symbol,
+		strings.Join(descriptions, ", "))
+	if rules.Halted() && !previous.Halted() {
+		message = fmt.Sprintf("%s trading halted: status %s", rules.Symbol, rules.Status)
+	} else if previous.Halted() && !rules.Halted() {
+		message = fmt.Sprintf("%s trading resumed: status %s", rules.Symbol, rules.Status)
+	}
+	return Event{
+		Type:      TypeRuleChange,
+		Exchange:  exchange,
+		Symbol:    rules.Symbol,
+		Timestamp: now,
+		Message:   message,
+		Data: map[string]interface{}{
+			"changes": changes,
+			"status":  rules.Status,
+			"halted":  rules.Halted(),
+		},
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package events
+
+import (
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TypeVolumeSpike = "volume_spike"
+	TypeWhaleTrade  = "whale_trade"
+	TypeListing     = "listing"
+	TypeDelisting   = "delisting"
+	TypeLevelBreak  = "level_break"
+	TypeRuleChange  = "rule_change"
+
+	// A minute with anomalous trades or quote volume.
+	TypeActivitySurge = "activity_surge"
+
+	// Futures markets only.
+	TypeLiquidation        = "liquidation"
+	TypeLiquidationCascade = "liquidation_cascade"
+
+	// The price of a pair differed across exchanges by more than the
+	// spread threshold.
+	TypeSpread = "spread"
+
+	// An exchange's share of the volume of an asset across exchanges
+	// shifted abruptly.
+	TypeVolumeShare = "volume_share"
+
+	// The first trade of a symbol watched for its listing. Raised with
+	// high priority.
+	TypeListingLive = "listing_live"
+
+	// A user defined alert fired.
+	TypeAlert = "alert"
+)
+
+// Set to true in the data of events that would have been alerted had dry
+// run not been enabled.
+const DryRunField = "dry_run"
+
+// The maximum number of events kept per symbol regardless of age.
+const maxEventsPerSymbol = 1000
+
+type Event struct {
+	Type      string                 `json:"type"`
+	Exchange  string                 `json:"exchange"`
+	Symbol    string                 `json:"symbol"`
+	Timestamp time.Time              `json:"timestamp"`
+	Message   string                 `json:"message"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+// Store keeps recent events per symbol in time order and fans out each new
+// event to its sinks.
+type Store struct {
+	retention time.Duration
+	events    map[string][]Event
+	lock      sync.RWMutex
+	topic     *pkg.Topic
+
+	// Nil allows all events.
+	include func(event Event) bool
+}
+
+func NewStore(retention time.Duration) *Store {
+	return &Store{
+		retention: retention,
+		events:    map[string][]Event{},
+		topic:     pkg.DefaultBus.NewTopic("events", Event{}),
+	}
+}
+
+// Retention returns how long events are kept.
+func (s *Store) Retention() time.Duration {
+	return s.retention
+}
+
+func storeKey(exchange string, symbol string) string {
+	return fmt.Sprintf("%s:%s", strings.ToLower(exchange), strings.ToUpper(symbol))
+}
+
+// SetFilter limits the events added to those include returns true for.
+// Must be called before any events are added.
+func (s *Store) SetFilter(include func(event Event) bool) {
+	s.include = include
+}
+
+// AddSink registers a sink to receive every new event.
+func (s *Store) AddSink(sink pkg.Sink) {
+	s.topic.AddSink(sink)
+}
+
+// Close stops fanning out new events, for stores that are discarded.
+func (s *Store) Close() {
+	s.topic.Close()
+}
+
+func (s *Store) Add(event Event) {
+	if s.include != nil && !s.include(event) {
+		return
+	}
+	key := storeKey(event.Exchange, event.Symbol)
+
+	s.lock.Lock()
+	events := s.events[key]
+
+	// Events are usually added in order, but backfilled trades may produce
+	// events older than the last one.
+	i := sort.Search(len(events), func(i int) bool {
+		return events[i].Timestamp.After(event.Timestamp)
+	})
+	events = append(events, Event{})
+	copy(events[i+1:], events[i:])
+	events[i] = event
+
+	cutoff := time.Now().Add(-s.retention)
+	start := sort.Search(len(events), func(i int) bool {
+		return !events[i].Timestamp.Before(cutoff)
+	})
+	if len(events)-start > maxEventsPerSymbol {
+		start = len(events) - maxEventsPerSymbol
+	}
+	s.events[key] = events[start:]
+	s.lock.Unlock()
+
+	s.topic.Publish(event)
+}
+
+// Query returns the events for a symbol in the range [from, to), oldest
+// first.
+func (s *Store) Query(exchange string, symbol string, from time.Time, to time.Time) []Event {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	result := []Event{}
+	for _, event := range s.events[storeKey(exchange, symbol)] {
+		if event.Timestamp.Before(from) || !event.Timestamp.Before(to) {
+			continue
+		}
+		result = append(result, event)
+	}
+	return result
+}
+
+// Since returns the events of all symbols on an exchange at or after since,
+// oldest first. An empty exchange returns events for all exchanges.
+func (s *Store) Since(exchange string, since time.Time) []Event {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	prefix := strings.ToLower(exchange) + ":"
+	result := []Event{}
+	for key, events := range s.events {
+		if exchange != "" && !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		for _, event := range events {
+			if !event.Timestamp.Before(since) {
+				result = append(result, event)
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Timestamp.Before(result[j].Timestamp)
+	})
+	return result
+}
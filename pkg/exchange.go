@@ -0,0 +1,171 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"context"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/depth"
+)
+
+// Exchange is implemented by each supported exchange. Everything above the
+// exchange, such as the trackers, fan-out and websocket API, only deals with
+// the common trade and ticker models.
+type Exchange interface {
+	// The lowercase name of the exchange, used in logging, cache keys and
+	// URL paths.
+	Name() string
+
+	// The type of market, futures exchanges also implement
+	// FuturesExchange.
+	Market() Market
+
+	// GetSymbols returns all currently trading symbols in the exchange's
+	// own format.
+	GetSymbols() ([]string, error)
+
+	TradeStream() TradeStream
+	TickerStream() TickerStream
+
+	// DepthStream returns nil if the exchange does not support order book
+	// streams.
+	DepthStream() DepthStream
+}
+
+type TradeStream interface {
+	// Subscribe returns a channel of trades queued as per options. If the
+	// subscriber is disconnected for being too slow the channel is closed.
+	Subscribe(name string, options QueueOptions) chan CommonTrade
+	Unsubscribe(channel chan CommonTrade)
+	AddSink(sink Sink)
+
+	// SetSymbolFilter restricts the symbols subscribed to and published.
+	// Must be called before Run.
+	SetSymbolFilter(filter *SymbolFilter)
+
+	// SetDedupWindow sets the number of trade IDs remembered per symbol to
+	// drop duplicate trades, 0 to disable. Must be called before Run.
+	SetDedupWindow(size int)
+
+	// DecodePool returns the pool raw messages are decoded on. It can be
+	// resized while running. Streams that decode inline, such as sources
+	// and replays, leave it idle.
+	DecodePool() *DecodePool
+
+	// Run restores any cached trades then streams live trades until ctx is
+	// cancelled.
+	Run(ctx context.Context)
+}
+
+// SymbolRefresher is implemented by trade streams that can subscribe to
+// newly listed symbols as soon as asked, rather than on their next periodic
+// refresh or reconnect.
+type SymbolRefresher interface {
+	// RefreshSymbols requests that the symbols are fetched again and any
+	// new ones subscribed to. It does not block.
+	RefreshSymbols()
+}
+
+type TickerStream interface {
+	// ReplayCache calls cb with each set of cached tickers, oldest first.
+	ReplayCache(cb func(tickers []CommonTicker))
+
+	// Run sends each new set of tickers to channel until ctx is cancelled.
+	Run(ctx context.Context, channel chan []CommonTicker)
+}
+
+type DepthStream interface {
+	Subscribe(symbol string) chan *depth.Book
+	Unsubscribe(symbol string, channel chan *depth.Book)
+	Run(ctx context.Context)
+}
+
+// TradePublisher implements the subscription side of a TradeStream and is
+// meant to be embedded by the exchange specific trade streams.
+type TradePublisher struct {
+	name  string
+	topic *Topic
+
+	// Trades of symbols not allowed by the filter are dropped.
+	filter *SymbolFilter
+
+	// Trades already published are dropped.
+	dedup *TradeDedup
+
+	// Decodes the raw messages of the exchange streams.
+	decoders *DecodePool
+}
+
+func NewTradePublisher(name string) *TradePublisher {
+	return &TradePublisher{
+		name:     name,
+		topic:    DefaultBus.NewTopic(name, CommonTrade{}),
+		dedup:    NewTradeDedup(name, DefaultDedupWindow),
+		decoders: NewDecodePool(name + ".decode"),
+	}
+}
+
+// Name returns the name of the stream, such as binance.trades.
+func (p *TradePublisher) Name() string {
+	return p.name
+}
+
+func (p *TradePublisher) Subscribe(name string, options QueueOptions) chan CommonTrade {
+	return p.topic.Subscribe(name, options).(chan CommonTrade)
+}
+
+// Unsubscribe removes the subscriber and closes its channel.
+func (p *TradePublisher) Unsubscribe(channel chan CommonTrade) {
+	p.topic.Unsubscribe(channel)
+}
+
+// AddSink registers an additional sink, such as a message queue publisher,
+// to receive every published trade.
+func (p *TradePublisher) AddSink(sink Sink) {
+	p.topic.AddSink(sink)
+}
+
+// SetSymbolFilter drops the trades of symbols not allowed by filter. The
+// exchange trade streams also use the filter to limit their subscriptions.
+func (p *TradePublisher) SetSymbolFilter(filter *SymbolFilter) {
+	p.filter = filter
+}
+
+// SymbolFilter returns the symbol filter, nil if all symbols are allowed.
+func (p *TradePublisher) SymbolFilter() *SymbolFilter {
+	return p.filter
+}
+
+// DecodePool returns the pool the exchange trade streams decode their raw
+// messages on.
+func (p *TradePublisher) DecodePool() *DecodePool {
+	return p.decoders
+}
+
+// SetDedupWindow sets the number of trade IDs remembered per symbol to drop
+// duplicate trades, 0 to disable.
+func (p *TradePublisher) SetDedupWindow(size int) {
+	p.dedup = NewTradeDedup(p.name, size)
+}
+
+func (p *TradePublisher) Publish(trade CommonTrade) {
+	if !p.filter.Allow(trade.Symbol) {
+		return
+	}
+	if p.dedup.Duplicate(&trade) {
+		return
+	}
+	p.topic.Publish(trade)
+}
@@ -0,0 +1,179 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package fix
+
+import (
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"strconv"
+	"time"
+)
+
+// MDEntryType values.
+const (
+	MDEntryTypeBid   = "0"
+	MDEntryTypeOffer = "1"
+	MDEntryTypeTrade = "2"
+)
+
+// MDUpdateAction values.
+const (
+	MDUpdateActionNew = "0"
+)
+
+// SubscriptionRequestType values.
+const (
+	SubscriptionSnapshotAndUpdates = "1"
+	SubscriptionUnsubscribe        = "2"
+)
+
+// Side values, used on trade entries for the aggressor side.
+const (
+	SideBuy  = "1"
+	SideSell = "2"
+)
+
+const (
+	entryDateFormat = "20060102"
+	entryTimeFormat = "15:04:05.000"
+)
+
+// NewTradeRequest builds a MarketDataRequest subscribing to trades for
+// symbols with incremental updates.
+func NewTradeRequest(reqId string, symbols []string) *Message {
+	message := NewMessage(MsgTypeMarketDataRequest).
+		Add(TagMDReqID, reqId).
+		Add(TagSubscriptionType, SubscriptionSnapshotAndUpdates).
+		AddInt(TagMarketDepth, 0).
+		AddInt(TagMDUpdateType, 1).
+		AddInt(TagNoMDEntryTypes, 1).
+		Add(TagMDEntryType, MDEntryTypeTrade).
+		AddInt(TagNoRelatedSym, len(symbols))
+	for _, symbol := range symbols {
+		message.Add(TagSymbol, symbol)
+	}
+	return message
+}
+
+// NewTradeSnapshot builds a MarketDataSnapshotFullRefresh holding the last
+// trade for a symbol.
+func NewTradeSnapshot(reqId string, trade pkg.CommonTrade) *Message {
+	message := NewMessage(MsgTypeMarketDataSnapshot).
+		Add(TagMDReqID, reqId).
+		Add(TagSymbol, trade.Symbol).
+		AddInt(TagNoMDEntries, 1)
+	addTradeEntry(message, trade)
+	return message
+}
+
+// NewTradeIncrement builds a MarketDataIncrementalRefresh with a new trade.
+func NewTradeIncrement(reqId string, trade pkg.CommonTrade) *Message {
+	message := NewMessage(MsgTypeMarketDataIncrementalRefresh).
+		Add(TagMDReqID, reqId).
+		AddInt(TagNoMDEntries, 1).
+		Add(TagMDUpdateAction, MDUpdateActionNew)
+	message.Add(TagSymbol, trade.Symbol)
+	addTradeEntry(message, trade)
+	return message
+}
+
+func addTradeEntry(message *Message, trade pkg.CommonTrade) {
+	side := SideBuy
+	if trade.BuyerMaker {
+		side = SideSell
+	}
+	timestamp := trade.Timestamp.UTC()
+	message.Add(TagMDEntryType, MDEntryTypeTrade).
+		AddFloat(TagMDEntryPx, trade.Price).
+		AddFloat(TagMDEntrySize, trade.Quantity).
+		Add(TagMDEntryDate, timestamp.Format(entryDateFormat)).
+		Add(TagMDEntryTime, timestamp.Format(entryTimeFormat)).
+		Add(TagMDEntryID, strconv.FormatInt(trade.Id, 10)).
+		Add(TagSide, side)
+}
+
+// ParseTrades returns the trade entries of a snapshot or incremental
+// refresh. Other entry types are ignored. The symbol of a snapshot applies
+// to all entries, an incremental refresh has a symbol per entry.
+func ParseTrades(message *Message) ([]pkg.CommonTrade, error) {
+	var groups [][]Field
+	symbol := ""
+	switch message.Type {
+	case MsgTypeMarketDataSnapshot:
+		symbol, _ = message.Get(TagSymbol)
+		groups = message.Groups(TagNoMDEntries, TagMDEntryType)
+	case MsgTypeMarketDataIncrementalRefresh:
+		groups = message.Groups(TagNoMDEntries, TagMDUpdateAction)
+	default:
+		return nil, fmt.Errorf("not a market data message: %s", message.Type)
+	}
+
+	trades := []pkg.CommonTrade{}
+	for _, group := range groups {
+		if entryType, _ := GroupValue(group, TagMDEntryType); entryType != MDEntryTypeTrade {
+			continue
+		}
+		if action, ok := GroupValue(group, TagMDUpdateAction); ok && action != MDUpdateActionNew {
+			continue
+		}
+		trade, err := parseTradeEntry(group, symbol)
+		if err != nil {
+			return nil, err
+		}
+		trades = append(trades, trade)
+	}
+	return trades, nil
+}
+
+func parseTradeEntry(group []Field, symbol string) (pkg.CommonTrade, error) {
+	trade := pkg.CommonTrade{
+		Symbol:    symbol,
+		Timestamp: time.Now(),
+	}
+	if value, ok := GroupValue(group, TagSymbol); ok {
+		trade.Symbol = value
+	}
+	if trade.Symbol == "" {
+		return trade, fmt.Errorf("trade entry without symbol")
+	}
+	var err error
+	value, _ := GroupValue(group, TagMDEntryPx)
+	if trade.Price, err = strconv.ParseFloat(value, 64); err != nil {
+		return trade, fmt.Errorf("bad price: %s", value)
+	}
+	value, _ = GroupValue(group, TagMDEntrySize)
+	if trade.Quantity, err = strconv.ParseFloat(value, 64); err != nil {
+		return trade, fmt.Errorf("bad size: %s", value)
+	}
+	if value, ok := GroupValue(group, TagMDEntryID); ok {
+		trade.Id, _ = strconv.ParseInt(value, 10, 64)
+	}
+	if value, _ := GroupValue(group, TagSide); value == SideSell {
+		trade.BuyerMaker = true
+	}
+	date, hasDate := GroupValue(group, TagMDEntryDate)
+	clock, hasTime := GroupValue(group, TagMDEntryTime)
+	if hasDate && hasTime {
+		for _, layout := range []string{entryTimeFormat, "15:04:05"} {
+			if timestamp, err := time.Parse(entryDateFormat+layout,
+				date+clock); err == nil {
+				trade.Timestamp = timestamp
+				break
+			}
+		}
+	}
+	return trade, nil
+}
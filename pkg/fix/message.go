@@ -0,0 +1,274 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package fix implements enough of FIX 4.4 to consume and publish market
+// data: message encoding, a session layer with logon and heartbeats, and
+// the MarketDataRequest, Snapshot and IncrementalRefresh messages.
+//
+// Sequence numbers are reset on each logon and resend requests are not
+// supported, market data consumers are expected to resubscribe after a
+// reconnect.
+package fix
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const BeginString = "FIX.4.4"
+
+const soh = '\x01'
+
+// Tags used by this package.
+const (
+	TagBeginString      = 8
+	TagBodyLength       = 9
+	TagCheckSum         = 10
+	TagMsgSeqNum        = 34
+	TagMsgType          = 35
+	TagSenderCompID     = 49
+	TagSendingTime      = 52
+	TagSide             = 54
+	TagSymbol           = 55
+	TagTargetCompID     = 56
+	TagText             = 58
+	TagEncryptMethod    = 98
+	TagHeartBtInt       = 108
+	TagTestReqID        = 112
+	TagResetSeqNumFlag  = 141
+	TagNoRelatedSym     = 146
+	TagSecurityExchange = 207
+	TagMDReqID          = 262
+	TagSubscriptionType = 263
+	TagMarketDepth      = 264
+	TagMDUpdateType     = 265
+	TagNoMDEntryTypes   = 267
+	TagNoMDEntries      = 268
+	TagMDEntryType      = 269
+	TagMDEntryPx        = 270
+	TagMDEntrySize      = 271
+	TagMDEntryDate      = 272
+	TagMDEntryTime      = 273
+	TagMDEntryID        = 278
+	TagMDUpdateAction   = 279
+	TagMDReqRejReason   = 281
+)
+
+// Message types used by this package.
+const (
+	MsgTypeHeartbeat                    = "0"
+	MsgTypeTestRequest                  = "1"
+	MsgTypeReject                       = "3"
+	MsgTypeLogout                       = "5"
+	MsgTypeLogon                        = "A"
+	MsgTypeMarketDataRequest            = "V"
+	MsgTypeMarketDataSnapshot           = "W"
+	MsgTypeMarketDataIncrementalRefresh = "X"
+	MsgTypeMarketDataRequestReject      = "Y"
+)
+
+type Field struct {
+	Tag   int
+	Value string
+}
+
+// Message is a FIX message. Fields holds the header and body fields in
+// order, excluding BeginString, BodyLength, MsgType and CheckSum.
+type Message struct {
+	Type   string
+	Fields []Field
+}
+
+func NewMessage(msgType string) *Message {
+	return &Message{
+		Type: msgType,
+	}
+}
+
+func (m *Message) Add(tag int, value string) *Message {
+	m.Fields = append(m.Fields, Field{Tag: tag, Value: value})
+	return m
+}
+
+func (m *Message) AddInt(tag int, value int) *Message {
+	return m.Add(tag, strconv.Itoa(value))
+}
+
+func (m *Message) AddFloat(tag int, value float64) *Message {
+	return m.Add(tag, strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+// Get returns the value of the first field with tag.
+func (m *Message) Get(tag int) (string, bool) {
+	for _, field := range m.Fields {
+		if field.Tag == tag {
+			return field.Value, true
+		}
+	}
+	return "", false
+}
+
+func (m *Message) GetInt(tag int) (int, bool) {
+	value, ok := m.Get(tag)
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(value)
+	return n, err == nil
+}
+
+// Groups splits the fields following the first occurrence of countTag into
+// the repeating group entries, each starting with delimiterTag.
+func (m *Message) Groups(countTag int, delimiterTag int) [][]Field {
+	groups := [][]Field{}
+	i := 0
+	for i < len(m.Fields) && m.Fields[i].Tag != countTag {
+		i++
+	}
+	for i++; i < len(m.Fields); i++ {
+		field := m.Fields[i]
+		if field.Tag == delimiterTag {
+			groups = append(groups, []Field{})
+		}
+		if len(groups) == 0 {
+			break
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], field)
+	}
+	return groups
+}
+
+// GroupValue returns the value of tag in a repeating group entry.
+func GroupValue(group []Field, tag int) (string, bool) {
+	for _, field := range group {
+		if field.Tag == tag {
+			return field.Value, true
+		}
+	}
+	return "", false
+}
+
+// Encode returns the message in wire format with the header fields first.
+func (m *Message) Encode(header ...Field) []byte {
+	body := bytes.Buffer{}
+	writeField(&body, TagMsgType, m.Type)
+	for _, field := range header {
+		writeField(&body, field.Tag, field.Value)
+	}
+	for _, field := range m.Fields {
+		writeField(&body, field.Tag, field.Value)
+	}
+
+	buf := bytes.Buffer{}
+	writeField(&buf, TagBeginString, BeginString)
+	writeField(&buf, TagBodyLength, strconv.Itoa(body.Len()))
+	buf.Write(body.Bytes())
+	writeField(&buf, TagCheckSum, fmt.Sprintf("%03d", checksum(buf.Bytes())))
+	return buf.Bytes()
+}
+
+func (m *Message) String() string {
+	return string(bytes.Replace(m.Encode(), []byte{soh}, []byte{'|'}, -1))
+}
+
+func writeField(buf *bytes.Buffer, tag int, value string) {
+	buf.WriteString(strconv.Itoa(tag))
+	buf.WriteByte('=')
+	buf.WriteString(value)
+	buf.WriteByte(soh)
+}
+
+func checksum(buf []byte) int {
+	sum := 0
+	for _, b := range buf {
+		sum += int(b)
+	}
+	return sum % 256
+}
+
+// ReadMessage reads and validates the next message.
+func ReadMessage(r *bufio.Reader) (*Message, error) {
+	begin, err := r.ReadBytes(soh)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(begin, []byte("8="+BeginString+string(soh))) {
+		return nil, fmt.Errorf("unexpected begin string: %q", begin)
+	}
+	lengthField, err := r.ReadBytes(soh)
+	if err != nil {
+		return nil, err
+	}
+	tag, value, err := parseField(lengthField[:len(lengthField)-1])
+	if err != nil || tag != TagBodyLength {
+		return nil, fmt.Errorf("expected body length: %q", lengthField)
+	}
+	length, err := strconv.Atoi(value)
+	if err != nil || length <= 0 || length > maxBodyLength {
+		return nil, fmt.Errorf("bad body length: %s", value)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	trailer, err := r.ReadBytes(soh)
+	if err != nil {
+		return nil, err
+	}
+	tag, value, err = parseField(trailer[:len(trailer)-1])
+	if err != nil || tag != TagCheckSum {
+		return nil, fmt.Errorf("expected checksum: %q", trailer)
+	}
+	expected := checksum(begin) + checksum(lengthField) + checksum(body)
+	if sum, err := strconv.Atoi(value); err != nil || sum != expected%256 {
+		return nil, fmt.Errorf("bad checksum: %s", value)
+	}
+
+	message := &Message{}
+	for _, raw := range bytes.Split(bytes.TrimSuffix(body, []byte{soh}), []byte{soh}) {
+		tag, value, err := parseField(raw)
+		if err != nil {
+			return nil, err
+		}
+		if tag == TagMsgType && message.Type == "" {
+			message.Type = value
+			continue
+		}
+		message.Fields = append(message.Fields, Field{Tag: tag, Value: value})
+	}
+	if message.Type == "" {
+		return nil, fmt.Errorf("message without type")
+	}
+	return message, nil
+}
+
+// The largest body accepted, market data snapshots for a single symbol are
+// far smaller.
+const maxBodyLength = 1 << 20
+
+func parseField(raw []byte) (int, string, error) {
+	i := bytes.IndexByte(raw, '=')
+	if i <= 0 {
+		return 0, "", fmt.Errorf("bad field: %q", raw)
+	}
+	tag, err := strconv.Atoi(string(raw[:i]))
+	if err != nil {
+		return 0, "", fmt.Errorf("bad tag: %q", raw)
+	}
+	return tag, string(raw[i+1:]), nil
+}
@@ -0,0 +1,255 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package fix
+
+import (
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a FIX acceptor publishing trades to downstream consumers.
+// Consumers subscribe with a MarketDataRequest for trade entries, selecting
+// the exchange with SecurityExchange (the first exchange added if not set).
+// A snapshot of the last trade is sent for each symbol followed by an
+// incremental refresh for each new trade.
+type Server struct {
+	compId    string
+	exchanges []string
+	sessions  map[*serverSession]bool
+	last      map[string]pkg.CommonTrade
+	lock      sync.RWMutex
+	listener  net.Listener
+}
+
+type serverSession struct {
+	session *Session
+
+	// Subscriptions keyed by exchange then symbol, with the request id.
+	subscriptions map[string]map[string]string
+	lock          sync.Mutex
+
+	// Trades waiting to be written to the session.
+	queue chan *Message
+}
+
+func NewServer(compId string) *Server {
+	return &Server{
+		compId:   compId,
+		sessions: map[*serverSession]bool{},
+		last:     map[string]pkg.CommonTrade{},
+	}
+}
+
+// Sink returns a sink for the trades of exchange.
+func (s *Server) Sink(exchange string) pkg.Sink {
+	s.lock.Lock()
+	s.exchanges = append(s.exchanges, exchange)
+	s.lock.Unlock()
+	return &serverSink{server: s, exchange: exchange}
+}
+
+type serverSink struct {
+	server   *Server
+	exchange string
+}
+
+func (s *serverSink) Name() string {
+	return "fix"
+}
+
+func (s *serverSink) Send(message interface{}) error {
+	trade, ok := message.(pkg.CommonTrade)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", message)
+	}
+	s.server.publish(s.exchange, trade)
+	return nil
+}
+
+func (s *Server) publish(exchange string, trade pkg.CommonTrade) {
+	s.lock.Lock()
+	s.last[exchange+":"+trade.Symbol] = trade
+	s.lock.Unlock()
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for session := range s.sessions {
+		session.lock.Lock()
+		reqId, ok := session.subscriptions[exchange][trade.Symbol]
+		session.lock.Unlock()
+		if !ok {
+			continue
+		}
+		select {
+		case session.queue <- NewTradeIncrement(reqId, trade):
+		default:
+			log.Printf("fix: %s: consumer is too slow, disconnecting\n",
+				session.session.Options().TargetCompID)
+			session.session.Close()
+		}
+	}
+}
+
+// ListenAndServe accepts consumer sessions on address until Close is
+// called.
+func (s *Server) ListenAndServe(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.listener = listener
+	s.lock.Unlock()
+	log.Printf("fix: accepting market data sessions on %s as %s\n",
+		address, s.compId)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+// Close stops accepting sessions and logs out all consumers.
+func (s *Server) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for session := range s.sessions {
+		session.session.Logout("server shutting down")
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	session := &serverSession{
+		session: NewSession(conn, SessionOptions{
+			SenderCompID: s.compId,
+			HeartBtInt:   30 * time.Second,
+		}),
+		subscriptions: map[string]map[string]string{},
+		queue:         make(chan *Message, 1024),
+	}
+	defer session.session.Close()
+
+	// Closed after the session is removed, so publish never sends to a
+	// closed queue.
+	defer close(session.queue)
+
+	if err := session.session.Accept(); err != nil {
+		log.Printf("fix: logon from %s failed: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+	name := session.session.Options().TargetCompID
+	log.Printf("fix: %s logged on from %s\n", name, conn.RemoteAddr())
+
+	s.lock.Lock()
+	s.sessions[session] = true
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.sessions, session)
+		s.lock.Unlock()
+	}()
+
+	go session.session.RunHeartbeats()
+	go func() {
+		for message := range session.queue {
+			if err := session.session.Send(message); err != nil {
+				session.session.Close()
+				return
+			}
+		}
+	}()
+
+	for {
+		message, err := session.session.Receive()
+		if err != nil {
+			log.Printf("fix: %s disconnected: %v\n", name, err)
+			return
+		}
+		if message.Type != MsgTypeMarketDataRequest {
+			continue
+		}
+		s.handleRequest(session, message)
+	}
+}
+
+func (s *Server) handleRequest(session *serverSession, message *Message) {
+	reqId, _ := message.Get(TagMDReqID)
+	reject := func(text string) {
+		session.queue <- NewMessage(MsgTypeMarketDataRequestReject).
+			Add(TagMDReqID, reqId).
+			Add(TagText, text)
+	}
+
+	s.lock.RLock()
+	exchange, ok := message.Get(TagSecurityExchange)
+	if !ok && len(s.exchanges) > 0 {
+		exchange = s.exchanges[0]
+	}
+	known := false
+	for _, name := range s.exchanges {
+		known = known || name == exchange
+	}
+	s.lock.RUnlock()
+	if !known {
+		reject(fmt.Sprintf("unknown exchange: %s", exchange))
+		return
+	}
+
+	symbols := []string{}
+	for _, group := range message.Groups(TagNoRelatedSym, TagSymbol) {
+		symbol, _ := GroupValue(group, TagSymbol)
+		symbols = append(symbols, strings.ToUpper(symbol))
+	}
+	if len(symbols) == 0 {
+		reject("no symbols")
+		return
+	}
+
+	subscriptionType, _ := message.Get(TagSubscriptionType)
+	session.lock.Lock()
+	if session.subscriptions[exchange] == nil {
+		session.subscriptions[exchange] = map[string]string{}
+	}
+	for _, symbol := range symbols {
+		if subscriptionType == SubscriptionUnsubscribe {
+			delete(session.subscriptions[exchange], symbol)
+		} else {
+			session.subscriptions[exchange][symbol] = reqId
+		}
+	}
+	session.lock.Unlock()
+	if subscriptionType == SubscriptionUnsubscribe {
+		return
+	}
+
+	s.lock.RLock()
+	for _, symbol := range symbols {
+		if trade, ok := s.last[exchange+":"+symbol]; ok {
+			session.queue <- NewTradeSnapshot(reqId, trade)
+		}
+	}
+	s.lock.RUnlock()
+}
@@ -0,0 +1,238 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package fix
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const sendingTimeFormat = "20060102-15:04:05.000"
+
+// ErrLogout is returned by Receive when the counterparty logs out.
+var ErrLogout = fmt.Errorf("logout")
+
+type SessionOptions struct {
+	SenderCompID string
+	TargetCompID string
+	HeartBtInt   time.Duration
+}
+
+// Session is a FIX session over a connection. Administrative messages are
+// handled internally, Receive only returns application messages.
+type Session struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	options   SessionOptions
+	outSeq    int
+	writeLock sync.Mutex
+
+	lastSent     time.Time
+	lastReceived time.Time
+	timesLock    sync.Mutex
+
+	done chan struct{}
+	once sync.Once
+}
+
+func NewSession(conn net.Conn, options SessionOptions) *Session {
+	if options.HeartBtInt <= 0 {
+		options.HeartBtInt = 30 * time.Second
+	}
+	now := time.Now()
+	return &Session{
+		conn:         conn,
+		reader:       bufio.NewReader(conn),
+		options:      options,
+		lastSent:     now,
+		lastReceived: now,
+		done:         make(chan struct{}),
+	}
+}
+
+func (s *Session) Options() SessionOptions {
+	return s.options
+}
+
+// Send adds the session header and writes the message.
+func (s *Session) Send(message *Message) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.outSeq++
+	now := time.Now()
+	buf := message.Encode(
+		Field{TagSenderCompID, s.options.SenderCompID},
+		Field{TagTargetCompID, s.options.TargetCompID},
+		Field{TagMsgSeqNum, strconv.Itoa(s.outSeq)},
+		Field{TagSendingTime, now.UTC().Format(sendingTimeFormat)},
+	)
+	s.conn.SetWriteDeadline(now.Add(s.options.HeartBtInt))
+	if _, err := s.conn.Write(buf); err != nil {
+		return err
+	}
+	s.timesLock.Lock()
+	s.lastSent = now
+	s.timesLock.Unlock()
+	return nil
+}
+
+// Receive returns the next application message, answering heartbeats and
+// test requests. Returns ErrLogout if the counterparty logs out.
+func (s *Session) Receive() (*Message, error) {
+	for {
+		message, err := ReadMessage(s.reader)
+		if err != nil {
+			return nil, err
+		}
+		s.timesLock.Lock()
+		s.lastReceived = time.Now()
+		s.timesLock.Unlock()
+
+		if sender, _ := message.Get(TagSenderCompID); sender != s.options.TargetCompID {
+			return nil, fmt.Errorf("unexpected sender comp id: %s", sender)
+		}
+
+		switch message.Type {
+		case MsgTypeHeartbeat:
+		case MsgTypeTestRequest:
+			heartbeat := NewMessage(MsgTypeHeartbeat)
+			if id, ok := message.Get(TagTestReqID); ok {
+				heartbeat.Add(TagTestReqID, id)
+			}
+			if err := s.Send(heartbeat); err != nil {
+				return nil, err
+			}
+		case MsgTypeLogout:
+			text, _ := message.Get(TagText)
+			s.Send(NewMessage(MsgTypeLogout))
+			return nil, fmt.Errorf("%v: %s", ErrLogout, text)
+		case MsgTypeReject:
+			text, _ := message.Get(TagText)
+			return nil, fmt.Errorf("session reject: %s", text)
+		default:
+			return message, nil
+		}
+	}
+}
+
+func (s *Session) logonMessage() *Message {
+	return NewMessage(MsgTypeLogon).
+		Add(TagEncryptMethod, "0").
+		AddInt(TagHeartBtInt, int(s.options.HeartBtInt/time.Second)).
+		Add(TagResetSeqNumFlag, "Y")
+}
+
+// Logon logs on as the initiator and waits for the acknowledgement.
+func (s *Session) Logon() error {
+	if err := s.Send(s.logonMessage()); err != nil {
+		return err
+	}
+	s.conn.SetReadDeadline(time.Now().Add(s.options.HeartBtInt))
+	defer s.conn.SetReadDeadline(time.Time{})
+	message, err := ReadMessage(s.reader)
+	if err != nil {
+		return err
+	}
+	if message.Type != MsgTypeLogon {
+		text, _ := message.Get(TagText)
+		return fmt.Errorf("logon rejected: type=%s: %s", message.Type, text)
+	}
+	return nil
+}
+
+// Accept waits for the initiator's logon and acknowledges it. The target
+// comp id is taken from the logon if not set.
+func (s *Session) Accept() error {
+	s.conn.SetReadDeadline(time.Now().Add(s.options.HeartBtInt))
+	defer s.conn.SetReadDeadline(time.Time{})
+	message, err := ReadMessage(s.reader)
+	if err != nil {
+		return err
+	}
+	if message.Type != MsgTypeLogon {
+		return fmt.Errorf("expected logon, got type %s", message.Type)
+	}
+	if target, _ := message.Get(TagTargetCompID); target != s.options.SenderCompID {
+		s.options.TargetCompID, _ = message.Get(TagSenderCompID)
+		s.Send(NewMessage(MsgTypeLogout).Add(TagText, "unknown target comp id"))
+		return fmt.Errorf("unexpected target comp id: %s", target)
+	}
+	sender, _ := message.Get(TagSenderCompID)
+	if s.options.TargetCompID == "" {
+		s.options.TargetCompID = sender
+	} else if sender != s.options.TargetCompID {
+		return fmt.Errorf("unexpected sender comp id: %s", sender)
+	}
+	if seconds, ok := message.GetInt(TagHeartBtInt); ok && seconds > 0 {
+		s.options.HeartBtInt = time.Duration(seconds) * time.Second
+	}
+	return s.Send(s.logonMessage())
+}
+
+// RunHeartbeats sends heartbeats when idle and test requests when nothing
+// has been received, closing the connection if the counterparty stops
+// responding. Returns when the session is closed.
+func (s *Session) RunHeartbeats() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	testRequestSent := false
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		s.timesLock.Lock()
+		sinceSent := time.Now().Sub(s.lastSent)
+		sinceReceived := time.Now().Sub(s.lastReceived)
+		s.timesLock.Unlock()
+
+		interval := s.options.HeartBtInt
+		if sinceReceived < interval {
+			testRequestSent = false
+		}
+		switch {
+		case sinceReceived > 2*interval+interval/5:
+			s.Close()
+			return
+		case sinceReceived > interval+interval/5 && !testRequestSent:
+			s.Send(NewMessage(MsgTypeTestRequest).
+				Add(TagTestReqID, strconv.FormatInt(time.Now().Unix(), 10)))
+			testRequestSent = true
+		case sinceSent >= interval:
+			s.Send(NewMessage(MsgTypeHeartbeat))
+		}
+	}
+}
+
+// Logout sends a logout and closes the session.
+func (s *Session) Logout(text string) {
+	s.Send(NewMessage(MsgTypeLogout).Add(TagText, text))
+	s.Close()
+}
+
+func (s *Session) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.done)
+		err = s.conn.Close()
+	})
+	return err
+}
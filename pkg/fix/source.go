@@ -0,0 +1,143 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package fix
+
+import (
+	"context"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/source"
+	"net"
+	"time"
+)
+
+func init() {
+	source.Register("fix", NewSource)
+}
+
+type sourceOptions struct {
+	// host:port of the FIX acceptor.
+	Address      string   `json:"address"`
+	SenderCompID string   `json:"sender_comp_id"`
+	TargetCompID string   `json:"target_comp_id"`
+	Symbols      []string `json:"symbols"`
+
+	// Heartbeat interval in seconds.
+	Heartbeat int `json:"heartbeat"`
+}
+
+// Source is a trade source fed by a FIX market data session. It connects
+// as the initiator and subscribes to trades for the configured symbols.
+type Source struct {
+	options sourceOptions
+	health  *pkg.StreamHealth
+	nextId  int64
+}
+
+func NewSource(options map[string]interface{}) (source.Source, error) {
+	s := &Source{
+		options: sourceOptions{
+			Heartbeat: 30,
+		},
+		nextId: 1,
+	}
+	if err := source.DecodeOptions(options, &s.options); err != nil {
+		return nil, err
+	}
+	if s.options.Address == "" || s.options.SenderCompID == "" || s.options.TargetCompID == "" {
+		return nil, fmt.Errorf("fix: address, sender_comp_id and target_comp_id required")
+	}
+	if len(s.options.Symbols) == 0 {
+		return nil, fmt.Errorf("fix: no symbols")
+	}
+	s.health = pkg.NewStreamHealth("fix."+s.options.TargetCompID, pkg.DefaultBackoffOptions)
+	return s, nil
+}
+
+// Run connects and logs on, reconnecting with backoff until ctx is
+// cancelled.
+func (s *Source) Run(ctx context.Context, publish func(trade pkg.CommonTrade)) error {
+	for {
+		err := s.runOnce(ctx, publish)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if !s.health.Disconnected(ctx, err) {
+			return err
+		}
+	}
+}
+
+func (s *Source) runOnce(ctx context.Context, publish func(trade pkg.CommonTrade)) error {
+	conn, err := net.DialTimeout("tcp", s.options.Address, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	session := NewSession(conn, SessionOptions{
+		SenderCompID: s.options.SenderCompID,
+		TargetCompID: s.options.TargetCompID,
+		HeartBtInt:   time.Duration(s.options.Heartbeat) * time.Second,
+	})
+	defer session.Close()
+	defer pkg.CloseOnDone(ctx, session)()
+
+	if err := session.Logon(); err != nil {
+		return err
+	}
+	go session.RunHeartbeats()
+
+	reqId := fmt.Sprintf("%d", time.Now().UnixNano())
+	if err := session.Send(NewTradeRequest(reqId, s.options.Symbols)); err != nil {
+		return err
+	}
+	s.health.Connected()
+	log.Printf("fix: %s: subscribed to %d symbols\n", s.options.Address,
+		len(s.options.Symbols))
+
+	for {
+		message, err := session.Receive()
+		if err != nil {
+			if ctx.Err() != nil {
+				session.Logout("shutting down")
+			}
+			return err
+		}
+		s.health.Message()
+
+		switch message.Type {
+		case MsgTypeMarketDataSnapshot, MsgTypeMarketDataIncrementalRefresh:
+			trades, err := ParseTrades(message)
+			if err != nil {
+				log.Printf("error: fix: %s: bad market data: %v\n",
+					s.options.Address, err)
+				continue
+			}
+			for _, trade := range trades {
+				if trade.Id == 0 {
+					trade.Id = s.nextId
+				}
+				s.nextId = trade.Id + 1
+				publish(trade)
+			}
+		case MsgTypeMarketDataRequestReject:
+			text, _ := message.Get(TagText)
+			reason, _ := message.Get(TagMDReqRejReason)
+			return fmt.Errorf("market data request rejected: reason=%s: %s",
+				reason, text)
+		}
+	}
+}
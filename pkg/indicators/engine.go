@@ -0,0 +1,154 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package indicators
+
+import (
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/candles"
+	"sync"
+	"time"
+)
+
+const (
+	rsiPeriod     = 14
+	emaFastPeriod = 9
+	emaSlowPeriod = 21
+	emaLongPeriod = 200
+	macdFast      = 12
+	macdSlow      = 26
+	macdSignal    = 9
+)
+
+// Values holds the indicators that are ready for a symbol and interval,
+// keyed by name, such as rsi_14 or macd_signal.
+type Values map[string]float64
+
+type state struct {
+	rsi     *RSI
+	emaFast *EMA
+	emaSlow *EMA
+	emaLong *EMA
+	macd    *MACD
+	vwap    *VWAP
+	values  Values
+}
+
+func newState() *state {
+	return &state{
+		rsi:     NewRSI(rsiPeriod),
+		emaFast: NewEMA(emaFastPeriod),
+		emaSlow: NewEMA(emaSlowPeriod),
+		emaLong: NewEMA(emaLongPeriod),
+		macd:    NewMACD(macdFast, macdSlow, macdSignal),
+		vwap:    &VWAP{},
+		values:  Values{},
+	}
+}
+
+func (s *state) update(candle candles.Candle) {
+	s.rsi.Update(candle.Close)
+	s.emaFast.Update(candle.Close)
+	s.emaSlow.Update(candle.Close)
+	s.emaLong.Update(candle.Close)
+	s.macd.Update(candle.Close)
+	s.vwap.Update(candle.OpenTime, candle.Volume, candle.QuoteVolume)
+
+	values := Values{}
+	if s.rsi.Ready() {
+		values[fmt.Sprintf("rsi_%d", rsiPeriod)] = pkg.Round3(s.rsi.Value())
+	}
+	if s.emaFast.Ready() {
+		values[fmt.Sprintf("ema_%d", emaFastPeriod)] = pkg.Round8(s.emaFast.Value())
+	}
+	if s.emaSlow.Ready() {
+		values[fmt.Sprintf("ema_%d", emaSlowPeriod)] = pkg.Round8(s.emaSlow.Value())
+	}
+	if s.emaLong.Ready() {
+		values[fmt.Sprintf("ema_%d", emaLongPeriod)] = pkg.Round8(s.emaLong.Value())
+	}
+	if s.macd.Ready() {
+		values["macd"] = pkg.Round8(s.macd.Value())
+		values["macd_signal"] = pkg.Round8(s.macd.Signal())
+		values["macd_hist"] = pkg.Round8(s.macd.Histogram())
+	}
+	if s.vwap.Ready() {
+		values["vwap"] = pkg.Round8(s.vwap.Value())
+	}
+	s.values = values
+}
+
+// Engine maintains streaming indicators per symbol and interval from closed
+// candles. It is registered as a sink on a candle builder.
+type Engine struct {
+	states map[string]map[time.Duration]*state
+	lock   sync.RWMutex
+}
+
+func NewEngine() *Engine {
+	return &Engine{
+		states: map[string]map[time.Duration]*state{},
+	}
+}
+
+func (e *Engine) Name() string {
+	return "indicators"
+}
+
+// Send implements pkg.Sink for closed candles.
+func (e *Engine) Send(message interface{}) error {
+	candle, ok := message.(candles.Candle)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", message)
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.states[candle.Symbol] == nil {
+		e.states[candle.Symbol] = map[time.Duration]*state{}
+	}
+	s := e.states[candle.Symbol][candle.Interval]
+	if s == nil {
+		s = newState()
+		e.states[candle.Symbol][candle.Interval] = s
+	}
+	s.update(candle)
+	return nil
+}
+
+// Get returns the indicators for a symbol and interval as of the last
+// closed candle.
+func (e *Engine) Get(symbol string, interval time.Duration) Values {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	if s := e.states[symbol][interval]; s != nil {
+		return s.values
+	}
+	return nil
+}
+
+// Snapshot returns the indicators of a symbol for all intervals, keyed by
+// interval name such as 5m.
+func (e *Engine) Snapshot(symbol string) map[string]Values {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	snapshot := map[string]Values{}
+	for interval, s := range e.states[symbol] {
+		if len(s.values) > 0 {
+			snapshot[candles.FormatInterval(interval)] = s.values
+		}
+	}
+	return snapshot
+}
@@ -0,0 +1,178 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package indicators
+
+import (
+	"time"
+)
+
+// EMA is a streaming exponential moving average, seeded with the simple
+// average of the first period values.
+type EMA struct {
+	period int
+	count  int
+	sum    float64
+	value  float64
+}
+
+func NewEMA(period int) *EMA {
+	return &EMA{period: period}
+}
+
+func (e *EMA) Update(value float64) {
+	e.count++
+	if e.count < e.period {
+		e.sum += value
+		return
+	}
+	if e.count == e.period {
+		e.value = (e.sum + value) / float64(e.period)
+		return
+	}
+	k := 2 / float64(e.period+1)
+	e.value = value*k + e.value*(1-k)
+}
+
+func (e *EMA) Ready() bool {
+	return e.count >= e.period
+}
+
+func (e *EMA) Value() float64 {
+	return e.value
+}
+
+// RSI is a streaming relative strength index using Wilder's smoothing.
+type RSI struct {
+	period   int
+	count    int
+	prev     float64
+	avgGain  float64
+	avgLoss  float64
+	havePrev bool
+}
+
+func NewRSI(period int) *RSI {
+	return &RSI{period: period}
+}
+
+func (r *RSI) Update(close float64) {
+	if !r.havePrev {
+		r.prev = close
+		r.havePrev = true
+		return
+	}
+	change := close - r.prev
+	r.prev = close
+	gain, loss := float64(0), float64(0)
+	if change > 0 {
+		gain = change
+	} else {
+		loss = -change
+	}
+
+	r.count++
+	if r.count <= r.period {
+		r.avgGain += gain / float64(r.period)
+		r.avgLoss += loss / float64(r.period)
+		return
+	}
+	r.avgGain = (r.avgGain*float64(r.period-1) + gain) / float64(r.period)
+	r.avgLoss = (r.avgLoss*float64(r.period-1) + loss) / float64(r.period)
+}
+
+func (r *RSI) Ready() bool {
+	return r.count >= r.period
+}
+
+func (r *RSI) Value() float64 {
+	if r.avgLoss == 0 {
+		if r.avgGain == 0 {
+			return 50
+		}
+		return 100
+	}
+	return 100 - 100/(1+r.avgGain/r.avgLoss)
+}
+
+// MACD is the difference between a fast and slow EMA, with a signal EMA of
+// that difference.
+type MACD struct {
+	fast   *EMA
+	slow   *EMA
+	signal *EMA
+}
+
+func NewMACD(fast int, slow int, signal int) *MACD {
+	return &MACD{
+		fast:   NewEMA(fast),
+		slow:   NewEMA(slow),
+		signal: NewEMA(signal),
+	}
+}
+
+func (m *MACD) Update(close float64) {
+	m.fast.Update(close)
+	m.slow.Update(close)
+	if m.slow.Ready() {
+		m.signal.Update(m.Value())
+	}
+}
+
+func (m *MACD) Ready() bool {
+	return m.signal.Ready()
+}
+
+func (m *MACD) Value() float64 {
+	return m.fast.Value() - m.slow.Value()
+}
+
+func (m *MACD) Signal() float64 {
+	return m.signal.Value()
+}
+
+func (m *MACD) Histogram() float64 {
+	return m.Value() - m.Signal()
+}
+
+// VWAP is the volume weighted average price since the start of the UTC
+// day.
+type VWAP struct {
+	day         time.Time
+	volume      float64
+	quoteVolume float64
+}
+
+func (v *VWAP) Update(timestamp time.Time, volume float64, quoteVolume float64) {
+	day := timestamp.UTC().Truncate(24 * time.Hour)
+	if !day.Equal(v.day) {
+		v.day = day
+		v.volume = 0
+		v.quoteVolume = 0
+	}
+	v.volume += volume
+	v.quoteVolume += quoteVolume
+}
+
+func (v *VWAP) Ready() bool {
+	return v.volume > 0
+}
+
+func (v *VWAP) Value() float64 {
+	if v.volume == 0 {
+		return 0
+	}
+	return v.quoteVolume / v.volume
+}
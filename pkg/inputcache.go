@@ -0,0 +1,205 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Input cache backends.
+const (
+	CacheBackendRedis  = "redis"
+	CacheBackendMemory = "memory"
+)
+
+// InputCache caches the raw messages of an exchange stream so they can be
+// replayed on startup. Entries are kept in the order pushed and positions
+// are counted from the oldest.
+type InputCache interface {
+	Ping() error
+
+	// Retention returns how long cached messages are kept.
+	Retention() time.Duration
+
+	// SetRetention must be called before the cache is written to.
+	SetRetention(retention time.Duration)
+
+	// RPush appends a message. It must not block on the backend.
+	RPush(buf []byte)
+
+	// Prune removes entries older than the retention, possibly in the
+	// background. Callers replaying the cache by position should not prune
+	// until the replay is done, as pruning shifts the positions.
+	Prune()
+
+	// GetN returns the entry at position n, nil if there is none.
+	GetN(n int64) (*RedisCacheEntry, error)
+
+	Len() (int64, error)
+
+	// Trim removes the n oldest entries. It is meant for the maintenance
+	// of a cache that is not being written to, such as by the cache
+	// command while the server is stopped.
+	Trim(n int64) error
+}
+
+type CacheOptions struct {
+	// The backend caches are created with, redis or memory.
+	Backend string
+
+	// The most entries a memory cache keeps, the oldest are dropped once
+	// full.
+	MaxEntries int
+
+	// The directory memory caches are snapshotted to, and restored from on
+	// startup, every SnapshotInterval. Empty or an interval of 0 disables
+	// snapshots.
+	SnapshotDir      string
+	SnapshotInterval time.Duration
+}
+
+// The options caches are created with, along with DefaultRedisOptions for
+// the retention. Must be set before the exchanges create their streams.
+var DefaultCacheOptions = CacheOptions{
+	Backend:          CacheBackendRedis,
+	MaxEntries:       1000000,
+	SnapshotInterval: time.Minute,
+}
+
+func (o CacheOptions) Validate() error {
+	if o.Backend != CacheBackendRedis && o.Backend != CacheBackendMemory {
+		return fmt.Errorf("unsupported cache backend: %s", o.Backend)
+	}
+	if o.Backend == CacheBackendMemory && o.MaxEntries <= 0 {
+		return fmt.Errorf("cache max entries must be positive")
+	}
+	if o.SnapshotInterval < 0 {
+		return fmt.Errorf("cache snapshot interval must not be negative")
+	}
+	return nil
+}
+
+// NewInputCache creates a cache stored under key with the backend of
+// DefaultCacheOptions.
+func NewInputCache(key string) InputCache {
+	if DefaultCacheOptions.Backend == CacheBackendMemory {
+		return NewMemoryInputCache(key)
+	}
+	return NewRedisInputCache(key)
+}
+
+// InputCacheKeys returns the keys of the caches stored in the backend of
+// DefaultCacheOptions, sorted.
+func InputCacheKeys() ([]string, error) {
+	var keys []string
+	var err error
+	if DefaultCacheOptions.Backend == CacheBackendMemory {
+		keys, err = memoryInputCacheKeys(DefaultCacheOptions.SnapshotDir)
+	} else {
+		keys, err = redisInputCacheKeys()
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// InputCacheInfo describes the entries of a cache.
+type InputCacheInfo struct {
+	Key     string    `json:"key"`
+	Backend string    `json:"backend"`
+	Entries int64     `json:"entries"`
+	Oldest  time.Time `json:"oldest"`
+	Newest  time.Time `json:"newest"`
+}
+
+// InspectInputCache returns the number of entries of cache, stored under
+// key, and when the oldest and newest were cached.
+func InspectInputCache(key string, cache InputCache) (InputCacheInfo, error) {
+	info := InputCacheInfo{
+		Key:     key,
+		Backend: DefaultCacheOptions.Backend,
+	}
+	if err := cache.Ping(); err != nil {
+		return info, err
+	}
+	length, err := cache.Len()
+	if err != nil || length == 0 {
+		return info, err
+	}
+	info.Entries = length
+	oldest, err := cache.GetN(0)
+	if err != nil {
+		return info, err
+	}
+	newest, err := cache.GetN(length - 1)
+	if err != nil {
+		return info, err
+	}
+	if oldest != nil {
+		info.Oldest = time.Unix(oldest.Timestamp, 0)
+	}
+	if newest != nil {
+		info.Newest = time.Unix(newest.Timestamp, 0)
+	}
+	return info, nil
+}
+
+// PruneInputCache removes the entries of cache cached before cutoff,
+// returning how many were removed. The first entry to keep is found by
+// binary search as entries are cached in time order. Memory caches are
+// snapshotted after.
+func PruneInputCache(cache InputCache, cutoff time.Time) (int64, error) {
+	length, err := cache.Len()
+	if err != nil {
+		return 0, err
+	}
+	expired, err := searchInputCache(cache, length, cutoff.Unix())
+	if err != nil {
+		return 0, err
+	}
+	if expired > 0 {
+		if err := cache.Trim(expired); err != nil {
+			return 0, err
+		}
+	}
+	if memory, ok := cache.(*MemoryInputCache); ok {
+		return expired, memory.Save()
+	}
+	return expired, nil
+}
+
+// searchInputCache returns the position of the first of the length entries
+// of cache cached at or after timestamp, length if there is none.
+func searchInputCache(cache InputCache, length int64, timestamp int64) (int64, error) {
+	low, high := int64(0), length
+	for low < high {
+		middle := low + (high-low)/2
+		entry, err := cache.GetN(middle)
+		if err != nil {
+			return 0, err
+		}
+		if entry != nil && entry.Timestamp < timestamp {
+			low = middle + 1
+		} else {
+			high = middle
+		}
+	}
+	return low, nil
+}
@@ -0,0 +1,347 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package journal
+
+import (
+	"context"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrStop can be returned from a read callback to stop reading without an
+// error.
+var ErrStop = errors.New("stop")
+
+type Options struct {
+	// Uncompressed size at which a block is compressed and written. Each
+	// block is one index entry, so smaller blocks give finer seeking at
+	// the cost of compression ratio.
+	BlockSize int
+
+	// Maximum time buffered records are held before being written.
+	FlushInterval time.Duration
+
+	// Time after which a new segment file is started.
+	SegmentDuration time.Duration
+
+	// Segments older than this are removed by Run. 0 keeps all segments.
+	Retention time.Duration
+}
+
+var DefaultOptions = Options{
+	BlockSize:       256 * 1024,
+	FlushInterval:   5 * time.Second,
+	SegmentDuration: time.Hour,
+}
+
+// Journal is an append only log of timestamped records stored in zstd
+// compressed segment files. Each block of records is an independent zstd
+// frame, located through a sparse time index, so reads can start at a
+// timestamp without decompressing the segment from the start.
+type Journal struct {
+	dir     string
+	options Options
+	lock    sync.Mutex
+
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+
+	segment      segmentInfo
+	segmentFile  *os.File
+	indexFile    *os.File
+	segmentStart time.Time
+	offset       int64
+
+	block        []byte
+	blockMinTime int64
+	lastFlush    time.Time
+
+	// The latest timestamp written.
+	lastTime int64
+}
+
+// Open opens the journal in dir, creating it if needed. New records are
+// always written to a new segment.
+func Open(dir string, options Options) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	j := &Journal{
+		dir:       dir,
+		options:   options,
+		encoder:   encoder,
+		decoder:   decoder,
+		lastFlush: time.Now(),
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) > 0 {
+		j.lastTime = j.segmentLastTime(segments[len(segments)-1])
+	}
+	return j, nil
+}
+
+func (j *Journal) segmentLastTime(segment segmentInfo) int64 {
+	entries, err := readIndex(segment.indexPath())
+	if err != nil || len(entries) == 0 {
+		return segment.start
+	}
+	last := int64(0)
+	j.readBlock(segment, entries[len(entries)-1], func(timestamp int64, data []byte) error {
+		if timestamp > last {
+			last = timestamp
+		}
+		return nil
+	})
+	return last
+}
+
+// LastTime returns the latest timestamp written to the journal.
+func (j *Journal) LastTime() time.Time {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.lastTime == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, j.lastTime)
+}
+
+func (j *Journal) Append(timestamp time.Time, data []byte) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	ts := timestamp.UnixNano()
+	if len(j.block) == 0 || ts < j.blockMinTime {
+		j.blockMinTime = ts
+	}
+	if ts > j.lastTime {
+		j.lastTime = ts
+	}
+	j.block = appendRecord(j.block, ts, data)
+
+	if len(j.block) >= j.options.BlockSize ||
+		time.Now().Sub(j.lastFlush) >= j.options.FlushInterval {
+		return j.flush()
+	}
+	return nil
+}
+
+// Flush writes any buffered records.
+func (j *Journal) Flush() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.flush()
+}
+
+func (j *Journal) flush() error {
+	j.lastFlush = time.Now()
+	if len(j.block) == 0 {
+		return nil
+	}
+
+	if j.segmentFile == nil || time.Now().Sub(j.segmentStart) >= j.options.SegmentDuration {
+		if err := j.rotate(); err != nil {
+			return err
+		}
+	}
+
+	frame := j.encoder.EncodeAll(j.block, nil)
+	if _, err := j.segmentFile.Write(frame); err != nil {
+		return err
+	}
+	entry := indexEntry{
+		MinTime: j.blockMinTime,
+		Offset:  j.offset,
+		Length:  int64(len(frame)),
+	}
+	if _, err := j.indexFile.Write(entry.encode()); err != nil {
+		return err
+	}
+	j.offset += int64(len(frame))
+	j.block = j.block[:0]
+	return nil
+}
+
+func (j *Journal) rotate() error {
+	j.closeSegment()
+	now := time.Now()
+	segment := newSegmentInfo(j.dir, now)
+	segmentFile, err := os.OpenFile(segment.segmentPath(),
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	indexFile, err := os.OpenFile(segment.indexPath(),
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		segmentFile.Close()
+		return err
+	}
+	j.segment = segment
+	j.segmentFile = segmentFile
+	j.indexFile = indexFile
+	j.segmentStart = now
+	j.offset = 0
+	return nil
+}
+
+func (j *Journal) closeSegment() {
+	if j.segmentFile != nil {
+		j.segmentFile.Close()
+		j.indexFile.Close()
+		j.segmentFile = nil
+		j.indexFile = nil
+	}
+}
+
+// Run periodically flushes buffered records and prunes old segments until
+// ctx is cancelled. The journal must still be closed to flush the final
+// records.
+func (j *Journal) Run(ctx context.Context) {
+	lastPrune := time.Time{}
+	for {
+		if !pkg.Sleep(ctx, j.options.FlushInterval) {
+			return
+		}
+		if err := j.Flush(); err != nil {
+			log.Printf("error: journal: %s: flush failed: %v\n", j.dir, err)
+		}
+		if j.options.Retention > 0 && time.Now().Sub(lastPrune) > time.Minute {
+			if err := j.Prune(time.Now().Add(-j.options.Retention)); err != nil {
+				log.Printf("error: journal: %s: prune failed: %v\n", j.dir, err)
+			}
+			lastPrune = time.Now()
+		}
+	}
+}
+
+// Close flushes buffered records and closes the current segment.
+func (j *Journal) Close() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	err := j.flush()
+	j.closeSegment()
+	return err
+}
+
+func (j *Journal) readBlock(segment segmentInfo, entry indexEntry, fn func(timestamp int64, data []byte) error) error {
+	file, err := os.Open(segment.segmentPath())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	frame := make([]byte, entry.Length)
+	if _, err := file.ReadAt(frame, entry.Offset); err != nil {
+		return err
+	}
+	block, err := j.decoder.DecodeAll(frame, nil)
+	if err != nil {
+		return err
+	}
+	return decodeRecords(block, fn)
+}
+
+// Read calls fn with each record with a timestamp in [from, to), in the
+// order written. Records still buffered are not included until flushed.
+// Return ErrStop from fn to stop early.
+func (j *Journal) Read(from time.Time, to time.Time, fn func(timestamp time.Time, data []byte) error) error {
+	segments, err := listSegments(j.dir)
+	if err != nil {
+		return err
+	}
+	fromNanos := from.UnixNano()
+	toNanos := to.UnixNano()
+
+	for i, segment := range segments {
+		// Records are written before the next segment is started, so a
+		// segment followed by one started before from has nothing to read.
+		if i+1 < len(segments) && segments[i+1].start <= fromNanos {
+			continue
+		}
+		entries, err := readIndex(segment.indexPath())
+		if err != nil {
+			log.Printf("error: journal: failed to read index %s: %v\n", segment.indexPath(), err)
+			continue
+		}
+
+		// Blocks are mostly in time order, start from the last block whose
+		// earliest record is before from.
+		start := sort.Search(len(entries), func(i int) bool {
+			return entries[i].MinTime > fromNanos
+		})
+		if start > 0 {
+			start--
+		}
+
+		for _, entry := range entries[start:] {
+			if entry.MinTime >= toNanos {
+				break
+			}
+			err := j.readBlock(segment, entry, func(timestamp int64, data []byte) error {
+				if timestamp < fromNanos || timestamp >= toNanos {
+					return nil
+				}
+				return fn(time.Unix(0, timestamp), data)
+			})
+			if err == ErrStop {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Prune removes segments with no records at or after before.
+func (j *Journal) Prune(before time.Time) error {
+	j.lock.Lock()
+	current := j.segment.path
+	j.lock.Unlock()
+
+	segments, err := listSegments(j.dir)
+	if err != nil {
+		return err
+	}
+	for i := 0; i+1 < len(segments); i++ {
+		// A segment only holds records written before the next segment was
+		// started.
+		if segments[i+1].start > before.UnixNano() || segments[i].path == current {
+			break
+		}
+		os.Remove(segments[i].segmentPath())
+		os.Remove(segments[i].indexPath())
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package journal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	segmentExt = ".seg.zst"
+	indexExt   = ".idx"
+
+	// Size of an index entry: min timestamp, offset and length.
+	indexEntrySize = 24
+)
+
+// indexEntry locates a block, a single zstd frame, within a segment.
+type indexEntry struct {
+	// The earliest record timestamp in the block, in Unix nanoseconds.
+	MinTime int64
+
+	Offset int64
+	Length int64
+}
+
+func (e *indexEntry) encode() []byte {
+	buf := make([]byte, indexEntrySize)
+	binary.BigEndian.PutUint64(buf[0:], uint64(e.MinTime))
+	binary.BigEndian.PutUint64(buf[8:], uint64(e.Offset))
+	binary.BigEndian.PutUint64(buf[16:], uint64(e.Length))
+	return buf
+}
+
+func readIndex(filename string) ([]indexEntry, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	entries := []indexEntry{}
+	// A partially written trailing entry is ignored.
+	for i := 0; i+indexEntrySize <= len(buf); i += indexEntrySize {
+		entries = append(entries, indexEntry{
+			MinTime: int64(binary.BigEndian.Uint64(buf[i:])),
+			Offset:  int64(binary.BigEndian.Uint64(buf[i+8:])),
+			Length:  int64(binary.BigEndian.Uint64(buf[i+16:])),
+		})
+	}
+	return entries, nil
+}
+
+// segmentInfo identifies a segment by the time it was started.
+type segmentInfo struct {
+	start int64
+	path  string
+}
+
+func (s segmentInfo) segmentPath() string {
+	return s.path + segmentExt
+}
+
+func (s segmentInfo) indexPath() string {
+	return s.path + indexExt
+}
+
+func newSegmentInfo(dir string, start time.Time) segmentInfo {
+	return segmentInfo{
+		start: start.UnixNano(),
+		path:  filepath.Join(dir, fmt.Sprintf("%020d", start.UnixNano())),
+	}
+}
+
+// listSegments returns the segments in dir, oldest first.
+func listSegments(dir string) ([]segmentInfo, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	segments := []segmentInfo{}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		base := strings.TrimSuffix(name, segmentExt)
+		start, err := strconv.ParseInt(base, 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segmentInfo{
+			start: start,
+			path:  filepath.Join(dir, base),
+		})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].start < segments[j].start
+	})
+	return segments, nil
+}
+
+// Records within a block are encoded as a varint timestamp in Unix
+// nanoseconds, a varint length and the data.
+func appendRecord(block []byte, timestamp int64, data []byte) []byte {
+	var header [2 * binary.MaxVarintLen64]byte
+	n := binary.PutVarint(header[:], timestamp)
+	n += binary.PutUvarint(header[n:], uint64(len(data)))
+	block = append(block, header[:n]...)
+	return append(block, data...)
+}
+
+func decodeRecords(block []byte, fn func(timestamp int64, data []byte) error) error {
+	for len(block) > 0 {
+		timestamp, n := binary.Varint(block)
+		if n <= 0 {
+			return io.ErrUnexpectedEOF
+		}
+		block = block[n:]
+		length, n := binary.Uvarint(block)
+		if n <= 0 || uint64(len(block)-n) < length {
+			return io.ErrUnexpectedEOF
+		}
+		block = block[n:]
+		if err := fn(timestamp, block[:length]); err != nil {
+			return err
+		}
+		block = block[length:]
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package journal
+
+import (
+	"encoding/json"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"time"
+)
+
+// TradeJournal records a trade stream as JSON encoded trades. It is
+// registered as a sink on a trade stream.
+type TradeJournal struct {
+	*Journal
+
+	// Trades at or before this time were journaled before the journal was
+	// opened, and are skipped when replayed from the trade cache.
+	highWater time.Time
+}
+
+func OpenTradeJournal(dir string, options Options) (*TradeJournal, error) {
+	journal, err := Open(dir, options)
+	if err != nil {
+		return nil, err
+	}
+	return &TradeJournal{
+		Journal:   journal,
+		highWater: journal.LastTime(),
+	}, nil
+}
+
+func (j *TradeJournal) Name() string {
+	return "journal"
+}
+
+// Send implements pkg.Sink for trades.
+func (j *TradeJournal) Send(message interface{}) error {
+	trade, ok := message.(pkg.CommonTrade)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", message)
+	}
+	if !trade.Timestamp.After(j.highWater) {
+		return nil
+	}
+	buf, err := json.Marshal(&trade)
+	if err != nil {
+		return err
+	}
+	return j.Append(trade.Timestamp, buf)
+}
+
+// ReadTrades calls fn with each trade in [from, to). If symbol is not empty
+// only trades for that symbol are returned.
+func (j *TradeJournal) ReadTrades(from time.Time, to time.Time, symbol string, fn func(trade pkg.CommonTrade) error) error {
+	return j.Read(from, to, func(timestamp time.Time, data []byte) error {
+		var trade pkg.CommonTrade
+		if err := json.Unmarshal(data, &trade); err != nil {
+			return err
+		}
+		if symbol != "" && trade.Symbol != symbol {
+			return nil
+		}
+		return fn(trade)
+	})
+}
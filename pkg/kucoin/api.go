@@ -0,0 +1,131 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package kucoin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const apiBaseUrl = "https://api.kucoin.com"
+
+var httpClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+type apiResponse struct {
+	Code string          `json:"code"`
+	Msg  string          `json:"msg"`
+	Data json.RawMessage `json:"data"`
+}
+
+func apiRequest(method string, path string, v interface{}) error {
+	request, err := http.NewRequest(method, fmt.Sprintf("%s%s", apiBaseUrl, path), nil)
+	if err != nil {
+		return err
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	var apiResponse apiResponse
+	if err := json.Unmarshal(body, &apiResponse); err != nil {
+		return err
+	}
+	if apiResponse.Code != "200000" {
+		return fmt.Errorf("%s: code=%s: %s", path, apiResponse.Code, apiResponse.Msg)
+	}
+
+	return json.Unmarshal(apiResponse.Data, v)
+}
+
+type InstanceServer struct {
+	Endpoint     string `json:"endpoint"`
+	Protocol     string `json:"protocol"`
+	PingInterval int64  `json:"pingInterval"`
+	PingTimeout  int64  `json:"pingTimeout"`
+}
+
+type BulletResponse struct {
+	Token           string           `json:"token"`
+	InstanceServers []InstanceServer `json:"instanceServers"`
+}
+
+// GetPublicBullet requests a token and server list for connecting to the
+// public websocket feed.
+func GetPublicBullet() (*BulletResponse, error) {
+	var bullet BulletResponse
+	if err := apiRequest("POST", "/api/v1/bullet-public", &bullet); err != nil {
+		return nil, err
+	}
+	if len(bullet.InstanceServers) == 0 {
+		return nil, fmt.Errorf("no websocket servers returned")
+	}
+	return &bullet, nil
+}
+
+type Symbol struct {
+	Symbol         string `json:"symbol"`
+	BaseCurrency   string `json:"baseCurrency"`
+	QuoteCurrency  string `json:"quoteCurrency"`
+	EnableTrading  bool   `json:"enableTrading"`
+	BaseMinSize    string `json:"baseMinSize"`
+	BaseMaxSize    string `json:"baseMaxSize"`
+	QuoteMinSize   string `json:"quoteMinSize"`
+	BaseIncrement  string `json:"baseIncrement"`
+	PriceIncrement string `json:"priceIncrement"`
+}
+
+func GetSymbols() ([]Symbol, error) {
+	symbols := []Symbol{}
+	if err := apiRequest("GET", "/api/v1/symbols", &symbols); err != nil {
+		return nil, err
+	}
+	return symbols, nil
+}
+
+// GetTradingSymbols returns the names of all symbols with trading enabled.
+func GetTradingSymbols() ([]string, error) {
+	symbols, err := GetSymbols()
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, symbol := range symbols {
+		if symbol.EnableTrading {
+			names = append(names, symbol.Symbol)
+		}
+	}
+	return names, nil
+}
+
+// parseFloat parses the decimal strings of the API, returning 0 if empty or
+// invalid.
+func parseFloat(value string) float64 {
+	f, _ := strconv.ParseFloat(value, 64)
+	return f
+}
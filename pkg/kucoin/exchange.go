@@ -0,0 +1,87 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package kucoin
+
+import (
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+)
+
+// Exchange implements pkg.Exchange for KuCoin.
+type Exchange struct {
+	tradeStream  *TradeStream
+	tickerStream *TickerStream
+}
+
+func NewExchange() *Exchange {
+	return &Exchange{
+		tradeStream:  NewTradeStream(),
+		tickerStream: NewTickerStream(),
+	}
+}
+
+func (e *Exchange) Name() string {
+	return "kucoin"
+}
+
+func (e *Exchange) Market() pkg.Market {
+	return pkg.MarketSpot
+}
+
+func (e *Exchange) GetSymbols() ([]string, error) {
+	symbols, err := GetTradingSymbols()
+	if err != nil {
+		return nil, err
+	}
+	return e.tradeStream.SymbolFilter().Apply(symbols), nil
+}
+
+// GetTradingRules returns the rules of all symbols. KuCoin only has a
+// trading enabled flag rather than a status.
+func (e *Exchange) GetTradingRules() (map[string]pkg.TradingRules, error) {
+	symbols, err := GetSymbols()
+	if err != nil {
+		return nil, err
+	}
+	rules := map[string]pkg.TradingRules{}
+	for _, symbol := range symbols {
+		status := "TRADING"
+		if !symbol.EnableTrading {
+			status = "DISABLED"
+		}
+		rules[symbol.Symbol] = pkg.TradingRules{
+			Symbol:      symbol.Symbol,
+			Status:      status,
+			TickSize:    parseFloat(symbol.PriceIncrement),
+			StepSize:    parseFloat(symbol.BaseIncrement),
+			MinQty:      parseFloat(symbol.BaseMinSize),
+			MaxQty:      parseFloat(symbol.BaseMaxSize),
+			MinNotional: parseFloat(symbol.QuoteMinSize),
+		}
+	}
+	return rules, nil
+}
+
+func (e *Exchange) TradeStream() pkg.TradeStream {
+	return e.tradeStream
+}
+
+func (e *Exchange) TickerStream() pkg.TickerStream {
+	return e.tickerStream
+}
+
+func (e *Exchange) DepthStream() pkg.DepthStream {
+	return nil
+}
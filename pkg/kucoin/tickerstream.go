@@ -16,6 +16,7 @@
 package kucoin
 
 import (
+	"context"
 	"gitlab.com/crankykernel/cryptotrader/kucoin"
 	"gitlab.com/crankykernel/cryptoxscanner/pkg"
 	"time"
@@ -25,14 +26,16 @@ import (
 
 type TickerStream struct {
 	client *kucoin.Client
-	cache  *pkg.RedisInputCache
+	cache  pkg.InputCache
 }
 
 func NewTickerStream() (*TickerStream) {
-	cache := pkg.NewRedisInputCache("kucoin.tickers.list")
+	cache := pkg.NewInputCache("kucoin.tickers.list")
 	if err := cache.Ping(); err != nil {
 		log.Printf("Redis cache not available. KuCoin tickers will not be cached.")
 		cache = nil
+	} else {
+		cache.SetRetention(time.Hour)
 	}
 	return &TickerStream{
 		client: kucoin.NewAnonymousClient(),
@@ -49,6 +52,33 @@ func (t *TickerStream) GetTickers() ([]pkg.CommonTicker, error) {
 	return t.toCommonTicker(response), nil
 }
 
+// Run polls the tickers every second, sending the tickers with a price and
+// volume to channel, until ctx is cancelled.
+func (t *TickerStream) Run(ctx context.Context, channel chan []pkg.CommonTicker) {
+	for {
+		tickers, err := t.GetTickers()
+		if err != nil {
+			log.Printf("error: failed to get kucoin tickers: %v", err)
+		} else {
+			filtered := []pkg.CommonTicker{}
+			for _, ticker := range tickers {
+				if ticker.QuoteVolume == 0 || ticker.LastPrice == 0 {
+					continue
+				}
+				filtered = append(filtered, ticker)
+			}
+			select {
+			case channel <- filtered:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if !pkg.Sleep(ctx, 1*time.Second) {
+			return
+		}
+	}
+}
+
 func (t *TickerStream) toCommonTicker(tickers *kucoin.TickResponse) []pkg.CommonTicker {
 	common := []pkg.CommonTicker{}
 	for _, entry := range tickers.Entries {
@@ -63,20 +93,7 @@ func (t *TickerStream) Cache(tickers *kucoin.TickResponse) {
 		return
 	}
 	t.cache.RPush([]byte(tickers.Raw))
-
-	// Trim the list.
-	for {
-		entry, err := t.cache.GetFirst()
-		if err != nil {
-			log.Printf("error: failed to get redis cache entry: %v\n", err)
-			break
-		}
-		if time.Now().Sub(time.Unix(entry.Timestamp, 0)) > time.Hour {
-			t.cache.LRemove()
-		} else {
-			break
-		}
-	}
+	t.cache.Prune()
 }
 
 func (k *TickerStream) ReplayCache(cb func(tickers []pkg.CommonTicker)) {
@@ -96,7 +113,8 @@ func (k *TickerStream) ReplayCache(cb func(tickers []pkg.CommonTicker)) {
 		}
 		var response kucoin.TickResponse
 		if err := json.Unmarshal([]byte(cacheEntry.Message), &response); err != nil {
-			log.Printf("error: failed to decode kucoin ticker cache entry: %v\n", err)
+			log.WithField("exchange", "kucoin").Limited().
+				Errorf("failed to decode kucoin ticker cache entry: %v", err)
 			continue
 		}
 		cb(k.toCommonTicker(&response))
@@ -0,0 +1,401 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package kucoin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/latency"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The maximum number of symbols KuCoin allows in a single topic
+// subscription.
+const maxSymbolsPerSubscribe = 100
+
+type streamMessage struct {
+	Id      string          `json:"id"`
+	Type    string          `json:"type"`
+	Topic   string          `json:"topic"`
+	Subject string          `json:"subject"`
+	Data    json.RawMessage `json:"data"`
+}
+
+type matchMessage struct {
+	Sequence string `json:"sequence"`
+	Symbol   string `json:"symbol"`
+	Side     string `json:"side"`
+	Price    string `json:"price"`
+	Size     string `json:"size"`
+	TradeId  string `json:"tradeId"`
+
+	// Trade time in nanoseconds.
+	Time string `json:"time"`
+}
+
+type TradeStream struct {
+	*pkg.TradePublisher
+	cache  pkg.InputCache
+	health *pkg.StreamHealth
+
+	// Signalled to subscribe to new symbols on the current connection.
+	refresh chan struct{}
+}
+
+func NewTradeStream() *TradeStream {
+	tradeStream := &TradeStream{
+		TradePublisher: pkg.NewTradePublisher("kucoin.trades"),
+		health:         pkg.NewStreamHealth("kucoin.trades", pkg.DefaultBackoffOptions),
+		refresh:        make(chan struct{}, 1),
+	}
+
+	cache := pkg.NewInputCache("kucoin.trades")
+	if err := cache.Ping(); err != nil {
+		log.Printf("Redis not available. No KuCoin trade caching will be done.")
+	} else {
+		tradeStream.cache = cache
+	}
+
+	return tradeStream
+}
+
+// Run replays the cache then streams live trades until ctx is cancelled.
+func (s *TradeStream) Run(ctx context.Context) {
+	restore := pkg.NewRestoreProgress("kucoin.trades")
+	s.restoreFromCache(ctx, restore)
+	restore.Done()
+
+	// Raw messages from the connection, decoded in parallel, in order.
+	bodies := make(chan []byte)
+	go s.publishDecoded(ctx, bodies)
+
+	for {
+		symbols, err := GetTradingSymbols()
+		if err != nil {
+			log.Printf("kucoin: failed to get symbols: %v\n", err)
+			goto TryAgain
+		}
+		symbols = s.SymbolFilter().Apply(symbols)
+		if len(symbols) == 0 {
+			log.Printf("kucoin: got 0 symbols, trying again\n")
+			goto TryAgain
+		}
+		log.Printf("kucoin: got %d symbols\n", len(symbols))
+
+		if err := s.runOnce(ctx, symbols, bodies); ctx.Err() == nil && s.health.Disconnected(ctx, err) {
+			continue
+		}
+		log.Printf("kucoin: trade feed exiting.\n")
+		return
+
+	TryAgain:
+		if !pkg.Sleep(ctx, 1*time.Second) {
+			log.Printf("kucoin: trade feed exiting.\n")
+			return
+		}
+	}
+}
+
+// runOnce connects, subscribes and reads trades into bodies until the
+// connection fails.
+func (s *TradeStream) runOnce(ctx context.Context, symbols []string, bodies chan<- []byte) error {
+	bullet, err := GetPublicBullet()
+	if err != nil {
+		return err
+	}
+	server := selectServer(bullet.InstanceServers)
+
+	url := fmt.Sprintf("%s?token=%s&connectId=%d", server.Endpoint, bullet.Token,
+		time.Now().UnixNano())
+	log.Printf("kucoin: connecting to trade stream.")
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer pkg.CloseOnDone(ctx, conn)()
+
+	writeLock := sync.Mutex{}
+	write := func(v interface{}) error {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+		return conn.WriteJSON(v)
+	}
+
+	subscribe := func(symbols []string) error {
+		for i := 0; i < len(symbols); i += maxSymbolsPerSubscribe {
+			end := i + maxSymbolsPerSubscribe
+			if end > len(symbols) {
+				end = len(symbols)
+			}
+			err := write(map[string]interface{}{
+				"id":             fmt.Sprintf("%d", time.Now().UnixNano()),
+				"type":           "subscribe",
+				"topic":          fmt.Sprintf("/market/match:%s", strings.Join(symbols[i:end], ",")),
+				"privateChannel": false,
+				"response":       true,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := subscribe(symbols); err != nil {
+		return err
+	}
+	log.Printf("kucoin: connected to trade stream.")
+	s.health.Connected()
+
+	pingInterval := time.Duration(server.PingInterval) * time.Millisecond
+	if pingInterval <= 0 {
+		pingInterval = 18 * time.Second
+	}
+	done := make(chan bool)
+	defer close(done)
+	go s.subscribeNew(symbols, subscribe, done)
+	go func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := write(map[string]interface{}{
+					"id":   fmt.Sprintf("%d", time.Now().UnixNano()),
+					"type": "ping",
+				})
+				if err != nil {
+					log.Printf("kucoin: failed to send ping: %v\n", err)
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		_, body, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		s.health.Message()
+		pkg.RecordRaw("kucoin.trades", body)
+
+		select {
+		case bodies <- body:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// RefreshSymbols subscribes to symbols listed since the connection was made
+// without waiting for a reconnect.
+func (s *TradeStream) RefreshSymbols() {
+	select {
+	case s.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// subscribeNew subscribes to the symbols not already subscribed to each
+// time RefreshSymbols is called, until done is closed.
+func (s *TradeStream) subscribeNew(symbols []string, subscribe func([]string) error, done chan bool) {
+	subscribed := map[string]bool{}
+	for _, symbol := range symbols {
+		subscribed[symbol] = true
+	}
+	for {
+		select {
+		case <-done:
+			return
+		case <-s.refresh:
+		}
+		symbols, err := GetTradingSymbols()
+		if err != nil {
+			log.Printf("kucoin: failed to get symbols: %v\n", err)
+			continue
+		}
+		added := []string{}
+		for _, symbol := range s.SymbolFilter().Apply(symbols) {
+			if !subscribed[symbol] {
+				subscribed[symbol] = true
+				added = append(added, symbol)
+			}
+		}
+		if len(added) == 0 {
+			continue
+		}
+		log.Printf("kucoin: subscribing to %d new symbols: %s\n", len(added),
+			strings.Join(added, ", "))
+		if err := subscribe(added); err != nil {
+			log.Printf("kucoin: failed to subscribe to new symbols: %v\n", err)
+			return
+		}
+	}
+}
+
+// publishDecoded decodes the messages from bodies on the decode pool,
+// publishing the trades, until ctx is cancelled.
+func (s *TradeStream) publishDecoded(ctx context.Context, bodies <-chan []byte) {
+	results := make(chan pkg.DecodeResult)
+	go s.DecodePool().Run(ctx, bodies, results, func(body []byte) (interface{}, error) {
+		return s.DecodeTrade(body)
+	})
+	for {
+		var result pkg.DecodeResult
+		select {
+		case result = <-results:
+		case <-ctx.Done():
+			return
+		}
+		if result.Err != nil {
+			log.WithField("exchange", "kucoin").Limited().
+				Errorf("failed to decode trade feed: %v", result.Err)
+			continue
+		}
+		trade := result.Value.(*pkg.CommonTrade)
+		if trade == nil {
+			continue
+		}
+
+		s.cacheAdd(result.Body)
+		s.Publish(*trade)
+	}
+}
+
+// StreamProber selects the instance server the trade stream connects to.
+// The servers are only known once a bullet has been requested.
+var StreamProber = latency.NewProber("kucoin.stream", nil, latency.DialProbe)
+
+// selectServer probes the instance servers of a bullet, returning the
+// fastest or the configured override.
+func selectServer(servers []InstanceServer) InstanceServer {
+	endpoints := []latency.Endpoint{}
+	for _, server := range servers {
+		endpoints = append(endpoints, latency.Endpoint{
+			Name: server.Endpoint,
+			Url:  server.Endpoint,
+		})
+	}
+	StreamProber.SetEndpoints(endpoints)
+	StreamProber.Probe()
+	selected := StreamProber.Selected()
+	for _, server := range servers {
+		if server.Endpoint == selected {
+			return server
+		}
+	}
+	// An override that is not one of the instance servers.
+	server := servers[0]
+	server.Endpoint = selected
+	return server
+}
+
+// DecodeTrade decodes a raw websocket message. If the message is not a trade
+// nil is returned without an error.
+func (s *TradeStream) DecodeTrade(body []byte) (*pkg.CommonTrade, error) {
+	var message streamMessage
+	if err := json.Unmarshal(body, &message); err != nil {
+		return nil, err
+	}
+	if message.Type != "message" || !strings.HasPrefix(message.Topic, "/market/match:") {
+		return nil, nil
+	}
+
+	var match matchMessage
+	if err := json.Unmarshal(message.Data, &match); err != nil {
+		return nil, err
+	}
+
+	trade := pkg.CommonTrade{
+		Symbol:     match.Symbol,
+		BuyerMaker: match.Side == "sell",
+	}
+
+	var err error
+	if trade.Id, err = strconv.ParseInt(match.Sequence, 10, 64); err != nil {
+		return nil, fmt.Errorf("bad sequence: %v", err)
+	}
+	if trade.Price, err = strconv.ParseFloat(match.Price, 64); err != nil {
+		return nil, fmt.Errorf("bad price: %v", err)
+	}
+	if trade.Quantity, err = strconv.ParseFloat(match.Size, 64); err != nil {
+		return nil, fmt.Errorf("bad size: %v", err)
+	}
+	nanos, err := strconv.ParseInt(match.Time, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad time: %v", err)
+	}
+	trade.Timestamp = time.Unix(0, nanos)
+
+	return &trade, nil
+}
+
+func (s *TradeStream) cacheAdd(body []byte) {
+	if s.cache == nil {
+		return
+	}
+	s.cache.RPush(body)
+	s.cache.Prune()
+}
+
+func (s *TradeStream) restoreFromCache(ctx context.Context, progress *pkg.RestoreProgress) {
+	if s.cache == nil {
+		return
+	}
+	if total, err := s.cache.Len(); err == nil {
+		progress.AddTotal(total)
+	}
+
+	log.Printf("kucoin: trade cache replay start\n")
+	start := time.Now()
+	count := 0
+
+	for i := int64(0); ctx.Err() == nil; i++ {
+		entry, err := s.cache.GetN(i)
+		if err != nil {
+			log.Printf("error: redis: %v", err)
+			break
+		}
+		if entry == nil {
+			break
+		}
+		progress.Restored(1)
+		trade, err := s.DecodeTrade([]byte(entry.Message))
+		if err != nil {
+			log.WithField("exchange", "kucoin").Limited().
+				Errorf("failed to decode kucoin trade from cache: %v", err)
+			continue
+		}
+		if trade == nil {
+			continue
+		}
+		s.Publish(*trade)
+		count++
+	}
+
+	log.Printf("kucoin: trade cache replay done: %d trades in %v\n",
+		count, time.Now().Sub(start))
+}
@@ -0,0 +1,275 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package latency measures the round trip time to the alternative
+// endpoints of an exchange and selects the fastest.
+package latency
+
+import (
+	"context"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/metrics"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The number of connections made to an endpoint per probe, the fastest
+// being its round trip time.
+const probeAttempts = 3
+
+const probeTimeout = 5 * time.Second
+
+func init() {
+	metrics.Describe("endpoint_rtt_seconds",
+		"Round trip time to an exchange endpoint measured by the last probe.")
+}
+
+type Endpoint struct {
+	Name string `json:"name"`
+	Url  string `json:"url"`
+}
+
+type Result struct {
+	Endpoint
+
+	// Round trip time in milliseconds, 0 if the probe failed.
+	RttMs    float64   `json:"rtt_ms"`
+	Error    string    `json:"error,omitempty"`
+	ProbedAt time.Time `json:"probed_at"`
+}
+
+type Status struct {
+	Name     string `json:"name"`
+	Selected string `json:"selected"`
+
+	// True if the endpoint is set in the config rather than selected by
+	// probing.
+	Override bool     `json:"override"`
+	Results  []Result `json:"results"`
+}
+
+// ProbeFunc measures the round trip time to url.
+type ProbeFunc func(url string) (time.Duration, error)
+
+// Prober probes the endpoints of a stream, selecting the fastest. Until
+// the first probe the first endpoint is selected.
+type Prober struct {
+	name      string
+	probe     ProbeFunc
+	endpoints []Endpoint
+	override  string
+	selected  string
+	results   []Result
+	lock      sync.RWMutex
+}
+
+var probers = map[string]*Prober{}
+var probersLock sync.Mutex
+
+// NewProber creates and registers a prober for the status API.
+func NewProber(name string, endpoints []Endpoint, probe ProbeFunc) *Prober {
+	p := &Prober{
+		name:  name,
+		probe: probe,
+	}
+	p.SetEndpoints(endpoints)
+	probersLock.Lock()
+	probers[name] = p
+	probersLock.Unlock()
+	return p
+}
+
+// List returns the status of every prober, by name.
+func List() []Status {
+	probersLock.Lock()
+	list := make([]Status, 0, len(probers))
+	for _, p := range probers {
+		list = append(list, p.Status())
+	}
+	probersLock.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+func (p *Prober) Name() string {
+	return p.name
+}
+
+// SetEndpoints replaces the endpoints, for streams that discover them at
+// connect time. The first is selected until probed.
+func (p *Prober) SetEndpoints(endpoints []Endpoint) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.endpoints = endpoints
+	p.results = nil
+	if p.override == "" && len(endpoints) > 0 {
+		p.selected = endpoints[0].Url
+	}
+}
+
+// SetOverride always selects url, disabling selection by probing. An
+// empty url re-enables it.
+func (p *Prober) SetOverride(url string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.override = url
+	if url != "" {
+		p.selected = url
+	} else if len(p.endpoints) > 0 {
+		p.selected = p.endpoints[0].Url
+	}
+}
+
+// Selected returns the url to connect to.
+func (p *Prober) Selected() string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.selected
+}
+
+func (p *Prober) Status() Status {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	results := make([]Result, len(p.results))
+	copy(results, p.results)
+	return Status{
+		Name:     p.name,
+		Selected: p.selected,
+		Override: p.override != "",
+		Results:  results,
+	}
+}
+
+// Probe measures every endpoint concurrently and selects the fastest, unless
+// overridden. The selection is kept if every endpoint fails.
+func (p *Prober) Probe() {
+	p.lock.RLock()
+	endpoints := p.endpoints
+	p.lock.RUnlock()
+
+	results := make([]Result, len(endpoints))
+	wg := sync.WaitGroup{}
+	for i, endpoint := range endpoints {
+		wg.Add(1)
+		go func(i int, endpoint Endpoint) {
+			defer wg.Done()
+			result := Result{
+				Endpoint: endpoint,
+				ProbedAt: time.Now(),
+			}
+			rtt, err := p.probe(endpoint.Url)
+			if err != nil {
+				result.Error = err.Error()
+			} else {
+				result.RttMs = pkg.Round3(rtt.Seconds() * 1000)
+				metrics.GetGauge("endpoint_rtt_seconds", metrics.Labels{
+					"stream":   p.name,
+					"endpoint": endpoint.Name,
+				}).Set(rtt.Seconds())
+			}
+			results[i] = result
+		}(i, endpoint)
+	}
+	wg.Wait()
+
+	var fastest *Result
+	for i := range results {
+		if results[i].Error != "" {
+			continue
+		}
+		if fastest == nil || results[i].RttMs < fastest.RttMs {
+			fastest = &results[i]
+		}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.results = results
+	if p.override != "" || fastest == nil {
+		return
+	}
+	if fastest.Url != p.selected {
+		log.Printf("%s: selected endpoint %s (%s), rtt %vms\n", p.name, fastest.Name,
+			fastest.Url, fastest.RttMs)
+	}
+	p.selected = fastest.Url
+}
+
+// Run probes every interval until ctx is cancelled. Connections switch to
+// a newly selected endpoint when they next reconnect.
+func (p *Prober) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.Probe()
+		}
+	}
+}
+
+// DialProbe measures the time to open a TCP connection to the host of a
+// URL, which takes one round trip.
+func DialProbe(rawUrl string) (time.Duration, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return 0, err
+	}
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "wss", "https":
+			port = "443"
+		case "ws", "http":
+			port = "80"
+		default:
+			return 0, fmt.Errorf("unknown scheme: %s", u.Scheme)
+		}
+	}
+	address := net.JoinHostPort(u.Hostname(), port)
+
+	// Resolve first so DNS isn't included in the round trip.
+	addresses, err := net.LookupHost(u.Hostname())
+	if err != nil {
+		return 0, err
+	}
+	if len(addresses) > 0 {
+		address = net.JoinHostPort(addresses[0], port)
+	}
+
+	fastest := time.Duration(0)
+	for i := 0; i < probeAttempts; i++ {
+		start := time.Now()
+		conn, err := net.DialTimeout("tcp", address, probeTimeout)
+		if err != nil {
+			return 0, err
+		}
+		rtt := time.Now().Sub(start)
+		conn.Close()
+		if fastest == 0 || rtt < fastest {
+			fastest = rtt
+		}
+	}
+	return fastest, nil
+}
@@ -0,0 +1,204 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package liquidation
+
+import (
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"math"
+	"sort"
+	"time"
+)
+
+// The number of price buckets of a heatmap if no price step is given, and
+// the most allowed.
+const (
+	DefaultHeatmapBuckets = 50
+	MaxHeatmapBuckets     = 500
+)
+
+// The most time buckets a heatmap may have.
+const MaxHeatmapIntervals = 1440
+
+// HeatmapOptions describes the buckets of a heatmap.
+type HeatmapOptions struct {
+	// The period covered, ending now, at most the longest of Windows.
+	Window time.Duration
+
+	// The width of each time bucket.
+	Interval time.Duration
+
+	// The width of each price bucket. If 0 a step is chosen so the price
+	// range of the liquidations spans about Buckets buckets.
+	PriceStep float64
+	Buckets   int
+}
+
+func (o HeatmapOptions) Validate() error {
+	longest := Windows[len(Windows)-1]
+	if o.Window <= 0 || o.Window > longest {
+		return fmt.Errorf("window must be positive and at most %v", longest)
+	}
+	if o.Interval <= 0 || o.Interval > o.Window {
+		return fmt.Errorf("interval must be positive and at most the window")
+	}
+	if o.Window/o.Interval > MaxHeatmapIntervals {
+		return fmt.Errorf("window must be at most %d intervals", MaxHeatmapIntervals)
+	}
+	if o.PriceStep < 0 || math.IsNaN(o.PriceStep) || math.IsInf(o.PriceStep, 0) {
+		return fmt.Errorf("price step must not be negative")
+	}
+	if o.Buckets < 0 || o.Buckets > MaxHeatmapBuckets {
+		return fmt.Errorf("buckets must be at most %d", MaxHeatmapBuckets)
+	}
+	return nil
+}
+
+// Heatmap is the liquidation volume of a symbol bucketed by price and time.
+// Only buckets with liquidations are included.
+type Heatmap struct {
+	Symbol          string    `json:"symbol"`
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	IntervalSeconds int64     `json:"interval_seconds"`
+	PriceStep       float64   `json:"price_step"`
+
+	// Liquidations by price and time bucket, ordered by time then price.
+	Cells []HeatmapCell `json:"cells"`
+
+	// Liquidations by price bucket over the whole window, ordered by
+	// price.
+	Levels []HeatmapLevel `json:"levels"`
+}
+
+// HeatmapCell is the liquidations within a price and time bucket. Price and
+// Time are the lower bounds of the bucket.
+type HeatmapCell struct {
+	Time  time.Time `json:"time"`
+	Price float64   `json:"price"`
+	Volume
+}
+
+// HeatmapLevel is the liquidations within a price bucket.
+type HeatmapLevel struct {
+	Price float64 `json:"price"`
+	Volume
+}
+
+// Heatmap returns the liquidations of symbol over the window ending at now
+// bucketed by price and time.
+func (t *Tracker) Heatmap(symbol string, now time.Time, options HeatmapOptions) Heatmap {
+	start := now.Add(-options.Window).Truncate(options.Interval)
+
+	t.lock.Lock()
+	liquidations := []Liquidation{}
+	for _, liquidation := range t.liquidations[symbol] {
+		if !liquidation.Timestamp.Before(start) && !liquidation.Timestamp.After(now) {
+			liquidations = append(liquidations, liquidation)
+		}
+	}
+	t.lock.Unlock()
+
+	step := options.PriceStep
+	if step == 0 {
+		buckets := options.Buckets
+		if buckets == 0 {
+			buckets = DefaultHeatmapBuckets
+		}
+		step = priceStep(liquidations, buckets)
+	}
+
+	heatmap := Heatmap{
+		Symbol:          symbol,
+		Start:           start,
+		End:             now,
+		IntervalSeconds: int64(options.Interval / time.Second),
+		PriceStep:       step,
+		Cells:           []HeatmapCell{},
+		Levels:          []HeatmapLevel{},
+	}
+
+	type cellKey struct {
+		time  time.Time
+		price int64
+	}
+	cells := map[cellKey]*HeatmapCell{}
+	levels := map[int64]*HeatmapLevel{}
+	for _, liquidation := range liquidations {
+		bucket := int64(math.Floor(liquidation.FilledPrice() / step))
+		price := pkg.Round8(float64(bucket) * step)
+		key := cellKey{liquidation.Timestamp.Truncate(options.Interval), bucket}
+		cell := cells[key]
+		if cell == nil {
+			cell = &HeatmapCell{Time: key.time, Price: price}
+			cells[key] = cell
+		}
+		cell.Volume.add(liquidation)
+		level := levels[bucket]
+		if level == nil {
+			level = &HeatmapLevel{Price: price}
+			levels[bucket] = level
+		}
+		level.Volume.add(liquidation)
+	}
+
+	for _, cell := range cells {
+		cell.Volume.round()
+		heatmap.Cells = append(heatmap.Cells, *cell)
+	}
+	sort.Slice(heatmap.Cells, func(i, j int) bool {
+		if !heatmap.Cells[i].Time.Equal(heatmap.Cells[j].Time) {
+			return heatmap.Cells[i].Time.Before(heatmap.Cells[j].Time)
+		}
+		return heatmap.Cells[i].Price < heatmap.Cells[j].Price
+	})
+	for _, level := range levels {
+		level.Volume.round()
+		heatmap.Levels = append(heatmap.Levels, *level)
+	}
+	sort.Slice(heatmap.Levels, func(i, j int) bool {
+		return heatmap.Levels[i].Price < heatmap.Levels[j].Price
+	})
+	return heatmap
+}
+
+// priceStep returns a step of 1, 2 or 5 times a power of 10 that divides
+// the price range of the liquidations into at most about buckets buckets.
+// Rounding the step keeps bucket boundaries stable as the range changes.
+func priceStep(liquidations []Liquidation, buckets int) float64 {
+	low, high := math.Inf(1), math.Inf(-1)
+	for _, liquidation := range liquidations {
+		price := liquidation.FilledPrice()
+		low = math.Min(low, price)
+		high = math.Max(high, price)
+	}
+	if len(liquidations) == 0 || high <= 0 {
+		return 1
+	}
+	span := high - low
+	if span == 0 {
+		// A single price, bucket it to about 0.1%.
+		span = high / 1000 * float64(buckets)
+	}
+	raw := math.Max(span/float64(buckets), 1e-8)
+	magnitude := math.Pow(10, math.Floor(math.Log10(raw)))
+	for _, multiple := range []float64{1, 2, 5, 10} {
+		if step := multiple * magnitude; step >= raw {
+			return pkg.Round8(step)
+		}
+	}
+	return pkg.Round8(10 * magnitude)
+}
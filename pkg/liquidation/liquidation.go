@@ -0,0 +1,285 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package liquidation aggregates the forced orders of futures markets into
+// the long and short liquidation volume of each symbol, and detects large
+// liquidations and cascades of liquidations.
+package liquidation
+
+import (
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/stats"
+	"sync"
+	"time"
+)
+
+// The windows liquidation volume is reported over. Liquidations older than
+// the longest are discarded.
+var Windows = []time.Duration{
+	time.Minute,
+	5 * time.Minute,
+	time.Hour,
+	24 * time.Hour,
+}
+
+// The maximum number of liquidations kept per symbol.
+const maxLiquidationsPerSymbol = 10000
+
+type Config struct {
+	// Single liquidations with a USD value of at least this generate an
+	// event. A threshold of 0 disables these events.
+	ThresholdUsd float64 `mapstructure:"threshold_usd" json:"threshold_usd"`
+
+	// A cascade is when the liquidations of a symbol within CascadeWindow
+	// total at least CascadeUsd. A cascade threshold of 0 disables cascade
+	// events.
+	CascadeUsd    float64       `mapstructure:"cascade_usd" json:"cascade_usd"`
+	CascadeWindow time.Duration `mapstructure:"cascade_window" json:"cascade_window"`
+}
+
+var DefaultConfig = Config{
+	ThresholdUsd:  100000,
+	CascadeUsd:    1000000,
+	CascadeWindow: time.Minute,
+}
+
+// Override returns c with the fields that are set in override replaced.
+func (c Config) Override(override Config) Config {
+	if override.ThresholdUsd != 0 {
+		c.ThresholdUsd = override.ThresholdUsd
+	}
+	if override.CascadeUsd != 0 {
+		c.CascadeUsd = override.CascadeUsd
+	}
+	if override.CascadeWindow != 0 {
+		c.CascadeWindow = override.CascadeWindow
+	}
+	return c
+}
+
+func (c Config) Validate() error {
+	if c.ThresholdUsd < 0 || c.CascadeUsd < 0 {
+		return fmt.Errorf("liquidation thresholds must not be negative")
+	}
+	if c.CascadeUsd > 0 && c.CascadeWindow <= 0 {
+		return fmt.Errorf("liquidation cascade window must be positive")
+	}
+	if c.CascadeWindow > Windows[len(Windows)-1] {
+		return fmt.Errorf("liquidation cascade window must not be longer than %v",
+			Windows[len(Windows)-1])
+	}
+	return nil
+}
+
+// Liquidation is a forced order with its USD value.
+type Liquidation struct {
+	pkg.Liquidation
+	Usd float64 `json:"usd"`
+}
+
+// Position returns the side of the position that was liquidated, long for
+// a forced sell and short for a forced buy.
+func (l Liquidation) Position() string {
+	if l.Side == "buy" {
+		return "short"
+	}
+	return "long"
+}
+
+// Cascade is the liquidations of a symbol over a cascade window.
+type Cascade struct {
+	Symbol string        `json:"symbol"`
+	Window time.Duration `json:"window"`
+	Volume Volume        `json:"volume"`
+}
+
+// Volume is the liquidations of a symbol over a window.
+type Volume struct {
+	Longs    int     `json:"longs"`
+	Shorts   int     `json:"shorts"`
+	LongUsd  float64 `json:"long_usd"`
+	ShortUsd float64 `json:"short_usd"`
+	TotalUsd float64 `json:"total_usd"`
+}
+
+// Metrics returns the volume as a map, the form alert rules can reference.
+func (v Volume) Metrics() map[string]float64 {
+	return map[string]float64{
+		"longs":     float64(v.Longs),
+		"shorts":    float64(v.Shorts),
+		"long_usd":  v.LongUsd,
+		"short_usd": v.ShortUsd,
+		"total_usd": v.TotalUsd,
+	}
+}
+
+// Dominant returns the side of the positions with the most liquidated value.
+func (v Volume) Dominant() string {
+	if v.ShortUsd > v.LongUsd {
+		return "short"
+	}
+	return "long"
+}
+
+// Tracker keeps the recent liquidations of each symbol. Safe for
+// concurrent use.
+type Tracker struct {
+	config Config
+
+	// Recent liquidations per symbol, oldest first.
+	liquidations map[string][]Liquidation
+
+	// The time of the last cascade of each symbol, so a cascade is only
+	// reported once per window.
+	cascades map[string]time.Time
+
+	lock sync.Mutex
+}
+
+func NewTracker(config Config) *Tracker {
+	return &Tracker{
+		config:       config,
+		liquidations: map[string][]Liquidation{},
+		cascades:     map[string]time.Time{},
+	}
+}
+
+func (t *Tracker) Config() Config {
+	return t.config
+}
+
+// Add records a liquidation, with rate converting its quote asset to USD.
+// The cascade is returned if the liquidation completes one.
+func (t *Tracker) Add(l pkg.Liquidation, rate float64) (Liquidation, Cascade, bool) {
+	liquidation := Liquidation{
+		Liquidation: l,
+		Usd:         pkg.Round3(l.Value() * rate),
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	liquidations := append(t.liquidations[l.Symbol], liquidation)
+	cutoff := l.Timestamp.Add(-Windows[len(Windows)-1])
+	start := 0
+	for start < len(liquidations) && liquidations[start].Timestamp.Before(cutoff) {
+		start++
+	}
+	if len(liquidations)-start > maxLiquidationsPerSymbol {
+		start = len(liquidations) - maxLiquidationsPerSymbol
+	}
+	liquidations = liquidations[start:]
+	t.liquidations[l.Symbol] = liquidations
+
+	if t.config.CascadeUsd <= 0 {
+		return liquidation, Cascade{}, false
+	}
+	if last, ok := t.cascades[l.Symbol]; ok && l.Timestamp.Sub(last) < t.config.CascadeWindow {
+		return liquidation, Cascade{}, false
+	}
+	volume := sum(liquidations, l.Timestamp.Add(-t.config.CascadeWindow))
+	if volume.TotalUsd < t.config.CascadeUsd {
+		return liquidation, Cascade{}, false
+	}
+	t.cascades[l.Symbol] = l.Timestamp
+	return liquidation, Cascade{
+		Symbol: l.Symbol,
+		Window: t.config.CascadeWindow,
+		Volume: volume,
+	}, true
+}
+
+// Recent returns up to limit of the most recent liquidations of symbol,
+// newest first. A limit of 0 returns all kept.
+func (t *Tracker) Recent(symbol string, limit int) []Liquidation {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	liquidations := t.liquidations[symbol]
+	result := []Liquidation{}
+	for i := len(liquidations) - 1; i >= 0; i-- {
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+		result = append(result, liquidations[i])
+	}
+	return result
+}
+
+// Volume returns the liquidation volume of symbol over each of the Windows
+// ending at now, keyed by the window name as in stats.WindowName. Nil is
+// returned if the symbol has had no liquidations in the longest window.
+func (t *Tracker) Volume(symbol string, now time.Time) map[string]Volume {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return volumes(t.liquidations[symbol], now)
+}
+
+// VolumeAll returns the liquidation volume of every symbol with
+// liquidations in the longest window.
+func (t *Tracker) VolumeAll(now time.Time) map[string]map[string]Volume {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	result := map[string]map[string]Volume{}
+	for symbol, liquidations := range t.liquidations {
+		if v := volumes(liquidations, now); v != nil {
+			result[symbol] = v
+		}
+	}
+	return result
+}
+
+func volumes(liquidations []Liquidation, now time.Time) map[string]Volume {
+	result := map[string]Volume{}
+	empty := true
+	for _, window := range Windows {
+		volume := sum(liquidations, now.Add(-window))
+		empty = volume.Longs+volume.Shorts == 0
+		result[stats.WindowName(window)] = volume
+	}
+	if empty {
+		return nil
+	}
+	return result
+}
+
+// sum totals the liquidations at or after cutoff.
+func sum(liquidations []Liquidation, cutoff time.Time) Volume {
+	volume := Volume{}
+	for _, liquidation := range liquidations {
+		if liquidation.Timestamp.Before(cutoff) {
+			continue
+		}
+		volume.add(liquidation)
+	}
+	volume.round()
+	return volume
+}
+
+func (v *Volume) add(liquidation Liquidation) {
+	if liquidation.Position() == "short" {
+		v.Shorts++
+		v.ShortUsd += liquidation.Usd
+	} else {
+		v.Longs++
+		v.LongUsd += liquidation.Usd
+	}
+}
+
+func (v *Volume) round() {
+	v.LongUsd = pkg.Round3(v.LongUsd)
+	v.ShortUsd = pkg.Round3(v.ShortUsd)
+	v.TotalUsd = pkg.Round3(v.LongUsd + v.ShortUsd)
+}
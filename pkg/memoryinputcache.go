@@ -0,0 +1,316 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The extension of memory cache snapshot files.
+const memoryCacheSnapshotExt = ".ndjson.gz"
+
+// The memory caches created, so they can be snapshotted on shutdown.
+var memoryCaches = struct {
+	sync.Mutex
+	caches []*MemoryInputCache
+}{}
+
+// MemoryInputCache is an InputCache kept in a ring buffer in memory,
+// bounded by count and retention, for deployments without Redis. If a
+// snapshot directory is configured the cache is restored from it on
+// creation and snapshotted to it periodically and by SaveInputCaches.
+type MemoryInputCache struct {
+	key        string
+	retention  time.Duration
+	maxEntries int
+
+	// The ring buffer, grown up to maxEntries as needed. The oldest entry
+	// is at start.
+	entries []RedisCacheEntry
+	start   int
+	count   int
+
+	// Incremented on each change, so unchanged caches are not
+	// snapshotted again.
+	version      int64
+	savedVersion int64
+
+	snapshotPath string
+	lock         sync.Mutex
+	saveLock     sync.Mutex
+}
+
+func NewMemoryInputCache(key string) *MemoryInputCache {
+	cache := &MemoryInputCache{
+		key:        key,
+		retention:  DefaultRedisOptions.Retention,
+		maxEntries: DefaultCacheOptions.MaxEntries,
+	}
+	if DefaultCacheOptions.SnapshotDir != "" && DefaultCacheOptions.SnapshotInterval > 0 {
+		cache.snapshotPath = filepath.Join(DefaultCacheOptions.SnapshotDir, key+memoryCacheSnapshotExt)
+		if err := cache.restore(); err != nil && !os.IsNotExist(err) {
+			log.Printf("error: memory cache %s: failed to restore snapshot: %v\n", key, err)
+		}
+		go cache.snapshotLoop(DefaultCacheOptions.SnapshotInterval)
+	}
+	memoryCaches.Lock()
+	memoryCaches.caches = append(memoryCaches.caches, cache)
+	memoryCaches.Unlock()
+	return cache
+}
+
+func (c *MemoryInputCache) Ping() error {
+	return nil
+}
+
+func (c *MemoryInputCache) Retention() time.Duration {
+	return c.retention
+}
+
+func (c *MemoryInputCache) SetRetention(retention time.Duration) {
+	c.retention = retention
+}
+
+func (c *MemoryInputCache) RPush(buf []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.push(RedisCacheEntry{
+		Timestamp: time.Now().Unix(),
+		Message:   string(buf),
+	})
+	c.version++
+}
+
+// push appends an entry, dropping the oldest if full. Must be called with
+// the lock held.
+func (c *MemoryInputCache) push(entry RedisCacheEntry) {
+	if c.count == len(c.entries) && len(c.entries) < c.maxEntries {
+		size := len(c.entries) * 2
+		if size < 1024 {
+			size = 1024
+		}
+		if size > c.maxEntries {
+			size = c.maxEntries
+		}
+		grown := make([]RedisCacheEntry, size)
+		for i := 0; i < c.count; i++ {
+			grown[i] = c.entries[(c.start+i)%len(c.entries)]
+		}
+		c.entries = grown
+		c.start = 0
+	}
+	if c.count == len(c.entries) {
+		c.entries[c.start] = entry
+		c.start = (c.start + 1) % len(c.entries)
+		return
+	}
+	c.entries[(c.start+c.count)%len(c.entries)] = entry
+	c.count++
+}
+
+func (c *MemoryInputCache) Prune() {
+	cutoff := time.Now().Add(-c.retention).Unix()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for c.count > 0 && c.entries[c.start].Timestamp < cutoff {
+		c.entries[c.start] = RedisCacheEntry{}
+		c.start = (c.start + 1) % len(c.entries)
+		c.count--
+		c.version++
+	}
+}
+
+func (c *MemoryInputCache) GetN(n int64) (*RedisCacheEntry, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if n < 0 || n >= int64(c.count) {
+		return nil, nil
+	}
+	entry := c.entries[(c.start+int(n))%len(c.entries)]
+	return &entry, nil
+}
+
+func (c *MemoryInputCache) Len() (int64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return int64(c.count), nil
+}
+
+func (c *MemoryInputCache) Trim(n int64) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for ; n > 0 && c.count > 0; n-- {
+		c.entries[c.start] = RedisCacheEntry{}
+		c.start = (c.start + 1) % len(c.entries)
+		c.count--
+		c.version++
+	}
+	return nil
+}
+
+func (c *MemoryInputCache) snapshotLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := c.Save(); err != nil {
+			log.Printf("error: memory cache %s: failed to save snapshot: %v\n", c.key, err)
+		}
+	}
+}
+
+// Save writes the entries to the snapshot file as gzip compressed NDJSON,
+// if they have changed since the last save.
+func (c *MemoryInputCache) Save() error {
+	if c.snapshotPath == "" {
+		return nil
+	}
+	c.saveLock.Lock()
+	defer c.saveLock.Unlock()
+
+	c.lock.Lock()
+	version := c.version
+	if version == c.savedVersion {
+		c.lock.Unlock()
+		return nil
+	}
+	entries := make([]RedisCacheEntry, 0, c.count)
+	for i := 0; i < c.count; i++ {
+		entries = append(entries, c.entries[(c.start+i)%len(c.entries)])
+	}
+	c.lock.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(c.snapshotPath), 0755); err != nil {
+		return err
+	}
+	tmp := c.snapshotPath + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for i := range entries {
+		if err = encoder.Encode(&entries[i]); err != nil {
+			break
+		}
+	}
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, c.snapshotPath)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	c.lock.Lock()
+	c.savedVersion = version
+	c.lock.Unlock()
+	return nil
+}
+
+// restore loads the entries from the snapshot file, skipping those older
+// than the retention.
+func (c *MemoryInputCache) restore() error {
+	file, err := os.Open(c.snapshotPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	cutoff := time.Now().Add(-c.retention).Unix()
+	skipped := 0
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for scanner.Scan() {
+		entry, err := DecodeRedisCacheEntry(scanner.Text())
+		if err != nil {
+			return err
+		}
+		if entry.Timestamp < cutoff {
+			skipped++
+			continue
+		}
+		c.push(entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	c.savedVersion = c.version
+	if skipped > 0 {
+		// Rewrite the snapshot without the expired entries on the next
+		// save.
+		c.version++
+	}
+	log.Printf("memory cache %s: restored %d entries\n", c.key, c.count)
+	return nil
+}
+
+// memoryInputCacheKeys returns the keys of the memory caches snapshotted to
+// dir.
+func memoryInputCacheKeys(dir string) ([]string, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	keys := []string{}
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), memoryCacheSnapshotExt) {
+			keys = append(keys, strings.TrimSuffix(file.Name(), memoryCacheSnapshotExt))
+		}
+	}
+	return keys, nil
+}
+
+// SaveInputCaches snapshots every memory cache with a snapshot directory,
+// called on shutdown once the streams have stopped.
+func SaveInputCaches() {
+	memoryCaches.Lock()
+	caches := append([]*MemoryInputCache{}, memoryCaches.caches...)
+	memoryCaches.Unlock()
+	for _, cache := range caches {
+		if err := cache.Save(); err != nil {
+			log.Printf("error: memory cache %s: failed to save snapshot: %v\n", cache.key, err)
+		}
+	}
+}
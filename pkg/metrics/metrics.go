@@ -0,0 +1,193 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package metrics is a minimal counter and gauge registry that can be
+// exposed in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type Labels map[string]string
+
+func (l Labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+	keys := []string{}
+	for key := range l {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, key := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", key, l[key]))
+	}
+	return fmt.Sprintf("{%s}", strings.Join(pairs, ","))
+}
+
+type Counter struct {
+	value int64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddInt64(&c.value, 1)
+}
+
+func (c *Counter) Add(n int64) {
+	atomic.AddInt64(&c.value, n)
+}
+
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.value)
+}
+
+type Gauge struct {
+	bits uint64
+}
+
+func (g *Gauge) Set(value float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(value))
+}
+
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+type family struct {
+	kind     string
+	help     string
+	counters map[string]*Counter
+	gauges   map[string]*Gauge
+}
+
+type Registry struct {
+	families map[string]*family
+	lock     sync.RWMutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		families: map[string]*family{},
+	}
+}
+
+var DefaultRegistry = NewRegistry()
+
+func (r *Registry) getFamily(name string, kind string) *family {
+	f := r.families[name]
+	if f == nil {
+		f = &family{
+			kind:     kind,
+			counters: map[string]*Counter{},
+			gauges:   map[string]*Gauge{},
+		}
+		r.families[name] = f
+	}
+	return f
+}
+
+// Describe sets the help text for the metric with the given name.
+func (r *Registry) Describe(name string, help string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.getFamily(name, "untyped").help = help
+}
+
+// Counter returns the counter for name and labels, creating it if needed.
+func (r *Registry) Counter(name string, labels Labels) *Counter {
+	key := labels.String()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	f := r.getFamily(name, "counter")
+	f.kind = "counter"
+	if f.counters[key] == nil {
+		f.counters[key] = &Counter{}
+	}
+	return f.counters[key]
+}
+
+// Gauge returns the gauge for name and labels, creating it if needed.
+func (r *Registry) Gauge(name string, labels Labels) *Gauge {
+	key := labels.String()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	f := r.getFamily(name, "gauge")
+	f.kind = "gauge"
+	if f.gauges[key] == nil {
+		f.gauges[key] = &Gauge{}
+	}
+	return f.gauges[key]
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	names := []string{}
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("content-type", "text/plain; version=0.0.4")
+
+	for _, name := range names {
+		f := r.families[name]
+		if f.help != "" {
+			fmt.Fprintf(w, "# HELP %s %s\n", name, f.help)
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, f.kind)
+		keys := []string{}
+		for key := range f.counters {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s%s %d\n", name, key, f.counters[key].Value())
+		}
+		keys = []string{}
+		for key := range f.gauges {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s%s %g\n", name, key, f.gauges[key].Value())
+		}
+	}
+}
+
+func Describe(name string, help string) {
+	DefaultRegistry.Describe(name, help)
+}
+
+func GetCounter(name string, labels Labels) *Counter {
+	return DefaultRegistry.Counter(name, labels)
+}
+
+func GetGauge(name string, labels Labels) *Gauge {
+	return DefaultRegistry.Gauge(name, labels)
+}
+
+func Handler() http.Handler {
+	return DefaultRegistry
+}
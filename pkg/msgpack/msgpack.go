@@ -0,0 +1,445 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package msgpack encodes values as MessagePack, a compact binary
+// alternative to JSON for high frequency websocket consumers.
+//
+// Values are encoded as encoding/json would encode them, but in
+// MessagePack: structs become maps keyed by their json field names,
+// honouring omitempty and "-", and embedded structs are flattened.
+// time.Time is encoded with the MessagePack timestamp extension (type -1)
+// rather than as a string. Types implementing json.Marshaler are encoded
+// from their JSON.
+package msgpack
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The extension type of the MessagePack timestamp, -1 as a signed byte.
+const timestampExtension = 0xff
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// Marshal returns the MessagePack encoding of v.
+func Marshal(v interface{}) ([]byte, error) {
+	e := &encoder{}
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return e.buf.Bytes(), nil
+}
+
+type encoder struct {
+	buf     bytes.Buffer
+	scratch [9]byte
+}
+
+func (e *encoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.buf.WriteByte(0xc0)
+		return nil
+	}
+
+	if v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			e.buf.WriteByte(0xc0)
+			return nil
+		}
+		return e.encode(v.Elem())
+	}
+
+	t := v.Type()
+	if t == timeType {
+		e.encodeTime(v.Interface().(time.Time))
+		return nil
+	}
+	if t.Implements(jsonMarshalerType) {
+		return e.encodeJSON(v.Interface().(json.Marshaler))
+	}
+	if t.Implements(textMarshalerType) {
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return err
+		}
+		e.encodeString(string(text))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf.WriteByte(0xc3)
+		} else {
+			e.buf.WriteByte(0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.encodeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.encodeUint(v.Uint())
+	case reflect.Float32:
+		e.scratch[0] = 0xca
+		binary.BigEndian.PutUint32(e.scratch[1:], math.Float32bits(float32(v.Float())))
+		e.buf.Write(e.scratch[:5])
+	case reflect.Float64:
+		e.scratch[0] = 0xcb
+		binary.BigEndian.PutUint64(e.scratch[1:], math.Float64bits(v.Float()))
+		e.buf.Write(e.scratch[:9])
+	case reflect.String:
+		e.encodeString(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			e.buf.WriteByte(0xc0)
+			return nil
+		}
+		if t.Elem().Kind() == reflect.Uint8 {
+			e.encodeBytes(v.Bytes())
+			return nil
+		}
+		return e.encodeArray(v)
+	case reflect.Array:
+		return e.encodeArray(v)
+	case reflect.Map:
+		return e.encodeMap(v)
+	case reflect.Struct:
+		return e.encodeStruct(v)
+	default:
+		return fmt.Errorf("msgpack: unsupported type: %s", t)
+	}
+	return nil
+}
+
+func (e *encoder) encodeInt(i int64) {
+	switch {
+	case i >= 0:
+		e.encodeUint(uint64(i))
+	case i >= -32:
+		e.buf.WriteByte(byte(i))
+	case i >= math.MinInt8:
+		e.buf.WriteByte(0xd0)
+		e.buf.WriteByte(byte(i))
+	case i >= math.MinInt16:
+		e.scratch[0] = 0xd1
+		binary.BigEndian.PutUint16(e.scratch[1:], uint16(i))
+		e.buf.Write(e.scratch[:3])
+	case i >= math.MinInt32:
+		e.scratch[0] = 0xd2
+		binary.BigEndian.PutUint32(e.scratch[1:], uint32(i))
+		e.buf.Write(e.scratch[:5])
+	default:
+		e.scratch[0] = 0xd3
+		binary.BigEndian.PutUint64(e.scratch[1:], uint64(i))
+		e.buf.Write(e.scratch[:9])
+	}
+}
+
+func (e *encoder) encodeUint(u uint64) {
+	switch {
+	case u <= math.MaxInt8:
+		e.buf.WriteByte(byte(u))
+	case u <= math.MaxUint8:
+		e.buf.WriteByte(0xcc)
+		e.buf.WriteByte(byte(u))
+	case u <= math.MaxUint16:
+		e.scratch[0] = 0xcd
+		binary.BigEndian.PutUint16(e.scratch[1:], uint16(u))
+		e.buf.Write(e.scratch[:3])
+	case u <= math.MaxUint32:
+		e.scratch[0] = 0xce
+		binary.BigEndian.PutUint32(e.scratch[1:], uint32(u))
+		e.buf.Write(e.scratch[:5])
+	default:
+		e.scratch[0] = 0xcf
+		binary.BigEndian.PutUint64(e.scratch[1:], u)
+		e.buf.Write(e.scratch[:9])
+	}
+}
+
+// encodeLength writes the header of a str, bin, array or map of length n,
+// using the fix format if given and n fits.
+func (e *encoder) encodeLength(n int, fix byte, fixMax int, b8 byte, b16 byte, b32 byte) {
+	switch {
+	case fix != 0 && n <= fixMax:
+		e.buf.WriteByte(fix | byte(n))
+	case b8 != 0 && n <= math.MaxUint8:
+		e.buf.WriteByte(b8)
+		e.buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		e.scratch[0] = b16
+		binary.BigEndian.PutUint16(e.scratch[1:], uint16(n))
+		e.buf.Write(e.scratch[:3])
+	default:
+		e.scratch[0] = b32
+		binary.BigEndian.PutUint32(e.scratch[1:], uint32(n))
+		e.buf.Write(e.scratch[:5])
+	}
+}
+
+func (e *encoder) encodeString(s string) {
+	e.encodeLength(len(s), 0xa0, 31, 0xd9, 0xda, 0xdb)
+	e.buf.WriteString(s)
+}
+
+func (e *encoder) encodeBytes(b []byte) {
+	e.encodeLength(len(b), 0, 0, 0xc4, 0xc5, 0xc6)
+	e.buf.Write(b)
+}
+
+func (e *encoder) encodeArray(v reflect.Value) error {
+	n := v.Len()
+	e.encodeLength(n, 0x90, 15, 0, 0xdc, 0xdd)
+	for i := 0; i < n; i++ {
+		if err := e.encode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *encoder) encodeMap(v reflect.Value) error {
+	if v.IsNil() {
+		e.buf.WriteByte(0xc0)
+		return nil
+	}
+	e.encodeLength(v.Len(), 0x80, 15, 0, 0xde, 0xdf)
+	iter := v.MapRange()
+	for iter.Next() {
+		if err := e.encode(iter.Key()); err != nil {
+			return err
+		}
+		if err := e.encode(iter.Value()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *encoder) encodeStruct(v reflect.Value) error {
+	fields := cachedFields(v.Type())
+	present := make([]reflect.Value, 0, len(fields))
+	for _, f := range fields {
+		value, ok := fieldByIndex(v, f.index)
+		if !ok || (f.omitEmpty && isEmptyValue(value)) {
+			present = append(present, reflect.Value{})
+			continue
+		}
+		present = append(present, value)
+	}
+
+	n := 0
+	for _, value := range present {
+		if value.IsValid() {
+			n++
+		}
+	}
+	e.encodeLength(n, 0x80, 15, 0, 0xde, 0xdf)
+	for i, value := range present {
+		if !value.IsValid() {
+			continue
+		}
+		e.encodeString(fields[i].name)
+		if err := e.encode(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeTime writes t with the timestamp extension, using the 32, 64 or 96
+// bit format, whichever is the smallest that fits. The 32 bit format holds
+// unsigned seconds only, the 64 bit format 34 bit seconds and nanoseconds.
+func (e *encoder) encodeTime(t time.Time) {
+	sec := t.Unix()
+	nsec := int64(t.Nanosecond())
+	switch {
+	case sec >= 0 && sec <= math.MaxUint32 && nsec == 0:
+		e.buf.Write([]byte{0xd6, timestampExtension})
+		binary.BigEndian.PutUint32(e.scratch[:4], uint32(sec))
+		e.buf.Write(e.scratch[:4])
+	case sec>>34 == 0:
+		e.buf.Write([]byte{0xd7, timestampExtension})
+		binary.BigEndian.PutUint64(e.scratch[:8], uint64(nsec)<<34|uint64(sec))
+		e.buf.Write(e.scratch[:8])
+	default:
+		e.buf.Write([]byte{0xc7, 12, timestampExtension})
+		binary.BigEndian.PutUint32(e.scratch[:4], uint32(nsec))
+		e.buf.Write(e.scratch[:4])
+		binary.BigEndian.PutUint64(e.scratch[:8], uint64(sec))
+		e.buf.Write(e.scratch[:8])
+	}
+}
+
+// encodeJSON encodes a json.Marshaler by decoding its JSON and encoding
+// the result.
+func (e *encoder) encodeJSON(m json.Marshaler) error {
+	buf, err := m.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(buf))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return err
+	}
+	return e.encode(reflect.ValueOf(normalizeNumbers(value)))
+}
+
+// normalizeNumbers replaces json.Numbers in a decoded JSON value with int64
+// if integral, otherwise float64.
+func normalizeNumbers(value interface{}) interface{} {
+	switch value := value.(type) {
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return i
+		}
+		f, _ := value.Float64()
+		return f
+	case []interface{}:
+		for i := range value {
+			value[i] = normalizeNumbers(value[i])
+		}
+	case map[string]interface{}:
+		for key := range value {
+			value[key] = normalizeNumbers(value[key])
+		}
+	}
+	return value
+}
+
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+var fieldCache = struct {
+	sync.RWMutex
+	fields map[reflect.Type][]field
+}{fields: map[reflect.Type][]field{}}
+
+func cachedFields(t reflect.Type) []field {
+	fieldCache.RLock()
+	fields, ok := fieldCache.fields[t]
+	fieldCache.RUnlock()
+	if ok {
+		return fields
+	}
+	fields = typeFields(t, nil)
+	fieldCache.Lock()
+	fieldCache.fields[t] = fields
+	fieldCache.Unlock()
+	return fields
+}
+
+// typeFields returns the encoded fields of a struct type. Untagged embedded
+// structs are flattened, fields of the outer struct win over embedded
+// fields of the same name.
+func typeFields(t reflect.Type, index []int) []field {
+	fields := []field{}
+	embedded := []field{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options := tag, ""
+		if comma := strings.Index(tag, ","); comma >= 0 {
+			name, options = tag[:comma], tag[comma+1:]
+		}
+		fieldIndex := append(append([]int{}, index...), i)
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct && ft != timeType {
+				embedded = append(embedded, typeFields(ft, fieldIndex)...)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, field{
+			name:      name,
+			index:     fieldIndex,
+			omitEmpty: strings.Contains(","+options+",", ",omitempty,"),
+		})
+	}
+	for _, f := range embedded {
+		shadowed := false
+		for _, existing := range fields {
+			if existing.name == f.name {
+				shadowed = true
+				break
+			}
+		}
+		if !shadowed {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// fieldByIndex returns the field of v at index, false if it is reached
+// through a nil embedded pointer.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
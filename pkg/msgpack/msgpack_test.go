@@ -0,0 +1,141 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package msgpack
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+type embedded struct {
+	Symbol string `json:"symbol"`
+	Price  float64
+}
+
+type record struct {
+	embedded
+	Id      int64    `json:"id"`
+	Ignored string   `json:"-"`
+	Note    string   `json:"note,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+	hidden  int
+}
+
+type rawJSON string
+
+func (r rawJSON) MarshalJSON() ([]byte, error) {
+	return []byte(r), nil
+}
+
+func TestMarshal(t *testing.T) {
+	// Expected encodings from the MessagePack specification.
+	tests := []struct {
+		name     string
+		value    interface{}
+		expected []byte
+	}{
+		{"nil", nil, []byte{0xc0}},
+		{"nil pointer", (*int)(nil), []byte{0xc0}},
+		{"false", false, []byte{0xc2}},
+		{"true", true, []byte{0xc3}},
+		{"positive fixint", 127, []byte{0x7f}},
+		{"uint8", 128, []byte{0xcc, 0x80}},
+		{"uint16", 256, []byte{0xcd, 0x01, 0x00}},
+		{"uint32", 65536, []byte{0xce, 0x00, 0x01, 0x00, 0x00}},
+		{"uint64", uint64(math.MaxUint32 + 1), []byte{0xcf, 0, 0, 0, 0x01, 0, 0, 0, 0}},
+		{"negative fixint", -32, []byte{0xe0}},
+		{"int8", -33, []byte{0xd0, 0xdf}},
+		{"int16", -129, []byte{0xd1, 0xff, 0x7f}},
+		{"int32", -32769, []byte{0xd2, 0xff, 0xff, 0x7f, 0xff}},
+		{"int64", int64(math.MinInt32 - 1), []byte{0xd3, 0xff, 0xff, 0xff, 0xff, 0x7f, 0xff, 0xff, 0xff}},
+		{"float32", float32(1.5), []byte{0xca, 0x3f, 0xc0, 0x00, 0x00}},
+		{"float64", 1.5, []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{"fixstr", "abc", []byte{0xa3, 'a', 'b', 'c'}},
+		{"str8", strings.Repeat("a", 32), append([]byte{0xd9, 32}, strings.Repeat("a", 32)...)},
+		{"str16", strings.Repeat("a", 256), append([]byte{0xda, 0x01, 0x00}, strings.Repeat("a", 256)...)},
+		{"bin8", []byte{1, 2}, []byte{0xc4, 0x02, 0x01, 0x02}},
+		{"fixarray", []int{1, 2}, []byte{0x92, 0x01, 0x02}},
+		{"array16", make([]bool, 16), append([]byte{0xdc, 0x00, 0x10}, bytes.Repeat([]byte{0xc2}, 16)...)},
+		{"fixed size array", [2]string{"a", ""}, []byte{0x92, 0xa1, 'a', 0xa0}},
+		{"nil slice", []int(nil), []byte{0xc0}},
+		{"fixmap", map[string]int{"a": 1}, []byte{0x81, 0xa1, 'a', 0x01}},
+		{"struct", record{embedded: embedded{Symbol: "BTC", Price: 1.5}, Id: 7, Ignored: "x", hidden: 1},
+			[]byte{0x83, 0xa2, 'i', 'd', 0x07,
+				0xa6, 's', 'y', 'm', 'b', 'o', 'l', 0xa3, 'B', 'T', 'C',
+				0xa5, 'P', 'r', 'i', 'c', 'e', 0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{"omitempty present", struct {
+			Note string `json:"note,omitempty"`
+		}{"x"}, []byte{0x81, 0xa4, 'n', 'o', 't', 'e', 0xa1, 'x'}},
+		{"json marshaler", rawJSON(`{"a":[1,-2,0.5]}`),
+			[]byte{0x81, 0xa1, 'a', 0x93, 0x01, 0xfe, 0xcb, 0x3f, 0xe0, 0, 0, 0, 0, 0, 0}},
+		{"text marshaler", json.Number("12"), []byte{0xa2, '1', '2'}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf, err := Marshal(test.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf, test.expected) {
+				t.Errorf("expected % x, got % x", test.expected, buf)
+			}
+		})
+	}
+}
+
+func TestMarshalTime(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    time.Time
+		expected []byte
+	}{
+		{"timestamp32 epoch", time.Unix(0, 0),
+			[]byte{0xd6, 0xff, 0, 0, 0, 0}},
+		{"timestamp32 max", time.Unix(math.MaxUint32, 0),
+			[]byte{0xd6, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"timestamp64 past 32 bits", time.Unix(math.MaxUint32+1, 0),
+			[]byte{0xd7, 0xff, 0, 0, 0, 0x01, 0, 0, 0, 0}},
+		{"timestamp64 nanoseconds", time.Unix(1, 1),
+			[]byte{0xd7, 0xff, 0, 0, 0, 0x04, 0, 0, 0, 0x01}},
+		{"timestamp64 max", time.Unix(1<<34-1, 999999999),
+			[]byte{0xd7, 0xff, 0xee, 0x6b, 0x27, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"timestamp96 past 34 bits", time.Unix(1<<34, 0),
+			[]byte{0xc7, 0x0c, 0xff, 0, 0, 0, 0, 0, 0, 0, 0x04, 0, 0, 0, 0}},
+		{"timestamp96 negative", time.Unix(-1, 5),
+			[]byte{0xc7, 0x0c, 0xff, 0, 0, 0, 0x05, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf, err := Marshal(test.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf, test.expected) {
+				t.Errorf("expected % x, got % x", test.expected, buf)
+			}
+		})
+	}
+}
+
+func TestMarshalUnsupported(t *testing.T) {
+	if _, err := Marshal(make(chan int)); err == nil {
+		t.Errorf("expected an error for a channel")
+	}
+}
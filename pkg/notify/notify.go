@@ -0,0 +1,214 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/metrics"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+func init() {
+	metrics.Describe("notifications_sent_total",
+		"Notifications successfully delivered.")
+	metrics.Describe("notifications_dropped_total",
+		"Notifications dropped by rate limiting.")
+	metrics.Describe("notifications_errors_total",
+		"Notifications that failed to be delivered.")
+}
+
+const defaultTemplate = `{{.Message}}`
+
+// The default maximum number of messages per minute for a channel.
+const defaultRateLimit = 20
+
+var httpClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+type Config struct {
+	Name string `mapstructure:"name" json:"name"`
+
+	// telegram or discord.
+	Type string `mapstructure:"type" json:"type"`
+
+	// Telegram bot token and chat.
+	BotToken string `mapstructure:"bot_token" json:"-"`
+	ChatId   string `mapstructure:"chat_id" json:"chat_id,omitempty"`
+
+	// Discord webhook URL.
+	Url string `mapstructure:"url" json:"-"`
+
+	// A text/template rendered with the notification data.
+	Template string `mapstructure:"template" json:"template,omitempty"`
+
+	// Maximum messages per minute. Messages over the limit are dropped.
+	RateLimit int `mapstructure:"rate_limit" json:"rate_limit,omitempty"`
+}
+
+// Notifier delivers a text message.
+type Notifier interface {
+	Notify(text string) error
+}
+
+// Channel is a configured notifier with its message template and rate
+// limit.
+type Channel struct {
+	name     string
+	notifier Notifier
+	template *template.Template
+	limiter  *pkg.RateLimiter
+
+	sent    *metrics.Counter
+	dropped *metrics.Counter
+	errors  *metrics.Counter
+}
+
+func NewChannel(config Config) (*Channel, error) {
+	if config.Name == "" {
+		return nil, fmt.Errorf("notifier name required")
+	}
+
+	var notifier Notifier
+	switch strings.ToLower(config.Type) {
+	case "telegram":
+		if config.BotToken == "" || config.ChatId == "" {
+			return nil, fmt.Errorf("notifier %s: bot_token and chat_id required", config.Name)
+		}
+		notifier = &TelegramNotifier{BotToken: config.BotToken, ChatId: config.ChatId}
+	case "discord":
+		if config.Url == "" {
+			return nil, fmt.Errorf("notifier %s: url required", config.Name)
+		}
+		notifier = &DiscordNotifier{Url: config.Url}
+	default:
+		return nil, fmt.Errorf("notifier %s: unknown type %s", config.Name, config.Type)
+	}
+
+	text := config.Template
+	if text == "" {
+		text = defaultTemplate
+	}
+	tmpl, err := template.New(config.Name).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("notifier %s: invalid template: %v", config.Name, err)
+	}
+
+	rate := config.RateLimit
+	if rate <= 0 {
+		rate = defaultRateLimit
+	}
+
+	labels := metrics.Labels{"notifier": config.Name}
+	return &Channel{
+		name:     config.Name,
+		notifier: notifier,
+		template: tmpl,
+		limiter:  pkg.NewRateLimiter(rate, time.Minute),
+		sent:     metrics.GetCounter("notifications_sent_total", labels),
+		dropped:  metrics.GetCounter("notifications_dropped_total", labels),
+		errors:   metrics.GetCounter("notifications_errors_total", labels),
+	}, nil
+}
+
+func (c *Channel) Name() string {
+	return c.name
+}
+
+// Send renders data with the channel's template and delivers it, unless the
+// rate limit has been reached. Also implements pkg.Sink.
+func (c *Channel) Send(data interface{}) error {
+	if !c.limiter.Allow() {
+		c.dropped.Inc()
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := c.template.Execute(&buf, data); err != nil {
+		c.errors.Inc()
+		return err
+	}
+	return c.notify(buf.String())
+}
+
+// SendText delivers text as is, without the channel's template, unless the
+// rate limit has been reached.
+func (c *Channel) SendText(text string) error {
+	if !c.limiter.Allow() {
+		c.dropped.Inc()
+		return nil
+	}
+	return c.notify(text)
+}
+
+func (c *Channel) notify(text string) error {
+	if err := c.notifier.Notify(text); err != nil {
+		c.errors.Inc()
+		return err
+	}
+	c.sent.Inc()
+	return nil
+}
+
+func postJSON(url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	response, err := httpClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("status %d", response.StatusCode)
+	}
+	return nil
+}
+
+type TelegramNotifier struct {
+	BotToken string
+	ChatId   string
+}
+
+func (n *TelegramNotifier) Notify(text string) error {
+	return postJSON(fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", n.BotToken),
+		map[string]interface{}{
+			"chat_id": n.ChatId,
+			"text":    text,
+		})
+}
+
+type DiscordNotifier struct {
+	Url string
+}
+
+// Discord rejects messages longer than this.
+const discordMaxLength = 2000
+
+func (n *DiscordNotifier) Notify(text string) error {
+	if len(text) > discordMaxLength {
+		text = text[:discordMaxLength]
+	}
+	return postJSON(n.Url, map[string]interface{}{
+		"content": text,
+	})
+}
@@ -0,0 +1,275 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package persist
+
+import (
+	"database/sql"
+	"encoding/json"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/candles"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/events"
+	"time"
+)
+
+// Trades returns up to limit trades of symbol in the range [from, to),
+// oldest first.
+func (s *Store) Trades(exchange string, symbol string, from time.Time, to time.Time,
+	limit int) ([]pkg.CommonTrade, error) {
+	rows, err := s.db.Query(s.bind(`SELECT symbol, id, timestamp, price, quantity, buyer_maker
+		FROM trades
+		WHERE exchange = ? AND symbol = ? AND timestamp >= ? AND timestamp < ?
+		ORDER BY timestamp, id LIMIT ?`),
+		exchange, symbol, toMillis(from), toMillis(to), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	trades := []pkg.CommonTrade{}
+	for rows.Next() {
+		var trade pkg.CommonTrade
+		var timestamp int64
+		if err := rows.Scan(&trade.Symbol, &trade.Id, &timestamp, &trade.Price,
+			&trade.Quantity, &trade.BuyerMaker); err != nil {
+			return nil, err
+		}
+		trade.Timestamp = fromMillis(timestamp)
+		trades = append(trades, trade)
+	}
+	return trades, rows.Err()
+}
+
+// ReadTrades calls fn with each trade of symbol in the range [from, to),
+// oldest first, stopping at the first error which is returned. Unlike Trades
+// the range is not limited.
+func (s *Store) ReadTrades(exchange string, symbol string, from time.Time, to time.Time,
+	fn func(trade pkg.CommonTrade) error) error {
+	rows, err := s.db.Query(s.bind(`SELECT symbol, id, timestamp, price, quantity, buyer_maker
+		FROM trades
+		WHERE exchange = ? AND symbol = ? AND timestamp >= ? AND timestamp < ?
+		ORDER BY timestamp, id`),
+		exchange, symbol, toMillis(from), toMillis(to))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var trade pkg.CommonTrade
+		var timestamp int64
+		if err := rows.Scan(&trade.Symbol, &trade.Id, &timestamp, &trade.Price,
+			&trade.Quantity, &trade.BuyerMaker); err != nil {
+			return err
+		}
+		trade.Timestamp = fromMillis(timestamp)
+		if err := fn(trade); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ReadExchangeTrades calls fn with each trade of every symbol of exchange in
+// the range [from, to), oldest first, stopping at the first error which is
+// returned.
+func (s *Store) ReadExchangeTrades(exchange string, from time.Time, to time.Time,
+	fn func(trade pkg.CommonTrade) error) error {
+	rows, err := s.db.Query(s.bind(`SELECT symbol, id, timestamp, price, quantity, buyer_maker
+		FROM trades
+		WHERE exchange = ? AND timestamp >= ? AND timestamp < ?
+		ORDER BY timestamp, symbol, id`),
+		exchange, toMillis(from), toMillis(to))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var trade pkg.CommonTrade
+		var timestamp int64
+		if err := rows.Scan(&trade.Symbol, &trade.Id, &timestamp, &trade.Price,
+			&trade.Quantity, &trade.BuyerMaker); err != nil {
+			return err
+		}
+		trade.Timestamp = fromMillis(timestamp)
+		if err := fn(trade); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Candles returns up to limit candles of symbol at interval with an open
+// time in the range [from, to), oldest first.
+func (s *Store) Candles(exchange string, symbol string, interval time.Duration,
+	from time.Time, to time.Time, limit int) ([]candles.Candle, error) {
+	rows, err := s.db.Query(s.bind(`SELECT symbol, open_time, open, high, low, close,
+		volume, quote_volume, taker_buy_quote_volume, trades
+		FROM candles
+		WHERE exchange = ? AND symbol = ? AND interval_seconds = ?
+		AND open_time >= ? AND open_time < ?
+		ORDER BY open_time LIMIT ?`),
+		exchange, symbol, int64(interval/time.Second), toMillis(from), toMillis(to), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanCandles(rows, interval)
+}
+
+// RecentCandles returns the candles of every symbol at interval with an
+// open time at or after since, oldest first, keyed by symbol. Used to seed
+// the candle builder on startup.
+func (s *Store) RecentCandles(exchange string, interval time.Duration,
+	since time.Time) (map[string][]candles.Candle, error) {
+	rows, err := s.db.Query(s.bind(`SELECT symbol, open_time, open, high, low, close,
+		volume, quote_volume, taker_buy_quote_volume, trades
+		FROM candles
+		WHERE exchange = ? AND interval_seconds = ? AND open_time >= ?
+		ORDER BY symbol, open_time`),
+		exchange, int64(interval/time.Second), toMillis(since))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	all, err := scanCandles(rows, interval)
+	if err != nil {
+		return nil, err
+	}
+	bySymbol := map[string][]candles.Candle{}
+	for _, candle := range all {
+		bySymbol[candle.Symbol] = append(bySymbol[candle.Symbol], candle)
+	}
+	return bySymbol, nil
+}
+
+func scanCandles(rows *sql.Rows, interval time.Duration) ([]candles.Candle, error) {
+	result := []candles.Candle{}
+	for rows.Next() {
+		candle := candles.Candle{
+			Interval: interval,
+			Closed:   true,
+		}
+		var openTime int64
+		if err := rows.Scan(&candle.Symbol, &openTime, &candle.Open, &candle.High,
+			&candle.Low, &candle.Close, &candle.Volume, &candle.QuoteVolume,
+			&candle.TakerBuyQuoteVolume, &candle.Trades); err != nil {
+			return nil, err
+		}
+		candle.OpenTime = fromMillis(openTime)
+		result = append(result, candle)
+	}
+	return result, rows.Err()
+}
+
+// candlesBetween returns the candles of exchange, of every interval, with
+// an open time in the range [from, to).
+func (s *Store) candlesBetween(exchange string, from time.Time, to time.Time) ([]candles.Candle, error) {
+	rows, err := s.db.Query(s.bind(`SELECT symbol, interval_seconds, open_time, open, high,
+		low, close, volume, quote_volume, taker_buy_quote_volume, trades
+		FROM candles
+		WHERE exchange = ? AND open_time >= ? AND open_time < ?
+		ORDER BY symbol, interval_seconds, open_time`),
+		exchange, toMillis(from), toMillis(to))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := []candles.Candle{}
+	for rows.Next() {
+		candle := candles.Candle{
+			Closed: true,
+		}
+		var intervalSeconds int64
+		var openTime int64
+		if err := rows.Scan(&candle.Symbol, &intervalSeconds, &openTime, &candle.Open,
+			&candle.High, &candle.Low, &candle.Close, &candle.Volume, &candle.QuoteVolume,
+			&candle.TakerBuyQuoteVolume, &candle.Trades); err != nil {
+			return nil, err
+		}
+		candle.Interval = time.Duration(intervalSeconds) * time.Second
+		candle.OpenTime = fromMillis(openTime)
+		result = append(result, candle)
+	}
+	return result, rows.Err()
+}
+
+// candleExchanges returns the exchanges with candles with an open time in
+// the range [from, to).
+func (s *Store) candleExchanges(from time.Time, to time.Time) ([]string, error) {
+	rows, err := s.db.Query(s.bind(`SELECT DISTINCT exchange FROM candles
+		WHERE open_time >= ? AND open_time < ?`), toMillis(from), toMillis(to))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	exchanges := []string{}
+	for rows.Next() {
+		var exchange string
+		if err := rows.Scan(&exchange); err != nil {
+			return nil, err
+		}
+		exchanges = append(exchanges, exchange)
+	}
+	return exchanges, rows.Err()
+}
+
+// Events returns up to limit events of symbol in the range [from, to),
+// oldest first.
+func (s *Store) Events(exchange string, symbol string, from time.Time, to time.Time,
+	limit int) ([]events.Event, error) {
+	return s.eventsBetween(exchange, symbol, from, to, limit)
+}
+
+// eventsBetween returns the events in the range [from, to), oldest first,
+// limited to exchange and symbol if not empty. A limit of 0 returns all.
+func (s *Store) eventsBetween(exchange string, symbol string, from time.Time, to time.Time,
+	limit int) ([]events.Event, error) {
+	query := `SELECT exchange, symbol, type, timestamp, message, data
+		FROM events WHERE timestamp >= ? AND timestamp < ?`
+	args := []interface{}{toMillis(from), toMillis(to)}
+	if exchange != "" {
+		query += ` AND exchange = ?`
+		args = append(args, exchange)
+	}
+	if symbol != "" {
+		query += ` AND symbol = ?`
+		args = append(args, symbol)
+	}
+	query += ` ORDER BY timestamp`
+	if limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, limit)
+	}
+	rows, err := s.db.Query(s.bind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := []events.Event{}
+	for rows.Next() {
+		var event events.Event
+		var timestamp int64
+		var data string
+		if err := rows.Scan(&event.Exchange, &event.Symbol, &event.Type, &timestamp,
+			&event.Message, &data); err != nil {
+			return nil, err
+		}
+		event.Timestamp = fromMillis(timestamp)
+		if err := json.Unmarshal([]byte(data), &event.Data); err != nil {
+			return nil, err
+		}
+		result = append(result, event)
+	}
+	return result, rows.Err()
+}
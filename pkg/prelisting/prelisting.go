@@ -0,0 +1,492 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package prelisting watches for symbols that are expected to be listed,
+// such as after a listing announcement, before they exist. The symbols of
+// exchanges with pending watches are polled frequently, the trade stream is
+// asked to subscribe as soon as a watched symbol appears, and the first
+// trade is reported as soon as it is received.
+package prelisting
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/metrics"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	metrics.Describe("prelisting_polls_total",
+		"Symbol list polls for pending pre-listing watches, by exchange.")
+	metrics.Describe("prelisting_live_total",
+		"Watched symbols that received their first trade, by exchange.")
+}
+
+// Watch states.
+const (
+	// Not yet in the symbols of the exchange.
+	StateWatching = "watching"
+
+	// In the symbols of the exchange and subscribed to, waiting for the
+	// first trade.
+	StateListed = "listed"
+
+	// The first trade has been received.
+	StateLive = "live"
+)
+
+// The shortest poll interval, to stay within the rate limits of the
+// exchanges.
+const MinPollInterval = time.Second
+
+type Config struct {
+	// Symbols to watch on startup, as exchange:symbol in the exchange's
+	// own format, such as binance:FOOUSDT.
+	Symbols []string `mapstructure:"symbols" json:"symbols,omitempty"`
+
+	// How often the symbols of exchanges with watched symbols not yet
+	// listed are polled.
+	PollInterval time.Duration `mapstructure:"poll_interval" json:"poll_interval"`
+
+	// Watches not listed after this long are dropped. 0 keeps them until
+	// removed.
+	Expire time.Duration `mapstructure:"expire" json:"expire"`
+
+	// Names of the alert webhooks and notifiers to deliver to. Empty
+	// delivers to all.
+	Webhooks []string `mapstructure:"webhooks" json:"webhooks,omitempty"`
+	Notify   []string `mapstructure:"notify" json:"notify,omitempty"`
+}
+
+var DefaultConfig = Config{
+	PollInterval: 5 * time.Second,
+	Expire:       30 * 24 * time.Hour,
+}
+
+// Override returns c with the fields that are set in override replaced.
+func (c Config) Override(override Config) Config {
+	if len(override.Symbols) > 0 {
+		c.Symbols = override.Symbols
+	}
+	if override.PollInterval != 0 {
+		c.PollInterval = override.PollInterval
+	}
+	if override.Expire != 0 {
+		c.Expire = override.Expire
+	}
+	if len(override.Webhooks) > 0 {
+		c.Webhooks = override.Webhooks
+	}
+	if len(override.Notify) > 0 {
+		c.Notify = override.Notify
+	}
+	return c
+}
+
+func (c Config) Validate() error {
+	if c.PollInterval < MinPollInterval {
+		return fmt.Errorf("pre-listing poll interval must be at least %v", MinPollInterval)
+	}
+	if c.Expire < 0 {
+		return fmt.Errorf("pre-listing expire must not be negative")
+	}
+	for _, key := range c.Symbols {
+		if _, _, err := ParseKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseKey parses an exchange:symbol key.
+func ParseKey(key string) (exchange string, symbol string, err error) {
+	parts := strings.SplitN(key, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid pre-listing symbol %q, expected exchange:symbol", key)
+	}
+	return strings.ToLower(parts[0]), strings.ToUpper(parts[1]), nil
+}
+
+func watchKey(exchange string, symbol string) string {
+	return strings.ToLower(exchange) + ":" + strings.ToUpper(symbol)
+}
+
+// FirstTrade is the first trade of a watched symbol.
+type FirstTrade struct {
+	Id         int64     `json:"id"`
+	Timestamp  time.Time `json:"timestamp"`
+	Price      float64   `json:"price"`
+	Quantity   float64   `json:"quantity"`
+	BuyerMaker bool      `json:"buyer_maker"`
+
+	// When the trade was received.
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// Watch is a symbol watched for its listing.
+type Watch struct {
+	Exchange string    `json:"exchange"`
+	Symbol   string    `json:"symbol"`
+	Note     string    `json:"note,omitempty"`
+	State    string    `json:"state"`
+	AddedAt  time.Time `json:"added_at"`
+
+	// When the symbol was first seen in the symbols of the exchange.
+	ListedAt time.Time `json:"listed_at,omitempty"`
+
+	FirstTrade *FirstTrade `json:"first_trade,omitempty"`
+}
+
+func (w Watch) Message() string {
+	return fmt.Sprintf("pre-listing: %s on %s live, first trade at %s",
+		w.Symbol, w.Exchange, strconv.FormatFloat(w.FirstTrade.Price, 'f', -1, 64))
+}
+
+type exchange struct {
+	// Returns the symbols currently trading.
+	symbols func() ([]string, error)
+
+	// Asks the trade stream to subscribe to new symbols, nil if it only
+	// does so on its own schedule.
+	refresh func()
+}
+
+// Watcher tracks the watched symbols. Trades are received through the sink
+// of each exchange. Safe for concurrent use.
+type Watcher struct {
+	config    Config
+	filename  string
+	exchanges map[string]exchange
+	watches   map[string]*Watch
+
+	// The keys of the watches that are not yet live, checked on every
+	// trade.
+	pending map[string]bool
+	lock    sync.RWMutex
+
+	// Called with each watch that goes live.
+	onLive func(watch Watch)
+}
+
+// NewWatcher loads the watches saved to filename, if it exists. Watches
+// are saved to it on change, not at all if filename is empty.
+func NewWatcher(config Config, filename string, onLive func(watch Watch)) (*Watcher, error) {
+	w := &Watcher{
+		config:    config,
+		filename:  filename,
+		exchanges: map[string]exchange{},
+		watches:   map[string]*Watch{},
+		pending:   map[string]bool{},
+		onLive:    onLive,
+	}
+	if filename != "" {
+		buf, err := ioutil.ReadFile(filename)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			watches := []*Watch{}
+			if err := json.Unmarshal(buf, &watches); err != nil {
+				return nil, fmt.Errorf("%s: %v", filename, err)
+			}
+			for _, watch := range watches {
+				key := watchKey(watch.Exchange, watch.Symbol)
+				w.watches[key] = watch
+				if watch.State != StateLive {
+					w.pending[key] = true
+				}
+			}
+		}
+	}
+	return w, nil
+}
+
+func (w *Watcher) Config() Config {
+	return w.config
+}
+
+// AddExchange adds an exchange symbols can be watched on. symbols returns
+// its trading symbols, and refresh, if not nil, asks its trade stream to
+// subscribe to new symbols. Must be called before Add and Run.
+func (w *Watcher) AddExchange(name string, symbols func() ([]string, error), refresh func()) {
+	w.exchanges[name] = exchange{symbols: symbols, refresh: refresh}
+}
+
+// Add watches symbol on exchange. Watching a symbol already watched
+// replaces its note.
+func (w *Watcher) Add(exchange string, symbol string, note string) (Watch, error) {
+	exchange = strings.ToLower(exchange)
+	symbol = strings.ToUpper(symbol)
+	if _, ok := w.exchanges[exchange]; !ok {
+		return Watch{}, fmt.Errorf("unknown exchange %s", exchange)
+	}
+	if symbol == "" {
+		return Watch{}, fmt.Errorf("symbol required")
+	}
+	key := watchKey(exchange, symbol)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	watch := w.watches[key]
+	if watch == nil {
+		watch = &Watch{
+			Exchange: exchange,
+			Symbol:   symbol,
+			State:    StateWatching,
+			AddedAt:  time.Now(),
+		}
+		w.watches[key] = watch
+		w.pending[key] = true
+		log.Printf("pre-listing: watching %s on %s\n", symbol, exchange)
+	}
+	watch.Note = note
+	w.save()
+	return *watch, nil
+}
+
+// Remove stops watching symbol on exchange, returning false if it was not
+// watched.
+func (w *Watcher) Remove(exchange string, symbol string) bool {
+	key := watchKey(exchange, symbol)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.watches[key] == nil {
+		return false
+	}
+	delete(w.watches, key)
+	delete(w.pending, key)
+	w.save()
+	return true
+}
+
+// Watches returns every watch, ordered by exchange and symbol.
+func (w *Watcher) Watches() []Watch {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	watches := []Watch{}
+	for _, watch := range w.watches {
+		watches = append(watches, *watch)
+	}
+	sort.Slice(watches, func(i, j int) bool {
+		if watches[i].Exchange != watches[j].Exchange {
+			return watches[i].Exchange < watches[j].Exchange
+		}
+		return watches[i].Symbol < watches[j].Symbol
+	})
+	return watches
+}
+
+// Sink returns the sink the trades of exchange are received by.
+func (w *Watcher) Sink(exchange string) pkg.Sink {
+	return &watcherSink{watcher: w, exchange: exchange}
+}
+
+type watcherSink struct {
+	watcher  *Watcher
+	exchange string
+}
+
+func (s *watcherSink) Name() string {
+	return "prelisting"
+}
+
+func (s *watcherSink) Send(message interface{}) error {
+	trade, ok := message.(pkg.CommonTrade)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", message)
+	}
+	s.watcher.AddTrade(s.exchange, trade, time.Now())
+	return nil
+}
+
+// AddTrade checks if trade, received at receivedAt, is the first trade of
+// a watched symbol. Cheap for symbols that are not watched.
+func (w *Watcher) AddTrade(exchange string, trade pkg.CommonTrade, receivedAt time.Time) {
+	key := watchKey(exchange, trade.Symbol)
+	w.lock.RLock()
+	pending := w.pending[key]
+	w.lock.RUnlock()
+	if !pending {
+		return
+	}
+
+	w.lock.Lock()
+	watch := w.watches[key]
+	if watch == nil || !w.pending[key] {
+		w.lock.Unlock()
+		return
+	}
+	delete(w.pending, key)
+	if watch.ListedAt.IsZero() {
+		watch.ListedAt = receivedAt
+	}
+	watch.State = StateLive
+	watch.FirstTrade = &FirstTrade{
+		Id:         trade.Id,
+		Timestamp:  trade.Timestamp,
+		Price:      trade.Price,
+		Quantity:   trade.Quantity,
+		BuyerMaker: trade.BuyerMaker,
+		ReceivedAt: receivedAt,
+	}
+	w.save()
+	live := *watch
+	w.lock.Unlock()
+
+	metrics.GetCounter("prelisting_live_total", metrics.Labels{"exchange": exchange}).Inc()
+	log.Printf("%s\n", live.Message())
+	if w.onLive != nil {
+		w.onLive(live)
+	}
+}
+
+// poll checks the symbols of each exchange with watches not yet listed,
+// subscribing to those that have appeared, and drops the watches that
+// have expired at now.
+func (w *Watcher) poll(now time.Time) {
+	w.lock.Lock()
+	watching := map[string][]*Watch{}
+	expired := false
+	for key := range w.pending {
+		watch := w.watches[key]
+		if watch.State != StateWatching {
+			continue
+		}
+		if w.config.Expire > 0 && now.Sub(watch.AddedAt) > w.config.Expire {
+			log.Printf("pre-listing: %s on %s not listed after %v, no longer watching\n",
+				watch.Symbol, watch.Exchange, w.config.Expire)
+			delete(w.watches, key)
+			delete(w.pending, key)
+			expired = true
+			continue
+		}
+		watching[watch.Exchange] = append(watching[watch.Exchange], watch)
+	}
+	if expired {
+		w.save()
+	}
+	w.lock.Unlock()
+
+	for name, watches := range watching {
+		exchange, ok := w.exchanges[name]
+		if !ok {
+			continue
+		}
+		metrics.GetCounter("prelisting_polls_total", metrics.Labels{"exchange": name}).Inc()
+		symbols, err := exchange.symbols()
+		if err != nil {
+			log.Printf("error: pre-listing: failed to get %s symbols: %v\n", name, err)
+			continue
+		}
+		trading := map[string]bool{}
+		for _, symbol := range symbols {
+			trading[strings.ToUpper(symbol)] = true
+		}
+
+		listed := false
+		w.lock.Lock()
+		for _, watch := range watches {
+			if watch.State != StateWatching || !trading[watch.Symbol] {
+				continue
+			}
+			watch.State = StateListed
+			watch.ListedAt = time.Now()
+			listed = true
+			log.Printf("pre-listing: %s listed on %s, subscribing\n", watch.Symbol, name)
+		}
+		if listed {
+			w.save()
+		}
+		w.lock.Unlock()
+
+		if listed && exchange.refresh != nil {
+			exchange.refresh()
+		}
+	}
+}
+
+// Run adds the watches of the config then polls every poll interval until
+// ctx is cancelled.
+func (w *Watcher) Run(ctx context.Context) {
+	for _, key := range w.config.Symbols {
+		exchange, symbol, _ := ParseKey(key)
+		if _, err := w.Add(exchange, symbol, ""); err != nil {
+			log.Printf("error: pre-listing: %s: %v\n", key, err)
+		}
+	}
+	ticker := time.NewTicker(w.config.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			w.poll(now)
+		}
+	}
+}
+
+// save writes the watches to disk, replacing the previous file atomically.
+// Must be called with the lock held.
+func (w *Watcher) save() {
+	if w.filename == "" {
+		return
+	}
+	if err := w.write(); err != nil {
+		log.Printf("error: pre-listing: failed to save watches: %v\n", err)
+	}
+}
+
+func (w *Watcher) write() error {
+	watches := []*Watch{}
+	for _, watch := range w.watches {
+		watches = append(watches, watch)
+	}
+	buf, err := json.Marshal(watches)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(w.filename), 0755); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(w.filename), ".prelisting-")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(buf); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	if err := os.Rename(file.Name(), w.filename); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return nil
+}
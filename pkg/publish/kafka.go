@@ -0,0 +1,58 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package publish
+
+import (
+	"context"
+	"github.com/segmentio/kafka-go"
+	"time"
+)
+
+type kafkaTransport struct {
+	writer *kafka.Writer
+}
+
+// newKafkaTransport writes to the partition of each message's key, waiting
+// for all in sync replicas to acknowledge.
+func newKafkaTransport(brokers []string) *kafkaTransport {
+	return &kafkaTransport{
+		writer: &kafka.Writer{
+			Addr:                   kafka.TCP(brokers...),
+			Balancer:               &kafka.Hash{},
+			RequiredAcks:           kafka.RequireAll,
+			AllowAutoTopicCreation: true,
+			BatchSize:              maxBatch,
+			BatchTimeout:           10 * time.Millisecond,
+			MaxAttempts:            1,
+		},
+	}
+}
+
+func (t *kafkaTransport) publish(ctx context.Context, messages []Message) error {
+	batch := make([]kafka.Message, 0, len(messages))
+	for _, message := range messages {
+		batch = append(batch, kafka.Message{
+			Topic: message.Topic,
+			Key:   []byte(message.Key),
+			Value: message.Value,
+		})
+	}
+	return t.writer.WriteMessages(ctx, batch...)
+}
+
+func (t *kafkaTransport) close() error {
+	return t.writer.Close()
+}
@@ -0,0 +1,72 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package publish
+
+import (
+	"context"
+	"github.com/nats-io/nats.go"
+)
+
+type natsTransport struct {
+	conn      *nats.Conn
+	jetStream nats.JetStreamContext
+}
+
+// newNatsTransport publishes to JetStream, which acknowledges each message
+// once stored. The key is sent in the Key header.
+func newNatsTransport(url string) (*natsTransport, error) {
+	conn, err := nats.Connect(url, nats.MaxReconnects(-1), nats.Name("cryptoxscanner"))
+	if err != nil {
+		return nil, err
+	}
+	jetStream, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &natsTransport{
+		conn:      conn,
+		jetStream: jetStream,
+	}, nil
+}
+
+func (t *natsTransport) publish(ctx context.Context, messages []Message) error {
+	futures := make([]nats.PubAckFuture, 0, len(messages))
+	for _, message := range messages {
+		msg := nats.NewMsg(message.Topic)
+		msg.Header.Set("Key", message.Key)
+		msg.Data = message.Value
+		future, err := t.jetStream.PublishMsgAsync(msg)
+		if err != nil {
+			return err
+		}
+		futures = append(futures, future)
+	}
+	for _, future := range futures {
+		select {
+		case <-future.Ok():
+		case err := <-future.Err():
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (t *natsTransport) close() error {
+	return t.conn.Drain()
+}
@@ -0,0 +1,343 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package publish forwards normalized scanner output to Kafka or NATS so it
+// can be consumed by other pipelines without the websocket API.
+package publish
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/metrics"
+	"strings"
+	"time"
+)
+
+func init() {
+	metrics.Describe("publish_messages_total",
+		"Messages acknowledged by the Kafka or NATS server.")
+	metrics.Describe("publish_dropped_total",
+		"Messages dropped as the publish queue was full.")
+	metrics.Describe("publish_errors_total",
+		"Failed attempts to publish a batch of messages, which are retried.")
+}
+
+const (
+	TypeKafka = "kafka"
+	TypeNats  = "nats"
+)
+
+// The kinds of messages that can be published.
+const (
+	Trades  = "trades"
+	Tickers = "tickers"
+	Alerts  = "alerts"
+)
+
+// The maximum number of messages published at a time.
+const maxBatch = 500
+
+// Retry delays for batches that fail to publish. Batches are retried until
+// they are acknowledged.
+var retryOptions = pkg.BackoffOptions{
+	Min:    100 * time.Millisecond,
+	Max:    30 * time.Second,
+	Jitter: 0.2,
+}
+
+type Config struct {
+	// kafka or nats. Publishing is disabled if empty.
+	Type string `mapstructure:"type"`
+
+	// Kafka bootstrap brokers as host:port.
+	Brokers []string `mapstructure:"brokers"`
+
+	// NATS server URL. Messages are published to JetStream, so a stream
+	// must capture the subjects.
+	Url string `mapstructure:"url"`
+
+	// The kinds of messages to publish: trades, tickers and alerts.
+	Publish []string `mapstructure:"publish"`
+
+	// Kafka topic, or NATS subject, of each kind. {exchange} is replaced
+	// with the exchange name, or "scanner" for alerts not about an
+	// exchange.
+	TradesTopic  string `mapstructure:"trades_topic"`
+	TickersTopic string `mapstructure:"tickers_topic"`
+	AlertsTopic  string `mapstructure:"alerts_topic"`
+
+	// Messages that can be queued waiting to be published, and what to do
+	// when the queue is full: drop, or block which stalls the scanner
+	// while the server is unavailable.
+	QueueSize int    `mapstructure:"queue_size"`
+	Overflow  string `mapstructure:"overflow"`
+}
+
+var DefaultConfig = Config{
+	Publish:      []string{Trades, Tickers, Alerts},
+	TradesTopic:  "cryptoxscanner.{exchange}.trades",
+	TickersTopic: "cryptoxscanner.{exchange}.tickers",
+	AlertsTopic:  "cryptoxscanner.alerts",
+	QueueSize:    100000,
+	Overflow:     string(pkg.OverflowDrop),
+}
+
+// Override returns c with the fields that are set in override replaced.
+func (c Config) Override(override Config) Config {
+	if override.Type != "" {
+		c.Type = override.Type
+	}
+	if len(override.Brokers) > 0 {
+		c.Brokers = override.Brokers
+	}
+	if override.Url != "" {
+		c.Url = override.Url
+	}
+	if len(override.Publish) > 0 {
+		c.Publish = override.Publish
+	}
+	if override.TradesTopic != "" {
+		c.TradesTopic = override.TradesTopic
+	}
+	if override.TickersTopic != "" {
+		c.TickersTopic = override.TickersTopic
+	}
+	if override.AlertsTopic != "" {
+		c.AlertsTopic = override.AlertsTopic
+	}
+	if override.QueueSize != 0 {
+		c.QueueSize = override.QueueSize
+	}
+	if override.Overflow != "" {
+		c.Overflow = override.Overflow
+	}
+	return c
+}
+
+func (c Config) Enabled() bool {
+	return c.Type != ""
+}
+
+func (c Config) Validate() error {
+	switch c.Type {
+	case TypeKafka:
+		if len(c.Brokers) == 0 {
+			return fmt.Errorf("kafka brokers required")
+		}
+	case TypeNats:
+		if c.Url == "" {
+			return fmt.Errorf("nats url required")
+		}
+	default:
+		return fmt.Errorf("unknown publish type: %s", c.Type)
+	}
+	for _, kind := range c.Publish {
+		if kind != Trades && kind != Tickers && kind != Alerts {
+			return fmt.Errorf("unknown publish kind: %s", kind)
+		}
+	}
+	if c.QueueSize <= 0 {
+		return fmt.Errorf("publish queue size must be positive")
+	}
+	if policy, err := pkg.ParseOverflowPolicy(c.Overflow); err != nil ||
+		policy == pkg.OverflowDisconnect {
+		return fmt.Errorf("invalid publish overflow: %s", c.Overflow)
+	}
+	return nil
+}
+
+type Message struct {
+	Topic string
+
+	// Messages with the same key, the symbol, are kept in order on Kafka
+	// by being published to the same partition.
+	Key   string
+	Value []byte
+}
+
+// transport delivers batches of messages to a server, returning once all
+// are acknowledged.
+type transport interface {
+	publish(ctx context.Context, messages []Message) error
+	close() error
+}
+
+// Publisher queues messages and publishes them in batches. Each batch is
+// retried until acknowledged so queued messages are delivered at least
+// once, including on shutdown within the close timeout.
+type Publisher struct {
+	config    Config
+	kinds     map[string]string
+	transport transport
+	queue     chan Message
+	policy    pkg.OverflowPolicy
+	done      chan struct{}
+
+	// The batch being published, kept until acknowledged.
+	pending []Message
+
+	published *metrics.Counter
+	dropped   *metrics.Counter
+	errors    *metrics.Counter
+}
+
+// NewPublisher connects to the server of a validated config.
+func NewPublisher(config Config) (*Publisher, error) {
+	var transport transport
+	var err error
+	switch config.Type {
+	case TypeKafka:
+		transport = newKafkaTransport(config.Brokers)
+	case TypeNats:
+		transport, err = newNatsTransport(config.Url)
+	default:
+		err = fmt.Errorf("unknown publish type: %s", config.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	kinds := map[string]string{}
+	topics := map[string]string{
+		Trades:  config.TradesTopic,
+		Tickers: config.TickersTopic,
+		Alerts:  config.AlertsTopic,
+	}
+	for _, kind := range config.Publish {
+		kinds[kind] = topics[kind]
+	}
+
+	labels := metrics.Labels{"type": config.Type}
+	return &Publisher{
+		config:    config,
+		kinds:     kinds,
+		transport: transport,
+		queue:     make(chan Message, config.QueueSize),
+		policy:    pkg.OverflowPolicy(config.Overflow),
+		done:      make(chan struct{}),
+		published: metrics.GetCounter("publish_messages_total", labels),
+		dropped:   metrics.GetCounter("publish_dropped_total", labels),
+		errors:    metrics.GetCounter("publish_errors_total", labels),
+	}, nil
+}
+
+// Topic returns the topic messages of kind are published to for exchange,
+// or an empty string if kind is not published.
+func (p *Publisher) Topic(kind string, exchange string) string {
+	topic, ok := p.kinds[kind]
+	if !ok {
+		return ""
+	}
+	if exchange == "" {
+		exchange = "scanner"
+	}
+	return strings.Replace(topic, "{exchange}", exchange, -1)
+}
+
+// Publish encodes value as JSON and queues it for publishing.
+func (p *Publisher) Publish(topic string, key string, value interface{}) error {
+	buf, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	message := Message{Topic: topic, Key: key, Value: buf}
+	select {
+	case p.queue <- message:
+		return nil
+	default:
+	}
+	if p.policy == pkg.OverflowBlock {
+		p.queue <- message
+		return nil
+	}
+	p.dropped.Inc()
+	return nil
+}
+
+// Done is closed once Run has returned.
+func (p *Publisher) Done() <-chan struct{} {
+	return p.done
+}
+
+// Run publishes queued messages until ctx is cancelled. The publisher must
+// still be closed to publish the remaining queued messages.
+func (p *Publisher) Run(ctx context.Context) {
+	defer close(p.done)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message := <-p.queue:
+			p.pending = append(p.pending[:0], message)
+		}
+		p.fill()
+		if !p.deliver(ctx) {
+			return
+		}
+	}
+}
+
+// fill adds queued messages to the pending batch, up to the batch size.
+func (p *Publisher) fill() {
+	for len(p.pending) < maxBatch {
+		select {
+		case message := <-p.queue:
+			p.pending = append(p.pending, message)
+		default:
+			return
+		}
+	}
+}
+
+// deliver publishes the pending batch, retrying until acknowledged. Returns
+// false if ctx was cancelled first, leaving the batch pending.
+func (p *Publisher) deliver(ctx context.Context) bool {
+	backoff := pkg.NewBackoff(retryOptions)
+	for {
+		err := p.transport.publish(ctx, p.pending)
+		if err == nil {
+			p.published.Add(int64(len(p.pending)))
+			p.pending = p.pending[:0]
+			return true
+		}
+		p.errors.Inc()
+		if ctx.Err() != nil {
+			return false
+		}
+		delay, _ := backoff.Next()
+		log.Printf("error: publish: failed to publish %d messages, retrying in %v: %v\n",
+			len(p.pending), delay.Round(time.Millisecond), err)
+		if !pkg.Sleep(ctx, delay) {
+			return false
+		}
+	}
+}
+
+// Close publishes the pending and queued messages, giving up when ctx is
+// cancelled, then disconnects. Must be called after Run has returned.
+func (p *Publisher) Close(ctx context.Context) error {
+	for len(p.pending) > 0 || len(p.queue) > 0 {
+		p.fill()
+		if !p.deliver(ctx) {
+			log.Printf("error: publish: gave up on %d queued messages\n",
+				len(p.pending)+len(p.queue))
+			break
+		}
+	}
+	return p.transport.close()
+}
@@ -0,0 +1,57 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket allowing count events per period, with
+// bursts of up to count.
+type RateLimiter struct {
+	capacity float64
+	rate     float64
+	tokens   float64
+	last     time.Time
+	lock     sync.Mutex
+}
+
+func NewRateLimiter(count int, period time.Duration) *RateLimiter {
+	return &RateLimiter{
+		capacity: float64(count),
+		rate:     float64(count) / period.Seconds(),
+		tokens:   float64(count),
+		last:     time.Now(),
+	}
+}
+
+// Allow takes a token, returning false if none are available.
+func (l *RateLimiter) Allow() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.capacity {
+		l.tokens = l.capacity
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,41 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"time"
+)
+
+// RawRecorder receives every raw message read from the exchange streams.
+// Record must not block.
+type RawRecorder interface {
+	Record(stream string, received time.Time, body []byte)
+}
+
+var rawRecorder RawRecorder
+
+// SetRawRecorder sets the recorder raw stream messages are passed to. Must
+// be set before the exchanges start their streams.
+func SetRawRecorder(recorder RawRecorder) {
+	rawRecorder = recorder
+}
+
+// RecordRaw passes a raw message of stream to the recorder, if any.
+func RecordRaw(stream string, body []byte) {
+	if rawRecorder != nil {
+		rawRecorder.Record(stream, time.Now(), body)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"fmt"
+	"sync"
+)
+
+// RecentTrades keeps the most recent trades of each symbol in memory so
+// they can be served without a journal. It is a sink for a trade stream.
+type RecentTrades struct {
+	name   string
+	size   int
+	trades map[string][]CommonTrade
+	lock   sync.RWMutex
+}
+
+// NewRecentTrades keeps up to size trades per symbol.
+func NewRecentTrades(name string, size int) *RecentTrades {
+	return &RecentTrades{
+		name:   name,
+		size:   size,
+		trades: map[string][]CommonTrade{},
+	}
+}
+
+func (r *RecentTrades) Name() string {
+	return r.name
+}
+
+func (r *RecentTrades) Send(message interface{}) error {
+	trade, ok := message.(CommonTrade)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", message)
+	}
+	r.Add(trade)
+	return nil
+}
+
+func (r *RecentTrades) Add(trade CommonTrade) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	trades := append(r.trades[trade.Symbol], trade)
+	// Trimmed only once double the size to avoid copying on every trade.
+	if len(trades) >= r.size*2 {
+		trades = append(make([]CommonTrade, 0, r.size*2), trades[len(trades)-r.size:]...)
+	}
+	r.trades[trade.Symbol] = trades
+}
+
+// Get returns up to limit of the most recent trades for symbol, oldest
+// first. A limit of 0 returns all that are kept.
+func (r *RecentTrades) Get(symbol string, limit int) []CommonTrade {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	trades := r.trades[symbol]
+	if limit <= 0 || limit > r.size {
+		limit = r.size
+	}
+	if len(trades) > limit {
+		trades = trades[len(trades)-limit:]
+	}
+	return append([]CommonTrade{}, trades...)
+}
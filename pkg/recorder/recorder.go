@@ -0,0 +1,352 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package recorder
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/metrics"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	metrics.Describe("recorder_messages_total",
+		"Raw stream messages written by the recorder.")
+	metrics.Describe("recorder_dropped_total",
+		"Raw stream messages dropped as the recorder queue was full.")
+}
+
+const fileExt = ".ndjson.gz"
+
+type Options struct {
+	// Time after which a new file is started for a stream.
+	RotateInterval time.Duration
+
+	// Files not written to for this long are removed. 0 keeps all files.
+	Retention time.Duration
+
+	// Maximum time written messages are buffered before being flushed to
+	// disk.
+	FlushInterval time.Duration
+
+	// Number of messages that can be queued for writing before messages
+	// are dropped.
+	QueueSize int
+}
+
+var DefaultOptions = Options{
+	RotateInterval: time.Hour,
+	FlushInterval:  5 * time.Second,
+	QueueSize:      8192,
+}
+
+// Record is a single line of a recording.
+type Record struct {
+	// Receive time in Unix milliseconds.
+	Timestamp int64  `json:"timestamp"`
+	Stream    string `json:"stream"`
+
+	// The raw message if it is JSON, otherwise the message as a string.
+	Message json.RawMessage `json:"message"`
+}
+
+func (r *Record) Time() time.Time {
+	return time.Unix(0, r.Timestamp*int64(time.Millisecond))
+}
+
+type message struct {
+	stream   string
+	received time.Time
+	body     []byte
+}
+
+type streamFile struct {
+	file   *os.File
+	gzip   *gzip.Writer
+	writer *bufio.Writer
+	opened time.Time
+}
+
+func (f *streamFile) flush() error {
+	if err := f.writer.Flush(); err != nil {
+		return err
+	}
+	return f.gzip.Flush()
+}
+
+func (f *streamFile) close() error {
+	err := f.writer.Flush()
+	if cerr := f.gzip.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Recorder writes raw stream messages to gzip compressed NDJSON files, one
+// directory per stream, rotated by time. Messages are queued so recording
+// never blocks a stream; if the queue is full messages are dropped.
+type Recorder struct {
+	dir     string
+	options Options
+	queue   chan message
+	lock    sync.Mutex
+	files   map[string]*streamFile
+	done    chan struct{}
+
+	recorded *metrics.Counter
+	dropped  *metrics.Counter
+}
+
+func NewRecorder(dir string, options Options) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Recorder{
+		dir:      dir,
+		options:  options,
+		queue:    make(chan message, options.QueueSize),
+		files:    map[string]*streamFile{},
+		done:     make(chan struct{}),
+		recorded: metrics.GetCounter("recorder_messages_total", nil),
+		dropped:  metrics.GetCounter("recorder_dropped_total", nil),
+	}, nil
+}
+
+// Record queues a message for writing.
+func (r *Recorder) Record(stream string, received time.Time, body []byte) {
+	select {
+	case r.queue <- message{stream: stream, received: received, body: body}:
+	default:
+		r.dropped.Inc()
+	}
+}
+
+// Done is closed once Run has returned.
+func (r *Recorder) Done() <-chan struct{} {
+	return r.done
+}
+
+// Run writes queued messages, periodically flushing and pruning old files,
+// until ctx is cancelled. The recorder must still be closed to write the
+// remaining queued messages.
+func (r *Recorder) Run(ctx context.Context) {
+	defer close(r.done)
+	ticker := time.NewTicker(r.options.FlushInterval)
+	defer ticker.Stop()
+	lastPrune := time.Time{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message := <-r.queue:
+			if err := r.write(message); err != nil {
+				log.Printf("error: recorder: %s: write failed: %v\n", message.stream, err)
+			}
+		case <-ticker.C:
+			if err := r.Flush(); err != nil {
+				log.Printf("error: recorder: flush failed: %v\n", err)
+			}
+			if r.options.Retention > 0 && time.Now().Sub(lastPrune) > time.Minute {
+				if err := r.Prune(time.Now().Add(-r.options.Retention)); err != nil {
+					log.Printf("error: recorder: prune failed: %v\n", err)
+				}
+				lastPrune = time.Now()
+			}
+		}
+	}
+}
+
+func (r *Recorder) write(message message) error {
+	record := Record{
+		Timestamp: message.received.UnixNano() / int64(time.Millisecond),
+		Stream:    message.stream,
+		Message:   message.body,
+	}
+	if !json.Valid(message.body) {
+		record.Message, _ = json.Marshal(string(message.body))
+	}
+	line, err := json.Marshal(&record)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	file, err := r.file(message.stream, message.received)
+	if err != nil {
+		return err
+	}
+	if _, err := file.writer.Write(line); err != nil {
+		return err
+	}
+	if err := file.writer.WriteByte('\n'); err != nil {
+		return err
+	}
+	r.recorded.Inc()
+	return nil
+}
+
+// file returns the open file for stream, rotating it if due.
+func (r *Recorder) file(stream string, now time.Time) (*streamFile, error) {
+	file := r.files[stream]
+	if file != nil && now.Sub(file.opened) < r.options.RotateInterval {
+		return file, nil
+	}
+	if file != nil {
+		delete(r.files, stream)
+		if err := file.close(); err != nil {
+			log.Printf("error: recorder: %s: failed to close file: %v\n", stream, err)
+		}
+	}
+
+	dir := filepath.Join(r.dir, stream)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	filename := filepath.Join(dir, now.UTC().Format("20060102T150405.000Z")+fileExt)
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	gz := gzip.NewWriter(f)
+	file = &streamFile{
+		file:   f,
+		gzip:   gz,
+		writer: bufio.NewWriter(gz),
+		opened: now,
+	}
+	r.files[stream] = file
+	return file, nil
+}
+
+// Flush flushes the open files to disk. Each flush ends a deflate block so
+// a file can be read up to the last flush while still being written.
+func (r *Recorder) Flush() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var err error
+	for stream, file := range r.files {
+		if ferr := file.flush(); ferr != nil {
+			log.Printf("error: recorder: %s: flush failed: %v\n", stream, ferr)
+			err = ferr
+		}
+	}
+	return err
+}
+
+// Close writes the messages still queued and closes all files. Must be
+// called after Run has returned.
+func (r *Recorder) Close() error {
+	for len(r.queue) > 0 {
+		message := <-r.queue
+		if err := r.write(message); err != nil {
+			log.Printf("error: recorder: %s: write failed: %v\n", message.stream, err)
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var err error
+	for stream, file := range r.files {
+		if cerr := file.close(); cerr != nil {
+			err = cerr
+		}
+		delete(r.files, stream)
+	}
+	return err
+}
+
+// Prune removes files not written to since before. Open files are never
+// removed.
+func (r *Recorder) Prune(before time.Time) error {
+	r.lock.Lock()
+	open := map[string]bool{}
+	for _, file := range r.files {
+		open[file.file.Name()] = true
+	}
+	r.lock.Unlock()
+
+	streams, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		return err
+	}
+	for _, stream := range streams {
+		if !stream.IsDir() {
+			continue
+		}
+		dir := filepath.Join(r.dir, stream.Name())
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			filename := filepath.Join(dir, file.Name())
+			if !strings.HasSuffix(file.Name(), fileExt) || open[filename] {
+				continue
+			}
+			if file.ModTime().Before(before) {
+				os.Remove(filename)
+			}
+		}
+	}
+	return nil
+}
+
+// ReadFile calls fn with each record of a recording file. A file that is
+// still being written, or was not closed cleanly, is read up to its last
+// complete record.
+func ReadFile(filename string, fn func(record *Record) error) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	reader := bufio.NewReader(gz)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var record Record
+		if err := json.Unmarshal(line, &record); err != nil {
+			return err
+		}
+		if err := fn(&record); err != nil {
+			return err
+		}
+	}
+}
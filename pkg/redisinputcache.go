@@ -16,9 +16,38 @@
 package pkg
 
 import (
+	"encoding/json"
 	"github.com/go-redis/redis"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/metrics"
+	"sync"
+	"sync/atomic"
 	"time"
-	"encoding/json"
+)
+
+func init() {
+	metrics.Describe("redis_cache_dropped_total",
+		"Messages not cached as the Redis write queue was full.")
+	metrics.Describe("redis_cache_write_errors_total",
+		"Failed Redis cache write batches.")
+	metrics.Describe("redis_cache_pruned_total",
+		"Messages pruned from the Redis cache for being older than the retention.")
+}
+
+const (
+	// The number of messages that may be queued for writing. Messages
+	// pushed while the queue is full are dropped.
+	redisCacheQueueSize = 65536
+
+	// The most messages written in a single pipeline.
+	redisCacheBatchSize = 1024
+
+	// The minimum time between prunes.
+	redisCachePruneInterval = time.Second
+
+	// The number of entries sampled to rebuild the timestamp index of
+	// entries cached by a previous run.
+	redisCacheIndexSamples = 256
 )
 
 type RedisCacheEntry struct {
@@ -32,31 +61,272 @@ func DecodeRedisCacheEntry(buf string) (RedisCacheEntry, error) {
 	return cacheEntry, err
 }
 
+type RedisOptions struct {
+	Address  string
+	Password string
+	DB       int
+
+	// How long cached trades are kept for replay on startup.
+	Retention time.Duration
+}
+
+// The options caches are created with. Must be set before the exchanges
+// create their streams.
+var DefaultRedisOptions = RedisOptions{
+	Address:   "localhost:6379",
+	Retention: 2 * time.Hour,
+}
+
+// redisIndexEntry is a run of consecutive list entries, the newest of
+// which was cached at timestamp.
+type redisIndexEntry struct {
+	timestamp int64
+	count     int64
+}
+
+// RedisInputCache caches raw exchange messages in a Redis list so they can
+// be replayed on startup.
+//
+// Writes are queued and made by a background goroutine, batched into
+// pipelines, so RPush does not wait on Redis. Entries older than the
+// retention are removed with LTRIM using an index of the timestamps of the
+// list, kept in memory as the list is written, so pruning does not need to
+// read the list.
 type RedisInputCache struct {
-	client *redis.Client
-	key    string
+	client    *redis.Client
+	key       string
+	retention time.Duration
+
+	queue chan RedisCacheEntry
+	once  sync.Once
+
+	// Set by Prune, cleared by the writer once pruned.
+	pruneRequested int32
+
+	// Only accessed by the writer. Nil until rebuilt from the list.
+	index     []redisIndexEntry
+	lastPrune time.Time
+
+	dropped     *metrics.Counter
+	writeErrors *metrics.Counter
+	pruned      *metrics.Counter
+}
+
+func newRedisClient() *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:     DefaultRedisOptions.Address,
+		Password: DefaultRedisOptions.Password,
+		DB:       DefaultRedisOptions.DB,
+	})
 }
 
 func NewRedisInputCache(key string) *RedisInputCache {
 	cache := RedisInputCache{}
-	cache.client = redis.NewClient(&redis.Options{
-		Addr: "localhost:6379",
-	})
+	cache.client = newRedisClient()
 	cache.key = key
+	cache.retention = DefaultRedisOptions.Retention
+	cache.queue = make(chan RedisCacheEntry, redisCacheQueueSize)
+	labels := metrics.Labels{"cache": key}
+	cache.dropped = metrics.GetCounter("redis_cache_dropped_total", labels)
+	cache.writeErrors = metrics.GetCounter("redis_cache_write_errors_total", labels)
+	cache.pruned = metrics.GetCounter("redis_cache_pruned_total", labels)
 	return &cache
 }
 
+// Retention returns how long cached messages are kept.
+func (c *RedisInputCache) Retention() time.Duration {
+	return c.retention
+}
+
+// SetRetention sets how long cached messages are kept. Must be called
+// before the cache is written to.
+func (c *RedisInputCache) SetRetention(retention time.Duration) {
+	c.retention = retention
+}
+
 func (c *RedisInputCache) Ping() error {
 	return c.client.Ping().Err()
 }
 
+// RPush queues buf to be appended to the cache. It does not block, if the
+// write queue is full the message is dropped.
 func (c *RedisInputCache) RPush(buf []byte) {
+	c.once.Do(c.start)
 	entry := RedisCacheEntry{
 		Timestamp: time.Now().Unix(),
 		Message:   string(buf),
 	}
-	encoded, _ := json.Marshal(&entry)
-	c.client.RPush(c.key, encoded)
+	select {
+	case c.queue <- entry:
+	default:
+		c.dropped.Inc()
+	}
+}
+
+// Prune requests that entries older than the retention be removed. It does
+// not block, the entries are removed by the writer, at most once every
+// redisCachePruneInterval. Callers replaying the cache by position should
+// not prune until the replay is done, as pruning shifts the positions.
+func (c *RedisInputCache) Prune() {
+	c.once.Do(c.start)
+	atomic.StoreInt32(&c.pruneRequested, 1)
+}
+
+func (c *RedisInputCache) start() {
+	go c.run()
+}
+
+// run writes queued messages in batches and prunes when requested.
+func (c *RedisInputCache) run() {
+	ticker := time.NewTicker(redisCachePruneInterval)
+	defer ticker.Stop()
+	batch := make([]RedisCacheEntry, 0, redisCacheBatchSize)
+	for {
+		select {
+		case entry := <-c.queue:
+			batch = append(batch[:0], entry)
+		Drain:
+			for len(batch) < redisCacheBatchSize {
+				select {
+				case entry := <-c.queue:
+					batch = append(batch, entry)
+				default:
+					break Drain
+				}
+			}
+			c.write(batch)
+		case <-ticker.C:
+		}
+		if atomic.LoadInt32(&c.pruneRequested) == 1 &&
+			time.Since(c.lastPrune) >= redisCachePruneInterval {
+			atomic.StoreInt32(&c.pruneRequested, 0)
+			c.lastPrune = time.Now()
+			c.prune()
+		}
+	}
+}
+
+// write appends a batch of entries to the list in one pipeline and adds
+// them to the index.
+func (c *RedisInputCache) write(batch []RedisCacheEntry) {
+	// The index must be known before writing, otherwise the new entries
+	// would be indexed at the wrong positions. If it can't be built the
+	// batch is still written, and it is built once Redis is available.
+	c.rebuildIndex()
+
+	values := make([]interface{}, 0, len(batch))
+	for i := range batch {
+		encoded, _ := json.Marshal(&batch[i])
+		values = append(values, encoded)
+	}
+	pipe := c.client.Pipeline()
+	pipe.RPush(c.key, values...)
+	if _, err := pipe.Exec(); err != nil {
+		c.writeErrors.Inc()
+		log.Printf("error: redis cache %s: failed to write %d entries: %v\n",
+			c.key, len(batch), err)
+		// Some of the batch may have been written, rebuild the index
+		// from the list.
+		c.index = nil
+		return
+	}
+	if c.index == nil {
+		return
+	}
+	for _, entry := range batch {
+		timestamp := entry.Timestamp
+		if last := len(c.index) - 1; last >= 0 && c.index[last].timestamp >= timestamp {
+			c.index[last].count++
+		} else {
+			c.index = append(c.index, redisIndexEntry{timestamp: timestamp, count: 1})
+		}
+	}
+}
+
+// prune removes the entries older than the retention from the head of the
+// list. Runs of entries are removed once the newest of them has expired,
+// so no entry is removed early.
+func (c *RedisInputCache) prune() {
+	if !c.rebuildIndex() {
+		return
+	}
+	cutoff := time.Now().Add(-c.retention).Unix()
+	expired := int64(0)
+	n := 0
+	for n < len(c.index) && c.index[n].timestamp < cutoff {
+		expired += c.index[n].count
+		n++
+	}
+	if expired == 0 {
+		return
+	}
+	if err := c.client.LTrim(c.key, expired, -1).Err(); err != nil {
+		log.Printf("error: redis cache %s: failed to prune: %v\n", c.key, err)
+		c.index = nil
+		return
+	}
+	c.index = c.index[n:]
+	c.pruned.Add(expired)
+}
+
+// rebuildIndex builds the index from the list if it is not known, such as
+// for entries cached by a previous run or after a failed write, by reading
+// the timestamps of a sample of the entries in one pipeline. Returns false
+// if the index could not be built.
+func (c *RedisInputCache) rebuildIndex() bool {
+	if c.index != nil {
+		return true
+	}
+	length, err := c.client.LLen(c.key).Result()
+	if err != nil {
+		return false
+	}
+	index := []redisIndexEntry{}
+	if length == 0 {
+		c.index = index
+		return true
+	}
+	stride := length / redisCacheIndexSamples
+	if stride < 1 {
+		stride = 1
+	}
+	positions := []int64{}
+	for position := stride - 1; position < length-1; position += stride {
+		positions = append(positions, position)
+	}
+	positions = append(positions, length-1)
+
+	pipe := c.client.Pipeline()
+	commands := make([]*redis.StringCmd, len(positions))
+	for i, position := range positions {
+		commands[i] = pipe.LIndex(c.key, position)
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return false
+	}
+	previous := int64(-1)
+	for i, position := range positions {
+		timestamp := entryTimestamp(commands[i].Val())
+		// Timestamps should not decrease, but if the clock went back
+		// keep the index ordered so no run is removed early.
+		if last := len(index) - 1; last >= 0 && index[last].timestamp > timestamp {
+			timestamp = index[last].timestamp
+		}
+		index = append(index, redisIndexEntry{timestamp: timestamp, count: position - previous})
+		previous = position
+	}
+	c.index = index
+	return true
+}
+
+// entryTimestamp returns the timestamp of an encoded entry, 0 if it can not
+// be decoded so the entry is pruned.
+func entryTimestamp(encoded string) int64 {
+	entry, err := DecodeRedisCacheEntry(encoded)
+	if err != nil {
+		return 0
+	}
+	return entry.Timestamp
 }
 
 func (c *RedisInputCache) LRange(start, stop int64) ([]string, error) {
@@ -84,7 +354,42 @@ func (c *RedisInputCache) Len() (int64, error) {
 	return c.client.LLen(c.key).Result()
 }
 
-// Like LPop, but ignores the result.
-func (c *RedisInputCache) LRemove() {
-	c.client.LPop(c.key).Err()
+// Trim removes the n oldest entries. The index of the writer is not
+// updated, so it must not be called once the cache is written to.
+func (c *RedisInputCache) Trim(n int64) error {
+	return c.client.LTrim(c.key, n, -1).Err()
+}
+
+// redisInputCacheKeys returns the keys of the lists in the Redis database
+// of DefaultRedisOptions, which are taken to be caches. A scan may return
+// a key more than once.
+func redisInputCacheKeys() ([]string, error) {
+	client := newRedisClient()
+	defer client.Close()
+	keys := []string{}
+	seen := map[string]bool{}
+	cursor := uint64(0)
+	for {
+		batch, next, err := client.Scan(cursor, "*", 1000).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range batch {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			kind, err := client.Type(key).Result()
+			if err != nil {
+				return nil, err
+			}
+			if kind == "list" {
+				keys = append(keys, key)
+			}
+		}
+		if next == 0 {
+			return keys, nil
+		}
+		cursor = next
+	}
 }
@@ -0,0 +1,116 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package replay plays recorded trades, from the journal or the database,
+// back through the normal pipeline in place of the live exchange streams,
+// at real time or accelerated speed. Indicators and alert rules can then be
+// tested deterministically against known market conditions.
+package replay
+
+import (
+	"context"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/journal"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/persist"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/source"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Where recorded trades are read from.
+const (
+	FromJournal  = "journal"
+	FromDatabase = "database"
+)
+
+// TradeReader calls fn with each recorded trade of every symbol in the
+// range [from, to), oldest first, stopping at the first error which is
+// returned.
+type TradeReader func(from time.Time, to time.Time, fn func(trade pkg.CommonTrade) error) error
+
+// JournalReader reads the trades recorded in the trade journal in dir.
+func JournalReader(dir string) (TradeReader, error) {
+	tradeJournal, err := journal.OpenTradeJournal(dir, journal.DefaultOptions)
+	if err != nil {
+		return nil, err
+	}
+	return func(from time.Time, to time.Time, fn func(trade pkg.CommonTrade) error) error {
+		return tradeJournal.ReadTrades(from, to, "", fn)
+	}, nil
+}
+
+// DatabaseReader reads the trades of exchange persisted to store.
+func DatabaseReader(store *persist.Store, exchange string) TradeReader {
+	return func(from time.Time, to time.Time, fn func(trade pkg.CommonTrade) error) error {
+		return store.ReadExchangeTrades(exchange, from, to, fn)
+	}
+}
+
+// ParseSpeed parses a replay speed such as 1x or 10x, the x being
+// optional. "max", or 0, replays as fast as possible.
+func ParseSpeed(value string) (float64, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "max" {
+		return 0, nil
+	}
+	speed, err := strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64)
+	if err != nil || speed < 0 {
+		return 0, fmt.Errorf("invalid replay speed: %s", value)
+	}
+	return speed, nil
+}
+
+type Options struct {
+	// Speed relative to the original timeline, 0 for as fast as possible.
+	Speed float64
+
+	// Shift the timestamps so the replay starts now, so it is treated as
+	// live by the trackers.
+	Rebase bool
+
+	// The range of recorded trades replayed.
+	From time.Time
+	To   time.Time
+}
+
+// Source implements source.Source for recorded trades.
+type Source struct {
+	read    TradeReader
+	options Options
+}
+
+func NewSource(read TradeReader, options Options) *Source {
+	return &Source{
+		read:    read,
+		options: options,
+	}
+}
+
+func (s *Source) Run(ctx context.Context, publish func(trade pkg.CommonTrade)) error {
+	pacer := source.NewPacer(s.options.Speed, s.options.Rebase)
+	err := s.read(s.options.From, s.options.To, func(trade pkg.CommonTrade) error {
+		if !pacer.Pace(ctx, &trade) {
+			return ctx.Err()
+		}
+		publish(trade)
+		return nil
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,269 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/events"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The number of entries in each ranked section of a summary.
+const summaryTopN = 10
+
+const dateFormat = "2006-01-02"
+
+// How long to wait for the tickers of a source when generating a summary.
+const sourceTimeout = 30 * time.Second
+
+// Source provides the current tickers of an exchange.
+type Source interface {
+	Name() string
+	Tickers(ctx context.Context) ([]pkg.CommonTicker, error)
+
+	// IsHidden returns true if the events of symbol are left out.
+	IsHidden(symbol string) bool
+}
+
+type Mover struct {
+	Symbol         string  `json:"symbol"`
+	Close          float64 `json:"close"`
+	PriceChangePct float64 `json:"price_change_pct"`
+	QuoteVolume    float64 `json:"volume"`
+}
+
+type ExchangeSummary struct {
+	Exchange        string         `json:"exchange"`
+	TopGainers      []Mover        `json:"top_gainers"`
+	TopLosers       []Mover        `json:"top_losers"`
+	VolumeAnomalies []events.Event `json:"volume_anomalies"`
+	Listings        []events.Event `json:"listings"`
+	Alerts          []events.Event `json:"alerts"`
+}
+
+type DailySummary struct {
+	// The UTC date covered, as YYYY-MM-DD.
+	Date      string            `json:"date"`
+	From      time.Time         `json:"from"`
+	To        time.Time         `json:"to"`
+	Generated time.Time         `json:"generated"`
+	Exchanges []ExchangeSummary `json:"exchanges"`
+}
+
+// DailyGenerator generates a market summary for each UTC day, stores it as
+// JSON and HTML in a directory and publishes it to its sinks.
+type DailyGenerator struct {
+	dir     string
+	store   *events.Store
+	sources []Source
+	topic   *pkg.Topic
+}
+
+func NewDailyGenerator(dir string, store *events.Store, sources ...Source) *DailyGenerator {
+	return &DailyGenerator{
+		dir:     dir,
+		store:   store,
+		sources: sources,
+		topic:   pkg.DefaultBus.NewTopic("reports.daily", (*DailySummary)(nil)),
+	}
+}
+
+// AddSink registers a sink, such as a notification channel, to receive each
+// generated *DailySummary.
+func (g *DailyGenerator) AddSink(sink pkg.Sink) {
+	g.topic.AddSink(sink)
+}
+
+// Run generates the summary for the previous day shortly after each UTC
+// midnight until ctx is cancelled.
+func (g *DailyGenerator) Run(ctx context.Context) {
+	for {
+		now := time.Now().UTC()
+		next := now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+		if !pkg.Sleep(ctx, next.Sub(now)+time.Minute) {
+			return
+		}
+
+		if _, err := g.Generate(next); err != nil {
+			log.Printf("error: failed to generate daily summary: %v\n", err)
+		}
+	}
+}
+
+// Generate builds, saves and publishes the summary for the 24 hours before
+// to. Ticker based sections reflect the tickers at the time of generation.
+func (g *DailyGenerator) Generate(to time.Time) (*DailySummary, error) {
+	to = to.UTC()
+	from := to.Add(-24 * time.Hour)
+	summary := &DailySummary{
+		Date:      from.Format(dateFormat),
+		From:      from,
+		To:        to,
+		Generated: time.Now().UTC(),
+		Exchanges: []ExchangeSummary{},
+	}
+
+	for _, source := range g.sources {
+		exchange := ExchangeSummary{
+			Exchange:        source.Name(),
+			VolumeAnomalies: []events.Event{},
+			Listings:        []events.Event{},
+			Alerts:          []events.Event{},
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), sourceTimeout)
+		tickers, err := source.Tickers(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("error: daily summary: failed to get %s tickers: %v\n",
+				source.Name(), err)
+		}
+		exchange.TopGainers, exchange.TopLosers = rankMovers(tickers)
+
+		for _, event := range g.store.Since(source.Name(), from) {
+			if !event.Timestamp.Before(to) || source.IsHidden(event.Symbol) {
+				continue
+			}
+			switch event.Type {
+			case events.TypeVolumeSpike:
+				exchange.VolumeAnomalies = append(exchange.VolumeAnomalies, event)
+			case events.TypeListing:
+				exchange.Listings = append(exchange.Listings, event)
+			case events.TypeAlert:
+				exchange.Alerts = append(exchange.Alerts, event)
+			}
+		}
+		sort.SliceStable(exchange.VolumeAnomalies, func(i, j int) bool {
+			return eventFactor(exchange.VolumeAnomalies[i]) >
+				eventFactor(exchange.VolumeAnomalies[j])
+		})
+		if len(exchange.VolumeAnomalies) > summaryTopN {
+			exchange.VolumeAnomalies = exchange.VolumeAnomalies[:summaryTopN]
+		}
+
+		summary.Exchanges = append(summary.Exchanges, exchange)
+	}
+
+	if err := g.save(summary); err != nil {
+		return nil, err
+	}
+	log.Printf("report: generated daily summary for %s\n", summary.Date)
+
+	g.topic.Publish(summary)
+	return summary, nil
+}
+
+func eventFactor(event events.Event) float64 {
+	factor, _ := event.Data["factor"].(float64)
+	return factor
+}
+
+func rankMovers(tickers []pkg.CommonTicker) (gainers []Mover, losers []Mover) {
+	movers := []Mover{}
+	for _, ticker := range tickers {
+		if ticker.QuoteVolume <= 0 {
+			continue
+		}
+		movers = append(movers, Mover{
+			Symbol:         ticker.Symbol,
+			Close:          ticker.LastPrice,
+			PriceChangePct: ticker.PriceChangePct24,
+			QuoteVolume:    ticker.QuoteVolume,
+		})
+	}
+	sort.Slice(movers, func(i, j int) bool {
+		return movers[i].PriceChangePct > movers[j].PriceChangePct
+	})
+
+	gainers = []Mover{}
+	losers = []Mover{}
+	for i := 0; i < len(movers) && i < summaryTopN; i++ {
+		if movers[i].PriceChangePct > 0 {
+			gainers = append(gainers, movers[i])
+		}
+	}
+	for i := len(movers) - 1; i >= 0 && len(losers) < summaryTopN; i-- {
+		if movers[i].PriceChangePct < 0 {
+			losers = append(losers, movers[i])
+		}
+	}
+	return gainers, losers
+}
+
+func (g *DailyGenerator) path(date string, ext string) string {
+	return filepath.Join(g.dir, fmt.Sprintf("%s.%s", date, ext))
+}
+
+func (g *DailyGenerator) save(summary *DailySummary) error {
+	if err := os.MkdirAll(g.dir, 0755); err != nil {
+		return err
+	}
+	buf, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(g.path(summary.Date, "json"), buf, 0644); err != nil {
+		return err
+	}
+	html, err := RenderHTML(summary)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(g.path(summary.Date, "html"), html, 0644)
+}
+
+// List returns the dates of all stored summaries, newest first.
+func (g *DailyGenerator) List() ([]string, error) {
+	dates := []string{}
+	files, err := ioutil.ReadDir(g.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return dates, nil
+		}
+		return nil, err
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".json") {
+			dates = append(dates, strings.TrimSuffix(file.Name(), ".json"))
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dates)))
+	return dates, nil
+}
+
+// Load returns the stored summary for a date in the given format, json or
+// html. Returns nil if there is no summary for the date.
+func (g *DailyGenerator) Load(date string, format string) ([]byte, error) {
+	if _, err := time.Parse(dateFormat, date); err != nil {
+		return nil, fmt.Errorf("invalid date: %s", date)
+	}
+	if format != "json" && format != "html" {
+		return nil, fmt.Errorf("invalid format: %s", format)
+	}
+	buf, err := ioutil.ReadFile(g.path(date, format))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return buf, err
+}
@@ -0,0 +1,70 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package report
+
+import (
+	"bytes"
+	"html/template"
+)
+
+var dailyTemplate = template.Must(template.New("daily").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Daily Market Summary {{.Date}}</title>
+</head>
+<body>
+<h1>Daily Market Summary {{.Date}}</h1>
+<p>{{.From.Format "2006-01-02 15:04"}} to {{.To.Format "2006-01-02 15:04"}} UTC</p>
+{{range .Exchanges}}
+<h2>{{.Exchange}}</h2>
+<h3>Top Gainers</h3>
+<table>
+<tr><th>Symbol</th><th>Close</th><th>Change %</th><th>Volume</th></tr>
+{{range .TopGainers}}<tr><td>{{.Symbol}}</td><td>{{.Close}}</td><td>{{printf "%.2f" .PriceChangePct}}</td><td>{{printf "%.2f" .QuoteVolume}}</td></tr>
+{{end}}</table>
+<h3>Top Losers</h3>
+<table>
+<tr><th>Symbol</th><th>Close</th><th>Change %</th><th>Volume</th></tr>
+{{range .TopLosers}}<tr><td>{{.Symbol}}</td><td>{{.Close}}</td><td>{{printf "%.2f" .PriceChangePct}}</td><td>{{printf "%.2f" .QuoteVolume}}</td></tr>
+{{end}}</table>
+<h3>Volume Anomalies</h3>
+<ul>
+{{range .VolumeAnomalies}}<li>{{.Timestamp.Format "15:04"}} {{.Message}}</li>
+{{else}}<li>None</li>
+{{end}}</ul>
+<h3>New Listings</h3>
+<ul>
+{{range .Listings}}<li>{{.Timestamp.Format "15:04"}} {{.Symbol}}</li>
+{{else}}<li>None</li>
+{{end}}</ul>
+<h3>Alerts</h3>
+<ul>
+{{range .Alerts}}<li>{{.Timestamp.Format "15:04"}} {{.Message}}</li>
+{{else}}<li>None</li>
+{{end}}</ul>
+{{end}}
+</body>
+</html>
+`))
+
+func RenderHTML(summary *DailySummary) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := dailyTemplate.Execute(&buf, summary); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
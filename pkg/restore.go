@@ -0,0 +1,106 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// RestoreStatus is the progress of a stream restoring its state on
+// startup, from its cache and by backfilling history, before it publishes
+// live data.
+type RestoreStatus struct {
+	Name string `json:"name"`
+	Done bool   `json:"done"`
+
+	// The entries restored, and the total to restore if known.
+	Restored int64 `json:"restored"`
+	Total    int64 `json:"total,omitempty"`
+
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+}
+
+var restoreProgresses = map[string]*RestoreProgress{}
+var restoreProgressesLock sync.Mutex
+
+// RestoreStatuses returns the restore progress of every stream, by name.
+func RestoreStatuses() []RestoreStatus {
+	restoreProgressesLock.Lock()
+	list := make([]RestoreStatus, 0, len(restoreProgresses))
+	for _, p := range restoreProgresses {
+		list = append(list, p.Status())
+	}
+	restoreProgressesLock.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// RestoreProgress tracks the restore of a stream. Safe for concurrent use.
+type RestoreProgress struct {
+	status RestoreStatus
+	lock   sync.Mutex
+}
+
+// NewRestoreProgress starts tracking the restore of the stream name,
+// replacing any previous restore of the same name.
+func NewRestoreProgress(name string) *RestoreProgress {
+	p := &RestoreProgress{
+		status: RestoreStatus{
+			Name:      name,
+			StartedAt: time.Now(),
+		},
+	}
+	restoreProgressesLock.Lock()
+	restoreProgresses[name] = p
+	restoreProgressesLock.Unlock()
+	return p
+}
+
+func (p *RestoreProgress) Status() RestoreStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.status
+}
+
+// AddTotal adds to the number of entries to restore.
+func (p *RestoreProgress) AddTotal(n int64) {
+	p.lock.Lock()
+	p.status.Total += n
+	p.lock.Unlock()
+}
+
+// Restored records n entries restored.
+func (p *RestoreProgress) Restored(n int64) {
+	p.lock.Lock()
+	p.status.Restored += n
+	p.lock.Unlock()
+}
+
+// Done records that the restore has finished, successfully or not, and
+// the stream is publishing live data.
+func (p *RestoreProgress) Done() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.status.Done {
+		p.status.Done = true
+		p.status.FinishedAt = time.Now()
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"context"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/candles"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/events"
+	"time"
+)
+
+// TradeReader calls fn with each trade to replay, of any symbols, oldest
+// first, stopping at the first error which is returned.
+type TradeReader func(fn func(trade pkg.CommonTrade) error) error
+
+// eventSink calls fn with the events of a detection.
+type eventSink struct {
+	fn func(event events.Event)
+}
+
+func (s *eventSink) Name() string {
+	return "detect"
+}
+
+func (s *eventSink) Send(message interface{}) error {
+	event, ok := message.(events.Event)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", message)
+	}
+	s.fn(event)
+	return nil
+}
+
+// Detect replays the trades of read through a fresh candle builder and
+// event detector, calling fn with each event detected, and returns the
+// number of trades replayed. The Source of options is not used. If Rates
+// is not set whale trades are converted at the last prices replayed,
+// updated every minute of trade time.
+func Detect(ctx context.Context, read TradeReader, options Options,
+	fn func(event events.Event)) (int, error) {
+	builder := candles.NewBuilder(options.Exchange+".detect",
+		[]time.Duration{time.Minute}, detectorWindow(options.Detector)+1)
+	defer builder.Close()
+	store := events.NewStore(0)
+	defer store.Close()
+	store.AddSink(&eventSink{fn: fn})
+
+	prices := map[string]float64{}
+	var rates *pkg.ConversionRates
+	if options.Rates == nil {
+		options.Rates = func() *pkg.ConversionRates {
+			if rates == nil {
+				rates = pkg.NewConversionRates(prices)
+			}
+			return rates
+		}
+	}
+	detector := events.NewDetector(options.Exchange, store, builder, options.Rates,
+		options.Detector)
+	builder.AddSink(detector)
+
+	replayed := 0
+	var minute time.Time
+	err := read(func(trade pkg.CommonTrade) error {
+		if replayed%1000 == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		replayed++
+		prices[trade.Symbol] = trade.Price
+		if trade.Timestamp.Truncate(time.Minute) != minute {
+			minute = trade.Timestamp.Truncate(time.Minute)
+			rates = nil
+		}
+		detector.Send(trade)
+		builder.AddTrade(trade)
+		return nil
+	})
+	return replayed, err
+}
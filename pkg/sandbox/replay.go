@@ -0,0 +1,342 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"context"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/candles"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/events"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/signals"
+	"sort"
+	"time"
+)
+
+// The maximum number of trades replayed in a single run, over all symbols.
+const MaxReplayTrades = 5000000
+
+// TradeSource calls fn with each trade of symbol in the range [from, to),
+// oldest first, stopping at the first error which is returned.
+type TradeSource func(symbol string, from time.Time, to time.Time,
+	fn func(trade pkg.CommonTrade) error) error
+
+type Options struct {
+	Exchange string
+	Source   TradeSource
+
+	// The detector options of the exchange, so the replayed signals match
+	// the live ones.
+	Detector events.DetectorOptions
+
+	// Conversion rates for whale trades. The current rates are used for
+	// the whole replay.
+	Rates func() *pkg.ConversionRates
+}
+
+type Trade struct {
+	Symbol     string    `json:"symbol"`
+	Side       string    `json:"side"`
+	SignalId   string    `json:"signal_id"`
+	EntryTime  time.Time `json:"entry_time"`
+	EntryPrice float64   `json:"entry_price"`
+	ExitTime   time.Time `json:"exit_time"`
+	ExitPrice  float64   `json:"exit_price"`
+	ExitReason string    `json:"exit_reason"`
+
+	// Return after fees.
+	ReturnPct float64 `json:"return_pct"`
+}
+
+// Summary of the trades of a run. Returns are summed, as if every trade
+// used the same fixed stake.
+type Summary struct {
+	// Signals that matched the strategy, and those skipped as a position
+	// was already open for the symbol.
+	Signals int `json:"signals"`
+	Skipped int `json:"skipped"`
+
+	Trades     int     `json:"trades"`
+	Wins       int     `json:"wins"`
+	Losses     int     `json:"losses"`
+	WinRatePct float64 `json:"win_rate_pct"`
+
+	TotalReturnPct   float64 `json:"total_return_pct"`
+	AverageReturnPct float64 `json:"average_return_pct"`
+	BestReturnPct    float64 `json:"best_return_pct"`
+	WorstReturnPct   float64 `json:"worst_return_pct"`
+
+	// The largest fall of the summed return from a previous high, with
+	// trades taken in exit order.
+	MaxDrawdownPct float64 `json:"max_drawdown_pct"`
+
+	// Gross profit over gross loss, 0 if there were no losses.
+	ProfitFactor float64 `json:"profit_factor"`
+
+	AverageHoldSeconds float64 `json:"average_hold_seconds"`
+}
+
+type Result struct {
+	Strategy Strategy  `json:"strategy"`
+	Symbols  []string  `json:"symbols"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+
+	// The number of trades replayed, including those before From used to
+	// warm up the detector.
+	Replayed int `json:"replayed"`
+
+	Trades  []Trade `json:"trades"`
+	Summary Summary `json:"summary"`
+}
+
+// Run replays the trade history of each symbol through a fresh candle
+// builder and event detector, and trades strategy on the signals generated
+// in the range [from, to). History before from is replayed to warm up the
+// detector but is not traded.
+func Run(ctx context.Context, strategy Strategy, symbols []string, from time.Time, to time.Time,
+	options Options) (*Result, error) {
+	if err := strategy.Validate(); err != nil {
+		return nil, err
+	}
+	result := &Result{
+		Strategy: strategy,
+		Symbols:  symbols,
+		From:     from,
+		To:       to,
+		Trades:   []Trade{},
+	}
+
+	// Enough 1 minute candles for the detector to have a full window at
+	// from.
+	window := detectorWindow(options.Detector)
+	warmup := time.Duration(window+1) * time.Minute
+
+	for _, symbol := range symbols {
+		r := newReplay(&strategy, symbol, from, options, window+1)
+		err := options.Source(symbol, from.Add(-warmup), to, func(trade pkg.CommonTrade) error {
+			if result.Replayed%1000 == 0 && ctx.Err() != nil {
+				return ctx.Err()
+			}
+			result.Replayed++
+			if result.Replayed > MaxReplayTrades {
+				return fmt.Errorf("more than %d trades to replay, reduce the range or symbols",
+					MaxReplayTrades)
+			}
+			r.trade(trade)
+			return nil
+		})
+		r.close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", symbol, err)
+		}
+		r.finish()
+		result.Trades = append(result.Trades, r.trades...)
+		result.Summary.Signals += r.signals
+		result.Summary.Skipped += r.skipped
+	}
+
+	sort.SliceStable(result.Trades, func(i, j int) bool {
+		return result.Trades[i].EntryTime.Before(result.Trades[j].EntryTime)
+	})
+	summarize(&result.Summary, result.Trades)
+	return result, nil
+}
+
+// detectorWindow returns the number of previous 1 minute candles the
+// detector compares a candle to.
+func detectorWindow(options events.DetectorOptions) int {
+	window := options.LevelBreakWindow
+	if options.VolumeSpike.Window > window {
+		window = options.VolumeSpike.Window
+	}
+	return window
+}
+
+type position struct {
+	signalId string
+	time     time.Time
+	price    float64
+}
+
+// replay trades a strategy on a single symbol.
+type replay struct {
+	strategy *Strategy
+	symbol   string
+	from     time.Time
+	builder  *candles.Builder
+	store    *events.Store
+	detector *events.Detector
+
+	// Signals generated by the last trade.
+	pending []signals.Signal
+
+	position  *position
+	lastTrade *pkg.CommonTrade
+
+	trades  []Trade
+	signals int
+	skipped int
+}
+
+func newReplay(strategy *Strategy, symbol string, from time.Time, options Options, window int) *replay {
+	r := &replay{
+		strategy: strategy,
+		symbol:   symbol,
+		from:     from,
+		builder: candles.NewBuilder(options.Exchange+".sandbox",
+			[]time.Duration{time.Minute}, window),
+		trades: []Trade{},
+	}
+	// The store only relays the events to the replay, none are kept.
+	r.store = events.NewStore(0)
+	r.store.AddSink(r)
+	r.detector = events.NewDetector(options.Exchange, r.store, r.builder, options.Rates,
+		options.Detector)
+	r.builder.AddSink(r.detector)
+	return r
+}
+
+func (r *replay) Name() string {
+	return "sandbox"
+}
+
+// Send implements pkg.Sink for the events of the replay.
+func (r *replay) Send(message interface{}) error {
+	event, ok := message.(events.Event)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", message)
+	}
+	if signal, ok := signals.FromEvent(event, event.Timestamp); ok {
+		r.pending = append(r.pending, signal)
+	}
+	return nil
+}
+
+func (r *replay) trade(trade pkg.CommonTrade) {
+	r.lastTrade = &trade
+	r.pending = r.pending[:0]
+	r.detector.Send(trade)
+	r.builder.AddTrade(trade)
+
+	if r.position != nil {
+		reason := r.strategy.exitReason(r.position.time, r.position.price,
+			trade.Timestamp, trade.Price)
+		if reason != "" {
+			r.exit(trade, reason)
+		}
+	}
+
+	// Signals are acted on at the price of the trade that generated them.
+	for _, signal := range r.pending {
+		if signal.EventTime.Before(r.from) || !r.strategy.matches(signal) {
+			continue
+		}
+		r.signals++
+		if r.position != nil {
+			r.skipped++
+			continue
+		}
+		r.position = &position{
+			signalId: signal.Id,
+			time:     trade.Timestamp,
+			price:    trade.Price,
+		}
+	}
+}
+
+// close releases the bus topics of the builder and store.
+func (r *replay) close() {
+	r.builder.Close()
+	r.store.Close()
+}
+
+// finish closes any open position at the last price.
+func (r *replay) finish() {
+	if r.position != nil {
+		r.exit(*r.lastTrade, ExitEnd)
+	}
+}
+
+func (r *replay) exit(trade pkg.CommonTrade, reason string) {
+	gross := r.strategy.grossReturn(r.position.price, trade.Price)
+	r.trades = append(r.trades, Trade{
+		Symbol:     r.symbol,
+		Side:       r.strategy.Side,
+		SignalId:   r.position.signalId,
+		EntryTime:  r.position.time,
+		EntryPrice: r.position.price,
+		ExitTime:   trade.Timestamp,
+		ExitPrice:  trade.Price,
+		ExitReason: reason,
+		ReturnPct:  pkg.Round3(gross - 2*r.strategy.FeePct),
+	})
+	r.position = nil
+}
+
+func summarize(summary *Summary, trades []Trade) {
+	summary.Trades = len(trades)
+	if len(trades) == 0 {
+		return
+	}
+
+	byExit := make([]Trade, len(trades))
+	copy(byExit, trades)
+	sort.SliceStable(byExit, func(i, j int) bool {
+		return byExit[i].ExitTime.Before(byExit[j].ExitTime)
+	})
+
+	total := float64(0)
+	high := float64(0)
+	profit := float64(0)
+	loss := float64(0)
+	hold := time.Duration(0)
+	summary.BestReturnPct = byExit[0].ReturnPct
+	summary.WorstReturnPct = byExit[0].ReturnPct
+	for _, trade := range byExit {
+		if trade.ReturnPct > 0 {
+			summary.Wins++
+			profit += trade.ReturnPct
+		} else {
+			summary.Losses++
+			loss -= trade.ReturnPct
+		}
+		if trade.ReturnPct > summary.BestReturnPct {
+			summary.BestReturnPct = trade.ReturnPct
+		}
+		if trade.ReturnPct < summary.WorstReturnPct {
+			summary.WorstReturnPct = trade.ReturnPct
+		}
+		total += trade.ReturnPct
+		if total > high {
+			high = total
+		}
+		if high-total > summary.MaxDrawdownPct {
+			summary.MaxDrawdownPct = high - total
+		}
+		hold += trade.ExitTime.Sub(trade.EntryTime)
+	}
+
+	count := float64(len(trades))
+	summary.WinRatePct = pkg.Round3(float64(summary.Wins) / count * 100)
+	summary.TotalReturnPct = pkg.Round3(total)
+	summary.AverageReturnPct = pkg.Round3(total / count)
+	summary.MaxDrawdownPct = pkg.Round3(summary.MaxDrawdownPct)
+	if loss > 0 {
+		summary.ProfitFactor = pkg.Round3(profit / loss)
+	}
+	summary.AverageHoldSeconds = pkg.Round3(hold.Seconds() / count)
+}
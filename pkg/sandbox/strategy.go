@@ -0,0 +1,137 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package sandbox runs simple signal driven strategies against replayed
+// trade history, to check how scanner signals would have performed.
+package sandbox
+
+import (
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/events"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/signals"
+	"time"
+)
+
+const (
+	SideLong  = "long"
+	SideShort = "short"
+)
+
+const (
+	ExitTakeProfit = "take_profit"
+	ExitStopLoss   = "stop_loss"
+	ExitTime       = "time"
+
+	// The position was still open at the end of the replay and was closed
+	// at the last price.
+	ExitEnd = "end"
+)
+
+// ReplayableSignals are the signal types that can be regenerated from trade
+// history. Listings and alerts depend on state that is not persisted.
+var ReplayableSignals = []string{
+	events.TypeVolumeSpike,
+	events.TypeWhaleTrade,
+	events.TypeLevelBreak,
+}
+
+// Strategy enters a position on a signal and exits after a time, or once
+// the return reaches the take profit or stop loss. Only one position is
+// held per symbol, signals while in a position are skipped.
+type Strategy struct {
+	// The signal type to enter on, and data fields the signal must have,
+	// such as {"direction": "up"} for level breaks.
+	Signal string            `json:"signal"`
+	Where  map[string]string `json:"where,omitempty"`
+
+	// long or short, defaults to long.
+	Side string `json:"side"`
+
+	// Zero disables each exit, but at least one is required.
+	ExitAfterMinutes float64 `json:"exit_after_minutes"`
+	TakeProfitPct    float64 `json:"take_profit_pct"`
+	StopLossPct      float64 `json:"stop_loss_pct"`
+
+	// Fee charged on entry and on exit, as a percentage.
+	FeePct float64 `json:"fee_pct"`
+}
+
+// Validate checks the strategy, defaulting the side to long.
+func (s *Strategy) Validate() error {
+	replayable := false
+	for _, signal := range ReplayableSignals {
+		if s.Signal == signal {
+			replayable = true
+		}
+	}
+	if !replayable {
+		return fmt.Errorf("signal must be one of %v", ReplayableSignals)
+	}
+	if s.Side == "" {
+		s.Side = SideLong
+	}
+	if s.Side != SideLong && s.Side != SideShort {
+		return fmt.Errorf("invalid side: %s", s.Side)
+	}
+	if s.ExitAfterMinutes < 0 || s.TakeProfitPct < 0 || s.StopLossPct < 0 || s.FeePct < 0 {
+		return fmt.Errorf("exits and fee must not be negative")
+	}
+	if s.ExitAfterMinutes == 0 && s.TakeProfitPct == 0 && s.StopLossPct == 0 {
+		return fmt.Errorf("at least one exit is required")
+	}
+	return nil
+}
+
+func (s *Strategy) matches(signal signals.Signal) bool {
+	if signal.Type != s.Signal {
+		return false
+	}
+	for field, value := range s.Where {
+		if fmt.Sprint(signal.Data[field]) != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Strategy) exitAfter() time.Duration {
+	return time.Duration(s.ExitAfterMinutes * float64(time.Minute))
+}
+
+// grossReturn is the return in percent of a position entered at entry if
+// it were closed at price, before fees.
+func (s *Strategy) grossReturn(entry float64, price float64) float64 {
+	if s.Side == SideShort {
+		return (entry - price) / entry * 100
+	}
+	return (price - entry) / entry * 100
+}
+
+// exitReason returns why a position entered at entryTime and entry should be
+// closed at a trade at price and timestamp, or an empty string to stay in the
+// position.
+func (s *Strategy) exitReason(entryTime time.Time, entry float64, timestamp time.Time, price float64) string {
+	gross := s.grossReturn(entry, price)
+	if s.TakeProfitPct > 0 && gross >= s.TakeProfitPct {
+		return ExitTakeProfit
+	}
+	if s.StopLossPct > 0 && gross <= -s.StopLossPct {
+		return ExitStopLoss
+	}
+	if s.ExitAfterMinutes > 0 && !timestamp.Before(entryTime.Add(s.exitAfter())) {
+		return ExitTime
+	}
+	return ""
+}
@@ -0,0 +1,200 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package signals
+
+import (
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/events"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/metrics"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The maximum number of signals kept for polling, regardless of expiry.
+const maxSignals = 10000
+
+// The queue of each subscriber, signals that do not fit are dropped.
+var subscriberQueueOptions = pkg.QueueOptions{
+	Size:   256,
+	Policy: pkg.OverflowDrop,
+}
+
+func init() {
+	metrics.Describe("signals_emitted_total",
+		"Signals emitted by type.")
+	metrics.Describe("signals_expired_total",
+		"Events not emitted as signals as they had already expired.")
+}
+
+// Filter selects signals. Empty fields match all.
+type Filter struct {
+	Exchange string
+	Symbol   string
+	Types    map[string]bool
+}
+
+func (f *Filter) Matches(signal *Signal) bool {
+	if f.Exchange != "" && f.Exchange != signal.Exchange {
+		return false
+	}
+	if f.Symbol != "" && f.Symbol != signal.Symbol {
+		return false
+	}
+	if len(f.Types) > 0 && !f.Types[signal.Type] {
+		return false
+	}
+	return true
+}
+
+// Feed emits signals for events. It is a sink for the event store. Signals
+// are kept until they expire for polling, and published to subscribers.
+type Feed struct {
+	signals  []Signal
+	sequence uint64
+	lock     sync.RWMutex
+
+	// Signals are published to the subscribers as they are emitted.
+	topic *pkg.Topic
+
+	now func() time.Time
+}
+
+func NewFeed() *Feed {
+	return &Feed{
+		topic: pkg.DefaultBus.NewTopicWithOptions("signals", Signal{},
+			pkg.TopicOptions{Shards: pkg.FanoutShards}),
+		now: time.Now,
+	}
+}
+
+func (f *Feed) Name() string {
+	return "signals"
+}
+
+// Send implements pkg.Sink for events.
+func (f *Feed) Send(message interface{}) error {
+	event, ok := message.(events.Event)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", message)
+	}
+	f.Add(event)
+	return nil
+}
+
+// Add emits a signal for event. Events that are not signal types, or have
+// already expired, such as events from backfilled trades, are ignored.
+func (f *Feed) Add(event events.Event) {
+	now := f.now()
+	signal, ok := FromEvent(event, now)
+	if !ok {
+		return
+	}
+	if signal.Expired(now) {
+		metrics.GetCounter("signals_expired_total", metrics.Labels{"type": signal.Type}).Inc()
+		return
+	}
+
+	f.lock.Lock()
+	f.sequence++
+	signal.Sequence = f.sequence
+	f.signals = append(f.signals, signal)
+	f.prune(now)
+	f.lock.Unlock()
+
+	metrics.GetCounter("signals_emitted_total", metrics.Labels{"type": signal.Type}).Inc()
+
+	f.topic.Publish(signal)
+}
+
+// prune removes expired signals from the front, and the oldest signals over
+// the maximum. Signals have different TTLs so expired signals may remain
+// behind an unexpired one, Since skips them. Must be called with the lock
+// held.
+func (f *Feed) prune(now time.Time) {
+	start := 0
+	for start < len(f.signals) && f.signals[start].Expired(now) {
+		start++
+	}
+	if len(f.signals)-start > maxSignals {
+		start = len(f.signals) - maxSignals
+	}
+	if start > 0 {
+		f.signals = append(f.signals[:0], f.signals[start:]...)
+	}
+}
+
+// Since returns up to limit unexpired signals with a sequence after
+// sequence that match filter, oldest first. A limit of 0 returns all.
+func (f *Feed) Since(sequence uint64, filter Filter, limit int) []Signal {
+	now := f.now()
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	i := sort.Search(len(f.signals), func(i int) bool {
+		return f.signals[i].Sequence > sequence
+	})
+	result := []Signal{}
+	for ; i < len(f.signals); i++ {
+		signal := &f.signals[i]
+		if signal.Expired(now) || !filter.Matches(signal) {
+			continue
+		}
+		result = append(result, *signal)
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+	}
+	return result
+}
+
+// Sequence returns the sequence of the last signal emitted.
+func (f *Feed) Sequence() uint64 {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.sequence
+}
+
+// Subscribe returns a channel that receives every signal emitted. Signals
+// are dropped for subscribers that are not ready to receive, subscribers
+// can detect this from a gap in the sequence and poll for the missed
+// signals.
+func (f *Feed) Subscribe() chan Signal {
+	return f.topic.Subscribe("signals", subscriberQueueOptions).(chan Signal)
+}
+
+func (f *Feed) Unsubscribe(channel chan Signal) {
+	f.topic.Unsubscribe(channel)
+}
+
+// ParseFilter creates a filter from comma separated types.
+func ParseFilter(exchange string, symbol string, types string) (Filter, error) {
+	filter := Filter{
+		Exchange: strings.ToLower(exchange),
+		Symbol:   strings.ToUpper(symbol),
+		Types:    map[string]bool{},
+	}
+	if types != "" {
+		for _, name := range strings.Split(types, ",") {
+			if _, ok := Schemas[name]; !ok {
+				return Filter{}, fmt.Errorf("unknown signal type: %s", name)
+			}
+			filter.Types[name] = true
+		}
+	}
+	return filter, nil
+}
@@ -0,0 +1,231 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package signals converts detector events into versioned signals with
+// stable IDs and expiry, for consumption by automated trading bots.
+package signals
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/events"
+	"time"
+)
+
+// SchemaVersion is incremented on any incompatible change to Signal or the
+// data of a signal type. Adding a signal type or an optional data field is
+// not an incompatible change.
+const SchemaVersion = 1
+
+// Signal is an event in a form that is stable for bots. Only the fields
+// listed in Schemas for the type are included in Data.
+type Signal struct {
+	// Derived from the type, exchange, symbol, event time and data, so the
+	// same event always has the same ID, even across restarts.
+	Id string `json:"id"`
+
+	Schema int `json:"schema"`
+
+	// Increases by one for each signal emitted. Only meaningful within a
+	// single run of the server, use Id to detect duplicates.
+	Sequence uint64 `json:"seq"`
+
+	Type     string `json:"type"`
+	Exchange string `json:"exchange"`
+	Symbol   string `json:"symbol"`
+
+	// When the event happened, when the signal was emitted, and after when
+	// it should no longer be acted on.
+	EventTime time.Time `json:"event_time"`
+	EmittedAt time.Time `json:"emitted_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	Message string                 `json:"message"`
+	Data    map[string]interface{} `json:"data"`
+}
+
+func (s *Signal) Expired(now time.Time) bool {
+	return !now.Before(s.ExpiresAt)
+}
+
+// Field types used in Schemas.
+const (
+	FieldNumber = "number"
+	FieldString = "string"
+	FieldObject = "object"
+	FieldBool   = "boolean"
+)
+
+// TypeSchema describes the data of a signal type.
+type TypeSchema struct {
+	Description string `json:"description"`
+
+	// How long after the event the signal expires.
+	TTL time.Duration `json:"-"`
+
+	Fields map[string]string `json:"fields"`
+}
+
+// Schemas describes each signal type. Events of other types are not emitted
+// as signals.
+var Schemas = map[string]TypeSchema{
+	events.TypeVolumeSpike: {
+		Description: "The quote volume of a closed 1 minute candle is anomalous against its baseline",
+		TTL:         5 * time.Minute,
+		Fields: map[string]string{
+			"quote_volume": FieldNumber,
+			"baseline":     FieldNumber,
+			"factor":       FieldNumber,
+			"score":        FieldNumber,
+			"model":        FieldString,
+		},
+	},
+	events.TypeWhaleTrade: {
+		Description: "A single trade, or a burst of trades on the same side, with a large USD value",
+		TTL:         2 * time.Minute,
+		Fields: map[string]string{
+			"side":     FieldString,
+			"price":    FieldNumber,
+			"quantity": FieldNumber,
+			"usd":      FieldNumber,
+			"trades":   FieldNumber,
+			"burst":    FieldBool,
+		},
+	},
+	events.TypeLiquidation: {
+		Description: "A single futures liquidation with a large USD value",
+		TTL:         2 * time.Minute,
+		Fields: map[string]string{
+			"position": FieldString,
+			"price":    FieldNumber,
+			"quantity": FieldNumber,
+			"usd":      FieldNumber,
+		},
+	},
+	events.TypeLiquidationCascade: {
+		Description: "The futures liquidations of a symbol over a short window reached a large USD value",
+		TTL:         5 * time.Minute,
+		Fields: map[string]string{
+			"window":    FieldString,
+			"position":  FieldString,
+			"longs":     FieldNumber,
+			"shorts":    FieldNumber,
+			"long_usd":  FieldNumber,
+			"short_usd": FieldNumber,
+			"total_usd": FieldNumber,
+		},
+	},
+	events.TypeLevelBreak: {
+		Description: "A 1 minute close broke above the high or below the low of the previous candles",
+		TTL:         15 * time.Minute,
+		Fields: map[string]string{
+			"direction": FieldString,
+			"level":     FieldNumber,
+			"close":     FieldNumber,
+		},
+	},
+	events.TypeListing: {
+		Description: "A symbol was listed",
+		TTL:         time.Hour,
+		Fields:      map[string]string{},
+	},
+	events.TypeDelisting: {
+		Description: "A symbol was removed from the symbols of the exchange",
+		TTL:         time.Hour,
+		Fields:      map[string]string{},
+	},
+	events.TypeListingLive: {
+		Description: "The first trade of a symbol watched for its listing, with high priority",
+		TTL:         5 * time.Minute,
+		Fields: map[string]string{
+			"priority":    FieldString,
+			"price":       FieldNumber,
+			"quantity":    FieldNumber,
+			"trade_time":  FieldNumber,
+			"listed_time": FieldNumber,
+		},
+	},
+	events.TypeRuleChange: {
+		Description: "The trading rules of a symbol changed, such as its status, tick size or order types",
+		TTL:         time.Hour,
+		Fields: map[string]string{
+			"changes": FieldObject,
+			"status":  FieldString,
+			"halted":  FieldBool,
+		},
+	},
+	events.TypeAlert: {
+		Description: "A user defined alert rule fired, values holds the metrics of its conditions",
+		TTL:         15 * time.Minute,
+		Fields: map[string]string{
+			"rule":   FieldString,
+			"values": FieldObject,
+		},
+	},
+}
+
+// FromEvent converts an event to a signal, without a sequence. Returns false
+// if the event type is not a signal type, or the event is a dry run alert.
+func FromEvent(event events.Event, now time.Time) (Signal, bool) {
+	schema, ok := Schemas[event.Type]
+	if !ok {
+		return Signal{}, false
+	}
+	if dryRun, _ := event.Data[events.DryRunField].(bool); dryRun {
+		return Signal{}, false
+	}
+	data := map[string]interface{}{}
+	if event.Type == events.TypeAlert {
+		values := map[string]interface{}{}
+		for key, value := range event.Data {
+			if key == "rule" {
+				data[key] = value
+			} else {
+				values[key] = value
+			}
+		}
+		data["values"] = values
+	} else {
+		for field := range schema.Fields {
+			if value, ok := event.Data[field]; ok {
+				data[field] = value
+			}
+		}
+	}
+	signal := Signal{
+		Schema:    SchemaVersion,
+		Type:      event.Type,
+		Exchange:  event.Exchange,
+		Symbol:    event.Symbol,
+		EventTime: event.Timestamp,
+		EmittedAt: now,
+		ExpiresAt: event.Timestamp.Add(schema.TTL),
+		Message:   event.Message,
+		Data:      data,
+	}
+	signal.Id = signalId(&signal)
+	return signal, true
+}
+
+func signalId(signal *Signal) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%d|%s|%s|%s|%d", signal.Schema, signal.Type,
+		signal.Exchange, signal.Symbol, signal.EventTime.UnixNano())
+	// Distinguishes different alert rules, or whale trades, in the same
+	// instant. Printing a map sorts the keys so this is deterministic.
+	fmt.Fprintf(hash, "|%v", signal.Data)
+	return "sig_" + hex.EncodeToString(hash.Sum(nil))[:24]
+}
@@ -0,0 +1,52 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// The file in a data directory locked while it is in use.
+const lockName = ".lock"
+
+var ErrInUse = errors.New("data directory is in use by a running server")
+
+// DirLock is an exclusive lock on a data directory, released when the
+// process exits.
+type DirLock struct {
+	file *os.File
+}
+
+// LockDir locks the data directory dir, creating it if needed. The server
+// holds the lock while running, export and import take it so they never
+// copy a directory being written to, such as a journal or SQLite database
+// mid write. Returns ErrInUse if the lock is held by another process.
+func LockDir(dir string) (*DirLock, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	file, err := lockFile(filepath.Join(dir, lockName))
+	if err != nil {
+		return nil, err
+	}
+	return &DirLock{file: file}, nil
+}
+
+func (l *DirLock) Unlock() error {
+	return l.file.Close()
+}
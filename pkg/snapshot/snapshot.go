@@ -0,0 +1,305 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package snapshot exports the persistent state of a scanner instance into a
+// single archive and imports it on another host.
+//
+// The state is the data directory (trade journals, reports), the alert
+// rules and the config file, which holds the symbol watch lists, aliases and
+// security settings. Candles and journal checkpoints are derived from the
+// journal so are restored with it.
+package snapshot
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const manifestName = "manifest.json"
+
+const manifestVersion = 1
+
+// Entry is a file or directory included in a snapshot. Name is the
+// location in the archive, such as "data" or "alerts.yaml", and Path the
+// location on disk.
+type Entry struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	Dir  bool   `json:"dir"`
+}
+
+type Manifest struct {
+	Version  int       `json:"version"`
+	Created  time.Time `json:"created"`
+	Hostname string    `json:"hostname"`
+	Entries  []Entry   `json:"entries"`
+}
+
+// Export writes a gzipped tar of the entries to w, starting with the
+// manifest. Entries whose path does not exist are skipped. The archive may
+// contain secrets from the config file so should be stored accordingly.
+//
+// The data directory must not be written to during the export, callers
+// should hold its lock from LockDir.
+func Export(w io.Writer, entries []Entry) (*Manifest, error) {
+	hostname, _ := os.Hostname()
+	manifest := &Manifest{
+		Version:  manifestVersion,
+		Created:  time.Now().UTC(),
+		Hostname: hostname,
+		Entries:  []Entry{},
+	}
+	for _, entry := range entries {
+		if entry.Path == "" {
+			continue
+		}
+		info, err := os.Stat(entry.Path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				log.Printf("snapshot: skipping %s, %s does not exist\n",
+					entry.Name, entry.Path)
+				continue
+			}
+			return nil, err
+		}
+		entry.Dir = info.IsDir()
+		manifest.Entries = append(manifest.Entries, entry)
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	buf, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	header := &tar.Header{
+		Name:    manifestName,
+		Mode:    0600,
+		Size:    int64(len(buf)),
+		ModTime: manifest.Created,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(buf); err != nil {
+		return nil, err
+	}
+
+	for _, entry := range manifest.Entries {
+		if err := addEntry(tw, entry); err != nil {
+			return nil, fmt.Errorf("%s: %v", entry.Name, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, gz.Close()
+}
+
+func addEntry(tw *tar.Writer, entry Entry) error {
+	return filepath.Walk(entry.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || info.Name() == lockName {
+			return nil
+		}
+		rel, err := filepath.Rel(entry.Path, path)
+		if err != nil {
+			return err
+		}
+		name := entry.Name
+		if entry.Dir {
+			name = filepath.ToSlash(filepath.Join(entry.Name, rel))
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		// The file may still be growing, so only the size at the time of the
+		// stat is copied.
+		header := &tar.Header{
+			Name:    name,
+			Mode:    int64(info.Mode().Perm()),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err = io.CopyN(tw, file, info.Size())
+		return err
+	})
+}
+
+// Import extracts a snapshot read from r. targets maps entry names to where
+// they should be restored, entries without a target are skipped. Existing
+// files are only replaced if overwrite is set.
+//
+// Files are extracted to a staging directory beside each target and only
+// moved into place once the whole snapshot has been read, so nothing is
+// restored from a truncated archive or if any file already exists.
+func Import(r io.Reader, targets map[string]string, overwrite bool) (*Manifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	var manifest *Manifest
+	staging := map[string]string{}
+	defer func() {
+		for _, dir := range staging {
+			os.RemoveAll(dir)
+		}
+	}()
+	staged := []stagedFile{}
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if header.Name == manifestName {
+			manifest = &Manifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, fmt.Errorf("bad manifest: %v", err)
+			}
+			if manifest.Version > manifestVersion {
+				return nil, fmt.Errorf("unsupported snapshot version %d",
+					manifest.Version)
+			}
+			continue
+		}
+
+		target, path, err := targetPath(header.Name, targets)
+		if err != nil {
+			return nil, err
+		}
+		if path == "" {
+			continue
+		}
+		dir, ok := staging[target]
+		if !ok {
+			parent := filepath.Dir(target)
+			if err := os.MkdirAll(parent, 0755); err != nil {
+				return nil, err
+			}
+			dir, err = ioutil.TempDir(parent, "."+filepath.Base(target)+".import")
+			if err != nil {
+				return nil, err
+			}
+			staging[target] = dir
+		}
+		file := stagedFile{
+			from: filepath.Join(dir, strconv.Itoa(len(staged))),
+			to:   path,
+		}
+		if err := extractFile(tr, header, file.from); err != nil {
+			return nil, err
+		}
+		staged = append(staged, file)
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("not a snapshot: no manifest")
+	}
+
+	if !overwrite {
+		exists := []string{}
+		for _, file := range staged {
+			if _, err := os.Stat(file.to); err == nil {
+				exists = append(exists, file.to)
+			}
+		}
+		if len(exists) > 0 {
+			return nil, fmt.Errorf("%d files already exist, such as %s",
+				len(exists), exists[0])
+		}
+	}
+	for _, file := range staged {
+		if err := os.MkdirAll(filepath.Dir(file.to), 0755); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(file.from, file.to); err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("snapshot: imported %d files from %s, created %v\n",
+		len(staged), manifest.Hostname, manifest.Created)
+	return manifest, nil
+}
+
+type stagedFile struct {
+	from string
+	to   string
+}
+
+// targetPath maps an archive name to a path using the target for its first
+// path element, returning the target and the path. Returns an empty path if
+// there is no target.
+func targetPath(name string, targets map[string]string) (string, string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || clean == ".." ||
+		strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", "", fmt.Errorf("invalid path in snapshot: %s", name)
+	}
+	parts := strings.SplitN(filepath.ToSlash(clean), "/", 2)
+	target, ok := targets[parts[0]]
+	if !ok || target == "" {
+		return "", "", nil
+	}
+	if len(parts) == 1 {
+		return target, target, nil
+	}
+	return target, filepath.Join(target, filepath.FromSlash(parts[1])), nil
+}
+
+func extractFile(tr *tar.Reader, header *tar.Header, path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY,
+		os.FileMode(header.Mode).Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, tr); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(path, header.ModTime, header.ModTime)
+}
@@ -0,0 +1,200 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func export(t *testing.T, src string) []byte {
+	writeFiles(t, src, map[string]string{
+		"data/journal/a": "journal",
+		"data/reports/b": "report",
+		"alerts.yaml":    "rules",
+	})
+	var buf bytes.Buffer
+	_, err := Export(&buf, []Entry{
+		{Name: "data", Path: filepath.Join(src, "data")},
+		{Name: "alerts", Path: filepath.Join(src, "alerts.yaml")},
+		{Name: "config", Path: filepath.Join(src, "missing.yaml")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExportImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	lock, err := LockDir(filepath.Join(src, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Unlock()
+	archive := export(t, src)
+
+	// The manifest is first.
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := tar.NewReader(gz).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Name != manifestName {
+		t.Fatalf("expected %s first, got %s", manifestName, header.Name)
+	}
+
+	dst := filepath.Join(dir, "dst")
+	manifest, err := Import(bytes.NewReader(archive), map[string]string{
+		"data":   filepath.Join(dst, "data"),
+		"alerts": filepath.Join(dst, "alerts.yaml"),
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Entries) != 2 {
+		t.Fatalf("expected 2 entries, got %v", manifest.Entries)
+	}
+	for name, expected := range map[string]string{
+		"data/journal/a": "journal",
+		"data/reports/b": "report",
+		"alerts.yaml":    "rules",
+	} {
+		content, err := ioutil.ReadFile(filepath.Join(dst, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != expected {
+			t.Fatalf("%s: expected %q, got %q", name, expected, content)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dst, "data", lockName)); !os.IsNotExist(err) {
+		t.Fatalf("expected the lock file not to be exported")
+	}
+	remaining, err := ioutil.ReadDir(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 2 {
+		t.Fatalf("expected staging directories to be removed, got %d files", len(remaining))
+	}
+}
+
+func TestImportCollision(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archive := export(t, filepath.Join(dir, "src"))
+
+	dst := filepath.Join(dir, "dst")
+	writeFiles(t, dst, map[string]string{"data/reports/b": "existing"})
+	targets := map[string]string{
+		"data":   filepath.Join(dst, "data"),
+		"alerts": filepath.Join(dst, "alerts.yaml"),
+	}
+
+	// Nothing is restored if any file exists.
+	if _, err := Import(bytes.NewReader(archive), targets, false); err == nil {
+		t.Fatal("expected an error as a file exists")
+	}
+	for _, name := range []string{"data/journal/a", "alerts.yaml"} {
+		if _, err := os.Stat(filepath.Join(dst, filepath.FromSlash(name))); !os.IsNotExist(err) {
+			t.Fatalf("expected %s not to be restored", name)
+		}
+	}
+
+	if _, err := Import(bytes.NewReader(archive), targets, true); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dst, "data", "reports", "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "report" {
+		t.Fatalf("expected the file to be replaced, got %q", content)
+	}
+}
+
+func TestImportTruncated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archive := export(t, filepath.Join(dir, "src"))
+
+	dst := filepath.Join(dir, "dst")
+	_, err = Import(bytes.NewReader(archive[:len(archive)/2]), map[string]string{
+		"data": filepath.Join(dst, "data"),
+	}, false)
+	if err == nil {
+		t.Fatal("expected an error importing a truncated snapshot")
+	}
+	if _, err := os.Stat(filepath.Join(dst, "data")); !os.IsNotExist(err) {
+		t.Fatal("expected nothing to be restored")
+	}
+}
+
+func TestLockDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lock, err := LockDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LockDir(dir); err != ErrInUse {
+		t.Fatalf("expected %v, got %v", ErrInUse, err)
+	}
+	if err := lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	lock, err = LockDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Unlock()
+}
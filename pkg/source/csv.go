@@ -0,0 +1,197 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package source
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	Register("csv", NewCSVSource)
+}
+
+// CSVReader reads trades from CSV with the columns:
+//
+//	timestamp,symbol,price,quantity,side[,id]
+//
+// The timestamp is unix milliseconds or RFC3339 and side is the taker side,
+// buy or sell. A header row is skipped.
+type CSVReader struct {
+	reader *csv.Reader
+	line   int
+	nextId int64
+}
+
+func NewCSVReader(r io.Reader) *CSVReader {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+	return &CSVReader{
+		reader: reader,
+		nextId: 1,
+	}
+}
+
+// Next returns the next trade, or io.EOF at the end of the input.
+func (r *CSVReader) Next() (pkg.CommonTrade, error) {
+	for {
+		record, err := r.reader.Read()
+		if err != nil {
+			return pkg.CommonTrade{}, err
+		}
+		r.line++
+		trade, err := r.parse(record)
+		if err != nil {
+			if r.line == 1 {
+				// Assume a header.
+				continue
+			}
+			return trade, fmt.Errorf("line %d: %v", r.line, err)
+		}
+		return trade, nil
+	}
+}
+
+func (r *CSVReader) parse(record []string) (pkg.CommonTrade, error) {
+	trade := pkg.CommonTrade{}
+	if len(record) < 5 {
+		return trade, fmt.Errorf("expected at least 5 fields, got %d", len(record))
+	}
+	timestamp, err := parseTimestamp(record[0])
+	if err != nil {
+		return trade, err
+	}
+	trade.Timestamp = timestamp
+	trade.Symbol = strings.ToUpper(record[1])
+	if trade.Price, err = strconv.ParseFloat(record[2], 64); err != nil {
+		return trade, fmt.Errorf("bad price: %v", err)
+	}
+	if trade.Quantity, err = strconv.ParseFloat(record[3], 64); err != nil {
+		return trade, fmt.Errorf("bad quantity: %v", err)
+	}
+	switch strings.ToLower(record[4]) {
+	case "buy":
+		trade.BuyerMaker = false
+	case "sell":
+		trade.BuyerMaker = true
+	default:
+		return trade, fmt.Errorf("bad side: %s", record[4])
+	}
+	if len(record) > 5 && record[5] != "" {
+		if trade.Id, err = strconv.ParseInt(record[5], 10, 64); err != nil {
+			return trade, fmt.Errorf("bad id: %v", err)
+		}
+	} else {
+		trade.Id = r.nextId
+	}
+	r.nextId = trade.Id + 1
+	return trade, nil
+}
+
+func parseTimestamp(value string) (time.Time, error) {
+	if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(0, millis*int64(time.Millisecond)), nil
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return timestamp, fmt.Errorf("bad timestamp: %s", value)
+	}
+	return timestamp, nil
+}
+
+type csvOptions struct {
+	File string `json:"file"`
+
+	// Replay speed relative to the original timeline, 0 for as fast as
+	// possible.
+	Speed float64 `json:"speed"`
+
+	// Shift the timestamps so the replay starts now, so it is treated as
+	// live by the trackers.
+	Rebase bool `json:"rebase"`
+
+	// Restart from the beginning at the end of the file.
+	Loop bool `json:"loop"`
+}
+
+// CSVSource replays trades from a CSV file.
+type CSVSource struct {
+	options csvOptions
+}
+
+func NewCSVSource(options map[string]interface{}) (Source, error) {
+	source := &CSVSource{
+		options: csvOptions{
+			Speed:  1,
+			Rebase: true,
+		},
+	}
+	if err := DecodeOptions(options, &source.options); err != nil {
+		return nil, err
+	}
+	if source.options.File == "" {
+		return nil, fmt.Errorf("csv: file required")
+	}
+	if _, err := os.Stat(source.options.File); err != nil {
+		return nil, fmt.Errorf("csv: %v", err)
+	}
+	return source, nil
+}
+
+func (s *CSVSource) Run(ctx context.Context, publish func(trade pkg.CommonTrade)) error {
+	for {
+		if err := s.replay(ctx, publish); err != nil {
+			return err
+		}
+		if !s.options.Loop || ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+func (s *CSVSource) replay(ctx context.Context, publish func(trade pkg.CommonTrade)) error {
+	file, err := os.Open(s.options.File)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := NewCSVReader(file)
+	pacer := NewPacer(s.options.Speed, s.options.Rebase)
+
+	for ctx.Err() == nil {
+		trade, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !pacer.Pace(ctx, &trade) {
+			return nil
+		}
+		publish(trade)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package source
+
+import (
+	"context"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"time"
+)
+
+// Pacer paces the trades of a replay against their original timeline.
+type Pacer struct {
+	// Speed relative to the original timeline, 0 for as fast as possible.
+	speed float64
+
+	// Shift the timestamps so the replay starts now, so it is treated as
+	// live by the trackers.
+	rebase bool
+
+	start time.Time
+	first time.Time
+}
+
+func NewPacer(speed float64, rebase bool) *Pacer {
+	return &Pacer{
+		speed:  speed,
+		rebase: rebase,
+	}
+}
+
+// Pace waits until trade is due, then rebases its timestamp if enabled.
+// False is returned if ctx is cancelled while waiting.
+func (p *Pacer) Pace(ctx context.Context, trade *pkg.CommonTrade) bool {
+	if p.first.IsZero() {
+		p.start = time.Now()
+		p.first = trade.Timestamp
+	}
+	offset := trade.Timestamp.Sub(p.first)
+	if p.speed > 0 {
+		offset = time.Duration(float64(offset) / p.speed)
+		if wait := p.start.Add(offset).Sub(time.Now()); wait > 0 {
+			if !pkg.Sleep(ctx, wait) {
+				return false
+			}
+		}
+	}
+	if p.rebase {
+		trade.Timestamp = p.start.Add(offset)
+	}
+	return true
+}
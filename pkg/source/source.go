@@ -0,0 +1,182 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package source adapts non-exchange trade feeds, such as internal matching
+// engines, CSV replays or FIX bridges, into a pkg.Exchange so their symbols
+// flow through the trackers, events and API like any exchange.
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Source is implemented by each trade source adapter.
+type Source interface {
+	// Run calls publish with each trade until ctx is cancelled or the
+	// source is exhausted.
+	Run(ctx context.Context, publish func(trade pkg.CommonTrade)) error
+}
+
+// Config configures a source from the "sources" section of the config
+// file, for example:
+//
+//	sources:
+//	  - name: internal
+//	    type: csv
+//	    options:
+//	      file: trades.csv
+type Config struct {
+	// The name the source is exposed as, in place of the exchange name in
+	// URL paths.
+	Name    string
+	Type    string
+	Options map[string]interface{}
+}
+
+// Factory creates a source from the options of its config.
+type Factory func(options map[string]interface{}) (Source, error)
+
+var factories = map[string]Factory{}
+var factoriesLock sync.Mutex
+
+// Register makes a source type available to the config. Typically called
+// from the init function of the package implementing the source.
+func Register(sourceType string, factory Factory) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+	factories[sourceType] = factory
+}
+
+// Types returns the registered source types.
+func Types() []string {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+	types := []string{}
+	for sourceType := range factories {
+		types = append(types, sourceType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// New creates the source for config wrapped as an exchange.
+func New(config Config) (*Exchange, error) {
+	if config.Name == "" {
+		return nil, fmt.Errorf("source name required")
+	}
+	factoriesLock.Lock()
+	factory := factories[config.Type]
+	factoriesLock.Unlock()
+	if factory == nil {
+		return nil, fmt.Errorf("%s: unknown source type: %s (available: %v)",
+			config.Name, config.Type, Types())
+	}
+	source, err := factory(config.Options)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", config.Name, err)
+	}
+	return NewExchange(config.Name, source), nil
+}
+
+// DecodeOptions decodes the options of a source config into v, a pointer to
+// a struct with json tags.
+func DecodeOptions(options map[string]interface{}, v interface{}) error {
+	buf, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(buf, v); err != nil {
+		return fmt.Errorf("invalid options: %v", err)
+	}
+	return nil
+}
+
+// Exchange implements pkg.Exchange for a source. Sources only provide
+// trades, so tickers are derived from the trades.
+type Exchange struct {
+	name         string
+	tradeStream  *tradeStream
+	tickerStream *TickerBuilder
+}
+
+func NewExchange(name string, source Source) *Exchange {
+	tickers := NewTickerBuilder()
+	return &Exchange{
+		name: name,
+		tradeStream: &tradeStream{
+			TradePublisher: pkg.NewTradePublisher(name + ".trades"),
+			name:           name,
+			source:         source,
+			tickers:        tickers,
+		},
+		tickerStream: tickers,
+	}
+}
+
+func (e *Exchange) Name() string {
+	return e.name
+}
+
+func (e *Exchange) Market() pkg.Market {
+	return pkg.MarketSpot
+}
+
+// GetSymbols returns the symbols that have traded so far.
+func (e *Exchange) GetSymbols() ([]string, error) {
+	return e.tickerStream.Symbols(), nil
+}
+
+func (e *Exchange) TradeStream() pkg.TradeStream {
+	return e.tradeStream
+}
+
+func (e *Exchange) TickerStream() pkg.TickerStream {
+	return e.tickerStream
+}
+
+func (e *Exchange) DepthStream() pkg.DepthStream {
+	return nil
+}
+
+type tradeStream struct {
+	*pkg.TradePublisher
+	name    string
+	source  Source
+	tickers *TickerBuilder
+}
+
+func (s *tradeStream) Run(ctx context.Context) {
+	log.Printf("%s: source starting\n", s.name)
+	count := 0
+	err := s.source.Run(ctx, func(trade pkg.CommonTrade) {
+		s.tickers.AddTrade(trade)
+		s.Publish(trade)
+		count++
+	})
+	if err != nil && ctx.Err() == nil {
+		log.Printf("error: %s: source failed: %v\n", s.name, err)
+	}
+	log.Printf("%s: source stopped after %d trades\n", s.name, count)
+}
+
+// The interval at which tickers are derived from the trades.
+const tickerInterval = time.Second
@@ -0,0 +1,168 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package source
+
+import (
+	"context"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"sort"
+	"sync"
+	"time"
+)
+
+type minuteBucket struct {
+	minute      time.Time
+	open        float64
+	high        float64
+	low         float64
+	quoteVolume float64
+}
+
+type symbolStats struct {
+	last    pkg.CommonTrade
+	updated bool
+	buckets []minuteBucket
+}
+
+// TickerBuilder derives 24 hour rolling tickers from trades, for sources
+// that do not provide their own. Tickers are timestamped with the last
+// trade so replayed sources keep their original timeline.
+type TickerBuilder struct {
+	symbols map[string]*symbolStats
+	lock    sync.Mutex
+}
+
+func NewTickerBuilder() *TickerBuilder {
+	return &TickerBuilder{
+		symbols: map[string]*symbolStats{},
+	}
+}
+
+func (b *TickerBuilder) AddTrade(trade pkg.CommonTrade) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	stats := b.symbols[trade.Symbol]
+	if stats == nil {
+		stats = &symbolStats{}
+		b.symbols[trade.Symbol] = stats
+	}
+	stats.last = trade
+	stats.updated = true
+
+	minute := trade.Timestamp.Truncate(time.Minute)
+	n := len(stats.buckets)
+	if n == 0 || minute.After(stats.buckets[n-1].minute) {
+		stats.buckets = append(stats.buckets, minuteBucket{
+			minute: minute,
+			open:   trade.Price,
+			high:   trade.Price,
+			low:    trade.Price,
+		})
+		n++
+	}
+	bucket := &stats.buckets[n-1]
+	if trade.Price > bucket.high {
+		bucket.high = trade.Price
+	}
+	if trade.Price < bucket.low {
+		bucket.low = trade.Price
+	}
+	bucket.quoteVolume += trade.QuoteQuantity()
+
+	// Drop buckets older than 24 hours.
+	cutoff := minute.Add(-24 * time.Hour)
+	i := 0
+	for i < len(stats.buckets) && !stats.buckets[i].minute.After(cutoff) {
+		i++
+	}
+	stats.buckets = stats.buckets[i:]
+}
+
+// Symbols returns the symbols seen so far.
+func (b *TickerBuilder) Symbols() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	symbols := make([]string, 0, len(b.symbols))
+	for symbol := range b.symbols {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	return symbols
+}
+
+// Tickers returns the tickers for symbols that have traded since the last
+// call.
+func (b *TickerBuilder) Tickers() []pkg.CommonTicker {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	tickers := []pkg.CommonTicker{}
+	for symbol, stats := range b.symbols {
+		if !stats.updated {
+			continue
+		}
+		stats.updated = false
+		ticker := pkg.CommonTicker{
+			Symbol:    symbol,
+			Timestamp: stats.last.Timestamp,
+			LastPrice: stats.last.Price,
+			Bid:       stats.last.Price,
+			Ask:       stats.last.Price,
+			High:      stats.last.Price,
+			Low:       stats.last.Price,
+		}
+		for _, bucket := range stats.buckets {
+			ticker.QuoteVolume += bucket.quoteVolume
+			if bucket.high > ticker.High {
+				ticker.High = bucket.high
+			}
+			if bucket.low < ticker.Low {
+				ticker.Low = bucket.low
+			}
+		}
+		if open := stats.buckets[0].open; open > 0 {
+			ticker.PriceChangePct24 = (ticker.LastPrice - open) / open * 100
+		}
+		tickers = append(tickers, ticker)
+	}
+	return tickers
+}
+
+// ReplayCache implements pkg.TickerStream, sources are not cached.
+func (b *TickerBuilder) ReplayCache(cb func(tickers []pkg.CommonTicker)) {
+}
+
+// Run implements pkg.TickerStream, sending the tickers that changed every
+// tickerInterval.
+func (b *TickerBuilder) Run(ctx context.Context, channel chan []pkg.CommonTicker) {
+	ticker := time.NewTicker(tickerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		tickers := b.Tickers()
+		if len(tickers) == 0 {
+			continue
+		}
+		select {
+		case channel <- tickers:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,328 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package spread matches equivalent pairs across exchanges, such as
+// BTCUSDT on Binance and BTC-USDT on KuCoin, and tracks the spread between
+// their last trade prices, raising an alert when it stays wide.
+package spread
+
+import (
+	"context"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/metrics"
+	"sort"
+	"sync"
+	"time"
+)
+
+func init() {
+	metrics.Describe("spread_alerts_total",
+		"Cross-exchange spread alerts raised, by pair.")
+}
+
+// How often the spreads are checked against the threshold.
+const checkInterval = time.Second
+
+type Config struct {
+	// Spreads of at least this percentage of the lowest price are wide. A
+	// threshold of 0 disables the monitor.
+	ThresholdPct float64 `mapstructure:"threshold_pct" json:"threshold_pct"`
+
+	// How long a spread must stay wide before an alert is raised.
+	Duration time.Duration `mapstructure:"duration" json:"duration"`
+
+	// Prices older than this are not compared, so a pair that stopped
+	// trading on one exchange does not raise alerts.
+	MaxAge time.Duration `mapstructure:"max_age" json:"max_age"`
+
+	// Match pairs quoted in different USD stable coins, such as BTCUSDT
+	// and BTC-USD.
+	UsdEquivalent bool `mapstructure:"usd_equivalent" json:"usd_equivalent"`
+
+	// Names of the alert webhooks and notifiers to deliver to. Empty
+	// delivers to all.
+	Webhooks []string `mapstructure:"webhooks" json:"webhooks,omitempty"`
+	Notify   []string `mapstructure:"notify" json:"notify,omitempty"`
+}
+
+var DefaultConfig = Config{
+	Duration: 30 * time.Second,
+	MaxAge:   time.Minute,
+}
+
+// Override returns c with the fields that are set in override replaced.
+func (c Config) Override(override Config) Config {
+	if override.ThresholdPct != 0 {
+		c.ThresholdPct = override.ThresholdPct
+	}
+	if override.Duration != 0 {
+		c.Duration = override.Duration
+	}
+	if override.MaxAge != 0 {
+		c.MaxAge = override.MaxAge
+	}
+	if override.UsdEquivalent {
+		c.UsdEquivalent = true
+	}
+	if len(override.Webhooks) > 0 {
+		c.Webhooks = override.Webhooks
+	}
+	if len(override.Notify) > 0 {
+		c.Notify = override.Notify
+	}
+	return c
+}
+
+func (c Config) Validate() error {
+	if c.ThresholdPct < 0 || c.Duration < 0 {
+		return fmt.Errorf("spread threshold and duration must not be negative")
+	}
+	if c.MaxAge <= 0 {
+		return fmt.Errorf("spread max age must be positive")
+	}
+	return nil
+}
+
+func (c Config) Enabled() bool {
+	return c.ThresholdPct > 0
+}
+
+// Price is the last trade price of a pair on an exchange.
+type Price struct {
+	Exchange  string    `json:"exchange"`
+	Symbol    string    `json:"symbol"`
+	Price     float64   `json:"price"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Spread is the spread of a pair between the exchanges with the highest and
+// lowest price.
+type Spread struct {
+	Pair   string  `json:"pair"`
+	High   Price   `json:"high"`
+	Low    Price   `json:"low"`
+	Pct    float64 `json:"pct"`
+	Prices []Price `json:"prices"`
+
+	// When the spread became wide, nil if it is not.
+	WideSince *time.Time `json:"wide_since,omitempty"`
+}
+
+// Alert is raised when the spread of a pair has been wide for the
+// configured duration. It is raised once until the spread narrows again.
+type Alert struct {
+	Spread
+	Duration time.Duration
+}
+
+func (a Alert) Message() string {
+	return fmt.Sprintf("spread: %s %.2f%% for %v: %s %s %v, %s %s %v",
+		a.Pair, a.Pct, a.Duration.Round(time.Second),
+		a.High.Exchange, a.High.Symbol, a.High.Price,
+		a.Low.Exchange, a.Low.Symbol, a.Low.Price)
+}
+
+type pairState struct {
+	prices    map[string]Price
+	wideSince time.Time
+	alerted   bool
+}
+
+// Monitor tracks the last trade price of each pair per exchange. Trades are
+// received through the sink of each exchange. Safe for concurrent use.
+type Monitor struct {
+	config Config
+	pairs  map[string]*pairState
+	lock   sync.Mutex
+
+	// Called with each alert from Run.
+	onAlert func(alert Alert)
+}
+
+func NewMonitor(config Config, onAlert func(alert Alert)) *Monitor {
+	return &Monitor{
+		config:  config,
+		pairs:   map[string]*pairState{},
+		onAlert: onAlert,
+	}
+}
+
+func (m *Monitor) Config() Config {
+	return m.config
+}
+
+// PairKey returns the key symbol is matched across exchanges by, such as
+// BTC/USDT, or false if its quote asset is unknown.
+func (m *Monitor) PairKey(symbol string) (string, bool) {
+	base, quote, ok := pkg.SplitSymbol(symbol)
+	if !ok {
+		return "", false
+	}
+	if m.config.UsdEquivalent && pkg.IsUsdAsset(quote) {
+		quote = "USD"
+	}
+	return base + "/" + quote, true
+}
+
+// Sink returns the sink the trades of exchange are received by.
+func (m *Monitor) Sink(exchange string) pkg.Sink {
+	return &monitorSink{monitor: m, exchange: exchange}
+}
+
+type monitorSink struct {
+	monitor  *Monitor
+	exchange string
+}
+
+func (s *monitorSink) Name() string {
+	return "spread"
+}
+
+func (s *monitorSink) Send(message interface{}) error {
+	trade, ok := message.(pkg.CommonTrade)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", message)
+	}
+	s.monitor.AddTrade(s.exchange, trade)
+	return nil
+}
+
+// AddTrade updates the price of the pair of trade on exchange.
+func (m *Monitor) AddTrade(exchange string, trade pkg.CommonTrade) {
+	key, ok := m.PairKey(trade.Symbol)
+	if !ok || trade.Price <= 0 {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	state := m.pairs[key]
+	if state == nil {
+		state = &pairState{
+			prices: map[string]Price{},
+		}
+		m.pairs[key] = state
+	}
+	if last, ok := state.prices[exchange]; ok && trade.Timestamp.Before(last.Timestamp) {
+		return
+	}
+	state.prices[exchange] = Price{
+		Exchange:  exchange,
+		Symbol:    trade.Symbol,
+		Price:     trade.Price,
+		Timestamp: trade.Timestamp,
+	}
+}
+
+// spread returns the spread of a pair between the prices not older than
+// MaxAge at now, or false if fewer than 2 exchanges have one.
+func (m *Monitor) spread(pair string, state *pairState, now time.Time) (Spread, bool) {
+	prices := []Price{}
+	for _, price := range state.prices {
+		if now.Sub(price.Timestamp) <= m.config.MaxAge {
+			prices = append(prices, price)
+		}
+	}
+	if len(prices) < 2 {
+		return Spread{}, false
+	}
+	sort.Slice(prices, func(i, j int) bool {
+		return prices[i].Price > prices[j].Price
+	})
+	high := prices[0]
+	low := prices[len(prices)-1]
+	return Spread{
+		Pair:   pair,
+		High:   high,
+		Low:    low,
+		Pct:    pkg.Round3((high.Price - low.Price) / low.Price * 100),
+		Prices: prices,
+	}, true
+}
+
+// check updates how long the spread of each pair has been wide at now and
+// returns the alerts for those wide for the configured duration.
+func (m *Monitor) check(now time.Time) []Alert {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	alerts := []Alert{}
+	for pair, state := range m.pairs {
+		spread, ok := m.spread(pair, state, now)
+		if !ok || spread.Pct < m.config.ThresholdPct {
+			state.wideSince = time.Time{}
+			state.alerted = false
+			continue
+		}
+		if state.wideSince.IsZero() {
+			state.wideSince = now
+		}
+		duration := now.Sub(state.wideSince)
+		if state.alerted || duration < m.config.Duration {
+			continue
+		}
+		state.alerted = true
+		alerts = append(alerts, Alert{
+			Spread:   spread,
+			Duration: duration,
+		})
+	}
+	return alerts
+}
+
+// Spreads returns the current spread of each pair traded on at least 2
+// exchanges with a spread of at least minPct, widest first.
+func (m *Monitor) Spreads(minPct float64) []Spread {
+	now := time.Now()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	result := []Spread{}
+	for pair, state := range m.pairs {
+		spread, ok := m.spread(pair, state, now)
+		if !ok || spread.Pct < minPct {
+			continue
+		}
+		if !state.wideSince.IsZero() {
+			since := state.wideSince
+			spread.WideSince = &since
+		}
+		result = append(result, spread)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Pct > result[j].Pct
+	})
+	return result
+}
+
+// Run checks the spreads every checkInterval until ctx is cancelled.
+func (m *Monitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, alert := range m.check(now) {
+				metrics.GetCounter("spread_alerts_total",
+					metrics.Labels{"pair": alert.Pair}).Inc()
+				log.Printf("%s\n", alert.Message())
+				if m.onAlert != nil {
+					m.onAlert(alert)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package stats
+
+import (
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"sort"
+	"sync"
+	"time"
+)
+
+type SymbolStats struct {
+	Symbol    string                 `json:"symbol"`
+	Price     float64                `json:"price"`
+	Timestamp time.Time              `json:"timestamp"`
+	Windows   map[string]WindowStats `json:"windows"`
+}
+
+// Aggregator maintains the rolling statistics of every symbol of an
+// exchange. It is a sink for the trade stream.
+type Aggregator struct {
+	name    string
+	symbols map[string]*Rolling
+
+	// The last trade added for each symbol, and the last trade of each
+	// symbol restored from a previous run.
+	last     map[string]pkg.TradeMark
+	restored map[string]pkg.TradeMark
+
+	lock sync.Mutex
+}
+
+func NewAggregator(name string) *Aggregator {
+	return &Aggregator{
+		name:     name,
+		symbols:  map[string]*Rolling{},
+		last:     map[string]pkg.TradeMark{},
+		restored: map[string]pkg.TradeMark{},
+	}
+}
+
+func (a *Aggregator) Name() string {
+	return a.name
+}
+
+func (a *Aggregator) Send(message interface{}) error {
+	trade, ok := message.(pkg.CommonTrade)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", message)
+	}
+	a.AddTrade(trade)
+	return nil
+}
+
+func (a *Aggregator) AddTrade(trade pkg.CommonTrade) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.restored[trade.Symbol].Covers(&trade) {
+		// Already in the restored windows, such as a trade replayed from
+		// the cache or backfilled on startup.
+		return
+	}
+	a.last[trade.Symbol] = a.last[trade.Symbol].Advance(&trade)
+	rolling := a.symbols[trade.Symbol]
+	if rolling == nil {
+		rolling = NewRolling()
+		a.symbols[trade.Symbol] = rolling
+	}
+	rolling.AddTrade(trade.Timestamp, trade.Price, trade.Price*trade.Quantity,
+		!trade.BuyerMaker)
+}
+
+// Get returns the statistics of symbol as of now, or nil if no trades have
+// been seen for the symbol.
+func (a *Aggregator) Get(symbol string, now time.Time) *SymbolStats {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	rolling := a.symbols[symbol]
+	if rolling == nil {
+		return nil
+	}
+	return a.snapshot(symbol, rolling, now)
+}
+
+// GetAll returns the statistics of all symbols as of now, sorted by symbol.
+func (a *Aggregator) GetAll(now time.Time) []*SymbolStats {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	all := make([]*SymbolStats, 0, len(a.symbols))
+	for symbol, rolling := range a.symbols {
+		all = append(all, a.snapshot(symbol, rolling, now))
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Symbol < all[j].Symbol
+	})
+	return all
+}
+
+// Profile returns the volume profile of symbol over window as of now, or
+// nil if no trades have been seen for the symbol.
+func (a *Aggregator) Profile(symbol string, now time.Time, window time.Duration, levels int) *VolumeProfile {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	rolling := a.symbols[symbol]
+	if rolling == nil {
+		return nil
+	}
+	rolling.Expire(now)
+	profile := rolling.Profile(window, levels)
+	profile.Symbol = symbol
+	return &profile
+}
+
+// State returns the state of the windows of every symbol, to be restored
+// after a restart.
+func (a *Aggregator) State() map[string]RollingState {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	states := map[string]RollingState{}
+	for symbol, rolling := range a.symbols {
+		state := rolling.State()
+		state.LastTrade = a.last[symbol]
+		states[symbol] = state
+	}
+	return states
+}
+
+// Restore restores the windows saved by a previous run as of now, for
+// symbols without trades yet. Trades up to the last trade of a restored
+// symbol are not added again. Returns the number of symbols restored.
+func (a *Aggregator) Restore(states map[string]RollingState, now time.Time) int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	restored := 0
+	for symbol, state := range states {
+		if a.symbols[symbol] != nil {
+			continue
+		}
+		rolling := NewRolling()
+		rolling.Restore(state, now)
+		a.symbols[symbol] = rolling
+		a.last[symbol] = state.LastTrade
+		a.restored[symbol] = state.LastTrade
+		restored++
+	}
+	return restored
+}
+
+func (a *Aggregator) snapshot(symbol string, rolling *Rolling, now time.Time) *SymbolStats {
+	rolling.Expire(now)
+	return &SymbolStats{
+		Symbol:    symbol,
+		Price:     rolling.LastPrice(),
+		Timestamp: rolling.LastTime(),
+		Windows:   rolling.Stats(),
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package stats
+
+import (
+	"math"
+	"time"
+)
+
+// ProfileWindow is how long trades are kept for the volume profile, the
+// same as the trades kept by the ticker trackers.
+const ProfileWindow = time.Hour
+
+const (
+	DefaultProfileLevels = 20
+	MaxProfileLevels     = 200
+)
+
+// Trade prices are rounded to this many significant digits before being
+// added to the profile, so a minute keeps a bounded number of prices however
+// many trades it has.
+const profileDigits = 5
+
+// ProfileLevel is the volume traded in a price range, in the quote
+// currency.
+type ProfileLevel struct {
+	PriceLow   float64 `json:"price_low"`
+	PriceHigh  float64 `json:"price_high"`
+	Volume     float64 `json:"volume"`
+	BuyVolume  float64 `json:"buy_volume"`
+	SellVolume float64 `json:"sell_volume"`
+}
+
+// VolumeProfile is the volume of a symbol over a window split into equal
+// price ranges, lowest first.
+type VolumeProfile struct {
+	Symbol   string         `json:"symbol"`
+	Window   string         `json:"window"`
+	Volume   float64        `json:"volume"`
+	BuyRatio float64        `json:"buy_ratio"`
+	Levels   []ProfileLevel `json:"levels"`
+
+	// The middle of the level with the most volume.
+	PointOfControl float64 `json:"point_of_control"`
+}
+
+type priceVolume struct {
+	buy  float64
+	sell float64
+}
+
+type profileBucket struct {
+	// Start of the minute in unix seconds.
+	start  int64
+	prices map[float64]*priceVolume
+}
+
+// profile keeps the volume of each rounded price by minute.
+type profile struct {
+	buckets []profileBucket
+	now     int64
+}
+
+func (p *profile) add(timestamp int64, price float64, quoteVolume float64, buy bool) {
+	if price <= 0 {
+		return
+	}
+	if timestamp > p.now {
+		p.now = timestamp
+	}
+	start := timestamp - timestamp%60
+	if start <= p.now-int64(ProfileWindow/time.Second) {
+		return
+	}
+
+	i := len(p.buckets) - 1
+	for i >= 0 && p.buckets[i].start > start {
+		i--
+	}
+	if i < 0 || p.buckets[i].start != start {
+		i++
+		p.buckets = append(p.buckets, profileBucket{})
+		copy(p.buckets[i+1:], p.buckets[i:])
+		p.buckets[i] = profileBucket{start: start, prices: map[float64]*priceVolume{}}
+	}
+
+	price = roundSignificant(price, profileDigits)
+	volume := p.buckets[i].prices[price]
+	if volume == nil {
+		volume = &priceVolume{}
+		p.buckets[i].prices[price] = volume
+	}
+	if buy {
+		volume.buy += quoteVolume
+	} else {
+		volume.sell += quoteVolume
+	}
+	p.expire(p.now)
+}
+
+func (p *profile) expire(now int64) {
+	if now > p.now {
+		p.now = now
+	}
+	oldest := 0
+	for oldest < len(p.buckets) &&
+		p.buckets[oldest].start <= p.now-int64(ProfileWindow/time.Second) {
+		oldest++
+	}
+	if oldest > 0 {
+		p.buckets = append(p.buckets[:0], p.buckets[oldest:]...)
+	}
+}
+
+// build splits the volume of the minutes in window into levels price
+// ranges between the lowest and highest price traded.
+func (p *profile) build(window time.Duration, levels int) VolumeProfile {
+	since := p.now - int64(window/time.Second)
+	prices := map[float64]*priceVolume{}
+	low, high := math.Inf(1), math.Inf(-1)
+	for _, bucket := range p.buckets {
+		if bucket.start <= since {
+			continue
+		}
+		for price, volume := range bucket.prices {
+			total := prices[price]
+			if total == nil {
+				total = &priceVolume{}
+				prices[price] = total
+			}
+			total.buy += volume.buy
+			total.sell += volume.sell
+			low = math.Min(low, price)
+			high = math.Max(high, price)
+		}
+	}
+
+	result := VolumeProfile{
+		Window: WindowName(window),
+		Levels: []ProfileLevel{},
+	}
+	if len(prices) == 0 {
+		return result
+	}
+	if high == low {
+		levels = 1
+	}
+	step := (high - low) / float64(levels)
+	result.Levels = make([]ProfileLevel, levels)
+	for i := range result.Levels {
+		result.Levels[i].PriceLow = low + step*float64(i)
+		result.Levels[i].PriceHigh = low + step*float64(i+1)
+	}
+	result.Levels[levels-1].PriceHigh = high
+
+	buyVolume := float64(0)
+	for price, volume := range prices {
+		i := levels - 1
+		if step > 0 {
+			i = int((price - low) / step)
+			if i >= levels {
+				i = levels - 1
+			}
+		}
+		level := &result.Levels[i]
+		level.BuyVolume += volume.buy
+		level.SellVolume += volume.sell
+		level.Volume += volume.buy + volume.sell
+		result.Volume += volume.buy + volume.sell
+		buyVolume += volume.buy
+	}
+	result.BuyRatio = ratio(buyVolume, result.Volume)
+
+	top := 0
+	for i, level := range result.Levels {
+		if level.Volume > result.Levels[top].Volume {
+			top = i
+		}
+	}
+	result.PointOfControl = (result.Levels[top].PriceLow + result.Levels[top].PriceHigh) / 2
+	return result
+}
+
+// roundSignificant rounds value to digits significant digits.
+func roundSignificant(value float64, digits int) float64 {
+	if value == 0 {
+		return 0
+	}
+	scale := math.Pow(10, float64(digits)-math.Ceil(math.Log10(math.Abs(value))))
+	return math.Round(value*scale) / scale
+}
+
+// ratio returns a / b, or 0 if b is 0.
+func ratio(a float64, b float64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return a / b
+}
@@ -0,0 +1,303 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package stats maintains rolling window statistics per symbol, computed
+// incrementally from the trade stream.
+package stats
+
+import (
+	"strconv"
+	"time"
+)
+
+// Windows are the rolling windows statistics are kept for.
+var Windows = []time.Duration{
+	1 * time.Minute,
+	5 * time.Minute,
+	15 * time.Minute,
+	1 * time.Hour,
+	4 * time.Hour,
+	24 * time.Hour,
+}
+
+// Windows up to this length are kept at one second resolution, longer
+// windows at one minute resolution. Keeping 24 hours of second buckets
+// for every active symbol would use far too much memory.
+const fineWindowLimit = 15 * time.Minute
+
+// WindowStats are the statistics of one window. Volumes are in the quote
+// currency, buy volume being trades where the taker bought.
+type WindowStats struct {
+	PriceChangePct float64 `json:"price_change_pct"`
+	Volume         float64 `json:"volume"`
+	BuyVolume      float64 `json:"buy_volume"`
+	SellVolume     float64 `json:"sell_volume"`
+	NetVolume      float64 `json:"net_volume"`
+	Trades         int64   `json:"trades"`
+
+	// The share of the volume where the taker bought, 0.5 when balanced,
+	// and the buy volume as a multiple of the sell volume, 0 without sells.
+	BuyRatio     float64 `json:"buy_ratio"`
+	BuySellRatio float64 `json:"buy_sell_ratio"`
+}
+
+type totals struct {
+	volume     float64
+	buyVolume  float64
+	sellVolume float64
+	trades     int64
+}
+
+func (t *totals) add(o *totals) {
+	t.volume += o.volume
+	t.buyVolume += o.buyVolume
+	t.sellVolume += o.sellVolume
+	t.trades += o.trades
+}
+
+func (t *totals) sub(o *totals) {
+	t.volume -= o.volume
+	t.buyVolume -= o.buyVolume
+	t.sellVolume -= o.sellVolume
+	t.trades -= o.trades
+}
+
+type bucket struct {
+	// Start of the bucket in unix seconds.
+	start int64
+	open  float64
+
+	// Timestamp of the trade the bucket opened at.
+	opened int64
+
+	totals
+}
+
+type window struct {
+	length int64
+
+	// Index of the oldest bucket in the window.
+	first int
+
+	totals totals
+}
+
+// series is a list of buckets at a fixed resolution with the running totals
+// of each window over them.
+type series struct {
+	resolution int64
+	buckets    []bucket
+	windows    []*window
+
+	// The latest event time seen, in unix seconds. Windows end here rather
+	// than at the wall clock time so late and replayed trades produce the
+	// same totals as live trades.
+	now int64
+
+	// The length of the longest window.
+	longest int64
+}
+
+func newSeries(resolution time.Duration, windows []time.Duration) *series {
+	s := &series{
+		resolution: int64(resolution / time.Second),
+	}
+	for _, length := range windows {
+		s.windows = append(s.windows, &window{
+			length: int64(length / time.Second),
+		})
+		if int64(length/time.Second) > s.longest {
+			s.longest = int64(length / time.Second)
+		}
+	}
+	return s
+}
+
+// add adds a trade to the bucket of its timestamp. A late trade is added to
+// its own bucket, and only to the windows that bucket is still in.
+func (s *series) add(timestamp int64, price float64, trade *totals) {
+	if timestamp > s.now {
+		s.now = timestamp
+	}
+	start := timestamp - timestamp%s.resolution
+	if start <= s.now-s.longest {
+		// Older than all windows.
+		return
+	}
+
+	n := len(s.buckets)
+	i := n - 1
+	for i >= 0 && s.buckets[i].start > start {
+		i--
+	}
+	if i < 0 || s.buckets[i].start != start {
+		i++
+		s.buckets = append(s.buckets, bucket{})
+		copy(s.buckets[i+1:], s.buckets[i:])
+		s.buckets[i] = bucket{start: start, open: price, opened: timestamp}
+		for _, window := range s.windows {
+			if window.first > i || (window.first == i && start <= s.now-window.length) {
+				window.first++
+			}
+		}
+	} else if timestamp < s.buckets[i].opened {
+		s.buckets[i].open = price
+		s.buckets[i].opened = timestamp
+	}
+
+	s.buckets[i].add(trade)
+	for _, window := range s.windows {
+		if i >= window.first {
+			window.totals.add(trade)
+		}
+	}
+	s.expire(s.now)
+}
+
+// expire removes buckets that have left each window, dropping buckets that
+// have left all windows.
+func (s *series) expire(now int64) {
+	if now > s.now {
+		s.now = now
+	}
+	now = s.now
+	oldest := len(s.buckets)
+	for _, window := range s.windows {
+		for window.first < len(s.buckets) &&
+			s.buckets[window.first].start <= now-window.length {
+			window.totals.sub(&s.buckets[window.first].totals)
+			window.first++
+		}
+		if window.first < oldest {
+			oldest = window.first
+		}
+	}
+	if oldest > 0 && oldest > len(s.buckets)/2 {
+		s.buckets = append(s.buckets[:0], s.buckets[oldest:]...)
+		for _, window := range s.windows {
+			window.first -= oldest
+		}
+	}
+}
+
+func (s *series) stats(i int, last float64) WindowStats {
+	window := s.windows[i]
+	stats := WindowStats{
+		Volume:     window.totals.volume,
+		BuyVolume:  window.totals.buyVolume,
+		SellVolume: window.totals.sellVolume,
+		NetVolume:  window.totals.buyVolume - window.totals.sellVolume,
+		Trades:     window.totals.trades,
+	}
+	stats.BuyRatio = ratio(stats.BuyVolume, stats.Volume)
+	stats.BuySellRatio = ratio(stats.BuyVolume, stats.SellVolume)
+	if window.first < len(s.buckets) {
+		if open := s.buckets[window.first].open; open > 0 {
+			stats.PriceChangePct = (last - open) / open * 100
+		}
+	}
+	return stats
+}
+
+// Rolling keeps the rolling window statistics for one symbol.
+type Rolling struct {
+	fine      *series
+	coarse    *series
+	profile   profile
+	lastPrice float64
+	lastTime  time.Time
+}
+
+func NewRolling() *Rolling {
+	fine := []time.Duration{}
+	coarse := []time.Duration{}
+	for _, window := range Windows {
+		if window <= fineWindowLimit {
+			fine = append(fine, window)
+		} else {
+			coarse = append(coarse, window)
+		}
+	}
+	return &Rolling{
+		fine:   newSeries(time.Second, fine),
+		coarse: newSeries(time.Minute, coarse),
+	}
+}
+
+// AddTrade adds a trade with the quote volume of the trade. Set buy if the
+// taker bought.
+func (r *Rolling) AddTrade(timestamp time.Time, price float64, quoteVolume float64, buy bool) {
+	trade := totals{volume: quoteVolume, trades: 1}
+	if buy {
+		trade.buyVolume = quoteVolume
+	} else {
+		trade.sellVolume = quoteVolume
+	}
+	unix := timestamp.Unix()
+	r.fine.add(unix, price, &trade)
+	r.coarse.add(unix, price, &trade)
+	r.profile.add(unix, price, quoteVolume, buy)
+	if !timestamp.Before(r.lastTime) {
+		r.lastPrice = price
+		r.lastTime = timestamp
+	}
+}
+
+// Expire removes trades that have left the windows as of now, for symbols
+// that have not traded recently.
+func (r *Rolling) Expire(now time.Time) {
+	r.fine.expire(now.Unix())
+	r.coarse.expire(now.Unix())
+	r.profile.expire(now.Unix())
+}
+
+func (r *Rolling) LastPrice() float64 {
+	return r.lastPrice
+}
+
+func (r *Rolling) LastTime() time.Time {
+	return r.lastTime
+}
+
+// Stats returns the statistics of each window keyed by the window name, such
+// as 5m or 4h.
+func (r *Rolling) Stats() map[string]WindowStats {
+	stats := map[string]WindowStats{}
+	i, j := 0, 0
+	for _, window := range Windows {
+		if window <= fineWindowLimit {
+			stats[WindowName(window)] = r.fine.stats(i, r.lastPrice)
+			i++
+		} else {
+			stats[WindowName(window)] = r.coarse.stats(j, r.lastPrice)
+			j++
+		}
+	}
+	return stats
+}
+
+// Profile returns the volume profile of window, up to ProfileWindow, split
+// into levels price ranges.
+func (r *Rolling) Profile(window time.Duration, levels int) VolumeProfile {
+	return r.profile.build(window, levels)
+}
+
+// WindowName formats a window as minutes or hours, for example 15m or 24h.
+func WindowName(window time.Duration) string {
+	if window >= time.Hour && window%time.Hour == 0 {
+		return strconv.FormatInt(int64(window/time.Hour), 10) + "h"
+	}
+	return strconv.FormatInt(int64(window/time.Minute), 10) + "m"
+}
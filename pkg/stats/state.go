@@ -0,0 +1,159 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package stats
+
+import (
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"time"
+)
+
+// BucketState is a bucket of a rolling window series.
+type BucketState struct {
+	Start      int64   `json:"start"`
+	Open       float64 `json:"open"`
+	Opened     int64   `json:"opened"`
+	Volume     float64 `json:"volume"`
+	BuyVolume  float64 `json:"buy_volume"`
+	SellVolume float64 `json:"sell_volume"`
+	Trades     int64   `json:"trades"`
+}
+
+// PriceVolumeState is the volume at a rounded price of a volume profile
+// minute.
+type PriceVolumeState struct {
+	Price      float64 `json:"price"`
+	BuyVolume  float64 `json:"buy_volume"`
+	SellVolume float64 `json:"sell_volume"`
+}
+
+type ProfileBucketState struct {
+	Start  int64              `json:"start"`
+	Prices []PriceVolumeState `json:"prices"`
+}
+
+// RollingState is the state of the rolling windows of a symbol, saved on
+// shutdown to be restored after a restart.
+type RollingState struct {
+	Fine      []BucketState        `json:"fine"`
+	Coarse    []BucketState        `json:"coarse"`
+	Profile   []ProfileBucketState `json:"profile"`
+	LastPrice float64              `json:"last_price"`
+	LastTime  time.Time            `json:"last_time"`
+	LastTrade pkg.TradeMark        `json:"last_trade"`
+}
+
+func (s *series) state() []BucketState {
+	buckets := make([]BucketState, 0, len(s.buckets))
+	for _, bucket := range s.buckets {
+		buckets = append(buckets, BucketState{
+			Start:      bucket.start,
+			Open:       bucket.open,
+			Opened:     bucket.opened,
+			Volume:     bucket.volume,
+			BuyVolume:  bucket.buyVolume,
+			SellVolume: bucket.sellVolume,
+			Trades:     bucket.trades,
+		})
+	}
+	return buckets
+}
+
+// restore replaces the buckets of the series, recalculating the totals of
+// each window as of now.
+func (s *series) restore(buckets []BucketState, now int64) {
+	s.buckets = make([]bucket, 0, len(buckets))
+	for _, state := range buckets {
+		s.buckets = append(s.buckets, bucket{
+			start:  state.Start,
+			open:   state.Open,
+			opened: state.Opened,
+			totals: totals{
+				volume:     state.Volume,
+				buyVolume:  state.BuyVolume,
+				sellVolume: state.SellVolume,
+				trades:     state.Trades,
+			},
+		})
+	}
+	for _, window := range s.windows {
+		window.first = 0
+		window.totals = totals{}
+		for i := range s.buckets {
+			window.totals.add(&s.buckets[i].totals)
+		}
+	}
+	s.now = 0
+	s.expire(now)
+}
+
+func (p *profile) state() []ProfileBucketState {
+	buckets := make([]ProfileBucketState, 0, len(p.buckets))
+	for _, bucket := range p.buckets {
+		state := ProfileBucketState{
+			Start:  bucket.start,
+			Prices: make([]PriceVolumeState, 0, len(bucket.prices)),
+		}
+		for price, volume := range bucket.prices {
+			state.Prices = append(state.Prices, PriceVolumeState{
+				Price:      price,
+				BuyVolume:  volume.buy,
+				SellVolume: volume.sell,
+			})
+		}
+		buckets = append(buckets, state)
+	}
+	return buckets
+}
+
+func (p *profile) restore(buckets []ProfileBucketState, now int64) {
+	p.buckets = make([]profileBucket, 0, len(buckets))
+	for _, state := range buckets {
+		bucket := profileBucket{
+			start:  state.Start,
+			prices: map[float64]*priceVolume{},
+		}
+		for _, price := range state.Prices {
+			bucket.prices[price.Price] = &priceVolume{
+				buy:  price.BuyVolume,
+				sell: price.SellVolume,
+			}
+		}
+		p.buckets = append(p.buckets, bucket)
+	}
+	p.now = 0
+	p.expire(now)
+}
+
+// State returns the state of the windows to be restored after a restart.
+func (r *Rolling) State() RollingState {
+	return RollingState{
+		Fine:      r.fine.state(),
+		Coarse:    r.coarse.state(),
+		Profile:   r.profile.state(),
+		LastPrice: r.lastPrice,
+		LastTime:  r.lastTime,
+	}
+}
+
+// Restore replaces the windows with a saved state, expiring the buckets
+// that have left the windows as of now.
+func (r *Rolling) Restore(state RollingState, now time.Time) {
+	r.fine.restore(state.Fine, now.Unix())
+	r.coarse.restore(state.Coarse, now.Unix())
+	r.profile.restore(state.Profile, now.Unix())
+	r.lastPrice = state.LastPrice
+	r.lastTime = state.LastTime
+}
@@ -0,0 +1,139 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/metrics"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+func init() {
+	metrics.Describe("subscriber_dropped_total",
+		"Messages dropped for slow subscribers.")
+	metrics.Describe("subscriber_disconnected_total",
+		"Slow subscribers disconnected.")
+}
+
+// OverflowPolicy determines what happens when a subscriber's queue is full.
+type OverflowPolicy string
+
+const (
+	// Wait for the subscriber, stalling the publisher. Only for internal
+	// consumers that must see every message.
+	OverflowBlock OverflowPolicy = "block"
+
+	// Drop the message for this subscriber.
+	OverflowDrop OverflowPolicy = "drop"
+
+	// Drop the message and disconnect the subscriber.
+	OverflowDisconnect OverflowPolicy = "disconnect"
+)
+
+func ParseOverflowPolicy(value string) (OverflowPolicy, error) {
+	switch policy := OverflowPolicy(value); policy {
+	case OverflowBlock, OverflowDrop, OverflowDisconnect:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid overflow policy: %s", value)
+}
+
+type QueueOptions struct {
+	Size   int
+	Policy OverflowPolicy
+}
+
+// SubscriberStats tracks the queue of a single subscriber. All live stats
+// are registered so lagging subscribers can be listed. Metrics are only
+// labelled by group as subscriber names may be per client.
+type SubscriberStats struct {
+	Group    string         `json:"group"`
+	Name     string         `json:"name"`
+	Policy   OverflowPolicy `json:"policy"`
+	Capacity int            `json:"capacity"`
+	Length   int            `json:"length"`
+	Dropped  int64          `json:"dropped"`
+
+	length       func() int
+	dropped      *metrics.Counter
+	disconnected *metrics.Counter
+}
+
+var subscriberStats = map[*SubscriberStats]bool{}
+var subscriberStatsLock sync.Mutex
+
+// NewSubscriberStats registers stats for a subscriber in group, such as
+// binance.trades. length returns the current queue length.
+func NewSubscriberStats(group string, name string, options QueueOptions, length func() int) *SubscriberStats {
+	labels := metrics.Labels{"group": group}
+	stats := &SubscriberStats{
+		Group:        group,
+		Name:         name,
+		Policy:       options.Policy,
+		Capacity:     options.Size,
+		length:       length,
+		dropped:      metrics.GetCounter("subscriber_dropped_total", labels),
+		disconnected: metrics.GetCounter("subscriber_disconnected_total", labels),
+	}
+	subscriberStatsLock.Lock()
+	subscriberStats[stats] = true
+	subscriberStatsLock.Unlock()
+	return stats
+}
+
+// Overflow records a message that did not fit in the queue. Returns true if
+// the subscriber should be disconnected.
+func (s *SubscriberStats) Overflow() bool {
+	atomic.AddInt64(&s.Dropped, 1)
+	s.dropped.Inc()
+	if s.Policy == OverflowDisconnect {
+		s.disconnected.Inc()
+		return true
+	}
+	return false
+}
+
+// Release unregisters the stats when the subscriber goes away.
+func (s *SubscriberStats) Release() {
+	subscriberStatsLock.Lock()
+	defer subscriberStatsLock.Unlock()
+	delete(subscriberStats, s)
+}
+
+// ListSubscriberStats returns a snapshot of all subscriber stats, most
+// dropped first.
+func ListSubscriberStats() []SubscriberStats {
+	subscriberStatsLock.Lock()
+	list := make([]SubscriberStats, 0, len(subscriberStats))
+	for stats := range subscriberStats {
+		snapshot := *stats
+		snapshot.Dropped = atomic.LoadInt64(&stats.Dropped)
+		if stats.length != nil {
+			snapshot.Length = stats.length()
+		}
+		list = append(list, snapshot)
+	}
+	subscriberStatsLock.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Dropped != list[j].Dropped {
+			return list[i].Dropped > list[j].Dropped
+		}
+		return list[i].Group+list[i].Name < list[j].Group+list[j].Name
+	})
+	return list
+}
@@ -0,0 +1,84 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"strings"
+)
+
+// Classes of symbols that distort gainers lists and volume rankings, and
+// that can be excluded with SymbolFilterConfig.ExcludeClasses.
+const (
+	// Leveraged tokens such as BTCUP, BTCDOWN, ETHBULL and KuCoin's
+	// ETH3L.
+	SymbolClassLeveraged = "leveraged"
+
+	// Sports and club fan tokens such as PSG and JUV.
+	SymbolClassFanToken = "fan_token"
+
+	// Pairs not quoted in one of the major quote assets.
+	SymbolClassOddQuote = "odd_quote"
+)
+
+var symbolClasses = map[string]bool{
+	SymbolClassLeveraged: true,
+	SymbolClassFanToken:  true,
+	SymbolClassOddQuote:  true,
+}
+
+// The quote assets of pairs that are not an odd quote.
+var majorQuotes = map[string]bool{
+	"USD": true, "USDT": true, "USDC": true, "FDUSD": true, "BUSD": true,
+	"TUSD": true, "BTC": true, "ETH": true, "BNB": true,
+}
+
+var leveragedSuffixes = []string{
+	"UP", "DOWN", "BULL", "BEAR", "3L", "3S", "2L", "2S",
+}
+
+var fanTokens = map[string]bool{
+	"ACM": true, "AFC": true, "ALPINE": true, "APL": true, "ASR": true,
+	"ATM": true, "BAR": true, "CITY": true, "INTER": true, "JUV": true,
+	"LAZIO": true, "NAVI": true, "OG": true, "PORTO": true, "PSG": true,
+	"SANTOS": true, "SPURS": true,
+}
+
+// ClassifySymbol returns the classes of a symbol, empty for a regular pair.
+//
+// Leveraged tokens are recognized by the suffix of the base asset, which
+// must leave at least a 3 letter underlying asset so assets like JUP are
+// not mistaken for a leveraged token.
+func ClassifySymbol(symbol string) []string {
+	classes := []string{}
+	base, quote, ok := SplitSymbol(symbol)
+	if !ok {
+		// The quote is not a known asset.
+		base = strings.ToUpper(symbol)
+	}
+	for _, suffix := range leveragedSuffixes {
+		if strings.HasSuffix(base, suffix) && len(base)-len(suffix) >= 3 {
+			classes = append(classes, SymbolClassLeveraged)
+			break
+		}
+	}
+	if fanTokens[base] {
+		classes = append(classes, SymbolClassFanToken)
+	}
+	if !majorQuotes[quote] {
+		classes = append(classes, SymbolClassOddQuote)
+	}
+	return classes
+}
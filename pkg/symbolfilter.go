@@ -0,0 +1,178 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// SymbolFilterConfig restricts the symbols of an exchange that are streamed
+// and processed. Patterns are shell style globs, such as "*UP*", matched
+// against the uppercase symbol.
+type SymbolFilterConfig struct {
+	// Only symbols matching one of these patterns are included. All symbols
+	// are included if empty.
+	Include []string `mapstructure:"include" json:"include,omitempty"`
+
+	// Symbols matching any of these patterns are excluded, even if included
+	// above.
+	Exclude []string `mapstructure:"exclude" json:"exclude,omitempty"`
+
+	// Only symbols quoted in one of these assets, such as USDT, are
+	// included. All quote assets are included if empty.
+	Quotes []string `mapstructure:"quotes" json:"quotes,omitempty"`
+
+	// Symbols of these classes, see ClassifySymbol, are excluded:
+	// leveraged, fan_token and odd_quote.
+	ExcludeClasses []string `mapstructure:"exclude_classes" json:"exclude_classes,omitempty"`
+}
+
+// Override returns c with the lists that are set in override replaced.
+func (c SymbolFilterConfig) Override(override SymbolFilterConfig) SymbolFilterConfig {
+	if len(override.Include) > 0 {
+		c.Include = override.Include
+	}
+	if len(override.Exclude) > 0 {
+		c.Exclude = override.Exclude
+	}
+	if len(override.Quotes) > 0 {
+		c.Quotes = override.Quotes
+	}
+	if len(override.ExcludeClasses) > 0 {
+		c.ExcludeClasses = override.ExcludeClasses
+	}
+	return c
+}
+
+// IsEmpty returns true if the config doesn't filter any symbols.
+func (c SymbolFilterConfig) IsEmpty() bool {
+	return len(c.Include) == 0 && len(c.Exclude) == 0 && len(c.Quotes) == 0 &&
+		len(c.ExcludeClasses) == 0
+}
+
+// SymbolFilter decides if a symbol is allowed by a SymbolFilterConfig. A
+// nil filter allows every symbol.
+type SymbolFilter struct {
+	include []string
+	exclude []string
+	quotes  []string
+	classes map[string]bool
+}
+
+func NewSymbolFilter(config SymbolFilterConfig) (*SymbolFilter, error) {
+	include, err := compilePatterns(config.Include)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := compilePatterns(config.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	filter := &SymbolFilter{
+		include: include,
+		exclude: exclude,
+		classes: map[string]bool{},
+	}
+	for _, class := range config.ExcludeClasses {
+		class = strings.ToLower(class)
+		if !symbolClasses[class] {
+			return nil, fmt.Errorf("unknown symbol class: %s", class)
+		}
+		filter.classes[class] = true
+	}
+	for _, quote := range config.Quotes {
+		if quote == "" {
+			return nil, fmt.Errorf("empty quote asset")
+		}
+		filter.quotes = append(filter.quotes, strings.ToUpper(quote))
+	}
+	return filter, nil
+}
+
+// Allow returns true if symbol passes the filter.
+func (f *SymbolFilter) Allow(symbol string) bool {
+	if f == nil {
+		return true
+	}
+	symbol = strings.ToUpper(symbol)
+	if len(f.quotes) > 0 && !f.hasQuote(symbol) {
+		return false
+	}
+	if len(f.include) > 0 && !matchAny(f.include, symbol) {
+		return false
+	}
+	if len(f.classes) > 0 {
+		for _, class := range ClassifySymbol(symbol) {
+			if f.classes[class] {
+				return false
+			}
+		}
+	}
+	return !matchAny(f.exclude, symbol)
+}
+
+// Apply returns the symbols that pass the filter.
+func (f *SymbolFilter) Apply(symbols []string) []string {
+	if f == nil {
+		return symbols
+	}
+	allowed := []string{}
+	for _, symbol := range symbols {
+		if f.Allow(symbol) {
+			allowed = append(allowed, symbol)
+		}
+	}
+	return allowed
+}
+
+// hasQuote checks the quote asset after the dash of KuCoin style symbols,
+// otherwise the suffix, as the quote assets of an exchange are not all
+// known.
+func (f *SymbolFilter) hasQuote(symbol string) bool {
+	for _, quote := range f.quotes {
+		if parts := strings.SplitN(symbol, "-", 2); len(parts) == 2 {
+			if parts[1] == quote {
+				return true
+			}
+		} else if strings.HasSuffix(symbol, quote) && len(symbol) > len(quote) {
+			return true
+		}
+	}
+	return false
+}
+
+func compilePatterns(patterns []string) ([]string, error) {
+	compiled := []string{}
+	for _, pattern := range patterns {
+		pattern = strings.ToUpper(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid symbol pattern %q", pattern)
+		}
+		compiled = append(compiled, pattern)
+	}
+	return compiled, nil
+}
+
+func matchAny(patterns []string, symbol string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, symbol); ok {
+			return true
+		}
+	}
+	return false
+}
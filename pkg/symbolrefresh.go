@@ -0,0 +1,90 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// The shortest symbol refresh interval, to stay within the rate limits of
+// the exchanges.
+const MinSymbolRefreshInterval = 30 * time.Second
+
+// SymbolRefreshConfig configures the periodic refresh of the symbols of
+// each exchange, which subscribes to new listings and reports listings and
+// delistings.
+type SymbolRefreshConfig struct {
+	Interval time.Duration `mapstructure:"interval" json:"interval"`
+
+	// Names of the alert webhooks and notifiers listings and delistings are
+	// delivered to. Empty delivers to all.
+	Webhooks []string `mapstructure:"webhooks" json:"webhooks,omitempty"`
+	Notify   []string `mapstructure:"notify" json:"notify,omitempty"`
+
+	// Only raise events for listings and delistings, not alerts.
+	NoAlerts bool `mapstructure:"no_alerts" json:"no_alerts,omitempty"`
+}
+
+var DefaultSymbolRefreshConfig = SymbolRefreshConfig{
+	Interval: 5 * time.Minute,
+}
+
+// Override returns c with the fields that are set in override replaced.
+func (c SymbolRefreshConfig) Override(override SymbolRefreshConfig) SymbolRefreshConfig {
+	if override.Interval != 0 {
+		c.Interval = override.Interval
+	}
+	if len(override.Webhooks) > 0 {
+		c.Webhooks = override.Webhooks
+	}
+	if len(override.Notify) > 0 {
+		c.Notify = override.Notify
+	}
+	if override.NoAlerts {
+		c.NoAlerts = true
+	}
+	return c
+}
+
+func (c SymbolRefreshConfig) Validate() error {
+	if c.Interval < MinSymbolRefreshInterval {
+		return fmt.Errorf("symbol refresh interval must be at least %v", MinSymbolRefreshInterval)
+	}
+	return nil
+}
+
+// DiffSymbols returns the symbols in current that are not in previous, and
+// those in previous that are not in current, each sorted.
+func DiffSymbols(previous []string, current []string) (added []string, removed []string) {
+	seen := map[string]bool{}
+	for _, symbol := range previous {
+		seen[symbol] = true
+	}
+	for _, symbol := range current {
+		if !seen[symbol] {
+			added = append(added, symbol)
+		}
+		delete(seen, symbol)
+	}
+	for symbol := range seen {
+		removed = append(removed, symbol)
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
@@ -0,0 +1,144 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SymbolRegistry holds the deployment defined display aliases and hidden
+// symbols. Keys may be a plain symbol, applying to all exchanges, or
+// qualified with an exchange name, such as "binance:WBTCBTC".
+type SymbolRegistry struct {
+	aliases map[string]string
+	hidden  map[string]bool
+	lock    sync.RWMutex
+}
+
+func NewSymbolRegistry() *SymbolRegistry {
+	return &SymbolRegistry{
+		aliases: map[string]string{},
+		hidden:  map[string]bool{},
+	}
+}
+
+func normalizeSymbolKey(key string) string {
+	parts := strings.SplitN(key, ":", 2)
+	if len(parts) == 2 {
+		return fmt.Sprintf("%s:%s", strings.ToLower(parts[0]),
+			strings.ToUpper(parts[1]))
+	}
+	return strings.ToUpper(key)
+}
+
+func qualifiedSymbolKey(exchange string, symbol string) string {
+	return fmt.Sprintf("%s:%s", strings.ToLower(exchange), strings.ToUpper(symbol))
+}
+
+func (r *SymbolRegistry) SetAlias(key string, alias string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.aliases[normalizeSymbolKey(key)] = alias
+}
+
+func (r *SymbolRegistry) RemoveAlias(key string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.aliases, normalizeSymbolKey(key))
+}
+
+// Alias returns the display alias for the symbol on the exchange, or an
+// empty string if it has none.
+func (r *SymbolRegistry) Alias(exchange string, symbol string) string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if alias, ok := r.aliases[qualifiedSymbolKey(exchange, symbol)]; ok {
+		return alias
+	}
+	return r.aliases[strings.ToUpper(symbol)]
+}
+
+func (r *SymbolRegistry) Hide(key string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.hidden[normalizeSymbolKey(key)] = true
+}
+
+func (r *SymbolRegistry) Unhide(key string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.hidden, normalizeSymbolKey(key))
+}
+
+func (r *SymbolRegistry) IsHidden(exchange string, symbol string) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.hidden[qualifiedSymbolKey(exchange, symbol)] ||
+		r.hidden[strings.ToUpper(symbol)]
+}
+
+func (r *SymbolRegistry) Aliases() map[string]string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	aliases := map[string]string{}
+	for key, alias := range r.aliases {
+		aliases[key] = alias
+	}
+	return aliases
+}
+
+func (r *SymbolRegistry) Hidden() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	hidden := []string{}
+	for key := range r.hidden {
+		hidden = append(hidden, key)
+	}
+	sort.Strings(hidden)
+	return hidden
+}
+
+type SymbolSearchResult struct {
+	Symbol string `json:"symbol"`
+	Alias  string `json:"alias,omitempty"`
+}
+
+// Search returns the symbols whose name or alias contains the query, case
+// insensitive, excluding hidden symbols.
+func (r *SymbolRegistry) Search(exchange string, symbols []string, query string) []SymbolSearchResult {
+	query = strings.ToUpper(query)
+	results := []SymbolSearchResult{}
+	for _, symbol := range symbols {
+		if r.IsHidden(exchange, symbol) {
+			continue
+		}
+		alias := r.Alias(exchange, symbol)
+		if strings.Contains(strings.ToUpper(symbol), query) ||
+			(alias != "" && strings.Contains(strings.ToUpper(alias), query)) {
+			results = append(results, SymbolSearchResult{
+				Symbol: symbol,
+				Alias:  alias,
+			})
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Symbol < results[j].Symbol
+	})
+	return results
+}
@@ -0,0 +1,94 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tape
+
+import (
+	"context"
+	"encoding/json"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/journal"
+	"time"
+)
+
+// ColdStore keeps the trades that have left the memory of the tape.
+type ColdStore interface {
+	Add(trades []Trade) error
+
+	// Read calls fn with each trade of asset with an event time in
+	// [from, to). Return journal.ErrStop from fn to stop early.
+	Read(asset string, from time.Time, to time.Time, fn func(trade Trade) error) error
+
+	Close() error
+}
+
+// JournalStore is a ColdStore of the trades of every asset in a journal,
+// as JSON encoded trades by event time.
+type JournalStore struct {
+	journal *journal.Journal
+}
+
+// OpenJournalStore opens the cold store in dir, keeping trades for
+// retention.
+func OpenJournalStore(dir string, retention time.Duration) (*JournalStore, error) {
+	options := journal.DefaultOptions
+	options.Retention = retention
+	j, err := journal.Open(dir, options)
+	if err != nil {
+		return nil, err
+	}
+	return &JournalStore{journal: j}, nil
+}
+
+func (s *JournalStore) Add(trades []Trade) error {
+	for i := range trades {
+		buf, err := json.Marshal(&trades[i])
+		if err != nil {
+			return err
+		}
+		if err := s.journal.Append(trades[i].Timestamp, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read flushes the trades buffered by the journal first, so trades are
+// readable as soon as they are added.
+func (s *JournalStore) Read(asset string, from time.Time, to time.Time, fn func(trade Trade) error) error {
+	if err := s.journal.Flush(); err != nil {
+		return err
+	}
+	return s.journal.Read(from, to, func(timestamp time.Time, data []byte) error {
+		var trade Trade
+		if err := json.Unmarshal(data, &trade); err != nil {
+			return err
+		}
+		if base, _, _ := pkg.SplitSymbol(trade.Symbol); base != asset {
+			return nil
+		}
+		return fn(trade)
+	})
+}
+
+// Run flushes the journal and removes trades older than the retention
+// until ctx is cancelled.
+func (s *JournalStore) Run(ctx context.Context) {
+	s.journal.Run(ctx)
+}
+
+func (s *JournalStore) Close() error {
+	return s.journal.Close()
+}
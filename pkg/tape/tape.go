@@ -0,0 +1,579 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package tape merges the trades of the spot exchanges into a combined
+// tape per asset, ordered by exchange event time. Trades arrive from each
+// exchange with its own latency, so ordering by arrival misorders trades
+// that happened close together on different exchanges. Each trade is held
+// in a reordering buffer for a short delay after it arrives, and released
+// in event time order once every trade that could precede it has arrived.
+//
+// Released trades are kept in memory up to a size and age per asset. If a
+// cold store is set, trades leaving memory are archived to it, so ranges
+// longer than memory holds can still be read.
+package tape
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/journal"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/metrics"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	metrics.Describe("tape_trades_total",
+		"Trades released to the combined tape, by exchange.")
+	metrics.Describe("tape_late_trades_total",
+		"Trades released to the combined tape after a later trade of the same asset, as they arrived after the reordering delay, by exchange.")
+	metrics.Describe("tape_archived_trades_total",
+		"Trades moved from memory to the cold store of the combined tape.")
+	metrics.Describe("tape_archive_errors_total",
+		"Failed writes of trades to the cold store of the combined tape.")
+}
+
+// The most trades kept per asset.
+const MaxSize = 100000
+
+// The longest reordering delay.
+const MaxDelay = 10 * time.Second
+
+// The shortest interval the reordering buffer is checked at.
+const minReleaseInterval = 10 * time.Millisecond
+
+// The interval trades are expired and archived at when there is no
+// reordering delay.
+const archiveInterval = time.Second
+
+type Config struct {
+	// The number of trades kept per asset. 0 disables the tape.
+	Size int `mapstructure:"size" json:"size"`
+
+	// How long a trade is held after it arrives for trades of other
+	// exchanges that happened before it to arrive. It should cover the
+	// difference in latency between the exchanges. 0 releases trades as
+	// they arrive.
+	Delay time.Duration `mapstructure:"delay" json:"delay"`
+
+	// How long trades are kept in memory, by event time, regardless of
+	// the metrics retention. 0 keeps size trades however old.
+	TTL time.Duration `mapstructure:"ttl" json:"ttl"`
+
+	// How long trades leaving memory are kept in the cold store. 0
+	// disables the cold store.
+	ColdRetention time.Duration `mapstructure:"cold_retention" json:"cold_retention"`
+}
+
+var DefaultConfig = Config{
+	Delay: 250 * time.Millisecond,
+}
+
+// Override returns c with the fields that are set in override replaced.
+func (c Config) Override(override Config) Config {
+	if override.Size != 0 {
+		c.Size = override.Size
+	}
+	if override.Delay != 0 {
+		c.Delay = override.Delay
+	}
+	if override.TTL != 0 {
+		c.TTL = override.TTL
+	}
+	if override.ColdRetention != 0 {
+		c.ColdRetention = override.ColdRetention
+	}
+	return c
+}
+
+func (c Config) Validate() error {
+	if c.Size < 0 || c.Size > MaxSize {
+		return fmt.Errorf("tape size must be between 0 and %d", MaxSize)
+	}
+	if c.Delay < 0 || c.Delay > MaxDelay {
+		return fmt.Errorf("tape delay must be between 0 and %v", MaxDelay)
+	}
+	if c.TTL < 0 {
+		return fmt.Errorf("tape ttl must not be negative")
+	}
+	if c.ColdRetention < 0 {
+		return fmt.Errorf("tape cold retention must not be negative")
+	}
+	if c.ColdRetention > 0 && c.TTL > 0 && c.ColdRetention < c.TTL {
+		return fmt.Errorf("tape cold retention must not be shorter than the ttl")
+	}
+	return nil
+}
+
+func (c Config) Enabled() bool {
+	return c.Size > 0
+}
+
+// Trade is a trade of an asset on the combined tape.
+type Trade struct {
+	Exchange  string    `json:"exchange"`
+	Symbol    string    `json:"symbol"`
+	Id        int64     `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Price     float64   `json:"price"`
+	Quantity  float64   `json:"quantity"`
+
+	// The price in USD, for comparing trades of different quote assets.
+	UsdPrice float64 `json:"usd_price"`
+
+	BuyerMaker bool `json:"buyer_maker"`
+
+	// When the trade arrived, and true if it was released after a later
+	// trade as it arrived after the reordering delay.
+	ReceivedAt time.Time `json:"received_at"`
+	Late       bool      `json:"late,omitempty"`
+}
+
+type pendingTrade struct {
+	trade Trade
+
+	// Breaks ties between trades with the same event time in order of
+	// arrival.
+	seq uint64
+}
+
+// pendingTrades is a heap of the trades of an asset waiting in the
+// reordering buffer, earliest event time first.
+type pendingTrades []pendingTrade
+
+func (p pendingTrades) Len() int {
+	return len(p)
+}
+
+func (p pendingTrades) Less(i, j int) bool {
+	if !p[i].trade.Timestamp.Equal(p[j].trade.Timestamp) {
+		return p[i].trade.Timestamp.Before(p[j].trade.Timestamp)
+	}
+	return p[i].seq < p[j].seq
+}
+
+func (p pendingTrades) Swap(i, j int) {
+	p[i], p[j] = p[j], p[i]
+}
+
+func (p *pendingTrades) Push(x interface{}) {
+	*p = append(*p, x.(pendingTrade))
+}
+
+func (p *pendingTrades) Pop() interface{} {
+	old := *p
+	last := old[len(old)-1]
+	*p = old[:len(old)-1]
+	return last
+}
+
+type assetTape struct {
+	pending pendingTrades
+
+	// The released trades, oldest first, at most Size.
+	trades []Trade
+}
+
+// Tape is the combined tape of every asset. Trades are received through
+// the sink of each exchange and released by Run. Safe for concurrent use.
+type Tape struct {
+	config Config
+	assets map[string]*assetTape
+	seq    uint64
+	lock   sync.Mutex
+
+	// Trades that have left memory, waiting to be written to the cold
+	// store by Run. Only collected if there is a cold store.
+	cold    ColdStore
+	evicted []Trade
+
+	// Held while evicted trades are written to the cold store, so a read
+	// never misses trades that are in neither.
+	archiveLock sync.Mutex
+}
+
+func NewTape(config Config) *Tape {
+	return &Tape{
+		config: config,
+		assets: map[string]*assetTape{},
+	}
+}
+
+func (t *Tape) Config() Config {
+	return t.config
+}
+
+// SetColdStore sets the store trades leaving memory are archived to. Must
+// be called before trades are added.
+func (t *Tape) SetColdStore(cold ColdStore) {
+	t.cold = cold
+}
+
+// Sink returns the sink the trades of exchange are received by, with rates
+// returning the exchange's rates to convert its quote assets to USD.
+func (t *Tape) Sink(exchange string, rates func() *pkg.ConversionRates) pkg.Sink {
+	return &tapeSink{tape: t, exchange: exchange, rates: rates}
+}
+
+type tapeSink struct {
+	tape     *Tape
+	exchange string
+	rates    func() *pkg.ConversionRates
+}
+
+func (s *tapeSink) Name() string {
+	return "tape"
+}
+
+func (s *tapeSink) Send(message interface{}) error {
+	trade, ok := message.(pkg.CommonTrade)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", message)
+	}
+	_, quote, ok := pkg.SplitSymbol(trade.Symbol)
+	if !ok {
+		return nil
+	}
+	// 0 if there is no rate, leaving the USD price unset.
+	rate, _ := s.rates().Rate(quote, "USD")
+	s.tape.AddTrade(s.exchange, trade, rate, time.Now())
+	return nil
+}
+
+// AddTrade adds trade of exchange, received at receivedAt, to the
+// reordering buffer of its asset. rate converts its quote asset to USD, 0
+// if unknown.
+func (t *Tape) AddTrade(exchange string, trade pkg.CommonTrade, rate float64, receivedAt time.Time) {
+	base, _, ok := pkg.SplitSymbol(trade.Symbol)
+	if !ok {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	asset := t.assets[base]
+	if asset == nil {
+		asset = &assetTape{}
+		t.assets[base] = asset
+	}
+	t.seq++
+	heap.Push(&asset.pending, pendingTrade{
+		trade: Trade{
+			Exchange:   exchange,
+			Symbol:     trade.Symbol,
+			Id:         trade.Id,
+			Timestamp:  trade.Timestamp,
+			Price:      trade.Price,
+			Quantity:   trade.Quantity,
+			UsdPrice:   pkg.Round8(trade.Price * rate),
+			BuyerMaker: trade.BuyerMaker,
+			ReceivedAt: receivedAt,
+		},
+		seq: t.seq,
+	})
+	if t.config.Delay == 0 {
+		t.releaseAsset(asset, receivedAt)
+	}
+}
+
+// release releases the trades held for the delay at now, of every asset,
+// and expires those older than the TTL.
+func (t *Tape) release(now time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, asset := range t.assets {
+		t.releaseAsset(asset, now)
+		t.expireAsset(asset, now)
+	}
+}
+
+// evict hands trades leaving memory to the cold store, if any. Must be
+// called with the lock held.
+func (t *Tape) evict(trades ...Trade) {
+	if t.cold != nil {
+		t.evicted = append(t.evicted, trades...)
+	}
+}
+
+// expireAsset removes the trades of asset older than the TTL at now. Must
+// be called with the lock held.
+func (t *Tape) expireAsset(asset *assetTape, now time.Time) {
+	if t.config.TTL == 0 {
+		return
+	}
+	cutoff := now.Add(-t.config.TTL)
+	n := 0
+	for n < len(asset.trades) && asset.trades[n].Timestamp.Before(cutoff) {
+		n++
+	}
+	if n > 0 {
+		t.evict(asset.trades[:n]...)
+		asset.trades = append(asset.trades[:0], asset.trades[n:]...)
+	}
+}
+
+// releaseAsset moves the trades of asset that have been held for the delay
+// at now to its tape, in event time order. The earliest pending trade holds
+// back those after it until it is released itself, so a trade is never
+// released ahead of one that happened before it and arrived within the
+// delay. Must be called with the lock held.
+func (t *Tape) releaseAsset(asset *assetTape, now time.Time) {
+	for len(asset.pending) > 0 {
+		next := asset.pending[0].trade
+		if now.Sub(next.ReceivedAt) < t.config.Delay {
+			return
+		}
+		heap.Pop(&asset.pending)
+
+		labels := metrics.Labels{"exchange": next.Exchange}
+		metrics.GetCounter("tape_trades_total", labels).Inc()
+
+		// A trade that arrived after the delay goes in its place among
+		// those already released.
+		i := len(asset.trades)
+		for i > 0 && asset.trades[i-1].Timestamp.After(next.Timestamp) {
+			i--
+		}
+		if i < len(asset.trades) {
+			next.Late = true
+			metrics.GetCounter("tape_late_trades_total", labels).Inc()
+		}
+		if i == 0 && len(asset.trades) >= t.config.Size {
+			// Older than every trade kept.
+			t.evict(next)
+			continue
+		}
+		asset.trades = append(asset.trades, Trade{})
+		copy(asset.trades[i+1:], asset.trades[i:])
+		asset.trades[i] = next
+		if over := len(asset.trades) - t.config.Size; over > 0 {
+			t.evict(asset.trades[:over]...)
+			asset.trades = append(asset.trades[:0], asset.trades[over:]...)
+		}
+	}
+}
+
+// Run releases the trades held for the delay, expires trades older than the
+// TTL and archives trades leaving memory to the cold store until ctx is
+// cancelled.
+func (t *Tape) Run(ctx context.Context) {
+	interval := archiveInterval
+	if t.config.Delay > 0 {
+		interval = t.config.Delay / 4
+		if interval < minReleaseInterval {
+			interval = minReleaseInterval
+		}
+	} else if t.config.TTL == 0 && t.cold == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			t.release(now)
+			t.archive(false)
+		}
+	}
+}
+
+// archive writes the evicted trades to the cold store. If all is true the
+// trades in memory and those still held for the delay are also written.
+func (t *Tape) archive(all bool) {
+	if t.cold == nil {
+		return
+	}
+	t.archiveLock.Lock()
+	defer t.archiveLock.Unlock()
+
+	t.lock.Lock()
+	if all {
+		for _, asset := range t.assets {
+			for len(asset.pending) > 0 {
+				t.evict(heap.Pop(&asset.pending).(pendingTrade).trade)
+			}
+			t.evict(asset.trades...)
+			asset.trades = nil
+		}
+	}
+	trades := t.evicted
+	t.evicted = nil
+	t.lock.Unlock()
+
+	if len(trades) == 0 {
+		return
+	}
+	if err := t.cold.Add(trades); err != nil {
+		metrics.GetCounter("tape_archive_errors_total", nil).Inc()
+		log.Printf("error: tape: failed to archive %d trades: %v\n", len(trades), err)
+		return
+	}
+	metrics.GetCounter("tape_archived_trades_total", nil).Add(int64(len(trades)))
+}
+
+// Close archives every trade to the cold store, if any, and closes it.
+// Called once trades are no longer added.
+func (t *Tape) Close() error {
+	if t.cold == nil {
+		return nil
+	}
+	t.archive(true)
+	return t.cold.Close()
+}
+
+// AssetSummary is the number of trades on the tape of an asset.
+type AssetSummary struct {
+	Asset     string   `json:"asset"`
+	Exchanges []string `json:"exchanges"`
+	Trades    int      `json:"trades"`
+}
+
+// Assets returns a summary of the tape of every asset, ordered by asset.
+func (t *Tape) Assets() []AssetSummary {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	result := []AssetSummary{}
+	for name, asset := range t.assets {
+		if len(asset.trades) == 0 {
+			continue
+		}
+		exchanges := map[string]bool{}
+		for _, trade := range asset.trades {
+			exchanges[trade.Exchange] = true
+		}
+		summary := AssetSummary{
+			Asset:     name,
+			Exchanges: []string{},
+			Trades:    len(asset.trades),
+		}
+		for exchange := range exchanges {
+			summary.Exchanges = append(summary.Exchanges, exchange)
+		}
+		sort.Strings(summary.Exchanges)
+		result = append(result, summary)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Asset < result[j].Asset
+	})
+	return result
+}
+
+// Trades returns the most recent trades on the tape of asset, oldest
+// first. All trades kept are returned if limit is 0.
+func (t *Tape) Trades(asset string, limit int) []Trade {
+	asset = strings.ToUpper(asset)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	result := []Trade{}
+	tape := t.assets[asset]
+	if tape == nil {
+		return result
+	}
+	trades := tape.trades
+	if limit > 0 && len(trades) > limit {
+		trades = trades[len(trades)-limit:]
+	}
+	return append(result, trades...)
+}
+
+// Range returns the trades on the tape of asset with an event time in
+// [from, to), oldest first, at most limit if not 0. If symbol is not empty
+// only the trades of that symbol are returned. Trades that have left
+// memory are read from the cold store, if any.
+func (t *Tape) Range(asset string, symbol string, from time.Time, to time.Time, limit int) ([]Trade, error) {
+	asset = strings.ToUpper(asset)
+	symbol = strings.ToUpper(symbol)
+	result := []Trade{}
+	seen := map[tradeKey]bool{}
+	add := func(trade Trade) bool {
+		if trade.Timestamp.Before(from) || !trade.Timestamp.Before(to) {
+			return false
+		}
+		if symbol != "" && trade.Symbol != symbol {
+			return false
+		}
+		// Trades replayed from the input cache on restart may also have
+		// been archived on shutdown.
+		key := tradeKey{trade.Exchange, trade.Symbol, trade.Id}
+		if seen[key] {
+			return false
+		}
+		seen[key] = true
+		result = append(result, trade)
+		return true
+	}
+
+	t.archiveLock.Lock()
+	defer t.archiveLock.Unlock()
+
+	t.lock.Lock()
+	// Trades leave memory oldest first, so the cold store only holds
+	// trades up to the oldest in memory.
+	coldTo := to
+	if tape := t.assets[asset]; tape != nil {
+		for _, trade := range tape.trades {
+			add(trade)
+		}
+		if len(tape.trades) > 0 && tape.trades[0].Timestamp.Before(coldTo) {
+			coldTo = tape.trades[0].Timestamp.Add(time.Nanosecond)
+		}
+	}
+	for _, trade := range t.evicted {
+		if base, _, _ := pkg.SplitSymbol(trade.Symbol); base == asset {
+			add(trade)
+		}
+	}
+	t.lock.Unlock()
+
+	if t.cold != nil && from.Before(coldTo) {
+		// Archived trades are read in about event time order and are
+		// older than those in memory, so reading can stop once limit
+		// have been read.
+		cold := 0
+		err := t.cold.Read(asset, from, coldTo, func(trade Trade) error {
+			if add(trade) {
+				cold++
+			}
+			if limit > 0 && cold >= limit {
+				return journal.ErrStop
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Timestamp.Before(result[j].Timestamp)
+	})
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+type tradeKey struct {
+	exchange string
+	symbol   string
+	id       int64
+}
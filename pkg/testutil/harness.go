@@ -0,0 +1,180 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package testutil
+
+import (
+	"context"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/binance"
+	"time"
+)
+
+// The queue size of the collectors, which block the stream when full so no
+// trade is dropped.
+const collectorQueueSize = 10000
+
+// UseMemoryCache makes the streams created after it cache in memory without
+// snapshots, rather than in Redis, so each stream starts with an empty
+// cache.
+func UseMemoryCache() {
+	pkg.DefaultCacheOptions.Backend = pkg.CacheBackendMemory
+	pkg.DefaultCacheOptions.SnapshotDir = ""
+}
+
+// UseFastReconnect makes the streams created after it reconnect after
+// delay, without jitter, rather than after seconds.
+func UseFastReconnect(delay time.Duration) {
+	pkg.DefaultBackoffOptions = pkg.BackoffOptions{
+		Min:         delay,
+		Max:         delay,
+		StableAfter: time.Minute,
+	}
+}
+
+// TradeCollector receives the trades published by a running trade stream.
+type TradeCollector struct {
+	trades chan pkg.CommonTrade
+	done   chan struct{}
+}
+
+// RunTradeStream subscribes to the trades of stream, then runs it until ctx
+// is cancelled.
+func RunTradeStream(ctx context.Context, stream pkg.TradeStream) *TradeCollector {
+	c := &TradeCollector{
+		trades: stream.Subscribe("testutil", pkg.QueueOptions{
+			Size:   collectorQueueSize,
+			Policy: pkg.OverflowBlock,
+		}),
+		done: make(chan struct{}),
+	}
+	go func() {
+		stream.Run(ctx)
+		close(c.done)
+	}()
+	return c
+}
+
+// Next returns the next trade published.
+func (c *TradeCollector) Next(ctx context.Context) (pkg.CommonTrade, error) {
+	select {
+	case trade, ok := <-c.trades:
+		if !ok {
+			return pkg.CommonTrade{}, fmt.Errorf("trade subscription closed")
+		}
+		return trade, nil
+	case <-ctx.Done():
+		return pkg.CommonTrade{}, ctx.Err()
+	}
+}
+
+// Collect returns the next count trades published, or those received
+// before ctx is done with its error.
+func (c *TradeCollector) Collect(ctx context.Context, count int) ([]pkg.CommonTrade, error) {
+	trades := []pkg.CommonTrade{}
+	for len(trades) < count {
+		trade, err := c.Next(ctx)
+		if err != nil {
+			return trades, fmt.Errorf("received %d of %d trades: %v", len(trades), count, err)
+		}
+		trades = append(trades, trade)
+	}
+	return trades, nil
+}
+
+// Done is closed once Run of the stream has returned.
+func (c *TradeCollector) Done() <-chan struct{} {
+	return c.done
+}
+
+// How often WaitRestored checks the restore progress.
+const restorePollInterval = 10 * time.Millisecond
+
+// WaitRestored waits until the trade stream named name, such as
+// binance.trades, has restored its cache and backfilled its history. Live
+// trades received before are queued by the stream until a live trade is
+// received after.
+func WaitRestored(ctx context.Context, name string) error {
+	for {
+		for _, status := range pkg.RestoreStatuses() {
+			if status.Name == name && status.Done {
+				return nil
+			}
+		}
+		if !pkg.Sleep(ctx, restorePollInterval) {
+			return fmt.Errorf("%s not restored: %v", name, ctx.Err())
+		}
+	}
+}
+
+// StartTradeStream runs a trade stream named name of the mock exchange
+// until ctx is cancelled, returning once it has subscribed to symbols and
+// restored, so trades published after are received in order. Any history
+// to backfill must be added, and HistoryDuration set by configure, before
+// it is called.
+func (m *MockExchange) StartTradeStream(ctx context.Context, name string,
+	configure func(stream *binance.TradeStream), symbols ...string) (*TradeCollector, error) {
+	stream := m.TradeStream(name)
+	if configure != nil {
+		configure(stream)
+	}
+	collector := RunTradeStream(ctx, stream)
+	streams := []string{}
+	for _, symbol := range symbols {
+		streams = append(streams, binance.AggTradeStreamName(symbol))
+	}
+	if err := m.WaitSubscribed(ctx, streams...); err != nil {
+		return nil, err
+	}
+	if err := WaitRestored(ctx, stream.Name()); err != nil {
+		return nil, err
+	}
+	return collector, nil
+}
+
+// TickerCollector receives the tickers sent by a running ticker stream.
+type TickerCollector struct {
+	tickers chan []pkg.CommonTicker
+}
+
+// RunTickerStream runs stream until ctx is cancelled.
+func RunTickerStream(ctx context.Context, stream pkg.TickerStream) *TickerCollector {
+	c := &TickerCollector{
+		tickers: make(chan []pkg.CommonTicker, collectorQueueSize),
+	}
+	go stream.Run(ctx, c.tickers)
+	return c
+}
+
+// Next returns the next set of tickers sent.
+func (c *TickerCollector) Next(ctx context.Context) ([]pkg.CommonTicker, error) {
+	select {
+	case tickers := <-c.tickers:
+		return tickers, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// StartTickerStream runs a ticker stream named name of the mock exchange
+// until ctx is cancelled, returning once it has subscribed.
+func (m *MockExchange) StartTickerStream(ctx context.Context, name string) (*TickerCollector, error) {
+	collector := RunTickerStream(ctx, m.TickerStream(name))
+	if err := m.WaitSubscribed(ctx, TickerStreamName); err != nil {
+		return nil, err
+	}
+	return collector, nil
+}
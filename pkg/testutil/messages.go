@@ -0,0 +1,187 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package testutil
+
+import (
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/depth"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func formatNumber(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// AggTrade is an aggregate trade of the mock exchange.
+type AggTrade struct {
+	Symbol     string
+	Id         int64
+	Time       time.Time
+	Price      float64
+	Quantity   float64
+	BuyerMaker bool
+}
+
+// restData returns the trade in the format of the REST API.
+func (t AggTrade) restData() map[string]interface{} {
+	return map[string]interface{}{
+		"a": t.Id,
+		"p": formatNumber(t.Price),
+		"q": formatNumber(t.Quantity),
+		"f": t.Id,
+		"l": t.Id,
+		"T": unixMillis(t.Time),
+		"m": t.BuyerMaker,
+		"M": true,
+	}
+}
+
+// streamData returns the trade in the format of the aggTrade stream.
+func (t AggTrade) streamData() map[string]interface{} {
+	data := t.restData()
+	data["e"] = "aggTrade"
+	data["E"] = unixMillis(t.Time)
+	data["s"] = strings.ToUpper(t.Symbol)
+	return data
+}
+
+// AggTrades returns count trades of symbol with consecutive IDs from
+// firstId, a second apart from start, with prices stepping by step from
+// price.
+func AggTrades(symbol string, firstId int64, count int, start time.Time, price float64,
+	step float64) []AggTrade {
+	trades := []AggTrade{}
+	for i := 0; i < count; i++ {
+		trades = append(trades, AggTrade{
+			Symbol:     symbol,
+			Id:         firstId + int64(i),
+			Time:       start.Add(time.Duration(i) * time.Second),
+			Price:      price + float64(i)*step,
+			Quantity:   1,
+			BuyerMaker: i%2 == 1,
+		})
+	}
+	return trades
+}
+
+// Ticker is a 24 hour rolling window ticker of the mock exchange.
+type Ticker struct {
+	Symbol string
+	Time   time.Time
+
+	Open  float64
+	High  float64
+	Low   float64
+	Close float64
+
+	Bid float64
+	Ask float64
+
+	// Base and quote asset volume.
+	Volume      float64
+	QuoteVolume float64
+}
+
+// streamData returns the ticker in the format of the all market tickers
+// stream.
+func (t Ticker) streamData() map[string]interface{} {
+	change := t.Close - t.Open
+	changePct := 0.0
+	if t.Open != 0 {
+		changePct = change / t.Open * 100
+	}
+	weighted := 0.0
+	if t.Volume != 0 {
+		weighted = t.QuoteVolume / t.Volume
+	}
+	ms := unixMillis(t.Time)
+	return map[string]interface{}{
+		"e": "24hrTicker",
+		"E": ms,
+		"s": strings.ToUpper(t.Symbol),
+		"p": formatNumber(change),
+		"P": formatNumber(changePct),
+		"w": formatNumber(weighted),
+		"x": formatNumber(t.Open),
+		"c": formatNumber(t.Close),
+		"Q": "0",
+		"b": formatNumber(t.Bid),
+		"B": "0",
+		"a": formatNumber(t.Ask),
+		"A": "0",
+		"o": formatNumber(t.Open),
+		"h": formatNumber(t.High),
+		"l": formatNumber(t.Low),
+		"v": formatNumber(t.Volume),
+		"q": formatNumber(t.QuoteVolume),
+		"O": ms - int64(24*time.Hour/time.Millisecond),
+		"C": ms,
+		"F": 0,
+		"L": 0,
+		"n": 0,
+	}
+}
+
+func formatLevels(levels []depth.Level) [][2]string {
+	formatted := [][2]string{}
+	for _, level := range levels {
+		formatted = append(formatted, [2]string{
+			formatNumber(level.Price), formatNumber(level.Quantity),
+		})
+	}
+	return formatted
+}
+
+// DepthSnapshot is an order book snapshot of the mock exchange.
+type DepthSnapshot struct {
+	LastUpdateId int64
+	Bids         []depth.Level
+	Asks         []depth.Level
+}
+
+// restData returns the snapshot in the format of the REST API.
+func (s DepthSnapshot) restData() map[string]interface{} {
+	return map[string]interface{}{
+		"lastUpdateId": s.LastUpdateId,
+		"bids":         formatLevels(s.Bids),
+		"asks":         formatLevels(s.Asks),
+	}
+}
+
+// DepthUpdate is a diff depth update of the mock exchange, a level with a
+// quantity of 0 is removed.
+type DepthUpdate struct {
+	Symbol        string
+	Time          time.Time
+	FirstUpdateId int64
+	FinalUpdateId int64
+	Bids          []depth.Level
+	Asks          []depth.Level
+}
+
+// streamData returns the update in the format of the diff depth stream.
+func (u DepthUpdate) streamData() map[string]interface{} {
+	return map[string]interface{}{
+		"e": "depthUpdate",
+		"E": unixMillis(u.Time),
+		"s": strings.ToUpper(u.Symbol),
+		"U": u.FirstUpdateId,
+		"u": u.FinalUpdateId,
+		"b": formatLevels(u.Bids),
+		"a": formatLevels(u.Asks),
+	}
+}
@@ -0,0 +1,494 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package testutil runs the exchange streams against a mock exchange so the
+// stream pipeline can be exercised without connectivity to the exchanges.
+// MockExchange serves the Binance REST endpoints the streams use and the
+// combined websocket stream, from trades, tickers and depth published to it.
+package testutil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/binance"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/latency"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The stream name of the all market tickers.
+const TickerStreamName = "!ticker@arr"
+
+// The aggregate trades kept per symbol for the REST API.
+const maxMockTrades = 10000
+
+// The most aggregate trades returned by one REST request, as Binance.
+const maxMockTradesLimit = 1000
+
+type mockConn struct {
+	conn    *websocket.Conn
+	streams map[string]bool
+	lock    sync.Mutex
+}
+
+func (c *mockConn) write(body []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, body)
+}
+
+// MockExchange is a Binance compatible exchange on a local HTTP server.
+// Safe for concurrent use.
+type MockExchange struct {
+	server   *httptest.Server
+	upgrader websocket.Upgrader
+
+	symbols map[string]string
+	trades  map[string][]AggTrade
+	depth   map[string]DepthSnapshot
+	conns   map[*mockConn]bool
+
+	// Depth snapshot requests of a symbol wait until its channel is closed.
+	depthHeld map[string]chan struct{}
+
+	// Signalled on each change to conns.
+	changed chan struct{}
+
+	lock sync.Mutex
+}
+
+// NewMockExchange starts a mock exchange trading symbols. It must be closed
+// when done.
+func NewMockExchange(symbols ...string) *MockExchange {
+	m := &MockExchange{
+		symbols:   map[string]string{},
+		trades:    map[string][]AggTrade{},
+		depth:     map[string]DepthSnapshot{},
+		conns:     map[*mockConn]bool{},
+		depthHeld: map[string]chan struct{}{},
+		changed:   make(chan struct{}),
+	}
+	for _, symbol := range symbols {
+		m.symbols[strings.ToUpper(symbol)] = "TRADING"
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v3/exchangeInfo", m.getExchangeInfo)
+	mux.HandleFunc("/api/v3/aggTrades", m.getAggTrades)
+	mux.HandleFunc("/api/v3/depth", m.getDepth)
+	mux.HandleFunc("/stream", m.stream)
+	m.server = httptest.NewServer(mux)
+	return m
+}
+
+// Close disconnects the streams and stops the server.
+func (m *MockExchange) Close() {
+	m.Disconnect()
+	m.server.Close()
+}
+
+// RestUrl returns the base URL of the REST API.
+func (m *MockExchange) RestUrl() string {
+	return m.server.URL + "/api/v3"
+}
+
+// StreamUrl returns the URL of the combined websocket stream.
+func (m *MockExchange) StreamUrl() string {
+	return "ws" + strings.TrimPrefix(m.server.URL, "http") + "/stream"
+}
+
+// Prober returns a prober named name that selects the stream of the mock
+// exchange without probing.
+func (m *MockExchange) Prober(name string) *latency.Prober {
+	prober := latency.NewProber(name, nil, latency.DialProbe)
+	prober.SetOverride(m.StreamUrl())
+	return prober
+}
+
+// TradeStream returns a Binance trade stream named name of the mock
+// exchange.
+func (m *MockExchange) TradeStream(name string) *binance.TradeStream {
+	return binance.NewCustomTradeStream(name, binance.NewRestClientWithUrl(m.RestUrl()),
+		m.Prober(name+".stream"))
+}
+
+// TickerStream returns a Binance ticker stream named name of the mock
+// exchange.
+func (m *MockExchange) TickerStream(name string) *binance.TickerStream {
+	return binance.NewCustomTickerStream(name, m.Prober(name+".stream"))
+}
+
+// DepthStream returns a Binance depth stream named name of the mock
+// exchange.
+func (m *MockExchange) DepthStream(name string) *binance.DepthStream {
+	return binance.NewCustomDepthStream(name, binance.NewRestClientWithUrl(m.RestUrl()),
+		m.Prober(name+".stream"))
+}
+
+// SetSymbolStatus sets the status of symbol, adding it if new. Only
+// symbols with a status of TRADING are streamed.
+func (m *MockExchange) SetSymbolStatus(symbol string, status string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.symbols[strings.ToUpper(symbol)] = status
+}
+
+// PublishAggTrade sends trade to the connections subscribed to its stream
+// and adds it to the trades served by the REST API.
+func (m *MockExchange) PublishAggTrade(trade AggTrade) error {
+	m.AddAggTrades(trade)
+	body, err := json.Marshal(map[string]interface{}{
+		"stream": binance.AggTradeStreamName(trade.Symbol),
+		"data":   trade.streamData(),
+	})
+	if err != nil {
+		return err
+	}
+	return m.Publish(binance.AggTradeStreamName(trade.Symbol), body)
+}
+
+// AddAggTrades adds trades to those served by the REST API without
+// streaming them, such as history to be backfilled.
+func (m *MockExchange) AddAggTrades(trades ...AggTrade) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, trade := range trades {
+		symbol := strings.ToUpper(trade.Symbol)
+		list := append(m.trades[symbol], trade)
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].Id < list[j].Id
+		})
+		if len(list) > maxMockTrades {
+			list = list[len(list)-maxMockTrades:]
+		}
+		m.trades[symbol] = list
+	}
+}
+
+// SetDepth sets the order book snapshot served by the REST API for the
+// symbol of snapshot.
+func (m *MockExchange) SetDepth(symbol string, snapshot DepthSnapshot) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.depth[strings.ToUpper(symbol)] = snapshot
+}
+
+// HoldDepth holds the requests for the order book snapshot of symbol until
+// the returned function is called, as for a slow exchange.
+func (m *MockExchange) HoldDepth(symbol string) func() {
+	symbol = strings.ToUpper(symbol)
+	held := make(chan struct{})
+	m.lock.Lock()
+	m.depthHeld[symbol] = held
+	m.lock.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.lock.Lock()
+			if m.depthHeld[symbol] == held {
+				delete(m.depthHeld, symbol)
+			}
+			m.lock.Unlock()
+			close(held)
+		})
+	}
+}
+
+// PublishDepthUpdate sends update to the connections subscribed to the diff
+// depth stream of its symbol.
+func (m *MockExchange) PublishDepthUpdate(update DepthUpdate) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"stream": binance.DepthStreamName(update.Symbol),
+		"data":   update.streamData(),
+	})
+	if err != nil {
+		return err
+	}
+	return m.Publish(binance.DepthStreamName(update.Symbol), body)
+}
+
+// PublishTickers sends tickers to the connections subscribed to the all
+// market tickers.
+func (m *MockExchange) PublishTickers(tickers ...Ticker) error {
+	data := []map[string]interface{}{}
+	for _, ticker := range tickers {
+		data = append(data, ticker.streamData())
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"stream": TickerStreamName,
+		"data":   data,
+	})
+	if err != nil {
+		return err
+	}
+	return m.Publish(TickerStreamName, body)
+}
+
+// Publish sends the raw message body to the connections subscribed to
+// stream, returning the first error writing to one.
+func (m *MockExchange) Publish(stream string, body []byte) error {
+	m.lock.Lock()
+	conns := []*mockConn{}
+	for conn := range m.conns {
+		if conn.streams[stream] {
+			conns = append(conns, conn)
+		}
+	}
+	m.lock.Unlock()
+	var first error
+	for _, conn := range conns {
+		if err := conn.write(body); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Subscribed returns true if a connection is subscribed to stream.
+func (m *MockExchange) Subscribed(stream string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for conn := range m.conns {
+		if conn.streams[stream] {
+			return true
+		}
+	}
+	return false
+}
+
+// WaitSubscribed waits until a connection is subscribed to each of
+// streams, so messages published to them are not missed.
+func (m *MockExchange) WaitSubscribed(ctx context.Context, streams ...string) error {
+	for {
+		m.lock.Lock()
+		changed := m.changed
+		m.lock.Unlock()
+		subscribed := true
+		for _, stream := range streams {
+			if !m.Subscribed(stream) {
+				subscribed = false
+				break
+			}
+		}
+		if subscribed {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return fmt.Errorf("not subscribed to %s: %v", strings.Join(streams, ", "), ctx.Err())
+		}
+	}
+}
+
+// Connections returns the number of connected streams.
+func (m *MockExchange) Connections() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.conns)
+}
+
+// Disconnect closes every stream connection, as on an exchange outage.
+// The streams are expected to reconnect.
+func (m *MockExchange) Disconnect() {
+	m.lock.Lock()
+	conns := []*mockConn{}
+	for conn := range m.conns {
+		conns = append(conns, conn)
+	}
+	m.lock.Unlock()
+	for _, conn := range conns {
+		conn.conn.Close()
+	}
+}
+
+// notify must be called with the lock held.
+func (m *MockExchange) notify() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+func (m *MockExchange) stream(w http.ResponseWriter, r *http.Request) {
+	conn, err := m.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &mockConn{
+		conn:    conn,
+		streams: map[string]bool{},
+	}
+	for _, stream := range strings.Split(r.FormValue("streams"), "/") {
+		if stream != "" {
+			c.streams[stream] = true
+		}
+	}
+	m.lock.Lock()
+	m.conns[c] = true
+	m.notify()
+	m.lock.Unlock()
+
+	// Read until the client disconnects, answering pings and subscription
+	// requests.
+	for {
+		_, body, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		var request struct {
+			Method string   `json:"method"`
+			Params []string `json:"params"`
+			Id     int64    `json:"id"`
+		}
+		if err := json.Unmarshal(body, &request); err != nil {
+			continue
+		}
+		m.lock.Lock()
+		for _, stream := range request.Params {
+			switch request.Method {
+			case "SUBSCRIBE":
+				c.streams[stream] = true
+			case "UNSUBSCRIBE":
+				delete(c.streams, stream)
+			}
+		}
+		m.notify()
+		m.lock.Unlock()
+		response, _ := json.Marshal(map[string]interface{}{
+			"result": nil,
+			"id":     request.Id,
+		})
+		c.write(response)
+	}
+	conn.Close()
+	m.lock.Lock()
+	delete(m.conns, c)
+	m.notify()
+	m.lock.Unlock()
+}
+
+func (m *MockExchange) getExchangeInfo(w http.ResponseWriter, r *http.Request) {
+	m.lock.Lock()
+	symbols := []binance.ExchangeInfoSymbol{}
+	for symbol, status := range m.symbols {
+		symbols = append(symbols, binance.ExchangeInfoSymbol{
+			Symbol:     symbol,
+			Status:     status,
+			OrderTypes: []string{"LIMIT", "MARKET"},
+			Filters:    []map[string]interface{}{},
+		})
+	}
+	m.lock.Unlock()
+	sort.Slice(symbols, func(i, j int) bool {
+		return symbols[i].Symbol < symbols[j].Symbol
+	})
+	writeMockJson(w, http.StatusOK, binance.ExchangeInfo{Symbols: symbols})
+}
+
+// getAggTrades serves the trades from fromId, in the time range, or the
+// most recent, as Binance.
+func (m *MockExchange) getAggTrades(w http.ResponseWriter, r *http.Request) {
+	symbol := strings.ToUpper(r.FormValue("symbol"))
+	limit := 500
+	if value := r.FormValue("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 || limit > maxMockTradesLimit {
+			writeMockJson(w, http.StatusBadRequest, map[string]interface{}{
+				"code": -1100,
+				"msg":  "Illegal characters found in parameter 'limit'.",
+			})
+			return
+		}
+	}
+	param := func(name string) (int64, bool) {
+		value, err := strconv.ParseInt(r.FormValue(name), 10, 64)
+		return value, err == nil
+	}
+
+	m.lock.Lock()
+	all := m.trades[symbol]
+	m.lock.Unlock()
+
+	trades := []AggTrade{}
+	if fromId, ok := param("fromId"); ok {
+		for _, trade := range all {
+			if trade.Id >= fromId && len(trades) < limit {
+				trades = append(trades, trade)
+			}
+		}
+	} else if start, ok := param("startTime"); ok {
+		end, hasEnd := param("endTime")
+		for _, trade := range all {
+			ms := unixMillis(trade.Time)
+			if ms >= start && (!hasEnd || ms <= end) && len(trades) < limit {
+				trades = append(trades, trade)
+			}
+		}
+	} else {
+		if len(all) > limit {
+			all = all[len(all)-limit:]
+		}
+		trades = append(trades, all...)
+	}
+
+	data := []map[string]interface{}{}
+	for _, trade := range trades {
+		data = append(data, trade.restData())
+	}
+	writeMockJson(w, http.StatusOK, data)
+}
+
+// getDepth serves the order book snapshot of a symbol, once released if
+// held.
+func (m *MockExchange) getDepth(w http.ResponseWriter, r *http.Request) {
+	symbol := strings.ToUpper(r.FormValue("symbol"))
+	m.lock.Lock()
+	held := m.depthHeld[symbol]
+	m.lock.Unlock()
+	if held != nil {
+		select {
+		case <-held:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	m.lock.Lock()
+	snapshot, ok := m.depth[symbol]
+	m.lock.Unlock()
+	if !ok {
+		writeMockJson(w, http.StatusBadRequest, map[string]interface{}{
+			"code": -1121,
+			"msg":  "Invalid symbol.",
+		})
+		return
+	}
+	writeMockJson(w, http.StatusOK, snapshot.restData())
+}
+
+func writeMockJson(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(v)
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
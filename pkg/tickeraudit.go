@@ -0,0 +1,374 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// The most aggregates returned by an RSI audit, the most recent.
+const maxAuditAggregates = 200
+
+// The metrics of a TickerTracker that can be audited, by the name given to
+// Audit.
+const (
+	AuditPriceChange  = "price_change_pct"
+	AuditVolumeChange = "volume_change_pct"
+	AuditHigh         = "high"
+	AuditLow          = "low"
+	AuditRange        = "range"
+	AuditRangePercent = "range_pct"
+	AuditVwap         = "vwap"
+	AuditTotalVolume  = "total_volume"
+	AuditNetVolume    = "net_volume"
+	AuditRSI          = "rsi"
+)
+
+// AuditMetrics returns the names of the metrics that can be audited.
+func AuditMetrics() []string {
+	return []string{
+		AuditPriceChange, AuditVolumeChange, AuditHigh, AuditLow, AuditRange,
+		AuditRangePercent, AuditVwap, AuditTotalVolume, AuditNetVolume, AuditRSI,
+	}
+}
+
+// MetricAudit is the calculation of a metric of a symbol over a window,
+// redone from the ticks, trades or aggregates the tracker holds, to check
+// the value published in the ticker updates.
+type MetricAudit struct {
+	Symbol string `json:"symbol"`
+	Metric string `json:"metric"`
+	Window string `json:"window"`
+
+	// The event time the window ends at, as of the last calculation.
+	CalculatedAt time.Time `json:"calculated_at"`
+
+	// The value published, and the value calculated again from the window
+	// contents. Nil if the window has no data to calculate from, in which
+	// case the published value is left from an earlier calculation.
+	Value        float64  `json:"value"`
+	Recalculated *float64 `json:"recalculated"`
+
+	// The intermediate values of the calculation, by name.
+	Steps map[string]interface{} `json:"steps"`
+
+	Notes []string `json:"notes,omitempty"`
+
+	// The window contents the metric is calculated from, oldest first.
+	Ticks      []AuditTick      `json:"ticks,omitempty"`
+	Trades     []AuditTrade     `json:"trades,omitempty"`
+	Aggregates []AuditAggregate `json:"aggregates,omitempty"`
+}
+
+type AuditTick struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Age         string    `json:"age"`
+	Bucket      int       `json:"bucket"`
+	Price       float64   `json:"price"`
+	QuoteVolume float64   `json:"quote_volume"`
+
+	// True for the tick the change is measured from.
+	Reference bool `json:"reference,omitempty"`
+}
+
+type AuditTrade struct {
+	Id            int64     `json:"id"`
+	Timestamp     time.Time `json:"timestamp"`
+	Age           string    `json:"age"`
+	Bucket        int       `json:"bucket"`
+	Price         float64   `json:"price"`
+	Quantity      float64   `json:"quantity"`
+	QuoteQuantity float64   `json:"quote_quantity"`
+	Side          string    `json:"side"`
+}
+
+type AuditAggregate struct {
+	Time   time.Time `json:"time"`
+	Open   float64   `json:"open"`
+	High   float64   `json:"high"`
+	Low    float64   `json:"low"`
+	Close  float64   `json:"close"`
+	Trades int       `json:"trades"`
+}
+
+// bucketOf returns the metrics bucket an event at timestamp falls in, as
+// calculated by the tracker.
+func bucketOf(now time.Time, timestamp time.Time) int {
+	return (int(now.Sub(timestamp).Seconds()) / 60) + 1
+}
+
+// Audit calculates metric over the window of bucket minutes again, as of
+// the last calculation, and returns it with the window contents and
+// intermediate values. Must not be called while the tracker is updated.
+func (t *TickerTracker) Audit(metric string, bucket int) (*MetricAudit, error) {
+	metrics := t.Metrics[bucket]
+	if metrics == nil {
+		return nil, fmt.Errorf("unsupported window: %dm", bucket)
+	}
+	audit := &MetricAudit{
+		Symbol:       t.Symbol,
+		Metric:       metric,
+		Window:       fmt.Sprintf("%dm", bucket),
+		CalculatedAt: t.CalculatedAt,
+		Steps:        map[string]interface{}{},
+	}
+	if t.CalculatedAt.IsZero() {
+		audit.Notes = append(audit.Notes, "metrics have not been calculated yet")
+	}
+	switch metric {
+	case AuditPriceChange:
+		audit.Value = metrics.PriceChangePercent
+		t.auditTicks(audit, bucket)
+	case AuditVolumeChange:
+		audit.Value = metrics.VolumeChangePercent
+		t.auditTicks(audit, bucket)
+	case AuditHigh:
+		audit.Value = metrics.High
+		t.auditTicks(audit, bucket)
+	case AuditLow:
+		audit.Value = metrics.Low
+		t.auditTicks(audit, bucket)
+	case AuditRange:
+		audit.Value = metrics.Range
+		t.auditTicks(audit, bucket)
+	case AuditRangePercent:
+		audit.Value = metrics.RangePercent
+		t.auditTicks(audit, bucket)
+	case AuditVwap:
+		audit.Value = metrics.Vwap
+		t.auditTrades(audit, bucket)
+	case AuditTotalVolume:
+		audit.Value = metrics.TotalVolume
+		t.auditTrades(audit, bucket)
+	case AuditNetVolume:
+		audit.Value = metrics.NetVolume
+		t.auditTrades(audit, bucket)
+	case AuditRSI:
+		audit.Value = metrics.RSI
+		t.auditRSI(audit, bucket)
+	default:
+		return nil, fmt.Errorf("unknown metric: %s, expected one of %s", metric,
+			strings.Join(AuditMetrics(), ", "))
+	}
+	if math.IsNaN(audit.Value) || math.IsInf(audit.Value, 0) {
+		audit.Notes = append(audit.Notes, fmt.Sprintf("published value is %v", audit.Value))
+		audit.Value = 0
+	}
+	return audit, nil
+}
+
+// auditTicks calculates the metrics of the ticks as CalculateTicks does:
+// the change is measured from the oldest tick in the bucket, and the high
+// and low are over the ticks since it.
+func (t *TickerTracker) auditTicks(audit *MetricAudit, bucket int) {
+	now := t.CalculatedAt
+	last := t.LastTick()
+	if last == nil || len(t.Ticks) < 2 {
+		audit.Notes = append(audit.Notes, "fewer than 2 ticks")
+		return
+	}
+
+	reference := -1
+	for i := len(t.Ticks) - 2; i >= 0; i-- {
+		if bucketOf(now, t.Ticks[i].Timestamp) == bucket {
+			reference = i
+		}
+	}
+	first := reference
+	if first < 0 {
+		// Show the ticks of the shorter buckets.
+		first = len(t.Ticks) - 1
+		for first > 0 && bucketOf(now, t.Ticks[first-1].Timestamp) < bucket {
+			first--
+		}
+	}
+	for i := first; i < len(t.Ticks); i++ {
+		tick := t.Ticks[i]
+		audit.Ticks = append(audit.Ticks, AuditTick{
+			Timestamp:   tick.Timestamp,
+			Age:         now.Sub(tick.Timestamp).String(),
+			Bucket:      bucketOf(now, tick.Timestamp),
+			Price:       tick.LastPrice,
+			QuoteVolume: tick.QuoteVolume,
+			Reference:   i == reference,
+		})
+	}
+	audit.Steps["last_price"] = last.LastPrice
+	audit.Steps["last_quote_volume"] = last.QuoteVolume
+	audit.Steps["last_timestamp"] = last.Timestamp
+	if reference < 0 {
+		audit.Notes = append(audit.Notes, fmt.Sprintf(
+			"no tick aged %dm to %dm, the published value is left from an earlier calculation",
+			bucket-1, bucket))
+		return
+	}
+
+	high, low := last.LastPrice, last.LastPrice
+	for _, tick := range t.Ticks[reference : len(t.Ticks)-1] {
+		high = math.Max(high, tick.LastPrice)
+		low = math.Min(low, tick.LastPrice)
+	}
+	tick := t.Ticks[reference]
+	audit.Steps["reference_price"] = tick.LastPrice
+	audit.Steps["reference_quote_volume"] = tick.QuoteVolume
+	audit.Steps["reference_timestamp"] = tick.Timestamp
+	audit.Steps["high"] = high
+	audit.Steps["low"] = low
+
+	var value float64
+	switch audit.Metric {
+	case AuditPriceChange:
+		audit.Steps["price_change"] = last.LastPrice - tick.LastPrice
+		if tick.LastPrice > 0 {
+			value = Round3((last.LastPrice - tick.LastPrice) / tick.LastPrice * 100)
+		}
+	case AuditVolumeChange:
+		audit.Steps["volume_change"] = last.QuoteVolume - tick.QuoteVolume
+		if tick.QuoteVolume > 0 {
+			value = Round3((last.QuoteVolume - tick.QuoteVolume) / tick.QuoteVolume * 100)
+		}
+		audit.Notes = append(audit.Notes,
+			"volume is the rolling 24h quote volume of the ticker, so the change is of the 24h volume")
+	case AuditHigh:
+		value = high
+	case AuditLow:
+		value = low
+	case AuditRange:
+		value = Round8(high - low)
+	case AuditRangePercent:
+		audit.Steps["range"] = Round8(high - low)
+		if low > 0 {
+			value = Round3(Round8(high-low) / low * 100)
+		} else if high > 0 {
+			value = 100
+		}
+	}
+	audit.Recalculated = &value
+}
+
+// auditTrades calculates the metrics of the trades as CalculateTrades does,
+// accumulated from the latest trade back to the oldest in the bucket.
+func (t *TickerTracker) auditTrades(audit *MetricAudit, bucket int) {
+	now := t.CalculatedAt
+	oldest := -1
+	for i := len(t.Trades) - 1; i >= 0; i-- {
+		if bucketOf(now, t.Trades[i].Timestamp) == bucket {
+			oldest = i
+		}
+	}
+	if oldest < 0 {
+		audit.Notes = append(audit.Notes, fmt.Sprintf(
+			"no trade aged %dm to %dm, the published value is left from an earlier calculation",
+			bucket-1, bucket))
+		return
+	}
+
+	buyVolume, sellVolume := 0.0, 0.0
+	vwapPrice, vwapVolume := 0.0, 0.0
+	for _, trade := range t.Trades[oldest:] {
+		side := "buy"
+		if trade.BuyerMaker {
+			side = "sell"
+			sellVolume += trade.QuoteQuantity()
+		} else {
+			buyVolume += trade.QuoteQuantity()
+		}
+		vwapPrice += trade.Quantity * trade.Price
+		vwapVolume += trade.Quantity
+		audit.Trades = append(audit.Trades, AuditTrade{
+			Id:            trade.Id,
+			Timestamp:     trade.Timestamp,
+			Age:           now.Sub(trade.Timestamp).String(),
+			Bucket:        bucketOf(now, trade.Timestamp),
+			Price:         trade.Price,
+			Quantity:      trade.Quantity,
+			QuoteQuantity: trade.QuoteQuantity(),
+			Side:          side,
+		})
+	}
+	if late := bucketOf(now, t.Trades[len(t.Trades)-1].Timestamp); late < 1 {
+		audit.Notes = append(audit.Notes, "includes trades after the calculation time")
+	}
+	audit.Steps["trades"] = len(audit.Trades)
+	audit.Steps["buy_volume"] = buyVolume
+	audit.Steps["sell_volume"] = sellVolume
+	audit.Steps["price_quantity_sum"] = vwapPrice
+	audit.Steps["quantity_sum"] = vwapVolume
+
+	var value float64
+	switch audit.Metric {
+	case AuditVwap:
+		value = vwapPrice / vwapVolume
+	case AuditTotalVolume:
+		value = buyVolume + sellVolume
+	case AuditNetVolume:
+		value = buyVolume - sellVolume
+	}
+	audit.Recalculated = &value
+}
+
+// auditRSI calculates the RSI of the aggregates as CalculateRSI does, with
+// Wilder's smoothing over the whole series.
+func (t *TickerTracker) auditRSI(audit *MetricAudit, bucket int) {
+	aggs := t.Aggs[bucket]
+	if len(aggs) == 0 {
+		audit.Notes = append(audit.Notes, "no aggregates")
+		return
+	}
+	value := t.CalculateRSI(aggs)
+
+	period := 14
+	gains, losses := 0.0, 0.0
+	for i := 1; i < len(aggs) && i < period; i++ {
+		if change := aggs[i].Close - aggs[i-1].Close; change > 0 {
+			gains += change
+		} else {
+			losses -= change
+		}
+	}
+	audit.Steps["periods"] = len(aggs)
+	audit.Steps["seed_gains"] = gains / float64(period)
+	audit.Steps["seed_losses"] = losses / float64(period)
+	if len(aggs) < period {
+		audit.Notes = append(audit.Notes, fmt.Sprintf(
+			"fewer than %d aggregates, the RSI is not seeded", period))
+	}
+
+	start := 0
+	if len(aggs) > maxAuditAggregates {
+		start = len(aggs) - maxAuditAggregates
+		audit.Notes = append(audit.Notes, fmt.Sprintf(
+			"only the last %d of %d aggregates are listed", maxAuditAggregates, len(aggs)))
+	}
+	for _, agg := range aggs[start:] {
+		audit.Aggregates = append(audit.Aggregates, AuditAggregate{
+			Time:   agg.Time,
+			Open:   agg.Open,
+			High:   agg.High,
+			Low:    agg.Low,
+			Close:  agg.Close,
+			Trades: agg.trades,
+		})
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		audit.Notes = append(audit.Notes, fmt.Sprintf("RSI is %v, no losses or gains", value))
+		return
+	}
+	audit.Recalculated = &value
+}
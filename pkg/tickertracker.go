@@ -18,7 +18,6 @@ package pkg
 import (
 	"math"
 	"time"
-	"gitlab.com/crankykernel/cryptotrader/binance"
 	"sync"
 	"gitlab.com/crankykernel/cryptoxscanner/log"
 )
@@ -34,6 +33,10 @@ type Aggregate struct {
 
 	// The 24 volume in the quote asset.
 	QuoteVolume24 float64
+
+	// The number of trades in the period, 0 for a period carried forward
+	// from the previous close.
+	trades int
 }
 
 type TickerMetrics struct {
@@ -60,8 +63,10 @@ type TickerTracker struct {
 	LastUpdate time.Time
 	H24Metrics TickerMetrics
 
-	// Trades, in Binance format.
-	Trades []*binance.StreamAggTrade
+	// The event time the metric windows ended at when last calculated.
+	CalculatedAt time.Time
+
+	Trades []*CommonTrade
 
 	Aggs map[int][]Aggregate
 
@@ -89,7 +94,7 @@ func NewTickerTracker(symbol string) *TickerTracker {
 	tracker := TickerTracker{
 		Symbol:  symbol,
 		Ticks:   []*CommonTicker{},
-		Trades:  []*binance.StreamAggTrade{},
+		Trades:  []*CommonTrade{},
 		Metrics: make(map[int]*TickerMetrics),
 		Aggs:    make(map[int][]Aggregate),
 	}
@@ -108,9 +113,12 @@ func (t *TickerTracker) LastTick() *CommonTicker {
 	return t.Ticks[len(t.Ticks)-1]
 }
 
-func (t *TickerTracker) Recalculate() {
-	t.CalculateTrades()
-	t.CalculateTicks()
+// Recalculate calculates the metrics with windows ending at now, the event
+// time of the exchange.
+func (t *TickerTracker) Recalculate(now time.Time) {
+	t.CalculatedAt = now
+	t.CalculateTrades(now)
+	t.CalculateTicks(now)
 
 	for _, bucket := range Buckets {
 		t.Metrics[bucket].RSI = t.CalculateRSI(t.Aggs[bucket])
@@ -160,9 +168,8 @@ func (t *TickerTracker) CalculateRSI(aggs []Aggregate) (float64) {
 	return rsi
 }
 
-func (t *TickerTracker) CalculateTicks() {
+func (t *TickerTracker) CalculateTicks(now time.Time) {
 	last := t.LastTick()
-	now := time.Now()
 	count := len(t.Ticks)
 
 	if count < 2 {
@@ -230,14 +237,12 @@ func (t *TickerTracker) CalculateTicks() {
 // - VWAP
 // - Total volume
 // - Net volume
-func (t *TickerTracker) CalculateTrades() {
+func (t *TickerTracker) CalculateTrades(now time.Time) {
 	count := len(t.Trades)
 	if count < 1 {
 		return
 	}
 
-	now := time.Now()
-
 	t.HaveNetVolume = true
 	t.HaveTotalVolume = true
 	t.HaveVwap = true;
@@ -249,7 +254,7 @@ func (t *TickerTracker) CalculateTrades() {
 	for i := count - 1; i >= 0; i-- {
 		trade := t.Trades[i]
 
-		age := now.Sub(trade.Timestamp())
+		age := now.Sub(trade.Timestamp)
 
 		if !trade.BuyerMaker {
 			buyVolume += trade.QuoteQuantity()
@@ -280,10 +285,18 @@ func (t *TickerTracker) CalculateTrades() {
 	t.PruneTrades(now)
 }
 
+// Update adds a ticker, in event time order, pruning tickers over an hour
+// older than the latest.
 func (t *TickerTracker) Update(ticker CommonTicker) {
 	t.LastUpdate = time.Now()
-	t.Ticks = append(t.Ticks, &ticker)
-	now := ticker.Timestamp
+	i := len(t.Ticks)
+	for i > 0 && ticker.Timestamp.Before(t.Ticks[i-1].Timestamp) {
+		i--
+	}
+	t.Ticks = append(t.Ticks, nil)
+	copy(t.Ticks[i+1:], t.Ticks[i:])
+	t.Ticks[i] = &ticker
+	now := t.LastTick().Timestamp
 	for {
 		first := t.Ticks[0]
 		if now.Sub(first.Timestamp) > (time.Minute*60)+1 {
@@ -294,125 +307,148 @@ func (t *TickerTracker) Update(ticker CommonTicker) {
 	}
 }
 
-func (t *TickerTracker) AddTrade(trade binance.StreamAggTrade) {
+// AddTrade adds a trade to the trades and aggregates of the tracker. Trades
+// are kept in event time order, so a late trade, such as one backfilled
+// after a reconnect, is inserted at its place and updates the aggregate of
+// its period rather than the latest.
+func (t *TickerTracker) AddTrade(trade CommonTrade) {
 	if trade.Symbol == "" {
 		log.Printf("error: not adding trade with empty symbol")
 		return
 	}
 
-	if len(t.Trades) > 0 {
-		lastTrade := t.Trades[len(t.Trades)-1]
-		if trade.Timestamp().Before(lastTrade.Timestamp()) {
-			log.Printf("error: received trade older than previous trade (symbol: %s)\n",
-				t.Symbol)
-		}
+	i := len(t.Trades)
+	for i > 0 && trade.Timestamp.Before(t.Trades[i-1].Timestamp) {
+		i--
+	}
+	t.Trades = append(t.Trades, nil)
+	copy(t.Trades[i+1:], t.Trades[i:])
+	t.Trades[i] = &trade
+
+	// The trades either side of a late trade.
+	var prev, next *CommonTrade
+	if i > 0 {
+		prev = t.Trades[i-1]
+	}
+	if i+1 < len(t.Trades) {
+		next = t.Trades[i+1]
 	}
 
-	t.Trades = append(t.Trades, &trade)
-
-	openTime := trade.Timestamp().Truncate(time.Minute)
+	for _, interval := range Buckets {
+		t.addAggregateTrade(interval, &trade, prev, next)
+	}
+}
 
-	if t.Aggs[1] == nil {
-		t.Aggs[1] = append(t.Aggs[1], Aggregate{
-			Time:  openTime,
-			Open:  trade.Price,
-			Close: trade.Price,
-			High:  trade.Price,
-			Low:   trade.Price,
+// addAggregateTrade adds a trade to the aggregate of its period. Periods
+// without trades carry forward the previous close.
+func (t *TickerTracker) addAggregateTrade(interval int, trade *CommonTrade, prev *CommonTrade, next *CommonTrade) {
+	period := time.Minute * time.Duration(interval)
+	openTime := trade.Timestamp.Truncate(period)
+	aggs := t.Aggs[interval]
+
+	if len(aggs) == 0 {
+		t.Aggs[interval] = append(aggs, Aggregate{
+			Time:   openTime,
+			Open:   trade.Price,
+			Close:  trade.Price,
+			High:   trade.Price,
+			Low:    trade.Price,
+			trades: 1,
 		})
-	} else {
-		aggs := t.Aggs[1]
-		lastAgg := &aggs[len(aggs)-1]
-		if lastAgg.Time == openTime {
-			lastAgg.Close = trade.Price
-			if trade.Price > lastAgg.High {
-				lastAgg.High = trade.Price
-			}
-			if trade.Price < lastAgg.Low {
-				lastAgg.Low = trade.Price
-			}
-		} else {
-			nextTime := lastAgg.Time.Add(time.Minute)
-			for {
-				if nextTime.Before(openTime) {
-					t.Aggs[1] = append(aggs, Aggregate{
-						Time:  nextTime,
-						Open:  lastAgg.Close,
-						Close: lastAgg.Close,
-						High:  lastAgg.Close,
-						Low:   lastAgg.Close,
-					})
-					nextTime = nextTime.Add(time.Minute)
-				} else {
-					t.Aggs[1] = append(aggs, Aggregate{
-						Time:  openTime,
-						Open:  lastAgg.Close,
-						Close: trade.Price,
-						High:  trade.Price,
-						Low:   trade.Price,
-					})
-					break
-				}
-			}
-		}
+		return
 	}
-	m1Agg := t.Aggs[1][len(t.Aggs[1])-1]
 
-	for _, interval := range Buckets[1:] {
-		openTime := m1Agg.Time.Truncate(time.Minute * time.Duration(interval))
-		aggs := t.Aggs[interval]
-		if aggs == nil {
+	lastAgg := aggs[len(aggs)-1]
+	if openTime.After(lastAgg.Time) {
+		for nextTime := lastAgg.Time.Add(period); nextTime.Before(openTime); nextTime = nextTime.Add(period) {
 			aggs = append(aggs, Aggregate{
-				Time:  openTime,
-				Open:  m1Agg.Open,
-				Close: m1Agg.Close,
-				High:  m1Agg.High,
-				Low:   m1Agg.Low,
+				Time:  nextTime,
+				Open:  lastAgg.Close,
+				Close: lastAgg.Close,
+				High:  lastAgg.Close,
+				Low:   lastAgg.Close,
 			})
-			t.Aggs[interval] = aggs
-		} else {
-			aggs := t.Aggs[interval]
-			lastAgg := &aggs[len(aggs)-1]
-			if lastAgg.Time == openTime {
-				lastAgg.Close = m1Agg.Close
-				if m1Agg.Close > lastAgg.High {
-					lastAgg.High = m1Agg.Close
-				}
-				if m1Agg.Close < lastAgg.Low {
-					lastAgg.Low = m1Agg.Close
-				}
-			} else {
-				nextTime := lastAgg.Time.Add(time.Minute * time.Duration(interval))
-				for {
-					if nextTime.Before(openTime) {
-						t.Aggs[interval] = append(aggs, Aggregate{
-							Time:  nextTime,
-							Open:  lastAgg.Close,
-							Close: lastAgg.Close,
-							High:  lastAgg.Close,
-							Low:   lastAgg.Close,
-						})
-						nextTime = nextTime.Add(time.Minute * time.Duration(interval))
-					} else {
-						t.Aggs[interval] = append(aggs, Aggregate{
-							Time:  openTime,
-							Open:  lastAgg.Close,
-							Close: m1Agg.Close,
-							High:  m1Agg.High,
-							Low:   m1Agg.Low,
-						})
-						break
-					}
-				}
+		}
+		t.Aggs[interval] = append(aggs, Aggregate{
+			Time:   openTime,
+			Open:   lastAgg.Close,
+			Close:  trade.Price,
+			High:   trade.Price,
+			Low:    trade.Price,
+			trades: 1,
+		})
+		return
+	}
+
+	if openTime.Before(aggs[0].Time) {
+		// Older than the first aggregate, so it opens the aggregates.
+		first := []Aggregate{}
+		for nextTime := openTime; nextTime.Before(aggs[0].Time); nextTime = nextTime.Add(period) {
+			first = append(first, Aggregate{
+				Time:  nextTime,
+				Open:  trade.Price,
+				Close: trade.Price,
+				High:  trade.Price,
+				Low:   trade.Price,
+			})
+		}
+		first[0].trades = 1
+		aggs = append(first, aggs...)
+		t.Aggs[interval] = aggs
+		for k := len(first); k < len(aggs); k++ {
+			aggs[k].Open = trade.Price
+			if aggs[k].trades > 0 {
+				break
 			}
+			aggs[k].Close = trade.Price
+			aggs[k].High = trade.Price
+			aggs[k].Low = trade.Price
 		}
+		return
+	}
+
+	j := len(aggs) - 1
+	for aggs[j].Time.After(openTime) {
+		j--
+	}
+	agg := &aggs[j]
+	if j == 0 && (prev == nil || prev.Timestamp.Before(openTime)) {
+		// The first trade of the first aggregate.
+		agg.Open = trade.Price
+	}
+	if agg.trades == 0 {
+		agg.High = trade.Price
+		agg.Low = trade.Price
+	}
+	agg.trades++
+	if trade.Price > agg.High {
+		agg.High = trade.Price
+	}
+	if trade.Price < agg.Low {
+		agg.Low = trade.Price
+	}
+	if next != nil && next.Timestamp.Before(openTime.Add(period)) {
+		// Not the last trade of the period.
+		return
+	}
+	agg.Close = trade.Price
+
+	// Carry the close forward to the following periods.
+	for k := j + 1; k < len(aggs); k++ {
+		aggs[k].Open = agg.Close
+		if aggs[k].trades > 0 {
+			break
+		}
+		aggs[k].Close = agg.Close
+		aggs[k].High = agg.Close
+		aggs[k].Low = agg.Close
 	}
 }
 
 func (t *TickerTracker) PruneTrades(now time.Time) {
 	chop := 0
 	for i, trade := range t.Trades {
-		age := now.Sub(trade.Timestamp())
+		age := now.Sub(trade.Timestamp)
 		if age < time.Hour {
 			break
 		}
@@ -452,8 +488,22 @@ func (t *TickerTrackerMap) GetTracker(symbol string) *TickerTracker {
 	return t.Trackers[symbol]
 }
 
+// Symbols returns the symbols of all trackers.
+func (t *TickerTrackerMap) Symbols() []string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	symbols := make([]string, 0, len(t.Trackers))
+	for symbol := range t.Trackers {
+		symbols = append(symbols, symbol)
+	}
+	return symbols
+}
+
 func (t *TickerTrackerMap) GetLastForSymbol(symbol string) *CommonTicker {
-	if tracker, ok := t.Trackers[symbol]; ok {
+	t.lock.RLock()
+	tracker, ok := t.Trackers[symbol]
+	t.lock.RUnlock()
+	if ok {
 		return tracker.LastTick()
 	}
 	return nil
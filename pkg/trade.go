@@ -0,0 +1,53 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"gitlab.com/crankykernel/cryptotrader/binance"
+	"time"
+)
+
+type CommonTrade struct {
+	// The coin and the pairing: ETHBTC, ETH-BTC...
+	Symbol string
+
+	// The exchange assigned trade ID. For Binance this is the aggregate
+	// trade ID, for KuCoin the sequence number.
+	Id int64
+
+	Timestamp time.Time
+
+	Price    float64
+	Quantity float64
+
+	// True if the buyer was the maker, meaning the taker sold.
+	BuyerMaker bool
+}
+
+func (t *CommonTrade) QuoteQuantity() float64 {
+	return t.Price * t.Quantity
+}
+
+func CommonTradeFromBinanceTrade(trade binance.StreamAggTrade) CommonTrade {
+	common := CommonTrade{}
+	common.Symbol = trade.Symbol
+	common.Id = trade.AggTradeID
+	common.Timestamp = trade.Timestamp()
+	common.Price = trade.Price
+	common.Quantity = trade.Quantity
+	common.BuyerMaker = trade.BuyerMaker
+	return common
+}
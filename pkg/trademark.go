@@ -0,0 +1,50 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"time"
+)
+
+// TradeMark is the position of a trade in the trades of a symbol, such as
+// the last trade added to state saved on shutdown.
+type TradeMark struct {
+	Timestamp time.Time `json:"timestamp"`
+	Id        int64     `json:"id,omitempty"`
+}
+
+// Advance returns the later of the mark and trade.
+func (m TradeMark) Advance(trade *CommonTrade) TradeMark {
+	if trade.Timestamp.Before(m.Timestamp) ||
+		(trade.Timestamp.Equal(m.Timestamp) && trade.Id <= m.Id) {
+		return m
+	}
+	return TradeMark{Timestamp: trade.Timestamp, Id: trade.Id}
+}
+
+// Covers returns true if trade is at or before the mark, so was already
+// seen when the mark was taken. Trades at the same time as the mark are
+// told apart by ID, and are covered if they have none. The zero mark
+// covers no trades.
+func (m TradeMark) Covers(trade *CommonTrade) bool {
+	if m.Timestamp.IsZero() || trade.Timestamp.After(m.Timestamp) {
+		return false
+	}
+	if trade.Timestamp.Before(m.Timestamp) {
+		return true
+	}
+	return trade.Id == 0 || trade.Id <= m.Id
+}
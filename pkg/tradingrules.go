@@ -0,0 +1,150 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TradingRulesExchange is implemented, in addition to Exchange, by
+// exchanges that publish the trading rules of their symbols.
+type TradingRulesExchange interface {
+	// GetTradingRules returns the current rules keyed by symbol.
+	GetTradingRules() (map[string]TradingRules, error)
+}
+
+// SymbolStatus is the trading status of a symbol, common to the exchanges.
+type SymbolStatus string
+
+const (
+	SymbolTrading SymbolStatus = "trading"
+
+	// Not trading, at least for now, such as in a break, halted or
+	// disabled.
+	SymbolHalted SymbolStatus = "halted"
+
+	// Orders are being collected to be matched at a single price, such as
+	// before trading starts or resumes.
+	SymbolAuction SymbolStatus = "auction"
+
+	// The exchange has given no status.
+	SymbolUnknown SymbolStatus = ""
+)
+
+// Suspended returns true if the symbol is not continuously trading, so its
+// trades and prices are not comparable to those of regular trading.
+func (s SymbolStatus) Suspended() bool {
+	return s == SymbolHalted || s == SymbolAuction
+}
+
+// Exchange statuses of a symbol collecting orders for an auction.
+var auctionStatuses = map[string]bool{
+	"AUCTION":       true,
+	"AUCTION_MATCH": true,
+	"PRE_TRADING":   true,
+}
+
+// TradingRules are the rules an exchange enforces on the orders of a
+// symbol. Values an exchange does not have are 0 or empty.
+type TradingRules struct {
+	Symbol      string   `json:"symbol"`
+	Status      string   `json:"status"`
+	OrderTypes  []string `json:"order_types,omitempty"`
+	TickSize    float64  `json:"tick_size"`
+	StepSize    float64  `json:"step_size"`
+	MinQty      float64  `json:"min_qty"`
+	MaxQty      float64  `json:"max_qty"`
+	MinNotional float64  `json:"min_notional"`
+}
+
+// SymbolStatus returns the common status of the exchange status. Statuses
+// other than trading and auctions are taken as halted.
+func (r TradingRules) SymbolStatus() SymbolStatus {
+	status := strings.ToUpper(r.Status)
+	switch {
+	case status == "":
+		return SymbolUnknown
+	case status == "TRADING":
+		return SymbolTrading
+	case auctionStatuses[status]:
+		return SymbolAuction
+	}
+	return SymbolHalted
+}
+
+// Halted returns true if the symbol is in a break, halted or disabled.
+func (r TradingRules) Halted() bool {
+	return r.SymbolStatus() == SymbolHalted
+}
+
+// SymbolStatusChange is a transition of the trading status of a symbol.
+type SymbolStatusChange struct {
+	Exchange string       `json:"exchange"`
+	Symbol   string       `json:"symbol"`
+	Status   SymbolStatus `json:"status"`
+	Previous SymbolStatus `json:"previous"`
+
+	// The status as given by the exchange.
+	ExchangeStatus string    `json:"exchange_status"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+type RuleChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+func (c RuleChange) String() string {
+	return fmt.Sprintf("%s %v -> %v", c.Field, c.Old, c.New)
+}
+
+// Diff returns the changes from previous to r. Order types are compared
+// regardless of order.
+func (r TradingRules) Diff(previous TradingRules) []RuleChange {
+	changes := []RuleChange{}
+	if r.Status != previous.Status {
+		changes = append(changes, RuleChange{"status", previous.Status, r.Status})
+	}
+	numbers := []struct {
+		field    string
+		old, new float64
+	}{
+		{"tick_size", previous.TickSize, r.TickSize},
+		{"step_size", previous.StepSize, r.StepSize},
+		{"min_qty", previous.MinQty, r.MinQty},
+		{"max_qty", previous.MaxQty, r.MaxQty},
+		{"min_notional", previous.MinNotional, r.MinNotional},
+	}
+	for _, number := range numbers {
+		if number.old != number.new {
+			changes = append(changes, RuleChange{number.field, number.old, number.new})
+		}
+	}
+	if old, new := sortedJoin(previous.OrderTypes), sortedJoin(r.OrderTypes); old != new {
+		changes = append(changes, RuleChange{"order_types", old, new})
+	}
+	return changes
+}
+
+func sortedJoin(values []string) string {
+	sorted := append([]string{}, values...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
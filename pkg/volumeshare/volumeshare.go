@@ -0,0 +1,505 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package volumeshare tracks the USD trade volume of each asset on each
+// exchange it trades on, and each exchange's share of the total over
+// rolling windows. An abrupt shift in share is often a sign of activity
+// specific to one venue, or of an outage.
+package volumeshare
+
+import (
+	"context"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/metrics"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/stats"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	metrics.Describe("volume_share_shifts_total",
+		"Abrupt volume share shifts detected, by exchange.")
+}
+
+// The windows volume share is reported over. Volume older than the longest
+// is discarded.
+var Windows = []time.Duration{
+	5 * time.Minute,
+	time.Hour,
+	24 * time.Hour,
+}
+
+// How often the shares are checked for shifts.
+const checkInterval = 10 * time.Second
+
+type Config struct {
+	// A change in an exchange's share of at least this many percentage
+	// points raises an event. A threshold of 0 disables the monitor.
+	ShiftPct float64 `mapstructure:"shift_pct" json:"shift_pct"`
+
+	// The share over the most recent Window is compared to the share over
+	// the Baseline before it.
+	Window   time.Duration `mapstructure:"window" json:"window"`
+	Baseline time.Duration `mapstructure:"baseline" json:"baseline"`
+
+	// Assets with less than this USD volume across all exchanges in
+	// either period are not checked, as shares of thin volume are noisy.
+	MinUsd float64 `mapstructure:"min_usd" json:"min_usd"`
+
+	// The minimum time between shifts raised for an asset.
+	Cooldown time.Duration `mapstructure:"cooldown" json:"cooldown"`
+
+	// Names of the alert webhooks and notifiers to deliver to. Empty
+	// delivers to all.
+	Webhooks []string `mapstructure:"webhooks" json:"webhooks,omitempty"`
+	Notify   []string `mapstructure:"notify" json:"notify,omitempty"`
+}
+
+var DefaultConfig = Config{
+	Window:   5 * time.Minute,
+	Baseline: time.Hour,
+	MinUsd:   100000,
+	Cooldown: 15 * time.Minute,
+}
+
+// Override returns c with the fields that are set in override replaced.
+func (c Config) Override(override Config) Config {
+	if override.ShiftPct != 0 {
+		c.ShiftPct = override.ShiftPct
+	}
+	if override.Window != 0 {
+		c.Window = override.Window
+	}
+	if override.Baseline != 0 {
+		c.Baseline = override.Baseline
+	}
+	if override.MinUsd != 0 {
+		c.MinUsd = override.MinUsd
+	}
+	if override.Cooldown != 0 {
+		c.Cooldown = override.Cooldown
+	}
+	if len(override.Webhooks) > 0 {
+		c.Webhooks = override.Webhooks
+	}
+	if len(override.Notify) > 0 {
+		c.Notify = override.Notify
+	}
+	return c
+}
+
+func (c Config) Validate() error {
+	if c.ShiftPct < 0 || c.ShiftPct > 100 {
+		return fmt.Errorf("volume share shift must be between 0 and 100")
+	}
+	if c.Window < time.Minute || c.Baseline < time.Minute {
+		return fmt.Errorf("volume share window and baseline must be at least 1m")
+	}
+	if longest := Windows[len(Windows)-1]; c.Window+c.Baseline > longest {
+		return fmt.Errorf("volume share window and baseline must not total more than %v", longest)
+	}
+	if c.MinUsd < 0 || c.Cooldown < 0 {
+		return fmt.Errorf("volume share min usd and cooldown must not be negative")
+	}
+	return nil
+}
+
+func (c Config) Enabled() bool {
+	return c.ShiftPct > 0
+}
+
+// Share is an exchange's volume of an asset over a window.
+type Share struct {
+	Exchange string  `json:"exchange"`
+	Usd      float64 `json:"usd"`
+	Pct      float64 `json:"pct"`
+}
+
+// AssetShares is the volume share of each exchange an asset trades on, over
+// each of the Windows keyed by stats.WindowName, largest share first.
+type AssetShares struct {
+	Asset   string             `json:"asset"`
+	Windows map[string][]Share `json:"windows"`
+}
+
+// Shift is raised when an exchange's share of an asset's volume over the
+// recent window differs from its share over the baseline by at least the
+// configured percentage points.
+type Shift struct {
+	Asset    string `json:"asset"`
+	Exchange string `json:"exchange"`
+
+	// The symbol of the asset with the most volume on the exchange over
+	// the baseline and window.
+	Symbol string `json:"symbol"`
+
+	SharePct    float64 `json:"share_pct"`
+	BaselinePct float64 `json:"baseline_pct"`
+	ChangePct   float64 `json:"change_pct"`
+
+	Window   time.Duration `json:"window"`
+	Baseline time.Duration `json:"baseline"`
+
+	// The shares over the recent window.
+	Shares []Share `json:"shares"`
+}
+
+func (s Shift) Message() string {
+	return fmt.Sprintf("volume share: %s on %s %.1f%% -> %.1f%% (%+.1f points) over %v",
+		s.Asset, s.Exchange, s.BaselinePct, s.SharePct, s.ChangePct, s.Window)
+}
+
+type minuteVolume struct {
+	minute int64
+	usd    float64
+}
+
+// series is the USD volume of a symbol per minute, oldest first. Minutes
+// without trades are not kept.
+type series []minuteVolume
+
+func (s series) sum(from int64, to int64) float64 {
+	total := 0.0
+	for i := len(s) - 1; i >= 0 && s[i].minute >= from; i-- {
+		if s[i].minute < to {
+			total += s[i].usd
+		}
+	}
+	return total
+}
+
+type assetState struct {
+	// Volume by exchange then symbol.
+	exchanges map[string]map[string]series
+	lastShift time.Time
+}
+
+// volume returns the volume of each exchange of the asset in the minutes
+// from, inclusive, to to, exclusive, and the symbol of each with the most.
+func (a *assetState) volume(from int64, to int64) (map[string]float64, map[string]string) {
+	volumes := map[string]float64{}
+	symbols := map[string]string{}
+	for exchange, bySymbol := range a.exchanges {
+		best := -1.0
+		for symbol, s := range bySymbol {
+			usd := s.sum(from, to)
+			volumes[exchange] += usd
+			if usd > best {
+				best = usd
+				symbols[exchange] = symbol
+			}
+		}
+	}
+	return volumes, symbols
+}
+
+// Monitor tracks the volume of each asset on each exchange. Trades are
+// received through the sink of each exchange. Safe for concurrent use.
+type Monitor struct {
+	config Config
+	assets map[string]*assetState
+	lock   sync.Mutex
+
+	// Called with each shift from Run.
+	onShift func(shift Shift)
+}
+
+func NewMonitor(config Config, onShift func(shift Shift)) *Monitor {
+	return &Monitor{
+		config:  config,
+		assets:  map[string]*assetState{},
+		onShift: onShift,
+	}
+}
+
+func (m *Monitor) Config() Config {
+	return m.config
+}
+
+// Sink returns the sink the trades of exchange are received by, with rates
+// returning the exchange's rates to convert its quote assets to USD.
+func (m *Monitor) Sink(exchange string, rates func() *pkg.ConversionRates) pkg.Sink {
+	return &monitorSink{monitor: m, exchange: exchange, rates: rates}
+}
+
+type monitorSink struct {
+	monitor  *Monitor
+	exchange string
+	rates    func() *pkg.ConversionRates
+}
+
+func (s *monitorSink) Name() string {
+	return "volumeshare"
+}
+
+func (s *monitorSink) Send(message interface{}) error {
+	trade, ok := message.(pkg.CommonTrade)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", message)
+	}
+	_, quote, ok := pkg.SplitSymbol(trade.Symbol)
+	if !ok {
+		return nil
+	}
+	rate, ok := s.rates().Rate(quote, "USD")
+	if !ok {
+		return nil
+	}
+	s.monitor.AddTrade(s.exchange, trade, rate)
+	return nil
+}
+
+// AddTrade adds the volume of trade on exchange, with rate converting its
+// quote asset to USD.
+func (m *Monitor) AddTrade(exchange string, trade pkg.CommonTrade, rate float64) {
+	base, _, ok := pkg.SplitSymbol(trade.Symbol)
+	if !ok {
+		return
+	}
+	usd := trade.QuoteQuantity() * rate
+	if usd <= 0 {
+		return
+	}
+	minute := trade.Timestamp.Unix() / 60
+	cutoff := minute - int64(Windows[len(Windows)-1]/time.Minute)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	state := m.assets[base]
+	if state == nil {
+		state = &assetState{exchanges: map[string]map[string]series{}}
+		m.assets[base] = state
+	}
+	bySymbol := state.exchanges[exchange]
+	if bySymbol == nil {
+		bySymbol = map[string]series{}
+		state.exchanges[exchange] = bySymbol
+	}
+	bySymbol[trade.Symbol] = bySymbol[trade.Symbol].add(minute, usd).trim(cutoff)
+}
+
+// add adds usd to minute. Trades are usually in order, but late trades,
+// such as from a backfill, are inserted into their minute.
+func (s series) add(minute int64, usd float64) series {
+	i := len(s)
+	for i > 0 && s[i-1].minute > minute {
+		i--
+	}
+	if i > 0 && s[i-1].minute == minute {
+		s[i-1].usd += usd
+		return s
+	}
+	s = append(s, minuteVolume{})
+	copy(s[i+1:], s[i:])
+	s[i] = minuteVolume{minute: minute, usd: usd}
+	return s
+}
+
+// trim removes the minutes at or before cutoff.
+func (s series) trim(cutoff int64) series {
+	start := 0
+	for start < len(s) && s[start].minute <= cutoff {
+		start++
+	}
+	return s[start:]
+}
+
+// trim removes volume at or before cutoff, and the symbols and exchanges
+// left without volume.
+func (a *assetState) trim(cutoff int64) {
+	for exchange, bySymbol := range a.exchanges {
+		for symbol, s := range bySymbol {
+			if s = s.trim(cutoff); len(s) == 0 {
+				delete(bySymbol, symbol)
+			} else {
+				bySymbol[symbol] = s
+			}
+		}
+		if len(bySymbol) == 0 {
+			delete(a.exchanges, exchange)
+		}
+	}
+}
+
+// shares returns the volumes as shares of their total, largest first.
+func shares(volumes map[string]float64) []Share {
+	total := 0.0
+	for _, usd := range volumes {
+		total += usd
+	}
+	result := []Share{}
+	for exchange, usd := range volumes {
+		share := Share{Exchange: exchange, Usd: pkg.Round3(usd)}
+		if total > 0 {
+			share.Pct = pkg.Round3(usd / total * 100)
+		}
+		result = append(result, share)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Pct != result[j].Pct {
+			return result[i].Pct > result[j].Pct
+		}
+		return result[i].Exchange < result[j].Exchange
+	})
+	return result
+}
+
+// assetShares returns the shares of an asset over each of the Windows
+// ending at now. Must be called with the lock held.
+func assetShares(asset string, state *assetState, now time.Time) AssetShares {
+	minute := now.Unix()/60 + 1
+	result := AssetShares{
+		Asset:   asset,
+		Windows: map[string][]Share{},
+	}
+	for _, window := range Windows {
+		volumes, _ := state.volume(minute-int64(window/time.Minute), minute)
+		result.Windows[stats.WindowName(window)] = shares(volumes)
+	}
+	return result
+}
+
+// Shares returns the shares of every asset traded on at least 2 exchanges,
+// ordered by asset.
+func (m *Monitor) Shares() []AssetShares {
+	now := time.Now()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	result := []AssetShares{}
+	for asset, state := range m.assets {
+		if len(state.exchanges) < 2 {
+			continue
+		}
+		result = append(result, assetShares(asset, state, now))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Asset < result[j].Asset
+	})
+	return result
+}
+
+// Asset returns the shares of an asset, false if it is not traded on at
+// least 2 exchanges.
+func (m *Monitor) Asset(asset string) (AssetShares, bool) {
+	asset = strings.ToUpper(asset)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	state := m.assets[asset]
+	if state == nil || len(state.exchanges) < 2 {
+		return AssetShares{}, false
+	}
+	return assetShares(asset, state, time.Now()), true
+}
+
+// check compares the share of each exchange over the window ending at now
+// to its share over the baseline before it, returning a shift for the
+// exchange with the largest change of each asset if it is at least the
+// threshold.
+func (m *Monitor) check(now time.Time) []Shift {
+	end := now.Unix() / 60
+	start := end - int64(m.config.Window/time.Minute)
+	baselineStart := start - int64(m.config.Baseline/time.Minute)
+
+	cutoff := end - int64(Windows[len(Windows)-1]/time.Minute)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	shifts := []Shift{}
+	for asset, state := range m.assets {
+		state.trim(cutoff)
+		if len(state.exchanges) == 0 {
+			delete(m.assets, asset)
+			continue
+		}
+		if len(state.exchanges) < 2 {
+			continue
+		}
+		if !state.lastShift.IsZero() && now.Sub(state.lastShift) < m.config.Cooldown {
+			continue
+		}
+		recent, _ := state.volume(start, end)
+		baseline, _ := state.volume(baselineStart, start)
+		recentShares := shares(recent)
+		baselineShares := shares(baseline)
+		if total(recentShares) < m.config.MinUsd || total(baselineShares) < m.config.MinUsd {
+			continue
+		}
+		baselinePct := map[string]float64{}
+		for _, share := range baselineShares {
+			baselinePct[share.Exchange] = share.Pct
+		}
+		var shift *Shift
+		for _, share := range recentShares {
+			change := share.Pct - baselinePct[share.Exchange]
+			if math.Abs(change) < m.config.ShiftPct {
+				continue
+			}
+			if shift == nil || math.Abs(change) > math.Abs(shift.ChangePct) {
+				shift = &Shift{
+					Asset:       asset,
+					Exchange:    share.Exchange,
+					SharePct:    share.Pct,
+					BaselinePct: baselinePct[share.Exchange],
+					ChangePct:   pkg.Round3(change),
+				}
+			}
+		}
+		if shift == nil {
+			continue
+		}
+		_, symbols := state.volume(baselineStart, end)
+		shift.Symbol = symbols[shift.Exchange]
+		shift.Window = m.config.Window
+		shift.Baseline = m.config.Baseline
+		shift.Shares = recentShares
+		state.lastShift = now
+		shifts = append(shifts, *shift)
+	}
+	return shifts
+}
+
+func total(shares []Share) float64 {
+	usd := 0.0
+	for _, share := range shares {
+		usd += share.Usd
+	}
+	return usd
+}
+
+// Run checks for shifts every checkInterval until ctx is cancelled.
+func (m *Monitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, shift := range m.check(now) {
+				metrics.GetCounter("volume_share_shifts_total",
+					metrics.Labels{"exchange": shift.Exchange}).Inc()
+				log.Printf("%s\n", shift.Message())
+				if m.onShift != nil {
+					m.onShift(shift)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,314 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package whale detects trades, and short bursts of trades, with a large
+// USD value and tracks the whale buy and sell flow of each symbol.
+package whale
+
+import (
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/stats"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The windows whale flow is reported over. Whales older than the longest
+// are discarded.
+var FlowWindows = []time.Duration{
+	5 * time.Minute,
+	time.Hour,
+	24 * time.Hour,
+}
+
+// The maximum number of whales kept per symbol.
+const maxWhalesPerSymbol = 10000
+
+type Config struct {
+	// Trades, or bursts, with a USD value of at least this are whales. A
+	// threshold of 0 disables whale detection.
+	ThresholdUsd float64 `mapstructure:"threshold_usd" json:"threshold_usd"`
+
+	// Thresholds for individual symbols, overriding ThresholdUsd.
+	Symbols map[string]float64 `mapstructure:"symbols" json:"symbols,omitempty"`
+
+	// Consecutive trades on the same side within this long of the first
+	// are summed as a burst. A window of 0 disables bursts.
+	BurstWindow time.Duration `mapstructure:"burst_window" json:"burst_window"`
+}
+
+var DefaultConfig = Config{
+	ThresholdUsd: 100000,
+	BurstWindow:  2 * time.Second,
+}
+
+// Override returns c with the fields that are set in override replaced.
+// Symbol thresholds are merged.
+func (c Config) Override(override Config) Config {
+	if override.ThresholdUsd != 0 {
+		c.ThresholdUsd = override.ThresholdUsd
+	}
+	if override.BurstWindow != 0 {
+		c.BurstWindow = override.BurstWindow
+	}
+	if len(override.Symbols) > 0 {
+		symbols := map[string]float64{}
+		for symbol, threshold := range c.Symbols {
+			symbols[symbol] = threshold
+		}
+		for symbol, threshold := range override.Symbols {
+			symbols[strings.ToUpper(symbol)] = threshold
+		}
+		c.Symbols = symbols
+	}
+	return c
+}
+
+func (c Config) Validate() error {
+	if c.ThresholdUsd < 0 || c.BurstWindow < 0 {
+		return fmt.Errorf("whale threshold and burst window must not be negative")
+	}
+	for symbol, threshold := range c.Symbols {
+		if threshold < 0 {
+			return fmt.Errorf("whale threshold for %s must not be negative", symbol)
+		}
+	}
+	return nil
+}
+
+// Threshold returns the USD value of a whale for symbol, 0 if disabled.
+func (c Config) Threshold(symbol string) float64 {
+	if threshold, ok := c.Symbols[symbol]; ok {
+		return threshold
+	}
+	return c.ThresholdUsd
+}
+
+type Whale struct {
+	Symbol    string    `json:"symbol"`
+	Side      string    `json:"side"`
+	Timestamp time.Time `json:"timestamp"`
+
+	// The volume weighted price and total quantity of the trades.
+	Price    float64 `json:"price"`
+	Quantity float64 `json:"quantity"`
+	Usd      float64 `json:"usd"`
+
+	// The number of trades, more than 1 for a burst.
+	Trades int  `json:"trades"`
+	Burst  bool `json:"burst"`
+}
+
+// Flow is the whale activity of a symbol over a window.
+type Flow struct {
+	Buys    int     `json:"buys"`
+	Sells   int     `json:"sells"`
+	BuyUsd  float64 `json:"buy_usd"`
+	SellUsd float64 `json:"sell_usd"`
+	NetUsd  float64 `json:"net_usd"`
+}
+
+// Metrics returns the flow as a map, the form alert rules can reference.
+func (f Flow) Metrics() map[string]float64 {
+	return map[string]float64{
+		"buys":     float64(f.Buys),
+		"sells":    float64(f.Sells),
+		"buy_usd":  f.BuyUsd,
+		"sell_usd": f.SellUsd,
+		"net_usd":  f.NetUsd,
+	}
+}
+
+type burst struct {
+	side     string
+	start    time.Time
+	last     time.Time
+	quantity float64
+	quote    float64
+	usd      float64
+	trades   int
+}
+
+// Detector checks trades for whales. Safe for concurrent use.
+type Detector struct {
+	config Config
+	bursts map[string]*burst
+
+	// Recent whales per symbol, oldest first.
+	whales map[string][]Whale
+
+	lock sync.Mutex
+}
+
+func NewDetector(config Config) *Detector {
+	return &Detector{
+		config: config,
+		bursts: map[string]*burst{},
+		whales: map[string][]Whale{},
+	}
+}
+
+func (d *Detector) Config() Config {
+	return d.config
+}
+
+// Check checks a trade, with rate converting its quote currency to USD, and
+// returns the whale if the trade completes one. A trade that is a whale on
+// its own is never part of a burst.
+func (d *Detector) Check(trade pkg.CommonTrade, rate float64) (Whale, bool) {
+	threshold := d.config.Threshold(trade.Symbol)
+	if threshold <= 0 {
+		return Whale{}, false
+	}
+	side := "buy"
+	if trade.BuyerMaker {
+		side = "sell"
+	}
+	quote := trade.QuoteQuantity()
+	usd := quote * rate
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if usd >= threshold {
+		whale := Whale{
+			Symbol:    trade.Symbol,
+			Side:      side,
+			Timestamp: trade.Timestamp,
+			Price:     trade.Price,
+			Quantity:  trade.Quantity,
+			Usd:       pkg.Round3(usd),
+			Trades:    1,
+		}
+		d.add(whale)
+		return whale, true
+	}
+
+	if d.config.BurstWindow <= 0 {
+		return Whale{}, false
+	}
+	b := d.bursts[trade.Symbol]
+	if b == nil || b.side != side || trade.Timestamp.Sub(b.start) > d.config.BurstWindow {
+		b = &burst{
+			side:  side,
+			start: trade.Timestamp,
+		}
+		d.bursts[trade.Symbol] = b
+	}
+	b.last = trade.Timestamp
+	b.quantity += trade.Quantity
+	b.quote += quote
+	b.usd += usd
+	b.trades++
+	if b.usd < threshold {
+		return Whale{}, false
+	}
+	delete(d.bursts, trade.Symbol)
+	whale := Whale{
+		Symbol:    trade.Symbol,
+		Side:      side,
+		Timestamp: b.last,
+		Price:     pkg.Round8(b.quote / b.quantity),
+		Quantity:  pkg.Round8(b.quantity),
+		Usd:       pkg.Round3(b.usd),
+		Trades:    b.trades,
+		Burst:     true,
+	}
+	d.add(whale)
+	return whale, true
+}
+
+func (d *Detector) add(whale Whale) {
+	whales := append(d.whales[whale.Symbol], whale)
+	cutoff := whale.Timestamp.Add(-FlowWindows[len(FlowWindows)-1])
+	start := 0
+	for start < len(whales) && whales[start].Timestamp.Before(cutoff) {
+		start++
+	}
+	if len(whales)-start > maxWhalesPerSymbol {
+		start = len(whales) - maxWhalesPerSymbol
+	}
+	d.whales[whale.Symbol] = whales[start:]
+}
+
+// Recent returns up to limit of the most recent whales of symbol, newest
+// first. A limit of 0 returns all kept.
+func (d *Detector) Recent(symbol string, limit int) []Whale {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	whales := d.whales[symbol]
+	result := []Whale{}
+	for i := len(whales) - 1; i >= 0; i-- {
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+		result = append(result, whales[i])
+	}
+	return result
+}
+
+// Flow returns the whale flow of symbol over each of the FlowWindows
+// ending at now, keyed by the window name as in stats.WindowName. Nil is
+// returned if the symbol has had no whales in the longest window.
+func (d *Detector) Flow(symbol string, now time.Time) map[string]Flow {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return flow(d.whales[symbol], now)
+}
+
+// FlowAll returns the whale flow of every symbol with whales in the longest
+// window.
+func (d *Detector) FlowAll(now time.Time) map[string]map[string]Flow {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	result := map[string]map[string]Flow{}
+	for symbol, whales := range d.whales {
+		if flows := flow(whales, now); flows != nil {
+			result[symbol] = flows
+		}
+	}
+	return result
+}
+
+func flow(whales []Whale, now time.Time) map[string]Flow {
+	result := map[string]Flow{}
+	empty := true
+	for _, window := range FlowWindows {
+		cutoff := now.Add(-window)
+		flow := Flow{}
+		for _, whale := range whales {
+			if whale.Timestamp.Before(cutoff) {
+				continue
+			}
+			if whale.Side == "buy" {
+				flow.Buys++
+				flow.BuyUsd += whale.Usd
+			} else {
+				flow.Sells++
+				flow.SellUsd += whale.Usd
+			}
+		}
+		flow.BuyUsd = pkg.Round3(flow.BuyUsd)
+		flow.SellUsd = pkg.Round3(flow.SellUsd)
+		flow.NetUsd = pkg.Round3(flow.BuyUsd - flow.SellUsd)
+		empty = flow.Buys+flow.Sells == 0
+		result[stats.WindowName(window)] = flow
+	}
+	if empty {
+		return nil
+	}
+	return result
+}
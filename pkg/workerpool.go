@@ -0,0 +1,394 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/metrics"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	metrics.Describe("worker_pool_size",
+		"Workers of a decode or metric update pool.")
+	metrics.Describe("worker_pool_busy_microseconds_total",
+		"Time the workers of a pool spent working.")
+	metrics.Describe("worker_pool_utilization",
+		"Fraction of the last interval the workers of a pool were busy.")
+}
+
+// The maximum number of workers of a pool.
+const MaxPoolWorkers = 64
+
+// How often the utilization of the pools is updated.
+const poolUtilizationInterval = 10 * time.Second
+
+// The number of messages a decode pool may have in flight.
+const decodeQueueSize = 1024
+
+// The queue size of each worker of a sharded pool.
+const shardQueueSize = 1024
+
+// WorkerPoolStats is the size and recent utilization of a pool.
+type WorkerPoolStats struct {
+	Name        string  `json:"name"`
+	Workers     int     `json:"workers"`
+	Utilization float64 `json:"utilization"`
+}
+
+// poolUsage tracks the size and busy time of a pool.
+type poolUsage struct {
+	name    string
+	workers int64
+	busy    int64
+
+	// The busy time at the last utilization update.
+	lastBusy int64
+	lastTime time.Time
+
+	sizeGauge        *metrics.Gauge
+	busyCounter      *metrics.Counter
+	utilizationGauge *metrics.Gauge
+}
+
+var pools = struct {
+	sync.Mutex
+	usage map[string]*poolUsage
+	once  sync.Once
+}{usage: map[string]*poolUsage{}}
+
+func newPoolUsage(name string) *poolUsage {
+	labels := metrics.Labels{"pool": name}
+	usage := &poolUsage{
+		name:             name,
+		lastTime:         time.Now(),
+		sizeGauge:        metrics.GetGauge("worker_pool_size", labels),
+		busyCounter:      metrics.GetCounter("worker_pool_busy_microseconds_total", labels),
+		utilizationGauge: metrics.GetGauge("worker_pool_utilization", labels),
+	}
+	pools.Lock()
+	pools.usage[name] = usage
+	pools.Unlock()
+	pools.once.Do(func() {
+		go updatePoolUtilization()
+	})
+	return usage
+}
+
+func (u *poolUsage) setWorkers(n int) {
+	atomic.StoreInt64(&u.workers, int64(n))
+	u.sizeGauge.Set(float64(n))
+}
+
+func (u *poolUsage) addBusy(d time.Duration) {
+	atomic.AddInt64(&u.busy, int64(d))
+	u.busyCounter.Add(int64(d / time.Microsecond))
+}
+
+// update sets the utilization to the busy time since the last update over
+// the time available to the workers.
+func (u *poolUsage) update(now time.Time) {
+	busy := atomic.LoadInt64(&u.busy)
+	workers := atomic.LoadInt64(&u.workers)
+	available := float64(now.Sub(u.lastTime)) * float64(workers)
+	if available > 0 {
+		utilization := float64(busy-u.lastBusy) / available
+		if utilization > 1 {
+			utilization = 1
+		}
+		u.utilizationGauge.Set(utilization)
+	}
+	u.lastBusy = busy
+	u.lastTime = now
+}
+
+func updatePoolUtilization() {
+	for {
+		time.Sleep(poolUtilizationInterval)
+		now := time.Now()
+		pools.Lock()
+		for _, usage := range pools.usage {
+			usage.update(now)
+		}
+		pools.Unlock()
+	}
+}
+
+// WorkerPools returns the stats of all pools, by name.
+func WorkerPools() []WorkerPoolStats {
+	pools.Lock()
+	defer pools.Unlock()
+	stats := []WorkerPoolStats{}
+	for name, usage := range pools.usage {
+		stats = append(stats, WorkerPoolStats{
+			Name:        name,
+			Workers:     int(atomic.LoadInt64(&usage.workers)),
+			Utilization: usage.utilizationGauge.Value(),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
+
+func checkWorkers(n int) error {
+	if n < 1 || n > MaxPoolWorkers {
+		return fmt.Errorf("workers must be between 1 and %d", MaxPoolWorkers)
+	}
+	return nil
+}
+
+// DecodeResult is a decoded message.
+type DecodeResult struct {
+	Body  []byte
+	Value interface{}
+	Err   error
+}
+
+type decodeJob struct {
+	body   []byte
+	decode func([]byte) (interface{}, error)
+	result chan DecodeResult
+}
+
+// DecodePool decodes the raw messages of a stream on a number of workers,
+// delivering the results in the order the messages arrived. The number of
+// workers can be changed while running.
+type DecodePool struct {
+	*poolUsage
+	jobs  chan *decodeJob
+	stops []chan struct{}
+	lock  sync.Mutex
+}
+
+func NewDecodePool(name string) *DecodePool {
+	pool := &DecodePool{
+		poolUsage: newPoolUsage(name),
+		jobs:      make(chan *decodeJob),
+	}
+	pool.SetWorkers(1)
+	return pool
+}
+
+// Name returns the name of the pool.
+func (p *DecodePool) Name() string {
+	return p.name
+}
+
+// Workers returns the number of workers.
+func (p *DecodePool) Workers() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.stops)
+}
+
+// SetWorkers starts or stops workers to have n.
+func (p *DecodePool) SetWorkers(n int) error {
+	if err := checkWorkers(n); err != nil {
+		return err
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for len(p.stops) < n {
+		stop := make(chan struct{})
+		p.stops = append(p.stops, stop)
+		go p.work(stop)
+	}
+	for len(p.stops) > n {
+		close(p.stops[len(p.stops)-1])
+		p.stops = p.stops[:len(p.stops)-1]
+	}
+	p.setWorkers(n)
+	return nil
+}
+
+func (p *DecodePool) work(stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case job := <-p.jobs:
+			start := time.Now()
+			value, err := job.decode(job.body)
+			p.addBusy(time.Since(start))
+			job.result <- DecodeResult{Body: job.body, Value: value, Err: err}
+		}
+	}
+}
+
+// Run decodes the messages from in with decode, sending the results to out
+// in order, until ctx is cancelled.
+func (p *DecodePool) Run(ctx context.Context, in <-chan []byte, out chan<- DecodeResult,
+	decode func([]byte) (interface{}, error)) {
+	pending := make(chan chan DecodeResult, decodeQueueSize)
+	go func() {
+		for result := range pending {
+			select {
+			case out <- <-result:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	defer close(pending)
+
+	for {
+		var body []byte
+		select {
+		case body = <-in:
+		case <-ctx.Done():
+			return
+		}
+		job := &decodeJob{
+			body:   body,
+			decode: decode,
+			result: make(chan DecodeResult, 1),
+		}
+		select {
+		case pending <- job.result:
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case p.jobs <- job:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ShardedPool runs tasks on a number of workers, with the tasks of a key
+// always run in order on the same worker. The number of workers can be
+// changed while running.
+type ShardedPool struct {
+	*poolUsage
+	queues []chan func()
+	lock   sync.RWMutex
+}
+
+func NewShardedPool(name string) *ShardedPool {
+	pool := &ShardedPool{
+		poolUsage: newPoolUsage(name),
+	}
+	pool.SetWorkers(1)
+	return pool
+}
+
+// Name returns the name of the pool.
+func (p *ShardedPool) Name() string {
+	return p.name
+}
+
+// Workers returns the number of workers.
+func (p *ShardedPool) Workers() int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return len(p.queues)
+}
+
+// SetWorkers waits for the queued tasks to finish then replaces the workers
+// with n new ones, so the tasks of a key are never run concurrently.
+func (p *ShardedPool) SetWorkers(n int) error {
+	if err := checkWorkers(n); err != nil {
+		return err
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.flush()
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.queues = make([]chan func(), n)
+	for i := range p.queues {
+		p.queues[i] = make(chan func(), shardQueueSize)
+		go p.work(p.queues[i])
+	}
+	p.setWorkers(n)
+	return nil
+}
+
+func (p *ShardedPool) work(queue chan func()) {
+	for task := range queue {
+		start := time.Now()
+		task()
+		p.addBusy(time.Since(start))
+	}
+}
+
+// Submit queues task on the worker of key.
+func (p *ShardedPool) Submit(key string, task func()) {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	p.queues[hash.Sum32()%uint32(len(p.queues))] <- task
+}
+
+// Flush waits for all submitted tasks to finish.
+func (p *ShardedPool) Flush() {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	p.flush()
+}
+
+// flush waits for the tasks queued on each worker. Must be called with the
+// lock held.
+func (p *ShardedPool) flush() {
+	var wg sync.WaitGroup
+	for _, queue := range p.queues {
+		wg.Add(1)
+		queue <- wg.Done
+	}
+	wg.Wait()
+}
+
+// WorkersConfig sizes the worker pools of an exchange.
+type WorkersConfig struct {
+	// Workers decoding the raw messages of the trade stream.
+	Decode int `mapstructure:"decode" json:"decode,omitempty"`
+
+	// Workers applying trades to the ticker metrics, sharded by symbol.
+	Metrics int `mapstructure:"metrics" json:"metrics,omitempty"`
+}
+
+// Override returns c with the sizes that are set in override replaced.
+func (c WorkersConfig) Override(override WorkersConfig) WorkersConfig {
+	if override.Decode != 0 {
+		c.Decode = override.Decode
+	}
+	if override.Metrics != 0 {
+		c.Metrics = override.Metrics
+	}
+	return c
+}
+
+// Validate checks the sizes that are set.
+func (c WorkersConfig) Validate() error {
+	for _, n := range []int{c.Decode, c.Metrics} {
+		if n != 0 {
+			if err := checkWorkers(n); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/alerts"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/events"
+	"net/http"
+	"time"
+)
+
+type AlertsApi struct {
+	engine *alerts.Engine
+	events *events.Store
+}
+
+func NewAlertsApi(engine *alerts.Engine, store *events.Store) *AlertsApi {
+	return &AlertsApi{
+		engine: engine,
+		events: store,
+	}
+}
+
+func (a *AlertsApi) Register(router *mux.Router) {
+	router.HandleFunc("/api/1/alerts/rules", a.getRules).Methods("GET")
+	router.HandleFunc("/api/1/alerts/recent", a.getRecent).Methods("GET")
+}
+
+func (a *AlertsApi) getRules(w http.ResponseWriter, r *http.Request) {
+	writeJsonResponse(w, http.StatusOK, a.engine.Config().Rules)
+}
+
+// getRecent returns the alerts fired since the given time, defaulting to the
+// last hour.
+func (a *AlertsApi) getRecent(w http.ResponseWriter, r *http.Request) {
+	since, err := parseTimeParam(r.FormValue("since"), time.Now().Add(-time.Hour))
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	fired := []events.Event{}
+	for _, event := range a.events.Since(r.FormValue("exchange"), since) {
+		if event.Type == events.TypeAlert {
+			fired = append(fired, event)
+		}
+	}
+	writeJsonResponse(w, http.StatusOK, fired)
+}
@@ -0,0 +1,76 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MetricAuditApi serves the calculation of a metric of a symbol, with the
+// window contents and intermediate values, to check surprising values of
+// the ticker updates. Served on the debug server only, as the windows can
+// be large.
+//
+// GET /debug/metrics/audit?exchange=binance&symbol=ETHBTC&metric=price_change_pct&window=5m
+type MetricAuditApi struct {
+	feeds map[string]*ExchangeRunner
+}
+
+func NewMetricAuditApi(feeds map[string]*ExchangeRunner) *MetricAuditApi {
+	return &MetricAuditApi{
+		feeds: feeds,
+	}
+}
+
+func (a *MetricAuditApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	feed := a.feeds[r.FormValue("exchange")]
+	if feed == nil {
+		writeJsonError(w, http.StatusNotFound, "unknown exchange")
+		return
+	}
+	symbol := strings.ToUpper(r.FormValue("symbol"))
+	if symbol == "" {
+		writeJsonError(w, http.StatusBadRequest, "symbol is required")
+		return
+	}
+	metric := r.FormValue("metric")
+	if metric == "" {
+		writeJsonResponse(w, http.StatusBadRequest, map[string]interface{}{
+			"error":   "metric is required",
+			"metrics": pkg.AuditMetrics(),
+			"windows": pkg.Buckets,
+		})
+		return
+	}
+	window, err := time.ParseDuration(r.FormValue("window"))
+	if err != nil || window <= 0 || window%time.Minute != 0 {
+		writeJsonError(w, http.StatusBadRequest, "invalid window, expected minutes such as 5m")
+		return
+	}
+	audit, err := feed.AuditMetric(r.Context(), symbol, metric, int(window/time.Minute))
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, audit)
+}
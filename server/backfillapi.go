@@ -0,0 +1,131 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/backfill"
+	"net/http"
+	"time"
+)
+
+// BackfillApi schedules backfill jobs for a symbol and range, and serves
+// their status for polling. Jobs are only available with a database.
+type BackfillApi struct {
+	scheduler *backfill.Scheduler
+}
+
+func NewBackfillApi(scheduler *backfill.Scheduler) *BackfillApi {
+	return &BackfillApi{
+		scheduler: scheduler,
+	}
+}
+
+func (a *BackfillApi) Register(router *mux.Router) {
+	router.HandleFunc("/api/1/backfill", a.getAll).Methods("GET")
+	router.HandleFunc("/api/1/backfill", a.submit).Methods("POST")
+	router.HandleFunc("/api/1/backfill/{id}", a.get).Methods("GET")
+	router.HandleFunc("/api/1/backfill/{id}", a.cancel).Methods("DELETE")
+}
+
+// backfillRequest is a backfill.Request with the range as Unix milliseconds
+// or RFC3339.
+type backfillRequest struct {
+	Exchange string `json:"exchange"`
+	Symbol   string `json:"symbol"`
+	Kind     string `json:"kind"`
+	Interval string `json:"interval"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+}
+
+func (a *BackfillApi) enabled(w http.ResponseWriter) bool {
+	if a.scheduler == nil {
+		writeJsonError(w, http.StatusServiceUnavailable, "backfill requires a database")
+		return false
+	}
+	return true
+}
+
+func (a *BackfillApi) getAll(w http.ResponseWriter, r *http.Request) {
+	if !a.enabled(w) {
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, a.scheduler.Jobs())
+}
+
+// submit queues a job, responding with its status. The status URL is in
+// the location header.
+func (a *BackfillApi) submit(w http.ResponseWriter, r *http.Request) {
+	if !a.enabled(w) {
+		return
+	}
+	var body backfillRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	from, err := parseTimeParam(body.From, time.Time{})
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	to, err := parseTimeParam(body.To, time.Now())
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	job, err := a.scheduler.Submit(backfill.Request{
+		Exchange: body.Exchange,
+		Symbol:   body.Symbol,
+		Kind:     body.Kind,
+		Interval: body.Interval,
+		From:     from,
+		To:       to,
+	})
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.Header().Set("Location", "/api/1/backfill/"+job.Id)
+	writeJsonResponse(w, http.StatusAccepted, job)
+}
+
+func (a *BackfillApi) get(w http.ResponseWriter, r *http.Request) {
+	if !a.enabled(w) {
+		return
+	}
+	job, ok := a.scheduler.Job(mux.Vars(r)["id"])
+	if !ok {
+		writeJsonError(w, http.StatusNotFound, "unknown job")
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, job)
+}
+
+// cancel cancels a queued or running job, rows already written are kept.
+func (a *BackfillApi) cancel(w http.ResponseWriter, r *http.Request) {
+	if !a.enabled(w) {
+		return
+	}
+	job, err := a.scheduler.Cancel(mux.Vars(r)["id"])
+	if err != nil {
+		writeJsonError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, job)
+}
@@ -0,0 +1,200 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/candles"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type CandlesApi struct {
+	feeds    map[string]*ExchangeRunner
+	upgrader websocket.Upgrader
+}
+
+func NewCandlesApi(feeds map[string]*ExchangeRunner) *CandlesApi {
+	return &CandlesApi{
+		feeds: feeds,
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+			EnableCompression: true,
+			Subprotocols:      webSocketSubprotocols,
+		},
+	}
+}
+
+func (a *CandlesApi) Register(router *mux.Router) {
+	router.HandleFunc("/api/1/{exchange}/candles/{symbol}", a.getCandles).Methods("GET")
+	router.HandleFunc("/api/1/{exchange}/indicators/{symbol}", a.getIndicators).Methods("GET")
+	router.HandleFunc("/ws/{exchange}/candles", a.handleWebSocket)
+}
+
+type candleResponse struct {
+	candles.Candle
+	Interval string `json:"interval"`
+}
+
+func newCandleResponse(candle candles.Candle) candleResponse {
+	return candleResponse{
+		Candle:   candle,
+		Interval: candles.FormatInterval(candle.Interval),
+	}
+}
+
+// parseCandleRequest returns the feed and interval for a request, writing an
+// error response if either is invalid.
+func (a *CandlesApi) parseCandleRequest(w http.ResponseWriter, r *http.Request) (*ExchangeRunner, time.Duration, bool) {
+	feed := a.feeds[mux.Vars(r)["exchange"]]
+	if feed == nil {
+		writeJsonError(w, http.StatusNotFound, "unknown exchange")
+		return nil, 0, false
+	}
+	interval, ok := candleIntervalParam(feed, r)
+	if !ok {
+		writeJsonError(w, http.StatusBadRequest, "unsupported interval")
+		return nil, 0, false
+	}
+	return feed, interval, true
+}
+
+// candleIntervalParam returns the interval requested, defaulting to 1m, and
+// false if the feed does not build candles at that interval.
+func candleIntervalParam(feed *ExchangeRunner, r *http.Request) (time.Duration, bool) {
+	value := r.FormValue("interval")
+	if value == "" {
+		value = "1m"
+	}
+	interval, err := candles.ParseInterval(value)
+	if err != nil || !feed.Candles().HasInterval(interval) {
+		return 0, false
+	}
+	return interval, true
+}
+
+func (a *CandlesApi) getCandles(w http.ResponseWriter, r *http.Request) {
+	feed, interval, ok := a.parseCandleRequest(w, r)
+	if !ok {
+		return
+	}
+	limit := 0
+	if value := r.FormValue("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			writeJsonError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+	symbol, ok := symbolParam(w, r, feed)
+	if !ok {
+		return
+	}
+	response := []candleResponse{}
+	for _, candle := range feed.Candles().Get(symbol, interval, limit) {
+		response = append(response, newCandleResponse(candle))
+	}
+	writeJsonResponse(w, http.StatusOK, response)
+}
+
+// getIndicators returns the indicators of a symbol for all intervals.
+func (a *CandlesApi) getIndicators(w http.ResponseWriter, r *http.Request) {
+	feed := a.feeds[mux.Vars(r)["exchange"]]
+	if feed == nil {
+		writeJsonError(w, http.StatusNotFound, "unknown exchange")
+		return
+	}
+	symbol, ok := symbolParam(w, r, feed)
+	if !ok {
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, feed.Indicators().Snapshot(symbol))
+}
+
+// handleWebSocket streams candle updates for a single symbol and interval.
+func (a *CandlesApi) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	symbol := strings.ToUpper(r.FormValue("symbol"))
+	if symbol == "" {
+		http.Error(w, "symbol required", http.StatusBadRequest)
+		return
+	}
+	feed, interval, ok := a.parseCandleRequest(w, r)
+	if !ok {
+		return
+	}
+	if feed.IsHidden(symbol) {
+		http.Error(w, "unknown symbol", http.StatusNotFound)
+		return
+	}
+
+	if !checkEncodingParam(w, r) {
+		return
+	}
+
+	release, ok := floodGuard.Admit(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	conn, err := a.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Failed to upgrade websocket connection: %v\n", err)
+		return
+	}
+	floodGuard.Configure(conn)
+	client := NewWebSocketClient(conn, r)
+	defer client.Close()
+
+	wsConnectionTracker.Add(r.URL.String(), client)
+	defer wsConnectionTracker.Del(r.URL.String(), client)
+
+	channel := feed.Candles().Subscribe(symbol, interval)
+	defer feed.Candles().Unsubscribe(symbol, interval, channel)
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				floodGuard.CheckReadError(err)
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		case candle, ok := <-channel:
+			if !ok {
+				return
+			}
+			if err := writeMessage(client, newCandleResponse(candle)); err != nil {
+				log.Printf("error: websocket write error to %s: %v\n",
+					client.GetRemoteAddr(), err)
+				return
+			}
+		}
+	}
+}
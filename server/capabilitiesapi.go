@@ -0,0 +1,211 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/alerts"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/auth"
+	"net/http"
+	"sort"
+)
+
+// CapabilitiesApi describes the subsystems enabled in this deployment and
+// their limits, so clients can adapt to the configuration of the server.
+type CapabilitiesApi struct {
+	options       Options
+	feeds         map[string]*ExchangeRunner
+	alertEngine   *alerts.Engine
+	authenticator *auth.Authenticator
+}
+
+func NewCapabilitiesApi(options Options, feeds map[string]*ExchangeRunner,
+	alertEngine *alerts.Engine, authenticator *auth.Authenticator) *CapabilitiesApi {
+	return &CapabilitiesApi{
+		options:       options,
+		feeds:         feeds,
+		alertEngine:   alertEngine,
+		authenticator: authenticator,
+	}
+}
+
+func (a *CapabilitiesApi) Register(router *mux.Router) {
+	router.HandleFunc("/api/1/capabilities", a.getCapabilities).Methods("GET")
+}
+
+type Capabilities struct {
+	Version int    `json:"version"`
+	Mode    string `json:"mode"`
+
+	// True if the exchanges are replayed from recorded trades.
+	Replay bool `json:"replay"`
+
+	Exchanges []ExchangeCapabilities `json:"exchanges"`
+
+	// The optional subsystems by name, and whether they are enabled.
+	Features map[string]bool `json:"features"`
+
+	Alerts      AlertCapabilities       `json:"alerts"`
+	Persistence PersistenceCapabilities `json:"persistence"`
+	Limits      LimitCapabilities       `json:"limits"`
+}
+
+type ExchangeCapabilities struct {
+	Name       string `json:"name"`
+	Futures    bool   `json:"futures"`
+	Depth      bool   `json:"depth"`
+	Indicators bool   `json:"indicators"`
+	Symbols    int    `json:"symbols"`
+}
+
+type AlertCapabilities struct {
+	// True if an alert rules file is configured.
+	Enabled        bool `json:"enabled"`
+	DryRun         bool `json:"dry_run"`
+	Rules          int  `json:"rules"`
+	Webhooks       int  `json:"webhooks"`
+	Notifiers      int  `json:"notifiers"`
+	MetricWebhooks int  `json:"metric_webhooks"`
+}
+
+type PersistenceCapabilities struct {
+	// The backend of the exchange stream caches, redis or memory.
+	Cache                 string `json:"cache"`
+	CacheRetentionSeconds int64  `json:"cache_retention_seconds"`
+
+	Journal               bool `json:"journal"`
+	JournalRetentionHours int  `json:"journal_retention_hours,omitempty"`
+
+	// The database driver, empty if there is no database.
+	Database string `json:"database,omitempty"`
+	Archive  bool   `json:"archive"`
+	Record   bool   `json:"record"`
+
+	EventRetentionSeconds int64 `json:"event_retention_seconds"`
+}
+
+// LimitCapabilities are the limits clients are held to. A limit of 0 is
+// no limit.
+type LimitCapabilities struct {
+	WebSocketQueueSize        int    `json:"websocket_queue_size"`
+	WebSocketSlowConsumer     string `json:"websocket_slow_consumer"`
+	MaxConnectionsPerIP       int    `json:"max_connections_per_ip"`
+	MaxSubscriptionsPerMinute int    `json:"max_subscriptions_per_minute"`
+	MaxMessageSize            int64  `json:"max_message_size"`
+	MaxMetricsLimit           int    `json:"max_metrics_limit"`
+	TapeSize                  int    `json:"tape_size"`
+	BackfillHours             int    `json:"backfill_hours"`
+}
+
+func (a *CapabilitiesApi) getCapabilities(w http.ResponseWriter, r *http.Request) {
+	writeJsonResponse(w, http.StatusOK, a.Capabilities())
+}
+
+// Capabilities returns the capabilities as currently configured. The alert
+// counts follow reloads of the rules file.
+func (a *CapabilitiesApi) Capabilities() Capabilities {
+	options := a.options
+	live := options.Replay == ""
+	capabilities := Capabilities{
+		Version:   PROTO_VERSION,
+		Mode:      options.Mode,
+		Replay:    !live,
+		Exchanges: []ExchangeCapabilities{},
+	}
+	if capabilities.Mode == "" {
+		capabilities.Mode = ModeFull
+	}
+
+	names := []string{}
+	for name := range a.feeds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	futures := false
+	depth := false
+	for _, name := range names {
+		feed := a.feeds[name]
+		_, isFutures := feed.Exchange().(pkg.FuturesExchange)
+		exchange := ExchangeCapabilities{
+			Name:       name,
+			Futures:    isFutures,
+			Depth:      feed.DepthStream() != nil,
+			Indicators: !options.Lite(),
+			Symbols:    len(feed.Symbols()),
+		}
+		futures = futures || exchange.Futures
+		depth = depth || exchange.Depth
+		capabilities.Exchanges = append(capabilities.Exchanges, exchange)
+	}
+
+	alertsConfig := a.alertEngine.Config()
+	capabilities.Alerts = AlertCapabilities{
+		Enabled:        options.AlertsConfig != "",
+		DryRun:         a.alertEngine.DryRun(),
+		Rules:          len(alertsConfig.Rules),
+		Webhooks:       len(alertsConfig.Webhooks),
+		Notifiers:      len(alertsConfig.Notifiers),
+		MetricWebhooks: len(options.MetricWebhooks),
+	}
+	if !live {
+		capabilities.Alerts.MetricWebhooks = 0
+	}
+
+	capabilities.Persistence = PersistenceCapabilities{
+		Cache:                 options.Cache.Backend,
+		CacheRetentionSeconds: int64(options.Redis.Retention.Seconds()),
+		Journal:               live && options.Journal,
+		Archive:               options.Archive.Enabled(),
+		Record:                options.Record,
+		EventRetentionSeconds: int64(options.EventRetention.Seconds()),
+	}
+	if capabilities.Persistence.Journal {
+		capabilities.Persistence.JournalRetentionHours = options.JournalRetentionHours
+	}
+	if options.DatabaseDSN != "" {
+		capabilities.Persistence.Database = options.DatabaseDriver
+	}
+
+	capabilities.Limits = LimitCapabilities{
+		WebSocketQueueSize:        options.WebSocketQueueSize,
+		WebSocketSlowConsumer:     options.WebSocketSlowConsumer,
+		MaxConnectionsPerIP:       options.FloodGuard.MaxConnectionsPerIP,
+		MaxSubscriptionsPerMinute: options.FloodGuard.MaxSubscriptionsPerMinute,
+		MaxMessageSize:            options.FloodGuard.MaxMessageSize,
+		MaxMetricsLimit:           maxMetricsLimit,
+		TapeSize:                  options.Tape.Size,
+		BackfillHours:             options.BackfillHours,
+	}
+
+	capabilities.Features = map[string]bool{
+		"futures":       futures,
+		"depth":         depth,
+		"indicators":    !options.Lite(),
+		"alerts":        capabilities.Alerts.Enabled,
+		"persistence":   capabilities.Persistence.Journal || capabilities.Persistence.Database != "",
+		"publish":       options.Publish.Enabled(),
+		"spread":        options.Spread.Enabled(),
+		"volume_share":  options.VolumeShare.Enabled(),
+		"tape":          options.Tape.Enabled(),
+		"assets":        options.Assets.Enabled(),
+		"fix":           options.FixListen != "",
+		"client_memory": options.ClientMemoryTTL > 0,
+		"billing":       options.Billing.Enabled,
+		"auth":          a.authenticator.Enabled(),
+	}
+	return capabilities
+}
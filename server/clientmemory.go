@@ -0,0 +1,219 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/auth"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// The maximum number of clients remembered. The least recently seen client
+// is forgotten to make room for a new one.
+const maxRememberedClients = 10000
+
+// How often changes are written to disk.
+const clientMemorySaveInterval = 10 * time.Second
+
+// Client IDs are chosen by the client, such as a random UUID stored by a
+// dashboard.
+var clientIdPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{8,64}$`)
+
+// The remembered subscriptions, nil if disabled. Set in ServerMain.
+var clientMemory *ClientMemory
+
+type rememberedClient struct {
+	// Topics keyed by exchange.
+	Topics   map[string][]string `json:"topics"`
+	LastSeen time.Time           `json:"last_seen"`
+}
+
+// ClientMemory remembers the topic subscriptions of clients that connect
+// with a client_id, and restores them when the client reconnects. Clients
+// not seen for the TTL are forgotten. The subscriptions are persisted so
+// they survive a restart.
+type ClientMemory struct {
+	filename string
+	ttl      time.Duration
+	clients  map[string]*rememberedClient
+	dirty    bool
+	lock     sync.Mutex
+}
+
+// NewClientMemory loads the remembered clients from filename, if it
+// exists.
+func NewClientMemory(filename string, ttl time.Duration) (*ClientMemory, error) {
+	m := &ClientMemory{
+		filename: filename,
+		ttl:      ttl,
+		clients:  map[string]*rememberedClient{},
+	}
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &m.clients); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	m.expire(time.Now())
+	return m, nil
+}
+
+// clientMemoryKey returns the key the subscriptions of the request are
+// remembered under, or an empty string if no client ID was given. Client
+// IDs of authenticated requests are scoped to the identity so they can't be
+// used to see the subscriptions of another user.
+func clientMemoryKey(r *http.Request) (string, error) {
+	clientId := r.FormValue("client_id")
+	if clientId == "" {
+		return "", nil
+	}
+	if !clientIdPattern.MatchString(clientId) {
+		return "", fmt.Errorf("invalid client_id, must be 8 to 64 letters, digits, '.', '_' or '-'")
+	}
+	if identity := auth.GetIdentity(r); identity != nil {
+		return identity.Account + "/" + clientId, nil
+	}
+	return clientId, nil
+}
+
+// Topics returns the remembered topics of a client on exchange, marking
+// the client as seen.
+func (m *ClientMemory) Topics(key string, exchange string) []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	client := m.clients[key]
+	if client == nil {
+		return nil
+	}
+	client.LastSeen = time.Now()
+	m.dirty = true
+	return client.Topics[exchange]
+}
+
+// Remember replaces the remembered topics of a client on exchange.
+func (m *ClientMemory) Remember(key string, exchange string, topics []string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	client := m.clients[key]
+	if client == nil {
+		if len(m.clients) >= maxRememberedClients {
+			m.forgetOldest()
+		}
+		client = &rememberedClient{
+			Topics: map[string][]string{},
+		}
+		m.clients[key] = client
+	}
+	if len(topics) == 0 {
+		delete(client.Topics, exchange)
+	} else {
+		client.Topics[exchange] = topics
+	}
+	client.LastSeen = time.Now()
+	m.dirty = true
+}
+
+// forgetOldest must be called with the lock held.
+func (m *ClientMemory) forgetOldest() {
+	oldestKey := ""
+	oldest := time.Time{}
+	for key, client := range m.clients {
+		if oldestKey == "" || client.LastSeen.Before(oldest) {
+			oldestKey = key
+			oldest = client.LastSeen
+		}
+	}
+	delete(m.clients, oldestKey)
+}
+
+// expire must be called with the lock held, or before the memory is
+// shared.
+func (m *ClientMemory) expire(now time.Time) {
+	for key, client := range m.clients {
+		if now.Sub(client.LastSeen) > m.ttl {
+			delete(m.clients, key)
+			m.dirty = true
+		}
+	}
+}
+
+// Run expires clients and writes changes to disk until ctx is cancelled.
+// Save must be called on shutdown for the last changes.
+func (m *ClientMemory) Run(ctx context.Context) {
+	ticker := time.NewTicker(clientMemorySaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.lock.Lock()
+			m.expire(time.Now())
+			m.lock.Unlock()
+			if err := m.Save(); err != nil {
+				log.Printf("error: failed to save client subscriptions: %v\n", err)
+			}
+		}
+	}
+}
+
+// Save writes the remembered clients to disk if they have changed.
+func (m *ClientMemory) Save() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.dirty {
+		return nil
+	}
+	buf, err := json.Marshal(m.clients)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.filename), 0755); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(m.filename), ".clients-")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(buf); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	if err := os.Rename(file.Name(), m.filename); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	m.dirty = false
+	return nil
+}
@@ -0,0 +1,156 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"github.com/gorilla/websocket"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/depth"
+	"net/http"
+)
+
+const (
+	// Number of levels per side sent to depth clients.
+	depthClientLevels = 20
+
+	// Send a checksum frame after this many delta frames.
+	depthChecksumInterval = 10
+
+	// A level is considered a wall if its quote volume is this many times
+	// the average of the levels sent.
+	depthWallFactor = 5
+)
+
+type depthClientMessage struct {
+	Type string `json:"type"`
+}
+
+type depthMetricsFrame struct {
+	Type    string            `json:"type"`
+	Metrics depth.BookMetrics `json:"metrics"`
+}
+
+// DepthWebSocketHandler streams an order book for a single symbol to each
+// client as a snapshot followed by deltas, with periodic checksums and book
+// metrics. A client that detects a checksum mismatch can send
+// {"type": "snapshot"} to receive a new snapshot.
+type DepthWebSocketHandler struct {
+	upgrader websocket.Upgrader
+	feed     *ExchangeRunner
+	stream   pkg.DepthStream
+}
+
+func NewDepthWebSocketHandler(feed *ExchangeRunner) *DepthWebSocketHandler {
+	return &DepthWebSocketHandler{
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+			EnableCompression: true,
+			Subprotocols:      webSocketSubprotocols,
+		},
+		feed:   feed,
+		stream: feed.DepthStream(),
+	}
+}
+
+func (h *DepthWebSocketHandler) Handle(w http.ResponseWriter, r *http.Request) {
+	symbol := r.FormValue("symbol")
+	if symbol == "" {
+		http.Error(w, "symbol required", http.StatusBadRequest)
+		return
+	}
+	if h.feed.IsHidden(symbol) {
+		http.Error(w, "unknown symbol", http.StatusNotFound)
+		return
+	}
+
+	if !checkEncodingParam(w, r) {
+		return
+	}
+
+	release, ok := floodGuard.Admit(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Failed to upgrade websocket connection: %v\n", err)
+		return
+	}
+	floodGuard.Configure(conn)
+	client := NewWebSocketClient(conn, r)
+	defer client.Close()
+
+	wsConnectionTracker.Add(r.URL.String(), client)
+	defer wsConnectionTracker.Del(r.URL.String(), client)
+
+	channel := h.stream.Subscribe(symbol)
+	defer h.stream.Unsubscribe(symbol, channel)
+
+	snapshotRequests := make(chan bool, 1)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for {
+			var message depthClientMessage
+			if err := conn.ReadJSON(&message); err != nil {
+				floodGuard.CheckReadError(err)
+				return
+			}
+			if message.Type == depth.FrameTypeSnapshot {
+				select {
+				case snapshotRequests <- true:
+				default:
+				}
+			}
+		}
+	}()
+
+	encoder := depth.NewDeltaEncoder(depthClientLevels, depthChecksumInterval)
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-snapshotRequests:
+			encoder.RequestSnapshot(symbol)
+		case book, ok := <-channel:
+			if !ok {
+				return
+			}
+			for _, frame := range encoder.Encode(book) {
+				if err := writeMessage(client, frame); err != nil {
+					log.Printf("error: websocket write error to %s: %v\n",
+						client.GetRemoteAddr(), err)
+					return
+				}
+			}
+			metrics := depthMetricsFrame{
+				Type:    "metrics",
+				Metrics: depth.CalculateMetrics(book, depthClientLevels, depthWallFactor),
+			}
+			if err := writeMessage(client, metrics); err != nil {
+				log.Printf("error: websocket write error to %s: %v\n",
+					client.GetRemoteAddr(), err)
+				return
+			}
+		}
+	}
+}
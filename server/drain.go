@@ -0,0 +1,132 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The notice sent to every websocket client when the server starts
+// draining before a planned shutdown. Clients should reconnect after
+// retry_after seconds, spread with some jitter, rather than as soon as
+// they are disconnected.
+type drainNotice struct {
+	Type       string `json:"type"`
+	Reason     string `json:"reason"`
+	RetryAfter int    `json:"retry_after"`
+}
+
+// DrainState is set once the server is draining. While draining, new
+// websocket connections and topic subscriptions are refused with the retry
+// after hint, and existing connections are closed once the drain period
+// ends.
+type DrainState struct {
+	draining   bool
+	retryAfter time.Duration
+	lock       sync.RWMutex
+}
+
+var drainState = &DrainState{}
+
+// Draining returns true and the retry after hint if the server is
+// draining.
+func (d *DrainState) Draining() (bool, time.Duration) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.draining, d.retryAfter
+}
+
+// Reject responds with 503 and a Retry-After header if the server is
+// draining, returning true if it did.
+func (d *DrainState) Reject(w http.ResponseWriter) bool {
+	draining, retryAfter := d.Draining()
+	if !draining {
+		return false
+	}
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", retrySeconds(retryAfter)))
+	http.Error(w, "server is restarting", http.StatusServiceUnavailable)
+	return true
+}
+
+// Start marks the server as draining and sends the drain notice to every
+// connected websocket client.
+func (d *DrainState) Start(reason string, retryAfter time.Duration) {
+	d.lock.Lock()
+	d.draining = true
+	d.retryAfter = retryAfter
+	d.lock.Unlock()
+
+	notice := drainNotice{
+		Type:       "drain",
+		Reason:     reason,
+		RetryAfter: retrySeconds(retryAfter),
+	}
+
+	wsConnectionTracker.Lock.RLock()
+	clients := make([]*WebSocketClient, 0, len(wsConnectionTracker.Clients))
+	for client := range wsConnectionTracker.Clients {
+		clients = append(clients, client)
+	}
+	wsConnectionTracker.Lock.RUnlock()
+
+	// Clients that are blocked are not waited for, they are closed at the
+	// end of the drain anyway.
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		wg := sync.WaitGroup{}
+		for _, client := range clients {
+			wg.Add(1)
+			go func(client *WebSocketClient) {
+				defer wg.Done()
+				sendDrainNotice(client, notice)
+			}(client)
+		}
+		wg.Wait()
+	}()
+	select {
+	case <-sent:
+	case <-time.After(drainNoticeTimeout):
+	}
+	log.Printf("Sent drain notice to %d websocket clients, retry after %v.\n",
+		len(clients), retryAfter)
+}
+
+// The time allowed for writing the drain notice to a client.
+const drainNoticeTimeout = time.Second
+
+func sendDrainNotice(client *WebSocketClient, notice drainNotice) {
+	buf, err := json.Marshal(&notice)
+	if err != nil {
+		return
+	}
+	client.writeLock.Lock()
+	defer client.writeLock.Unlock()
+	client.conn.SetWriteDeadline(time.Now().Add(drainNoticeTimeout))
+	client.conn.WriteMessage(websocket.TextMessage, buf)
+	client.conn.SetWriteDeadline(time.Time{})
+}
+
+// retrySeconds rounds up so clients never retry early.
+func retrySeconds(duration time.Duration) int {
+	return int((duration + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,126 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/msgpack"
+	"net/http"
+)
+
+// Encodings of messages sent to websocket clients. Clients request an
+// encoding with the encoding query parameter, or by offering it as a
+// websocket subprotocol. JSON is sent in text frames, MessagePack in binary
+// frames. The frames are described in docs/websocket-encoding.md.
+const (
+	EncodingJson    = "json"
+	EncodingMsgpack = "msgpack"
+)
+
+// The subprotocols accepted by the websocket upgraders, in order of
+// preference.
+var webSocketSubprotocols = []string{EncodingJson, EncodingMsgpack}
+
+func isEncoding(encoding string) bool {
+	return encoding == EncodingJson || encoding == EncodingMsgpack
+}
+
+// checkEncodingParam validates the encoding query parameter, writing an
+// error response if it is not supported. Called before upgrading.
+func checkEncodingParam(w http.ResponseWriter, r *http.Request) bool {
+	encoding := r.FormValue("encoding")
+	if encoding != "" && !isEncoding(encoding) {
+		http.Error(w, fmt.Sprintf("unsupported encoding: %s", encoding),
+			http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// connEncoding returns the encoding for an upgraded connection, the
+// encoding query parameter taking precedence over the negotiated
+// subprotocol.
+func connEncoding(conn *websocket.Conn, r *http.Request) string {
+	if encoding := r.FormValue("encoding"); isEncoding(encoding) {
+		return encoding
+	}
+	if encoding := conn.Subprotocol(); isEncoding(encoding) {
+		return encoding
+	}
+	return EncodingJson
+}
+
+// encodeMessage encodes v, returning the websocket message type to send it
+// as.
+func encodeMessage(encoding string, v interface{}) (int, []byte, error) {
+	if encoding == EncodingMsgpack {
+		buf, err := msgpack.Marshal(v)
+		return websocket.BinaryMessage, buf, err
+	}
+	buf, err := json.Marshal(v)
+	return websocket.TextMessage, buf, err
+}
+
+func prepareMessage(encoding string, v interface{}) (*websocket.PreparedMessage, error) {
+	messageType, buf, err := encodeMessage(encoding, v)
+	if err != nil {
+		return nil, err
+	}
+	return websocket.NewPreparedMessage(messageType, buf)
+}
+
+// preparedMessages prepares a message broadcast to many clients once for
+// each encoding it is sent in, and only if a client uses that encoding.
+type preparedMessages struct {
+	value    interface{}
+	messages map[string]*websocket.PreparedMessage
+	errors   map[string]error
+}
+
+func newPreparedMessages(v interface{}) *preparedMessages {
+	return &preparedMessages{
+		value:    v,
+		messages: map[string]*websocket.PreparedMessage{},
+		errors:   map[string]error{},
+	}
+}
+
+func (p *preparedMessages) get(encoding string) (*websocket.PreparedMessage, error) {
+	if message := p.messages[encoding]; message != nil {
+		return message, nil
+	}
+	if err := p.errors[encoding]; err != nil {
+		return nil, err
+	}
+	message, err := prepareMessage(encoding, p.value)
+	if err != nil {
+		p.errors[encoding] = err
+		return nil, err
+	}
+	p.messages[encoding] = message
+	return message, nil
+}
+
+// writeMessage encodes v in the client's encoding and writes it.
+func writeMessage(client *WebSocketClient, v interface{}) error {
+	messageType, buf, err := encodeMessage(client.encoding, v)
+	if err != nil {
+		return err
+	}
+	return client.WriteMessage(messageType, buf)
+}
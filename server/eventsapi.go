@@ -0,0 +1,139 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/candles"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/events"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The maximum number of events read from the database for a request.
+const maxPersistedEvents = 10000
+
+type EventsApi struct {
+	feeds map[string]*ExchangeRunner
+}
+
+func NewEventsApi(feeds map[string]*ExchangeRunner) *EventsApi {
+	return &EventsApi{
+		feeds: feeds,
+	}
+}
+
+func (a *EventsApi) Register(router *mux.Router) {
+	router.HandleFunc("/api/1/{exchange}/events/{symbol}", a.getCorrelation).Methods("GET")
+}
+
+// parseTimeParam parses a time given as Unix milliseconds or RFC3339. An
+// empty value returns def.
+func parseTimeParam(value string, def time.Time) (time.Time, error) {
+	if value == "" {
+		return def, nil
+	}
+	if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(0, millis*int64(time.Millisecond)), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time: %s", value)
+	}
+	return t, nil
+}
+
+type correlatedEvent struct {
+	events.Event
+
+	// The open time of the candle the event falls in.
+	CandleTime time.Time `json:"candle_time"`
+}
+
+// getCorrelation returns the candles and events of a symbol over a time
+// range, with each event tagged with the candle it belongs to. The range
+// defaults to the last hour.
+func (a *EventsApi) getCorrelation(w http.ResponseWriter, r *http.Request) {
+	feed := a.feeds[mux.Vars(r)["exchange"]]
+	if feed == nil {
+		writeJsonError(w, http.StatusNotFound, "unknown exchange")
+		return
+	}
+	symbol, ok := symbolParam(w, r, feed)
+	if !ok {
+		return
+	}
+
+	interval, ok := candleIntervalParam(feed, r)
+	if !ok {
+		writeJsonError(w, http.StatusBadRequest, "unsupported interval")
+		return
+	}
+
+	now := time.Now()
+	to, err := parseTimeParam(r.FormValue("to"), now)
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	from, err := parseTimeParam(r.FormValue("from"), to.Add(-time.Hour))
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !from.Before(to) {
+		writeJsonError(w, http.StatusBadRequest, "from must be before to")
+		return
+	}
+
+	series := []candleResponse{}
+	for _, candle := range feed.Candles().Get(symbol, interval, 0) {
+		if candle.CloseTime().After(from) && candle.OpenTime.Before(to) {
+			series = append(series, newCandleResponse(candle))
+		}
+	}
+
+	// Events older than those kept in memory come from the database.
+	found := feed.Events().Query(feed.Exchange().Name(), symbol, from, to)
+	store := feed.PersistStore()
+	if store != nil && from.Before(now.Add(-feed.Events().Retention())) {
+		found, err = store.Events(feed.Exchange().Name(), symbol, from, to, maxPersistedEvents)
+		if err != nil {
+			writeJsonError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	correlated := []correlatedEvent{}
+	for _, event := range found {
+		correlated = append(correlated, correlatedEvent{
+			Event:      event,
+			CandleTime: event.Timestamp.Truncate(interval),
+		})
+	}
+
+	writeJsonResponse(w, http.StatusOK, map[string]interface{}{
+		"exchange": feed.Exchange().Name(),
+		"symbol":   symbol,
+		"interval": candles.FormatInterval(interval),
+		"from":     from,
+		"to":       to,
+		"candles":  series,
+		"events":   correlated,
+	})
+}
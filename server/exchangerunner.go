@@ -0,0 +1,1119 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/activity"
+	"time"
+	"strings"
+	"sync"
+	"runtime"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/candles"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/events"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/indicators"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/alerts"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/anomaly"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/journal"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/persist"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/stats"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/liquidation"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/whale"
+)
+
+// The number of closed candles kept per symbol and interval.
+const candleWindow = 500
+
+// The number of recent trades kept in memory per symbol.
+const recentTradesSize = 1000
+
+// Queue options for internal trade consumers. These must see every trade
+// so block when full, the queue absorbs bursts such as cache replays.
+var internalQueueOptions = pkg.QueueOptions{
+	Size:   4096,
+	Policy: pkg.OverflowBlock,
+}
+
+// ExchangeRunner combines the trade and ticker streams of an exchange into
+// the trackers and publishes the enhanced ticker feed.
+type ExchangeRunner struct {
+	exchange  pkg.Exchange
+	symbols   *pkg.SymbolRegistry
+	trackers  *pkg.TickerTrackerMap
+
+	// The enhanced ticker feed, and the updates of each symbol keyed by
+	// symbol.
+	tickers *pkg.Topic
+	updates *pkg.Topic
+
+	// Changes of the trading status of the symbols, from the polled
+	// trading rules.
+	statuses *pkg.Topic
+
+	// The last enhanced ticker update of each symbol.
+	lastUpdates     map[string]map[string]interface{}
+	lastUpdatesLock sync.RWMutex
+
+	recentTrades *pkg.RecentTrades
+
+	// Candles built from the trade stream, and indicators calculated from
+	// them.
+	candles    *candles.Builder
+	indicators *indicators.Engine
+
+	// Disabled in lite mode.
+	noIndicators bool
+	noDepth      bool
+
+	// Rolling window statistics per symbol.
+	stats *stats.Aggregator
+
+	// The in-progress candles and statistics are saved here on shutdown,
+	// not saved if empty.
+	stateFile string
+
+	// Applies trades to the trackers, sharded by symbol. Flushed before the
+	// trackers are read for a ticker update.
+	metricWorkers *pkg.ShardedPool
+
+	events   *events.Store
+	detector *events.Detector
+	alerts   *alerts.Engine
+
+	// Ticker metric thresholds posted to URLs, nil if none are configured.
+	metricWebhooks *alerts.MetricWebhooks
+
+	// Trading rule changes, nil if the exchange doesn't publish its rules.
+	// Polled every rulesInterval, 0 to disable.
+	rules         *events.RulesWatcher
+	rulesInterval time.Duration
+
+	// The symbols of the exchange are refreshed every interval to subscribe
+	// to new listings and report listings and delistings. A zero interval
+	// disables the refresh.
+	symbolRefresh pkg.SymbolRefreshConfig
+
+	// Symbols not allowed by the filter are neither streamed nor tracked.
+	// Nil allows all symbols.
+	symbolFilter *pkg.SymbolFilter
+
+	// Symbols with a 24h volume in USD below the floor are still ingested
+	// but are not broadcast or checked for events and alerts. A floor of 0
+	// disables it.
+	volumeFloor     float64
+	belowFloor      map[string]bool
+	belowFloorLock  sync.RWMutex
+
+	// Baseline for volume spikes and the volume score.
+	anomalyConfig   anomaly.Config
+	anomalyBaseline *anomaly.Baseline
+
+	// Journal of the trade stream, nil if not enabled.
+	journal *journal.TradeJournal
+
+	// Database persistence of trades and candles, nil if not enabled.
+	persist *persist.Store
+
+	// Conversion rates from the last ticker update.
+	rates     *pkg.ConversionRates
+	ratesLock sync.RWMutex
+
+	// Event time of the exchange that metric windows end at. Trades later
+	// than the allowed lateness are dropped.
+	clock *pkg.EventClock
+
+	// Tasks run on the run loop between ticker updates, when the trackers
+	// are not being updated.
+	loopTasks chan func()
+
+	// Closed once Run has stopped and the journal is closed.
+	done chan struct{}
+}
+
+func NewExchangeRunner(exchange pkg.Exchange, symbols *pkg.SymbolRegistry,
+	eventStore *events.Store, alertEngine *alerts.Engine) *ExchangeRunner {
+	feed := ExchangeRunner{
+		exchange: exchange,
+		symbols:  symbols,
+		trackers: pkg.NewTickerTrackerMap(),
+		tickers:     pkg.DefaultBus.NewTopic(exchange.Name()+".tickers", (*TickerStream)(nil)),
+		updates: pkg.DefaultBus.NewTopicWithOptions(exchange.Name()+".symbols", nil,
+			pkg.TopicOptions{Shards: pkg.FanoutShards, ShardByKey: true}),
+		statuses:    pkg.DefaultBus.NewTopic(exchange.Name()+".status", pkg.SymbolStatusChange{}),
+		lastUpdates: map[string]map[string]interface{}{},
+		belowFloor: map[string]bool{},
+		recentTrades: pkg.NewRecentTrades(exchange.Name()+".recent", recentTradesSize),
+		candles: candles.NewBuilder(exchange.Name()+".candles",
+			candles.DefaultIntervals, candleWindow),
+		indicators: indicators.NewEngine(),
+		stats: stats.NewAggregator(exchange.Name() + ".stats"),
+		metricWorkers: pkg.NewShardedPool(exchange.Name() + ".metrics"),
+		events: eventStore,
+		alerts: alertEngine,
+		clock: pkg.NewEventClock(exchange.Name(), pkg.DefaultAllowedLateness),
+		loopTasks: make(chan func()),
+		done: make(chan struct{}),
+	}
+	feed.detector = events.NewDetector(exchange.Name(), eventStore, feed.candles,
+		feed.Rates, events.DefaultDetectorOptions)
+	feed.detector.SetFilter(feed.detectable)
+	if source, ok := exchange.(pkg.TradingRulesExchange); ok {
+		feed.rules = events.NewRulesWatcher(exchange.Name(), source, eventStore,
+			feed.allowSymbol)
+		feed.rules.OnStatusChange(feed.publishStatus)
+	}
+	feed.anomalyConfig = events.DefaultDetectorOptions.VolumeSpike
+	feed.anomalyBaseline, _ = anomaly.New(feed.anomalyConfig)
+	alertEngine.SetScorer(exchange.Name(), feed.volumeScore)
+	return &feed
+}
+
+func (b *ExchangeRunner) Exchange() pkg.Exchange {
+	return b.exchange
+}
+
+func (b *ExchangeRunner) Name() string {
+	return b.exchange.Name()
+}
+
+// IsHidden returns true if symbol is hidden on the exchange, and must be
+// left out of all output.
+func (b *ExchangeRunner) IsHidden(symbol string) bool {
+	return b.symbols.IsHidden(b.Name(), symbol)
+}
+
+// Tickers returns the last ticker of each symbol that is not hidden. The
+// trackers are read on the run loop, as they are written by it, so an
+// error is returned if it does not run the read before ctx is done.
+func (b *ExchangeRunner) Tickers(ctx context.Context) ([]pkg.CommonTicker, error) {
+	tickers := []pkg.CommonTicker{}
+	err := b.runTask(ctx, func() {
+		for _, symbol := range b.trackers.Symbols() {
+			if b.IsHidden(symbol) {
+				continue
+			}
+			if last := b.trackers.GetLastForSymbol(symbol); last != nil {
+				tickers = append(tickers, *last)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tickers, nil
+}
+
+// LastUpdates returns the last enhanced ticker update of each symbol that
+// is not hidden. The updates must not be modified.
+func (b *ExchangeRunner) LastUpdates() []map[string]interface{} {
+	b.lastUpdatesLock.RLock()
+	defer b.lastUpdatesLock.RUnlock()
+	updates := make([]map[string]interface{}, 0, len(b.lastUpdates))
+	for symbol, update := range b.lastUpdates {
+		if !b.IsHidden(symbol) {
+			updates = append(updates, update)
+		}
+	}
+	return updates
+}
+
+// LastUpdate returns the last enhanced ticker update of symbol, nil if
+// there is none or the symbol is hidden. The update must not be modified.
+func (b *ExchangeRunner) LastUpdate(symbol string) map[string]interface{} {
+	if b.IsHidden(symbol) {
+		return nil
+	}
+	b.lastUpdatesLock.RLock()
+	defer b.lastUpdatesLock.RUnlock()
+	return b.lastUpdates[symbol]
+}
+
+func (b *ExchangeRunner) RecentTrades() *pkg.RecentTrades {
+	return b.recentTrades
+}
+
+func (b *ExchangeRunner) Candles() *candles.Builder {
+	return b.candles
+}
+
+func (b *ExchangeRunner) Indicators() *indicators.Engine {
+	return b.indicators
+}
+
+// MetricWorkers returns the pool trades are applied to the trackers on. It
+// can be resized while running.
+func (b *ExchangeRunner) MetricWorkers() *pkg.ShardedPool {
+	return b.metricWorkers
+}
+
+// SetWorkers resizes the pools that are set in config. May be called while
+// running.
+func (b *ExchangeRunner) SetWorkers(config pkg.WorkersConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	if config.Decode != 0 {
+		if err := b.exchange.TradeStream().DecodePool().SetWorkers(config.Decode); err != nil {
+			return err
+		}
+	}
+	if config.Metrics != 0 {
+		if err := b.metricWorkers.SetWorkers(config.Metrics); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Workers returns the sizes of the pools.
+func (b *ExchangeRunner) Workers() pkg.WorkersConfig {
+	return pkg.WorkersConfig{
+		Decode:  b.exchange.TradeStream().DecodePool().Workers(),
+		Metrics: b.metricWorkers.Workers(),
+	}
+}
+
+// DisableIndicators stops calculating indicators, leaving the engine
+// empty. Must be called before Run.
+func (b *ExchangeRunner) DisableIndicators() {
+	b.noIndicators = true
+}
+
+// DisableDepth stops maintaining the depth books of the exchange, if it has
+// any. Must be called before Run.
+func (b *ExchangeRunner) DisableDepth() {
+	b.noDepth = true
+}
+
+// DepthStream returns the depth books of the exchange, nil if it has none
+// or they are disabled.
+func (b *ExchangeRunner) DepthStream() pkg.DepthStream {
+	if b.noDepth {
+		return nil
+	}
+	return b.exchange.DepthStream()
+}
+
+// OpenJournal starts journaling the trade stream to dir. Must be called
+// before Run.
+func (b *ExchangeRunner) OpenJournal(dir string, options journal.Options) error {
+	tradeJournal, err := journal.OpenTradeJournal(dir, options)
+	if err != nil {
+		return err
+	}
+	b.journal = tradeJournal
+	b.exchange.TradeStream().AddSink(tradeJournal)
+	return nil
+}
+
+// SetPersistStore persists the trade stream and closed candles to store.
+// Must be called before Run.
+func (b *ExchangeRunner) SetPersistStore(store *persist.Store) {
+	b.persist = store
+	b.exchange.TradeStream().AddSink(store.TradeSink(b.Name()))
+	b.candles.AddSink(store.CandleSink(b.Name()))
+}
+
+// PersistStore returns the database store, or nil if persistence is not
+// enabled.
+func (b *ExchangeRunner) PersistStore() *persist.Store {
+	return b.persist
+}
+
+// SetSymbolFilter restricts the symbols streamed from the exchange and the
+// tickers tracked. Must be called before Run.
+func (b *ExchangeRunner) SetSymbolFilter(filter *pkg.SymbolFilter) {
+	b.symbolFilter = filter
+	b.exchange.TradeStream().SetSymbolFilter(filter)
+}
+
+func (b *ExchangeRunner) allowSymbol(symbol string) bool {
+	return b.symbolFilter.Allow(symbol)
+}
+
+// SetRulesInterval sets how often the trading rules are polled for
+// changes, 0 to disable. Must be called before Run.
+func (b *ExchangeRunner) SetRulesInterval(interval time.Duration) {
+	b.rulesInterval = interval
+}
+
+// SetSymbolRefresh sets how often the symbols of the exchange are refreshed
+// and where listings and delistings are alerted. Must be called before Run.
+func (b *ExchangeRunner) SetSymbolRefresh(config pkg.SymbolRefreshConfig) {
+	b.symbolRefresh = config
+}
+
+// refreshSymbols refreshes the symbols of the exchange every interval until
+// ctx is done. The first refresh only records the symbols.
+func (b *ExchangeRunner) refreshSymbols(ctx context.Context) {
+	var known []string
+	ticker := time.NewTicker(b.symbolRefresh.Interval)
+	defer ticker.Stop()
+	for {
+		symbols, err := b.exchange.GetSymbols()
+		if err != nil {
+			log.Printf("error: %s: failed to refresh symbols: %v\n", b.Name(), err)
+		} else if len(symbols) > 0 {
+			symbols = b.symbolFilter.Apply(symbols)
+			if known != nil {
+				b.updateSymbols(pkg.DiffSymbols(known, symbols))
+			}
+			known = symbols
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// updateSymbols subscribes to the added symbols, if the trade stream
+// supports it, and reports the added and removed symbols. Streams of
+// removed symbols are left to go quiet.
+func (b *ExchangeRunner) updateSymbols(added []string, removed []string) {
+	if len(added) > 0 {
+		log.Printf("%s: %d new symbols: %s\n", b.Name(), len(added), strings.Join(added, ", "))
+		if refresher, ok := b.exchange.TradeStream().(pkg.SymbolRefresher); ok {
+			refresher.RefreshSymbols()
+		}
+	}
+	if len(removed) > 0 {
+		log.Printf("%s: %d symbols delisted: %s\n", b.Name(), len(removed), strings.Join(removed, ", "))
+	}
+	for _, symbol := range added {
+		if b.detector.AddListing(symbol) {
+			b.fireSymbolAlert("listing", symbol, fmt.Sprintf("%s listed on %s", symbol, b.Name()))
+		}
+	}
+	for _, symbol := range removed {
+		b.detector.AddDelisting(symbol)
+		b.fireSymbolAlert("delisting", symbol, fmt.Sprintf("%s delisted from %s", symbol, b.Name()))
+	}
+}
+
+func (b *ExchangeRunner) fireSymbolAlert(name string, symbol string, message string) {
+	if b.symbolRefresh.NoAlerts {
+		return
+	}
+	b.alerts.FireMonitor(name, b.Name(), symbol, message, map[string]float64{},
+		b.symbolRefresh.Webhooks, b.symbolRefresh.Notify)
+}
+
+// TradingRules returns the last polled trading rules of symbol.
+func (b *ExchangeRunner) TradingRules(symbol string) (pkg.TradingRules, bool) {
+	if b.rules == nil {
+		return pkg.TradingRules{}, false
+	}
+	return b.rules.Rules(symbol)
+}
+
+// SetMetricWebhooks sets the metric webhooks the ticker updates are
+// evaluated against. Must be called before Run.
+func (b *ExchangeRunner) SetMetricWebhooks(hooks *alerts.MetricWebhooks) {
+	b.metricWebhooks = hooks
+}
+
+// SetVolumeFloor sets the 24h volume in USD below which symbols are
+// excluded from the ticker feed, events and alerts. Must be called before
+// Run.
+func (b *ExchangeRunner) SetVolumeFloor(usd float64) {
+	b.volumeFloor = usd
+}
+
+// BelowVolumeFloor returns true if symbol is currently excluded by the
+// volume floor.
+func (b *ExchangeRunner) BelowVolumeFloor(symbol string) bool {
+	b.belowFloorLock.RLock()
+	defer b.belowFloorLock.RUnlock()
+	return b.belowFloor[symbol]
+}
+
+func (b *ExchangeRunner) aboveVolumeFloor(symbol string) bool {
+	return !b.BelowVolumeFloor(symbol)
+}
+
+// detectable returns true if events are detected for symbol: it is not
+// hidden, above the volume floor and not halted or in an auction, where its
+// trades would raise false signals.
+func (b *ExchangeRunner) detectable(symbol string) bool {
+	return !b.IsHidden(symbol) && b.aboveVolumeFloor(symbol) &&
+		!b.SymbolStatus(symbol).Suspended()
+}
+
+// AuditMetric calculates metric of symbol over the window of bucket
+// minutes again from the data its tracker holds, on the run loop so the
+// tracker is not being updated.
+func (b *ExchangeRunner) AuditMetric(ctx context.Context, symbol string, metric string,
+	bucket int) (*pkg.MetricAudit, error) {
+	var audit *pkg.MetricAudit
+	var err error
+	if runErr := b.runTask(ctx, func() {
+		tracker := b.trackers.Trackers[symbol]
+		if tracker == nil {
+			err = fmt.Errorf("unknown symbol: %s", symbol)
+			return
+		}
+		audit, err = tracker.Audit(metric, bucket)
+	}); runErr != nil {
+		return nil, runErr
+	}
+	return audit, err
+}
+
+// runTask runs task on the run loop once the trades submitted to the metric
+// workers are applied, so it can read the trackers, and waits for it to
+// finish.
+func (b *ExchangeRunner) runTask(ctx context.Context, task func()) error {
+	finished := make(chan struct{})
+	select {
+	case b.loopTasks <- func() {
+		defer close(finished)
+		task()
+	}:
+	case <-b.done:
+		return fmt.Errorf("%s is not running", b.Name())
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	<-finished
+	return nil
+}
+
+// SymbolStatus returns the trading status of symbol as of the last poll of
+// the trading rules, unknown if the exchange doesn't publish its rules.
+func (b *ExchangeRunner) SymbolStatus(symbol string) pkg.SymbolStatus {
+	if b.rules == nil {
+		return pkg.SymbolUnknown
+	}
+	return b.rules.Status(symbol)
+}
+
+// SymbolStatuses returns the trading status of every symbol as of the last
+// poll of the trading rules, empty if the exchange doesn't publish its
+// rules.
+func (b *ExchangeRunner) SymbolStatuses() map[string]pkg.SymbolStatus {
+	if b.rules == nil {
+		return map[string]pkg.SymbolStatus{}
+	}
+	return b.rules.Statuses()
+}
+
+// Statuses returns the topic the changes of the trading status of the
+// symbols are published to.
+func (b *ExchangeRunner) Statuses() *pkg.Topic {
+	return b.statuses
+}
+
+func (b *ExchangeRunner) publishStatus(change pkg.SymbolStatusChange) {
+	log.Printf("%s: %s trading status changed from %s to %s (%s)\n", b.Name(),
+		change.Symbol, change.Previous, change.Status, change.ExchangeStatus)
+	b.statuses.Publish(change)
+}
+
+// updateVolumeFloor recalculates the symbols below the volume floor from
+// the last tickers. Symbols whose volume can't be converted to USD are
+// kept.
+func (b *ExchangeRunner) updateVolumeFloor() {
+	if b.volumeFloor <= 0 {
+		return
+	}
+	rates := b.Rates()
+	below := map[string]bool{}
+	for _, symbol := range b.trackers.Symbols() {
+		last := b.trackers.GetLastForSymbol(symbol)
+		if last == nil {
+			continue
+		}
+		_, quote, ok := pkg.SplitSymbol(symbol)
+		if !ok {
+			continue
+		}
+		rate, ok := rates.Rate(quote, "USD")
+		if !ok {
+			continue
+		}
+		if last.QuoteVolume*rate < b.volumeFloor {
+			below[symbol] = true
+		}
+	}
+	b.belowFloorLock.Lock()
+	changed := len(below) != len(b.belowFloor)
+	b.belowFloor = below
+	b.belowFloorLock.Unlock()
+	if changed {
+		log.Printf("%s: %d symbols below the volume floor of $%.0f\n",
+			b.Name(), len(below), b.volumeFloor)
+	}
+}
+
+// SetAnomalyConfig sets the baseline used for volume spike events and the
+// volume score. Must be called before Run.
+func (b *ExchangeRunner) SetAnomalyConfig(config anomaly.Config) error {
+	baseline, err := anomaly.New(config)
+	if err != nil {
+		return err
+	}
+	options := b.detector.Options()
+	options.VolumeSpike = config
+	if err := b.detector.SetOptions(options); err != nil {
+		return err
+	}
+	b.anomalyConfig = config
+	b.anomalyBaseline = baseline
+	return nil
+}
+
+// SetWhaleConfig sets the thresholds for whale trade events and flow. Must
+// be called before Run.
+func (b *ExchangeRunner) SetWhaleConfig(config whale.Config) error {
+	options := b.detector.Options()
+	options.Whale = config
+	return b.detector.SetOptions(options)
+}
+
+// Whales returns the whale detector, for the whale flow of each symbol.
+func (b *ExchangeRunner) Whales() *whale.Detector {
+	return b.detector.Whales()
+}
+
+// SetActivityConfig sets the baseline for activity surge events. Must be
+// called before Run.
+func (b *ExchangeRunner) SetActivityConfig(config activity.Config) error {
+	options := b.detector.Options()
+	options.ActivitySurge = config
+	return b.detector.SetOptions(options)
+}
+
+// SetLiquidationConfig sets the thresholds for liquidation and cascade
+// events of futures markets. Must be called before Run.
+func (b *ExchangeRunner) SetLiquidationConfig(config liquidation.Config) error {
+	options := b.detector.Options()
+	options.Liquidation = config
+	return b.detector.SetOptions(options)
+}
+
+// Liquidations returns the liquidation tracker, for the liquidation volume
+// of each symbol.
+func (b *ExchangeRunner) Liquidations() *liquidation.Tracker {
+	return b.detector.Liquidations()
+}
+
+// DetectorOptions returns the options events are detected with.
+func (b *ExchangeRunner) DetectorOptions() events.DetectorOptions {
+	return b.detector.Options()
+}
+
+// volumeScore scores the quote volume of the last closed 1 minute candle
+// of symbol with the exchange baseline overridden by override.
+func (b *ExchangeRunner) volumeScore(symbol string, override anomaly.Config) (float64, bool) {
+	baseline, err := anomaly.New(b.anomalyConfig.Override(override))
+	if err != nil {
+		return 0, false
+	}
+	return scoreLastVolume(b.candles, baseline, symbol)
+}
+
+func scoreLastVolume(builder *candles.Builder, baseline *anomaly.Baseline, symbol string) (float64, bool) {
+	volumes := builder.ClosedQuoteVolumes(symbol, time.Minute, baseline.Window+1)
+	if len(volumes) < baseline.Window+1 {
+		return 0, false
+	}
+	result, ok := baseline.Score(volumes[:len(volumes)-1], volumes[len(volumes)-1])
+	if !ok {
+		return 0, false
+	}
+	return pkg.Round3(result.Score), true
+}
+
+// LoadCandleHistory seeds the candle builder and indicators with the
+// historical candles in store. Must be called before Run.
+func (b *ExchangeRunner) LoadCandleHistory(store *candles.HistoryStore) error {
+	files, err := store.List()
+	if err != nil {
+		return err
+	}
+	count := 0
+	for _, file := range files {
+		history, err := store.Load(file.Symbol, file.Interval)
+		if err != nil {
+			return fmt.Errorf("%s %s: %v", file.Symbol,
+				candles.FormatInterval(file.Interval), err)
+		}
+		count += b.seedCandles(file.Symbol, file.Interval, history)
+	}
+	if count > 0 {
+		log.Printf("%s: loaded %d historical candles for %d series\n",
+			b.Name(), count, len(files))
+	}
+	return nil
+}
+
+// LoadPersistedCandles seeds the candle builder and indicators with the
+// recent candles persisted to store, so indicators are warm after a
+// restart. Must be called before Run.
+func (b *ExchangeRunner) LoadPersistedCandles(store *persist.Store) error {
+	now := time.Now()
+	count := 0
+	for _, interval := range b.candles.Intervals() {
+		since := now.Add(-interval * candleWindow)
+		recent, err := store.RecentCandles(b.Name(), interval, since)
+		if err != nil {
+			return fmt.Errorf("%s: %v", candles.FormatInterval(interval), err)
+		}
+		for symbol, history := range recent {
+			count += b.seedCandles(symbol, interval, history)
+		}
+	}
+	if count > 0 {
+		log.Printf("%s: loaded %d persisted candles\n", b.Name(), count)
+	}
+	return nil
+}
+
+func (b *ExchangeRunner) seedCandles(symbol string, interval time.Duration, history []candles.Candle) int {
+	seeded := b.candles.Seed(symbol, interval, history)
+	if !b.noIndicators {
+		for _, candle := range seeded {
+			b.indicators.Send(candle)
+		}
+	}
+	return len(seeded)
+}
+
+// Journal returns the trade journal, or nil if journaling is not enabled.
+func (b *ExchangeRunner) Journal() *journal.TradeJournal {
+	return b.journal
+}
+
+func (b *ExchangeRunner) Stats() *stats.Aggregator {
+	return b.stats
+}
+
+func (b *ExchangeRunner) Events() *events.Store {
+	return b.events
+}
+
+// Symbols returns all symbols seen on the exchange.
+func (b *ExchangeRunner) Symbols() []string {
+	return b.trackers.Symbols()
+}
+
+// AddSink registers a sink to receive every enhanced ticker update.
+func (b *ExchangeRunner) AddSink(sink pkg.Sink) {
+	b.tickers.AddSink(sink)
+}
+
+// visibleTradeSink forwards the trades of symbols that are not hidden.
+type visibleTradeSink struct {
+	pkg.Sink
+	feed *ExchangeRunner
+}
+
+func (s *visibleTradeSink) Send(message interface{}) error {
+	if trade, ok := message.(pkg.CommonTrade); ok && s.feed.IsHidden(trade.Symbol) {
+		return nil
+	}
+	return s.Sink.Send(message)
+}
+
+// AddTradeSink registers a sink to receive the trades of the exchange,
+// except those of hidden symbols.
+func (b *ExchangeRunner) AddTradeSink(sink pkg.Sink) {
+	b.exchange.TradeStream().AddSink(&visibleTradeSink{Sink: sink, feed: b})
+}
+
+// Rates returns the conversion rates as of the last ticker update. May be
+// nil before the first update.
+func (b *ExchangeRunner) Rates() *pkg.ConversionRates {
+	b.ratesLock.RLock()
+	defer b.ratesLock.RUnlock()
+	return b.rates
+}
+
+func (b *ExchangeRunner) updateRates() {
+	prices := map[string]float64{}
+	for _, symbol := range b.trackers.Symbols() {
+		if last := b.trackers.GetLastForSymbol(symbol); last != nil {
+			prices[symbol] = last.LastPrice
+		}
+	}
+	rates := pkg.NewConversionRates(prices)
+	b.ratesLock.Lock()
+	b.rates = rates
+	b.ratesLock.Unlock()
+}
+
+// Subscribe returns a channel of updates for symbol, queued as per options.
+// The channel is closed if the subscriber is disconnected for being too
+// slow.
+func (b *ExchangeRunner) Subscribe(symbol string, name string, options pkg.QueueOptions) chan interface{} {
+	return b.updates.SubscribeKey(symbol, name, options).(chan interface{})
+}
+
+func (b *ExchangeRunner) Unsubscribe(symbol string, channel chan interface{}) {
+	b.updates.Unsubscribe(channel)
+}
+
+// publishSymbol queues an update to each subscriber of symbol.
+func (b *ExchangeRunner) publishSymbol(symbol string, update map[string]interface{}) {
+	b.updates.PublishKey(symbol, update)
+}
+
+// SetDedupWindow sets the number of trade IDs remembered per symbol to drop
+// duplicate trades, 0 to disable. Must be called before Run.
+func (b *ExchangeRunner) SetDedupWindow(size int) {
+	b.exchange.TradeStream().SetDedupWindow(size)
+}
+
+// SetAllowedLateness sets how far behind the latest event time a trade may be
+// and still be counted. Must be called before Run.
+func (b *ExchangeRunner) SetAllowedLateness(lateness time.Duration) {
+	b.clock = pkg.NewEventClock(b.exchange.Name(), lateness)
+}
+
+// EventTime returns the latest event time of the exchange.
+func (b *ExchangeRunner) EventTime() time.Time {
+	return b.clock.Now()
+}
+
+// Done is closed once the runner has stopped after ctx passed to Run is
+// cancelled.
+func (b *ExchangeRunner) Done() <-chan struct{} {
+	return b.done
+}
+
+// Run starts the streams and processes them until ctx is cancelled. On
+// cancellation the trade stream is stopped before the journal is closed so
+// no published trades are lost, then Done is closed.
+func (b *ExchangeRunner) Run(ctx context.Context) {
+	lastUpdate := time.Now()
+
+	name := b.exchange.Name()
+
+	tradeStream := b.exchange.TradeStream()
+	tradeChannel := tradeStream.Subscribe("trackers", internalQueueOptions)
+	candleChannel := tradeStream.Subscribe("candles", internalQueueOptions)
+	go b.candles.Run(candleChannel)
+	tradeStream.AddSink(b.detector)
+	tradeStream.AddSink(b.stats)
+	tradeStream.AddSink(b.recentTrades)
+	b.candles.AddSink(b.detector)
+	if !b.noIndicators {
+		b.candles.AddSink(b.indicators)
+	}
+
+	tradeStreamDone := make(chan struct{})
+	go func() {
+		defer close(tradeStreamDone)
+		tradeStream.Run(ctx)
+	}()
+
+	if b.journal != nil {
+		go b.journal.Run(ctx)
+	}
+
+	tickerStream := b.exchange.TickerStream()
+	tickerStream.ReplayCache(func(tickers []pkg.CommonTicker) {
+		b.updateTrackers(b.trackers, tickers, false)
+	})
+
+	tickerChannel := make(chan []pkg.CommonTicker)
+	go tickerStream.Run(ctx, tickerChannel)
+
+	if depthStream := b.DepthStream(); depthStream != nil {
+		go depthStream.Run(ctx)
+	}
+
+	if futures, ok := b.exchange.(pkg.FuturesExchange); ok {
+		futures.AddLiquidationSink(b.detector)
+		go futures.RunDerivatives(ctx)
+	}
+
+	if b.rules != nil && b.rulesInterval > 0 {
+		go b.rules.Run(ctx, b.rulesInterval)
+	}
+
+	if b.symbolRefresh.Interval > 0 {
+		go b.refreshSymbols(ctx)
+	}
+
+	go func() {
+		defer close(b.done)
+
+		tradeCount := 0
+		lastTradeTime := time.Time{}
+		for {
+		ReadLoop:
+			loopStartTime := time.Now()
+			select {
+
+			case <-ctx.Done():
+				b.shutdown(tradeStreamDone, tradeChannel, candleChannel)
+				return
+
+			case trade := <-tradeChannel:
+				if !b.clock.Observe(trade.Timestamp) {
+					continue
+				}
+				b.metricWorkers.Submit(trade.Symbol, func() {
+					b.trackers.GetTracker(trade.Symbol).AddTrade(trade)
+				})
+
+				if trade.Timestamp.After(lastTradeTime) {
+					lastTradeTime = trade.Timestamp
+				}
+
+				tradeCount++
+
+			case task := <-b.loopTasks:
+				b.metricWorkers.Flush()
+				task()
+
+			case tickers := <-tickerChannel:
+
+				waitTime := time.Now().Sub(loopStartTime)
+				if len(tickers) == 0 {
+					goto ReadLoop
+				}
+
+				lastServerTickerTimestamp := time.Time{}
+				for _, ticker := range tickers {
+					if ticker.Timestamp.After(lastServerTickerTimestamp) {
+						lastServerTickerTimestamp = ticker.Timestamp
+					}
+				}
+
+				b.metricWorkers.Flush()
+				b.updateTrackers(b.trackers, tickers, true)
+				b.updateRates()
+				b.updateVolumeFloor()
+				b.detector.CheckListings(b.trackers.Symbols())
+
+				// Create enhanced feed.
+				message := []interface{}{}
+				for key := range b.trackers.Trackers {
+					tracker := b.trackers.Trackers[key]
+					if tracker.LastUpdate.Before(lastUpdate) {
+						continue
+					}
+					if b.symbols.IsHidden(name, key) {
+						continue
+					}
+					if b.BelowVolumeFloor(key) {
+						b.lastUpdatesLock.Lock()
+						delete(b.lastUpdates, key)
+						b.lastUpdatesLock.Unlock()
+						continue
+					}
+					update := buildUpdateMessage(tracker)
+					addTradeMetrics(update, tracker)
+					if values := b.indicators.Snapshot(key); len(values) > 0 {
+						update["indicators"] = values
+					}
+					b.addVolumeRatios(update, key)
+					b.addWhaleFlow(update, key)
+					b.addDerivatives(update, key)
+					b.addLiquidations(update, key)
+					if status := b.SymbolStatus(key); status != pkg.SymbolUnknown {
+						update["status"] = string(status)
+					}
+					b.alerts.Evaluate(name, key, update)
+					if b.metricWebhooks != nil {
+						b.metricWebhooks.Evaluate(name, key, update)
+					}
+					if alias := b.symbols.Alias(name, key); alias != "" {
+						update["alias"] = alias
+					}
+
+					message = append(message, update)
+
+					b.publishSymbol(key, update)
+					b.lastUpdatesLock.Lock()
+					b.lastUpdates[key] = update
+					b.lastUpdatesLock.Unlock()
+				}
+				b.tickers.Publish(&TickerStream{Tickers: &message,})
+
+				now := time.Now()
+				lastUpdate = now;
+				processingTime := now.Sub(loopStartTime) - waitTime
+				lagTime := now.Sub(lastServerTickerTimestamp)
+				tradeLag := now.Sub(lastTradeTime)
+
+				log.WithFields(log.Fields{
+					"exchange":   name,
+					"wait":       waitTime.String(),
+					"processing": processingTime.String(),
+					"lag":        lagTime.String(),
+					"trades":     tradeCount,
+					"trade_lag":  tradeLag.String(),
+				}).Debugf("ticker update")
+				tradeCount = 0
+			}
+		}
+	}()
+}
+
+// shutdown waits for the trade stream to stop publishing, unsubscribes the
+// internal consumers and closes the journal.
+func (b *ExchangeRunner) shutdown(tradeStreamDone chan struct{}, channels ...chan pkg.CommonTrade) {
+	name := b.exchange.Name()
+	log.Printf("%s: shutting down\n", name)
+
+	// The trade stream may be blocked publishing to the trackers channel,
+	// so keep it drained until the stream has stopped.
+	tradeStream := b.exchange.TradeStream()
+Drain:
+	for {
+		select {
+		case <-channels[0]:
+		case <-tradeStreamDone:
+			break Drain
+		}
+	}
+	for _, channel := range channels {
+		tradeStream.Unsubscribe(channel)
+	}
+
+	if b.journal != nil {
+		if err := b.journal.Close(); err != nil {
+			log.Printf("error: %s: failed to close journal: %v\n", name, err)
+		} else {
+			log.Printf("%s: journal flushed and closed\n", name)
+		}
+	}
+
+	if err := b.saveState(); err != nil {
+		log.Printf("error: %s: failed to save in-progress state: %v\n", name, err)
+	}
+}
+
+// addVolumeRatios adds the volume of the last minute as a multiple of the
+// average minute over recent windows, and the volume of the last day as a
+// multiple of the average day over the last 30. The volume score of the last
+// minute against the exchange baseline is also added.
+func (b *ExchangeRunner) addVolumeRatios(update map[string]interface{}, symbol string) {
+	ratios := map[string]float64{}
+	for _, window := range []int{15, 60} {
+		if ratio, ok := b.candles.VolumeRatio(symbol, time.Minute, window); ok {
+			ratios[candles.FormatInterval(time.Duration(window)*time.Minute)] = pkg.Round3(ratio)
+		}
+	}
+	if ratio, ok := b.candles.VolumeRatio(symbol, 24*time.Hour, 30); ok {
+		ratios["30d"] = pkg.Round3(ratio)
+	}
+	if len(ratios) > 0 {
+		update["volume_ratio"] = ratios
+	}
+	if b.anomalyBaseline != nil {
+		if score, ok := scoreLastVolume(b.candles, b.anomalyBaseline, symbol); ok {
+			update[alerts.VolumeScoreMetric] = score
+		}
+	}
+}
+
+// addWhaleFlow adds the whale buy and sell flow of the symbol, if it has
+// had any whales in the last day.
+func (b *ExchangeRunner) addWhaleFlow(update map[string]interface{}, symbol string) {
+	flows := b.Whales().Flow(symbol, b.clock.Now())
+	if flows == nil {
+		return
+	}
+	metrics := map[string]interface{}{}
+	for window, flow := range flows {
+		metrics[window] = flow.Metrics()
+	}
+	update["whale_flow"] = metrics
+}
+
+// addDerivatives adds the mark price, funding and open interest of futures
+// markets.
+func (b *ExchangeRunner) addDerivatives(update map[string]interface{}, symbol string) {
+	futures, ok := b.exchange.(pkg.FuturesExchange)
+	if !ok {
+		return
+	}
+	if info, ok := futures.Derivatives(symbol); ok {
+		update["futures"] = info.Metrics()
+	}
+}
+
+// addLiquidations adds the long and short liquidation volume of the
+// symbol, if it has had any liquidations in the last day.
+func (b *ExchangeRunner) addLiquidations(update map[string]interface{}, symbol string) {
+	volumes := b.Liquidations().Volume(symbol, b.clock.Now())
+	if volumes == nil {
+		return
+	}
+	metrics := map[string]interface{}{}
+	for window, volume := range volumes {
+		metrics[window] = volume.Metrics()
+	}
+	update["liquidations"] = metrics
+}
+
+// updateTrackers updates the trackers with tickers, recalculating the metrics
+// with windows ending at the event time of the latest ticker or trade.
+// Tickers later than the allowed lateness are dropped.
+func (b *ExchangeRunner) updateTrackers(trackers *pkg.TickerTrackerMap, tickers []pkg.CommonTicker, recalculate bool) {
+	current := []pkg.CommonTicker{}
+	for _, ticker := range tickers {
+		if !b.symbolFilter.Allow(ticker.Symbol) {
+			continue
+		}
+		if !b.clock.Observe(ticker.Timestamp) {
+			continue
+		}
+		current = append(current, ticker)
+	}
+	now := b.clock.Now()
+
+	channel := make(chan pkg.CommonTicker)
+	wg := sync.WaitGroup{}
+
+	handler := func() {
+		count := 0
+		for {
+			ticker := <-channel
+			if ticker.Timestamp.IsZero() {
+				break
+			}
+			count += 1
+			tracker := trackers.GetTracker(ticker.Symbol)
+			tracker.Update(ticker)
+			if recalculate {
+				tracker.Recalculate(now)
+			}
+		}
+		wg.Done()
+	}
+
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go handler()
+	}
+
+	for _, ticker := range current {
+		channel <- ticker
+	}
+
+	close(channel)
+	wg.Wait()
+}
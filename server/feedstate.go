@@ -0,0 +1,107 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/candles"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/stats"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// feedState is the in-progress state of a feed saved on shutdown, so a
+// quick restart doesn't start with a partial first candle and windows.
+type feedState struct {
+	SavedAt time.Time                     `json:"saved_at"`
+	Candles []candles.InProgress          `json:"candles"`
+	Stats   map[string]stats.RollingState `json:"stats"`
+}
+
+// FeedStateFile returns the file the in-progress state of an exchange is
+// saved to on shutdown.
+func FeedStateFile(dataDir string, exchange string) string {
+	return filepath.Join(dataDir, "state", exchange+".json.gz")
+}
+
+// SetStateFile restores the candles in progress and rolling statistics
+// saved to filename by the last shutdown, then removes it so a crash
+// doesn't restore them again, and saves them to it on shutdown. Must be
+// called before Run, after the candle history is loaded.
+func (b *ExchangeRunner) SetStateFile(filename string) error {
+	b.stateFile = filename
+	file, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	var state feedState
+	if err := json.NewDecoder(reader).Decode(&state); err != nil {
+		return err
+	}
+	candleCount := b.candles.Restore(state.Candles)
+	symbolCount := b.stats.Restore(state.Stats, time.Now())
+	log.Printf("%s: restored %d candles in progress and the windows of %d symbols saved %v ago\n",
+		b.Name(), candleCount, symbolCount, time.Since(state.SavedAt).Round(time.Second))
+	return os.Remove(filename)
+}
+
+// saveState saves the candles in progress and rolling statistics to the
+// state file, if set. The trade stream must have stopped.
+func (b *ExchangeRunner) saveState() error {
+	if b.stateFile == "" {
+		return nil
+	}
+	state := feedState{
+		SavedAt: time.Now(),
+		Candles: b.candles.InProgress(),
+		Stats:   b.stats.State(),
+	}
+	if err := os.MkdirAll(filepath.Dir(b.stateFile), 0755); err != nil {
+		return err
+	}
+	tmp := b.stateFile + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(file)
+	err = json.NewEncoder(writer).Encode(&state)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, b.stateFile)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"github.com/gorilla/websocket"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/auth"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/metrics"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	metrics.Describe("websocket_blocked_total",
+		"WebSocket connections, subscriptions and messages blocked by the flood guard.")
+}
+
+// Per-IP state idle for this long is discarded.
+const floodGuardIdleTimeout = 10 * time.Minute
+
+type FloodGuardOptions struct {
+	// Maximum concurrent websocket connections per IP. 0 for no limit.
+	MaxConnectionsPerIP int
+
+	// Maximum new websocket subscriptions per IP per minute. 0 for no
+	// limit.
+	MaxSubscriptionsPerMinute int
+
+	// Maximum size of a message from a client, larger messages close the
+	// connection. 0 for no limit.
+	MaxMessageSize int64
+}
+
+var DefaultFloodGuardOptions = FloodGuardOptions{
+	MaxConnectionsPerIP:       20,
+	MaxSubscriptionsPerMinute: 60,
+	MaxMessageSize:            4096,
+}
+
+type floodGuardEntry struct {
+	connections   int
+	subscriptions *pkg.RateLimiter
+	lastSeen      time.Time
+}
+
+// FloodGuard limits what a single client IP can do to the websocket server.
+type FloodGuard struct {
+	options  FloodGuardOptions
+	clientIP func(r *http.Request) net.IP
+	entries  map[string]*floodGuardEntry
+	lock     sync.Mutex
+
+	// Websocket connections per API key account.
+	keyConnections map[string]int
+
+	blockedConnections    *metrics.Counter
+	blockedKeyConnections *metrics.Counter
+	blockedTopics         *metrics.Counter
+	blockedSubscriptions  *metrics.Counter
+	blockedMessages       *metrics.Counter
+}
+
+// The flood guard shared by all websocket handlers, created by ServerMain.
+var floodGuard *FloodGuard
+
+// NewFloodGuard creates a flood guard using clientIP to identify clients.
+// If clientIP is nil the remote address of the connection is used.
+func NewFloodGuard(options FloodGuardOptions, clientIP func(r *http.Request) net.IP) *FloodGuard {
+	guard := &FloodGuard{
+		options:        options,
+		clientIP:       clientIP,
+		entries:        map[string]*floodGuardEntry{},
+		keyConnections: map[string]int{},
+		blockedConnections: metrics.GetCounter("websocket_blocked_total",
+			metrics.Labels{"reason": "connections"}),
+		blockedKeyConnections: metrics.GetCounter("websocket_blocked_total",
+			metrics.Labels{"reason": "key_connections"}),
+		blockedTopics: metrics.GetCounter("websocket_blocked_total",
+			metrics.Labels{"reason": "topic"}),
+		blockedSubscriptions: metrics.GetCounter("websocket_blocked_total",
+			metrics.Labels{"reason": "subscription_rate"}),
+		blockedMessages: metrics.GetCounter("websocket_blocked_total",
+			metrics.Labels{"reason": "message_size"}),
+	}
+	go guard.prune()
+	return guard
+}
+
+func (g *FloodGuard) ip(r *http.Request) string {
+	if g.clientIP != nil {
+		if ip := g.clientIP(r); ip != nil {
+			return ip.String()
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (g *FloodGuard) entry(ip string) *floodGuardEntry {
+	entry := g.entries[ip]
+	if entry == nil {
+		entry = &floodGuardEntry{}
+		if g.options.MaxSubscriptionsPerMinute > 0 {
+			entry.subscriptions = pkg.NewRateLimiter(
+				g.options.MaxSubscriptionsPerMinute, time.Minute)
+		}
+		g.entries[ip] = entry
+	}
+	entry.lastSeen = time.Now()
+	return entry
+}
+
+// Admit checks the connection and subscription limits for a new websocket
+// request, writing an error response if blocked. Requests are also refused
+// while the server is draining, for streams the API key of the request is
+// not permitted, for API keys at their connection limit, and for accounts
+// over their hard usage limit. If admitted the returned function must be
+// called when the connection closes.
+func (g *FloodGuard) Admit(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	if drainState.Reject(w) {
+		return nil, false
+	}
+
+	identity := auth.GetIdentity(r)
+	if stream := strings.TrimPrefix(r.URL.Path, "/ws/"); !identity.AllowsTopic(stream) {
+		g.blockedTopics.Inc()
+		http.Error(w, "stream not permitted", http.StatusForbidden)
+		return nil, false
+	}
+	keyAccount := ""
+	if identity != nil && identity.MaxConnections > 0 {
+		keyAccount = identity.Account
+	}
+
+	ip := g.ip(r)
+
+	g.lock.Lock()
+	entry := g.entry(ip)
+	if g.options.MaxConnectionsPerIP > 0 && entry.connections >= g.options.MaxConnectionsPerIP {
+		g.lock.Unlock()
+		g.blockedConnections.Inc()
+		log.Printf("floodguard: %s exceeded %d connections\n", ip, g.options.MaxConnectionsPerIP)
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+		return nil, false
+	}
+	if keyAccount != "" && g.keyConnections[keyAccount] >= identity.MaxConnections {
+		g.lock.Unlock()
+		g.blockedKeyConnections.Inc()
+		log.Printf("floodguard: %s exceeded %d connections\n", keyAccount, identity.MaxConnections)
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+		return nil, false
+	}
+	if entry.subscriptions != nil && !entry.subscriptions.Allow() {
+		g.lock.Unlock()
+		g.blockedSubscriptions.Inc()
+		log.Printf("floodguard: %s exceeded %d subscriptions per minute\n",
+			ip, g.options.MaxSubscriptionsPerMinute)
+		http.Error(w, "too many subscriptions", http.StatusTooManyRequests)
+		return nil, false
+	}
+	entry.connections++
+	g.addKeyConnection(keyAccount, 1)
+	g.lock.Unlock()
+
+	releaseUsage, ok := admitUsage(w, r)
+	if !ok {
+		g.lock.Lock()
+		g.entry(ip).connections--
+		g.addKeyConnection(keyAccount, -1)
+		g.lock.Unlock()
+		return nil, false
+	}
+
+	release := func() {
+		releaseUsage()
+		g.lock.Lock()
+		defer g.lock.Unlock()
+		g.entry(ip).connections--
+		g.addKeyConnection(keyAccount, -1)
+	}
+	return release, true
+}
+
+// addKeyConnection adjusts the connection count of an API key account,
+// ignoring the empty account. Must be called with the lock held.
+func (g *FloodGuard) addKeyConnection(account string, n int) {
+	if account == "" {
+		return
+	}
+	g.keyConnections[account] += n
+	if g.keyConnections[account] <= 0 {
+		delete(g.keyConnections, account)
+	}
+}
+
+// Configure applies the message size limit to a new connection.
+func (g *FloodGuard) Configure(conn *websocket.Conn) {
+	if g.options.MaxMessageSize > 0 {
+		conn.SetReadLimit(g.options.MaxMessageSize)
+	}
+}
+
+// CheckReadError counts read errors caused by oversized messages.
+func (g *FloodGuard) CheckReadError(err error) {
+	if err == websocket.ErrReadLimit {
+		g.blockedMessages.Inc()
+	}
+}
+
+func (g *FloodGuard) prune() {
+	for {
+		time.Sleep(time.Minute)
+		now := time.Now()
+		g.lock.Lock()
+		for ip, entry := range g.entries {
+			if entry.connections == 0 && now.Sub(entry.lastSeen) > floodGuardIdleTimeout {
+				delete(g.entries, ip)
+			}
+		}
+		g.lock.Unlock()
+	}
+}
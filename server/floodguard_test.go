@@ -0,0 +1,51 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/auth"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFloodGuardConnectionsPerForwardedClient(t *testing.T) {
+	policy, err := auth.NewIPPolicy(auth.IPPolicyConfig{TrustProxy: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	guard := NewFloodGuard(FloodGuardOptions{MaxConnectionsPerIP: 2}, policy.ClientIP)
+
+	// The client forges a different address on each request, the proxy
+	// appends the real one.
+	admit := func(i int) int {
+		r := httptest.NewRequest("GET", "/ws/binance/live", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("x-forwarded-for", fmt.Sprintf("198.51.100.%d, 203.0.113.7", i))
+		w := httptest.NewRecorder()
+		guard.Admit(w, r)
+		return w.Code
+	}
+	for i := 0; i < 2; i++ {
+		if code := admit(i); code != http.StatusOK {
+			t.Fatalf("connection %d refused with %d", i, code)
+		}
+	}
+	if code := admit(2); code != http.StatusTooManyRequests {
+		t.Errorf("expected the third connection to be refused, got %d", code)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"net/http"
+)
+
+// FuturesApi serves the mark price, funding and open interest of futures
+// markets.
+type FuturesApi struct {
+	feeds map[string]*ExchangeRunner
+}
+
+func NewFuturesApi(feeds map[string]*ExchangeRunner) *FuturesApi {
+	return &FuturesApi{
+		feeds: feeds,
+	}
+}
+
+func (a *FuturesApi) Register(router *mux.Router) {
+	router.HandleFunc("/api/1/{exchange}/futures", a.getAll).Methods("GET")
+	router.HandleFunc("/api/1/{exchange}/futures/{symbol}", a.getSymbol).Methods("GET")
+}
+
+func (a *FuturesApi) futures(w http.ResponseWriter, r *http.Request) (*ExchangeRunner, pkg.FuturesExchange, bool) {
+	feed := a.feeds[mux.Vars(r)["exchange"]]
+	if feed == nil {
+		writeJsonError(w, http.StatusNotFound, "unknown exchange")
+		return nil, nil, false
+	}
+	futures, ok := feed.Exchange().(pkg.FuturesExchange)
+	if !ok {
+		writeJsonError(w, http.StatusNotFound, "not a futures market")
+		return nil, nil, false
+	}
+	return feed, futures, true
+}
+
+func (a *FuturesApi) getAll(w http.ResponseWriter, r *http.Request) {
+	feed, futures, ok := a.futures(w, r)
+	if !ok {
+		return
+	}
+	all := []pkg.DerivativesInfo{}
+	for _, info := range futures.AllDerivatives() {
+		if !feed.IsHidden(info.Symbol) {
+			all = append(all, info)
+		}
+	}
+	writeJsonResponse(w, http.StatusOK, all)
+}
+
+func (a *FuturesApi) getSymbol(w http.ResponseWriter, r *http.Request) {
+	feed, futures, ok := a.futures(w, r)
+	if !ok {
+		return
+	}
+	symbol, ok := symbolParam(w, r, feed)
+	if !ok {
+		return
+	}
+	info, ok := futures.Derivatives(symbol)
+	if !ok {
+		writeJsonError(w, http.StatusNotFound, "unknown symbol")
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, info)
+}
@@ -0,0 +1,160 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"net/http"
+	"time"
+)
+
+// The default time a stream may be down, or connected without receiving a
+// message, before it is reported unhealthy.
+const DefaultHealthStaleAfter = 2 * time.Minute
+
+type healthStream struct {
+	pkg.StreamStatus
+
+	// Seconds since the last message, or since the stream was created if
+	// it has not received one.
+	LastMessageAge float64 `json:"last_message_age"`
+}
+
+type healthCache struct {
+	Backend   string `json:"backend"`
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+	Ok       bool                `json:"ok"`
+	Problems []string            `json:"problems"`
+	Streams  []healthStream      `json:"streams"`
+	Cache    healthCache         `json:"cache"`
+	Restores []pkg.RestoreStatus `json:"restores"`
+}
+
+// HealthApi serves the liveness and readiness checks for process
+// supervisors such as Kubernetes and systemd. /healthz fails when an
+// exchange stream is wedged, down or silent for longer than staleAfter, and
+// a restart is needed. /readyz fails until every stream has connected and
+// restored its cache, while the cache is unreachable and while draining.
+type HealthApi struct {
+	cacheBackend string
+	cachePing    func() error
+	staleAfter   time.Duration
+}
+
+// NewHealthApi returns the health checks of the cache backend. A
+// staleAfter of 0 disables the stream staleness check.
+func NewHealthApi(cacheBackend string, staleAfter time.Duration) *HealthApi {
+	a := &HealthApi{
+		cacheBackend: cacheBackend,
+		staleAfter:   staleAfter,
+	}
+	if cacheBackend == pkg.CacheBackendRedis {
+		a.cachePing = pkg.NewRedisInputCache("health").Ping
+	}
+	return a
+}
+
+func (a *HealthApi) Register(router *mux.Router) {
+	router.HandleFunc("/healthz", a.getHealth).Methods("GET", "HEAD")
+	router.HandleFunc("/readyz", a.getReady).Methods("GET", "HEAD")
+}
+
+// check returns the state of the streams, cache and restores.
+func (a *HealthApi) check(now time.Time) healthResponse {
+	response := healthResponse{
+		Problems: []string{},
+		Streams:  []healthStream{},
+		Cache: healthCache{
+			Backend:   a.cacheBackend,
+			Reachable: true,
+		},
+		Restores: pkg.RestoreStatuses(),
+	}
+	for _, status := range pkg.StreamStatuses() {
+		response.Streams = append(response.Streams, healthStream{
+			StreamStatus:   status,
+			LastMessageAge: status.LastMessageAge(now).Seconds(),
+		})
+	}
+	if a.cachePing != nil {
+		if err := a.cachePing(); err != nil {
+			response.Cache.Reachable = false
+			response.Cache.Error = err.Error()
+		}
+	}
+	return response
+}
+
+func (a *HealthApi) getHealth(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	response := a.check(now)
+	if a.staleAfter > 0 {
+		for _, stream := range response.Streams {
+			if !stream.Connected {
+				if down := now.Sub(stream.DownSince); down >= a.staleAfter {
+					response.Problems = append(response.Problems, fmt.Sprintf(
+						"stream %s down for %v", stream.Name, down.Round(time.Second)))
+				}
+			} else if age := stream.StreamStatus.LastMessageAge(now); age >= a.staleAfter {
+				response.Problems = append(response.Problems, fmt.Sprintf(
+					"stream %s connected without a message for %v", stream.Name,
+					age.Round(time.Second)))
+			}
+		}
+	}
+	a.respond(w, response)
+}
+
+func (a *HealthApi) getReady(w http.ResponseWriter, r *http.Request) {
+	response := a.check(time.Now())
+	if draining, _ := drainState.Draining(); draining {
+		response.Problems = append(response.Problems, "draining")
+	}
+	for _, stream := range response.Streams {
+		if !stream.HasConnected() {
+			response.Problems = append(response.Problems, fmt.Sprintf(
+				"stream %s not connected yet", stream.Name))
+		}
+	}
+	for _, restore := range response.Restores {
+		if !restore.Done {
+			response.Problems = append(response.Problems, fmt.Sprintf(
+				"stream %s restoring: %d of %d", restore.Name, restore.Restored,
+				restore.Total))
+		}
+	}
+	if !response.Cache.Reachable {
+		response.Problems = append(response.Problems, fmt.Sprintf(
+			"%s cache unreachable", response.Cache.Backend))
+	}
+	a.respond(w, response)
+}
+
+// respond writes the response, with 503 if there are problems.
+func (a *HealthApi) respond(w http.ResponseWriter, response healthResponse) {
+	response.Ok = len(response.Problems) == 0
+	if !response.Ok {
+		writeJsonResponse(w, http.StatusServiceUnavailable, response)
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, response)
+}
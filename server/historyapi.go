@@ -0,0 +1,137 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/persist"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HistoryApi serves trades and candles persisted to the database.
+type HistoryApi struct {
+	feeds map[string]*ExchangeRunner
+}
+
+func NewHistoryApi(feeds map[string]*ExchangeRunner) *HistoryApi {
+	return &HistoryApi{
+		feeds: feeds,
+	}
+}
+
+func (a *HistoryApi) Register(router *mux.Router) {
+	router.HandleFunc("/api/1/{exchange}/history/trades/{symbol}", a.getTrades).Methods("GET")
+	router.HandleFunc("/api/1/{exchange}/history/candles/{symbol}", a.getCandles).Methods("GET")
+}
+
+// parseHistoryRequest returns the feed, store and time range of a request,
+// writing an error response if any are invalid. The range defaults to the
+// period before now given by defaultRange.
+func (a *HistoryApi) parseHistoryRequest(w http.ResponseWriter, r *http.Request,
+	defaultRange time.Duration) (*ExchangeRunner, *persist.Store, time.Time, time.Time, bool) {
+	feed := a.feeds[mux.Vars(r)["exchange"]]
+	if feed == nil {
+		writeJsonError(w, http.StatusNotFound, "unknown exchange")
+		return nil, nil, time.Time{}, time.Time{}, false
+	}
+	store := feed.PersistStore()
+	if store == nil {
+		writeJsonError(w, http.StatusNotFound, "persistence not enabled")
+		return nil, nil, time.Time{}, time.Time{}, false
+	}
+	to, err := parseTimeParam(r.FormValue("to"), time.Now())
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return nil, nil, time.Time{}, time.Time{}, false
+	}
+	from, err := parseTimeParam(r.FormValue("from"), to.Add(-defaultRange))
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return nil, nil, time.Time{}, time.Time{}, false
+	}
+	return feed, store, from, to, true
+}
+
+func historyLimitParam(r *http.Request) (int, bool) {
+	value := r.FormValue("limit")
+	if value == "" {
+		return defaultTradesLimit, true
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 || limit > maxTradesLimit {
+		return 0, false
+	}
+	return limit, true
+}
+
+// getTrades returns persisted trades of a symbol in a time range, which
+// defaults to the last hour.
+func (a *HistoryApi) getTrades(w http.ResponseWriter, r *http.Request) {
+	feed, store, from, to, ok := a.parseHistoryRequest(w, r, time.Hour)
+	if !ok {
+		return
+	}
+	limit, ok := historyLimitParam(r)
+	if !ok {
+		writeJsonError(w, http.StatusBadRequest, "invalid limit")
+		return
+	}
+	symbol, ok := symbolParam(w, r, feed)
+	if !ok {
+		return
+	}
+	trades, err := store.Trades(feed.Name(), symbol, from, to, limit)
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, trades)
+}
+
+// getCandles returns persisted candles of a symbol in a time range, which
+// defaults to the last 24 hours.
+func (a *HistoryApi) getCandles(w http.ResponseWriter, r *http.Request) {
+	feed, store, from, to, ok := a.parseHistoryRequest(w, r, 24*time.Hour)
+	if !ok {
+		return
+	}
+	interval, ok := candleIntervalParam(feed, r)
+	if !ok {
+		writeJsonError(w, http.StatusBadRequest, "unsupported interval")
+		return
+	}
+	limit, ok := historyLimitParam(r)
+	if !ok {
+		writeJsonError(w, http.StatusBadRequest, "invalid limit")
+		return
+	}
+	symbol, ok := symbolParam(w, r, feed)
+	if !ok {
+		return
+	}
+	history, err := store.Candles(feed.Name(), symbol, interval, from, to, limit)
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	response := []candleResponse{}
+	for _, candle := range history {
+		response = append(response, newCandleResponse(candle))
+	}
+	writeJsonResponse(w, http.StatusOK, response)
+}
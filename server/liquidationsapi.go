@@ -0,0 +1,159 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/candles"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/liquidation"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The number of recent liquidations returned for a symbol by default.
+const defaultLiquidationsLimit = 100
+
+// The default window and interval of a liquidation heatmap.
+const (
+	defaultHeatmapWindow   = 24 * time.Hour
+	defaultHeatmapInterval = time.Hour
+)
+
+// LiquidationsApi serves the liquidation volume and recent liquidations of
+// each symbol of futures markets.
+type LiquidationsApi struct {
+	feeds map[string]*ExchangeRunner
+}
+
+func NewLiquidationsApi(feeds map[string]*ExchangeRunner) *LiquidationsApi {
+	return &LiquidationsApi{
+		feeds: feeds,
+	}
+}
+
+func (a *LiquidationsApi) Register(router *mux.Router) {
+	router.HandleFunc("/api/1/{exchange}/liquidations", a.getAll).Methods("GET")
+	router.HandleFunc("/api/1/{exchange}/liquidations/{symbol}", a.getSymbol).Methods("GET")
+	router.HandleFunc("/api/1/{exchange}/liquidations/{symbol}/heatmap", a.getHeatmap).Methods("GET")
+}
+
+func (a *LiquidationsApi) feed(w http.ResponseWriter, r *http.Request) (*ExchangeRunner, bool) {
+	feed := a.feeds[mux.Vars(r)["exchange"]]
+	if feed == nil {
+		writeJsonError(w, http.StatusNotFound, "unknown exchange")
+		return nil, false
+	}
+	if _, ok := feed.Exchange().(pkg.FuturesExchange); !ok {
+		writeJsonError(w, http.StatusNotFound, "not a futures market")
+		return nil, false
+	}
+	return feed, true
+}
+
+// getAll returns the liquidation volume of every symbol with liquidations
+// in the last day.
+func (a *LiquidationsApi) getAll(w http.ResponseWriter, r *http.Request) {
+	feed, ok := a.feed(w, r)
+	if !ok {
+		return
+	}
+	all := feed.Liquidations().VolumeAll(time.Now())
+	for symbol := range all {
+		if feed.IsHidden(symbol) {
+			delete(all, symbol)
+		}
+	}
+	writeJsonResponse(w, http.StatusOK, all)
+}
+
+func (a *LiquidationsApi) getSymbol(w http.ResponseWriter, r *http.Request) {
+	feed, ok := a.feed(w, r)
+	if !ok {
+		return
+	}
+	limit := defaultLiquidationsLimit
+	if value := r.FormValue("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			writeJsonError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+	symbol, ok := symbolParam(w, r, feed)
+	if !ok {
+		return
+	}
+	liquidations := feed.Liquidations()
+	volume := liquidations.Volume(symbol, time.Now())
+	if volume == nil {
+		volume = map[string]liquidation.Volume{}
+	}
+	writeJsonResponse(w, http.StatusOK, map[string]interface{}{
+		"symbol": symbol,
+		"volume": volume,
+		"recent": liquidations.Recent(symbol, limit),
+	})
+}
+
+// getHeatmap returns the liquidations of a symbol bucketed by price and
+// time. The window and interval are given as in candle intervals, such as
+// 4h and 15m, and the price buckets by price_step or a number of buckets.
+func (a *LiquidationsApi) getHeatmap(w http.ResponseWriter, r *http.Request) {
+	feed, ok := a.feed(w, r)
+	if !ok {
+		return
+	}
+	options := liquidation.HeatmapOptions{
+		Window:   defaultHeatmapWindow,
+		Interval: defaultHeatmapInterval,
+	}
+	var err error
+	if value := r.FormValue("window"); value != "" {
+		if options.Window, err = candles.ParseInterval(value); err != nil {
+			writeJsonError(w, http.StatusBadRequest, "invalid window")
+			return
+		}
+	}
+	if value := r.FormValue("interval"); value != "" {
+		if options.Interval, err = candles.ParseInterval(value); err != nil {
+			writeJsonError(w, http.StatusBadRequest, "invalid interval")
+			return
+		}
+	}
+	if value := r.FormValue("price_step"); value != "" {
+		if options.PriceStep, err = strconv.ParseFloat(value, 64); err != nil {
+			writeJsonError(w, http.StatusBadRequest, "invalid price_step")
+			return
+		}
+	}
+	if value := r.FormValue("buckets"); value != "" {
+		if options.Buckets, err = strconv.Atoi(value); err != nil {
+			writeJsonError(w, http.StatusBadRequest, "invalid buckets")
+			return
+		}
+	}
+	if err := options.Validate(); err != nil {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	symbol, ok := symbolParam(w, r, feed)
+	if !ok {
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, feed.Liquidations().Heatmap(symbol, time.Now(), options))
+}
@@ -0,0 +1,98 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"golang.org/x/crypto/acme/autocert"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// listenAddress returns the address the server listens on.
+func listenAddress(options Options) string {
+	return net.JoinHostPort(options.ListenAddress, fmt.Sprintf("%d", options.Port))
+}
+
+// normalizeBasePath returns the base path with a leading slash and no
+// trailing slash, empty for the root.
+func normalizeBasePath(basePath string) string {
+	basePath = strings.Trim(basePath, "/")
+	if basePath == "" {
+		return ""
+	}
+	return "/" + basePath
+}
+
+// withBasePath serves handler under basePath, for proxies that forward
+// the path unchanged. Requests outside of the base path are not found and
+// the base path itself is redirected to its trailing slash form.
+func withBasePath(basePath string, handler http.Handler) http.Handler {
+	if basePath == "" {
+		return handler
+	}
+	stripped := http.StripPrefix(basePath, handler)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == basePath {
+			http.Redirect(w, r, basePath+"/", http.StatusMovedPermanently)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, basePath+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		stripped.ServeHTTP(w, r)
+	})
+}
+
+// listenAndServe serves with TLS from Let's Encrypt if autocert domains
+// are configured, with the configured certificate if there is one, and
+// plain HTTP otherwise.
+func listenAndServe(server *http.Server, options Options) error {
+	if len(options.AutocertDomains) > 0 {
+		cacheDir := options.AutocertCacheDir
+		if cacheDir == "" {
+			cacheDir = filepath.Join(options.DataDir, "autocert")
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(options.AutocertDomains...),
+			Cache:      autocert.DirCache(cacheDir),
+			Email:      options.AutocertEmail,
+		}
+		server.TLSConfig = manager.TLSConfig()
+		if options.AutocertHTTPListen != "" {
+			// Answers HTTP-01 challenges and redirects everything else to
+			// HTTPS.
+			go func() {
+				err := http.ListenAndServe(options.AutocertHTTPListen, manager.HTTPHandler(nil))
+				if err != nil {
+					log.Printf("error: failed to start autocert http server: %v\n", err)
+				}
+			}()
+		}
+		log.Printf("Obtaining certificates for %s from Let's Encrypt\n",
+			strings.Join(options.AutocertDomains, ", "))
+		return server.ListenAndServeTLS("", "")
+	}
+	if options.TLSCert != "" {
+		return server.ListenAndServeTLS(options.TLSCert, options.TLSKey)
+	}
+	return server.ListenAndServe()
+}
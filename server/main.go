@@ -22,13 +22,51 @@ import (
 	"fmt"
 	"github.com/gorilla/mux"
 	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/activity"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/backfill"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/billing"
 	"gitlab.com/crankykernel/cryptoxscanner/pkg/binance"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/kucoin"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/coinbase"
 	"crypto/sha256"
 	"encoding/hex"
 	"math/rand"
+	"math"
 	_ "net/http/pprof"
 	"github.com/gobuffalo/packr"
 	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/metrics"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/events"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/report"
+	"path/filepath"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/alerts"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/archive"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/assets"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/auth"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/journal"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/latency"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/persist"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/publish"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/recorder"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/replay"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/liquidation"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/whale"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/source"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/fix"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/candles"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/anomaly"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/signals"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/spread"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/volumeshare"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/tape"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/prelisting"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/snapshot"
+	"sort"
+	"strings"
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 var salt []byte
@@ -39,40 +77,709 @@ func init() {
 	rand.Read(salt)
 }
 
+// The exchanges built in, as opposed to configured sources.
+var Exchanges = []string{"binance", "kucoin", "coinbase", binance.FuturesName}
+
+// The built in exchanges run by default.
+var DefaultExchanges = []string{"binance", "kucoin"}
+
+// Startup modes. Full runs every subsystem, lite disables the heavy ones:
+// depth books, the indicator engine, and persistence to the journal,
+// recordings, database and archive.
+const (
+	ModeFull = "full"
+	ModeLite = "lite"
+)
+
 type Options struct {
 	Port uint16
+
+	// Address to listen on, all addresses if empty.
+	ListenAddress string
+
+	// Path prefix everything is served under, for a reverse proxy that
+	// forwards the path unchanged. Served at the root if empty.
+	BasePath string
+
+	// Certificate and key files to serve TLS with. Or certificates for
+	// AutocertDomains are obtained from Let's Encrypt and cached in
+	// AutocertCacheDir, defaulting to the autocert directory of DataDir,
+	// with HTTP-01 challenges answered on AutocertHTTPListen if set.
+	TLSCert            string
+	TLSKey             string
+	AutocertDomains    []string
+	AutocertEmail      string
+	AutocertCacheDir   string
+	AutocertHTTPListen string
+
+	// Startup mode, ModeFull or ModeLite.
+	Mode string
+
+	// The built in exchanges to run.
+	Exchanges []string
+
+	// Redis cache of the exchange streams.
+	Redis pkg.RedisOptions
+
+	// The cache backend, redis or an in-memory ring buffer. The retention
+	// is that of Redis.
+	Cache pkg.CacheOptions
+
+	// Stream endpoints keyed by exchange, overriding the fastest found by
+	// probing. Probing is repeated every LatencyProbeInterval, 0 to only
+	// probe on startup.
+	Endpoints            map[string]string
+	LatencyProbeInterval time.Duration
+
+	// Display aliases keyed by symbol or exchange:symbol.
+	SymbolAliases map[string]string
+
+	// Symbols, or exchange:symbol, to hide from all output.
+	HiddenSymbols []string
+
+	// Hours of trade history to backfill from the exchange on startup.
+	BackfillHours int
+
+	// The number of Binance trade streams per websocket connection.
+	BinanceStreamsPerConnection int
+
+	// Directory for persistent data such as reports.
+	DataDir string
+
+	// Journal the trade streams to disk, keeping JournalRetentionHours.
+	Journal               bool
+	JournalRetentionHours int
+
+	// Record every raw websocket message to gzip compressed NDJSON files
+	// in the data directory, starting a new file every RecordRotate and
+	// keeping RecordRetention.
+	Record          bool
+	RecordRotate    time.Duration
+	RecordRetention time.Duration
+
+	// How long events are kept in memory.
+	EventRetention time.Duration
+
+	// How far behind the latest exchange time a trade or ticker may arrive
+	// and still be included in the metrics.
+	AllowedLateness time.Duration
+
+	// The number of trade IDs remembered per symbol to drop duplicate
+	// trades, such as when the restored cache overlaps the live stream.
+	DedupWindow int
+
+	// Database to persist trades, candles and events to, disabled if the
+	// DSN is empty. The driver is sqlite3 or postgres.
+	DatabaseDriver          string
+	DatabaseDSN             string
+	DatabaseTradeRetention  time.Duration
+	DatabaseCandleRetention time.Duration
+	DatabaseEventRetention  time.Duration
+
+	// Object storage events and candles are archived to before deletion
+	// from the database, disabled if no bucket is set.
+	Archive archive.Config
+
+	// Kafka or NATS server trades, tickers and alerts are published to,
+	// disabled if no type is set.
+	Publish publish.Config
+
+	// Alert rules file, reloaded on change.
+	AlertsConfig string
+
+	// Record alerts as events without delivering them, and don't post
+	// metric webhooks.
+	DryRun bool
+
+	// Authentication providers. Authentication is disabled if none are
+	// configured.
+	Auth auth.Config
+
+	// IP allow lists and per-route policies.
+	IPPolicy auth.IPPolicyConfig
+
+	// WebSocket abuse limits.
+	FloodGuard FloodGuardOptions
+
+	// Additional trade sources, exposed like exchanges.
+	Sources []source.Config
+
+	// Volume anomaly baselines keyed by exchange, or "default" for all
+	// exchanges. Exchange entries override the default.
+	Anomaly map[string]anomaly.Config
+
+	// Whale trade thresholds keyed by exchange, or "default" for all
+	// exchanges, like Anomaly.
+	Whales map[string]whale.Config
+
+	// Usage metering, reporting and limits for hosted operators.
+	Billing billing.Config
+
+	// Cross-exchange spread monitoring of the spot exchanges, disabled if
+	// no threshold is set.
+	Spread spread.Config
+
+	// Cross-exchange volume share of the spot exchanges, disabled if no
+	// shift threshold is set.
+	VolumeShare volumeshare.Config
+
+	// Symbols watched for their listing.
+	Prelisting prelisting.Config
+
+	// Combined tape of the trades of each asset across the spot
+	// exchanges, disabled if no size is set.
+	Tape tape.Config
+
+	// Refresh of the symbols of each exchange for listings and delistings.
+	SymbolRefresh pkg.SymbolRefreshConfig
+
+	// Names and icons of the assets of the exchanges, attached to symbol
+	// metadata responses, disabled if no source is set.
+	Assets assets.Config
+
+	// Ticker metric thresholds posted to URLs when crossed.
+	MetricWebhooks []alerts.MetricWebhookConfig
+
+	// Worker pool sizes keyed by exchange, or "default" for all exchanges,
+	// like Anomaly.
+	Workers map[string]pkg.WorkersConfig
+
+	// Activity surge baselines keyed by exchange, or "default" for all
+	// exchanges, like Anomaly.
+	Activity map[string]activity.Config
+
+	// Liquidation event thresholds of futures markets keyed by exchange, or
+	// "default" for all exchanges, like Anomaly.
+	Liquidations map[string]liquidation.Config
+
+	// Symbol include/exclude patterns and quote assets keyed by exchange,
+	// or "default" for all exchanges, like Anomaly.
+	SymbolFilters map[string]pkg.SymbolFilterConfig
+
+	// 24h volume in USD below which symbols are excluded from the ticker
+	// feeds, events and alerts, keyed by exchange or "default" like
+	// Anomaly.
+	VolumeFloor map[string]float64
+
+	// Topic subscriptions of clients that connect with a client ID are
+	// remembered for ClientMemoryTTL after they were last seen, 0 to
+	// disable.
+	ClientMemoryTTL time.Duration
+
+	// On shutdown websocket clients are sent a drain notice and given
+	// ShutdownDrain to disconnect before being closed. DrainRetryAfter is
+	// the hint of when to reconnect.
+	ShutdownDrain   time.Duration
+	DrainRetryAfter time.Duration
+
+	// How long an exchange stream may be down, or connected without a
+	// message, before /healthz fails. 0 disables the check.
+	HealthStaleAfter time.Duration
+
+	// How often exchange trading rules are polled for changes, 0 to
+	// disable.
+	RulesPollInterval time.Duration
+
+	// Replay the trades recorded in the journal or database in place of
+	// the live streams of the exchanges at this speed, such as 10x,
+	// disabled if empty. The range is Unix milliseconds or RFC3339,
+	// defaulting to everything recorded.
+	Replay       string
+	ReplaySource string
+	ReplayFrom   string
+	ReplayTo     string
+	ReplayRebase bool
+
+	// Address to accept FIX market data sessions on, disabled if empty,
+	// and the comp id to accept them as.
+	FixListen string
+	FixCompID string
+
+	// Stream reconnection backoff.
+	ReconnectMaxDelay   time.Duration
+	ReconnectMaxRetries int
+
+	// Send queue size per websocket client, and what to do when it is
+	// full: drop or disconnect.
+	WebSocketQueueSize    int
+	WebSocketSlowConsumer string
+}
+
+// Validate checks the options that would otherwise only fail once the
+// server is running.
+func (o *Options) Validate() error {
+	if o.Port == 0 {
+		return fmt.Errorf("port is required")
+	}
+	if (o.TLSCert == "") != (o.TLSKey == "") {
+		return fmt.Errorf("tls cert and key must be given together")
+	}
+	if o.TLSCert != "" && len(o.AutocertDomains) > 0 {
+		return fmt.Errorf("tls cert and autocert domains are exclusive")
+	}
+	if o.Mode != ModeFull && o.Mode != ModeLite {
+		return fmt.Errorf("invalid mode: %s (available: %s, %s)", o.Mode, ModeFull, ModeLite)
+	}
+	if o.Mode == ModeLite && o.Replay != "" && o.ReplaySource == replay.FromDatabase {
+		return fmt.Errorf("replaying from the database is not available in lite mode")
+	}
+	for _, name := range o.Exchanges {
+		if !isBuiltinExchange(name) {
+			return fmt.Errorf("unknown exchange: %s (available: %s)", name,
+				strings.Join(Exchanges, ", "))
+		}
+	}
+	for name := range o.Endpoints {
+		if !o.HasExchange(name) {
+			return fmt.Errorf("endpoint configured for unknown or disabled exchange: %s", name)
+		}
+	}
+	if o.LatencyProbeInterval < 0 {
+		return fmt.Errorf("latency probe interval must not be negative")
+	}
+	if o.RulesPollInterval < 0 {
+		return fmt.Errorf("rules poll interval must not be negative")
+	}
+	if o.Replay != "" {
+		if _, err := replay.ParseSpeed(o.Replay); err != nil {
+			return err
+		}
+		if o.ReplaySource != replay.FromJournal && o.ReplaySource != replay.FromDatabase {
+			return fmt.Errorf("invalid replay source: %s", o.ReplaySource)
+		}
+		if o.ReplaySource == replay.FromDatabase && o.DatabaseDSN == "" {
+			return fmt.Errorf("replaying from the database requires a database")
+		}
+		if _, err := parseTimeParam(o.ReplayFrom, time.Time{}); err != nil {
+			return fmt.Errorf("invalid replay from: %v", err)
+		}
+		if _, err := parseTimeParam(o.ReplayTo, time.Time{}); err != nil {
+			return fmt.Errorf("invalid replay to: %v", err)
+		}
+	}
+	if o.ClientMemoryTTL < 0 {
+		return fmt.Errorf("client memory ttl must not be negative")
+	}
+	if len(o.Exchanges) == 0 && len(o.Sources) == 0 {
+		return fmt.Errorf("no exchanges or sources configured")
+	}
+	if o.DataDir == "" {
+		return fmt.Errorf("data directory is required")
+	}
+	if o.BackfillHours < 0 || o.JournalRetentionHours < 0 {
+		return fmt.Errorf("backfill and journal retention hours must not be negative")
+	}
+	if o.Record && (o.RecordRotate <= 0 || o.RecordRetention < 0) {
+		return fmt.Errorf("record rotate must be positive and retention not negative")
+	}
+	if o.AllowedLateness < 0 {
+		return fmt.Errorf("allowed lateness must not be negative")
+	}
+	if o.DedupWindow < 0 {
+		return fmt.Errorf("dedup window must not be negative")
+	}
+	if o.BinanceStreamsPerConnection <= 0 {
+		return fmt.Errorf("binance streams per connection must be positive")
+	}
+	if o.Redis.Retention <= 0 {
+		return fmt.Errorf("redis retention must be positive")
+	}
+	if err := o.Cache.Validate(); err != nil {
+		return err
+	}
+	if o.DatabaseDSN != "" && o.DatabaseDriver != persist.DriverSQLite &&
+		o.DatabaseDriver != persist.DriverPostgres {
+		return fmt.Errorf("unsupported database driver: %s", o.DatabaseDriver)
+	}
+	if o.DatabaseTradeRetention < 0 || o.DatabaseCandleRetention < 0 ||
+		o.DatabaseEventRetention < 0 {
+		return fmt.Errorf("database retention must not be negative")
+	}
+	if o.EventRetention <= 0 {
+		return fmt.Errorf("event retention must be positive")
+	}
+	if o.Archive.Enabled() && o.DatabaseDSN == "" {
+		return fmt.Errorf("archiving requires a database")
+	}
+	if o.Publish.Enabled() {
+		if err := publish.DefaultConfig.Override(o.Publish).Validate(); err != nil {
+			return err
+		}
+	}
+	if o.WebSocketQueueSize <= 0 {
+		return fmt.Errorf("websocket queue size must be positive")
+	}
+	policy, err := pkg.ParseOverflowPolicy(o.WebSocketSlowConsumer)
+	if err != nil || policy == pkg.OverflowBlock {
+		return fmt.Errorf("invalid websocket slow consumer policy: %s",
+			o.WebSocketSlowConsumer)
+	}
+	if o.FixListen != "" && o.FixCompID == "" {
+		return fmt.Errorf("fix comp id is required to accept fix sessions")
+	}
+	return nil
+}
+
+// applyMode disables the persistence options in lite mode. The depth books
+// and indicator engine are disabled per feed.
+func (o *Options) applyMode() {
+	if o.Mode != ModeLite {
+		return
+	}
+	o.Journal = false
+	o.Record = false
+	o.DatabaseDSN = ""
+	o.Archive = archive.Config{}
+	o.Tape.ColdRetention = 0
+}
+
+// Lite returns true if the heavy subsystems are disabled.
+func (o *Options) Lite() bool {
+	return o.Mode == ModeLite
+}
+
+// HasExchange returns true if the built in exchange name is enabled.
+func (o *Options) HasExchange(name string) bool {
+	for _, exchange := range o.Exchanges {
+		if exchange == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isBuiltinExchange(name string) bool {
+	for _, exchange := range Exchanges {
+		if exchange == name {
+			return true
+		}
+	}
+	return false
+}
+
+// NewBuiltinExchange creates the built in exchange named name, nil if there
+// is none, without running its streams.
+func NewBuiltinExchange(name string) pkg.Exchange {
+	switch name {
+	case "binance":
+		return binance.NewExchange()
+	case "kucoin":
+		return kucoin.NewExchange()
+	case "coinbase":
+		return coinbase.NewExchange()
+	case binance.FuturesName:
+		return binance.NewFuturesExchange()
+	}
+	return nil
 }
 
 var static packr.Box
 
 func ServerMain(options Options) {
+	if err := options.Validate(); err != nil {
+		log.Fatal("error: invalid configuration: ", err)
+	}
+	options.applyMode()
+
+	// Held until exit so the data directory is not exported, imported or
+	// used by another server while this one writes to it.
+	dataDirLock, err := snapshot.LockDir(options.DataDir)
+	if err != nil {
+		log.Fatal("error: ", options.DataDir, ": ", err)
+	}
+	defer dataDirLock.Unlock()
+
+	if options.Lite() {
+		log.Printf("Running in lite mode: depth books, indicators and persistence are disabled\n")
+	}
 
-	// Start the KuCoin runner.
-	kucoinWebSocketHandler := NewBroadcastWebSocketHandler()
-	go KuCoinRunner(kucoinWebSocketHandler)
+	// Must be set before the exchanges create their stream clients.
+	pkg.DefaultBackoffOptions.Max = options.ReconnectMaxDelay
+	pkg.DefaultBackoffOptions.MaxRetries = options.ReconnectMaxRetries
+	pkg.DefaultRedisOptions = options.Redis
+	pkg.DefaultCacheOptions = options.Cache
+	pkg.DefaultCacheOptions.SnapshotDir = filepath.Join(options.DataDir, "cache")
+	rawRecorder := openRawRecorder(options)
 
-	// Start the Binance runner. This is a little bit of a message as the
+	// Start the exchange runners. This is a little bit of a mess as the
 	// socket can subscribe to specific symbol feeds directly. This should be
 	// abstracted with some sort of broker.
-	binanceFeed := NewBinanceRunner()
-	binanceWebSocketHandler := NewBroadcastWebSocketHandler()
-	binanceFeed.websocket = binanceWebSocketHandler
-	binanceWebSocketHandler.Feed = binanceFeed
-	go binanceFeed.Run()
+	symbols := pkg.NewSymbolRegistry()
+	for key, alias := range options.SymbolAliases {
+		symbols.SetAlias(key, alias)
+	}
+	for _, key := range options.HiddenSymbols {
+		symbols.Hide(key)
+	}
+
+	// Cancelled on SIGINT or SIGTERM to stop the streams.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Recent events from all exchanges.
+	eventStore := events.NewStore(options.EventRetention)
+	eventStore.SetFilter(func(event events.Event) bool {
+		return !symbols.IsHidden(event.Exchange, event.Symbol)
+	})
+
+	alertEngine, err := alerts.NewEngine(options.AlertsConfig, eventStore)
+	if err != nil {
+		log.Fatal("error: failed to load alert rules: ", err)
+	}
+	if options.DryRun {
+		alertEngine.SetDryRun(true)
+		log.Printf("Dry run: alerts are recorded as events but not delivered\n")
+	}
+	// Replayed alerts are not kept across restarts, so they are never
+	// delivered by a live run.
+	if options.Replay == "" {
+		outbox, err := alerts.OpenOutbox(filepath.Join(options.DataDir, "alerts-outbox.json"))
+		if err != nil {
+			log.Fatal("error: failed to open alert outbox: ", err)
+		}
+		alertEngine.SetOutbox(outbox)
+	}
+	alertsDone := make(chan struct{})
+	go func() {
+		defer close(alertsDone)
+		alertEngine.Run(ctx)
+	}()
+	if options.Billing.Enabled {
+		usageMeter, err = billing.NewMeter(billing.DefaultConfig.Override(options.Billing))
+		if err != nil {
+			log.Fatal("error: invalid billing configuration: ", err)
+		}
+		alertEngine.SetUsageMeter(usageMeter)
+		go usageMeter.Run(ctx)
+	}
+	healthMonitor := alerts.NewHealthMonitor(alertEngine)
+	if options.Cache.Backend == pkg.CacheBackendRedis {
+		healthMonitor.SetRedisPing(pkg.NewRedisInputCache("health").Ping)
+	}
+	go healthMonitor.Run(ctx)
+
+	persistStore := openPersistStore(options)
+	if persistStore != nil {
+		// Replayed events are not persisted as they already were when
+		// live.
+		if options.Replay == "" {
+			eventStore.AddSink(persistStore.EventSink())
+		}
+		go persistStore.Run(ctx)
+	}
+
+	if rawRecorder != nil {
+		go rawRecorder.Run(ctx)
+	}
+
+	publisher := openPublisher(options)
+	if publisher != nil {
+		alertEngine.AddSink(NewPublishSink(publisher, ""))
+		go publisher.Run(ctx)
+	}
+
+	startLatencyProbes(ctx, options)
+
+	if options.ClientMemoryTTL > 0 {
+		clientMemory, err = NewClientMemory(filepath.Join(options.DataDir, "clients.json"),
+			options.ClientMemoryTTL)
+		if err != nil {
+			log.Fatal("error: failed to load client subscriptions: ", err)
+		}
+		go clientMemory.Run(ctx)
+	}
+
+	// Replayed tickers are not posted to the metric webhooks.
+	var metricWebhooks *alerts.MetricWebhooks
+	if options.Replay == "" && len(options.MetricWebhooks) > 0 {
+		metricWebhooks = startMetricWebhooks(ctx, options, alertEngine)
+	}
+
+	// Starts the runner of an exchange, returning the handler for its
+	// ticker websockets.
+	startFeed := func(exchange pkg.Exchange) *TickerWebSocketHandler {
+		feed := NewExchangeRunner(exchange, symbols, eventStore, alertEngine)
+		handler := NewBroadcastWebSocketHandler()
+		feed.AddSink(handler)
+		handler.Feed = feed
+		configureSymbolFilter(options, feed)
+		if options.Lite() {
+			feed.DisableDepth()
+			feed.DisableIndicators()
+		}
+		feed.SetRulesInterval(options.RulesPollInterval)
+		feed.SetAllowedLateness(options.AllowedLateness)
+		feed.SetDedupWindow(options.DedupWindow)
+		if options.Replay == "" {
+			openJournal(options, feed)
+			loadCandleHistory(options, feed)
+			persistFeed(persistStore, feed)
+			restoreFeedState(options, feed)
+			configureSymbolRefresh(options, feed)
+		}
+		configureAnomaly(options, feed)
+		configureWhales(options, feed)
+		configureActivity(options, feed)
+		configureLiquidations(options, feed)
+		configureVolumeFloor(options, feed)
+		configureWorkers(options, feed)
+		if metricWebhooks != nil {
+			feed.SetMetricWebhooks(metricWebhooks)
+		}
+		if publisher != nil {
+			sink := NewPublishSink(publisher, feed.Name())
+			feed.AddTradeSink(sink)
+			feed.AddSink(sink)
+		}
+		go feed.Run(ctx)
+		return handler
+	}
+
+	handlers := map[string]*TickerWebSocketHandler{}
+	if options.Replay != "" {
+		for _, name := range options.Exchanges {
+			handlers[name] = startFeed(newReplayExchange(options, name, persistStore))
+			log.Printf("Replaying %s trades from the %s at %s\n", name,
+				options.ReplaySource, options.Replay)
+		}
+	}
+	if options.Replay == "" && options.HasExchange("kucoin") {
+		handlers["kucoin"] = startFeed(kucoin.NewExchange())
+	}
+	if options.Replay == "" && options.HasExchange("coinbase") {
+		handlers["coinbase"] = startFeed(coinbase.NewExchange())
+	}
+	if options.Replay == "" && options.HasExchange("binance") {
+		binanceExchange := binance.NewExchange()
+		binanceExchange.SetHistoryDuration(time.Duration(options.BackfillHours) * time.Hour)
+		binanceExchange.SetStreamsPerConnection(options.BinanceStreamsPerConnection)
+		handlers["binance"] = startFeed(binanceExchange)
+	}
+	if options.Replay == "" && options.HasExchange(binance.FuturesName) {
+		futuresExchange := binance.NewFuturesExchange()
+		futuresExchange.SetHistoryDuration(time.Duration(options.BackfillHours) * time.Hour)
+		futuresExchange.SetStreamsPerConnection(options.BinanceStreamsPerConnection)
+		handlers[binance.FuturesName] = startFeed(futuresExchange)
+	}
+
+	for _, config := range options.Sources {
+		if isBuiltinExchange(config.Name) || handlers[config.Name] != nil {
+			log.Fatal("error: duplicate source name: ", config.Name)
+		}
+		exchange, err := source.New(config)
+		if err != nil {
+			log.Fatal("error: failed to create source: ", err)
+		}
+		handlers[config.Name] = startFeed(exchange)
+		log.Printf("Started %s source %s\n", config.Type, config.Name)
+	}
 
 	router := mux.NewRouter()
 
-	router.HandleFunc("/ws/kucoin/live", kucoinWebSocketHandler.Handle)
-	router.HandleFunc("/ws/kucoin/monitor", kucoinWebSocketHandler.Handle)
+	ipPolicy, err := auth.NewIPPolicy(options.IPPolicy)
+	if err != nil {
+		log.Fatal("error: invalid ip policy: ", err)
+	}
+	router.Use(ipPolicy.Middleware)
+	floodGuard = NewFloodGuard(options.FloodGuard, ipPolicy.ClientIP)
 
-	router.HandleFunc("/ws/binance/live", binanceWebSocketHandler.Handle)
-	router.HandleFunc("/ws/binance/monitor", binanceWebSocketHandler.Handle)
-	router.HandleFunc("/ws/binance/symbol", binanceWebSocketHandler.Handle)
+	// Checked by Validate.
+	policy, _ := pkg.ParseOverflowPolicy(options.WebSocketSlowConsumer)
+	webSocketQueueOptions = pkg.QueueOptions{
+		Size:   options.WebSocketQueueSize,
+		Policy: policy,
+	}
 
-	router.PathPrefix("/api/1/binance/proxy").Handler(binance.NewApiProxy())
+	authenticator := newAuthenticator(options.Auth, normalizeBasePath(options.BasePath), router)
+	router.Use(authenticator.Middleware(isPublicRequest))
+	router.HandleFunc("/api/1/auth/whoami", whoamiHandler)
+
+	names := []string{}
+	for name := range handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	feeds := map[string]*ExchangeRunner{}
+	reportSources := []report.Source{}
+	for _, name := range names {
+		handler := handlers[name]
+		router.HandleFunc(fmt.Sprintf("/ws/%s/live", name), handler.Handle)
+		router.HandleFunc(fmt.Sprintf("/ws/%s/monitor", name), handler.Handle)
+		router.HandleFunc(fmt.Sprintf("/ws/%s/symbol", name), handler.Handle)
+		feeds[name] = handler.Feed
+		reportSources = append(reportSources, handler.Feed)
+	}
+	router.Use(exchangePermissions(feeds))
+
+	if binanceFeed := feeds["binance"]; binanceFeed != nil {
+		if binanceFeed.DepthStream() != nil {
+			router.HandleFunc("/ws/binance/depth",
+				NewDepthWebSocketHandler(binanceFeed).Handle)
+		}
+		router.PathPrefix("/api/1/binance/proxy").Handler(binance.NewApiProxy())
+	}
+
+	var assetMetadata *assets.Store
+	if options.Assets.Enabled() {
+		assetMetadata = startAssetMetadata(ctx, options, feeds)
+	}
+	NewSymbolsApi(symbols, feeds, assetMetadata).Register(router)
+	NewCandlesApi(feeds).Register(router)
+	NewEventsApi(feeds).Register(router)
+	NewTradesApi(feeds).Register(router)
+	NewStatsApi(feeds).Register(router)
+	NewTickersApi(feeds).Register(router)
+	NewHistoryApi(feeds).Register(router)
+	NewSandboxApi(feeds).Register(router)
+	NewWhalesApi(feeds).Register(router)
+	NewFuturesApi(feeds).Register(router)
+	NewLiquidationsApi(feeds).Register(router)
+	NewWorkersApi(feeds).Register(router)
+	NewBackfillApi(startBackfillScheduler(ctx, persistStore, feeds)).Register(router)
+	if options.Spread.Enabled() {
+		spreadMonitor := startSpreadMonitor(ctx, options, feeds, eventStore, alertEngine)
+		NewSpreadsApi(spreadMonitor).Register(router)
+	}
+	if options.VolumeShare.Enabled() {
+		volumeShareMonitor := startVolumeShareMonitor(ctx, options, feeds, eventStore, alertEngine)
+		NewVolumeShareApi(volumeShareMonitor).Register(router)
+	}
+	NewPrelistingApi(startPrelistingWatcher(ctx, options, feeds, eventStore, alertEngine)).Register(router)
+	var combinedTape *tape.Tape
+	if options.Tape.Enabled() {
+		combinedTape = startTape(ctx, options, feeds)
+		NewTapeApi(combinedTape).Register(router)
+	}
+	for name, feed := range feeds {
+		hub := NewTopicHub(feed)
+		feed.Exchange().TradeStream().AddSink(hub)
+		feed.AddSink(hub)
+		feed.Statuses().AddSink(hub)
+		router.HandleFunc(fmt.Sprintf("/ws/%s/topics", name), hub.Handle)
+	}
+
+	dailyReports := report.NewDailyGenerator(filepath.Join(options.DataDir, "reports", "daily"),
+		eventStore, reportSources...)
+	go dailyReports.Run(ctx)
+	NewReportsApi(dailyReports).Register(router)
+	NewAlertsApi(alertEngine, eventStore).Register(router)
+	NewCapabilitiesApi(options, feeds, alertEngine, authenticator).Register(router)
+
+	signalFeed := signals.NewFeed()
+	eventStore.AddSink(signalFeed)
+	NewSignalsApi(signalFeed).Register(router)
+
+	var fixServer *fix.Server
+	if options.FixListen != "" {
+		fixServer = startFixServer(options, feeds)
+	}
 
 	router.HandleFunc("/api/1/ping", pingHandler)
+	NewHealthApi(options.Cache.Backend, options.HealthStaleAfter).Register(router)
 	router.HandleFunc("/api/1/status/websockets", webSocketsStatusHandler)
+	router.HandleFunc("/api/1/status/subscribers", subscribersStatusHandler)
+	router.HandleFunc("/api/1/status/bus", busStatusHandler)
+	router.HandleFunc("/api/1/status/endpoints", endpointsStatusHandler)
 
 	static := packr.NewBox("../webapp/dist")
 	staticServer := http.FileServer(static)
@@ -84,14 +791,743 @@ func ServerMain(options Options) {
 		staticServer.ServeHTTP(w, r)
 	})
 
+	// The metrics name API keys and accounts, so are only served on
+	// localhost.
+	http.Handle("/metrics", metrics.Handler())
+	http.Handle("/debug/metrics/audit", NewMetricAuditApi(feeds))
 	go func() {
 		err := http.ListenAndServe(fmt.Sprintf("127.0.0.1:%d", options.Port+1), nil)
 		if err != nil {
 			log.Printf("error: failed to start debug server: %v\n", err)
 		}
 	}()
-	log.Printf("Starting server on port %d.", options.Port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", options.Port), router))
+	basePath := normalizeBasePath(options.BasePath)
+	server := &http.Server{
+		Addr:    listenAddress(options),
+		Handler: withBasePath(basePath, router),
+	}
+	go func() {
+		log.Printf("Starting server on %s%s.", server.Addr, basePath)
+		if err := listenAndServe(server, options); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Printf("Received %v, shutting down.\n", sig)
+	drainWebSockets(options, signals)
+
+	if fixServer != nil {
+		fixServer.Close()
+	}
+
+	runners := []*ExchangeRunner{}
+	for _, feed := range feeds {
+		runners = append(runners, feed)
+	}
+	shutdown(server, cancel, alertsDone, persistStore, rawRecorder, publisher, combinedTape, runners...)
+}
+
+// drainWebSockets sends the drain notice to websocket clients and refuses
+// new ones, then waits for the drain period. A second signal skips the
+// wait.
+func drainWebSockets(options Options, signals chan os.Signal) {
+	if options.ShutdownDrain <= 0 {
+		return
+	}
+	drainState.Start("restart", options.DrainRetryAfter)
+	log.Printf("Draining websocket clients for %v.\n", options.ShutdownDrain)
+	select {
+	case <-time.After(options.ShutdownDrain):
+	case sig := <-signals:
+		log.Printf("Received %v, skipping drain.\n", sig)
+	}
+}
+
+// The maximum time to wait for in-flight requests and the feeds to stop
+// before exiting anyway.
+const shutdownTimeout = 10 * time.Second
+
+// shutdown stops accepting connections, closes the websockets, then cancels
+// the streams and waits for the feeds to flush. The persist store, raw
+// recorder and publisher, if any, are closed once the feeds have stopped so
+// no trades, candles or messages are lost.
+func shutdown(server *http.Server, cancel context.CancelFunc, alertsDone chan struct{},
+	persistStore *persist.Store, rawRecorder *recorder.Recorder, publisher *publish.Publisher,
+	combinedTape *tape.Tape, feeds ...*ExchangeRunner) {
+	timeout, cancelTimeout := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelTimeout()
+
+	if err := server.Shutdown(timeout); err != nil {
+		log.Printf("error: http server shutdown: %v\n", err)
+	}
+	closeWebSockets()
+	if clientMemory != nil {
+		if err := clientMemory.Save(); err != nil {
+			log.Printf("error: failed to save client subscriptions: %v\n", err)
+		}
+	}
+
+	cancel()
+	for _, feed := range feeds {
+		select {
+		case <-feed.Done():
+		case <-timeout.Done():
+			log.Printf("error: timed out waiting for %s to stop\n", feed.Name())
+		}
+	}
+	select {
+	case <-alertsDone:
+	case <-timeout.Done():
+		log.Printf("error: timed out delivering queued alerts\n")
+	}
+
+	// Nothing is published once the feeds have stopped, closing the bus
+	// ends the remaining subscribers.
+	pkg.DefaultBus.Close()
+	pkg.SaveInputCaches()
+	if combinedTape != nil {
+		if err := combinedTape.Close(); err != nil {
+			log.Printf("error: failed to close tape cold store: %v\n", err)
+		}
+	}
+	if usageMeter != nil {
+		select {
+		case <-usageMeter.Done():
+		case <-timeout.Done():
+			log.Printf("error: timed out reporting usage\n")
+		}
+	}
+	if persistStore != nil {
+		if err := persistStore.Close(); err != nil {
+			log.Printf("error: failed to close database: %v\n", err)
+		}
+	}
+	if rawRecorder != nil {
+		select {
+		case <-rawRecorder.Done():
+			if err := rawRecorder.Close(); err != nil {
+				log.Printf("error: failed to close raw recorder: %v\n", err)
+			}
+		case <-timeout.Done():
+			log.Printf("error: timed out waiting for the raw recorder to stop\n")
+		}
+	}
+	if publisher != nil {
+		select {
+		case <-publisher.Done():
+			if err := publisher.Close(timeout); err != nil {
+				log.Printf("error: failed to close publisher: %v\n", err)
+			}
+		case <-timeout.Done():
+			log.Printf("error: timed out waiting for the publisher to stop\n")
+		}
+	}
+	log.Printf("Shutdown complete.\n")
+}
+
+// startFixServer publishes the trades of every feed to FIX consumers. The
+// feeds are added in name order, the first being the default exchange for
+// requests that don't specify one.
+func startFixServer(options Options, feeds map[string]*ExchangeRunner) *fix.Server {
+	fixServer := fix.NewServer(options.FixCompID)
+	names := []string{}
+	for name := range feeds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		feeds[name].AddTradeSink(fixServer.Sink(name))
+	}
+	go func() {
+		if err := fixServer.ListenAndServe(options.FixListen); err != nil {
+			log.Printf("fix: server stopped: %v\n", err)
+		}
+	}()
+	return fixServer
+}
+
+// startBackfillScheduler runs the on demand backfill jobs of the exchanges
+// that support them, writing to the database. Nil is returned without a
+// database.
+func startBackfillScheduler(ctx context.Context, store *persist.Store,
+	feeds map[string]*ExchangeRunner) *backfill.Scheduler {
+	if store == nil {
+		return nil
+	}
+	scheduler := backfill.NewScheduler(store)
+	for name, feed := range feeds {
+		if source, ok := feed.Exchange().(backfill.Source); ok {
+			scheduler.AddSource(name, source)
+		}
+	}
+	go scheduler.Run(ctx)
+	return scheduler
+}
+
+// startSpreadMonitor matches the pairs of the spot exchanges and raises an
+// alert, recorded as an event on the cheaper exchange, when their spread
+// stays wide.
+func startSpreadMonitor(ctx context.Context, options Options, feeds map[string]*ExchangeRunner,
+	eventStore *events.Store, alertEngine *alerts.Engine) *spread.Monitor {
+	config := spread.DefaultConfig.Override(options.Spread)
+	if err := config.Validate(); err != nil {
+		log.Fatal("error: invalid spread configuration: ", err)
+	}
+	monitor := spread.NewMonitor(config, func(alert spread.Alert) {
+		message := alert.Message()
+		eventStore.Add(events.Event{
+			Type:      events.TypeSpread,
+			Exchange:  alert.Low.Exchange,
+			Symbol:    alert.Low.Symbol,
+			Timestamp: time.Now(),
+			Message:   message,
+			Data: map[string]interface{}{
+				"pair":          alert.Pair,
+				"pct":           alert.Pct,
+				"duration":      alert.Duration.Seconds(),
+				"high_exchange": alert.High.Exchange,
+				"high_price":    alert.High.Price,
+				"low_exchange":  alert.Low.Exchange,
+				"low_price":     alert.Low.Price,
+			},
+		})
+		alertEngine.FireMonitor("spread", alert.Low.Exchange, alert.Low.Symbol, message,
+			map[string]float64{
+				"spread_pct": alert.Pct,
+				"high_price": alert.High.Price,
+				"low_price":  alert.Low.Price,
+			}, config.Webhooks, config.Notify)
+	})
+	names := []string{}
+	for name, feed := range feeds {
+		if feed.Exchange().Market() != pkg.MarketSpot {
+			continue
+		}
+		feed.AddTradeSink(monitor.Sink(name))
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	go monitor.Run(ctx)
+	log.Printf("Monitoring spreads of at least %v%% for %v across %s\n",
+		config.ThresholdPct, config.Duration, strings.Join(names, ", "))
+	return monitor
+}
+
+// startVolumeShareMonitor tracks the volume share of each asset across the
+// spot exchanges and raises an alert, recorded as an event on the exchange
+// whose share moved, when it shifts abruptly.
+func startVolumeShareMonitor(ctx context.Context, options Options, feeds map[string]*ExchangeRunner,
+	eventStore *events.Store, alertEngine *alerts.Engine) *volumeshare.Monitor {
+	config := volumeshare.DefaultConfig.Override(options.VolumeShare)
+	if err := config.Validate(); err != nil {
+		log.Fatal("error: invalid volume share configuration: ", err)
+	}
+	monitor := volumeshare.NewMonitor(config, func(shift volumeshare.Shift) {
+		message := shift.Message()
+		eventStore.Add(events.Event{
+			Type:      events.TypeVolumeShare,
+			Exchange:  shift.Exchange,
+			Symbol:    shift.Symbol,
+			Timestamp: time.Now(),
+			Message:   message,
+			Data: map[string]interface{}{
+				"asset":        shift.Asset,
+				"share_pct":    shift.SharePct,
+				"baseline_pct": shift.BaselinePct,
+				"change_pct":   shift.ChangePct,
+				"window":       shift.Window.Seconds(),
+				"baseline":     shift.Baseline.Seconds(),
+			},
+		})
+		alertEngine.FireMonitor("volume_share", shift.Exchange, shift.Symbol, message,
+			map[string]float64{
+				"share_pct":    shift.SharePct,
+				"baseline_pct": shift.BaselinePct,
+				"change_pct":   shift.ChangePct,
+			}, config.Webhooks, config.Notify)
+	})
+	names := []string{}
+	for name, feed := range feeds {
+		if feed.Exchange().Market() != pkg.MarketSpot {
+			continue
+		}
+		feed.AddTradeSink(monitor.Sink(name, feed.Rates))
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	go monitor.Run(ctx)
+	log.Printf("Monitoring volume share shifts of at least %v points across %s\n",
+		config.ShiftPct, strings.Join(names, ", "))
+	return monitor
+}
+
+// startPrelistingWatcher watches for the listing of the symbols in the
+// config and those added through the API, raising a high priority event and
+// alert with the first trade of each.
+func startPrelistingWatcher(ctx context.Context, options Options, feeds map[string]*ExchangeRunner,
+	eventStore *events.Store, alertEngine *alerts.Engine) *prelisting.Watcher {
+	config := prelisting.DefaultConfig.Override(options.Prelisting)
+	if err := config.Validate(); err != nil {
+		log.Fatal("error: invalid pre-listing configuration: ", err)
+	}
+	watcher, err := prelisting.NewWatcher(config, filepath.Join(options.DataDir, "prelisting.json"),
+		func(watch prelisting.Watch) {
+			message := watch.Message()
+			eventStore.Add(events.Event{
+				Type:      events.TypeListingLive,
+				Exchange:  watch.Exchange,
+				Symbol:    watch.Symbol,
+				Timestamp: watch.FirstTrade.ReceivedAt,
+				Message:   message,
+				Data: map[string]interface{}{
+					"priority":    "high",
+					"price":       watch.FirstTrade.Price,
+					"quantity":    watch.FirstTrade.Quantity,
+					"trade_time":  watch.FirstTrade.Timestamp.UnixNano() / int64(time.Millisecond),
+					"listed_time": watch.ListedAt.UnixNano() / int64(time.Millisecond),
+				},
+			})
+			alertEngine.FireMonitor("listing_live", watch.Exchange, watch.Symbol, message,
+				map[string]float64{
+					"price":    watch.FirstTrade.Price,
+					"quantity": watch.FirstTrade.Quantity,
+				}, config.Webhooks, config.Notify)
+		})
+	if err != nil {
+		log.Fatal("error: failed to load pre-listing watches: ", err)
+	}
+	for name, feed := range feeds {
+		stream := feed.Exchange().TradeStream()
+		var refresh func()
+		if refresher, ok := stream.(pkg.SymbolRefresher); ok {
+			refresh = refresher.RefreshSymbols
+		}
+		watcher.AddExchange(name, feed.Exchange().GetSymbols, refresh)
+		stream.AddSink(watcher.Sink(name))
+	}
+	go watcher.Run(ctx)
+	return watcher
+}
+
+// startAssetMetadata loads the cached metadata of the assets and starts
+// refreshing the metadata of the base and quote assets of the symbols of
+// the exchanges.
+func startAssetMetadata(ctx context.Context, options Options, feeds map[string]*ExchangeRunner) *assets.Store {
+	config := assets.DefaultConfig.Override(options.Assets)
+	if err := config.Validate(); err != nil {
+		log.Fatal("error: invalid asset metadata configuration: ", err)
+	}
+	store, err := assets.NewStore(config, filepath.Join(options.DataDir, "assets.json"),
+		func() []string {
+			wanted := []string{}
+			for _, feed := range feeds {
+				for _, symbol := range feed.Symbols() {
+					if base, quote, ok := pkg.SplitSymbol(symbol); ok {
+						wanted = append(wanted, base, quote)
+					}
+				}
+			}
+			return wanted
+		})
+	if err != nil {
+		log.Fatal("error: failed to load asset metadata: ", err)
+	}
+	go store.Run(ctx)
+	return store
+}
+
+// startMetricWebhooks starts posting the metric webhooks crossed by the
+// ticker updates.
+func startMetricWebhooks(ctx context.Context, options Options,
+	alertEngine *alerts.Engine) *alerts.MetricWebhooks {
+	hooks, err := alerts.NewMetricWebhooks(options.MetricWebhooks)
+	if err != nil {
+		log.Fatal("error: invalid metric webhooks configuration: ", err)
+	}
+	// Dry run with the alerts.
+	hooks.SetDryRun(alertEngine.DryRun)
+	go hooks.Run(ctx)
+	log.Printf("Loaded %d metric webhooks\n", len(options.MetricWebhooks))
+	return hooks
+}
+
+// startTape merges the trades of the spot exchanges into the combined tape
+// of each asset.
+func startTape(ctx context.Context, options Options, feeds map[string]*ExchangeRunner) *tape.Tape {
+	config := tape.DefaultConfig.Override(options.Tape)
+	if err := config.Validate(); err != nil {
+		log.Fatal("error: invalid tape configuration: ", err)
+	}
+	combined := tape.NewTape(config)
+	if config.ColdRetention > 0 {
+		dir := filepath.Join(options.DataDir, "tape")
+		cold, err := tape.OpenJournalStore(dir, config.ColdRetention)
+		if err != nil {
+			log.Fatal("error: failed to open tape cold store: ", err)
+		}
+		combined.SetColdStore(cold)
+		go cold.Run(ctx)
+		log.Printf("Archiving tape trades to %s for %v\n", dir, config.ColdRetention)
+	}
+	names := []string{}
+	for name, feed := range feeds {
+		if feed.Exchange().Market() != pkg.MarketSpot {
+			continue
+		}
+		feed.AddTradeSink(combined.Sink(name, feed.Rates))
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	go combined.Run(ctx)
+	log.Printf("Merging trades of %s into the combined tape with a %v reordering delay\n",
+		strings.Join(names, ", "), config.Delay)
+	return combined
+}
+
+// startLatencyProbes selects the stream endpoint of each exchange, by
+// probing or from the config, before the streams connect. KuCoin servers
+// are only known on connect so are probed then.
+func startLatencyProbes(ctx context.Context, options Options) {
+	probers := map[string]*latency.Prober{
+		"binance":           binance.StreamProber,
+		"kucoin":            kucoin.StreamProber,
+		"coinbase":          coinbase.StreamProber,
+		binance.FuturesName: binance.FuturesStreamProber,
+	}
+	for name, prober := range probers {
+		if !options.HasExchange(name) {
+			continue
+		}
+		if endpoint := options.Endpoints[name]; endpoint != "" {
+			prober.SetOverride(endpoint)
+			log.Printf("%s: using configured endpoint %s\n", name, endpoint)
+			continue
+		}
+		prober.Probe()
+		if options.LatencyProbeInterval > 0 {
+			go prober.Run(ctx, options.LatencyProbeInterval)
+		}
+	}
+}
+
+// openPublisher connects to the Kafka or NATS server output is published to,
+// if enabled.
+func openPublisher(options Options) *publish.Publisher {
+	if !options.Publish.Enabled() {
+		return nil
+	}
+	config := publish.DefaultConfig.Override(options.Publish)
+	publisher, err := publish.NewPublisher(config)
+	if err != nil {
+		log.Fatal("error: failed to connect publisher: ", err)
+	}
+	log.Printf("Publishing %s to %s\n", strings.Join(config.Publish, ", "), config.Type)
+	return publisher
+}
+
+// openRawRecorder creates the recorder of raw stream messages if enabled,
+// setting it as the raw recorder of the exchange streams. Nothing is
+// recorded when replaying.
+func openRawRecorder(options Options) *recorder.Recorder {
+	if !options.Record || options.Replay != "" {
+		return nil
+	}
+	recorderOptions := recorder.DefaultOptions
+	recorderOptions.RotateInterval = options.RecordRotate
+	recorderOptions.Retention = options.RecordRetention
+	dir := filepath.Join(options.DataDir, "recordings")
+	rawRecorder, err := recorder.NewRecorder(dir, recorderOptions)
+	if err != nil {
+		log.Fatal("error: failed to open raw recorder: ", err)
+	}
+	pkg.SetRawRecorder(rawRecorder)
+	log.Printf("Recording raw stream messages to %s\n", dir)
+	return rawRecorder
+}
+
+func openJournal(options Options, feed *ExchangeRunner) {
+	if !options.Journal {
+		return
+	}
+	journalOptions := journal.DefaultOptions
+	journalOptions.Retention = time.Duration(options.JournalRetentionHours) * time.Hour
+	dir := JournalDir(options.DataDir, feed.Name())
+	if err := feed.OpenJournal(dir, journalOptions); err != nil {
+		log.Fatal("error: failed to open journal: ", err)
+	}
+	log.Printf("Journaling %s trades to %s\n", feed.Name(), dir)
+}
+
+// JournalDir returns the directory the trades of an exchange are journaled
+// to.
+func JournalDir(dataDir string, exchange string) string {
+	return filepath.Join(dataDir, "journal", exchange, "trades")
+}
+
+// newReplayExchange returns an exchange replaying the recorded trades of
+// the exchange name, as configured by the replay options.
+func newReplayExchange(options Options, name string, store *persist.Store) pkg.Exchange {
+	// Checked by Validate.
+	speed, _ := replay.ParseSpeed(options.Replay)
+	from, _ := parseTimeParam(options.ReplayFrom, time.Unix(0, 0))
+	to, _ := parseTimeParam(options.ReplayTo, time.Now())
+
+	reader := replay.DatabaseReader(store, name)
+	if options.ReplaySource == replay.FromJournal {
+		var err error
+		reader, err = replay.JournalReader(JournalDir(options.DataDir, name))
+		if err != nil {
+			log.Fatal(fmt.Sprintf("error: %s: failed to open journal for replay: ", name), err)
+		}
+	}
+	return source.NewExchange(name, replay.NewSource(reader, replay.Options{
+		Speed:  speed,
+		Rebase: options.ReplayRebase,
+		From:   from,
+		To:     to,
+	}))
+}
+
+// CandleHistoryDir returns the directory imported candles are stored in for
+// an exchange.
+func CandleHistoryDir(dataDir string, exchange string) string {
+	return filepath.Join(dataDir, "candles", exchange)
+}
+
+func loadCandleHistory(options Options, feed *ExchangeRunner) {
+	store := candles.NewHistoryStore(CandleHistoryDir(options.DataDir, feed.Name()))
+	if err := feed.LoadCandleHistory(store); err != nil {
+		log.Printf("error: %s: failed to load candle history: %v\n", feed.Name(), err)
+	}
+}
+
+// restoreFeedState restores the in-progress state of feed saved by the last
+// shutdown, to be saved again on this one.
+func restoreFeedState(options Options, feed *ExchangeRunner) {
+	if err := feed.SetStateFile(FeedStateFile(options.DataDir, feed.Name())); err != nil {
+		log.Printf("error: %s: failed to restore in-progress state: %v\n", feed.Name(), err)
+	}
+}
+
+func openPersistStore(options Options) *persist.Store {
+	if options.DatabaseDSN == "" {
+		return nil
+	}
+	config := persist.DefaultConfig
+	config.Driver = options.DatabaseDriver
+	config.DSN = options.DatabaseDSN
+	config.TradeRetention = options.DatabaseTradeRetention
+	config.CandleRetention = options.DatabaseCandleRetention
+	config.EventRetention = options.DatabaseEventRetention
+	store, err := persist.Open(config)
+	if err != nil {
+		log.Fatal("error: failed to open database: ", err)
+	}
+	log.Printf("Persisting trades, candles and events to %s database\n", config.Driver)
+	if options.Archive.Enabled() {
+		archiver, err := archive.NewArchiver(archive.DefaultConfig.Override(options.Archive))
+		if err != nil {
+			log.Fatal("error: invalid archive configuration: ", err)
+		}
+		store.SetArchiver(archiver)
+		log.Printf("Archiving expired events and candles to bucket %s\n", options.Archive.Bucket)
+	}
+	return store
+}
+
+// persistFeed loads the persisted candles of feed then persists its trades
+// and candles, if persistence is enabled.
+func persistFeed(store *persist.Store, feed *ExchangeRunner) {
+	if store == nil {
+		return
+	}
+	if err := feed.LoadPersistedCandles(store); err != nil {
+		log.Printf("error: %s: failed to load persisted candles: %v\n", feed.Name(), err)
+	}
+	feed.SetPersistStore(store)
+}
+
+func configureWhales(options Options, feed *ExchangeRunner) {
+	config := whale.DefaultConfig.
+		Override(options.Whales["default"]).
+		Override(options.Whales[feed.Name()])
+	if err := feed.SetWhaleConfig(config); err != nil {
+		log.Fatal(fmt.Sprintf("error: %s: invalid whale configuration: ", feed.Name()), err)
+	}
+}
+
+func configureActivity(options Options, feed *ExchangeRunner) {
+	config := activity.DefaultConfig.
+		Override(options.Activity["default"]).
+		Override(options.Activity[feed.Name()])
+	if err := feed.SetActivityConfig(config); err != nil {
+		log.Fatal(fmt.Sprintf("error: %s: invalid activity configuration: ", feed.Name()), err)
+	}
+}
+
+func configureLiquidations(options Options, feed *ExchangeRunner) {
+	config := liquidation.DefaultConfig.
+		Override(options.Liquidations["default"]).
+		Override(options.Liquidations[feed.Name()])
+	if err := feed.SetLiquidationConfig(config); err != nil {
+		log.Fatal(fmt.Sprintf("error: %s: invalid liquidation configuration: ", feed.Name()), err)
+	}
+}
+
+func configureSymbolFilter(options Options, feed *ExchangeRunner) {
+	config := options.SymbolFilters["default"].
+		Override(options.SymbolFilters[feed.Name()])
+	if config.IsEmpty() {
+		return
+	}
+	filter, err := pkg.NewSymbolFilter(config)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("error: %s: invalid symbol filter: ", feed.Name()), err)
+	}
+	feed.SetSymbolFilter(filter)
+	log.Printf("%s: symbol filter: include %v, exclude %v, quotes %v\n",
+		feed.Name(), config.Include, config.Exclude, config.Quotes)
+}
+
+func configureSymbolRefresh(options Options, feed *ExchangeRunner) {
+	config := pkg.DefaultSymbolRefreshConfig.Override(options.SymbolRefresh)
+	if err := config.Validate(); err != nil {
+		log.Fatal("error: invalid symbol refresh configuration: ", err)
+	}
+	feed.SetSymbolRefresh(config)
+}
+
+func configureVolumeFloor(options Options, feed *ExchangeRunner) {
+	floor, ok := options.VolumeFloor[feed.Name()]
+	if !ok {
+		floor = options.VolumeFloor["default"]
+	}
+	if floor > 0 {
+		feed.SetVolumeFloor(floor)
+		log.Printf("%s: excluding symbols with a 24h volume below $%.0f\n", feed.Name(), floor)
+	}
+}
+
+func configureWorkers(options Options, feed *ExchangeRunner) {
+	config := options.Workers["default"].Override(options.Workers[feed.Name()])
+	if config == (pkg.WorkersConfig{}) {
+		return
+	}
+	if err := feed.SetWorkers(config); err != nil {
+		log.Fatal(fmt.Sprintf("error: %s: invalid workers configuration: ", feed.Name()), err)
+	}
+	workers := feed.Workers()
+	log.Printf("%s: %d decode workers, %d metric workers\n", feed.Name(),
+		workers.Decode, workers.Metrics)
+}
+
+func configureAnomaly(options Options, feed *ExchangeRunner) {
+	config := anomaly.DefaultConfig.
+		Override(options.Anomaly["default"]).
+		Override(options.Anomaly[feed.Name()])
+	if err := feed.SetAnomalyConfig(config); err != nil {
+		log.Fatal(fmt.Sprintf("error: %s: invalid anomaly configuration: ", feed.Name()), err)
+	}
+	if config != anomaly.DefaultConfig {
+		log.Printf("%s: volume baseline %s, window %d, threshold %v\n",
+			feed.Name(), config.Model, config.Window, config.Threshold)
+	}
+}
+
+// ExchangeDetectorOptions returns the options the events of exchange are
+// detected with as configured by options, for detecting events outside of
+// a running exchange such as with the replay command.
+func ExchangeDetectorOptions(options Options, exchange string) events.DetectorOptions {
+	detector := events.DefaultDetectorOptions
+	detector.Whale = whale.DefaultConfig.
+		Override(options.Whales["default"]).
+		Override(options.Whales[exchange])
+	detector.Liquidation = liquidation.DefaultConfig.
+		Override(options.Liquidations["default"]).
+		Override(options.Liquidations[exchange])
+	detector.VolumeSpike = anomaly.DefaultConfig.
+		Override(options.Anomaly["default"]).
+		Override(options.Anomaly[exchange])
+	detector.ActivitySurge = activity.DefaultConfig.
+		Override(options.Activity["default"]).
+		Override(options.Activity[exchange])
+	return detector
+}
+
+func newAuthenticator(config auth.Config, basePath string, router *mux.Router) *auth.Authenticator {
+	providers := []auth.Provider{}
+	if len(config.Tokens) > 0 {
+		providers = append(providers, auth.NewStaticTokenProvider(config.Tokens))
+	}
+	if len(config.Keys) > 0 {
+		provider, err := auth.NewAPIKeyProvider(config.Keys)
+		if err != nil {
+			log.Fatal("error: invalid api keys: ", err)
+		}
+		providers = append(providers, provider)
+	}
+	if config.OIDC != nil {
+		provider, err := auth.NewOIDCProvider(*config.OIDC)
+		if err != nil {
+			log.Fatal("error: failed to initialize oidc: ", err)
+		}
+		provider.SetBasePath(basePath)
+		router.HandleFunc("/auth/login", provider.HandleLogin)
+		router.HandleFunc("/auth/callback", provider.HandleCallback)
+		providers = append(providers, provider)
+	}
+	for _, provider := range providers {
+		log.Printf("Authentication provider enabled: %s\n", provider.Name())
+	}
+	return auth.NewAuthenticator(providers...)
+}
+
+// isPublicRequest returns true for requests that do not require
+// authentication: the frontend, the login flow, the ping endpoint and the
+// health checks.
+func isPublicRequest(r *http.Request) bool {
+	path := r.URL.Path
+	if path == "/api/1/ping" || path == "/healthz" || path == "/readyz" {
+		return true
+	}
+	return !strings.HasPrefix(path, "/api/") && !strings.HasPrefix(path, "/ws/")
+}
+
+// exchangePermissions refuses requests to the REST API of an exchange,
+// /api/1/<exchange>/<resource>/..., unless the identity of the request is
+// permitted <exchange>/<resource>, matched as streams and topics are, so
+// binance/* allows the whole API of binance.
+func exchangePermissions(feeds map[string]*ExchangeRunner) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, "/api/1/") {
+				parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/api/1/"), "/", 3)
+				if len(parts) > 1 && feeds[parts[0]] != nil &&
+					!auth.GetIdentity(r).AllowsTopic(parts[0]+"/"+parts[1]) {
+					http.Error(w, "not permitted", http.StatusForbidden)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func whoamiHandler(w http.ResponseWriter, r *http.Request) {
+	identity := auth.GetIdentity(r)
+	if identity == nil {
+		writeJsonResponse(w, http.StatusOK, map[string]interface{}{
+			"authenticated": false,
+		})
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, map[string]interface{}{
+		"authenticated": true,
+		"identity":      identity,
+	})
 }
 
 func buildUpdateMessage(tracker *pkg.TickerTracker) map[string]interface{} {
@@ -146,6 +1582,34 @@ func buildUpdateMessage(tracker *pkg.TickerTracker) map[string]interface{} {
 	return message
 }
 
+// addTradeMetrics adds the metrics that can only be calculated from trades
+// to an update message.
+func addTradeMetrics(update map[string]interface{}, tracker *pkg.TickerTracker) {
+	if tracker.HaveVwap {
+		for i, k := range tracker.Metrics {
+			update[fmt.Sprintf("vwap_%dm", i)] = pkg.Round8(k.Vwap)
+		}
+	}
+
+	if tracker.HaveTotalVolume {
+		for i, k := range tracker.Metrics {
+			update[fmt.Sprintf("total_volume_%d", i)] = pkg.Round8(k.TotalVolume)
+		}
+	}
+
+	if tracker.HaveNetVolume {
+		for i, k := range tracker.Metrics {
+			update[fmt.Sprintf("nv_%d", i)] = pkg.Round8(k.NetVolume)
+		}
+	}
+
+	for i, k := range tracker.Metrics {
+		if !math.IsNaN(k.RSI) {
+			update[fmt.Sprintf("rsi_%d", i*60)] = pkg.Round8(k.RSI)
+		}
+	}
+}
+
 func pingHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("content-type", "application/json")
 	encoder := json.NewEncoder(w)
@@ -154,6 +1618,34 @@ func pingHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// hashRemoteHost is used instead of the actual remote address in status
+// output as we may be running without password protection and don't want to
+// expose users IP addresses.
+func hashRemoteHost(host string) string {
+	hash := sha256.New()
+	hash.Write([]byte(host))
+	hash.Write(salt)
+	return hex.EncodeToString(hash.Sum(nil))[0:8]
+}
+
+// subscribersStatusHandler lists the queue of every subscriber, including
+// websocket clients, with the most dropped messages first.
+func subscribersStatusHandler(w http.ResponseWriter, r *http.Request) {
+	writeJsonResponse(w, http.StatusOK, pkg.ListSubscriberStats())
+}
+
+// busStatusHandler lists the topics of the internal bus with their sinks
+// and subscribers.
+func busStatusHandler(w http.ResponseWriter, r *http.Request) {
+	writeJsonResponse(w, http.StatusOK, pkg.DefaultBus.Topics())
+}
+
+// endpointsStatusHandler lists the measured round trip times to the stream
+// endpoints of each exchange and the endpoint selected.
+func endpointsStatusHandler(w http.ResponseWriter, r *http.Request) {
+	writeJsonResponse(w, http.StatusOK, latency.List())
+}
+
 func webSocketsStatusHandler(w http.ResponseWriter, r *http.Request) {
 	wsConnectionTracker.Lock.RLock()
 	defer wsConnectionTracker.Lock.RUnlock()
@@ -171,13 +1663,7 @@ func webSocketsStatusHandler(w http.ResponseWriter, r *http.Request) {
 
 	for client := range wsConnectionTracker.Clients {
 
-		// Instead of using the actual remote address we use a hash of it
-		// as we may be running without password protection and don't want
-		// to expose users IP addresses.
-		hash := sha256.New()
-		hash.Write([]byte(client.GetRemoteHost()))
-		hash.Write(salt)
-		remoteAddr := hex.EncodeToString(hash.Sum(nil))[0:8]
+		remoteAddr := hashRemoteHost(client.GetRemoteHost())
 
 		for path := range wsConnectionTracker.Clients[client] {
 			clients[remoteAddr] = append(
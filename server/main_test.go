@@ -0,0 +1,60 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/auth"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExchangePermissions(t *testing.T) {
+	provider, err := auth.NewAPIKeyProvider([]auth.APIKeyConfig{
+		{Name: "stats", Key: "secret", Topics: []string{"binance/stats", "*/ticker:*"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator := auth.NewAuthenticator(provider)
+	feeds := map[string]*ExchangeRunner{"binance": {}, "kucoin": {}}
+	handler := authenticator.Middleware(func(r *http.Request) bool { return false })(
+		exchangePermissions(feeds)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	tests := []struct {
+		path     string
+		expected int
+	}{
+		{"/api/1/binance/stats", http.StatusOK},
+		{"/api/1/binance/stats/BTCUSDT", http.StatusOK},
+		{"/api/1/binance/candles/BTCUSDT", http.StatusForbidden},
+		{"/api/1/kucoin/stats/BTC-USDT", http.StatusForbidden},
+		{"/api/1/binance/proxy/api/v3/depth", http.StatusForbidden},
+		{"/api/1/symbols/search", http.StatusOK},
+		{"/api/1/workers", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			r := httptest.NewRequest("GET", test.path, nil)
+			r.Header.Set("x-api-key", "secret")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != test.expected {
+				t.Errorf("expected %d, got %d", test.expected, w.Code)
+			}
+		})
+	}
+}
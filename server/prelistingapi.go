@@ -0,0 +1,73 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/prelisting"
+	"io"
+	"net/http"
+)
+
+// PrelistingApi manages the symbols watched for their listing.
+type PrelistingApi struct {
+	watcher *prelisting.Watcher
+}
+
+func NewPrelistingApi(watcher *prelisting.Watcher) *PrelistingApi {
+	return &PrelistingApi{
+		watcher: watcher,
+	}
+}
+
+func (a *PrelistingApi) Register(router *mux.Router) {
+	router.HandleFunc("/api/1/prelisting", a.getAll).Methods("GET")
+	router.HandleFunc("/api/1/prelisting/{exchange}/{symbol}", a.watch).Methods("PUT")
+	router.HandleFunc("/api/1/prelisting/{exchange}/{symbol}", a.remove).Methods("DELETE")
+}
+
+func (a *PrelistingApi) getAll(w http.ResponseWriter, r *http.Request) {
+	writeJsonResponse(w, http.StatusOK, a.watcher.Watches())
+}
+
+// watch watches a symbol, with an optional note such as the announced
+// listing time.
+func (a *PrelistingApi) watch(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Note string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	vars := mux.Vars(r)
+	watch, err := a.watcher.Add(vars["exchange"], vars["symbol"], body.Note)
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, watch)
+}
+
+func (a *PrelistingApi) remove(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !a.watcher.Remove(vars["exchange"], vars["symbol"]) {
+		writeJsonError(w, http.StatusNotFound, "symbol not watched")
+		return
+	}
+	a.getAll(w, r)
+}
@@ -0,0 +1,111 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/alerts"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/publish"
+)
+
+// publishedMessage is the envelope of every published message.
+type publishedMessage struct {
+	Type     string      `json:"type"`
+	Exchange string      `json:"exchange"`
+	Data     interface{} `json:"data"`
+}
+
+// PublishSink forwards the trades and enhanced tickers of an exchange, and
+// fired alerts, to Kafka or NATS. Trades and tickers are keyed by symbol,
+// as on the topics websocket.
+type PublishSink struct {
+	publisher *publish.Publisher
+	exchange  string
+}
+
+// NewPublishSink creates a sink for the feed of exchange, or for alerts if
+// exchange is empty.
+func NewPublishSink(publisher *publish.Publisher, exchange string) *PublishSink {
+	return &PublishSink{
+		publisher: publisher,
+		exchange:  exchange,
+	}
+}
+
+func (s *PublishSink) Name() string {
+	return "publish"
+}
+
+// Send implements pkg.Sink for trades, the enhanced ticker feed and alerts.
+func (s *PublishSink) Send(message interface{}) error {
+	switch message := message.(type) {
+	case pkg.CommonTrade:
+		topic := s.publisher.Topic(publish.Trades, s.exchange)
+		if topic == "" {
+			return nil
+		}
+		side := "buy"
+		if message.BuyerMaker {
+			side = "sell"
+		}
+		return s.publisher.Publish(topic, message.Symbol, &publishedMessage{
+			Type:     "trade",
+			Exchange: s.exchange,
+			Data: topicTrade{
+				Symbol:    message.Symbol,
+				Id:        message.Id,
+				Timestamp: message.Timestamp,
+				Price:     message.Price,
+				Quantity:  message.Quantity,
+				Side:      side,
+			},
+		})
+	case *TickerStream:
+		topic := s.publisher.Topic(publish.Tickers, s.exchange)
+		if topic == "" {
+			return nil
+		}
+		for _, ticker := range *message.Tickers {
+			update, ok := ticker.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			symbol, _ := update["symbol"].(string)
+			err := s.publisher.Publish(topic, symbol, &publishedMessage{
+				Type:     "ticker",
+				Exchange: s.exchange,
+				Data:     update,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	case *alerts.Alert:
+		topic := s.publisher.Topic(publish.Alerts, message.Exchange)
+		if topic == "" {
+			return nil
+		}
+		return s.publisher.Publish(topic, message.Symbol, &publishedMessage{
+			Type:     "alert",
+			Exchange: message.Exchange,
+			Data:     message,
+		})
+	default:
+		return fmt.Errorf("unexpected message type %T", message)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/report"
+	"net/http"
+	"time"
+)
+
+type ReportsApi struct {
+	daily *report.DailyGenerator
+}
+
+func NewReportsApi(daily *report.DailyGenerator) *ReportsApi {
+	return &ReportsApi{
+		daily: daily,
+	}
+}
+
+func (a *ReportsApi) Register(router *mux.Router) {
+	router.HandleFunc("/api/1/reports/daily", a.listDaily).Methods("GET")
+	router.HandleFunc("/api/1/reports/daily", a.generateDaily).Methods("POST")
+	router.HandleFunc("/api/1/reports/daily/{date}", a.getDaily).Methods("GET")
+}
+
+func (a *ReportsApi) listDaily(w http.ResponseWriter, r *http.Request) {
+	dates, err := a.daily.List()
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, dates)
+}
+
+// generateDaily generates a summary of the last 24 hours now, replacing any
+// existing summary for the same date.
+func (a *ReportsApi) generateDaily(w http.ResponseWriter, r *http.Request) {
+	summary, err := a.daily.Generate(time.Now())
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, summary)
+}
+
+// getDaily returns a stored summary as JSON, or HTML with ?format=html.
+func (a *ReportsApi) getDaily(w http.ResponseWriter, r *http.Request) {
+	format := r.FormValue("format")
+	if format == "" {
+		format = "json"
+	}
+	buf, err := a.daily.Load(mux.Vars(r)["date"], format)
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if buf == nil {
+		writeJsonError(w, http.StatusNotFound, "report not found")
+		return
+	}
+	if format == "html" {
+		w.Header().Set("content-type", "text/html; charset=utf-8")
+	} else {
+		w.Header().Set("content-type", "application/json")
+	}
+	w.Write(buf)
+}
@@ -0,0 +1,125 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/sandbox"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	maxSandboxSymbols = 20
+	maxSandboxRange   = 7 * 24 * time.Hour
+	sandboxTimeout    = 2 * time.Minute
+)
+
+// SandboxApi runs strategies on the signals regenerated from persisted
+// trade history.
+type SandboxApi struct {
+	feeds map[string]*ExchangeRunner
+}
+
+func NewSandboxApi(feeds map[string]*ExchangeRunner) *SandboxApi {
+	return &SandboxApi{
+		feeds: feeds,
+	}
+}
+
+func (a *SandboxApi) Register(router *mux.Router) {
+	router.HandleFunc("/api/1/{exchange}/sandbox", a.run).Methods("POST")
+}
+
+type sandboxRequest struct {
+	Strategy sandbox.Strategy `json:"strategy"`
+	Symbols  []string         `json:"symbols"`
+
+	// Milliseconds or RFC3339, defaulting to the last 24 hours.
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func (a *SandboxApi) run(w http.ResponseWriter, r *http.Request) {
+	feed := a.feeds[mux.Vars(r)["exchange"]]
+	if feed == nil {
+		writeJsonError(w, http.StatusNotFound, "unknown exchange")
+		return
+	}
+	store := feed.PersistStore()
+	if store == nil {
+		writeJsonError(w, http.StatusNotFound, "persistence not enabled")
+		return
+	}
+
+	var request sandboxRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := request.Strategy.Validate(); err != nil {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(request.Symbols) == 0 || len(request.Symbols) > maxSandboxSymbols {
+		writeJsonError(w, http.StatusBadRequest, "between 1 and 20 symbols required")
+		return
+	}
+	symbols := []string{}
+	for _, symbol := range request.Symbols {
+		symbol = strings.ToUpper(symbol)
+		if feed.IsHidden(symbol) {
+			writeJsonError(w, http.StatusNotFound, "unknown symbol: "+symbol)
+			return
+		}
+		symbols = append(symbols, symbol)
+	}
+	to, err := parseTimeParam(request.To, time.Now())
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	from, err := parseTimeParam(request.From, to.Add(-24*time.Hour))
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !from.Before(to) || to.Sub(from) > maxSandboxRange {
+		writeJsonError(w, http.StatusBadRequest, "range must be positive and at most 7 days")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), sandboxTimeout)
+	defer cancel()
+	result, err := sandbox.Run(ctx, request.Strategy, symbols, from, to, sandbox.Options{
+		Exchange: feed.Name(),
+		Source: func(symbol string, from time.Time, to time.Time,
+			fn func(trade pkg.CommonTrade) error) error {
+			return store.ReadTrades(feed.Name(), symbol, from, to, fn)
+		},
+		Detector: feed.DetectorOptions(),
+		Rates:    feed.Rates,
+	})
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, result)
+}
@@ -0,0 +1,230 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/metrics"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/signals"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	metrics.Describe("signals_retransmitted_total",
+		"Signals retransmitted to ack mode websocket clients for not being acknowledged.")
+	metrics.Describe("signals_unacknowledged_total",
+		"Signals dropped unacknowledged by ack mode websocket clients as they expired.")
+}
+
+const (
+	// How long an ack mode client has to acknowledge a signal before it is
+	// sent again, unless given with the ack_timeout parameter.
+	defaultAckTimeout = 5 * time.Second
+	minAckTimeout     = time.Second
+	maxAckTimeout     = 5 * time.Minute
+
+	// The most signals an ack mode client may leave unacknowledged before
+	// it is disconnected.
+	maxAckPending = 1000
+
+	// The delivery state of clients that have not reconnected for this long
+	// is dropped.
+	ackStateTTL = time.Hour
+)
+
+type pendingSignal struct {
+	signal   signals.Signal
+	sent     time.Time
+	attempts int
+}
+
+// signalDelivery is the delivery state of an ack mode client of the signals
+// websocket. The state of clients that connect with a client_id is kept
+// across reconnects, so signals not acknowledged before a disconnect are
+// sent again on reconnect.
+type signalDelivery struct {
+	key string
+
+	// Signals sent but not acknowledged, by sequence.
+	pending map[uint64]*pendingSignal
+
+	// The sequence of the last signal sent, to resume from on reconnect.
+	last uint64
+
+	acknowledged  uint64
+	retransmitted uint64
+	expired       uint64
+	lastAck       time.Time
+	connected     bool
+	lastSeen      time.Time
+
+	lock sync.Mutex
+}
+
+func newSignalDelivery(key string) *signalDelivery {
+	return &signalDelivery{
+		key:     key,
+		pending: map[uint64]*pendingSignal{},
+	}
+}
+
+// sent records a signal sent for the first time. Returns false if the client
+// has too many signals pending.
+func (d *signalDelivery) sent(signal signals.Signal, now time.Time) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if signal.Sequence > d.last {
+		d.last = signal.Sequence
+	}
+	if d.pending[signal.Sequence] == nil {
+		d.pending[signal.Sequence] = &pendingSignal{signal: signal, sent: now, attempts: 1}
+	}
+	return len(d.pending) <= maxAckPending
+}
+
+// ack records the acknowledgement of the signal with sequence. Returns false
+// if the signal was not pending.
+func (d *signalDelivery) ack(sequence uint64, now time.Time) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.pending[sequence] == nil {
+		return false
+	}
+	delete(d.pending, sequence)
+	d.acknowledged++
+	d.lastAck = now
+	return true
+}
+
+// due returns the pending signals, oldest first, that have not been
+// acknowledged within timeout of being sent, marking them as sent again.
+// Pending signals that have expired are dropped. All pending signals are due
+// if all is set, such as on reconnect.
+func (d *signalDelivery) due(now time.Time, timeout time.Duration, all bool) []signals.Signal {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	due := []signals.Signal{}
+	for sequence, pending := range d.pending {
+		if pending.signal.Expired(now) {
+			delete(d.pending, sequence)
+			d.expired++
+			metrics.GetCounter("signals_unacknowledged_total", nil).Inc()
+			continue
+		}
+		if !all && now.Sub(pending.sent) < timeout {
+			continue
+		}
+		pending.sent = now
+		pending.attempts++
+		d.retransmitted++
+		metrics.GetCounter("signals_retransmitted_total", nil).Inc()
+		due = append(due, pending.signal)
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].Sequence < due[j].Sequence
+	})
+	return due
+}
+
+func (d *signalDelivery) setConnected(connected bool, now time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.connected = connected
+	d.lastSeen = now
+}
+
+type signalDeliveryStatus struct {
+	Client        string     `json:"client"`
+	Connected     bool       `json:"connected"`
+	Pending       int        `json:"pending"`
+	Acknowledged  uint64     `json:"acknowledged"`
+	Retransmitted uint64     `json:"retransmitted"`
+	Expired       uint64     `json:"expired"`
+	LastSequence  uint64     `json:"last_seq"`
+	LastAck       *time.Time `json:"last_ack,omitempty"`
+	LastSeen      time.Time  `json:"last_seen"`
+}
+
+func (d *signalDelivery) status() signalDeliveryStatus {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	status := signalDeliveryStatus{
+		Client:        d.key,
+		Connected:     d.connected,
+		Pending:       len(d.pending),
+		Acknowledged:  d.acknowledged,
+		Retransmitted: d.retransmitted,
+		Expired:       d.expired,
+		LastSequence:  d.last,
+		LastSeen:      d.lastSeen,
+	}
+	if !d.lastAck.IsZero() {
+		lastAck := d.lastAck
+		status.LastAck = &lastAck
+	}
+	return status
+}
+
+// signalDeliveries keeps the delivery state of the ack mode clients that
+// connected with a client_id.
+type signalDeliveries struct {
+	clients map[string]*signalDelivery
+	lock    sync.Mutex
+}
+
+func newSignalDeliveries() *signalDeliveries {
+	return &signalDeliveries{
+		clients: map[string]*signalDelivery{},
+	}
+}
+
+// get returns the delivery state of a client, creating it if it is new,
+// and drops the state of clients not seen for ackStateTTL.
+func (s *signalDeliveries) get(key string, now time.Time) *signalDelivery {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for other, delivery := range s.clients {
+		status := delivery.status()
+		if !status.Connected && now.Sub(status.LastSeen) > ackStateTTL {
+			delete(s.clients, other)
+		}
+	}
+	delivery := s.clients[key]
+	if delivery == nil {
+		delivery = newSignalDelivery(key)
+		s.clients[key] = delivery
+	}
+	return delivery
+}
+
+// statuses returns the delivery state of the clients whose key starts with
+// prefix, sorted by client.
+func (s *signalDeliveries) statuses(prefix string) []signalDeliveryStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	statuses := []signalDeliveryStatus{}
+	for key, delivery := range s.clients {
+		if strings.HasPrefix(key, prefix) {
+			statuses = append(statuses, delivery.status())
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Client < statuses[j].Client
+	})
+	return statuses
+}
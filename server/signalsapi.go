@@ -0,0 +1,318 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/auth"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/signals"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultSignalsLimit = 500
+	maxSignalsLimit     = 5000
+)
+
+// SignalsApi serves the signal feed for bots. Signals are polled with
+// GET /api/1/signals?after=<seq>, or streamed from /ws/signals which first
+// replays the signals after the after parameter if given.
+//
+// Bots that must not miss a signal connect to /ws/signals with ack=true
+// and acknowledge each signal with {"type": "ack", "seq": <seq>}. Signals
+// not acknowledged within ack_timeout, 5s by default, are sent again until
+// acknowledged or expired. With a client_id the delivery state is kept
+// across reconnects: unacknowledged signals are sent again on reconnect,
+// followed by those emitted while disconnected. The delivery state of
+// clients is served at /api/1/signals/deliveries.
+type SignalsApi struct {
+	feed       *signals.Feed
+	deliveries *signalDeliveries
+	upgrader   websocket.Upgrader
+}
+
+type signalClientMessage struct {
+	Type     string `json:"type"`
+	Sequence uint64 `json:"seq"`
+}
+
+func NewSignalsApi(feed *signals.Feed) *SignalsApi {
+	return &SignalsApi{
+		feed:       feed,
+		deliveries: newSignalDeliveries(),
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+			EnableCompression: true,
+			Subprotocols:      webSocketSubprotocols,
+		},
+	}
+}
+
+func (a *SignalsApi) Register(router *mux.Router) {
+	router.HandleFunc("/api/1/signals", a.getSignals).Methods("GET")
+	router.HandleFunc("/api/1/signals/schema", a.getSchema).Methods("GET")
+	router.HandleFunc("/api/1/signals/deliveries", a.getDeliveries).Methods("GET")
+	router.HandleFunc("/ws/signals", a.handleWebSocket)
+}
+
+type signalsResponse struct {
+	Schema int `json:"schema"`
+
+	// The sequence of the last signal emitted, to poll with as after when
+	// no signals are returned.
+	Sequence uint64           `json:"seq"`
+	Signals  []signals.Signal `json:"signals"`
+}
+
+type signalTypeSchema struct {
+	signals.TypeSchema
+	TTLSeconds int64 `json:"ttl_seconds"`
+}
+
+// parseSignalsRequest returns the filter and after sequence of a request,
+// writing an error response if either is invalid.
+func parseSignalsRequest(w http.ResponseWriter, r *http.Request) (signals.Filter, uint64, bool) {
+	filter, err := signals.ParseFilter(r.FormValue("exchange"), r.FormValue("symbol"),
+		r.FormValue("type"))
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return filter, 0, false
+	}
+	after := uint64(0)
+	if value := r.FormValue("after"); value != "" {
+		if after, err = strconv.ParseUint(value, 10, 64); err != nil {
+			writeJsonError(w, http.StatusBadRequest, "invalid after")
+			return filter, 0, false
+		}
+	}
+	return filter, after, true
+}
+
+func (a *SignalsApi) getSignals(w http.ResponseWriter, r *http.Request) {
+	filter, after, ok := parseSignalsRequest(w, r)
+	if !ok {
+		return
+	}
+	limit := defaultSignalsLimit
+	if value := r.FormValue("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 || limit > maxSignalsLimit {
+			writeJsonError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+	sequence := a.feed.Sequence()
+	result := a.feed.Since(after, filter, limit)
+	if len(result) == limit {
+		// More may follow, resume from the last returned.
+		sequence = result[len(result)-1].Sequence
+	}
+	writeJsonResponse(w, http.StatusOK, signalsResponse{
+		Schema:   signals.SchemaVersion,
+		Sequence: sequence,
+		Signals:  result,
+	})
+}
+
+func (a *SignalsApi) getSchema(w http.ResponseWriter, r *http.Request) {
+	types := map[string]signalTypeSchema{}
+	for name, schema := range signals.Schemas {
+		types[name] = signalTypeSchema{
+			TypeSchema: schema,
+			TTLSeconds: int64(schema.TTL.Seconds()),
+		}
+	}
+	writeJsonResponse(w, http.StatusOK, map[string]interface{}{
+		"schema": signals.SchemaVersion,
+		"types":  types,
+	})
+}
+
+// getDeliveries returns the delivery state of the ack mode clients with a
+// client_id, only those of the caller unless an admin.
+func (a *SignalsApi) getDeliveries(w http.ResponseWriter, r *http.Request) {
+	prefix := ""
+	if identity := auth.GetIdentity(r); identity != nil && !identity.HasRole(auth.RoleAdmin) {
+		prefix = identity.Account + "/"
+	}
+	writeJsonResponse(w, http.StatusOK, a.deliveries.statuses(prefix))
+}
+
+// parseAckRequest returns the delivery state and ack timeout of an ack mode
+// request, nil if ack mode was not requested, writing an error response if
+// the parameters are invalid.
+func (a *SignalsApi) parseAckRequest(w http.ResponseWriter, r *http.Request) (*signalDelivery, time.Duration, bool) {
+	if value := r.FormValue("ack"); value == "" || value == "false" || value == "0" {
+		return nil, 0, true
+	}
+	timeout := defaultAckTimeout
+	if value := r.FormValue("ack_timeout"); value != "" {
+		var err error
+		timeout, err = time.ParseDuration(value)
+		if err != nil || timeout < minAckTimeout || timeout > maxAckTimeout {
+			writeJsonError(w, http.StatusBadRequest, "invalid ack_timeout")
+			return nil, 0, false
+		}
+	}
+	key, err := clientMemoryKey(r)
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return nil, 0, false
+	}
+	if key == "" {
+		return newSignalDelivery(""), timeout, true
+	}
+	return a.deliveries.get(key, time.Now()), timeout, true
+}
+
+func (a *SignalsApi) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	filter, after, ok := parseSignalsRequest(w, r)
+	if !ok {
+		return
+	}
+
+	delivery, ackTimeout, ok := a.parseAckRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if !checkEncodingParam(w, r) {
+		return
+	}
+
+	release, ok := floodGuard.Admit(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	conn, err := a.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Failed to upgrade websocket connection: %v\n", err)
+		return
+	}
+	floodGuard.Configure(conn)
+	client := NewWebSocketClient(conn, r)
+	defer client.Close()
+
+	wsConnectionTracker.Add(r.URL.String(), client)
+	defer wsConnectionTracker.Del(r.URL.String(), client)
+
+	// Subscribe before replaying so no signals are missed between the two,
+	// signals already replayed are skipped by sequence.
+	channel := a.feed.Subscribe()
+	defer a.feed.Unsubscribe(channel)
+
+	// Sends a signal, tracking it for acknowledgement in ack mode. Returns
+	// false if the client should be disconnected.
+	send := func(signal signals.Signal) bool {
+		if err := writeMessage(client, signal); err != nil {
+			log.Printf("error: websocket write error to %s: %v\n",
+				client.GetRemoteAddr(), err)
+			return false
+		}
+		if delivery != nil && !delivery.sent(signal, time.Now()) {
+			log.Printf("Signals client [%v] has %d unacknowledged signals. Dropping.\n",
+				client.GetRemoteAddr(), maxAckPending)
+			return false
+		}
+		return true
+	}
+
+	var retransmit <-chan time.Time
+	last := after
+	replay := r.FormValue("after") != ""
+	if delivery != nil {
+		delivery.setConnected(true, time.Now())
+		defer func() {
+			delivery.setConnected(false, time.Now())
+		}()
+		for _, signal := range delivery.due(time.Now(), ackTimeout, true) {
+			if !send(signal) {
+				return
+			}
+		}
+		// Resume after the last signal sent before the reconnect.
+		if !replay && delivery.last > 0 {
+			last = delivery.last
+			replay = true
+		}
+		ticker := time.NewTicker(minAckTimeout)
+		defer ticker.Stop()
+		retransmit = ticker.C
+	}
+
+	if replay {
+		for _, signal := range a.feed.Since(last, filter, 0) {
+			if !send(signal) {
+				return
+			}
+			last = signal.Sequence
+		}
+	}
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for {
+			_, buf, err := conn.ReadMessage()
+			if err != nil {
+				floodGuard.CheckReadError(err)
+				return
+			}
+			if delivery == nil {
+				continue
+			}
+			var message signalClientMessage
+			if err := json.Unmarshal(buf, &message); err != nil || message.Type != "ack" {
+				continue
+			}
+			delivery.ack(message.Sequence, time.Now())
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-retransmit:
+			for _, signal := range delivery.due(time.Now(), ackTimeout, false) {
+				if err := writeMessage(client, signal); err != nil {
+					log.Printf("error: websocket write error to %s: %v\n",
+						client.GetRemoteAddr(), err)
+					return
+				}
+			}
+		case signal, ok := <-channel:
+			if !ok {
+				return
+			}
+			if signal.Sequence <= last || !filter.Matches(&signal) {
+				continue
+			}
+			if !send(signal) {
+				return
+			}
+		}
+	}
+}
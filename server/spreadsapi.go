@@ -0,0 +1,55 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/spread"
+	"net/http"
+	"strconv"
+)
+
+// SpreadsApi serves the current cross-exchange spread of each pair.
+type SpreadsApi struct {
+	monitor *spread.Monitor
+}
+
+func NewSpreadsApi(monitor *spread.Monitor) *SpreadsApi {
+	return &SpreadsApi{
+		monitor: monitor,
+	}
+}
+
+func (a *SpreadsApi) Register(router *mux.Router) {
+	router.HandleFunc("/api/1/spreads", a.getAll).Methods("GET")
+}
+
+// getAll returns the spreads of at least the min_pct parameter, widest
+// first.
+func (a *SpreadsApi) getAll(w http.ResponseWriter, r *http.Request) {
+	minPct := 0.0
+	if value := r.FormValue("min_pct"); value != "" {
+		var err error
+		if minPct, err = strconv.ParseFloat(value, 64); err != nil {
+			writeJsonError(w, http.StatusBadRequest, "invalid min_pct")
+			return
+		}
+	}
+	writeJsonResponse(w, http.StatusOK, map[string]interface{}{
+		"threshold_pct": a.monitor.Config().ThresholdPct,
+		"spreads":       a.monitor.Spreads(minPct),
+	})
+}
@@ -0,0 +1,113 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/stats"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// StatsApi serves the rolling window statistics of each symbol.
+type StatsApi struct {
+	feeds map[string]*ExchangeRunner
+}
+
+func NewStatsApi(feeds map[string]*ExchangeRunner) *StatsApi {
+	return &StatsApi{
+		feeds: feeds,
+	}
+}
+
+func (a *StatsApi) Register(router *mux.Router) {
+	router.HandleFunc("/api/1/{exchange}/stats", a.getAll).Methods("GET")
+	router.HandleFunc("/api/1/{exchange}/stats/{symbol}", a.getSymbol).Methods("GET")
+	router.HandleFunc("/api/1/{exchange}/stats/{symbol}/profile", a.getProfile).Methods("GET")
+}
+
+func (a *StatsApi) getAll(w http.ResponseWriter, r *http.Request) {
+	feed := a.feeds[mux.Vars(r)["exchange"]]
+	if feed == nil {
+		writeJsonError(w, http.StatusNotFound, "unknown exchange")
+		return
+	}
+	all := []*stats.SymbolStats{}
+	for _, symbolStats := range feed.Stats().GetAll(feed.EventTime()) {
+		if !feed.IsHidden(symbolStats.Symbol) {
+			all = append(all, symbolStats)
+		}
+	}
+	writeJsonResponse(w, http.StatusOK, all)
+}
+
+func (a *StatsApi) getSymbol(w http.ResponseWriter, r *http.Request) {
+	feed := a.feeds[mux.Vars(r)["exchange"]]
+	if feed == nil {
+		writeJsonError(w, http.StatusNotFound, "unknown exchange")
+		return
+	}
+	symbol, ok := symbolParam(w, r, feed)
+	if !ok {
+		return
+	}
+	stats := feed.Stats().Get(symbol, feed.EventTime())
+	if stats == nil {
+		writeJsonError(w, http.StatusNotFound, "unknown symbol")
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, stats)
+}
+
+// getProfile returns the volume profile of a symbol over the window
+// parameter, up to an hour and defaulting to it, split into the levels
+// parameter price ranges.
+func (a *StatsApi) getProfile(w http.ResponseWriter, r *http.Request) {
+	feed := a.feeds[mux.Vars(r)["exchange"]]
+	if feed == nil {
+		writeJsonError(w, http.StatusNotFound, "unknown exchange")
+		return
+	}
+	window := stats.ProfileWindow
+	if value := r.FormValue("window"); value != "" {
+		var err error
+		window, err = time.ParseDuration(value)
+		if err != nil || window < time.Minute || window > stats.ProfileWindow {
+			writeJsonError(w, http.StatusBadRequest, "invalid window")
+			return
+		}
+	}
+	levels := stats.DefaultProfileLevels
+	if value := r.FormValue("levels"); value != "" {
+		var err error
+		levels, err = strconv.Atoi(value)
+		if err != nil || levels < 1 || levels > stats.MaxProfileLevels {
+			writeJsonError(w, http.StatusBadRequest, "invalid levels")
+			return
+		}
+	}
+	symbol, ok := symbolParam(w, r, feed)
+	if !ok {
+		return
+	}
+	profile := feed.Stats().Profile(symbol, feed.EventTime(), window, levels)
+	if profile == nil {
+		writeJsonError(w, http.StatusNotFound, "unknown symbol")
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, profile)
+}
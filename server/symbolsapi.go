@@ -0,0 +1,231 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/assets"
+	"net/http"
+	"strings"
+)
+
+type SymbolsApi struct {
+	registry *pkg.SymbolRegistry
+	feeds    map[string]*ExchangeRunner
+
+	// Asset metadata, nil if disabled.
+	metadata *assets.Store
+}
+
+func NewSymbolsApi(registry *pkg.SymbolRegistry, feeds map[string]*ExchangeRunner, metadata *assets.Store) *SymbolsApi {
+	return &SymbolsApi{
+		registry: registry,
+		feeds:    feeds,
+		metadata: metadata,
+	}
+}
+
+func (a *SymbolsApi) Register(router *mux.Router) {
+	router.HandleFunc("/api/1/symbols/config", a.getConfig).Methods("GET")
+	router.HandleFunc("/api/1/symbols/aliases/{symbol}", a.setAlias).Methods("PUT")
+	router.HandleFunc("/api/1/symbols/aliases/{symbol}", a.removeAlias).Methods("DELETE")
+	router.HandleFunc("/api/1/symbols/hidden/{symbol}", a.hide).Methods("PUT")
+	router.HandleFunc("/api/1/symbols/hidden/{symbol}", a.unhide).Methods("DELETE")
+	router.HandleFunc("/api/1/{exchange}/symbols/search", a.search).Methods("GET")
+	router.HandleFunc("/api/1/{exchange}/symbols/status", a.getStatuses).Methods("GET")
+	router.HandleFunc("/api/1/{exchange}/symbols/{symbol}/rules", a.getRules).Methods("GET")
+	router.HandleFunc("/api/1/{exchange}/symbols/{symbol}", a.getSymbol).Methods("GET")
+	if a.metadata != nil {
+		router.HandleFunc("/api/1/assets", a.getAssets).Methods("GET")
+		router.HandleFunc("/api/1/assets/{asset}", a.getAsset).Methods("GET")
+	}
+}
+
+func writeJsonResponse(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(statusCode)
+	encoder := json.NewEncoder(w)
+	encoder.Encode(v)
+}
+
+func writeJsonError(w http.ResponseWriter, statusCode int, message string) {
+	writeJsonResponse(w, statusCode, map[string]interface{}{
+		"error": message,
+	})
+}
+
+// symbolParam returns the symbol of the request path, writing a not found
+// response if it is hidden on the feed.
+func symbolParam(w http.ResponseWriter, r *http.Request, feed *ExchangeRunner) (string, bool) {
+	symbol := strings.ToUpper(mux.Vars(r)["symbol"])
+	if feed.IsHidden(symbol) {
+		writeJsonError(w, http.StatusNotFound, "unknown symbol")
+		return "", false
+	}
+	return symbol, true
+}
+
+func (a *SymbolsApi) getConfig(w http.ResponseWriter, r *http.Request) {
+	writeJsonResponse(w, http.StatusOK, map[string]interface{}{
+		"aliases": a.registry.Aliases(),
+		"hidden":  a.registry.Hidden(),
+	})
+}
+
+func (a *SymbolsApi) setAlias(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Alias string `json:"alias"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if body.Alias == "" {
+		writeJsonError(w, http.StatusBadRequest, "alias required")
+		return
+	}
+	a.registry.SetAlias(mux.Vars(r)["symbol"], body.Alias)
+	a.getConfig(w, r)
+}
+
+func (a *SymbolsApi) removeAlias(w http.ResponseWriter, r *http.Request) {
+	a.registry.RemoveAlias(mux.Vars(r)["symbol"])
+	a.getConfig(w, r)
+}
+
+func (a *SymbolsApi) hide(w http.ResponseWriter, r *http.Request) {
+	a.registry.Hide(mux.Vars(r)["symbol"])
+	a.getConfig(w, r)
+}
+
+func (a *SymbolsApi) unhide(w http.ResponseWriter, r *http.Request) {
+	a.registry.Unhide(mux.Vars(r)["symbol"])
+	a.getConfig(w, r)
+}
+
+func (a *SymbolsApi) search(w http.ResponseWriter, r *http.Request) {
+	exchange := mux.Vars(r)["exchange"]
+	feed := a.feeds[exchange]
+	if feed == nil {
+		writeJsonError(w, http.StatusNotFound, "unknown exchange")
+		return
+	}
+	results := []symbolMetadata{}
+	for _, result := range a.registry.Search(exchange, feed.Symbols(), r.FormValue("q")) {
+		results = append(results, a.symbolMetadata(result, r.FormValue("lang")))
+	}
+	writeJsonResponse(w, http.StatusOK, results)
+}
+
+// symbolMetadata is a symbol with the metadata of its base and quote
+// assets, if asset metadata is enabled and they are known.
+type symbolMetadata struct {
+	pkg.SymbolSearchResult
+	Base  *assets.Metadata `json:"base,omitempty"`
+	Quote *assets.Metadata `json:"quote,omitempty"`
+}
+
+func (a *SymbolsApi) symbolMetadata(result pkg.SymbolSearchResult, language string) symbolMetadata {
+	metadata := symbolMetadata{
+		SymbolSearchResult: result,
+	}
+	if a.metadata == nil {
+		return metadata
+	}
+	if base, quote, ok := pkg.SplitSymbol(result.Symbol); ok {
+		metadata.Base = a.metadata.Metadata(base, language)
+		metadata.Quote = a.metadata.Metadata(quote, language)
+	}
+	return metadata
+}
+
+// getSymbol returns the alias of a symbol and the metadata of its assets,
+// in the language of the lang parameter if configured.
+func (a *SymbolsApi) getSymbol(w http.ResponseWriter, r *http.Request) {
+	exchange := mux.Vars(r)["exchange"]
+	feed := a.feeds[exchange]
+	if feed == nil {
+		writeJsonError(w, http.StatusNotFound, "unknown exchange")
+		return
+	}
+	symbol, ok := symbolParam(w, r, feed)
+	if !ok {
+		return
+	}
+	for _, known := range feed.Symbols() {
+		if known == symbol {
+			writeJsonResponse(w, http.StatusOK, a.symbolMetadata(pkg.SymbolSearchResult{
+				Symbol: symbol,
+				Alias:  a.registry.Alias(exchange, symbol),
+			}, r.FormValue("lang")))
+			return
+		}
+	}
+	writeJsonError(w, http.StatusNotFound, "unknown symbol")
+}
+
+// getAssets returns the metadata of all known assets, with their names in
+// every configured language.
+func (a *SymbolsApi) getAssets(w http.ResponseWriter, r *http.Request) {
+	writeJsonResponse(w, http.StatusOK, a.metadata.Assets())
+}
+
+func (a *SymbolsApi) getAsset(w http.ResponseWriter, r *http.Request) {
+	metadata := a.metadata.Metadata(mux.Vars(r)["asset"], r.FormValue("lang"))
+	if metadata == nil {
+		writeJsonError(w, http.StatusNotFound, "unknown asset")
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, metadata)
+}
+
+// getRules returns the trading rules of a symbol as of the last poll.
+func (a *SymbolsApi) getRules(w http.ResponseWriter, r *http.Request) {
+	feed := a.feeds[mux.Vars(r)["exchange"]]
+	if feed == nil {
+		writeJsonError(w, http.StatusNotFound, "unknown exchange")
+		return
+	}
+	symbol, ok := symbolParam(w, r, feed)
+	if !ok {
+		return
+	}
+	rules, ok := feed.TradingRules(symbol)
+	if !ok {
+		writeJsonError(w, http.StatusNotFound, "no trading rules for symbol")
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, rules)
+}
+
+// getStatuses returns the trading status of each symbol as of the last poll
+// of the trading rules.
+func (a *SymbolsApi) getStatuses(w http.ResponseWriter, r *http.Request) {
+	feed := a.feeds[mux.Vars(r)["exchange"]]
+	if feed == nil {
+		writeJsonError(w, http.StatusNotFound, "unknown exchange")
+		return
+	}
+	statuses := map[string]pkg.SymbolStatus{}
+	for symbol, status := range feed.SymbolStatuses() {
+		if !feed.IsHidden(symbol) {
+			statuses[symbol] = status
+		}
+	}
+	writeJsonResponse(w, http.StatusOK, statuses)
+}
@@ -0,0 +1,87 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/tape"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const defaultTapeLimit = 100
+
+// The range of trades returned by default when only one end is given.
+const defaultTapeRange = time.Hour
+
+// TapeApi serves the combined tape of trades of each asset across the
+// spot exchanges.
+type TapeApi struct {
+	tape *tape.Tape
+}
+
+func NewTapeApi(tape *tape.Tape) *TapeApi {
+	return &TapeApi{
+		tape: tape,
+	}
+}
+
+func (a *TapeApi) Register(router *mux.Router) {
+	router.HandleFunc("/api/1/tape", a.getAssets).Methods("GET")
+	router.HandleFunc("/api/1/tape/{asset}", a.getTrades).Methods("GET")
+}
+
+func (a *TapeApi) getAssets(w http.ResponseWriter, r *http.Request) {
+	writeJsonResponse(w, http.StatusOK, a.tape.Assets())
+}
+
+// getTrades returns the most recent trades of an asset, oldest first. If a
+// time range or symbol is given the first trades of the range are returned
+// instead, including those that have moved to the cold store.
+func (a *TapeApi) getTrades(w http.ResponseWriter, r *http.Request) {
+	limit := defaultTapeLimit
+	if value := r.FormValue("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 || limit > tape.MaxSize {
+			writeJsonError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+	asset := mux.Vars(r)["asset"]
+	symbol := r.FormValue("symbol")
+	if r.FormValue("from") == "" && r.FormValue("to") == "" && symbol == "" {
+		writeJsonResponse(w, http.StatusOK, a.tape.Trades(asset, limit))
+		return
+	}
+
+	to, err := parseTimeParam(r.FormValue("to"), time.Now())
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	from, err := parseTimeParam(r.FormValue("from"), to.Add(-defaultTapeRange))
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	trades, err := a.tape.Range(asset, symbol, from, to, limit)
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, trades)
+}
@@ -0,0 +1,251 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/alerts"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultMetricsLimit = 50
+	maxMetricsLimit     = 5000
+)
+
+// TickersApi serves snapshots of the enhanced ticker feed, the same updates
+// sent to websocket clients, for clients that do not want to hold a
+// websocket open.
+type TickersApi struct {
+	feeds map[string]*ExchangeRunner
+}
+
+func NewTickersApi(feeds map[string]*ExchangeRunner) *TickersApi {
+	return &TickersApi{
+		feeds: feeds,
+	}
+}
+
+func (a *TickersApi) Register(router *mux.Router) {
+	router.HandleFunc("/api/1/exchanges", a.getExchanges).Methods("GET")
+	router.HandleFunc("/api/1/{exchange}/tickers", a.getTickers).Methods("GET")
+	router.HandleFunc("/api/1/{exchange}/tickers/{symbol}", a.getTicker).Methods("GET")
+	router.HandleFunc("/api/1/{exchange}/metrics", a.getMetrics).Methods("GET")
+}
+
+func (a *TickersApi) getExchanges(w http.ResponseWriter, r *http.Request) {
+	names := []string{}
+	for name := range a.feeds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	writeJsonResponse(w, http.StatusOK, names)
+}
+
+// parseTickersRequest returns the feed and currency of a request, writing
+// an error response if either is invalid.
+func (a *TickersApi) parseTickersRequest(w http.ResponseWriter, r *http.Request) (*ExchangeRunner, string, bool) {
+	feed := a.feeds[mux.Vars(r)["exchange"]]
+	if feed == nil {
+		writeJsonError(w, http.StatusNotFound, "unknown exchange")
+		return nil, "", false
+	}
+	currency := strings.ToUpper(r.FormValue("currency"))
+	if currency != "" && !pkg.IsConversionCurrency(currency) {
+		writeJsonError(w, http.StatusBadRequest,
+			fmt.Sprintf("unsupported currency: %s", currency))
+		return nil, "", false
+	}
+	if currency != "" && feed.Rates() == nil {
+		writeJsonError(w, http.StatusServiceUnavailable, "conversion rates not available yet")
+		return nil, "", false
+	}
+	return feed, currency, true
+}
+
+// getTickers returns the last update of every symbol, sorted by symbol,
+// optionally converted to a currency.
+func (a *TickersApi) getTickers(w http.ResponseWriter, r *http.Request) {
+	feed, currency, ok := a.parseTickersRequest(w, r)
+	if !ok {
+		return
+	}
+	updates := feed.LastUpdates()
+	sort.Slice(updates, func(i, j int) bool {
+		return fmt.Sprint(updates[i]["symbol"]) < fmt.Sprint(updates[j]["symbol"])
+	})
+	if currency != "" {
+		rates := feed.Rates()
+		for i, update := range updates {
+			updates[i] = rates.ConvertUpdate(update, currency)
+		}
+	}
+	writeJsonResponse(w, http.StatusOK, updates)
+}
+
+func (a *TickersApi) getTicker(w http.ResponseWriter, r *http.Request) {
+	feed, currency, ok := a.parseTickersRequest(w, r)
+	if !ok {
+		return
+	}
+	update := feed.LastUpdate(strings.ToUpper(mux.Vars(r)["symbol"]))
+	if update == nil {
+		writeJsonError(w, http.StatusNotFound, "unknown symbol")
+		return
+	}
+	if currency != "" {
+		update = feed.Rates().ConvertUpdate(update, currency)
+	}
+	writeJsonResponse(w, http.StatusOK, update)
+}
+
+type metricsResponse struct {
+	// The number of symbols matching the filters, before the offset and
+	// limit.
+	Total   int                      `json:"total"`
+	Offset  int                      `json:"offset"`
+	Limit   int                      `json:"limit"`
+	Metrics []map[string]interface{} `json:"metrics"`
+}
+
+// getMetrics returns the last updates of the symbols ranked by a metric,
+// for clients such as scripts that want the table without the websocket.
+//
+// sort is a metric path as used by the alert rules, such as
+// price_change_pct.15m, symbol if not given, and dir is asc or desc,
+// desc unless sorting by symbol. Symbols without the metric are last.
+// filter is a condition such as "volume > 100", and may be given more than
+// once or comma separated, all of which must hold. quote limits the
+// symbols to a quote asset. Filters apply after conversion to currency.
+// limit and offset page through the result.
+func (a *TickersApi) getMetrics(w http.ResponseWriter, r *http.Request) {
+	feed, currency, ok := a.parseTickersRequest(w, r)
+	if !ok {
+		return
+	}
+
+	conditions := []alerts.Condition{}
+	for _, values := range r.Form["filter"] {
+		for _, value := range strings.Split(values, ",") {
+			if strings.TrimSpace(value) == "" {
+				continue
+			}
+			condition, err := alerts.ParseCondition(value)
+			if err != nil {
+				writeJsonError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			conditions = append(conditions, condition)
+		}
+	}
+	metric := r.FormValue("sort")
+	descending := metric != "" && metric != "symbol"
+	switch r.FormValue("dir") {
+	case "":
+	case "asc":
+		descending = false
+	case "desc":
+		descending = true
+	default:
+		writeJsonError(w, http.StatusBadRequest, "invalid dir, expected asc or desc")
+		return
+	}
+	limit, ok := parseIntParam(w, r, "limit", defaultMetricsLimit, 1, maxMetricsLimit)
+	if !ok {
+		return
+	}
+	offset, ok := parseIntParam(w, r, "offset", 0, 0, -1)
+	if !ok {
+		return
+	}
+	quote := strings.ToUpper(r.FormValue("quote"))
+
+	rates := feed.Rates()
+	updates := []map[string]interface{}{}
+Updates:
+	for _, update := range feed.LastUpdates() {
+		symbol := fmt.Sprint(update["symbol"])
+		if quote != "" {
+			if _, symbolQuote, ok := pkg.SplitSymbol(symbol); !ok || symbolQuote != quote {
+				continue
+			}
+		}
+		if currency != "" {
+			update = rates.ConvertUpdate(update, currency)
+		}
+		for _, condition := range conditions {
+			value, ok := alerts.LookupMetric(update, condition.Metric)
+			if !ok || !condition.Test(value) {
+				continue Updates
+			}
+		}
+		updates = append(updates, update)
+	}
+
+	sort.Slice(updates, func(i, j int) bool {
+		symbolI := fmt.Sprint(updates[i]["symbol"])
+		symbolJ := fmt.Sprint(updates[j]["symbol"])
+		if metric != "" && metric != "symbol" {
+			valueI, okI := alerts.LookupMetric(updates[i], metric)
+			valueJ, okJ := alerts.LookupMetric(updates[j], metric)
+			if okI != okJ {
+				return okI
+			}
+			if okI && valueI != valueJ {
+				return (valueI > valueJ) == descending
+			}
+		} else if symbolI != symbolJ {
+			return (symbolI > symbolJ) == descending
+		}
+		return symbolI < symbolJ
+	})
+
+	response := metricsResponse{
+		Total:   len(updates),
+		Offset:  offset,
+		Limit:   limit,
+		Metrics: []map[string]interface{}{},
+	}
+	if offset < len(updates) {
+		updates = updates[offset:]
+		if len(updates) > limit {
+			updates = updates[:limit]
+		}
+		response.Metrics = updates
+	}
+	writeJsonResponse(w, http.StatusOK, response)
+}
+
+// parseIntParam returns the integer query parameter name, def if not given,
+// writing an error response if it is not between min and max. A negative
+// max is unbounded.
+func parseIntParam(w http.ResponseWriter, r *http.Request, name string, def int, min int, max int) (int, bool) {
+	value := r.FormValue(name)
+	if value == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min || (max >= 0 && n > max) {
+		writeJsonError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s", name))
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,613 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"github.com/gorilla/websocket"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/auth"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/candles"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The maximum number of topics a client may be subscribed to.
+const maxTopicsPerClient = 200
+
+// The most minutes of history a client may ask to be replayed.
+const maxReplayMinutes = 60
+
+const (
+	TopicTrades  = "trades"
+	TopicTicker  = "ticker"
+	TopicCandles = "candles"
+	TopicStatus  = "status"
+
+	// Subscribes to a topic for all symbols, such as ticker:*.
+	topicWildcard = "*"
+)
+
+// parseTopic validates a topic and returns it in canonical form. Topics are
+// trades:<symbol>, ticker:<symbol>, status:<symbol> and
+// candles:<symbol>:<interval>, where all but candles accept * for all
+// symbols.
+func parseTopic(feed *ExchangeRunner, topic string) (string, error) {
+	parts := strings.Split(topic, ":")
+	if len(parts) < 2 || parts[1] == "" {
+		return "", fmt.Errorf("invalid topic: %s", topic)
+	}
+	kind := strings.ToLower(parts[0])
+	symbol := strings.ToUpper(parts[1])
+	switch kind {
+	case TopicTrades, TopicTicker, TopicStatus:
+		if len(parts) != 2 {
+			return "", fmt.Errorf("invalid topic: %s", topic)
+		}
+		return kind + ":" + symbol, nil
+	case TopicCandles:
+		if len(parts) != 3 || symbol == topicWildcard {
+			return "", fmt.Errorf("invalid topic: %s", topic)
+		}
+		interval, err := candles.ParseInterval(parts[2])
+		if err != nil || !feed.Candles().HasInterval(interval) {
+			return "", fmt.Errorf("unsupported interval: %s", topic)
+		}
+		return fmt.Sprintf("%s:%s:%s", kind, symbol, candles.FormatInterval(interval)), nil
+	}
+	return "", fmt.Errorf("unknown topic: %s", topic)
+}
+
+type topicClientMessage struct {
+	Type   string   `json:"type"`
+	Topics []string `json:"topics"`
+
+	// Minutes of history to replay for the topics subscribed to.
+	Replay int `json:"replay,omitempty"`
+}
+
+type topicReply struct {
+	Type   string   `json:"type"`
+	Topics []string `json:"topics"`
+	Error  string   `json:"error,omitempty"`
+}
+
+type topicMessage struct {
+	Topic string      `json:"topic"`
+	Data  interface{} `json:"data"`
+
+	// Set on messages replaying history from before the subscription.
+	Replay bool `json:"replay,omitempty"`
+}
+
+type topicTrade struct {
+	Symbol    string    `json:"symbol"`
+	Id        int64     `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Price     float64   `json:"price"`
+	Quantity  float64   `json:"quantity"`
+	Side      string    `json:"side"`
+}
+
+func newTopicTrade(trade pkg.CommonTrade) topicTrade {
+	side := "buy"
+	if trade.BuyerMaker {
+		side = "sell"
+	}
+	return topicTrade{
+		Symbol:    trade.Symbol,
+		Id:        trade.Id,
+		Timestamp: trade.Timestamp,
+		Price:     trade.Price,
+		Quantity:  trade.Quantity,
+		Side:      side,
+	}
+}
+
+type topicClient struct {
+	*WebSocketClient
+	topics map[string]bool
+
+	// The key the topics are remembered under, empty if the client did not
+	// give a client ID.
+	memoryKey string
+
+	// The identity the client authenticated as, nil if authentication is
+	// disabled.
+	identity *auth.Identity
+
+	// Closed when the client is disconnected for being too slow.
+	disconnected chan struct{}
+	once         sync.Once
+}
+
+func (c *topicClient) disconnect() {
+	c.once.Do(func() {
+		close(c.disconnected)
+	})
+}
+
+// candleSubscription forwards candle updates for a candles topic from the
+// builder while the topic has subscribers.
+type candleSubscription struct {
+	channel chan candles.Candle
+	stop    chan struct{}
+}
+
+// TopicHub serves a websocket where clients subscribe to topics of an
+// exchange and only receive messages for those topics. It is a sink for the
+// trade stream, the enhanced ticker feed and the symbol status changes.
+//
+// Clients send {"type": "subscribe", "topics": [...]} and
+// {"type": "unsubscribe", "topics": [...]}, and are replied to with the
+// topics they are subscribed to. Topics may also be given with the topics
+// query parameter, comma separated. Messages are sent as
+// {"topic": "...", "data": ...}.
+//
+// Messages are sent in the encoding the client negotiated, see
+// encoding.go. Client requests are always JSON.
+//
+// Clients may ask for the last minutes of trades and candles of the topics
+// they subscribe to with "replay": <minutes> in the subscribe message, or
+// the replay query parameter for the topics given or restored on connect.
+// The history is served from the recent trades and candles kept in memory,
+// so trades are limited to the most recent kept per symbol, and wildcard
+// topics are not replayed. Replayed messages have "replay": true, and are followed by
+// a {"type": "replayed"} reply with the topics replayed. Live messages may
+// arrive during the replay, so a trade may be received both replayed and
+// live, with the same id.
+//
+// Clients that connect with a client_id query parameter have their topics
+// remembered, and restored on reconnect with a {"type": "restored"} reply,
+// so they don't need to resubscribe.
+type TopicHub struct {
+	feed     *ExchangeRunner
+	upgrader websocket.Upgrader
+
+	clients map[string]map[*topicClient]bool
+	candles map[string]*candleSubscription
+	lock    sync.RWMutex
+}
+
+func NewTopicHub(feed *ExchangeRunner) *TopicHub {
+	return &TopicHub{
+		feed: feed,
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+			EnableCompression: true,
+			Subprotocols:      webSocketSubprotocols,
+		},
+		clients: map[string]map[*topicClient]bool{},
+		candles: map[string]*candleSubscription{},
+	}
+}
+
+func (h *TopicHub) Name() string {
+	return "topics"
+}
+
+// Send implements pkg.Sink for trades, the enhanced ticker feed and symbol
+// status changes.
+func (h *TopicHub) Send(message interface{}) error {
+	switch message := message.(type) {
+	case pkg.CommonTrade:
+		h.publish(TopicTrades, message.Symbol, "", newTopicTrade(message))
+	case pkg.SymbolStatusChange:
+		h.publish(TopicStatus, message.Symbol, "", message)
+	case *TickerStream:
+		for _, ticker := range *message.Tickers {
+			update, ok := ticker.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if symbol, ok := update["symbol"].(string); ok {
+				h.publish(TopicTicker, symbol, "", update)
+			}
+		}
+	default:
+		return fmt.Errorf("unexpected message type %T", message)
+	}
+	return nil
+}
+
+// publish sends data to the subscribers of kind:symbol[:suffix] and, if
+// there is no suffix, of kind:*. Clients subscribed to both receive the
+// message once. Nothing is sent for hidden symbols.
+func (h *TopicHub) publish(kind string, symbol string, suffix string, data interface{}) {
+	if h.feed.IsHidden(symbol) {
+		return
+	}
+	topic := kind + ":" + symbol
+	if suffix != "" {
+		topic += ":" + suffix
+	}
+
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	subscribers := h.clients[topic]
+	var wildcard map[*topicClient]bool
+	if suffix == "" {
+		wildcard = h.clients[kind+":"+topicWildcard]
+	}
+	if len(subscribers) == 0 && len(wildcard) == 0 {
+		return
+	}
+
+	messages := newPreparedMessages(&topicMessage{Topic: topic, Data: data})
+	for client := range subscribers {
+		h.queue(client, messages)
+	}
+	for client := range wildcard {
+		if !subscribers[client] {
+			h.queue(client, messages)
+		}
+	}
+}
+
+func (h *TopicHub) queue(client *topicClient, messages *preparedMessages) {
+	message, err := messages.get(client.encoding)
+	if err != nil {
+		log.Printf("error: failed to prepare %s websocket message: %v\n",
+			client.encoding, err)
+		return
+	}
+	select {
+	case client.sendChannel <- message:
+	default:
+		if client.stats.Overflow() {
+			log.Printf("WebSocket client [%v] appears to be blocked. Dropping.\n",
+				client.GetRemoteAddr())
+			client.disconnect()
+		}
+	}
+}
+
+// reply queues a reply to a client request. Replies are not dropped, if
+// the queue is full the client is disconnected.
+func (h *TopicHub) reply(client *topicClient, reply topicReply) {
+	message, err := prepareMessage(client.encoding, &reply)
+	if err != nil {
+		return
+	}
+	select {
+	case client.sendChannel <- message:
+	default:
+		client.disconnect()
+	}
+}
+
+// subscribe adds topics to the client, returning an error for the first
+// invalid or not permitted topic, or topic of a hidden symbol. Valid topics
+// before it are still subscribed.
+func (h *TopicHub) subscribe(client *topicClient, topics []string) error {
+	if draining, retryAfter := drainState.Draining(); draining {
+		return fmt.Errorf("server is restarting, retry after %ds", retrySeconds(retryAfter))
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, value := range topics {
+		topic, err := parseTopic(h.feed, value)
+		if err != nil {
+			return err
+		}
+		if client.topics[topic] {
+			continue
+		}
+		if h.feed.IsHidden(strings.Split(topic, ":")[1]) {
+			return fmt.Errorf("unknown symbol: %s", topic)
+		}
+		if !client.identity.AllowsTopic(h.feed.Name() + "/" + topic) {
+			return fmt.Errorf("topic not permitted: %s", topic)
+		}
+		if len(client.topics) >= maxTopicsPerClient {
+			return fmt.Errorf("too many topics, the maximum is %d", maxTopicsPerClient)
+		}
+		client.topics[topic] = true
+		if h.clients[topic] == nil {
+			h.clients[topic] = map[*topicClient]bool{}
+			if strings.HasPrefix(topic, TopicCandles+":") {
+				h.subscribeCandles(topic)
+			}
+		}
+		h.clients[topic][client] = true
+	}
+	return nil
+}
+
+func (h *TopicHub) unsubscribe(client *topicClient, topics []string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, value := range topics {
+		topic, err := parseTopic(h.feed, value)
+		if err != nil || !client.topics[topic] {
+			continue
+		}
+		delete(client.topics, topic)
+		delete(h.clients[topic], client)
+		if len(h.clients[topic]) == 0 {
+			delete(h.clients, topic)
+			if subscription := h.candles[topic]; subscription != nil {
+				h.unsubscribeCandles(topic, subscription)
+			}
+		}
+	}
+}
+
+// subscribeCandles subscribes to the builder for a candles topic. Must be
+// called with the lock held.
+func (h *TopicHub) subscribeCandles(topic string) {
+	parts := strings.Split(topic, ":")
+	symbol := parts[1]
+	interval, _ := candles.ParseInterval(parts[2])
+	subscription := &candleSubscription{
+		channel: h.feed.Candles().Subscribe(symbol, interval),
+		stop:    make(chan struct{}),
+	}
+	h.candles[topic] = subscription
+	go func() {
+		for {
+			select {
+			case <-subscription.stop:
+				return
+			case candle, ok := <-subscription.channel:
+				if !ok {
+					return
+				}
+				h.publish(TopicCandles, symbol, parts[2], newCandleResponse(candle))
+			}
+		}
+	}()
+}
+
+// unsubscribeCandles must be called with the lock held.
+func (h *TopicHub) unsubscribeCandles(topic string, subscription *candleSubscription) {
+	parts := strings.Split(topic, ":")
+	interval, _ := candles.ParseInterval(parts[2])
+	h.feed.Candles().Unsubscribe(parts[1], interval, subscription.channel)
+	close(subscription.stop)
+	delete(h.candles, topic)
+}
+
+// restore subscribes a client to its remembered topics. Topics that are no
+// longer valid are dropped.
+func (h *TopicHub) restore(client *topicClient) {
+	if client.memoryKey == "" || clientMemory == nil {
+		return
+	}
+	topics := clientMemory.Topics(client.memoryKey, h.feed.Name())
+	if len(topics) == 0 {
+		return
+	}
+	for _, topic := range topics {
+		h.subscribe(client, []string{topic})
+	}
+	h.reply(client, topicReply{Type: "restored", Topics: h.topicsOf(client)})
+}
+
+// replay sends the last minutes of history of topics to a client, then a
+// replayed reply. Blocks while the client's queue is full.
+func (h *TopicHub) replay(client *topicClient, topics []string, minutes int) {
+	since := h.feed.EventTime().Add(-time.Duration(minutes) * time.Minute)
+	replayed := []string{}
+	for _, topic := range topics {
+		parts := strings.Split(topic, ":")
+		if parts[1] == topicWildcard || h.feed.IsHidden(parts[1]) {
+			continue
+		}
+		var messages []interface{}
+		switch parts[0] {
+		case TopicTrades:
+			for _, trade := range h.feed.RecentTrades().Get(parts[1], 0) {
+				if !trade.Timestamp.Before(since) {
+					messages = append(messages, newTopicTrade(trade))
+				}
+			}
+		case TopicCandles:
+			interval, _ := candles.ParseInterval(parts[2])
+			for _, candle := range h.feed.Candles().Get(parts[1], interval, 0) {
+				if candle.CloseTime().After(since) {
+					messages = append(messages, newCandleResponse(candle))
+				}
+			}
+		default:
+			continue
+		}
+		for _, data := range messages {
+			message, err := prepareMessage(client.encoding,
+				&topicMessage{Topic: topic, Data: data, Replay: true})
+			if err != nil {
+				log.Printf("error: failed to prepare %s websocket message: %v\n",
+					client.encoding, err)
+				return
+			}
+			select {
+			case client.sendChannel <- message:
+			case <-client.disconnected:
+				return
+			}
+		}
+		replayed = append(replayed, topic)
+	}
+	h.reply(client, topicReply{Type: "replayed", Topics: replayed})
+}
+
+// added returns the topics of client not in before.
+func (h *TopicHub) added(client *topicClient, before []string) []string {
+	previous := map[string]bool{}
+	for _, topic := range before {
+		previous[topic] = true
+	}
+	added := []string{}
+	for _, topic := range h.topicsOf(client) {
+		if !previous[topic] {
+			added = append(added, topic)
+		}
+	}
+	sort.Strings(added)
+	return added
+}
+
+// remember saves the topics of a client that connected with a client ID.
+func (h *TopicHub) remember(client *topicClient) {
+	if client.memoryKey == "" || clientMemory == nil {
+		return
+	}
+	topics := h.topicsOf(client)
+	sort.Strings(topics)
+	clientMemory.Remember(client.memoryKey, h.feed.Name(), topics)
+}
+
+func (h *TopicHub) topicsOf(client *topicClient) []string {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	topics := make([]string, 0, len(client.topics))
+	for topic := range client.topics {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+func (h *TopicHub) Handle(w http.ResponseWriter, r *http.Request) {
+	memoryKey, err := clientMemoryKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !checkEncodingParam(w, r) {
+		return
+	}
+
+	replayMinutes := 0
+	if value := r.FormValue("replay"); value != "" {
+		replayMinutes, err = strconv.Atoi(value)
+		if err != nil || replayMinutes < 0 || replayMinutes > maxReplayMinutes {
+			http.Error(w, fmt.Sprintf("invalid replay, must be 0 to %d minutes",
+				maxReplayMinutes), http.StatusBadRequest)
+			return
+		}
+	}
+
+	release, ok := floodGuard.Admit(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Failed to upgrade websocket connection: %v\n", err)
+		return
+	}
+	floodGuard.Configure(conn)
+	client := &topicClient{
+		WebSocketClient: NewWebSocketClient(conn, r),
+		topics:          map[string]bool{},
+		memoryKey:       memoryKey,
+		identity:        auth.GetIdentity(r),
+		disconnected:    make(chan struct{}),
+	}
+	defer client.Close()
+	// Ends a replay blocked on the queue after a write error.
+	defer client.disconnect()
+
+	wsConnectionTracker.Add(r.URL.String(), client.WebSocketClient)
+	defer wsConnectionTracker.Del(r.URL.String(), client.WebSocketClient)
+
+	defer func() {
+		h.unsubscribe(client, h.topicsOf(client))
+	}()
+
+	h.restore(client)
+
+	if value := r.FormValue("topics"); value != "" {
+		topics := strings.Split(value, ",")
+		if err := h.subscribe(client, topics); err != nil {
+			h.reply(client, topicReply{Type: "error", Topics: h.topicsOf(client), Error: err.Error()})
+		} else {
+			h.reply(client, topicReply{Type: "subscribed", Topics: h.topicsOf(client)})
+		}
+		h.remember(client)
+	}
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		// Replayed here as the queue is not drained until the write loop
+		// below starts.
+		if replayMinutes > 0 {
+			h.replay(client, h.added(client, nil), replayMinutes)
+		}
+		for {
+			var message topicClientMessage
+			if err := conn.ReadJSON(&message); err != nil {
+				floodGuard.CheckReadError(err)
+				return
+			}
+			switch message.Type {
+			case "subscribe":
+				if message.Replay < 0 || message.Replay > maxReplayMinutes {
+					h.reply(client, topicReply{Type: "error", Topics: h.topicsOf(client),
+						Error: fmt.Sprintf("invalid replay, must be 0 to %d minutes", maxReplayMinutes)})
+					continue
+				}
+				before := h.topicsOf(client)
+				err := h.subscribe(client, message.Topics)
+				h.remember(client)
+				if err != nil {
+					h.reply(client, topicReply{Type: "error", Topics: h.topicsOf(client), Error: err.Error()})
+					continue
+				}
+				if message.Replay > 0 {
+					h.reply(client, topicReply{Type: "subscribed", Topics: h.topicsOf(client)})
+					h.replay(client, h.added(client, before), message.Replay)
+					continue
+				}
+			case "unsubscribe":
+				h.unsubscribe(client, message.Topics)
+				h.remember(client)
+			case "list":
+			default:
+				h.reply(client, topicReply{Type: "error", Topics: h.topicsOf(client),
+					Error: fmt.Sprintf("unknown message type: %s", message.Type)})
+				continue
+			}
+			h.reply(client, topicReply{Type: "subscribed", Topics: h.topicsOf(client)})
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-client.disconnected:
+			return
+		case message := <-client.sendChannel:
+			if err := client.WritePreparedMessage(message); err != nil {
+				log.Printf("error: websocket write error to %s: %v\n",
+					client.GetRemoteAddr(), err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/journal"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTradesLimit = 1000
+	maxTradesLimit     = 10000
+)
+
+type TradesApi struct {
+	feeds map[string]*ExchangeRunner
+}
+
+func NewTradesApi(feeds map[string]*ExchangeRunner) *TradesApi {
+	return &TradesApi{
+		feeds: feeds,
+	}
+}
+
+func (a *TradesApi) Register(router *mux.Router) {
+	router.HandleFunc("/api/1/{exchange}/trades", a.getTrades).Methods("GET")
+	router.HandleFunc("/api/1/{exchange}/trades/{symbol}", a.getRecentTrades).Methods("GET")
+}
+
+// getRecentTrades returns the most recent trades of a symbol held in
+// memory, which does not require the journal.
+func (a *TradesApi) getRecentTrades(w http.ResponseWriter, r *http.Request) {
+	feed := a.feeds[mux.Vars(r)["exchange"]]
+	if feed == nil {
+		writeJsonError(w, http.StatusNotFound, "unknown exchange")
+		return
+	}
+	limit := 0
+	if value := r.FormValue("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			writeJsonError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+	symbol, ok := symbolParam(w, r, feed)
+	if !ok {
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, feed.RecentTrades().Get(symbol, limit))
+}
+
+// getTrades returns journaled trades in a time range, optionally for a
+// single symbol. The range defaults to the last 5 minutes.
+func (a *TradesApi) getTrades(w http.ResponseWriter, r *http.Request) {
+	feed := a.feeds[mux.Vars(r)["exchange"]]
+	if feed == nil {
+		writeJsonError(w, http.StatusNotFound, "unknown exchange")
+		return
+	}
+	tradeJournal := feed.Journal()
+	if tradeJournal == nil {
+		writeJsonError(w, http.StatusNotFound, "journal not enabled")
+		return
+	}
+
+	to, err := parseTimeParam(r.FormValue("to"), time.Now())
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	from, err := parseTimeParam(r.FormValue("from"), to.Add(-5*time.Minute))
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	limit := defaultTradesLimit
+	if value := r.FormValue("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 || limit > maxTradesLimit {
+			writeJsonError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+	symbol := strings.ToUpper(r.FormValue("symbol"))
+
+	if feed.IsHidden(symbol) {
+		writeJsonError(w, http.StatusNotFound, "unknown symbol")
+		return
+	}
+
+	trades := []pkg.CommonTrade{}
+	err = tradeJournal.ReadTrades(from, to, symbol, func(trade pkg.CommonTrade) error {
+		if feed.IsHidden(trade.Symbol) {
+			return nil
+		}
+		trades = append(trades, trade)
+		if len(trades) >= limit {
+			return journal.ErrStop
+		}
+		return nil
+	})
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, trades)
+}
@@ -0,0 +1,54 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/auth"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/billing"
+	"net/http"
+)
+
+// The usage meter of hosted operators, nil if billing is disabled. Set in
+// ServerMain.
+var usageMeter *billing.Meter
+
+// requestAccount returns the account the usage of a request is metered
+// against, empty if the request is not authenticated.
+func requestAccount(r *http.Request) string {
+	if identity := auth.GetIdentity(r); identity != nil {
+		return identity.Account
+	}
+	return ""
+}
+
+// admitUsage records a new websocket connection against the account of the
+// request, writing an error response if the account is over its hard limit.
+// If admitted the returned function must be called when the connection
+// closes. Unauthenticated connections are not metered.
+func admitUsage(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	account := requestAccount(r)
+	if account == "" {
+		return func() {}, true
+	}
+	release, err := usageMeter.Connect(account)
+	if err != nil {
+		log.Printf("billing: rejecting connection of %s: %v\n", account, err)
+		http.Error(w, err.Error(), http.StatusPaymentRequired)
+		return nil, false
+	}
+	return release, true
+}
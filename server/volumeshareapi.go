@@ -0,0 +1,52 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/volumeshare"
+	"net/http"
+)
+
+// VolumeShareApi serves each exchange's share of the volume of the assets
+// traded on more than one exchange.
+type VolumeShareApi struct {
+	monitor *volumeshare.Monitor
+}
+
+func NewVolumeShareApi(monitor *volumeshare.Monitor) *VolumeShareApi {
+	return &VolumeShareApi{
+		monitor: monitor,
+	}
+}
+
+func (a *VolumeShareApi) Register(router *mux.Router) {
+	router.HandleFunc("/api/1/volumeshare", a.getAll).Methods("GET")
+	router.HandleFunc("/api/1/volumeshare/{asset}", a.getAsset).Methods("GET")
+}
+
+func (a *VolumeShareApi) getAll(w http.ResponseWriter, r *http.Request) {
+	writeJsonResponse(w, http.StatusOK, a.monitor.Shares())
+}
+
+func (a *VolumeShareApi) getAsset(w http.ResponseWriter, r *http.Request) {
+	shares, ok := a.monitor.Asset(mux.Vars(r)["asset"])
+	if !ok {
+		writeJsonError(w, http.StatusNotFound, "asset not traded on more than one exchange")
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, shares)
+}
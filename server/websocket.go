@@ -18,14 +18,26 @@ package server
 import (
 	"github.com/gorilla/websocket"
 	"net/http"
-	"encoding/json"
 	"sync"
 	"strings"
 	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"fmt"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"time"
 )
 
 var wsConnectionTracker *WsConnectionTracker
 
+// The default send queue for websocket clients. A client that falls this many
+// messages behind is disconnected.
+var DefaultWebSocketQueueOptions = pkg.QueueOptions{
+	Size:   16,
+	Policy: pkg.OverflowDisconnect,
+}
+
+// Send queue options for websocket clients, set in ServerMain.
+var webSocketQueueOptions = DefaultWebSocketQueueOptions
+
 func init() {
 	wsConnectionTracker = NewWsConnectionTracker()
 }
@@ -78,19 +90,45 @@ type WebSocketClient struct {
 	// Data written into this Channel will be sent to the client.
 	sendChannel chan *websocket.PreparedMessage
 
-	blocks int
+	// Queue stats for the send channel.
+	stats *pkg.SubscriberStats
+
+	// Serializes writes, as notices may be written from outside the
+	// handler.
+	writeLock sync.Mutex
 
 	done bool
+
+	// The currency to convert prices and volumes to, empty for none.
+	currency string
+
+	// The encoding of messages sent to the client.
+	encoding string
+
+	// The account messages are metered against, empty if not
+	// authenticated.
+	account string
 }
 
 func NewWebSocketClient(c *websocket.Conn, r *http.Request) *WebSocketClient {
-	return &WebSocketClient{
+	client := &WebSocketClient{
 		conn:        c,
-		sendChannel: make(chan *websocket.PreparedMessage),
+		sendChannel: make(chan *websocket.PreparedMessage, webSocketQueueOptions.Size),
 		r:           r,
-		blocks:      0,
 		done:        false,
+		account:     requestAccount(r),
+		encoding:    connEncoding(c, r),
 	}
+	client.stats = pkg.NewSubscriberStats("websocket", client.Name(),
+		webSocketQueueOptions, func() int {
+			return len(client.sendChannel)
+		})
+	return client
+}
+
+// Name identifies the client in subscriber stats.
+func (c *WebSocketClient) Name() string {
+	return fmt.Sprintf("%s %s", hashRemoteHost(c.GetRemoteHost()), c.r.URL.Path)
 }
 
 func (c *WebSocketClient) GetRemoteAddr() string {
@@ -110,15 +148,76 @@ func (c *WebSocketClient) GetRemoteHost() string {
 	return strings.Split(remoteAddr, ":")[0]
 }
 
+// Close releases the client's subscriber stats and closes the connection.
+// It is safe to call more than once.
+func (c *WebSocketClient) Close() {
+	c.stats.Release()
+	c.conn.Close()
+}
+
+// closeWebSockets sends a service restart close message, with the retry
+// after hint if draining, to every connected client and closes the
+// connection, causing the handlers to return. Used on shutdown as the http
+// server does not track upgraded connections.
+func closeWebSockets() {
+	wsConnectionTracker.Lock.RLock()
+	defer wsConnectionTracker.Lock.RUnlock()
+	reason := "server shutting down"
+	if draining, retryAfter := drainState.Draining(); draining {
+		reason = fmt.Sprintf("server restarting, retry after %ds", retrySeconds(retryAfter))
+	}
+	message := websocket.FormatCloseMessage(websocket.CloseServiceRestart, reason)
+	deadline := time.Now().Add(time.Second)
+	for client := range wsConnectionTracker.Clients {
+		client.conn.WriteControl(websocket.CloseMessage, message, deadline)
+		client.Close()
+	}
+	log.Printf("Closed %d websocket connections.\n", len(wsConnectionTracker.Clients))
+}
+
 func (c *WebSocketClient) WriteTextMessage(msg []byte) error {
-	return c.conn.WriteMessage(websocket.TextMessage, msg)
+	return c.WriteMessage(websocket.TextMessage, msg)
+}
+
+func (c *WebSocketClient) WriteMessage(messageType int, msg []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if err := c.conn.WriteMessage(messageType, msg); err != nil {
+		return err
+	}
+	return c.meterDelivered()
+}
+
+func (c *WebSocketClient) WritePreparedMessage(msg *websocket.PreparedMessage) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if err := c.conn.WritePreparedMessage(msg); err != nil {
+		return err
+	}
+	return c.meterDelivered()
+}
+
+// meterDelivered records a delivered message against the client's account.
+// If the account is over its hard limit the client is sent a close message
+// and an error is returned so the handler closes the connection. Must be
+// called with the write lock held.
+func (c *WebSocketClient) meterDelivered() error {
+	if c.account == "" {
+		return nil
+	}
+	if err := usageMeter.Delivered(c.account, 1); err != nil {
+		message := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error())
+		c.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+		return err
+	}
+	return nil
 }
 
 type TickerWebSocketHandler struct {
 	upgrader    websocket.Upgrader
 	clients     map[*WebSocketClient]bool
 	clientsLock sync.RWMutex
-	Feed        *BinanceRunner
+	Feed        *ExchangeRunner
 }
 
 func NewBroadcastWebSocketHandler() *TickerWebSocketHandler {
@@ -128,6 +227,7 @@ func NewBroadcastWebSocketHandler() *TickerWebSocketHandler {
 				return true
 			},
 			EnableCompression: true,
+			Subprotocols:      webSocketSubprotocols,
 		},
 		clients: make(map[*WebSocketClient]bool),
 	}
@@ -136,7 +236,7 @@ func NewBroadcastWebSocketHandler() *TickerWebSocketHandler {
 
 func (h *TickerWebSocketHandler) CloseClient(client *WebSocketClient) {
 	delete(h.clients, client)
-	client.conn.Close()
+	client.Close()
 }
 
 func (h *TickerWebSocketHandler) AddClient(client *WebSocketClient) {
@@ -154,11 +254,33 @@ func (h *TickerWebSocketHandler) Upgrade(w http.ResponseWriter, r *http.Request)
 }
 
 func (h *TickerWebSocketHandler) Handle(w http.ResponseWriter, r *http.Request) {
+	currency := strings.ToUpper(r.FormValue("currency"))
+	if currency != "" && !pkg.IsConversionCurrency(currency) {
+		http.Error(w, fmt.Sprintf("unsupported currency: %s", currency),
+			http.StatusBadRequest)
+		return
+	}
+	if !checkEncodingParam(w, r) {
+		return
+	}
+	if symbol := r.FormValue("symbol"); symbol != "" && h.Feed.IsHidden(symbol) {
+		http.Error(w, "unknown symbol", http.StatusNotFound)
+		return
+	}
+
+	release, ok := floodGuard.Admit(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
 	client, err := h.Upgrade(w, r)
 	if err != nil {
 		log.Printf("Failed to upgrade websocket connection: %v\n", err)
 		return
 	}
+	floodGuard.Configure(client.conn)
+	client.currency = currency
 	h.AddClient(client)
 	log.Printf("WebSocket connnected to %s: RemoteAddr=%v; Origin=%s\n",
 		r.URL.String(),
@@ -175,21 +297,22 @@ func (h *TickerWebSocketHandler) Handle(w http.ResponseWriter, r *http.Request)
 	go h.readLoop(client)
 
 	if symbol != "" {
-		channel := h.Feed.Subscribe(symbol)
+		channel := h.Feed.Subscribe(symbol, client.Name(), webSocketQueueOptions)
 		defer h.Feed.Unsubscribe(symbol, channel)
 		for {
 			if client.done {
 				break
 			}
 			select {
-			case filteredMessage := <-channel:
-				bytes, err := json.Marshal(filteredMessage)
-				if err != nil {
-					log.Printf("failed to marshal filtered ticker: %v\n", err)
-					continue
+			case filteredMessage, ok := <-channel:
+				if !ok {
+					// Disconnected for being too slow.
+					goto Done
 				}
-
-				if err := client.WriteTextMessage(bytes); err != nil {
+				if update, ok := filteredMessage.(map[string]interface{}); ok && client.currency != "" {
+					filteredMessage = h.Feed.Rates().ConvertUpdate(update, client.currency)
+				}
+				if err := writeMessage(client, filteredMessage); err != nil {
 					log.Printf("error: websocket write error to %s: %v\n", client.GetRemoteAddr(), err)
 					goto Done
 				}
@@ -209,7 +332,7 @@ func (h *TickerWebSocketHandler) Handle(w http.ResponseWriter, r *http.Request)
 			if msg == nil {
 				goto Done
 			}
-			if err := client.conn.WritePreparedMessage(msg); err != nil {
+			if err := client.WritePreparedMessage(msg); err != nil {
 				log.Printf("error: websocket write error to %s: %v\n", client.GetRemoteAddr(), err)
 				goto Done
 			}
@@ -223,6 +346,7 @@ Done:
 func (h *TickerWebSocketHandler) readLoop(client *WebSocketClient) {
 	for {
 		if _, _, err := client.conn.ReadMessage(); err != nil {
+			floodGuard.CheckReadError(err)
 			break;
 		}
 	}
@@ -234,29 +358,54 @@ type TickerStream struct {
 	Tickers *[]interface{} `json:"tickers"`
 }
 
-func (h *TickerWebSocketHandler) Broadcast(v *TickerStream) error {
-	buf, err := json.Marshal(v)
-	if err != nil {
-		return err
+func (h *TickerWebSocketHandler) Name() string {
+	return "websocket"
+}
+
+// Send implements pkg.Sink by broadcasting the ticker stream to all
+// connected clients.
+func (h *TickerWebSocketHandler) Send(message interface{}) error {
+	tickerStream, ok := message.(*TickerStream)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", message)
 	}
+	return h.Broadcast(tickerStream)
+}
 
-	preparedMessage, err := websocket.NewPreparedMessage(websocket.TextMessage, buf)
-	if err != nil {
+func (h *TickerWebSocketHandler) Broadcast(v *TickerStream) error {
+	prepared := newPreparedMessages(v)
+	if _, err := prepared.get(EncodingJson); err != nil {
 		log.Printf("error: failed to prepare websocket message: %v\n", err)
 		return err
 	}
 
+	// Messages converted to another currency, only prepared if a client
+	// has requested that currency.
+	convertedMessages := map[string]*preparedMessages{}
+
 	h.clientsLock.RLock()
 	defer h.clientsLock.RUnlock()
 
 	for client := range h.clients {
 		if !client.done {
+			messages := prepared
+			if client.currency != "" {
+				messages = convertedMessages[client.currency]
+				if messages == nil {
+					messages = newPreparedMessages(h.convert(v, client.currency))
+					convertedMessages[client.currency] = messages
+				}
+			}
+			message, err := messages.get(client.encoding)
+			if err != nil {
+				log.Printf("error: failed to prepare %s websocket message: %v\n",
+					client.encoding, err)
+				continue
+			}
 			select {
-			case client.sendChannel <- preparedMessage:
-				client.blocks = 0
+			case client.sendChannel <- message:
 			default:
-				client.blocks += 1
-				if client.blocks == 3 {
+				if client.stats.Overflow() {
 					log.Printf("WebSocket client [%v] appears to be blocked. Dropping.\n",
 						client.GetRemoteAddr())
 					client.done = true
@@ -271,3 +420,15 @@ func (h *TickerWebSocketHandler) Broadcast(v *TickerStream) error {
 
 	return nil
 }
+
+func (h *TickerWebSocketHandler) convert(v *TickerStream, currency string) *TickerStream {
+	rates := h.Feed.Rates()
+	tickers := make([]interface{}, 0, len(*v.Tickers))
+	for _, ticker := range *v.Tickers {
+		if update, ok := ticker.(map[string]interface{}); ok {
+			ticker = rates.ConvertUpdate(update, currency)
+		}
+		tickers = append(tickers, ticker)
+	}
+	return &TickerStream{Tickers: &tickers}
+}
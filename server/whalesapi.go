@@ -0,0 +1,91 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg/whale"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The number of recent whales returned for a symbol by default.
+const defaultWhalesLimit = 100
+
+// WhalesApi serves the whale flow and recent whales of each symbol.
+type WhalesApi struct {
+	feeds map[string]*ExchangeRunner
+}
+
+func NewWhalesApi(feeds map[string]*ExchangeRunner) *WhalesApi {
+	return &WhalesApi{
+		feeds: feeds,
+	}
+}
+
+func (a *WhalesApi) Register(router *mux.Router) {
+	router.HandleFunc("/api/1/{exchange}/whales", a.getAll).Methods("GET")
+	router.HandleFunc("/api/1/{exchange}/whales/{symbol}", a.getSymbol).Methods("GET")
+}
+
+// getAll returns the whale flow of every symbol with whales in the last
+// day.
+func (a *WhalesApi) getAll(w http.ResponseWriter, r *http.Request) {
+	feed := a.feeds[mux.Vars(r)["exchange"]]
+	if feed == nil {
+		writeJsonError(w, http.StatusNotFound, "unknown exchange")
+		return
+	}
+	all := feed.Whales().FlowAll(time.Now())
+	for symbol := range all {
+		if feed.IsHidden(symbol) {
+			delete(all, symbol)
+		}
+	}
+	writeJsonResponse(w, http.StatusOK, all)
+}
+
+func (a *WhalesApi) getSymbol(w http.ResponseWriter, r *http.Request) {
+	feed := a.feeds[mux.Vars(r)["exchange"]]
+	if feed == nil {
+		writeJsonError(w, http.StatusNotFound, "unknown exchange")
+		return
+	}
+	limit := defaultWhalesLimit
+	if value := r.FormValue("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			writeJsonError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+	symbol, ok := symbolParam(w, r, feed)
+	if !ok {
+		return
+	}
+	whales := feed.Whales()
+	flow := whales.Flow(symbol, time.Now())
+	if flow == nil {
+		flow = map[string]whale.Flow{}
+	}
+	writeJsonResponse(w, http.StatusOK, map[string]interface{}{
+		"symbol":    symbol,
+		"threshold": whales.Config().Threshold(symbol),
+		"flow":      flow,
+		"recent":    whales.Recent(symbol, limit),
+	})
+}
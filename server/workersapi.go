@@ -0,0 +1,77 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"gitlab.com/crankykernel/cryptoxscanner/log"
+	"gitlab.com/crankykernel/cryptoxscanner/pkg"
+	"net/http"
+)
+
+// WorkersApi serves the sizes and utilization of the worker pools, and
+// resizes the pools of an exchange while running.
+type WorkersApi struct {
+	feeds map[string]*ExchangeRunner
+}
+
+func NewWorkersApi(feeds map[string]*ExchangeRunner) *WorkersApi {
+	return &WorkersApi{
+		feeds: feeds,
+	}
+}
+
+func (a *WorkersApi) Register(router *mux.Router) {
+	router.HandleFunc("/api/1/workers", a.getAll).Methods("GET")
+	router.HandleFunc("/api/1/{exchange}/workers", a.get).Methods("GET")
+	router.HandleFunc("/api/1/{exchange}/workers", a.set).Methods("PUT")
+}
+
+func (a *WorkersApi) getAll(w http.ResponseWriter, r *http.Request) {
+	writeJsonResponse(w, http.StatusOK, pkg.WorkerPools())
+}
+
+func (a *WorkersApi) get(w http.ResponseWriter, r *http.Request) {
+	feed := a.feeds[mux.Vars(r)["exchange"]]
+	if feed == nil {
+		writeJsonError(w, http.StatusNotFound, "unknown exchange")
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, feed.Workers())
+}
+
+// set resizes the pools given in the body, such as {"decode": 4}.
+func (a *WorkersApi) set(w http.ResponseWriter, r *http.Request) {
+	feed := a.feeds[mux.Vars(r)["exchange"]]
+	if feed == nil {
+		writeJsonError(w, http.StatusNotFound, "unknown exchange")
+		return
+	}
+	var config pkg.WorkersConfig
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := feed.SetWorkers(config); err != nil {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	workers := feed.Workers()
+	log.Printf("%s: workers set to decode %d, metrics %d\n", feed.Name(),
+		workers.Decode, workers.Metrics)
+	writeJsonResponse(w, http.StatusOK, workers)
+}